@@ -24,12 +24,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/spf13/cobra"
 )
 
@@ -46,6 +48,7 @@ var cmdCPUs float64
 var cmdDisk int
 var cmdOvr int
 var cmdPri int
+var cmdDeadline string
 var cmdRet int
 var cmdFile string
 var cmdCwdMatters bool
@@ -71,8 +74,13 @@ var cmdFlavor string
 var cmdQueue string
 var cmdMisc string
 var cmdMonitorDocker string
+var cmdCacheDir string
+var cmdCacheInputs string
+var cmdCacheOutputs string
+var cmdCacheLink bool
 var rtimeoutint int
 var simpleOutput bool
+var cmdDryRun bool
 
 // addCmd represents the add command
 var addCmd = &cobra.Command{
@@ -87,9 +95,10 @@ alternatively have only a JSON object in column 1 that also specifies the
 command as one of the name:value pairs. The possible options are:
 
 cmd cwd cwd_matters change_home on_failure on_success on_exit mounts req_grp
-memory time override cpus disk queue misc priority retries rep_grp dep_grps deps
-cmd_deps monitor_docker cloud_os cloud_username cloud_ram cloud_script
-cloud_config_files cloud_flavor cloud_shared env bsub_mode
+size_hint memory time override cpus disk queue misc priority retries rep_grp
+user dep_grps deps cmd_deps monitor_docker cloud_os cloud_username cloud_ram
+cloud_script cloud_config_files cloud_flavor cloud_shared env bsub_mode
+cache_dir cache_inputs cache_outputs cache_link
 
 If any of these will be the same for all your commands, you can instead specify
 them as flags (which are treated as defaults in the case that they are
@@ -191,6 +200,12 @@ sizes in a certain range, and then provide a req_grp that describes this, eg.
 only learning about how good your estimates are! The name of your executable
 should almost always be part of the req_grp name.)
 
+"size_hint" is an optional number that you expect the memory, disk and time
+requirements of a command to grow with, such as the size in bytes of its input
+file. Once the manager has seen enough commands in a req_grp with a size_hint,
+it will recommend requirements for new commands based on how usage grew with
+size_hint in the past, so you don't need to batch your commands by input size.
+
 "override" defines if your memory, disk or time should be used instead of the
 manager's estimate. Possible values are:
 0 = do not override wr's learned values for memory, disk and time (if any)
@@ -224,12 +239,22 @@ value; do NOT use single quotes within the value. Eg. --misc '-R "foo bar"'.
 priorities will start running before those with lower priorities. The range of
 possible values is 0 (default, for lowest priority) to 255 (highest priority).
 Commands with the same priority will be started in the order they were added.
+If the manager was configured with managerpriorityaging, the priority of
+commands goes up the longer they wait to start, so that low priority commands
+aren't held back forever.
 (Note, however, that order of starting is only guaranteed to hold true amongst
 jobs with similar resource requirements, since your chosen job scheduler may,
 for example, run your highest priority job on a machine where it takes up 90% of
 memory, and then find another job to run on that machine that needs 10% or less
 memory - and that job might be one of your low priority ones.)
 
+"deadline" is when a command must have completed by, either as a date and time
+in RFC 3339 format (eg. 2021-06-01T18:00:00Z) or as a duration from now (eg.
+4h). Commands with a deadline start running before those without, earliest
+deadline minus "time" first, regardless of priority, and runners are created for
+them ahead of others when they must start soon. 'wr status' tells you about
+commands that are predicted to miss their deadline.
+
 "retries" defines how many times a command will be retried automatically if it
 fails. Automatic retries are helpful in the case of transient errors, or errors
 due to running out of memory or time (when retried, they will be retried with
@@ -241,12 +266,19 @@ retry button in the web interface.
 their status later. This is only used for reporting and presentation purposes
 when viewing status.
 
+"user" is who the cost of running a command is charged to, if the manager has
+been configured with managercostrates. It defaults to you, but you could set it
+to eg. the name of a project instead.
+
 "limit_grps" is an array of arbitrary names you can associate with a command,
 that can be used to limit the number of jobs that run at once in the same group.
 You can optionally suffix a group name with :n where n is a integer new limit
 for that group. 0 prevents jobs in that group running at all. -1 makes jobs in
 that group unlimited. If no limit number is suffixed, groups will be unlimited
-until a limit is set with the "wr limit" command.
+until a limit is set with the "wr limit" command. If a command uses more than
+one unit of a group's limit, eg. it opens 4 connections to a server that can
+only handle 20 at once, suffix the group name with *n where n is the number of
+units, before any limit, eg. "bigio*4:20".
 
 "dep_grps" is an array of arbitrary names you can associate with a command, so
 that you can then refer to this job (and others with the same dep_grp) in
@@ -262,6 +294,25 @@ name:value pairs (if cwd doesn't matter for a cmd, provide it as an empty
 string). These are static dependencies; once resolved they do not get re-
 evaluated.
 
+Each dep_grp in "deps" can also be wrapped in a condition: "done(dep_grp)" is
+the same as just "dep_grp"; "failed(dep_grp)" means this command will only start
+once the commands with that dep_grp have all been buried (eg. for cleanup or
+alerting steps; the command will never start if they complete successfully);
+"ended(dep_grp)" means it will start once they have all either completed or been
+buried. Multiple dep_grps (with or without conditions) can be joined with | to
+have this command start when any one of them is satisfied, eg.
+"deps":["ref","failed(align)|ended(qc)"] means start once the ref commands have
+completed, and then as soon as the align commands have all been buried or the qc
+commands have all finished.
+
+If the manager was configured with managerremotes, a dep_grp in "deps" can also
+refer to the commands of one of those other managers, as manager::dep_grp, or to
+a single command of one by its job key (as seen in 'wr status -o d' on that
+manager) as manager::key:JOBKEY. These can also be wrapped in conditions, eg.
+"deps":["failed(prod::align)"]. Such dependencies are satisfied once the other
+manager says its commands have reached the desired states; if it can't be
+contacted, this command keeps waiting and 'wr status -o d' tells you why.
+
 "monitor_docker" turns on monitoring of a docker container identified by the
 given string, which could be the container's --name or path to its --cidfile. If
 the string contains ? or * symbols and doesn't match a name or file name
@@ -318,7 +369,29 @@ machine was started.
 "bsub_mode" is a boolean that results in the job being assigned a unique (for
 this manager session) job id, and turns on bsub emulation, which means that if
 your Cmd calls bsub, it will instead result in a command being added to wr. The
-new job will have this job's mount and cloud_* options.`,
+new job will have this job's mount and cloud_* options.
+
+"cache_dir" turns on memoization of the command's results: it is a directory
+that must be accessible wherever the command runs (eg. on a shared disk, or in
+an S3 bucket you mount). "cache_inputs" are the paths (relative to the actual
+working directory, or absolute) of the files or directories the command reads,
+and "cache_outputs" those of the files or directories it creates. Before the
+command runs, its cmd (and cwd if cwd_matters), env and the content of its
+cache_inputs are looked up in cache_dir. If an identical command previously
+succeeded, its cache_outputs are copied in to place (or symlinked, if
+"cache_link" is true) and the command is marked complete without running; 'wr
+status' will say the results were cached. Otherwise the command runs, and if it
+succeeds its cache_outputs are stored in cache_dir. This lets you use the same
+expensive command (eg. building a reference) in many projects but only run it
+once, even if you don't use --rerun.
+
+With --dry-run, nothing is added. Instead the manager checks your commands as
+it would if adding them (so you get the same errors), and reports how many
+would be added, which are already in the queue or have previously completed
+(which would be skipped unless you use --rerun), which dependencies could not be
+satisfied because no command is in the dep_grp or matches the cmd_deps, and the
+requirements that the commands in each req_grp would actually be scheduled with,
+given the resource usage of previous commands in that req_grp and "override".`,
 	Run: func(combraCmd *cobra.Command, args []string) {
 		// check the command line options
 		if cmdFile == "" {
@@ -342,6 +415,15 @@ new job will have this job's mount and cloud_* options.`,
 			envVars = os.Environ()
 		}
 
+		if cmdDryRun {
+			dr, err := jq.AddDryRun(jobs, !cmdReRun)
+			if err != nil {
+				die("%s", err)
+			}
+			printAddDryRun(dr, !cmdReRun)
+			return
+		}
+
 		// add the jobs to the queue *** should add at most 1,000,000 jobs at a
 		// time to avoid time out issues...
 		if simpleOutput {
@@ -388,10 +470,15 @@ func init() {
 	addCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required (default 0)")
 	addCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
 	addCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
+	addCmd.Flags().StringVar(&cmdDeadline, "deadline", "", "time (RFC 3339) or duration from now by which commands must complete")
 	addCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
 	addCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
-	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
+	addCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\", where each dep_grp can be an expression like \"failed(dep_grp1)|dep_grp2\"")
 	addCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
+	addCmd.Flags().StringVar(&cmdCacheDir, "cache_dir", "", "directory to memoize the results of the commands in")
+	addCmd.Flags().StringVar(&cmdCacheInputs, "cache_inputs", "", "comma-separated paths of the inputs of the commands, for --cache_dir")
+	addCmd.Flags().StringVar(&cmdCacheOutputs, "cache_outputs", "", "comma-separated paths of the outputs of the commands, for --cache_dir")
+	addCmd.Flags().BoolVar(&cmdCacheLink, "cache_link", false, "restore --cache_outputs by symlinking instead of copying")
 	addCmd.Flags().StringVar(&cmdOnFailure, "on_failure", "", "behaviours to carry out when cmds fails, in JSON format")
 	addCmd.Flags().StringVar(&cmdOnSuccess, "on_success", "", "behaviours to carry out when cmds succeed, in JSON format")
 	addCmd.Flags().StringVar(&cmdOnExit, "on_exit", `[{"cleanup":true}]`, "behaviours to carry out when cmds finish running, in JSON format")
@@ -413,6 +500,7 @@ func init() {
 	addCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 	addCmd.Flags().IntVar(&rtimeoutint, "reserve_timeout", 1, "how long (seconds) to wait before a runner exits when there is no more work'")
 	addCmd.Flags().BoolVarP(&simpleOutput, "simple", "s", false, "simplify output to only queued job ids")
+	addCmd.Flags().BoolVar(&cmdDryRun, "dry-run", false, "don't add anything, just report what would happen if you did")
 
 	err := addCmd.Flags().MarkHidden("reserve_timeout")
 	if err != nil {
@@ -420,6 +508,58 @@ func init() {
 	}
 }
 
+// printAddDryRun prints the report of what adding some commands would do.
+func printAddDryRun(dr *jobqueue.AddDryRun, ignoreComplete bool) {
+	fmt.Printf("Would add %d new commands to the queue\n", dr.Added)
+
+	if len(dr.Existing) > 0 {
+		fmt.Printf("\n%d commands are already in the queue (or repeated):\n", len(dr.Existing))
+		for _, cmd := range dr.Existing {
+			fmt.Printf("  %s\n", cmd)
+		}
+	}
+
+	if len(dr.Complete) > 0 {
+		action := "would be run again"
+		if ignoreComplete {
+			action = "would be skipped; use --rerun to run them again"
+		}
+		fmt.Printf("\n%d commands have previously completed (%s):\n", len(dr.Complete), action)
+		for _, cmd := range dr.Complete {
+			fmt.Printf("  %s\n", cmd)
+		}
+	}
+
+	if len(dr.Unsatisfiable) > 0 {
+		fmt.Printf("\n%d dependencies can't be satisfied:\n", len(dr.Unsatisfiable))
+		for _, u := range dr.Unsatisfiable {
+			fmt.Printf("  %s: %s (%s)\n", u.Cmd, u.Dependency, u.Reason)
+		}
+	}
+
+	if len(dr.ReqGroups) > 0 {
+		fmt.Printf("\nRequirements by req_grp:\n")
+		for _, rg := range dr.ReqGroups {
+			fmt.Printf("  %s (%d commands)\n", rg.ReqGroup, rg.Jobs)
+			if rg.Requested == nil {
+				continue
+			}
+			fmt.Printf("    requested: %s\n", dryRunReqString(rg.Requested))
+			if rg.Recommended != nil {
+				fmt.Printf("    recommended: %s\n", dryRunReqString(rg.Recommended))
+			} else {
+				fmt.Printf("    recommended: none, since no commands in this req_grp have run before\n")
+			}
+			fmt.Printf("    effective: %s\n", dryRunReqString(rg.Effective))
+		}
+	}
+}
+
+// dryRunReqString formats requirements like `wr status` does.
+func dryRunReqString(req *jqs.Requirements) string {
+	return fmt.Sprintf("{ memory: %dMB; time: %s; cpus: %s disk: %dGB }", req.RAM, req.Time, strconv.FormatFloat(req.Cores, 'f', -1, 64), req.Disk)
+}
+
 // convert cmd,cwd columns in to Dependency.
 func colsToDeps(cols []string) (deps jobqueue.Dependencies) {
 	for i := 0; i < len(cols); i += 2 {
@@ -428,10 +568,15 @@ func colsToDeps(cols []string) (deps jobqueue.Dependencies) {
 	return
 }
 
-// convert group1,group2,... in to a Dependency.
+// convert group1,group2,... (where each group could be a dependency expression
+// like failed(group)|group2) in to a Dependency.
 func groupsToDeps(groups string) (deps jobqueue.Dependencies) {
-	for _, depgroup := range strings.Split(groups, ",") {
-		deps = append(deps, jobqueue.NewDepGroupDependency(depgroup))
+	for _, expr := range strings.Split(groups, ",") {
+		dep, err := jobqueue.ParseDependency(expr)
+		if err != nil {
+			die(err.Error())
+		}
+		deps = append(deps, dep)
 	}
 	return
 }
@@ -480,6 +625,8 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		Retries:          cmdRet,
 		Env:              cmdEnv,
 		MonitorDocker:    cmdMonitorDocker,
+		CacheDir:         cmdCacheDir,
+		CacheLink:        cmdCacheLink,
 		CloudOS:          cmdOsPrefix,
 		CloudUser:        cmdOsUsername,
 		CloudScript:      cmdPostCreationScript,
@@ -516,10 +663,23 @@ func parseCmdFile(jq *jobqueue.Client, diskSet bool) ([]*jobqueue.Job, bool, boo
 		}
 	}
 
+	jd.Deadline, err = jobqueue.ParseDeadline(cmdDeadline)
+	if err != nil {
+		die("--deadline was not specified correctly: %s", err)
+	}
+
 	if cmdLimitGroups != "" {
 		jd.LimitGroups = strings.Split(cmdLimitGroups, ",")
 	}
 
+	if cmdCacheInputs != "" {
+		jd.CacheInputs = strings.Split(cmdCacheInputs, ",")
+	}
+
+	if cmdCacheOutputs != "" {
+		jd.CacheOutputs = strings.Split(cmdCacheOutputs, ",")
+	}
+
 	if cmdDepGroups != "" {
 		jd.DepGroups = strings.Split(cmdDepGroups, ",")
 	}
@@ -0,0 +1,175 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var budgetName string
+var budgetRepGroup string
+var budgetUser string
+var budgetLimit float64
+var budgetUnit string
+var budgetWarnAt float64
+var budgetRemove bool
+
+// budgetCmd represents the budget command
+var budgetCmd = &cobra.Command{
+	Use:   "budget",
+	Short: "Cap spending on the commands of a rep_grp or user",
+	Long: `Budgets limit how much can be spent running commands, to stop a
+mistake or a runaway workflow from using far more compute than intended.
+
+A budget covers either the commands in rep_grps that start with a certain
+prefix (--rep_grp), or the commands charged to a certain user (--user), and has
+a limit (-l) in one of these units (-u):
+  "cost" (the default) is in the units of the manager's managercostrates
+  "corehours" is hours of reserved cores, which works without cost rates.
+
+Spending is the total cost or core-hours that the manager has recorded for the
+covered commands each time they finished running.
+
+When spending reaches a fraction (--warn, default 0.8) of a budget's limit, a
+warning appears amongst the scheduler messages (as seen on the status web
+page). When it reaches the limit, a further message is given and no more
+commands covered by the budget will be started: they stay pending, and
+'wr status' shows that they are being held back. Commands that were already
+running are allowed to finish.
+
+A limit of 0 stops any more covered commands from starting, regardless of
+spending.
+
+To let them run, raise the limit by setting the budget again with the same name
+(-n) and a higher -l, or remove the budget with --remove.
+
+Supplying no options lists all budgets along with how much of each has been
+spent. Supplying just -n shows that budget.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			die("Did you mean to specify --name?")
+		}
+
+		setting := cmd.Flags().Changed("limit")
+		if (setting || budgetRemove) && budgetName == "" {
+			die("-n is required to set or remove a budget")
+		}
+		if setting && budgetRemove {
+			die("-l and --remove are mutually exclusive")
+		}
+		if !setting && (budgetRepGroup != "" || budgetUser != "" || cmd.Flags().Changed("unit") || cmd.Flags().Changed("warn")) {
+			die("--rep_grp, --user, -u and --warn only apply when setting a budget with -l")
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case budgetRemove:
+			var removed int
+			removed, err = jq.RemoveBudget(budgetName)
+			if err != nil {
+				die("failed to remove budget: %s", err)
+			}
+			if removed == 0 {
+				die("there is no budget named %s", budgetName)
+			}
+			info("Removed budget %s", budgetName)
+		case setting:
+			var status *jobqueue.BudgetStatus
+			status, err = jq.SetBudget(&jobqueue.Budget{
+				Name:     budgetName,
+				RepGroup: budgetRepGroup,
+				User:     budgetUser,
+				Limit:    budgetLimit,
+				Unit:     budgetUnit,
+				WarnAt:   budgetWarnAt,
+			})
+			if err != nil {
+				die("failed to set budget: %s", err)
+			}
+			printBudgets([]*jobqueue.BudgetStatus{status})
+		default:
+			var statuses []*jobqueue.BudgetStatus
+			statuses, err = jq.GetBudgets(budgetName)
+			if err != nil {
+				die("failed to get budgets: %s", err)
+			}
+			if budgetName != "" && len(statuses) == 0 {
+				die("there is no budget named %s", budgetName)
+			}
+			printBudgets(statuses)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(budgetCmd)
+
+	// flags specific to this sub-command
+	budgetCmd.Flags().StringVarP(&budgetName, "name", "n", "", "name of the budget to view, set or remove")
+	budgetCmd.Flags().StringVarP(&budgetRepGroup, "rep_grp", "r", "", "the budget covers commands in rep_grps starting with this")
+	budgetCmd.Flags().StringVar(&budgetUser, "user", "", "the budget covers commands charged to this user")
+	budgetCmd.Flags().Float64VarP(&budgetLimit, "limit", "l", 0, "how much can be spent before no more commands are started")
+	budgetCmd.Flags().StringVarP(&budgetUnit, "unit", "u", jobqueue.BudgetUnitCost, "['cost','corehours'] the unit of -l")
+	budgetCmd.Flags().Float64Var(&budgetWarnAt, "warn", jobqueue.BudgetWarnAt, "fraction of -l spent before a warning is given")
+	budgetCmd.Flags().BoolVar(&budgetRemove, "remove", false, "remove the -n budget")
+
+	budgetCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// printBudgets prints the given budgets as a table.
+func printBudgets(statuses []*jobqueue.BudgetStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 2, 2, 3, ' ', 0)
+	fmt.Fprintf(w, "name\tcovers\tlimit\tunit\tspent\tstate\n")
+	for _, bs := range statuses {
+		covers := "rep_grp " + bs.Budget.RepGroup + "*"
+		if bs.Budget.RepGroup == "" {
+			covers = "user " + bs.Budget.User
+		}
+
+		state := "ok"
+		switch {
+		case bs.Exceeded:
+			state = "exceeded"
+		case bs.Warned:
+			state = "warning"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%g\t%s\t%s\t%s\n", bs.Budget.Name, covers, bs.Budget.Limit, bs.Budget.Unit, formatCost(bs.Spent), state)
+	}
+	err := w.Flush()
+	if err != nil {
+		warn("failed to flush output: %s", err)
+	}
+}
@@ -146,6 +146,128 @@ managerdbfile: "db"
 # usage.
 managerdbbkfile: "db_bk"
 
+# managerdbbkgens: How many timestamped generations of the database backup
+# should wr manager keep?
+# This defaults to 0, meaning only the latest backup is kept.
+#
+# If you set this to a number greater than 0, then after a backup, if at least
+# managerdbbkgenmins minutes have passed since the last generation was made, the
+# backup is also copied to managerdbbkfile with a .YYYYMMDDTHHMMSSZ suffix, and
+# the oldest generations are deleted so that only this many are kept. You can
+# then use 'wr manager restore --at' to roll back to before some mistake, such as
+# a bad mass 'wr remove'. Each generation is the full size of a backup.
+managerdbbkgens: 0
+
+# managerdbbkgenmins: How many minutes must pass between backup generations?
+# See managerdbbkgens.
+managerdbbkgenmins: 60
+
+# managerdbretention: When should wr manager delete old data from its database?
+# This defaults to "", meaning everything is kept forever.
+#
+# Otherwise, set this to semicolon separated rules like
+# what:age[:repgroup_regexp], where what is "std" (the stdout and stderr kept
+# for failed commands) or "jobs" (completed commands), age is a duration like
+# "720h" or a number of days like "30d", and the optional regular expression
+# restricts the rule to commands with matching report groups. For example:
+# "std:30d;jobs:365d:^tmp_" deletes the stdout/err of commands 30 days after
+# they last exited, and completed commands with report groups starting "tmp_"
+# after a year. Commands still in the queue are never deleted, and the stats
+# used to recommend the memory, disk and time of future commands are kept.
+#
+# Rules are applied when the manager starts and then hourly. The database file
+# does not shrink when data is deleted; use 'wr manager compact' to reclaim the
+# space.
+managerdbretention: ""
+
+# managerrecmbround: What should learned memory and disk requirements be rounded
+# up to, in MB?
+# This defaults to 100.
+#
+# wr manager learns how much memory, disk and time the commands in each req_grp
+# use, and reserves that much for future commands, rounded up so that commands
+# with similar requirements can be run by the same runners.
+managerrecmbround: 100
+
+# managerrecsecround: What should learned time requirements be rounded up to, in
+# seconds?
+# This defaults to 1. See managerrecmbround.
+managerrecsecround: 1
+
+# managerrechalflife: After how many days should old commands count for half as
+# much when learning requirements?
+# This defaults to 30, so that if your commands start needing less memory, say
+# after you improve your software, wr manager will learn that in a few months.
+# Set this to 0 to have all past commands count the same.
+managerrechalflife: 30
+
+# managerpriorityaging: Should low priority commands eventually run even while
+# higher priority ones keep being added?
+# This defaults to 0, meaning commands always run in order of priority.
+#
+# Otherwise, set this to a number of minutes; the priority of commands that are
+# ready to run goes up by 1 every that many minutes they spend waiting. For
+# example, with 1 a priority 0 command that has been waiting for over 100
+# minutes will run before a priority 100 command that was just added.
+managerpriorityaging: 0
+
+# managercostrates: How much does it cost to run commands?
+# This defaults to "", meaning costs are not worked out.
+#
+# Otherwise, set this to comma separated prices like name:price, where name is
+# "core" (the price of reserving a CPU core for an hour), "gb" (the price of
+# reserving a GB of memory for an hour) or the name of a cloud server flavor
+# (the price of running a server of that flavor for an hour). For example:
+# "core:0.02,gb:0.005,m1.large:0.3". Commands that ran on a server of a priced
+# flavor cost their share of the server (the greater of the fraction of its
+# cores and of its memory they reserved), while others cost the cores and memory
+# they reserved. The cost of each command is shown by 'wr status', and totals per
+# report group and user are in 'wr status -o s' and the web interface.
+managercostrates: ""
+
+# managerprotectors: What limited resources should commands be able to request
+# tokens for?
+# This defaults to "", meaning there are no protected resources.
+#
+# Otherwise, set this to comma separated resources like
+# name:max[:delay[:timeout]], where max is the most tokens that can be in use
+# at once, delay is the minimum time between granting tokens (default 0s) and
+# timeout is how long granted tokens can go without being touched before they
+# are released (default 5m). For example: "irods:20:100ms:10m,db:5". Commands
+# can then use 'wr token acquire' and 'wr token release' around the parts that
+# use the resource.
+managerprotectors: ""
+
+# managerremotes: What other wr managers should jobs be able to depend on the
+# jobs of?
+# This defaults to "", meaning jobs can only depend on jobs of this manager.
+#
+# Otherwise, set this to comma separated managers like name:deployment, to
+# connect to the manager of that deployment the same way wr client commands on
+# this machine would (eg. "prod:production"), or name:host:port:dir[:domain],
+# where dir is a directory containing that manager's ca.pem and client.token
+# (eg. a copy of its ~/.wr_production directory) and domain is the domain its
+# certificate is valid for (default localhost). For example:
+# "prod:production,teamb:farm5:46123:/shared/teamb_wr:farm5.internal". Jobs can
+# then be added with dependencies like "prod::dep_grp" or "prod::key:JOBKEY",
+# and this manager will periodically ask the named manager if they have been
+# satisfied. If a manager can't be reached, its dependent jobs keep waiting, and
+# the problem is logged and shown by 'wr status -o d'.
+managerremotes: ""
+
+# managerdbbackend: What kind of database file should wr manager use?
+# This defaults to "bolt", a fast embedded key/value store.
+#
+# Alternatively set this to "sqlite" to use an SQLite database instead, which
+# lets you query wr's history with SQL (jobs are stored as JSON, so you can use
+# eg. json_extract(CAST(v AS TEXT), '$.Cmd') on the jobscomplete table). It also
+# doesn't suffer from bolt's file growth with a single writer, which may suit
+# very large histories.
+#
+# The backend can't be changed for an existing database file: if you change
+# this, also change managerdbfile and managerdbbkfile to new locations.
+managerdbbackend: "bolt"
+
 # managertokenfile: Where should the manager store the authentication token?
 # This defaults to a file named "client.token" in managerdir.
 #
@@ -281,6 +403,16 @@ manageruploaddir: "uploads"
 # recommended.
 runnerexecshell: "bash"
 
+# runnerbatchsize: How many commands should runners reserve at once?
+# This defaults to 1, so that each runner reserves 1 command at a time.
+#
+# If you run millions of commands that only take a few seconds each, the time
+# spent communicating with wr manager can dominate. Set this higher to have
+# runners reserve up to that many commands (with the same requirements) at once,
+# run them one after the other, and then report the successful ones back to wr
+# manager in one go.
+runnerbatchsize: 1
+
 # privatekeypath: path to your private key.
 # This defaults to ~/.ssh/id_rsa.
 #
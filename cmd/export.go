@@ -0,0 +1,168 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var exportFormat string
+var exportOutput string
+var exportRepGroup string
+var exportSince string
+var exportUntil string
+var exportLive bool
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the history of commands for analysis",
+	Long: `Export the details of commands that have run, for analysis by other tools.
+
+For each command that completed, in the order they finished running, you get its
+key (internal job id), report group, requirements group, limit groups, command
+line and working directory, state, exit code, failure reason, number of
+attempts, the host it ran on (name, id and IP), its resource requirements
+(memory in MB, time in seconds, cores and disk in GB), its peak memory and disk
+usage (in MB), CPU and wall time (in seconds), its start and end times
+(RFC3339, UTC), its size hint, the user it is charged to and its cost (if the
+manager was configured with cost rates). The columns are named key, rep_group,
+req_group, limit_groups, cmd, cwd, state, exit_code, fail_reason, attempts,
+host, host_id, host_ip, req_memory_mb, req_time_secs, req_cores, req_disk_gb,
+peak_memory_mb, peak_disk_mb, cpu_time_secs, wall_time_secs, start_time,
+end_time, size_hint, user and cost.
+
+The output can be given to "wr reqs --seed" to seed another manager's learned
+resource requirements.
+
+With --live, commands that are still in the queue but have exited at least once
+(eg. those that are buried or are awaiting a retry) are also exported, based on
+their most recent exit. Commands that have never exited (those that are pending,
+ready or running for the first time) are never exported, even with --live,
+since there is nothing to analyse about them yet.
+
+There are 3 formats to choose from with -f:
+  "csv" outputs a header line followed by one line per command.
+  "jsonl" outputs one JSON object per line, per command.
+  "sqlite" creates a new SQLite database with a single "jobs" table containing
+    one row per command. For this format you must specify a file that does not
+    already exist with -o.
+
+By default output is to STDOUT; use -o to write to a file instead.
+
+You can restrict the export to commands in a particular report group with -i,
+and to commands that finished running in a particular time range with --since
+and --until. These take dates (eg. 2021-06-29), date-times (eg.
+2021-06-29T15:04 or RFC3339 format), or durations (eg. 24h) meaning that long
+ago.
+
+Commands are retrieved from the manager in batches and written out as they are
+received, so you can export millions of commands without using lots of memory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		format := jobqueue.ExportFormat(exportFormat)
+		switch format {
+		case jobqueue.ExportFormatCSV, jobqueue.ExportFormatJSONL:
+		case jobqueue.ExportFormatSQLite:
+			if exportOutput == "" || exportOutput == "-" {
+				die("-o must be supplied when using -f sqlite")
+			}
+		default:
+			die("invalid -f format specified")
+		}
+
+		js := &jobqueue.JobSearch{
+			RepGroup: exportRepGroup,
+			Complete: !exportLive,
+		}
+
+		var err error
+		if exportSince != "" {
+			js.Since, err = internal.ParseTimeOrAgo(exportSince)
+			if err != nil {
+				die("--since was invalid: %s", err)
+			}
+		}
+		if exportUntil != "" {
+			js.Until, err = internal.ParseTimeOrAgo(exportUntil)
+			if err != nil {
+				die("--until was invalid: %s", err)
+			}
+		}
+
+		var w io.Writer = os.Stdout
+		if format != jobqueue.ExportFormatSQLite && exportOutput != "" && exportOutput != "-" {
+			var f *os.File
+			f, err = os.Create(exportOutput)
+			if err != nil {
+				die("could not create output file: %s", err)
+			}
+			defer func() {
+				err = f.Close()
+				if err != nil {
+					warn("failed to close output file: %s", err)
+				}
+			}()
+			w = f
+		}
+
+		exporter, err := jobqueue.NewJobExporter(format, w, exportOutput)
+		if err != nil {
+			die("could not start the export: %s", err)
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		err = jq.ExportHistory(js, exporter)
+		errc := exporter.Close()
+		if err != nil {
+			die("failed to export commands: %s", err)
+		}
+		if errc != nil {
+			die("failed to finish the export: %s", errc)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+
+	// flags specific to this sub-command
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "csv", "['csv','jsonl','sqlite'] output format")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write to; - or unset means STDOUT")
+	exportCmd.Flags().StringVarP(&exportRepGroup, "identifier", "i", "", "only export commands with this report group")
+	exportCmd.Flags().StringVar(&exportSince, "since", "", "only export commands that exited at or after this date, time or duration ago")
+	exportCmd.Flags().StringVar(&exportUntil, "until", "", "only export commands that exited at or before this date, time or duration ago")
+	exportCmd.Flags().BoolVar(&exportLive, "live", false, "also export commands that are still in the queue but have exited at least once")
+
+	exportCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
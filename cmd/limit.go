@@ -23,11 +23,15 @@ import (
 	"sort"
 	"time"
 
+	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/spf13/cobra"
 )
 
 // options for this cmd
 var limitGroup string
+var limitProbe string
+var limitProbeTTL int
+var limitUnprobe bool
 
 // limitCmd represents the remove command
 var limitCmd = &cobra.Command{
@@ -46,7 +50,7 @@ same time. This limit command can be used to change the limit afterwards.
 
 Passing just a group name to -g will display the current limit of that limit
 group. Groups that are not known about will report -1. Limit group names should
-not contain commas or colons.
+not contain commas, colons or asterisks.
 
 Suffixing the name with :n, where n is an integer, will set the group's limit to
 that number.
@@ -54,11 +58,40 @@ that number.
 Setting a limit of 0 stops any more jobs in that group from running. Setting a
 limit of -1 makes that group unlimited.
 
-Supplying no options lists all limits that are currently in place.`,
+Groups can also be rate limited, so that no more than a certain number of their
+jobs start within a period of time, regardless of how many are running. Suffix
+the name with :c/d, where c is an integer count and d is a duration like 30s, 1m
+or 1h, either instead of or after the :n limit. Eg. "irods:50:100/1m" would
+let no more than 50 jobs in the irods group run at once, and no more than 100
+of them start within any minute. "irods:100/1m" would only limit the rate.
+Setting just :n removes any rate limit.
+
+Jobs normally use 1 unit of each of their limit groups, but can be added with a
+weight to use more (see "wr add -h"). Eg. only 5 jobs added with the group
+"bigio*4" could run at once if the "bigio" group had a limit of 20.
+
+Instead of setting a fixed limit, you can have the manager work out the limit
+of a group itself, by supplying --probe with a shell command (run on the
+manager's host) or an http:// or https:// URL, that outputs or returns an
+integer that should be the group's limit, eg. the number of free connections
+to a shared server. The probe is run straight away in the background (run this
+command with no options to see what it found), then again every --ttl seconds,
+setting the group's limit to the probed number each time, so that the
+number of running jobs adapts to the load on the shared resource. If a probe
+fails, the group keeps its previous limit. Setting the limit of a probed group
+using :n only lasts until the next probe. Use --unprobe to stop probing a group,
+which will keep the limit it last probed.
+
+Supplying no options lists all limits that are currently in place, along with
+how many units of each group are being used by running jobs, followed by any
+probes.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) > 0 {
 			die("Did you mean to specify --group?")
 		}
+		if limitGroup == "" && (limitProbe != "" || limitUnprobe) {
+			die("--probe and --unprobe need a --group")
+		}
 
 		timeout := time.Duration(timeoutint) * time.Second
 		jq := connect(timeout)
@@ -77,6 +110,18 @@ Supplying no options lists all limits that are currently in place.`,
 				die(err.Error())
 			}
 
+			var rates map[string]string
+			rates, err = jq.GetLimitGroupRates()
+			if err != nil {
+				die(err.Error())
+			}
+
+			var usage map[string]int
+			usage, err = jq.GetLimitGroupUsage()
+			if err != nil {
+				die(err.Error())
+			}
+
 			keys := make([]string, 0, len(limits))
 			for key := range limits {
 				keys = append(keys, key)
@@ -84,12 +129,51 @@ Supplying no options lists all limits that are currently in place.`,
 			sort.Strings(keys)
 
 			for _, key := range keys {
-				fmt.Printf("%s: %d\n", key, limits[key])
+				if rate, exists := rates[key]; exists {
+					fmt.Printf("%s: %d (%s); %d in use\n", key, limits[key], rate, usage[key])
+					continue
+				}
+				fmt.Printf("%s: %d; %d in use\n", key, limits[key], usage[key])
+			}
+
+			var probes []*jobqueue.LimitGroupProbeStatus
+			probes, err = jq.GetLimitGroupProbes("")
+			if err != nil {
+				die(err.Error())
+			}
+			for _, status := range probes {
+				printLimitGroupProbe(status)
 			}
 
 			return
 		}
 
+		switch {
+		case limitUnprobe:
+			var removed int
+			removed, err = jq.RemoveLimitGroupProbe(limitGroup)
+			if err != nil {
+				die(err.Error())
+			}
+			if removed == 0 {
+				die("limit group %s had no probe", limitGroup)
+			}
+			info("Stopped probing the limit of %s", limitGroup)
+			return
+		case limitProbe != "":
+			var status *jobqueue.LimitGroupProbeStatus
+			status, err = jq.SetLimitGroupProbe(&jobqueue.LimitGroupProbe{
+				Group: limitGroup,
+				Probe: limitProbe,
+				TTL:   time.Duration(limitProbeTTL) * time.Second,
+			})
+			if err != nil {
+				die(err.Error())
+			}
+			printLimitGroupProbe(status)
+			return
+		}
+
 		limit, err := jq.GetOrSetLimitGroup(limitGroup)
 		if err != nil {
 			die(err.Error())
@@ -102,5 +186,23 @@ func init() {
 	RootCmd.AddCommand(limitCmd)
 
 	// flags specific to this sub-command
-	limitCmd.Flags().StringVarP(&limitGroup, "group", "g", "", "name of the limit group to view, suffixed with :n to set limit")
+	limitCmd.Flags().StringVarP(&limitGroup, "group", "g", "", "name of the limit group to view, suffixed with :n and/or :c/d to set limit and rate")
+	limitCmd.Flags().StringVarP(&limitProbe, "probe", "p", "", "command or URL that outputs the limit of the --group")
+	limitCmd.Flags().IntVar(&limitProbeTTL, "ttl", int(jobqueue.LimitGroupProbeTTL.Seconds()), "seconds between runs of the --probe")
+	limitCmd.Flags().BoolVar(&limitUnprobe, "unprobe", false, "stop probing the limit of the --group")
+}
+
+// printLimitGroupProbe prints out the details of a limit group probe.
+func printLimitGroupProbe(status *jobqueue.LimitGroupProbeStatus) {
+	probe := status.Probe
+	fmt.Printf("%s: probed every %s with %s; ", probe.Group, probe.TTL, probe.Probe)
+	if status.Probed.IsZero() {
+		fmt.Printf("not yet probed")
+	} else {
+		fmt.Printf("limit %d at %s", status.Limit, status.Probed.Format(time.RFC3339))
+	}
+	if status.Err != "" {
+		fmt.Printf(" (last probe failed: %s)", status.Err)
+	}
+	fmt.Printf("\n")
 }
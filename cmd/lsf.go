@@ -74,10 +74,22 @@ nothing about the cloud to distribute their workload in that cloud environment.
 
 NB: currently the emulation is extremely limited, supporting only the
 interactive "console" mode where you run bsub without any arguments, and it only
-supports single flags per #BSUB line, and it only pays attention to -J, -n and
--M flags. (This is sufficient for compatibility with 10x Genomic's cellranger
-software (which has Martian built in), and to work as the scheduler for
-nextflow in LSF mode.) There is only one "queue", called 'wr'.
+supports single flags per #BSUB line, and it only pays attention to -J, -n, -M
+and -w flags. (This is sufficient for compatibility with 10x Genomic's
+cellranger software (which has Martian built in), and to work as the scheduler
+for nextflow in LSF mode.) There is only one "queue", called 'wr'.
+
+-w dependency expressions can use the done(), exit() and ended() conditions
+(without exit codes or operators) on job names given to -J, or on job ids,
+combined with && and ||. Where both are used, || terms must be grouped in
+parentheses, eg. "done(align) && (exit(qc) || ended(stats))". A bare job name or
+id is treated as done(). A done() or ended() condition on the id of a job that
+is no longer in the queue (because it completed) is already satisfied.
+
+Jobs given a name with -J are put in a dependency group of that name (as with
+'wr add --dep_grps'), so that other jobs can depend on them by name. Like any
+dependency group, this means that adding a new job with the same name later
+causes any completed jobs that depended on that name to be re-run.
 
 The best way to use this LSF emulation is not to call this command yourself
 directly, but to use 'wr add --bsubs [other opts]' to add the command that you
@@ -128,6 +140,7 @@ var lsfBsubCmd = &cobra.Command{
 		fmt.Printf("bsub> ")
 		scanner := bufio.NewScanner(os.Stdin)
 		var possibleExe string
+		var depExpr string
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 
@@ -139,6 +152,9 @@ var lsfBsubCmd = &cobra.Command{
 					switch matches[1] {
 					case "J":
 						job.RepGroup = matches[2]
+						job.DepGroups = []string{matches[2]}
+					case "w":
+						depExpr = matches[2]
 					case "n":
 						if n, err := strconv.ParseFloat(matches[2], 64); err == nil {
 							job.Requirements.Cores = n
@@ -186,6 +202,15 @@ var lsfBsubCmd = &cobra.Command{
 			}
 		}()
 
+		if depExpr != "" {
+			job.Dependencies, err = bsubDependencies(depExpr, func() ([]*jobqueue.Job, error) {
+				return jq.GetIncomplete(0, "", false, false)
+			})
+			if err != nil {
+				die("%s. Job not submitted.", err)
+			}
+		}
+
 		// add the job to the queue
 		inserts, _, err := jq.Add([]*jobqueue.Job{job}, os.Environ(), false)
 		if err != nil {
@@ -464,6 +489,87 @@ func init() {
 	lsfBjobsCmd.Flags().StringVarP(&lsfQueue, "queue", "q", "wr", "queue")
 }
 
+// bsubLSFConditions maps the bsub -w conditions we support to their
+// jobqueue.DependencyCondition.
+var bsubLSFConditions = map[string]jobqueue.DependencyCondition{
+	"done":  jobqueue.DependencyOnSuccess,
+	"exit":  jobqueue.DependencyOnFailure,
+	"ended": jobqueue.DependencyOnEnd,
+}
+
+// bsubDependencies converts a bsub -w dependency expression in to Dependencies.
+// Job names are treated as DepGroups (since bsub -J sets that), while job ids
+// are looked up amongst the jobs returned by getIncomplete. Ids not found there
+// belong to jobs that already completed, so done() and ended() terms on them
+// are already satisfied.
+func bsubDependencies(expr string, getIncomplete func() ([]*jobqueue.Job, error)) (jobqueue.Dependencies, error) {
+	expr = strings.Trim(strings.TrimSpace(expr), `"'`)
+	termRegex := regexp.MustCompile(`^(\w+)\(\s*([^(),\s]+)\s*\)$`)
+	var idToEssence map[string]*jobqueue.JobEssence
+
+	var deps jobqueue.Dependencies
+	for _, clause := range strings.Split(expr, "&&") {
+		clause = strings.TrimSpace(clause)
+		if strings.HasPrefix(clause, "(") && strings.HasSuffix(clause, ")") && !termRegex.MatchString(clause) {
+			clause = strings.TrimSpace(clause[1 : len(clause)-1])
+		}
+
+		var alts jobqueue.Dependencies
+		var satisfied bool
+		for _, term := range strings.Split(clause, "||") {
+			term = strings.TrimSpace(term)
+			name, on := term, jobqueue.DependencyOnSuccess
+			if matches := termRegex.FindStringSubmatch(term); matches != nil {
+				var supported bool
+				on, supported = bsubLSFConditions[matches[1]]
+				if !supported {
+					return nil, fmt.Errorf("dependency condition %s() is not supported", matches[1])
+				}
+				name = matches[2]
+			}
+			if name == "" || strings.ContainsAny(name, "()&|, ") {
+				return nil, fmt.Errorf("dependency condition syntax error in [%s]", expr)
+			}
+
+			dep := &jobqueue.Dependency{DepGroup: name, On: on}
+			if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+				if idToEssence == nil {
+					jobs, errg := getIncomplete()
+					if errg != nil {
+						return nil, errg
+					}
+					idToEssence = make(map[string]*jobqueue.JobEssence)
+					for _, job := range jobs {
+						if job.BsubID != 0 {
+							idToEssence[strconv.Itoa(int(job.BsubID))] = job.ToEssense()
+						}
+					}
+				}
+				essence, found := idToEssence[name]
+				if !found {
+					if on == jobqueue.DependencyOnFailure {
+						return nil, fmt.Errorf("dependency job <%s> not found or has already completed", name)
+					}
+					satisfied = true
+					continue
+				}
+				dep = &jobqueue.Dependency{Essence: essence, On: on}
+			}
+			alts = append(alts, dep)
+		}
+
+		switch {
+		case satisfied:
+			continue
+		case len(alts) == 1:
+			deps = append(deps, alts[0])
+		default:
+			deps = append(deps, &jobqueue.Dependency{AnyOf: alts})
+		}
+	}
+	return deps, nil
+}
+
 // filterGoFlags splits lsf args, which use single dash named args, from wr
 // args, which use single dash to mean a set of shorthand flags.
 func filterGoFlags(args []string, prefixes map[string]bool) ([]string, []string) {
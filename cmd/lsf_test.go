@@ -0,0 +1,71 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBsubDependencies(t *testing.T) {
+	Convey("Given a queue holding an incomplete bsub job", t, func() {
+		running := &jobqueue.Job{Cmd: "echo running", Cwd: "/tmp", BsubID: 2}
+		getIncomplete := func() ([]*jobqueue.Job, error) {
+			return []*jobqueue.Job{running}, nil
+		}
+
+		Convey("You can depend on it and on job names", func() {
+			deps, err := bsubDependencies(`"done(2) && (exit(qc) || ended(stats))"`, getIncomplete)
+			So(err, ShouldBeNil)
+			So(len(deps), ShouldEqual, 2)
+			So(deps[0].Essence, ShouldResemble, running.ToEssense())
+			So(deps[0].On, ShouldEqual, jobqueue.DependencyOnSuccess)
+			So(len(deps[1].AnyOf), ShouldEqual, 2)
+			So(deps[1].AnyOf[0].DepGroup, ShouldEqual, "qc")
+			So(deps[1].AnyOf[0].On, ShouldEqual, jobqueue.DependencyOnFailure)
+			So(deps[1].AnyOf[1].DepGroup, ShouldEqual, "stats")
+			So(deps[1].AnyOf[1].On, ShouldEqual, jobqueue.DependencyOnEnd)
+		})
+
+		Convey("Depending on a job that finished before submission is already satisfied", func() {
+			deps, err := bsubDependencies("done(1) && running", getIncomplete)
+			So(err, ShouldBeNil)
+			So(len(deps), ShouldEqual, 1)
+			So(deps[0].DepGroup, ShouldEqual, "running")
+
+			deps, err = bsubDependencies("ended(1)", getIncomplete)
+			So(err, ShouldBeNil)
+			So(len(deps), ShouldEqual, 0)
+
+			deps, err = bsubDependencies("done(2) || done(1)", getIncomplete)
+			So(err, ShouldBeNil)
+			So(len(deps), ShouldEqual, 0)
+
+			_, err = bsubDependencies("exit(1)", getIncomplete)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unsupported conditions are rejected", func() {
+			_, err := bsubDependencies("started(2)", getIncomplete)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
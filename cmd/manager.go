@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -59,6 +60,12 @@ var cloudNoSecurityGroups bool
 var cloudUseConfigDrive bool
 var useCertDomain bool
 var runnerDebug bool
+var standbyOf string
+var standbyTimeout int
+var restoreFrom string
+var restoreAt string
+var restoreDryRun bool
+var restoreList bool
 
 const kubernetes = "kubernetes"
 const deadlockTimeout = 5 * time.Minute
@@ -137,17 +144,47 @@ you've created yourself, note that --local_username will need to be globally
 unique, since it is used to name the private key that will be created in
 OpenStack, and if a key with that name already exists, the manager will not be
 able to create a new one (or get the existing one), and so will not function
-fully.`,
+fully.
+
+To protect against the manager's host dying, you can start a hot standby
+manager on another host with --standby-of, supplying the host:port of the
+running (primary) manager. The standby needs the same config, certificates and
+client.token file as the primary. It continuously receives a copy of the
+primary's database (including the state of all incomplete commands), and if the
+primary stops responding for --standby-timeout seconds (which includes the
+primary being stopped or drained), it takes over by starting to serve on our
+configured port. Combine with --set_domain_ip (to point your cert domain at the
+standby's host) and --use_cert_domain (on the primary and standby), so that
+clients and runners reconnect to the new manager and carry on. Standbys are
+only supported in production deployments, since development deployments start
+with a fresh database.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// first we need our working directory to exist
 		createWorkingDir()
 
-		// check to see if the manager is already running (regardless of the
-		// state of the pid file), giving us a meaningful error message in the
-		// most obvious case of failure to start
-		jq := connect(1*time.Second, true)
-		if jq != nil {
-			die("wr manager on port %s is already running (pid %d)", config.ManagerPort, jq.ServerInfo.PID)
+		if _, err := jobqueue.ParseRetentionRules(config.ManagerDbRetention); err != nil {
+			die("managerdbretention config option is invalid: %s", err)
+		}
+		if _, err := jobqueue.ParseCostRates(config.ManagerCostRates); err != nil {
+			die("managercostrates config option is invalid: %s", err)
+		}
+		if _, err := jobqueue.ParseProtectors(config.ManagerProtectors); err != nil {
+			die("managerprotectors config option is invalid: %s", err)
+		}
+		if _, err := jobqueue.ParseRemoteManagers(config.ManagerRemotes); err != nil {
+			die("managerremotes config option is invalid: %s", err)
+		}
+
+		if standbyOf != "" {
+			checkPrimary()
+		} else {
+			// check to see if the manager is already running (regardless of
+			// the state of the pid file), giving us a meaningful error message
+			// in the most obvious case of failure to start
+			jq := connect(1*time.Second, true)
+			if jq != nil {
+				die("wr manager on port %s is already running (pid %d)", config.ManagerPort, jq.ServerInfo.PID)
+			}
 		}
 
 		var postCreation []byte
@@ -202,7 +239,11 @@ fully.`,
 			startJQ(postCreation)
 		} else {
 			child, context := daemonize(config.ManagerPidFile, config.ManagerUmask, extraArgs...)
-			if child != nil {
+			if child != nil && standbyOf != "" {
+				// parent; our child won't start serving until the primary
+				// stops responding
+				info("wr manager started as a standby of %s, pid %d; see %s for when it takes over", standbyOf, child.Pid, config.ManagerLogFile)
+			} else if child != nil {
 				// parent; wait a while for our child to bring up the manager
 				// before exiting
 				mTimeout := time.Duration(managerTimeoutSeconds) * time.Second
@@ -520,6 +561,212 @@ somewhere.)`,
 	},
 }
 
+// compact sub-command compacts the database
+var managerCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Compact wr's database",
+	Long: `Compact wr's job database, reclaiming disk space.
+
+The manager's database file never shrinks on its own, even after old data has
+been deleted according to the managerdbretention config option. This command
+has the manager rewrite its database to a new file without the wasted space,
+and then switch to using that file, reporting how much space was reclaimed.
+
+The manager carries on working while this happens, only pausing access to its
+database for a moment at the end. Note that the new file is written alongside
+the old one, so you will temporarily need enough free disk space for another
+copy of the database's contents.
+
+The manager must be running. For very large databases you may need to increase
+--timeout.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		timeout := time.Duration(timeoutint) * time.Second
+
+		jq := connect(timeout)
+		defer func() {
+			err := jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		result, err := jq.CompactDB()
+		if err != nil {
+			die("%s", err)
+		}
+		info("compacted database from %.1fMB to %.1fMB, reclaiming %.1fMB (took %s, paused for %s)",
+			bytesToMB(result.SizeBefore), bytesToMB(result.SizeAfter), bytesToMB(result.Reclaimed()),
+			result.Took.Round(time.Millisecond), result.Paused.Round(time.Millisecond))
+	},
+}
+
+// bytesToMB converts bytes to MB.
+func bytesToMB(b int64) float64 {
+	return float64(b) / 1024 / 1024
+}
+
+// restore sub-command restores the database from a backup
+var managerRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore wr's database from a backup",
+	Long: `Restore wr's job database from a backup.
+
+The manager must be stopped before you restore. The backup is first verified
+(see 'wr manager verify-backup'), and only if it has no problems does it replace
+the current database, which is kept with a .pre_restore suffix. Start the
+manager again afterwards to use the restored database.
+
+By default the latest automatic backup (the configured managerdbbkfile) is
+restored. Use --from to restore a different file, such as one made with
+'wr manager backup', or --at to restore the newest backup generation (see the
+managerdbbkgens config option) made at or before the given date (eg.
+2021-06-29), date-time (eg. 2021-06-29T15:04 or RFC3339 format), or duration
+(eg. 2h) ago. Use --list to see the available generations.
+
+With --dry-run, nothing is restored; instead you see how many commands in each
+state, overall and per report group, would be restored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		bkFile := configuredBackupFile()
+		if restoreList {
+			gens, err := jobqueue.BackupGenerations(bkFile, appLogger)
+			if err != nil {
+				die("could not list backup generations: %s", err)
+			}
+			if len(gens) == 0 {
+				info("there are no backup generations of %s", bkFile)
+			}
+			for _, gen := range gens {
+				fmt.Printf("%s\t%s\n", gen.Time.Local().Format(time.RFC3339), gen.Path)
+			}
+			return
+		}
+
+		from := bkFile
+		if restoreFrom != "" && restoreAt != "" {
+			die("--from and --at can't be used together")
+		}
+		if restoreFrom != "" {
+			from = restoreFrom
+		}
+		if restoreAt != "" {
+			at, err := internal.ParseTimeOrAgo(restoreAt)
+			if err != nil {
+				die("--at was invalid: %s", err)
+			}
+			from, err = jobqueue.BackupGenerationAt(bkFile, at, appLogger)
+			if err != nil {
+				die("%s", err)
+			}
+		}
+
+		if restoreDryRun {
+			summary, err := jobqueue.VerifyDB(from, config.ManagerDbBackend, appLogger)
+			if summary != nil {
+				info("restoring %s would give you:", from)
+				printDBSummary(summary)
+			}
+			if err != nil {
+				die("%s", err)
+			}
+			return
+		}
+
+		if config.Deployment == internal.Development {
+			warn("development managers start with an empty database, so the restore will only be useful to tools that read the database file directly")
+		}
+
+		jq := connect(1*time.Second, true)
+		if jq != nil {
+			die("wr manager on port %s is running; stop it before restoring", config.ManagerPort)
+		}
+
+		summary, err := jobqueue.RestoreDB(from, config.ManagerDbFile, config.ManagerDbBackend, appLogger)
+		if summary != nil && len(summary.Problems) > 0 {
+			printDBSummary(summary)
+		}
+		if err != nil {
+			die("restore failed: %s", err)
+		}
+		info("restored %s from %s:", config.ManagerDbFile, from)
+		printDBSummary(summary)
+	},
+}
+
+// verify-backup sub-command checks a database backup
+var managerVerifyBackupCmd = &cobra.Command{
+	Use:   "verify-backup",
+	Short: "Verify a backup of wr's database",
+	Long: `Verify a backup of wr's job database.
+
+This checks the integrity of the database file and decodes every command in it,
+reporting any problems found, along with how many commands are in each state,
+overall and per report group. The backup file itself is not altered.
+
+By default the latest automatic backup (the configured managerdbbkfile) is
+checked; use --from to check a different file. Exits with a non-zero status if
+there were problems.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		from := restoreFrom
+		if from == "" {
+			from = configuredBackupFile()
+		}
+
+		summary, err := jobqueue.VerifyDB(from, config.ManagerDbBackend, appLogger)
+		if summary != nil {
+			printDBSummary(summary)
+		}
+		if err != nil {
+			die("%s", err)
+		}
+		info("%s verified OK", from)
+	},
+}
+
+// configuredBackupFile returns the location the manager backs up its database
+// to.
+func configuredBackupFile() string {
+	bkFile := config.ManagerDbBkFile
+	if internal.InS3(bkFile) && config.Deployment == internal.Development {
+		bkFile += "." + config.Deployment
+	}
+	return bkFile
+}
+
+// printDBSummary prints out the job counts and problems in a DBSummary.
+func printDBSummary(summary *jobqueue.DBSummary) {
+	fmt.Printf("schema version %d\n", summary.SchemaVersion)
+	fmt.Printf("%d commands: %s\n", summary.Jobs, formatStateCounts(summary.States))
+
+	rgs := make([]string, 0, len(summary.RepGroups))
+	for rg := range summary.RepGroups {
+		rgs = append(rgs, rg)
+	}
+	sort.Strings(rgs)
+	for _, rg := range rgs {
+		fmt.Printf("  %s: %s\n", rg, formatStateCounts(summary.RepGroups[rg]))
+	}
+
+	for _, problem := range summary.Problems {
+		fmt.Printf("problem: %s\n", problem)
+	}
+}
+
+// formatStateCounts formats job state counts like "complete: 3, buried: 1",
+// with states sorted by name.
+func formatStateCounts(counts map[jobqueue.JobState]int) string {
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, string(state))
+	}
+	sort.Strings(states)
+
+	parts := make([]string, len(states))
+	for i, state := range states {
+		parts[i] = fmt.Sprintf("%s: %d", state, counts[jobqueue.JobState(state)])
+	}
+	return strings.Join(parts, ", ")
+}
+
 // reportLiveStatus is used by the status command on a working connection to
 // distinguish between the server being in a normal 'started' state or the
 // 'drain' state.
@@ -541,6 +788,9 @@ func init() {
 	managerCmd.AddCommand(managerStopCmd)
 	managerCmd.AddCommand(managerStatusCmd)
 	managerCmd.AddCommand(managerBackupCmd)
+	managerCmd.AddCommand(managerCompactCmd)
+	managerCmd.AddCommand(managerRestoreCmd)
+	managerCmd.AddCommand(managerVerifyBackupCmd)
 
 	// flags specific to these sub-commands
 	defaultConfig := internal.DefaultConfig(appLogger)
@@ -571,8 +821,19 @@ func init() {
 	managerStartCmd.Flags().BoolVar(&useCertDomain, "use_cert_domain", false, "if cert domain is configured, provide it to spawned clients instead of our IP address")
 	managerStartCmd.Flags().BoolVar(&managerDebug, "debug", false, "include extra debugging information in the logs")
 	managerStartCmd.Flags().BoolVar(&runnerDebug, "runner_debug", false, "have runners log to syslog on their machines")
+	managerStartCmd.Flags().StringVar(&standbyOf, "standby-of", "", "host:port of a running manager to be a hot standby of")
+	managerStartCmd.Flags().IntVar(&standbyTimeout, "standby-timeout", 30, "with --standby-of, how long (seconds) the primary must be unresponsive before we take over")
 
 	managerBackupCmd.Flags().StringVarP(&backupPath, "path", "p", "", "backup file path")
+
+	managerCompactCmd.Flags().IntVar(&timeoutint, "timeout", 3600, "how long (seconds) to wait for compaction to complete")
+
+	managerRestoreCmd.Flags().StringVar(&restoreFrom, "from", "", "backup file to restore (defaults to the latest automatic backup)")
+	managerRestoreCmd.Flags().StringVar(&restoreAt, "at", "", "restore the newest backup generation made at or before this date, time or duration ago")
+	managerRestoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "only report what would be restored")
+	managerRestoreCmd.Flags().BoolVar(&restoreList, "list", false, "list the available backup generations")
+
+	managerVerifyBackupCmd.Flags().StringVar(&restoreFrom, "from", "", "backup file to verify (defaults to the latest automatic backup)")
 }
 
 func logStarted(s *jobqueue.ServerInfo, token []byte) {
@@ -743,26 +1004,66 @@ func startJQ(postCreation []byte) {
 	waitgroup.Opts.Logger = &wgDebug
 	waitgroup.Opts.Disable = false
 
+	if standbyOf != "" {
+		standBy(serverLogger)
+	}
+
+	retention, err := jobqueue.ParseRetentionRules(config.ManagerDbRetention)
+	if err != nil {
+		die("managerdbretention config option is invalid: %s", err)
+	}
+
+	costRates, err := jobqueue.ParseCostRates(config.ManagerCostRates)
+	if err != nil {
+		die("managercostrates config option is invalid: %s", err)
+	}
+
+	protectors, err := jobqueue.ParseProtectors(config.ManagerProtectors)
+	if err != nil {
+		die("managerprotectors config option is invalid: %s", err)
+	}
+
+	remotes, err := jobqueue.ParseRemoteManagers(config.ManagerRemotes)
+	if err != nil {
+		die("managerremotes config option is invalid: %s", err)
+	}
+
+	recHalfLife := time.Duration(config.ManagerRecHalfLife) * 24 * time.Hour
+	if config.ManagerRecHalfLife <= 0 {
+		recHalfLife = -1
+	}
+
 	// start the jobqueue server
 	server, msg, token, err := jobqueue.Serve(jobqueue.ServerConfig{
-		Port:            config.ManagerPort,
-		WebPort:         config.ManagerWeb,
-		SchedulerName:   scheduler,
-		SchedulerConfig: schedulerConfig,
-		RunnerCmd:       runnerCmd,
-		DBFile:          config.ManagerDbFile,
-		DBFileBackup:    config.ManagerDbBkFile,
-		TokenFile:       config.ManagerTokenFile,
-		UploadDir:       config.ManagerUploadDir,
-		CAFile:          config.ManagerCAFile,
-		CertFile:        config.ManagerCertFile,
-		KeyFile:         config.ManagerKeyFile,
-		CertDomain:      config.ManagerCertDomain,
-		DomainMatchesIP: useCertDomain,
-		AutoConfirmDead: time.Duration(cloudServersAutoConfirmDead) * time.Minute,
-		Deployment:      config.Deployment,
-		CIDR:            serverCIDR,
-		Logger:          serverLogger,
+		Port:                       config.ManagerPort,
+		WebPort:                    config.ManagerWeb,
+		SchedulerName:              scheduler,
+		SchedulerConfig:            schedulerConfig,
+		RunnerCmd:                  runnerCmd,
+		DBFile:                     config.ManagerDbFile,
+		DBFileBackup:               config.ManagerDbBkFile,
+		DBBackupGenerations:        config.ManagerDbBkGens,
+		DBBackupGenerationInterval: time.Duration(config.ManagerDbBkGenMins) * time.Minute,
+		DBBackend:                  config.ManagerDbBackend,
+		DBRetention:                retention,
+		RecMBRound:                 config.ManagerRecMBRound,
+		RecSecRound:                config.ManagerRecSecRound,
+		RecHalfLife:                recHalfLife,
+		PriorityAging:              time.Duration(config.ManagerPriorityAging) * time.Minute,
+		CostRates:                  costRates,
+		Protectors:                 protectors,
+		RemoteManagers:             remotes,
+		TokenFile:                  config.ManagerTokenFile,
+		UploadDir:                  config.ManagerUploadDir,
+		CAFile:                     config.ManagerCAFile,
+		CertFile:                   config.ManagerCertFile,
+		KeyFile:                    config.ManagerKeyFile,
+		CertDomain:                 config.ManagerCertDomain,
+		DomainMatchesIP:            useCertDomain,
+		AutoConfirmDead:            time.Duration(cloudServersAutoConfirmDead) * time.Minute,
+		Deployment:                 config.Deployment,
+		CIDR:                       serverCIDR,
+		Logger:                     serverLogger,
 	})
 
 	if msg != "" {
@@ -800,6 +1101,58 @@ func startJQ(postCreation []byte) {
 	}
 }
 
+// checkPrimary dies unless we can be a standby of the manager at standbyOf.
+func checkPrimary() {
+	if config.Deployment != internal.Production {
+		die("--standby-of is only supported in the production deployment")
+	}
+
+	token, err := token()
+	if err != nil {
+		die("--standby-of needs a copy of the primary's token file at %s: %s", config.ManagerTokenFile, err)
+	}
+
+	jq, err := jobqueue.Connect(standbyOf, config.ManagerCAFile, config.ManagerCertDomain, token, 5*time.Second)
+	if err != nil {
+		die("could not connect to the primary manager at %s: %s", standbyOf, err)
+	}
+	err = jq.Disconnect()
+	if err != nil {
+		warn("disconnecting from the primary manager failed: %s", err)
+	}
+}
+
+// standBy replicates the database of the manager at standbyOf, returning once
+// that manager has stopped responding, so that we can take over. Dies if we
+// are stopped or fail to replicate.
+func standBy(serverLogger log15.Logger) {
+	token, err := token()
+	if err != nil {
+		die("could not read token file: %s", err)
+	}
+
+	info("wr manager is a standby of %s", standbyOf)
+	err = jobqueue.Standby(jobqueue.StandbyConfig{
+		PrimaryAddr: standbyOf,
+		CAFile:      config.ManagerCAFile,
+		CertDomain:  config.ManagerCertDomain,
+		Token:       token,
+		DBFile:      config.ManagerDbFile,
+		DBBackend:   config.ManagerDbBackend,
+		Timeout:     time.Duration(standbyTimeout) * time.Second,
+		Logger:      serverLogger,
+	})
+	if err != nil {
+		jqerr, ok := err.(jobqueue.Error)
+		if ok && (jqerr.Err == jobqueue.ErrClosedTerm || jqerr.Err == jobqueue.ErrClosedInt) {
+			info("wr manager standby of %s gracefully stopped", standbyOf)
+			os.Exit(0)
+		}
+		die("wr manager standby of %s failed: %s", standbyOf, err)
+	}
+	info("wr manager at %s stopped responding; taking over", standbyOf)
+}
+
 // deleteToken should be called on successful, known clean stop of the manager,
 // so that the next time the manager is started it will create a new token.
 // For un-clean exits of the manager, we should keep the token so the manager
@@ -252,6 +252,13 @@ new internal ids is printed.`,
 		if cobraCmd.Flags().Changed("priority") {
 			jm.SetPriority(uint8(cmdPri))
 		}
+		if cobraCmd.Flags().Changed("deadline") {
+			deadline, errp := jobqueue.ParseDeadline(cmdDeadline)
+			if errp != nil {
+				die("--deadline was not specified correctly: %s", errp)
+			}
+			jm.SetDeadline(deadline)
+		}
 		if cobraCmd.Flags().Changed("retries") {
 			jm.SetRetries(uint8(cmdRet))
 		}
@@ -379,9 +386,10 @@ func init() {
 	modCmd.Flags().IntVar(&cmdDisk, "disk", 0, "number of GB of disk space required (default 0)")
 	modCmd.Flags().IntVarP(&cmdOvr, "override", "o", 0, "[0|1|2] should your mem/time estimates override? (default 0)")
 	modCmd.Flags().IntVarP(&cmdPri, "priority", "p", 0, "[0-255] command priority (default 0)")
+	modCmd.Flags().StringVar(&cmdDeadline, "deadline", "", "time (RFC 3339) or duration from now by which commands must complete (blank to remove)")
 	modCmd.Flags().IntVarP(&cmdRet, "retries", "r", 3, "[0-255] number of automatic retries for failed commands")
 	modCmd.Flags().StringVar(&cmdCmdDeps, "cmd_deps", "", "dependencies of your commands, in the form \"command1,cwd1,command2,cwd2...\"")
-	modCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\"")
+	modCmd.Flags().StringVarP(&cmdGroupDeps, "deps", "d", "", "dependencies of your commands, in the form \"dep_grp1,dep_grp2...\", where each dep_grp can be an expression like \"failed(dep_grp1)|dep_grp2\"")
 	modCmd.Flags().StringVar(&cmdMonitorDocker, "monitor_docker", "", "monitor resource usage of docker container with given --name or --cidfile path")
 	modCmd.Flags().StringVar(&cmdOnFailure, "on_failure", "", "behaviours to carry out when cmds fails, in JSON format")
 	modCmd.Flags().StringVar(&cmdOnSuccess, "on_success", "", "behaviours to carry out when cmds succeed, in JSON format")
@@ -0,0 +1,320 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// reqsHistogramWidth is the maximum width of the bars of histograms displayed
+// by reqs -o details.
+const reqsHistogramWidth = 40
+
+// options for this cmd
+var reqsGroup string
+var reqsOutput string
+var reqsReset bool
+var reqsResource string
+var reqsSince string
+var reqsUntil string
+var reqsSeed string
+var reqsSeedFormat string
+
+// reqsCmd represents the reqs command
+var reqsCmd = &cobra.Command{
+	Use:   "reqs",
+	Short: "Inspect and manage learned resource requirements",
+	Long: `See and manage what the manager has learned about the memory, disk and
+time used by the commands in each requirements group (req_grp).
+
+Every time a command completes, or fails for using too much memory, disk or
+time, the manager records how much it used against its req_grp, and uses these
+observations to decide how much to reserve for future commands in the same
+req_grp. With no options, this command lists every req_grp with the number of
+observations of each resource, their median, 95th percentile and maximum, and
+how much would currently be reserved for a new command.
+
+Use -g to restrict output to a particular req_grp; this shows more percentiles
+and a histogram of the observations. Memory and disk are in MB and time is in
+seconds. You can choose the output format with -o:
+  "summary" is the default without -g, showing a line per req_grp and resource.
+  "details" is the default with -g, adding percentiles and histograms.
+  "json" dumps all the stats as a JSON array.
+  "accuracy" instead shows, for each req_grp and resource, how many commands
+    we know the reservation of, how many of them used more than was
+    reserved, and the mean amounts reserved and used, and the mean absolute
+    difference between the two, so you can see how good the reservations are.
+
+If a tool had a bug that made it use far more (or less) than normal, the
+observations of its commands will distort future reservations. Use --reset
+with -g to forget the observations of a req_grp. You can restrict this to a
+particular resource with -r, and to commands that finished running in a time
+range with --since and --until, eg. while the buggy version was in use. These
+take dates (eg. 2021-06-29), date-times (eg. 2021-06-29T15:04 or RFC3339
+format), or durations (eg. 24h) meaning that long ago.
+
+To give a new manager (or a new req_grp) a head start, you can seed observations
+from a file made by "wr export" with --seed (- means read from STDIN), giving
+the format of the file with -f. Completed commands in the file give
+observations of all 3 resources, while those that failed for using too much of a
+resource give an observation of just that resource. The commands' own req_grps
+are used, unless you supply -g, in which case all the observations are stored
+against that req_grp. Seeding the same file twice does not count its commands
+twice.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			die("Did you mean to specify --req_grp?")
+		}
+		if reqsReset && reqsSeed != "" {
+			die("--reset and --seed are mutually exclusive")
+		}
+		if reqsReset && reqsGroup == "" {
+			die("--reset requires -g")
+		}
+		if !reqsReset && (reqsResource != "" || reqsSince != "" || reqsUntil != "") {
+			die("-r, --since and --until only apply to --reset")
+		}
+
+		var observations []*jobqueue.ReqGroupObservation
+		if reqsSeed != "" {
+			observations = readReqsSeed()
+		}
+
+		timeout := time.Duration(timeoutint) * time.Second
+		jq := connect(timeout)
+		var err error
+		defer func() {
+			err = jq.Disconnect()
+			if err != nil {
+				warn("Disconnecting from the server failed: %s", err)
+			}
+		}()
+
+		switch {
+		case reqsReset:
+			filter := &jobqueue.ReqGroupStatsFilter{ReqGroup: reqsGroup, Resource: reqsResource}
+			if reqsSince != "" {
+				filter.Since, err = internal.ParseTimeOrAgo(reqsSince)
+				if err != nil {
+					die("--since was invalid: %s", err)
+				}
+			}
+			if reqsUntil != "" {
+				filter.Until, err = internal.ParseTimeOrAgo(reqsUntil)
+				if err != nil {
+					die("--until was invalid: %s", err)
+				}
+			}
+
+			var removed int
+			removed, err = jq.RemoveReqGroupStats(filter)
+			if err != nil {
+				die("failed to reset stats: %s", err)
+			}
+			info("Removed %d observations of req_grp %s", removed, reqsGroup)
+		case reqsSeed != "":
+			var added int
+			added, err = jq.SeedReqGroupStats(observations)
+			if err != nil {
+				die("failed to seed stats: %s", err)
+			}
+			info("Seeded %d observations", added)
+		case reqsOutput == "accuracy" || reqsOutput == "a":
+			var accuracy []*jobqueue.ReqGroupAccuracy
+			accuracy, err = jq.RecommendationAccuracy(reqsGroup)
+			if err != nil {
+				die("failed to get accuracy: %s", err)
+			}
+			if reqsGroup != "" && len(accuracy) == 0 {
+				die("no reservations are known for req_grp %s", reqsGroup)
+			}
+			printReqGroupAccuracy(accuracy)
+		default:
+			var stats []*jobqueue.ReqGroupStats
+			stats, err = jq.GetReqGroupStats(reqsGroup)
+			if err != nil {
+				die("failed to get stats: %s", err)
+			}
+			if reqsGroup != "" && len(stats) == 0 {
+				die("nothing has been learned about req_grp %s", reqsGroup)
+			}
+			printReqGroupStats(stats)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reqsCmd)
+
+	// flags specific to this sub-command
+	reqsCmd.Flags().StringVarP(&reqsGroup, "req_grp", "g", "", "the requirements group to view, reset or seed")
+	reqsCmd.Flags().StringVarP(&reqsOutput, "output", "o", "", "['summary','details','json','accuracy'] output format")
+	reqsCmd.Flags().BoolVar(&reqsReset, "reset", false, "forget the observations of -g")
+	reqsCmd.Flags().StringVarP(&reqsResource, "resource", "r", "", "['memory','disk','time'] in --reset mode, only forget observations of this resource")
+	reqsCmd.Flags().StringVar(&reqsSince, "since", "", "in --reset mode, only forget observations of commands that exited at or after this date, time or duration ago")
+	reqsCmd.Flags().StringVar(&reqsUntil, "until", "", "in --reset mode, only forget observations of commands that exited at or before this date, time or duration ago")
+	reqsCmd.Flags().StringVar(&reqsSeed, "seed", "", "file made by 'wr export' to seed observations from; - means read from STDIN")
+	reqsCmd.Flags().StringVarP(&reqsSeedFormat, "format", "f", "csv", "['csv','jsonl'] format of the --seed file")
+
+	reqsCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
+
+// readReqsSeed reads the observations in the --seed file.
+func readReqsSeed() []*jobqueue.ReqGroupObservation {
+	format := jobqueue.ExportFormat(reqsSeedFormat)
+	if format != jobqueue.ExportFormatCSV && format != jobqueue.ExportFormatJSONL {
+		die("invalid -f format specified")
+	}
+
+	var r io.Reader = os.Stdin
+	if reqsSeed != "-" {
+		f, err := os.Open(reqsSeed)
+		if err != nil {
+			die("could not open seed file: %s", err)
+		}
+		defer func() {
+			err = f.Close()
+			if err != nil {
+				warn("failed to close seed file: %s", err)
+			}
+		}()
+		r = f
+	}
+
+	observations, err := jobqueue.ReadReqGroupObservations(r, format, reqsGroup)
+	if err != nil {
+		die("could not read seed file: %s", err)
+	}
+	if len(observations) == 0 {
+		die("the seed file contained no completed commands, or commands that failed due to resource usage")
+	}
+	return observations
+}
+
+// printReqGroupStats prints the given stats in our -o format.
+func printReqGroupStats(stats []*jobqueue.ReqGroupStats) {
+	format := reqsOutput
+	if format == "" {
+		format = "summary"
+		if reqsGroup != "" {
+			format = "details"
+		}
+	}
+
+	switch format {
+	case "summary", "s":
+		w := tabwriter.NewWriter(os.Stdout, 2, 2, 3, ' ', 0)
+		fmt.Fprintf(w, "req_grp\tresource\tcount\tmedian\t95th\tmax\trecommended\n")
+		for _, rgs := range stats {
+			for _, rs := range rgs.Resources {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", rgs.ReqGroup, rs.Resource, rs.Count,
+					reqsValue(rs.Resource, rs.Percentiles[50]), reqsValue(rs.Resource, rs.Percentiles[95]),
+					reqsValue(rs.Resource, rs.Max), reqsValue(rs.Resource, rs.Recommendation))
+			}
+		}
+		err := w.Flush()
+		if err != nil {
+			warn("failed to flush output: %s", err)
+		}
+	case "details", "d":
+		for _, rgs := range stats {
+			for _, rs := range rgs.Resources {
+				fmt.Printf("\n# %s %s\n", rgs.ReqGroup, rs.Resource)
+				fmt.Printf("Observations: %d, from %s to %s\n", rs.Count, rs.Oldest.Format(time.RFC3339), rs.Newest.Format(time.RFC3339))
+				fmt.Printf("Min: %s; 50th: %s; 75th: %s; 90th: %s; 95th: %s; 99th: %s; Max: %s\n",
+					reqsValue(rs.Resource, rs.Min), reqsValue(rs.Resource, rs.Percentiles[50]),
+					reqsValue(rs.Resource, rs.Percentiles[75]), reqsValue(rs.Resource, rs.Percentiles[90]),
+					reqsValue(rs.Resource, rs.Percentiles[95]), reqsValue(rs.Resource, rs.Percentiles[99]),
+					reqsValue(rs.Resource, rs.Max))
+				fmt.Printf("Recommended: %s\n", reqsValue(rs.Resource, rs.Recommendation))
+				printReqsHistogram(rs)
+			}
+		}
+	case "json", "j":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(stats)
+		if err != nil {
+			die("failed to encode stats: %s", err)
+		}
+	default:
+		die("invalid -o format specified")
+	}
+}
+
+// printReqGroupAccuracy prints the given accuracies with a line per req_grp and
+// resource.
+func printReqGroupAccuracy(accuracy []*jobqueue.ReqGroupAccuracy) {
+	w := tabwriter.NewWriter(os.Stdout, 2, 2, 3, ' ', 0)
+	fmt.Fprintf(w, "req_grp\tresource\tcount\tunder\tmean reserved\tmean used\tmean abs error\n")
+	for _, acc := range accuracy {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", acc.ReqGroup, acc.Resource, acc.Count, acc.Under,
+			reqsValue(acc.Resource, int(math.Round(acc.MeanPredicted))), reqsValue(acc.Resource, int(math.Round(acc.MeanActual))),
+			reqsValue(acc.Resource, int(math.Round(acc.MeanAbsError))))
+	}
+	err := w.Flush()
+	if err != nil {
+		warn("failed to flush output: %s", err)
+	}
+}
+
+// printReqsHistogram prints the histogram of the given stats as bars of #s.
+func printReqsHistogram(rs *jobqueue.ResourceStats) {
+	most := 0
+	for _, bin := range rs.Histogram {
+		if bin.Count > most {
+			most = bin.Count
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 2, 2, 1, ' ', 0)
+	for _, bin := range rs.Histogram {
+		bar := 0
+		if most > 0 {
+			bar = bin.Count * reqsHistogramWidth / most
+		}
+		if bar == 0 && bin.Count > 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "%s\t-\t%s\t| %s %d\n", reqsValue(rs.Resource, bin.From), reqsValue(rs.Resource, bin.To), strings.Repeat("#", bar), bin.Count)
+	}
+	err := w.Flush()
+	if err != nil {
+		warn("failed to flush output: %s", err)
+	}
+}
+
+// reqsValue formats a value of the given resource with its unit.
+func reqsValue(resource string, value int) string {
+	if resource == jobqueue.ReqGroupResourceTime {
+		return (time.Duration(value) * time.Second).String()
+	}
+	return fmt.Sprintf("%dMB", value)
+}
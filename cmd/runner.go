@@ -42,6 +42,7 @@ var rserver string
 var rdomain string
 var maxtime int
 var logToSyslog bool
+var batchSize int
 
 // runnerCmd represents the runner command
 var runnerCmd = &cobra.Command{
@@ -57,7 +58,11 @@ runner will pick up another and so on. Once max_time has been used (or would be
 used based on the expected time to complete of the next queued command), the
 runner stops picking up new commands and exits instead; max_time does not cause
 the runner to kill itself if the cmd it is running takes longer than max_time to
-complete.`,
+complete.
+
+With --batch greater than 1, the runner reserves up to that many commands at
+once, runs them one after the other, and reports those that ran OK back to the
+manager in one go, which is much faster for very short commands.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
@@ -134,11 +139,27 @@ complete.`,
 			endTime = time.Now().AddDate(1, 0, 0) // default to allowing us a year to run
 		}
 
+		// when running batches, we report successful commands in one go
+		// after each batch
+		if batchSize > 1 {
+			jq.SetDeferArchives(true)
+		}
+		flushArchives := func() {
+			failed, errf := jq.FlushArchives()
+			if errf != nil {
+				warn("failed to report completed commands: %s", errf)
+			}
+			for key, reason := range failed {
+				warn("failed to report completed command %s: %s", key, reason)
+			}
+		}
+
 		// loop, reserving and running commands from the queue, until there
 		// aren't any more commands in the queue
 		numrun := 0
 		exitReason := fmt.Sprintf("there are no more commands in scheduler group '%s'", schedgrp)
 		var jobTime time.Duration
+		var batch []*jobqueue.Job
 		for {
 			// see if we have enough time to run a new job before we should
 			// exit
@@ -149,9 +170,18 @@ complete.`,
 
 			var job *jobqueue.Job
 			var err error
-			if schedgrp == "" {
+			switch {
+			case len(batch) > 0:
+				job, batch = batch[0], batch[1:]
+			case batchSize > 1:
+				flushArchives()
+				batch, err = jq.ReserveMany(rtimeout, schedgrp, batchSize)
+				if len(batch) > 0 {
+					job, batch = batch[0], batch[1:]
+				}
+			case schedgrp == "":
 				job, err = jq.Reserve(rtimeout)
-			} else {
+			default:
 				job, err = jq.ReserveScheduled(rtimeout, schedgrp)
 			}
 
@@ -229,6 +259,15 @@ complete.`,
 			}
 		}
 
+		// give back any commands we reserved but didn't get to
+		for _, job := range batch {
+			err = jq.Release(job, nil, "runner exited before running it")
+			if err != nil {
+				warn("job release of unstarted batch job failed: %s", err)
+			}
+		}
+		flushArchives()
+
 		info("wr runner exiting, having run %d commands, because %s", numrun, exitReason)
 	},
 }
@@ -244,4 +283,5 @@ func init() {
 	runnerCmd.Flags().StringVar(&rserver, "server", internal.DefaultServer(appLogger), "ip:port of wr manager")
 	runnerCmd.Flags().StringVar(&rdomain, "domain", internal.DefaultConfig(appLogger).ManagerCertDomain, "domain the manager's cert is valid for")
 	runnerCmd.Flags().BoolVar(&logToSyslog, "debug", false, "enable logging to syslog")
+	runnerCmd.Flags().IntVarP(&batchSize, "batch", "b", internal.DefaultConfig(appLogger).RunnerBatchSize, "how many commands to reserve at once")
 }
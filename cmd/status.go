@@ -27,6 +27,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/jobqueue"
 	"github.com/carbocation/runningvariance"
 	"github.com/spf13/cobra"
@@ -48,6 +49,14 @@ var showEnv bool
 var outputFormat string
 var statusLimit int
 var fromHost string
+var statusSince string
+var statusUntil string
+var statusExit int
+var statusGraph string
+
+// historyPageSize is the number of jobs we get from the manager at a time when
+// searching job history.
+const historyPageSize = 1000
 
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
@@ -68,6 +77,24 @@ reported when using this command.
 
 The file to provide -f is in the format taken by "wr add".
 
+To search through the history of commands that have exited (successfully or
+not), instead of looking at the current state of the queue, supply any of
+--since, --until and --exit. These take dates (eg. 2021-06-29), date-times (eg.
+2021-06-29T15:04 or RFC3339 format), or durations (eg. 24h) meaning that long
+ago. --host and -i (as a report group, without -z) can be combined with these to
+further narrow your search, eg. to find all commands that ended on host X in the
+last week with exit code 137:
+wr status --since 168h --host X --exit 137
+In this mode, all matching commands are shown individually.
+
+To see where a pipeline is blocked, supply --graph along with -i (optionally
+with -z) to output the dependency graph of the commands in those report groups
+instead of their status. Each node is labelled with its command and current
+state; dependencies on commands outside the report group(s) are included, and
+dependencies that can never be satisfied are marked as missing. The format can
+be "dot" (for Graphviz, eg. wr status -i foo --graph dot | dot -Tsvg > g.svg),
+"mermaid" or "json".
+
 In -f and -l mode you must provide the cwd the commands were set to run in, if
 CwdMatters (and must NOT be provided otherwise). Likewise provide the mounts
 option that was used when the command was added, if any. You can do this by
@@ -80,7 +107,10 @@ name to just the first letter, eg. -o c):
   "summary" shows the counts broken down by report group, along with the mean
     (and standard deviation) resource usage of completed jobs in each report
     group, and the internal identifiers of any buried jobs, broken down by exit
-    code+failure reason.
+    code+failure reason. If the manager was configured with managercostrates,
+    the total cost of the jobs in each report group and of each user is also
+    shown, as is the number of jobs predicted to miss their deadline (given how
+    many jobs are queued ahead of them), if any.
   "details" groups jobs with the same state, reason for failure and exitcode
     together and shows the complete details of --limit random jobs in each group
     (and you are told how many are not being displayed). A limit of 0 turns off
@@ -106,6 +136,10 @@ name to just the first letter, eg. -o c):
 		}
 		timeout := time.Duration(timeoutint) * time.Second
 
+		if statusGraph != "" && (cmdIDStatus == "" || cmdIDIsInternal) {
+			die("--graph requires -i as a report group")
+		}
+
 		jq := connect(timeout)
 		var err error
 		defer func() {
@@ -115,12 +149,33 @@ name to just the first letter, eg. -o c):
 			}
 		}()
 
+		if statusGraph != "" {
+			g, errg := jq.GetDependencyGraph(cmdIDStatus, cmdIDIsSubStr)
+			if errg != nil {
+				die("failed to get the dependency graph: %s", errg)
+			}
+			out, errr := g.Render(jobqueue.DependencyGraphFormat(statusGraph))
+			if errr != nil {
+				die("%s", errr)
+			}
+			fmt.Println(strings.TrimSuffix(out, "\n"))
+			return
+		}
+
 		if outputFormat != "details" && outputFormat != "d" {
 			statusLimit = 0
 			showStd = false
 			showEnv = false
 		}
-		jobs := getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
+		var jobs []*jobqueue.Job
+		if js := statusJobSearch(cmd); js != nil {
+			if cmdFileStatus != "" || cmdLine != "" || cmdIDIsSubStr || cmdIDIsInternal || cmdState != "" {
+				die("--since, --until and --exit can only be combined with --host and -i")
+			}
+			jobs = searchHistory(jq, js, showStd, showEnv)
+		} else {
+			jobs = getJobs(jq, cmdState, set == 0, statusLimit, showStd, showEnv)
+		}
 		showextra := cmdFileStatus == ""
 
 		if fromHost != "" {
@@ -175,11 +230,23 @@ name to just the first letter, eg. -o c):
 			walltime := make(map[string]*runningvariance.RunningStat)
 			cputime := make(map[string]*runningvariance.RunningStat)
 			startends := make(map[string][]time.Time)
+			costs := make(map[string]float64)
+			userCosts := make(map[string]float64)
+			atRisk := make(map[string]int)
 			counts[allRepGrps] = make(map[jobqueue.JobState]int)
 			for _, job := range jobs {
 				if _, exists := counts[job.RepGroup]; !exists {
 					counts[job.RepGroup] = make(map[jobqueue.JobState]int)
 				}
+				if job.Cost > 0 {
+					costs[job.RepGroup] += job.Cost
+					costs[allRepGrps] += job.Cost
+					userCosts[job.User] += job.Cost
+				}
+				if job.DeadlineAtRisk {
+					atRisk[job.RepGroup]++
+					atRisk[allRepGrps]++
+				}
 				state := job.State
 				if state == jobqueue.JobStateReserved {
 					state = jobqueue.JobStateRunning
@@ -257,6 +324,14 @@ name to just the first letter, eg. -o c):
 					}
 				}
 
+				if costs[rg] > 0 {
+					usage += " cost=" + formatCost(costs[rg])
+				}
+
+				if atRisk[rg] > 0 {
+					usage += fmt.Sprintf(" deadline_at_risk=%d", atRisk[rg])
+				}
+
 				var dead string
 				if counts[rg][jobqueue.JobStateBuried] > 0 {
 					// sort the bury groups
@@ -273,6 +348,25 @@ name to just the first letter, eg. -o c):
 
 				fmt.Printf("%s : complete=%d running=%d ready=%d dependent=%d lost=%d delayed=%d buried=%d%s%s\n", rg, counts[rg][jobqueue.JobStateComplete], counts[rg][jobqueue.JobStateRunning], counts[rg][jobqueue.JobStateReady], counts[rg][jobqueue.JobStateDependent], counts[rg][jobqueue.JobStateLost], counts[rg][jobqueue.JobStateDelayed], counts[rg][jobqueue.JobStateBuried], usage, dead)
 			}
+
+			// display the costs charged to each user
+			if len(userCosts) > 0 {
+				users := make([]string, 0, len(userCosts))
+				for user := range userCosts {
+					users = append(users, user)
+				}
+				sort.Strings(users)
+
+				var userCostStrs []string
+				for _, user := range users {
+					name := user
+					if name == "" {
+						name = "unknown"
+					}
+					userCostStrs = append(userCostStrs, name+"="+formatCost(userCosts[user]))
+				}
+				fmt.Printf("\ncosts by user : %s\n", strings.Join(userCostStrs, " "))
+			}
 		case "details", "d":
 			// print out status information for each job
 			for _, job := range jobs {
@@ -306,6 +400,10 @@ name to just the first letter, eg. -o c):
 					}
 					dockerMonitored = fmt.Sprintf("Docker container monitoring turned on for: %s\n", dockerID)
 				}
+				var resultCache string
+				if job.ResultCache != nil {
+					resultCache = fmt.Sprintf("Result cache: %s\n", job.ResultCache)
+				}
 				var behaviours string
 				if len(job.Behaviours) > 0 {
 					behaviours = fmt.Sprintf("Behaviours: %s\n", job.Behaviours)
@@ -318,7 +416,7 @@ name to just the first letter, eg. -o c):
 					}
 					other = fmt.Sprintf("Resource requirements: %s\n", strings.Join(others, ", "))
 				}
-				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, dockerMonitored, behaviours, other, job.RepGroup, job.Key(), job.ReqGroup, groups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
+				fmt.Printf("\n# %s\nCwd: %s\n%s%s%s%s%s%sId: %s (%s); Requirements group: %s; %sPriority: %d; Attempts: %d\nExpected requirements: { memory: %dMB; time: %s; cpus: %s disk: %dGB }\n", job.Cmd, cwd, mounts, homeChanged, dockerMonitored, resultCache, behaviours, other, job.RepGroup, job.Key(), job.ReqGroup, groups, job.Priority, job.Attempts, job.Requirements.RAM, job.Requirements.Time, strconv.FormatFloat(job.Requirements.Cores, 'f', -1, 64), job.Requirements.Disk)
 
 				switch job.State {
 				case jobqueue.JobStateDelayed:
@@ -334,13 +432,33 @@ name to just the first letter, eg. -o c):
 				case jobqueue.JobStateLost:
 					fmt.Printf("Status: lost contact (started %s; lost %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
 				case jobqueue.JobStateComplete:
-					fmt.Printf("Status: complete (started %s; ended %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
+					if job.Cached {
+						fmt.Printf("Status: complete, by restoring the cached results of an identical earlier run (ended %s)\n", job.EndTime.Format(shortTimeFormat))
+					} else {
+						fmt.Printf("Status: complete (started %s; ended %s)\n", job.StartTime.Format(shortTimeFormat), job.EndTime.Format(shortTimeFormat))
+					}
 				}
 
 				if job.FailReason != "" {
 					fmt.Printf("Previous problem: %s\n", job.FailReason)
 				}
 
+				if job.BudgetExceeded != "" {
+					fmt.Printf("Held back: budget %s has reached its limit; see wr budget\n", job.BudgetExceeded)
+				}
+
+				for _, problem := range job.RemoteDepProblems {
+					fmt.Printf("Waiting: %s\n", problem)
+				}
+
+				if !job.Deadline.IsZero() {
+					var risk string
+					if job.DeadlineAtRisk {
+						risk = " - predicted to be missed given the jobs queued ahead of it!"
+					}
+					fmt.Printf("Deadline: %s%s\n", job.Deadline.Format(shortTimeFormat), risk)
+				}
+
 				var hostID string
 				if job.HostID != "" {
 					hostID = ", ID: " + job.HostID
@@ -385,6 +503,10 @@ name to just the first letter, eg. -o c):
 					}
 				}
 
+				if job.Cost > 0 {
+					fmt.Printf("Cost: %s (charged to %s)\n", formatCost(job.Cost), job.User)
+				}
+
 				if showextra && showEnv {
 					env, erre := job.Env()
 					if erre != nil {
@@ -452,10 +574,23 @@ func init() {
 	statusCmd.Flags().BoolVarP(&showEnv, "env", "e", false, "in -o d mode, except in -f mode, also show the environment variables the command(s) ran with")
 	statusCmd.Flags().StringVarP(&outputFormat, "output", "o", "details", "['counts','summary','details','json'] output format")
 	statusCmd.Flags().IntVar(&statusLimit, "limit", 1, "in -o d mode, number of commands that share the same properties to display; 0 displays all")
+	statusCmd.Flags().StringVar(&statusSince, "since", "", "only show commands that exited at or after this date, time or duration ago")
+	statusCmd.Flags().StringVar(&statusUntil, "until", "", "only show commands that exited at or before this date, time or duration ago")
+	statusCmd.Flags().IntVar(&statusExit, "exit", 0, "only show commands that exited with this exit code")
+	statusCmd.Flags().StringVar(&statusGraph, "graph", "", "['dot','mermaid','json'] output the dependency graph of the -i commands in this format")
 
 	statusCmd.Flags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
 }
 
+// formatCost formats a job cost for display, keeping enough precision to see
+// the cost of short-lived commands.
+func formatCost(cost float64) string {
+	if cost < 0.01 {
+		return strconv.FormatFloat(cost, 'g', 2, 64)
+	}
+	return strconv.FormatFloat(cost, 'f', 2, 64)
+}
+
 func countGetJobArgs() int {
 	set := 0
 	if cmdFileStatus != "" {
@@ -526,6 +661,58 @@ func getJobs(jq *jobqueue.Client, cmdState jobqueue.JobState, all bool, statusLi
 	return jobs
 }
 
+// statusJobSearch returns a JobSearch based on the --since, --until, --exit,
+// --host and -i options, if any of the first 3 were supplied. Otherwise returns
+// nil.
+func statusJobSearch(cmd *cobra.Command) *jobqueue.JobSearch {
+	if statusSince == "" && statusUntil == "" && !cmd.Flags().Changed("exit") {
+		return nil
+	}
+
+	js := &jobqueue.JobSearch{
+		Host:     fromHost,
+		RepGroup: cmdIDStatus,
+		Limit:    historyPageSize,
+	}
+
+	var err error
+	if statusSince != "" {
+		js.Since, err = internal.ParseTimeOrAgo(statusSince)
+		if err != nil {
+			die("--since was invalid: %s", err)
+		}
+	}
+	if statusUntil != "" {
+		js.Until, err = internal.ParseTimeOrAgo(statusUntil)
+		if err != nil {
+			die("--until was invalid: %s", err)
+		}
+	}
+	if cmd.Flags().Changed("exit") {
+		exit := statusExit
+		js.Exitcode = &exit
+	}
+
+	return js
+}
+
+// searchHistory gets all the jobs that match the given search, a page at a
+// time.
+func searchHistory(jq *jobqueue.Client, js *jobqueue.JobSearch, showStd, showEnv bool) []*jobqueue.Job {
+	var jobs []*jobqueue.Job
+	for {
+		page, next, err := jq.SearchHistory(js, showStd, showEnv)
+		if err != nil {
+			die("failed to search job history: %s", err)
+		}
+		jobs = append(jobs, page...)
+		if next == "" {
+			return jobs
+		}
+		js.After = next
+	}
+}
+
 func jobsToJobEssenses(jobs []*jobqueue.Job) []*jobqueue.JobEssence {
 	jes := make([]*jobqueue.JobEssence, 0, len(jobs))
 	for _, job := range jobs {
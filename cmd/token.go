@@ -0,0 +1,155 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue"
+	"github.com/spf13/cobra"
+)
+
+// options for this cmd
+var tokenResource string
+var tokenNum int
+var tokenWait int
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Protect a limited resource during part of a command",
+	Long: `Protect a limited resource during part of a command.
+
+If wr manager was configured with managerprotectors, it hands out a limited
+number of tokens for each named resource. Your commands can acquire tokens
+before using the resource and release them afterwards, so that only the part of
+each command that uses the resource is limited, instead of the whole command (as
+with limit groups).
+
+For example, the cmd of a job added with 'wr add' could be:
+  r=$(wr token acquire -r irods) || exit 1; iget foo; e=$?; wr token release $r; [ $e -eq 0 ] && bar foo
+
+Tokens acquired by a job's cmd are released automatically when the job exits,
+and any tokens not released or touched for the resource's timeout (configured
+in managerprotectors) are also released, so tokens are not held forever by
+commands that die. If you use a resource for longer than that timeout, run
+'wr token touch' periodically.`,
+}
+
+// acquire sub-command waits until tokens are granted and prints the receipt
+var tokenAcquireCmd = &cobra.Command{
+	Use:   "acquire",
+	Short: "Wait until tokens of a resource are granted",
+	Long: `Wait until tokens of a resource are granted.
+
+Requests -n tokens of the resource named with -r, then waits until they are
+granted, whereupon a receipt is printed to STDOUT. Pass that receipt to
+'wr token release' when you're done using the resource.
+
+If --wait is set and the tokens aren't granted within that many seconds, the
+request is cancelled and this exits with an error.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if tokenResource == "" {
+			die("--resource is required")
+		}
+
+		jq := connectForTokens()
+		defer disconnectForTokens(jq)
+
+		receipt, err := jq.AcquireTokens(tokenResource, tokenNum, time.Duration(tokenWait)*time.Second)
+		if err != nil {
+			die("failed to acquire tokens: %s", err)
+		}
+		fmt.Println(receipt)
+	},
+}
+
+// touch sub-command stops granted tokens from being automatically released
+var tokenTouchCmd = &cobra.Command{
+	Use:   "touch receipt",
+	Short: "Stop acquired tokens from timing out",
+	Long: `Stop acquired tokens from timing out.
+
+Resets the timeout after which the tokens of the given receipt (as output by
+'wr token acquire') are automatically released. Exits with an error if they were
+already released.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		receipt := tokenReceiptArg(args)
+		jq := connectForTokens()
+		defer disconnectForTokens(jq)
+
+		if err := jq.TouchTokens(receipt); err != nil {
+			die("failed to touch tokens: %s", err)
+		}
+	},
+}
+
+// release sub-command releases granted tokens
+var tokenReleaseCmd = &cobra.Command{
+	Use:   "release receipt",
+	Short: "Release acquired tokens",
+	Long: `Release acquired tokens.
+
+Releases the tokens of the given receipt (as output by 'wr token acquire'), so
+that others can use the resource.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		receipt := tokenReceiptArg(args)
+		jq := connectForTokens()
+		defer disconnectForTokens(jq)
+
+		if err := jq.ReleaseTokens(receipt); err != nil {
+			die("failed to release tokens: %s", err)
+		}
+	},
+}
+
+// tokenReceiptArg returns the single receipt the user supplied as an argument.
+func tokenReceiptArg(args []string) string {
+	if len(args) != 1 {
+		die("exactly 1 receipt must be supplied")
+	}
+	return args[0]
+}
+
+// connectForTokens connects to the manager with the user's timeout.
+func connectForTokens() *jobqueue.Client {
+	return connect(time.Duration(timeoutint) * time.Second)
+}
+
+// disconnectForTokens disconnects from the manager, warning on failure.
+func disconnectForTokens(jq *jobqueue.Client) {
+	if err := jq.Disconnect(); err != nil {
+		warn("Disconnecting from the server failed: %s", err)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenAcquireCmd)
+	tokenCmd.AddCommand(tokenTouchCmd)
+	tokenCmd.AddCommand(tokenReleaseCmd)
+
+	// flags specific to these sub-commands
+	tokenAcquireCmd.Flags().StringVarP(&tokenResource, "resource", "r", "", "name of the protected resource")
+	tokenAcquireCmd.Flags().IntVarP(&tokenNum, "num", "n", 1, "number of tokens to acquire")
+	tokenAcquireCmd.Flags().IntVar(&tokenWait, "wait", 0, "how long (seconds) to wait for the tokens to be granted (0 means forever)")
+
+	tokenCmd.PersistentFlags().IntVar(&timeoutint, "timeout", 120, "how long (seconds) to wait to get a reply from 'wr manager'")
+}
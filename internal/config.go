@@ -73,6 +73,17 @@ type Config struct {
 	ManagerLogFile       string `default:"log"`
 	ManagerDbFile        string `default:"db"`
 	ManagerDbBkFile      string `default:"db_bk"`
+	ManagerDbBackend     string `default:"bolt"`
+	ManagerDbBkGens      int    `default:"0"`
+	ManagerDbBkGenMins   int    `default:"60"`
+	ManagerDbRetention   string `default:""`
+	ManagerRecMBRound    int    `default:"100"`
+	ManagerRecSecRound   int    `default:"1"`
+	ManagerRecHalfLife   int    `default:"30"`
+	ManagerPriorityAging int    `default:"0"`
+	ManagerCostRates     string `default:""`
+	ManagerProtectors    string `default:""`
+	ManagerRemotes       string `default:""`
 	ManagerTokenFile     string `default:"client.token"`
 	ManagerUploadDir     string `default:"uploads"`
 	ManagerUmask         int    `default:"007"`
@@ -83,6 +94,7 @@ type Config struct {
 	ManagerCertDomain    string `default:"localhost"`
 	ManagerSetDomainIP   bool   `default:"false"`
 	RunnerExecShell      string `default:"bash"`
+	RunnerBatchSize      int    `default:"1"`
 	PrivateKeyPath       string `default:"~/.ssh/id_rsa"`
 	Deployment           string `default:"production"`
 	CloudFlavor          string `default:""`
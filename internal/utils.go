@@ -370,6 +370,28 @@ func FileMD5(path string, logger log15.Logger) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// ParseTimeOrAgo parses the given string as an RFC3339 time (eg.
+// 2006-01-02T15:04:05Z), a local date (eg. 2006-01-02), a local date and time
+// (eg. 2006-01-02T15:04 or 2006-01-02 15:04), or as a duration (eg. 36h)
+// meaning that long before now.
+func ParseTimeOrAgo(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%s is not a date, time or duration", value)
+}
+
 // RandomString generates a random string of length 8 characters.
 func RandomString() string {
 	// based on http://stackoverflow.com/a/31832326/675083
@@ -0,0 +1,406 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains functions for managing database backups: keeping
+// timestamped generations of them, verifying them and restoring from them.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+)
+
+// backupGenerationTimeFormat is the format of the timestamp suffix of backup
+// generation files.
+const backupGenerationTimeFormat = "20060102T150405Z"
+
+// sqliteFileHeader is how every SQLite database file starts.
+var sqliteFileHeader = []byte("SQLite format 3\x00")
+
+// BackupGeneration describes a timestamped copy of a database backup.
+type BackupGeneration struct {
+	Path string
+	Time time.Time
+}
+
+// backupGenerationPath returns the path of the generation of the given backup
+// file made at the given time.
+func backupGenerationPath(backupPath string, t time.Time) string {
+	return backupPath + "." + t.UTC().Format(backupGenerationTimeFormat)
+}
+
+// localBackupGenerations returns the generations of the given local backup
+// file, oldest first.
+func localBackupGenerations(backupPath string) ([]*BackupGeneration, error) {
+	paths, err := filepath.Glob(backupPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var gens []*BackupGeneration
+	for _, path := range paths {
+		t, errp := time.Parse(backupGenerationTimeFormat, strings.TrimPrefix(path, backupPath+"."))
+		if errp != nil {
+			continue
+		}
+		gens = append(gens, &BackupGeneration{Path: path, Time: t})
+	}
+
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].Time.Before(gens[j].Time)
+	})
+	return gens, nil
+}
+
+// setBackupGenerations makes us keep the given number of timestamped copies of
+// our backup file, creating a new one at most every interval.
+func (db *db) setBackupGenerations(keep int, interval time.Duration) {
+	db.backupGenerationMutex.Lock()
+	defer db.backupGenerationMutex.Unlock()
+	db.backupGenerations = keep
+	db.backupGenerationInterval = interval
+
+	gens, err := localBackupGenerations(db.backupPath)
+	if err != nil {
+		db.Warn("Listing database backup generations failed", "err", err)
+		return
+	}
+	if len(gens) > 0 {
+		db.backupGenerationLast = gens[len(gens)-1].Time
+	}
+}
+
+// createBackupGeneration copies our backup file to a new generation if it's
+// time to do so, deleting the oldest generations beyond the number we're
+// supposed to keep. Only call this after a successful backup.
+func (db *db) createBackupGeneration() {
+	db.backupGenerationMutex.Lock()
+	defer db.backupGenerationMutex.Unlock()
+	keep := db.backupGenerations
+	if keep <= 0 || time.Since(db.backupGenerationLast) < db.backupGenerationInterval {
+		return
+	}
+
+	now := time.Now()
+	err := copyFile(db.backupPath, backupGenerationPath(db.backupPath, now))
+	if err != nil {
+		db.Error("Database backup generation failed", "err", err)
+		return
+	}
+	db.backupGenerationLast = now
+
+	gens, err := localBackupGenerations(db.backupPath)
+	if err != nil {
+		db.Warn("Listing database backup generations failed", "err", err)
+		return
+	}
+	for len(gens) > keep {
+		err = os.Remove(gens[0].Path)
+		if err != nil {
+			db.Warn("Removing old database backup generation failed", "path", gens[0].Path, "err", err)
+		}
+		gens = gens[1:]
+	}
+}
+
+// withLocalBackup calls fn with the local path to the given backup file, which
+// may be an S3 location (specified like s3://[profile@]bucket/path/file), in
+// which case its directory is temporarily mounted.
+func withLocalBackup(backupPath string, logger log15.Logger, fn func(localPath string) error) error {
+	if !internal.InS3(backupPath) {
+		return fn(backupPath)
+	}
+
+	mntDir, err := os.MkdirTemp("", "wr_backup_mount_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(mntDir)
+
+	localPath, fs, err := mountS3Backup(backupPath, mntDir, logger)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		erru := fs.Unmount()
+		if erru != nil {
+			logger.Warn("Unmounting database backup location failed", "err", erru)
+		}
+	}()
+
+	return fn(localPath)
+}
+
+// BackupGenerations returns the timestamped generations of the given database
+// backup file (which may be an S3 location, as per ServerConfig.DBFileBackup)
+// that a server configured with DBBackupGenerations has kept, oldest first.
+func BackupGenerations(backupPath string, logger log15.Logger) ([]*BackupGeneration, error) {
+	var gens []*BackupGeneration
+	err := withLocalBackup(backupPath, logger, func(localPath string) error {
+		var errl error
+		gens, errl = localBackupGenerations(localPath)
+		return errl
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if internal.InS3(backupPath) {
+		for _, gen := range gens {
+			gen.Path = backupGenerationPath(backupPath, gen.Time)
+		}
+	}
+	return gens, nil
+}
+
+// BackupGenerationAt returns the path of the newest of the given backup file's
+// generations that was made at or before the given time. Returns an Error with
+// Err ErrNoBackup if there isn't one.
+func BackupGenerationAt(backupPath string, t time.Time, logger log15.Logger) (string, error) {
+	gens, err := BackupGenerations(backupPath, logger)
+	if err != nil {
+		return "", err
+	}
+	for i := len(gens) - 1; i >= 0; i-- {
+		if !gens[i].Time.After(t) {
+			return gens[i].Path, nil
+		}
+	}
+	return "", Error{"BackupGenerationAt", backupPath, ErrNoBackup}
+}
+
+// DBSummary describes the contents of a database file.
+type DBSummary struct {
+	// SchemaVersion is the version of the database schema. Databases made by
+	// older versions of wr will be migrated when a server uses them.
+	SchemaVersion int
+
+	// Jobs is the total number of jobs.
+	Jobs int
+
+	// States holds the number of jobs in each state. Jobs that completed are
+	// counted as JobStateComplete.
+	States map[JobState]int
+
+	// RepGroups holds the number of jobs in each state, per RepGroup.
+	RepGroups map[string]map[JobState]int
+
+	// Problems describes any integrity issues with the file, and any jobs that
+	// could not be decoded.
+	Problems []string
+}
+
+// add counts the given job.
+func (s *DBSummary) add(job *Job, state JobState) {
+	s.Jobs++
+	s.States[state]++
+	rgStates, exists := s.RepGroups[job.RepGroup]
+	if !exists {
+		rgStates = make(map[JobState]int)
+		s.RepGroups[job.RepGroup] = rgStates
+	}
+	rgStates[state]++
+}
+
+// detectDBBackend returns DBBackendSQLite if the given file is a SQLite
+// database, otherwise DBBackendBolt.
+func detectDBBackend(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteFileHeader))
+	_, err = io.ReadFull(f, header)
+	if err == nil && bytes.Equal(header, sqliteFileHeader) {
+		return DBBackendSQLite, nil
+	}
+	return DBBackendBolt, nil
+}
+
+// VerifyDB checks the integrity of the given database file (typically a
+// backup, and possibly an S3 location, as per ServerConfig.DBFileBackup), which
+// must be of the given backend (one of our DBBackend* constants), and decodes
+// every job in it. The file itself is not altered.
+//
+// The returned summary describes the jobs in the file. If there were any
+// problems, they are listed in the summary and an Error with Err ErrBadBackup
+// is also returned.
+func VerifyDB(path string, backend string, logger log15.Logger) (*DBSummary, error) {
+	if logger == nil {
+		logger = log15.New()
+		logger.SetHandler(log15.DiscardHandler())
+	}
+
+	var summary *DBSummary
+	err := withLocalBackup(path, logger, func(localPath string) error {
+		var errv error
+		summary, errv = verifyLocalDB(localPath, backend)
+		return errv
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(summary.Problems) > 0 {
+		return summary, Error{"VerifyDB", path, ErrBadBackup}
+	}
+	return summary, nil
+}
+
+// verifyLocalDB does the work of VerifyDB() on a copy of the given local file.
+func verifyLocalDB(path string, backend string) (*DBSummary, error) {
+	if backend == "" {
+		backend = DBBackendBolt
+	}
+	detected, err := detectDBBackend(path)
+	if err != nil {
+		return nil, err
+	}
+	if detected != backend {
+		return nil, Error{"VerifyDB", path, ErrWrongBackend}
+	}
+
+	// opening the store can alter the file, so we work on a copy
+	tmpDir, err := os.MkdirTemp("", "wr_verify_db_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "db")
+	err = copyFile(path, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openDBStore(backend, tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer store.close()
+
+	summary := &DBSummary{
+		States:    make(map[JobState]int),
+		RepGroups: make(map[string]map[JobState]int),
+	}
+
+	summary.Problems, err = store.check()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.view(func(tx dbTx) error {
+		var errg error
+		summary.SchemaVersion, errg = getSchemaVersion(tx)
+		return errg
+	})
+	if err != nil {
+		return nil, err
+	}
+	if summary.SchemaVersion > dbSchemaVersion {
+		summary.Problems = append(summary.Problems, fmt.Sprintf("database schema version %d is newer than this version of wr supports (%d)", summary.SchemaVersion, dbSchemaVersion))
+	}
+
+	ch := dbCodecHandle(backend)
+	err = store.view(func(tx dbTx) error {
+		for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete} {
+			errs := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
+				dec := codec.NewDecoderBytes(v, ch)
+				job := &Job{}
+				errd := dec.Decode(job)
+				if errd != nil {
+					summary.Problems = append(summary.Problems, fmt.Sprintf("job %s in %s could not be decoded: %s", k, bucket, errd))
+					return true, nil
+				}
+
+				state := job.State
+				if bytes.Equal(bucket, bucketJobsComplete) {
+					state = JobStateComplete
+				}
+				summary.add(job, state)
+				return true, nil
+			})
+			if errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	return summary, err
+}
+
+// RestoreDB verifies the given database backup file (which may be an S3
+// location, as per ServerConfig.DBFileBackup) using VerifyDB(), and then, if
+// there were no problems, makes dbFile a copy of it. Any existing dbFile is
+// first renamed with a ".pre_restore" suffix. The server using dbFile must not
+// be running.
+//
+// The returned summary describes the restored jobs.
+func RestoreDB(from string, dbFile string, backend string, logger log15.Logger) (*DBSummary, error) {
+	if logger == nil {
+		logger = log15.New()
+		logger.SetHandler(log15.DiscardHandler())
+	}
+
+	var summary *DBSummary
+	err := withLocalBackup(from, logger, func(localPath string) error {
+		var errv error
+		summary, errv = verifyLocalDB(localPath, backend)
+		if errv != nil {
+			return errv
+		}
+		if len(summary.Problems) > 0 {
+			return Error{"RestoreDB", from, ErrBadBackup}
+		}
+
+		if _, errs := os.Stat(dbFile); errs == nil {
+			errr := os.Rename(dbFile, dbFile+".pre_restore")
+			if errr != nil {
+				return errr
+			}
+		}
+		errr := removeDBFile(dbFile)
+		if errr != nil {
+			return errr
+		}
+
+		tmpPath := dbFile + ".tmp"
+		errc := copyFile(localPath, tmpPath)
+		if errc != nil {
+			return errc
+		}
+		errc = os.Chmod(tmpPath, dbFilePermission)
+		if errc != nil {
+			return errc
+		}
+		return os.Rename(tmpPath, dbFile)
+	})
+	return summary, err
+}
@@ -0,0 +1,378 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for Budgets, which cap how much can be spent
+// running the jobs of particular RepGroups or users.
+//
+// Spending is judged against the running totals kept in cost.go. As a budget
+// nears its limit, a warning is posted as a scheduler message; once it reaches
+// its limit, the ready added callback stops scheduling runners for the jobs it
+// covers, and reserves them under a group no runner asks for, so they stay
+// pending until the budget is raised or removed.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// BudgetUnit* are the units a Budget's Limit can be in: BudgetUnitCost is in
+// the units of the configured CostRates, BudgetUnitCoreHours is in hours of
+// reserved cores.
+const (
+	BudgetUnitCost      = "cost"
+	BudgetUnitCoreHours = "corehours"
+)
+
+// BudgetWarnAt is the default fraction of a Budget's Limit that must be spent
+// before a warning is given.
+const BudgetWarnAt = 0.8
+
+// budgetHeldGroupPrefix prefixes the reserve group of jobs held back by an
+// exceeded budget; no runner will ever reserve jobs in such a group.
+const budgetHeldGroupPrefix = "!budget:"
+
+// Budget describes a limit on spending for jobs in RepGroups with a certain
+// prefix, or for jobs charged to a certain user.
+type Budget struct {
+	// Name uniquely identifies the budget.
+	Name string `json:"name"`
+
+	// RepGroup, if set, makes the budget cover jobs with RepGroups that start
+	// with this prefix.
+	RepGroup string `json:"rep_grp"`
+
+	// User, if set instead of RepGroup, makes the budget cover jobs charged to
+	// this user.
+	User string `json:"user"`
+
+	// Limit is the total that can be spent on the covered jobs before no more
+	// of them will be scheduled. A Limit of 0 stops them being scheduled
+	// regardless of spending.
+	Limit float64 `json:"limit"`
+
+	// Unit is one of the BudgetUnit* constants, defaulting to BudgetUnitCost.
+	Unit string `json:"unit"`
+
+	// WarnAt is the fraction of Limit that must be spent before a warning is
+	// given; defaults to BudgetWarnAt.
+	WarnAt float64 `json:"warn_at"`
+}
+
+// validate checks the budget makes sense, filling in defaults. Returns an
+// Error with Err ErrBadBudget if not.
+func (b *Budget) validate() error {
+	if b.Unit == "" {
+		b.Unit = BudgetUnitCost
+	}
+	if b.WarnAt == 0 {
+		b.WarnAt = BudgetWarnAt
+	}
+	if b.Name == "" || strings.Contains(b.Name, dbDelimiter) || (b.RepGroup == "") == (b.User == "") ||
+		b.Limit < 0 || b.WarnAt < 0 || b.WarnAt > 1 ||
+		(b.Unit != BudgetUnitCost && b.Unit != BudgetUnitCoreHours) {
+		return Error{"SetBudget", b.Name, ErrBadBudget}
+	}
+	return nil
+}
+
+// covers tells you if jobs with the given RepGroup and user count against
+// this budget.
+func (b *Budget) covers(repGroup, user string) bool {
+	if b.RepGroup != "" {
+		return strings.HasPrefix(repGroup, b.RepGroup)
+	}
+	return b.User == user
+}
+
+// spent works out how much of the budget has been spent, given current
+// totals.
+func (b *Budget) spent(totals *CostTotals) float64 {
+	perRepGroup, perUser := totals.RepGroups, totals.Users
+	if b.Unit == BudgetUnitCoreHours {
+		perRepGroup, perUser = totals.RepGroupCoreHours, totals.UserCoreHours
+	}
+
+	if b.RepGroup == "" {
+		return perUser[b.User]
+	}
+
+	var spent float64
+	for rg, amount := range perRepGroup {
+		if strings.HasPrefix(rg, b.RepGroup) {
+			spent += amount
+		}
+	}
+	return spent
+}
+
+// String describes the budget, for use in messages.
+func (b *Budget) String() string {
+	if b.RepGroup != "" {
+		return fmt.Sprintf("budget %s (RepGroups starting %s)", b.Name, b.RepGroup)
+	}
+	return fmt.Sprintf("budget %s (user %s)", b.Name, b.User)
+}
+
+// BudgetStatus describes a Budget along with how much of it has been spent.
+type BudgetStatus struct {
+	Budget   *Budget `json:"budget"`
+	Spent    float64 `json:"spent"`
+	Warned   bool    `json:"warned"`
+	Exceeded bool    `json:"exceeded"`
+}
+
+// budgetState is how the server keeps track of a Budget, so that it only
+// warns about it once.
+type budgetState struct {
+	budget   *Budget
+	warned   bool
+	exceeded bool
+}
+
+// status returns a BudgetStatus for this state given current totals.
+func (bs *budgetState) status(totals *CostTotals) *BudgetStatus {
+	b := *bs.budget
+	return &BudgetStatus{
+		Budget:   &b,
+		Spent:    bs.budget.spent(totals),
+		Warned:   bs.warned,
+		Exceeded: bs.exceeded,
+	}
+}
+
+// storeBudget stores a budget in the database, replacing any existing one with
+// the same name.
+func (db *db) storeBudget(b *Budget) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(b)
+	if err != nil {
+		return err
+	}
+	return db.storage.update(func(tx dbTx) error {
+		return tx.put(bucketBudgets, []byte(b.Name), encoded)
+	})
+}
+
+// removeBudget removes the named budget from the database.
+func (db *db) removeBudget(name string) error {
+	return db.storage.update(func(tx dbTx) error {
+		return tx.delete(bucketBudgets, []byte(name))
+	})
+}
+
+// retrieveBudgets gets all the budgets stored with storeBudget().
+func (db *db) retrieveBudgets() ([]*Budget, error) {
+	var budgets []*Budget
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(bucketBudgets, nil, nil, func(k, v []byte) (bool, error) {
+			dec := codec.NewDecoderBytes(v, db.ch)
+			b := &Budget{}
+			err := dec.Decode(b)
+			if err != nil {
+				return false, err
+			}
+			budgets = append(budgets, b)
+			return true, nil
+		})
+	})
+	return budgets, err
+}
+
+// loadBudgets initialises our budgets and spending totals from the database.
+func (s *Server) loadBudgets() error {
+	totals, err := s.db.costTotals()
+	if err != nil {
+		return err
+	}
+	budgets, err := s.db.retrieveBudgets()
+	if err != nil {
+		return err
+	}
+
+	s.bgmutex.Lock()
+	s.spending = totals
+	s.budgets = make(map[string]*budgetState)
+	for _, b := range budgets {
+		s.budgets[b.Name] = &budgetState{budget: b}
+	}
+	s.bgmutex.Unlock()
+
+	s.checkBudgets()
+	return nil
+}
+
+// noteSpending adds to our in-memory spending totals and then checks if that
+// caused any budgets to be exceeded.
+func (s *Server) noteSpending(repGroup, user string, cost, coreHours float64) {
+	s.bgmutex.Lock()
+	s.spending.add(repGroup, user, cost, coreHours)
+	s.bgmutex.Unlock()
+	s.checkBudgets()
+}
+
+// checkBudgets compares our budgets to our spending totals, posting a
+// scheduler message for any budget that newly needs a warning or reached its
+// limit. If any budget changed between being exceeded or not, the ready added
+// callback is triggered so that jobs are held back or released.
+func (s *Server) checkBudgets() {
+	var msgs []string
+	var changed bool
+	s.bgmutex.Lock()
+	for _, name := range s.budgetNames() {
+		bs := s.budgets[name]
+		spent := bs.budget.spent(s.spending)
+
+		if bs.budget.Limit == 0 {
+			if !bs.exceeded {
+				changed = true
+				bs.exceeded = true
+				msgs = append(msgs, fmt.Sprintf("%s has a limit of 0; no more of its jobs will be scheduled until it is raised", bs.budget))
+			}
+			bs.warned = false
+			continue
+		}
+
+		exceeded := spent >= bs.budget.Limit
+		if exceeded != bs.exceeded {
+			changed = true
+			bs.exceeded = exceeded
+			if exceeded {
+				msgs = append(msgs, fmt.Sprintf("%s has reached its limit of %g %s; no more of its jobs will be scheduled until it is raised", bs.budget, bs.budget.Limit, bs.budget.Unit))
+			}
+		}
+
+		warn := spent >= bs.budget.Limit*bs.budget.WarnAt
+		if warn && !bs.warned && !exceeded {
+			msgs = append(msgs, fmt.Sprintf("%s has used %.0f%% of its limit of %g %s", bs.budget, spent/bs.budget.Limit*100, bs.budget.Limit, bs.budget.Unit))
+		}
+		bs.warned = warn
+	}
+	s.bgmutex.Unlock()
+
+	for _, msg := range msgs {
+		s.Warn(msg)
+		s.schedulerMessage(msg)
+	}
+
+	if changed && s.q != nil {
+		s.q.TriggerReadyAddedCallback()
+	}
+}
+
+// budgetNames returns the names of our budgets in sorted order. You must hold
+// bgmutex when calling this.
+func (s *Server) budgetNames() []string {
+	names := make([]string, 0, len(s.budgets))
+	for name := range s.budgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exceededBudget returns the name of the first exceeded budget that covers
+// jobs with the given RepGroup and user, or blank if there isn't one.
+func (s *Server) exceededBudget(repGroup, user string) string {
+	s.bgmutex.RLock()
+	defer s.bgmutex.RUnlock()
+	for _, name := range s.budgetNames() {
+		bs := s.budgets[name]
+		if bs.exceeded && bs.budget.covers(repGroup, user) {
+			return name
+		}
+	}
+	return ""
+}
+
+// SetBudget adds a new budget, or updates an existing one with the same name,
+// eg. to raise its Limit. Jobs held back by the budget will be scheduled again
+// if it is no longer exceeded.
+func (s *Server) SetBudget(b *Budget) (*BudgetStatus, error) {
+	err := b.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.storeBudget(b)
+	if err != nil {
+		return nil, err
+	}
+
+	s.bgmutex.Lock()
+	bs, existed := s.budgets[b.Name]
+	if existed {
+		bs.budget = b
+	} else {
+		bs = &budgetState{budget: b}
+		s.budgets[b.Name] = bs
+	}
+	s.bgmutex.Unlock()
+
+	s.checkBudgets()
+
+	s.bgmutex.RLock()
+	defer s.bgmutex.RUnlock()
+	return bs.status(s.spending), nil
+}
+
+// RemoveBudget removes the named budget, releasing any jobs it was holding
+// back. Returns true if the budget existed.
+func (s *Server) RemoveBudget(name string) (bool, error) {
+	s.bgmutex.RLock()
+	bs, existed := s.budgets[name]
+	s.bgmutex.RUnlock()
+	if !existed {
+		return false, nil
+	}
+
+	err := s.db.removeBudget(name)
+	if err != nil {
+		return false, err
+	}
+
+	s.bgmutex.Lock()
+	delete(s.budgets, name)
+	s.bgmutex.Unlock()
+
+	if bs.exceeded {
+		s.q.TriggerReadyAddedCallback()
+	}
+	return true, nil
+}
+
+// Budgets tells you about all the budgets that have been set with SetBudget(),
+// sorted by name, along with how much of them has been spent. If name is
+// supplied, only the budget with that name is returned (if it exists).
+func (s *Server) Budgets(name string) []*BudgetStatus {
+	s.bgmutex.RLock()
+	defer s.bgmutex.RUnlock()
+	statuses := []*BudgetStatus{}
+	for _, n := range s.budgetNames() {
+		if name != "" && n != name {
+			continue
+		}
+		statuses = append(statuses, s.budgets[n].status(s.spending))
+	}
+	return statuses
+}
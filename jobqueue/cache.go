@@ -0,0 +1,380 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for memoizing the results of jobs, so that
+// identical jobs can be completed without running their Cmd again.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	resultCacheRecordFile = "result.json"
+	resultCacheOutputsDir = "outputs"
+	resultCacheTmpPrefix  = ".tmp."
+)
+
+// ResultCache describes where and how the results of a Job's Cmd are memoized.
+//
+// Before the Cmd runs, a cache key is calculated from the Job's Key(), the
+// content of its Inputs, its Outputs and its EnvOverride (the environment
+// variables you set specifically for the job). If a previous run of the Cmd
+// with the same cache key succeeded, its Outputs are restored from Dir and the
+// Job is completed without running its Cmd, with Job.Cached set to true.
+// Otherwise the Cmd is run and, if it succeeds, its Outputs are stored in Dir
+// for future Jobs.
+//
+// Since a Job's Key() doesn't include its Cwd unless CwdMatters is true, this
+// lets the same expensive Cmd run in different Cwds (eg. for different
+// projects) only be run once.
+type ResultCache struct {
+	// Dir is the directory that results are stored in. It must be accessible
+	// from every host that runs the job, eg. on a shared disk or in a mounted
+	// S3 bucket.
+	Dir string
+
+	// Inputs are the paths to the files (or directories) that the Cmd reads.
+	// Relative paths are relative to the directory the Cmd runs in. All must
+	// exist, or results will not be memoized.
+	Inputs []string
+
+	// Outputs are the paths to the files (or directories) that the Cmd
+	// creates, which get stored in and restored from Dir. Relative paths are
+	// relative to the directory the Cmd runs in.
+	Outputs []string
+
+	// Link, if true, restores Outputs by symlinking to them in Dir instead of
+	// copying them. Only use this if Dir is on a disk that will always be
+	// accessible where you use the outputs.
+	Link bool
+}
+
+// resultCacheRecord is stored alongside the outputs of a cached result, and
+// its presence indicates that the result is complete.
+type resultCacheRecord struct {
+	Cmd     string    `json:"cmd"`
+	Outputs []string  `json:"outputs"`
+	Host    string    `json:"host"`
+	Stored  time.Time `json:"stored"`
+}
+
+// key calculates the cache key of the given job when its Cmd runs in the given
+// directory. Returns an error if any Inputs don't exist.
+func (rc *ResultCache) key(job *Job, dir string) (string, error) {
+	overrides, err := job.envCurrentOverrides()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(overrides)
+
+	h := sha256.New()
+	writeField := func(s string) {
+		_, _ = io.WriteString(h, s)
+		_, _ = h.Write([]byte{0})
+	}
+
+	writeField(job.Key())
+	for _, env := range overrides {
+		writeField("env:" + env)
+	}
+	for _, output := range rc.Outputs {
+		writeField("out:" + output)
+	}
+
+	for _, input := range rc.Inputs {
+		writeField("in:" + input)
+		err = hashPathContent(h, resultCachePath(input, dir))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPathContent writes the content of the file at path to w, or if path is a
+// directory, the relative paths and content of all the files within it.
+func hashPathContent(w io.Writer, path string) error {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, rel+"\x00"+strconv.FormatInt(info.Size(), 10)+"\x00")
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p) // #nosec G304 we're supposed to read user-specified paths
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		errc := f.Close()
+		if err == nil {
+			err = errc
+		}
+		return err
+	})
+}
+
+// resultCachePath returns path if absolute, otherwise path within dir.
+func resultCachePath(path, dir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// resultDir returns the directory a result with the given key is stored in.
+func (rc *ResultCache) resultDir(key string) string {
+	return filepath.Join(rc.Dir, key[:2], key)
+}
+
+// restore checks if there is a stored result with the given key, and if so
+// puts its outputs in place, relative to the given directory. Returns true if
+// a result was restored.
+func (rc *ResultCache) restore(key, dir string) (bool, error) {
+	resultDir := rc.resultDir(key)
+	if _, err := os.Stat(filepath.Join(resultDir, resultCacheRecordFile)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for i, output := range rc.Outputs {
+		src := filepath.Join(resultDir, resultCacheOutputsDir, strconv.Itoa(i))
+		dest := resultCachePath(output, dir)
+
+		err := os.RemoveAll(dest)
+		if err != nil {
+			return false, err
+		}
+		err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+		if err != nil {
+			return false, err
+		}
+
+		if rc.Link {
+			err = os.Symlink(src, dest)
+		} else {
+			err = copyPath(src, dest)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// store copies the outputs of a job's Cmd that ran in the given directory in
+// to our Dir as the result with the given key. Results are first written to a
+// temporary directory which is then renamed, so that concurrent jobs never see
+// partial results; if another job stored the result first, ours is discarded.
+func (rc *ResultCache) store(key, dir string, job *Job) error {
+	resultDir := rc.resultDir(key)
+	if _, err := os.Stat(filepath.Join(resultDir, resultCacheRecordFile)); err == nil {
+		return nil
+	}
+
+	parent := filepath.Dir(resultDir)
+	err := os.MkdirAll(parent, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(parent, resultCacheTmpPrefix+key+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// (after a successful rename, this does nothing)
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// (MkdirTemp makes a dir only we can read, but the result may be used by
+	// other users' jobs)
+	err = os.Chmod(tmpDir, 0755) // #nosec G302
+	if err != nil {
+		return err
+	}
+
+	outputsDir := filepath.Join(tmpDir, resultCacheOutputsDir)
+	err = os.Mkdir(outputsDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	for i, output := range rc.Outputs {
+		err = copyPath(resultCachePath(output, dir), filepath.Join(outputsDir, strconv.Itoa(i)))
+		if err != nil {
+			return fmt.Errorf("could not store output %s: %w", output, err)
+		}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = localhost
+	}
+	job.RLock()
+	record := &resultCacheRecord{Cmd: job.Cmd, Outputs: rc.Outputs, Host: host, Stored: time.Now()}
+	job.RUnlock()
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(tmpDir, resultCacheRecordFile), b, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpDir, resultDir)
+	if err != nil {
+		if _, errs := os.Stat(filepath.Join(resultDir, resultCacheRecordFile)); errs == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// copyPath copies the file or directory at src to dest, preserving file modes.
+// Symlinks are copied as the files they point to.
+func copyPath(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return copyFileWithMode(src, dest, info.Mode())
+	}
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			info, err = os.Stat(p)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return copyPath(p, target)
+			}
+		}
+		return copyFileWithMode(p, target, info.Mode())
+	})
+}
+
+// copyFileWithMode copies the file at src to dest, then gives it the given
+// mode.
+func copyFileWithMode(src, dest string, mode os.FileMode) error {
+	err := copyFile(src, dest)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dest, mode.Perm())
+}
+
+// String returns a description of the ResultCache for display to users.
+func (rc *ResultCache) String() string {
+	var parts []string
+	if len(rc.Inputs) > 0 {
+		parts = append(parts, "inputs: "+strings.Join(rc.Inputs, ", "))
+	}
+	if len(rc.Outputs) > 0 {
+		parts = append(parts, "outputs: "+strings.Join(rc.Outputs, ", "))
+	}
+	if rc.Link {
+		parts = append(parts, "linked")
+	}
+	if len(parts) == 0 {
+		return rc.Dir
+	}
+	return rc.Dir + " (" + strings.Join(parts, "; ") + ")"
+}
+
+// completeFromCache is used by Execute() when the outputs of the job's Cmd were
+// restored from its ResultCache: instead of running the Cmd, the job is
+// started and immediately archived as Cached.
+func (c *Client) completeFromCache(job *Job, actualCwd string) error {
+	err := c.Started(job, os.Getpid())
+	if err != nil {
+		_, erru := job.Unmount(true)
+		if erru != nil {
+			err = fmt.Errorf("%w (and unmounting the job failed: %s)", err, erru)
+		}
+		return err
+	}
+
+	// we run success behaviours and unmount (uploading the restored outputs)
+	// as if we'd run the cmd
+	var myerr error
+	berr := job.TriggerBehaviours(true)
+	if berr != nil {
+		myerr = fmt.Errorf("behaviour(s) had problem(s): %w", berr)
+	}
+	_, unmountErr := job.Unmount()
+	if unmountErr != nil {
+		errr := c.Release(job, &JobEndState{Cwd: actualCwd, Exitcode: -2, EndTime: time.Now(), Exited: true}, FailReasonUpload)
+		if errr != nil {
+			return fmt.Errorf("unmounting after restoring cached results failed: %w (and releasing the job failed: %s)", unmountErr, errr)
+		}
+		return fmt.Errorf("unmounting after restoring cached results failed: %w", unmountErr)
+	}
+
+	err = c.Archive(job, &JobEndState{Cwd: actualCwd, EndTime: time.Now(), Exited: true, Cached: true})
+	if err != nil {
+		return fmt.Errorf("command [%s] had its results restored from the cache, but will need to be rerun due to a jobqueue server error: %w", job.Cmd, err)
+	}
+	return myerr
+}
@@ -109,6 +109,17 @@ type clientRequest struct {
 	File                    []byte // compressed bytes of file content
 	Token                   []byte
 	LimitGroup              string
+	ReqGroup                string
+	ReqStatsFilter          *ReqGroupStatsFilter
+	Observations            []*ReqGroupObservation
+	Budget                  *Budget
+	Probe                   *LimitGroupProbe
+	Dependencies            Dependencies
+	Protector               string
+	Receipt                 string
+	NumTokens               int
+	TokenJobKey             string
+	NumJobs                 int
 	Method                  string
 	SchedulerGroup          string
 	State                   JobState
@@ -116,7 +127,9 @@ type clientRequest struct {
 	CloudServerID           string
 	Job                     *Job
 	JobEndState             *JobEndState
+	JobEndStates            []*JobEndState
 	Modifier                *JobModifier
+	History                 *JobSearch
 	Limit                   int
 	Timeout                 time.Duration
 	ClientID                uuid.UUID
@@ -127,6 +140,11 @@ type clientRequest struct {
 	Search                  bool
 	ConfirmDeadCloudServers bool
 	ReturnIDs               bool // when adding jobs, return the IDs of the added jobs
+	DryRun                  bool // when adding jobs, only report what would happen
+	ReplicaID               string
+	ReplicaSeq              uint64
+	ReplicaSnapshot         string
+	ReplicaOffset           int64
 }
 
 // Client represents the client side of the socket that the jobqueue server is
@@ -138,11 +156,18 @@ type Client struct {
 	sock        mangos.Socket
 	sync.Mutex
 	teMutex    sync.Mutex // to protect Touch() from other methods during Execute()
+	hmutex     sync.Mutex // to protect heldJobs, stopHolding and the deferred* fields
+	heldJobs   map[string]*Job
+	stopHold   chan struct{}
+	deferArch  bool
+	deferred   []*Job
+	deferredES []*JobEndState
 	token      []byte
 	ServerInfo *ServerInfo
 	host       string
 	port       string
 	args       []string // allowing internal reconnects
+	timeout    time.Duration
 	log15.Logger
 }
 
@@ -226,6 +251,7 @@ func Connect(addr, caFile, certDomain string, token []byte, timeout time.Duratio
 		host:     addrParts[0],
 		port:     addrParts[1],
 		args:     []string{addr, caFile, certDomain},
+		timeout:  timeout,
 	}
 
 	c.Logger = log15.New()
@@ -268,6 +294,12 @@ func ConnectUsingConfig(deployment string, timeout time.Duration, logger log15.L
 // Disconnect closes the connection to the jobqueue server. It is CRITICAL that
 // you call Disconnect() before calling Connect() again in the same process.
 func (c *Client) Disconnect() error {
+	c.hmutex.Lock()
+	if c.stopHold != nil {
+		close(c.stopHold)
+		c.stopHold = nil
+	}
+	c.hmutex.Unlock()
 	c.Lock()
 	defer c.Unlock()
 	return c.sock.Close()
@@ -376,6 +408,124 @@ func (c *Client) BackupDB(path string) error {
 	return os.Rename(tmpPath, path)
 }
 
+// CompactDB tells the server to rewrite its database file so that it takes up
+// as little space as possible, which it does while continuing to serve
+// requests. This can take a long time for large databases, so you should
+// Connect() with a suitably long timeout.
+func (c *Client) CompactDB() (*CompactionResult, error) {
+	resp, err := c.request(&clientRequest{Method: "compact"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Compaction, nil
+}
+
+// RecommendationAccuracy tells you how well the memory, disk and time reserved
+// for past jobs in the given ReqGroup matched what they actually used, so you
+// can see if the requirements wr learns are any good. Supply a blank reqGroup
+// to get the accuracy for all ReqGroups.
+func (c *Client) RecommendationAccuracy(reqGroup string) ([]*ReqGroupAccuracy, error) {
+	resp, err := c.request(&clientRequest{Method: "recaccuracy", ReqGroup: reqGroup})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Accuracy, nil
+}
+
+// GetReqGroupStats tells you what the server has learned about the memory,
+// disk and time used by jobs in the given ReqGroup, including what it would
+// currently recommend reserving. Supply a blank reqGroup to get the stats of
+// all ReqGroups.
+func (c *Client) GetReqGroupStats(reqGroup string) ([]*ReqGroupStats, error) {
+	resp, err := c.request(&clientRequest{Method: "getreqstats", ReqGroup: reqGroup})
+	if err != nil {
+		return nil, err
+	}
+	return resp.ReqStats, nil
+}
+
+// RemoveReqGroupStats makes the server forget the observations of resource
+// usage that match the given filter, eg. all those of a ReqGroup, or just those
+// of jobs that ran while a buggy version of a tool was in use. Returns the
+// number of observations removed.
+func (c *Client) RemoveReqGroupStats(filter *ReqGroupStatsFilter) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "removereqstats", ReqStatsFilter: filter})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Removed, nil
+}
+
+// SeedReqGroupStats gives the server observations of resource usage to learn
+// from, as if jobs had run with that usage, so that it can make good
+// recommendations for the first jobs of a ReqGroup. See
+// ReadReqGroupObservations() for getting these from exported job data. Returns
+// the number of observations stored.
+func (c *Client) SeedReqGroupStats(observations []*ReqGroupObservation) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "seedreqstats", Observations: observations})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Added, nil
+}
+
+// GetBudgets tells you about the budgets that have been set with SetBudget(),
+// including how much of each has been spent. Supply a blank name to get all of
+// them.
+func (c *Client) GetBudgets(name string) ([]*BudgetStatus, error) {
+	resp, err := c.request(&clientRequest{Method: "getbudgets", Budget: &Budget{Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Budgets, nil
+}
+
+// SetBudget creates or updates a budget that limits how much can be spent on
+// the jobs in RepGroups with a certain prefix, or charged to a certain user.
+// As spending approaches the budget's limit, a warning will appear amongst the
+// scheduler messages, and once the limit is reached no more runners will be
+// spawned for those jobs: they will remain pending with their BudgetExceeded
+// set until the budget is raised or removed.
+func (c *Client) SetBudget(budget *Budget) (*BudgetStatus, error) {
+	resp, err := c.request(&clientRequest{Method: "setbudget", Budget: budget})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Budgets) != 1 {
+		return nil, Error{"SetBudget", budget.Name, ErrBadBudget}
+	}
+	return resp.Budgets[0], nil
+}
+
+// RemoveBudget removes the budget with the given name, allowing any jobs it
+// was holding back to run. Returns the number of budgets removed (0 or 1).
+func (c *Client) RemoveBudget(name string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "removebudget", Budget: &Budget{Name: name}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Removed, nil
+}
+
+// replicate is used by Standby() to get the changes to the server's database
+// since the change with the given sequence number of the database with the
+// given id, waiting up to wait for there to be any. The response will instead
+// contain the id and size of a snapshot of the complete database, to be
+// fetched with replicateChunk(), if the changes are not available.
+func (c *Client) replicate(id string, seq uint64, wait time.Duration) (*serverResponse, error) {
+	return c.request(&clientRequest{Method: "replicate", ReplicaID: id, ReplicaSeq: seq, Timeout: wait})
+}
+
+// replicateChunk is used by Standby() to get the part of the snapshot with the
+// given id that starts at offset.
+func (c *Client) replicateChunk(id string, offset int64) ([]byte, error) {
+	resp, err := c.request(&clientRequest{Method: "replicatechunk", ReplicaSnapshot: id, ReplicaOffset: offset})
+	if err != nil {
+		return nil, err
+	}
+	return resp.DB, nil
+}
+
 // Add adds new jobs to the job queue, but only if those jobs aren't already in
 // there.
 //
@@ -389,6 +539,8 @@ func (c *Client) BackupDB(path string) error {
 // replace the old one in the database. To have such jobs skipped as "existed"
 // instead, supply ignoreComplete as true.
 //
+// Any jobs without a User will have it set to the name of the current user.
+//
 // The envVars argument is a slice of ("key=value") strings with the environment
 // variables you want to be set when the job's Cmd actually runs. Typically you
 // would pass in os.Environ().
@@ -397,6 +549,7 @@ func (c *Client) Add(jobs []*Job, envVars []string, ignoreComplete bool) (added,
 	if err != nil {
 		return 0, 0, err
 	}
+	setJobUsers(jobs)
 	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete})
 	if err != nil {
 		return 0, 0, err
@@ -412,6 +565,7 @@ func (c *Client) AddAndReturnIDs(jobs []*Job, envVars []string, ignoreComplete b
 	if err != nil {
 		return nil, err
 	}
+	setJobUsers(jobs)
 	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, Env: compressed, IgnoreComplete: ignoreComplete, ReturnIDs: true})
 	if err != nil {
 		return nil, err
@@ -419,6 +573,34 @@ func (c *Client) AddAndReturnIDs(jobs []*Job, envVars []string, ignoreComplete b
 	return resp.AddedIDs, err
 }
 
+// AddDryRun is like Add(), except that nothing is actually added. Instead the
+// jobs are validated in the same way (so you get the same errors) and you get
+// back a report of how many would be added, which already exist or are
+// complete, which of their dependencies can't be satisfied, and what
+// requirements the jobs of each ReqGroup would be scheduled with.
+func (c *Client) AddDryRun(jobs []*Job, ignoreComplete bool) (*AddDryRun, error) {
+	setJobUsers(jobs)
+	resp, err := c.request(&clientRequest{Method: "add", Jobs: jobs, IgnoreComplete: ignoreComplete, DryRun: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.DryRun, err
+}
+
+// setJobUsers sets the User of any of the given jobs that don't have one to the
+// current user.
+func setJobUsers(jobs []*Job) {
+	user, err := internal.Username()
+	if err != nil {
+		return
+	}
+	for _, job := range jobs {
+		if job.User == "" {
+			job.User = user
+		}
+	}
+}
+
 // Modify modifies previously Add()ed jobs that are incomplete and not currently
 // running.
 //
@@ -490,6 +672,143 @@ func (c *Client) ReserveScheduled(timeout time.Duration, schedulerGroup string)
 	return resp.Job, err
 }
 
+// ReserveMany is like ReserveScheduled() (or Reserve() if schedulerGroup is
+// blank), but reserves up to n jobs at once, for when you'll run many quick
+// jobs one after the other and want to avoid the overhead of reserving each
+// individually. It only waits for the first job; you get back that and as
+// many of the following jobs as were ready at the time.
+//
+// Each job has its own ttr, so until you Execute() a returned job (or
+// otherwise Archive(), Release() or Bury() it), it is Touch()ed for you in the
+// background.
+func (c *Client) ReserveMany(timeout time.Duration, schedulerGroup string, n int) ([]*Job, error) {
+	fr := false
+	if !c.hasReserved {
+		fr = true
+		c.hasReserved = true
+	}
+	resp, err := c.request(&clientRequest{Method: "reservemany", Timeout: timeout, SchedulerGroup: schedulerGroup, NumJobs: n, FirstReserve: fr})
+	if err != nil {
+		return nil, err
+	}
+	c.hold(resp.Jobs...)
+	return resp.Jobs, err
+}
+
+// hold starts touching the given jobs in the background, until they are
+// unhold()en.
+func (c *Client) hold(jobs ...*Job) {
+	if len(jobs) == 0 {
+		return
+	}
+	c.hmutex.Lock()
+	defer c.hmutex.Unlock()
+	if c.heldJobs == nil {
+		c.heldJobs = make(map[string]*Job)
+	}
+	for _, job := range jobs {
+		c.heldJobs[job.Key()] = job
+	}
+	if c.stopHold == nil {
+		c.stopHold = make(chan struct{})
+		go c.touchHeld(c.stopHold)
+	}
+}
+
+// unhold stops touching the given job in the background.
+func (c *Client) unhold(job *Job) {
+	c.hmutex.Lock()
+	defer c.hmutex.Unlock()
+	delete(c.heldJobs, job.Key())
+}
+
+// touchHeld touches all our held jobs every ClientTouchInterval, until stop is
+// closed.
+func (c *Client) touchHeld(stop chan struct{}) {
+	ticker := time.NewTicker(ClientTouchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.hmutex.Lock()
+			jobs := make([]*Job, 0, len(c.heldJobs))
+			for _, job := range c.heldJobs {
+				jobs = append(jobs, job)
+			}
+			c.hmutex.Unlock()
+
+			for _, job := range jobs {
+				if _, err := c.Touch(job); err != nil {
+					c.Warn("failed to touch held job", "job", job.Key(), "err", err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SetDeferArchives, when supplied true, makes Execute() not Archive() jobs
+// that ran successfully straight away. Instead they wait (being Touch()ed in
+// the background) until you call FlushArchives(), which archives them all in
+// one go. This is much faster when you Execute() many quick jobs, eg. those
+// from ReserveMany().
+func (c *Client) SetDeferArchives(deferArchives bool) {
+	c.hmutex.Lock()
+	defer c.hmutex.Unlock()
+	c.deferArch = deferArchives
+}
+
+// deferArchive records that we should archive the given job when
+// FlushArchives() is called, if we're deferring archives. Returns false if we
+// aren't.
+func (c *Client) deferArchive(job *Job, jes *JobEndState) (bool, error) {
+	c.hmutex.Lock()
+	deferring := c.deferArch
+	c.hmutex.Unlock()
+	if !deferring {
+		return false, nil
+	}
+
+	if err := c.ended(job, jes); err != nil {
+		return true, err
+	}
+
+	c.hmutex.Lock()
+	c.deferred = append(c.deferred, job)
+	c.deferredES = append(c.deferredES, jes)
+	c.hmutex.Unlock()
+	c.hold(job)
+	return true, nil
+}
+
+// FlushArchives archives all the jobs that Execute() ran successfully since
+// SetDeferArchives(true) or the last FlushArchives(). It returns the keys of
+// any jobs that could not be archived, and why.
+//
+// If none of the jobs could be archived (eg. there was an error communicating
+// with the server, or the server failed to write to its database), the jobs
+// remain waiting to be archived and you can try again later.
+func (c *Client) FlushArchives() (map[string]string, error) {
+	c.hmutex.Lock()
+	jobs, jess := c.deferred, c.deferredES
+	c.hmutex.Unlock()
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	failed, err := c.archiveMany(jobs, jess)
+	if err != nil {
+		return nil, err
+	}
+
+	c.hmutex.Lock()
+	c.deferred = c.deferred[len(jobs):]
+	c.deferredES = c.deferredES[len(jess):]
+	c.hmutex.Unlock()
+	return failed, nil
+}
+
 // Execute runs the given Job's Cmd and blocks until it exits. Then any Job
 // Behaviours get triggered as appropriate for the exit status.
 //
@@ -541,6 +860,10 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		return Error{"Execute", job.Key(), ErrMustReserve}
 	}
 
+	// we'll touch the job ourselves from now on, if it came from
+	// ReserveMany()
+	c.unhold(job)
+
 	// we support arbitrary shell commands that may include semi-colons,
 	// quoted stuff and pipes, so it's best if we just pass it to bash
 	jc := job.Cmd
@@ -836,8 +1159,28 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 			"LSF_BINDIR=" + prependPath,
 		})
 	}
+	env = envOverride(env, []string{JobKeyEnvVar + "=" + job.Key()})
 	cmd.Env = env
 
+	// if the results of an identical earlier run of the cmd were memoized,
+	// restore them and complete the job without running the cmd
+	var cacheKey string
+	if job.ResultCache != nil {
+		var errk error
+		cacheKey, errk = job.ResultCache.key(job, cmd.Dir)
+		if errk != nil {
+			logger.Warn("could not calculate result cache key; results will not be memoized", "err", errk)
+			cacheKey = ""
+		} else {
+			restored, errr := job.ResultCache.restore(cacheKey, cmd.Dir)
+			if errr != nil {
+				logger.Warn("could not restore cached results; will run the cmd instead", "err", errr)
+			} else if restored {
+				return c.completeFromCache(job, actualCwd)
+			}
+		}
+	}
+
 	// if docker monitoring has been requested, try and get the docker client
 	// now and fail early if we can't
 	var dockerClient *container.Operator
@@ -1257,6 +1600,15 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		myerr = nil
 	}
 
+	// memoize the results of a successful run, before any behaviours might
+	// clean them up
+	if doarchive && cacheKey != "" {
+		errc := job.ResultCache.store(cacheKey, cmd.Dir, job)
+		if errc != nil {
+			logger.Warn("could not store results in the result cache", "err", errc)
+		}
+	}
+
 	finalStdErr := bytes.TrimSpace(stderr.Bytes())
 
 	if killErr != nil {
@@ -1395,7 +1747,11 @@ func (c *Client) Execute(ctx context.Context, job *Job, shell string) error {
 		case dorelease:
 			err = c.Release(job, jes, failreason) // which buries after job.Retries fails in a row
 		case doarchive:
-			err = c.Archive(job, jes)
+			var deferred bool
+			deferred, err = c.deferArchive(job, jes)
+			if !deferred {
+				err = c.Archive(job, jes)
+			}
 		}
 		if err != nil {
 			logger.Error("failed to update server with cmd's final state", "err", err)
@@ -1549,6 +1905,7 @@ type JobEndState struct {
 	Stdout   []byte
 	Stderr   []byte
 	Exited   bool
+	Cached   bool // true if the Cmd wasn't run because its results were restored from its ResultCache
 }
 
 // ended updates a Job for the benefit of the client only; this has no effect on
@@ -1568,6 +1925,7 @@ func (c *Client) ended(job *Job, jes *JobEndState) error {
 	job.PeakDisk = jes.PeakDisk
 	job.CPUtime = jes.CPUtime
 	job.EndTime = jes.EndTime
+	job.Cached = jes.Cached
 	if jes.Cwd != "" {
 		job.ActualCwd = jes.Cwd
 	}
@@ -1600,6 +1958,7 @@ func (c *Client) Archive(job *Job, jes *JobEndState) error {
 	defer c.teMutex.Unlock()
 	job.RLock()
 	defer job.RUnlock()
+	c.unhold(job)
 	_, err = c.request(&clientRequest{Method: "jarchive", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
@@ -1608,6 +1967,49 @@ func (c *Client) Archive(job *Job, jes *JobEndState) error {
 	return err
 }
 
+// ArchiveMany is like Archive(), but archives many jobs in one go, which is
+// much faster than archiving each individually. jess must hold the end state
+// of each of the jobs, in the same order. Returns the keys of any jobs that
+// could not be archived, and why.
+func (c *Client) ArchiveMany(jobs []*Job, jess []*JobEndState) (map[string]string, error) {
+	if len(jobs) != len(jess) {
+		return nil, Error{"ArchiveMany", "", ErrBadRequest}
+	}
+	for i, job := range jobs {
+		if err := c.ended(job, jess[i]); err != nil {
+			return nil, err
+		}
+	}
+	return c.archiveMany(jobs, jess)
+}
+
+// archiveMany does the work of ArchiveMany() for jobs that have already been
+// ended().
+func (c *Client) archiveMany(jobs []*Job, jess []*JobEndState) (map[string]string, error) {
+	c.teMutex.Lock()
+	defer c.teMutex.Unlock()
+	for _, job := range jobs {
+		job.RLock()
+	}
+	resp, err := c.request(&clientRequest{Method: "jarchivemany", Jobs: jobs, JobEndStates: jess})
+	for _, job := range jobs {
+		job.RUnlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		c.unhold(job)
+		if _, failed := resp.Failed[job.Key()]; !failed {
+			job.Lock()
+			job.State = JobStateComplete
+			job.Unlock()
+		}
+	}
+	return resp.Failed, err
+}
+
 // Release places a job back on the jobqueue, for use when you can't handle the
 // job right now (eg. there was a suspected transient error) but maybe someone
 // else can later. Note that you must reserve a job before you can release it.
@@ -1625,6 +2027,7 @@ func (c *Client) Release(job *Job, jes *JobEndState, failreason string) error {
 	job.Lock()
 	defer job.Unlock()
 	job.FailReason = failreason
+	c.unhold(job)
 	_, err = c.request(&clientRequest{Method: "jrelease", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
@@ -1662,6 +2065,7 @@ func (c *Client) Bury(job *Job, jes *JobEndState, failreason string, stderr ...e
 			return err
 		}
 	}
+	c.unhold(job)
 	_, err = c.request(&clientRequest{Method: "jbury", Job: job, JobEndState: jes})
 	if err != nil {
 		return err
@@ -1773,6 +2177,18 @@ func (c *Client) GetByRepGroup(repgroup string, subStr bool, limit int, state Jo
 	return resp.Jobs, err
 }
 
+// GetDependencyGraph gets the graph of the Jobs in the given RepGroup (or, if
+// subStr is true, all RepGroups that the supplied repgroup is a substring of)
+// and the things they depend on, which you can Render() to see where a
+// pipeline is blocked.
+func (c *Client) GetDependencyGraph(repgroup string, subStr bool) (*DependencyGraph, error) {
+	resp, err := c.request(&clientRequest{Method: "getgraph", Job: &Job{RepGroup: repgroup}, Search: subStr})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Graph, err
+}
+
 // GetIncomplete gets all Jobs that are currently in the jobqueue, ie. excluding
 // those that are complete and have been Archive()d. The args are as in
 // GetByRepGroup().
@@ -1784,12 +2200,46 @@ func (c *Client) GetIncomplete(limit int, state JobState, getStd bool, getEnv bo
 	return resp.Jobs, err
 }
 
+// SearchHistory gets jobs that have exited (successfully or not) and match the
+// given search, in the order they ended; see JobSearch for details. getStd and
+// getEnv are as in GetByRepGroup().
+//
+// If the search has a Limit and there may be more matching jobs, the returned
+// string will be non-blank; set it as the search's After value and call this
+// again to get the next page of results.
+func (c *Client) SearchHistory(js *JobSearch, getStd bool, getEnv bool) ([]*Job, string, error) {
+	resp, err := c.request(&clientRequest{Method: "gethist", History: js, GetStd: getStd, GetEnv: getEnv})
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Jobs, resp.Next, err
+}
+
+// ExportHistory exports the jobs that have exited and match the given search,
+// in the order they ended, using the given exporter. The search's Limit and
+// After are ignored: jobs are retrieved from the server a page at a time, so
+// that any number of jobs can be exported using bounded memory. You must
+// Close() the exporter yourself afterwards.
+func (c *Client) ExportHistory(js *JobSearch, exporter JobExporter) error {
+	return exportHistory(js, exporter, func(page *JobSearch) ([]*Job, string, error) {
+		return c.SearchHistory(page, false, false)
+	})
+}
+
 // GetOrSetLimitGroup takes the name of a limit group and returns the current
 // limit for that group. If the group isn't known about, returns -1.
 //
 // If the name is suffixed with :n, where n is an integer, then the limit of
 // the group is set to n, and then n is returned. Setting n to -1 makes the
 // group forgotten about, effectively making it unlimited.
+//
+// The name can instead (or additionally, after :n) be suffixed with :c/d, where
+// c is an integer count and d is a duration like 1m, to limit how many jobs in
+// the group can start within any period of d to c, eg. "irods:50:100/1m". A
+// group with only a rate limit has a limit of -1. Setting just :n removes any
+// rate limit.
+//
+// Any weight the name is suffixed with (see Job.LimitGroups) is ignored.
 func (c *Client) GetOrSetLimitGroup(group string) (int, error) {
 	resp, err := c.request(&clientRequest{Method: "getsetlg", LimitGroup: group})
 	if err != nil {
@@ -1809,6 +2259,165 @@ func (c *Client) GetLimitGroups() (map[string]int, error) {
 	return resp.LimitGroups, err
 }
 
+// GetLimitGroupRates returns the rate limits of all currently known about
+// limit groups that have one, in the form "count/duration".
+func (c *Client) GetLimitGroupRates() (map[string]string, error) {
+	resp, err := c.request(&clientRequest{Method: "getlgs"})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.LimitRates, err
+}
+
+// GetLimitGroupUsage returns how many units of all currently known about limit
+// groups are being used by running jobs. Jobs use 1 unit of each of their
+// limit groups, unless they were given a weight (see Job.LimitGroups).
+func (c *Client) GetLimitGroupUsage() (map[string]int, error) {
+	resp, err := c.request(&clientRequest{Method: "getlgs"})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.LimitUsage, err
+}
+
+// SetLimitGroupProbe makes the server periodically set the limit of a limit
+// group to the integer output by a shell command or returned by a URL, eg. to
+// limit how many jobs use a shared resource based on how busy it currently is.
+// The probe is run straight away in the background (use GetLimitGroupProbes()
+// to find out the limit it found, or why it failed), and then again every
+// probe TTL, until removed with RemoveLimitGroupProbe(). Failed runs leave the
+// limit unchanged.
+func (c *Client) SetLimitGroupProbe(probe *LimitGroupProbe) (*LimitGroupProbeStatus, error) {
+	resp, err := c.request(&clientRequest{Method: "setprobe", Probe: probe})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Probes) != 1 {
+		return nil, Error{"SetLimitGroupProbe", probe.Group, ErrBadProbe}
+	}
+	return resp.Probes[0], nil
+}
+
+// GetLimitGroupProbes tells you about the probes that have been set with
+// SetLimitGroupProbe(), including their latest results. Supply a blank group to
+// get all of them.
+func (c *Client) GetLimitGroupProbes(group string) ([]*LimitGroupProbeStatus, error) {
+	resp, err := c.request(&clientRequest{Method: "getprobes", Probe: &LimitGroupProbe{Group: group}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Probes, nil
+}
+
+// RemoveLimitGroupProbe stops the probe of the given limit group, leaving the
+// group with the limit it last probed. Returns the number of probes removed (0
+// or 1).
+func (c *Client) RemoveLimitGroupProbe(group string) (int, error) {
+	resp, err := c.request(&clientRequest{Method: "removeprobe", Probe: &LimitGroupProbe{Group: group}})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Removed, nil
+}
+
+// AcquireTokens requests the given number of tokens of the named resource that
+// the server was configured to protect (see ServerConfig.Protectors), and
+// waits until they are granted. You would do this from within a job's Cmd
+// before using some limited resource, such as a database, to avoid
+// overloading it.
+//
+// The returned receipt should be given to ReleaseTokens() when you're done
+// using the resource. If it isn't (eg. because your command died), the tokens
+// will be released automatically after the resource's ReleaseTimeout, so if
+// you use the resource for longer than that, call TouchTokens() periodically.
+// If you're calling this from within the Cmd of a job run by Execute() (which
+// sets JobKeyEnvVar), the tokens will also be released when the job exits.
+//
+// If wait is greater than 0 and the tokens aren't granted within that time,
+// the request is cancelled and an Error with Err ErrTokensNotGranted is
+// returned.
+func (c *Client) AcquireTokens(protector string, numTokens int, wait time.Duration) (string, error) {
+	resp, err := c.request(&clientRequest{Method: "tokenrequest", Protector: protector, NumTokens: numTokens, TokenJobKey: os.Getenv(JobKeyEnvVar)})
+	if err != nil {
+		return "", err
+	}
+	receipt := resp.Receipt
+
+	// we wait in chunks so that we don't hit our connection timeout
+	chunk := c.timeout / 2
+	var limit time.Time
+	if wait > 0 {
+		limit = time.Now().Add(wait)
+	}
+	for {
+		timeout := chunk
+		if !limit.IsZero() {
+			remaining := time.Until(limit)
+			if remaining <= 0 {
+				errr := c.ReleaseTokens(receipt)
+				if errr != nil {
+					return "", errr
+				}
+				return "", Error{"tokenwait", receipt, ErrTokensNotGranted}
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		resp, err = c.request(&clientRequest{Method: "tokenwait", Receipt: receipt, Timeout: timeout})
+		if err != nil {
+			return "", err
+		}
+		if resp.Granted {
+			return receipt, nil
+		}
+	}
+}
+
+// TouchTokens stops the tokens granted to you by AcquireTokens() from being
+// released automatically for another ReleaseTimeout. Returns an Error with Err
+// ErrTokensNotGranted if they had already been released.
+func (c *Client) TouchTokens(receipt string) error {
+	_, err := c.request(&clientRequest{Method: "tokentouch", Receipt: receipt})
+	return err
+}
+
+// ReleaseTokens releases the tokens granted to you by AcquireTokens(), letting
+// others use the resource. Call this as soon as you're done using the
+// resource.
+func (c *Client) ReleaseTokens(receipt string) error {
+	_, err := c.request(&clientRequest{Method: "tokenrelease", Receipt: receipt})
+	return err
+}
+
+// DependenciesSatisfied tells you, for each of the given dependencies, if the
+// jobs they refer to on the server are currently in the state that would let
+// a job with that dependency run. The Manager of each dependency is ignored.
+// Servers use this to check the dependencies their jobs have on the jobs of
+// other managers (see ServerConfig.RemoteManagers).
+func (c *Client) DependenciesSatisfied(deps Dependencies) ([]bool, error) {
+	resp, err := c.request(&clientRequest{Method: "depstatus", Dependencies: deps})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Satisfied, nil
+}
+
+// GetRemoteManagers tells you about the other managers the server was
+// configured with (see ServerConfig.RemoteManagers), including whether they
+// could be contacted the last time the server checked the dependencies its
+// jobs have on them.
+func (c *Client) GetRemoteManagers() ([]*RemoteManagerStatus, error) {
+	resp, err := c.request(&clientRequest{Method: "getremotes"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Remotes, nil
+}
+
 // UploadFile uploads a local file to the machine where the server is running,
 // so you can add cloud jobs that need a script or config file on your local
 // machine to be copied over to created cloud instances.
@@ -1902,7 +2511,7 @@ func (c *Client) request(cr *clientRequest) (*serverResponse, error) {
 
 	// pull the error out of sr
 	if sr.Err != "" {
-		key := ""
+		key := sr.ErrItem
 		if cr.Job != nil {
 			key = cr.Job.Key()
 		}
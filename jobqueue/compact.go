@@ -0,0 +1,275 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for compacting our database file while the
+// server keeps running. Our storage backends never shrink their files, so
+// after lots of jobs have been deleted (eg. by a RetentionRule), the file can
+// be much bigger than its contents. We copy the contents to a new file,
+// capturing any changes made while we do so, then briefly pause database
+// access to apply the last of those changes and swap the new file in.
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// compactBatchBytes is roughly how much data we write to the new file per
+	// transaction.
+	compactBatchBytes = 4 * 1024 * 1024
+
+	// compactCatchUpRounds is the maximum number of times we apply captured
+	// changes to the new file before pausing to apply the rest.
+	compactCatchUpRounds = 5
+
+	compactFileSuffix = ".compact"
+)
+
+// CompactionResult describes the outcome of Client.CompactDB().
+type CompactionResult struct {
+	// SizeBefore and SizeAfter are the sizes in bytes of the database file
+	// before and after compaction.
+	SizeBefore int64
+	SizeAfter  int64
+
+	// Took is how long compaction took, and Paused is how long database access
+	// was paused for at the end.
+	Took   time.Duration
+	Paused time.Duration
+}
+
+// Reclaimed returns the number of bytes of disk space compaction freed up.
+func (cr *CompactionResult) Reclaimed() int64 {
+	return cr.SizeBefore - cr.SizeAfter
+}
+
+// compact rewrites our database file to take up as little space as possible,
+// without stopping the database from being used. Only one compaction can happen
+// at a time; others will get an Error with Err ErrCompacting.
+func (db *db) compact() (*CompactionResult, error) {
+	db.Lock()
+	if db.closed {
+		db.Unlock()
+		return nil, Error{"compact", db.path, ErrDBError}
+	}
+	if db.compacting {
+		db.Unlock()
+		return nil, Error{"compact", db.path, ErrCompacting}
+	}
+	db.compacting = true
+	db.Unlock()
+	defer func() {
+		db.Lock()
+		db.compacting = false
+		db.Unlock()
+	}()
+
+	start := time.Now()
+	result := &CompactionResult{SizeBefore: dbFileSize(db.path)}
+
+	rs := db.replication
+	rs.startCapture()
+	tmpPath := db.path + compactFileSuffix
+	newStore, err := db.compactTo(tmpPath)
+	if err != nil {
+		db.abortCompaction(newStore, tmpPath)
+		return nil, err
+	}
+
+	// catch up with the changes made while we were copying; each round should
+	// have fewer to apply, until there are few enough to do while paused
+	for i := 0; i < compactCatchUpRounds; i++ {
+		changes := rs.takeCaptured(false)
+		if len(changes) == 0 {
+			break
+		}
+		err = applyChangeSets(newStore, changes)
+		if err != nil {
+			db.abortCompaction(newStore, tmpPath)
+			return nil, err
+		}
+	}
+
+	pauseStart := time.Now()
+	if !rs.pause() {
+		db.abortCompaction(newStore, tmpPath)
+		return nil, Error{"compact", db.path, ErrDBError}
+	}
+	store, err := db.swapInCompacted(newStore, rs.takeCaptured(true), tmpPath)
+	rs.resume(store)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Paused = time.Since(pauseStart)
+	result.Took = time.Since(start)
+	result.SizeAfter = dbFileSize(db.path)
+	db.Info("Compacted database", "before", result.SizeBefore, "after", result.SizeAfter, "took", result.Took, "paused", result.Paused)
+
+	db.backgroundBackup()
+
+	return result, nil
+}
+
+// compactTo creates a new store at path and copies the contents of our current
+// store in to it.
+func (db *db) compactTo(path string) (dbStore, error) {
+	err := removeDBFile(path)
+	if err != nil {
+		return nil, err
+	}
+	newStore, err := openDBStore(db.backend, path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.storage.view(func(tx dbTx) error {
+		for _, bucket := range dbBuckets {
+			var batch sobsd
+			batchBytes := 0
+			errs := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
+				batch = append(batch, [2][]byte{copyBytes(k), copyBytes(v)})
+				batchBytes += len(k) + len(v)
+				if batchBytes < compactBatchBytes {
+					return true, nil
+				}
+				errp := putBatch(newStore, bucket, batch)
+				batch = nil
+				batchBytes = 0
+				return errp == nil, errp
+			})
+			if errs != nil {
+				return errs
+			}
+			errs = putBatch(newStore, bucket, batch)
+			if errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	return newStore, err
+}
+
+// swapInCompacted is called while our replicatingStore is paused to apply the
+// final changes to newStore and then replace our current store with it.
+// Returns the store that should be used from now on, or nil if the current one
+// should continue to be used (which will only be closed if we also return an
+// error after failing to reopen it). If the current store can't be closed we
+// don't try to reopen it, since it may still hold a lock on the file.
+func (db *db) swapInCompacted(newStore dbStore, changes []*dbChangeSet, tmpPath string) (dbStore, error) {
+	err := applyChangeSets(newStore, changes)
+	if err == nil {
+		err = newStore.close()
+	}
+	if err != nil {
+		db.abortCompaction(newStore, tmpPath)
+		return nil, err
+	}
+
+	err = db.replication.dbStore.close()
+	if err != nil {
+		db.Error("Closing database for compaction failed", "err", err)
+		db.abortCompaction(nil, tmpPath)
+		return nil, err
+	}
+
+	err = os.Rename(tmpPath, db.path)
+	if err == nil {
+		// any journal files belong to the old file; their contents will
+		// already be in the compacted copy
+		err = removeDBJournals(db.path)
+	}
+	errr := removeDBFile(tmpPath)
+	if errr != nil {
+		db.Warn("Removing compacted database file failed", "path", tmpPath, "err", errr)
+	}
+
+	store, erro := openDBStore(db.backend, db.path)
+	if erro != nil {
+		db.Crit("Reopening database after compaction failed", "path", db.path, "err", erro)
+		if err == nil {
+			err = erro
+		}
+		return nil, err
+	}
+	return store, err
+}
+
+// abortCompaction stops capturing changes and removes our partial compacted
+// file.
+func (db *db) abortCompaction(newStore dbStore, tmpPath string) {
+	db.replication.takeCaptured(true)
+	if newStore != nil {
+		errc := newStore.close()
+		if errc != nil {
+			db.Debug("Closing compacted database failed", "err", errc)
+		}
+	}
+	errr := removeDBFile(tmpPath)
+	if errr != nil {
+		db.Warn("Removing compacted database file failed", "path", tmpPath, "err", errr)
+	}
+}
+
+// putBatch stores the given keys and values in bucket in one transaction.
+func putBatch(store dbStore, bucket []byte, batch sobsd) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return store.update(func(tx dbTx) error {
+		for _, kv := range batch {
+			err := tx.put(bucket, kv[0], kv[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// applyChangeSets makes the given changes to store, in order.
+func applyChangeSets(store dbStore, changes []*dbChangeSet) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return store.update(func(tx dbTx) error {
+		for _, cs := range changes {
+			err := cs.apply(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dbFileSize returns the size of the database file at path, including any
+// SQLite write-ahead log, or 0 if it can't be determined.
+func dbFileSize(path string) int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal"} {
+		info, err := os.Stat(path + suffix)
+		if err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
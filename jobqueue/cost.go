@@ -0,0 +1,248 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for working out how much it cost to run jobs,
+// so that compute can be charged back to the people that used it.
+//
+// Every time a job exits, its cost is worked out from its wall time and its
+// share of the host it ran on, added to the job's Cost, and added to running
+// totals per RepGroup and per User that we keep in the costs bucket. The
+// core-hours it reserved are totalled in the same way, even if no CostRates
+// have been configured.
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// CostCore and CostGB are the names used in ParseCostRates() specs for the
+// CostRates CoreHour and GBHour prices.
+const (
+	CostCore = "core"
+	CostGB   = "gb"
+)
+
+// costKeyRepGroup, costKeyUser and their core-hour equivalents prefix the keys
+// of our costs bucket.
+const (
+	costKeyRepGroup          = "repgroup"
+	costKeyUser              = "user"
+	costKeyRepGroupCoreHours = "repgroupcorehours"
+	costKeyUserCoreHours     = "usercorehours"
+)
+
+// CostRates are the prices used to work out the cost of running jobs. The
+// units of the prices are up to you (eg. pounds or dollars), and Job.Cost and
+// the CostTotals will be in those units.
+type CostRates struct {
+	// Flavors are the prices per hour of cloud servers, keyed on flavor name.
+	// Jobs that run on a server of one of these flavors cost their share of
+	// the server: the greater of the fraction of its cores and the fraction of
+	// its memory that they reserved.
+	Flavors map[string]float64
+
+	// CoreHour and GBHour are the prices of reserving a core and a GB of
+	// memory for an hour, used for jobs that didn't run on a server of one of
+	// the Flavors, eg. when using the local or LSF schedulers.
+	CoreHour float64
+	GBHour   float64
+}
+
+// ParseCostRates parses a comma separated list of prices like "name:price",
+// where name is CostCore, CostGB or the name of a cloud server flavor, and
+// price is what it costs per hour. Eg. "core:0.02,gb:0.005,m1.large:0.3".
+// Returns nil if spec contains no prices, and an Error with Err ErrBadCostRates
+// if spec is invalid.
+func ParseCostRates(spec string) (*CostRates, error) {
+	var rates *CostRates
+	for _, rateSpec := range strings.Split(spec, ",") {
+		rateSpec = strings.TrimSpace(rateSpec)
+		if rateSpec == "" {
+			continue
+		}
+
+		i := strings.LastIndex(rateSpec, ":")
+		if i < 1 {
+			return nil, Error{"ParseCostRates", rateSpec, ErrBadCostRates}
+		}
+		name := rateSpec[:i]
+		price, err := strconv.ParseFloat(rateSpec[i+1:], 64)
+		if err != nil || price < 0 {
+			return nil, Error{"ParseCostRates", rateSpec, ErrBadCostRates}
+		}
+
+		if rates == nil {
+			rates = &CostRates{Flavors: make(map[string]float64)}
+		}
+		switch name {
+		case CostCore:
+			rates.CoreHour = price
+		case CostGB:
+			rates.GBHour = price
+		default:
+			rates.Flavors[name] = price
+		}
+	}
+	return rates, nil
+}
+
+// jobCost returns the cost of reserving the given requirements for the given
+// wall time on a server of the given flavor (which can be nil if not in the
+// cloud).
+func (c *CostRates) jobCost(req *scheduler.Requirements, flavor *cloud.Flavor, wall time.Duration) float64 {
+	if c == nil || req == nil || wall <= 0 {
+		return 0
+	}
+	hours := wall.Hours()
+
+	if flavor != nil {
+		if price, exists := c.Flavors[flavor.Name]; exists {
+			return hours * price * hostShare(req, flavor)
+		}
+	}
+
+	return hours * (req.Cores*c.CoreHour + float64(req.RAM)/1024*c.GBHour)
+}
+
+// hostShare returns the fraction of a server of the given flavor taken up by
+// the given requirements, being the greater of the fraction of its cores and
+// of its memory, capped at 1.
+func hostShare(req *scheduler.Requirements, flavor *cloud.Flavor) float64 {
+	var share float64
+	if flavor.Cores > 0 {
+		share = req.Cores / float64(flavor.Cores)
+	}
+	if flavor.RAM > 0 {
+		share = math.Max(share, float64(req.RAM)/float64(flavor.RAM))
+	}
+	if flavor.Cores <= 0 && flavor.RAM <= 0 {
+		share = 1
+	}
+	return math.Min(share, 1)
+}
+
+// jobCoreHours returns the core-hours used by reserving the given requirements
+// for the given wall time.
+func jobCoreHours(req *scheduler.Requirements, wall time.Duration) float64 {
+	if req == nil || wall <= 0 {
+		return 0
+	}
+	return req.Cores * wall.Hours()
+}
+
+// CostTotals are the total costs of all the jobs that have run, as worked out
+// using the CostRates configured at the time they ran, along with the total
+// core-hours they reserved.
+type CostTotals struct {
+	Total             float64
+	RepGroups         map[string]float64
+	Users             map[string]float64
+	CoreHours         float64
+	RepGroupCoreHours map[string]float64
+	UserCoreHours     map[string]float64
+}
+
+// newCostTotals returns an empty CostTotals.
+func newCostTotals() *CostTotals {
+	return &CostTotals{
+		RepGroups:         make(map[string]float64),
+		Users:             make(map[string]float64),
+		RepGroupCoreHours: make(map[string]float64),
+		UserCoreHours:     make(map[string]float64),
+	}
+}
+
+// add adds the given cost and core-hours to our totals for the given RepGroup
+// and user.
+func (t *CostTotals) add(repGroup, user string, cost, coreHours float64) {
+	t.Total += cost
+	t.RepGroups[repGroup] += cost
+	t.Users[user] += cost
+	t.CoreHours += coreHours
+	t.RepGroupCoreHours[repGroup] += coreHours
+	t.UserCoreHours[user] += coreHours
+}
+
+// addCosts adds the given cost and core-hours to the running totals of the
+// given RepGroup and user within a transaction.
+func addCosts(tx dbTx, repGroup, user string, cost, coreHours float64) error {
+	amounts := map[string]float64{
+		costKeyRepGroup + dbDelimiter + repGroup:          cost,
+		costKeyUser + dbDelimiter + user:                  cost,
+		costKeyRepGroupCoreHours + dbDelimiter + repGroup: coreHours,
+		costKeyUserCoreHours + dbDelimiter + user:         coreHours,
+	}
+	for key, total := range amounts {
+		if total <= 0 {
+			continue
+		}
+		if v := tx.get(bucketCosts, []byte(key)); v != nil {
+			prev, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return err
+			}
+			total += prev
+		}
+
+		err := tx.put(bucketCosts, []byte(key), []byte(strconv.FormatFloat(total, 'g', -1, 64)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// costTotals returns the running totals stored by addCosts().
+func (db *db) costTotals() (*CostTotals, error) {
+	totals := newCostTotals()
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(bucketCosts, nil, nil, func(k, v []byte) (bool, error) {
+			parts := strings.SplitN(string(k), dbDelimiter, 2)
+			if len(parts) != 2 {
+				return true, nil
+			}
+
+			cost, err := strconv.ParseFloat(string(v), 64)
+			if err != nil {
+				return false, err
+			}
+
+			switch parts[0] {
+			case costKeyRepGroup:
+				totals.RepGroups[parts[1]] = cost
+				totals.Total += cost
+			case costKeyUser:
+				totals.Users[parts[1]] = cost
+			case costKeyRepGroupCoreHours:
+				totals.RepGroupCoreHours[parts[1]] = cost
+				totals.CoreHours += cost
+			case costKeyUserCoreHours:
+				totals.UserCoreHours[parts[1]] = cost
+			}
+			return true, nil
+		})
+	})
+	return totals, err
+}
@@ -18,17 +18,17 @@
 
 package jobqueue
 
-// This file contains functions for interacting with our database, which is
-// boltdb, a simple key/val store with transactions and hot backup ability.
-// We don't use a generic ORM for boltdb like Storm, because we can do custom
-// queries that are multiple times faster than what Storm can do.
+// This file contains functions for interacting with our database, which is a
+// simple ordered key/val store of named buckets with transactions and hot
+// backup ability. The storage backend is a dbStore, by default boltdb (see
+// dbBolt.go), but optionally SQLite (see dbSQLite.go). We don't use a generic
+// ORM, because we can do custom queries that are multiple times faster.
 
 import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -40,11 +40,11 @@ import (
 
 	"github.com/VertebrateResequencing/muxfys/v4"
 	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/limiter"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/inconshreveable/log15"
 	"github.com/sb10/waitgroup"
 	"github.com/ugorji/go/codec"
-	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -69,15 +69,24 @@ var (
 	bucketJobRAM       = []byte("jobRAM")
 	bucketJobDisk      = []byte("jobDisk")
 	bucketJobSecs      = []byte("jobSecs")
+	bucketEndTK        = []byte("endtimeToKey")
+	bucketHostTK       = []byte("hostToKey")
+	bucketExitTK       = []byte("exitcodeToKey")
+	bucketFailTK       = []byte("failreasonToKey")
+	bucketReqTK        = []byte("reqgroupToKey")
+	bucketCosts        = []byte("costs")
+	bucketBudgets      = []byte("budgets")
+	bucketLGProbes     = []byte("limitgroupprobes")
 	wipeDevDBOnInit    = true
 	forceBackups       = false
 )
 
-// Rec* variables are only exported for testing purposes (*** though they should
-// probably be user configurable somewhere...).
+// Rec* variables are the defaults used when a ServerConfig doesn't specify
+// otherwise.
 var (
-	RecMBRound  = 100 // when we recommend amount of memory to reserve for a job, we round up to the nearest RecMBRound MBs
-	RecSecRound = 1   // when we recommend time to reserve for a job, we round up to the nearest RecSecRound seconds
+	RecMBRound  = 100                 // when we recommend amount of memory to reserve for a job, we round up to the nearest RecMBRound MBs
+	RecSecRound = 1                   // when we recommend time to reserve for a job, we round up to the nearest RecSecRound seconds
+	RecHalfLife = 30 * 24 * time.Hour // observations of job resource usage count for half as much every RecHalfLife
 )
 
 // sobsd ('slice of byte slice doublets') implements sort interface so we can
@@ -100,40 +109,159 @@ func (s sobsd) Less(i, j int) bool {
 // a particular bucket
 type sobsdStorer func(bucket []byte, encodes sobsd) (err error)
 
+// DBBackend* constants are the storage backends our database can use, as
+// specified in ServerConfig.DBBackend.
+const (
+	DBBackendBolt   = "bolt"
+	DBBackendSQLite = "sqlite"
+)
+
+// dbBuckets are all the buckets that our dbStores must have.
+var dbBuckets = [][]byte{
+	bucketJobsLive, bucketJobsComplete, bucketRTK, bucketRGs, bucketLGs,
+	bucketDTK, bucketRDTK, bucketEnvs, bucketStdO, bucketStdE, bucketJobRAM,
+	bucketJobDisk, bucketJobSecs, bucketEndTK, bucketHostTK, bucketExitTK,
+	bucketFailTK, bucketReqTK, bucketMeta, bucketCosts, bucketBudgets,
+	bucketLGProbes,
+}
+
+// dbStore is the interface to the storage backend of our db: an ordered
+// key/val store of named buckets with transactions and hot backup ability.
+// Keys are ordered byte-wise.
+type dbStore interface {
+	// view calls fn within a read-only transaction.
+	view(fn func(tx dbTx) error) error
+
+	// update calls fn within a read-write transaction. Concurrent updates may
+	// be combined in to a single transaction, in which case fn may be called
+	// more than once, so it must not have side effects outside of tx.
+	update(fn func(tx dbTx) error) error
+
+	// backup writes a consistent copy of the whole database to w, in the
+	// backend's file format.
+	backup(w io.Writer) error
+
+	// backupToFile writes a consistent copy of the whole database to a new
+	// file at path, replacing any existing file.
+	backupToFile(path string) error
+
+	// check checks the integrity of the database file, returning a
+	// description of each problem found.
+	check() ([]string, error)
+
+	close() error
+}
+
+// dbTx is a transaction on a dbStore. Values returned by get() and passed to
+// seek() functions are only valid for the life of the transaction.
+type dbTx interface {
+	// get returns the value of key in bucket, or nil if the key isn't there.
+	// If the value couldn't be read, the transaction fails with that error.
+	get(bucket, key []byte) []byte
+
+	put(bucket, key, val []byte) error
+	delete(bucket, key []byte) error
+
+	// seek calls fn with each key and value in bucket, in order, starting at
+	// the first key at or after start (or prefix, if start is empty), for as
+	// long as keys have the given prefix and fn returns true.
+	seek(bucket, start, prefix []byte, fn func(k, v []byte) (bool, error)) error
+}
+
+// openDBStore opens (or creates) the database file at path using the given
+// backend, ensuring all our buckets exist.
+func openDBStore(backend string, path string) (dbStore, error) {
+	switch backend {
+	case DBBackendBolt, "":
+		return openBoltStore(path, dbBuckets)
+	case DBBackendSQLite:
+		return openSQLiteStore(path, dbBuckets)
+	}
+	return nil, fmt.Errorf("unknown database backend '%s'", backend)
+}
+
+// dbCodecHandle returns the codec.Handle used to encode jobs for the given
+// backend. SQLite stores jobs as JSON so that they can be queried with SQL.
+func dbCodecHandle(backend string) codec.Handle {
+	if backend == DBBackendSQLite {
+		return new(codec.JsonHandle)
+	}
+	return new(codec.BincHandle)
+}
+
+// removeDBFile removes the database file at path, along with any SQLite
+// journal files, ignoring files that don't exist.
+func removeDBFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeDBJournals(path)
+}
+
+// removeDBJournals removes any SQLite journal files of the database file at
+// path.
+func removeDBJournals(path string) error {
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		err := os.Remove(path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 type db struct {
 	backupLast time.Time
 	backupPath string
 	ch         codec.Handle
 	log15.Logger
-	backupStopWait       chan bool
-	backupMount          *muxfys.MuxFys
-	backupNotification   chan bool
-	backupWait           time.Duration
-	bolt                 *bolt.DB
-	envcache             *lru.ARCCache
-	updatingAfterJobExit int
-	wg                   *waitgroup.WaitGroup
-	wgMutex              sync.Mutex // protects wg since we want to call Wait() while another goroutine might call Add()
+	backupStopWait           chan bool
+	backupMount              *muxfys.MuxFys
+	backupNotification       chan bool
+	backupWait               time.Duration
+	storage                  dbStore
+	replication              *replicatingStore
+	backend                  string
+	path                     string
+	retentionStop            chan struct{}
+	recMBRound               int
+	recSecRound              int
+	recHalfLife              time.Duration
+	backupGenerations        int
+	backupGenerationInterval time.Duration
+	backupGenerationLast     time.Time
+	backupGenerationMutex    sync.Mutex // protects the backupGeneration* fields, since backups happen while db is locked
+	envcache                 *lru.ARCCache
+	updatingAfterJobExit     int
+	wg                       *waitgroup.WaitGroup
+	wgMutex                  sync.Mutex // protects wg since we want to call Wait() while another goroutine might call Add()
 	sync.RWMutex
 	backingUp      bool
 	backupFinal    bool
 	backupQueued   bool
 	backupsEnabled bool
 	closed         bool
+	compacting     bool
 	slowBackups    bool // just for testing purposes
 }
 
 // initDB opens/creates our database and sets things up for use. If dbFile
 // doesn't exist or seems corrupted, we copy it from backup if that exists,
-// otherwise we start fresh.
+// otherwise we start fresh. Databases made by older versions of wr are
+// migrated to our current schema (see dbMigrations.go), and those made by newer
+// versions result in an Error with Err ErrSchemaTooNew.
 //
 // dbBkFile can be an S3 url specified like: s3://[profile@]bucket/path/file
 // which will cause that s3 path to be mounted in the same directory as dbFile
 // and backups will be written there.
 //
+// backend is one of our DBBackend* constants, and the files must be of that
+// backend's format.
+//
 // In development we delete any existing db and force a fresh start. Backups
 // are also not carried out, so dbBkFile is ignored.
-func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logger) (*db, string, error) {
+func initDB(dbFile string, dbBkFile string, backend string, deployment string, logger log15.Logger) (*db, string, error) {
 	l := logger.New()
 
 	var backupsEnabled bool
@@ -145,52 +273,17 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 			if deployment == internal.Development {
 				dbBkFile += "." + deployment
 			}
-			path := strings.TrimPrefix(dbBkFile, internal.S3Prefix)
-			pp := strings.Split(path, "@")
-			profile := "default"
-			if len(pp) == 2 {
-				profile = pp[0]
-				path = pp[1]
-			}
-			base := filepath.Base(path)
-			path = filepath.Dir(path)
-
-			mnt := filepath.Join(filepath.Dir(dbFile), ".db_bk_mount", path)
-			bkPath = filepath.Join(mnt, base)
-
-			accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
-			if err != nil {
-				return nil, "", err
-			}
-			accessor, err := muxfys.NewS3Accessor(accessorConfig)
-			if err != nil {
-				return nil, "", err
-			}
-			remoteConfig := &muxfys.RemoteConfig{
-				Accessor: accessor,
-				Write:    true,
-			}
-			muxfys.SetLogHandler(l.GetHandler())
-
-			cfg := &muxfys.Config{
-				Mount:   mnt,
-				Retries: 10,
-			}
-			fs, err = muxfys.New(cfg)
-			if err != nil {
-				return nil, "", err
-			}
-			err = fs.Mount(remoteConfig)
+			var err error
+			bkPath, fs, err = mountS3Backup(dbBkFile, filepath.Join(filepath.Dir(dbFile), ".db_bk_mount"), l)
 			if err != nil {
 				return nil, "", err
 			}
-			fs.UnmountOnDeath()
 		}
 	}
 
 	if wipeDevDBOnInit && deployment == internal.Development {
-		errr := os.Remove(dbFile)
-		if errr != nil && !os.IsNotExist(errr) {
+		errr := removeDBFile(dbFile)
+		if errr != nil {
 			l.Warn("Failed to remove database file", "path", dbFile, "err", errr)
 		}
 		errr = os.Remove(bkPath)
@@ -199,31 +292,37 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		}
 	}
 
-	var boltdb *bolt.DB
+	var store dbStore
 	var msg string
 	var err error
 	if _, err = os.Stat(dbFile); os.IsNotExist(err) {
 		if _, err = os.Stat(bkPath); os.IsNotExist(err) {
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+			store, err = openDBStore(backend, dbFile)
 			msg = "created new empty db file " + dbFile
 		} else {
+			err = removeDBFile(dbFile)
+			if err != nil {
+				return nil, msg, err
+			}
 			err = copyFile(bkPath, dbFile)
 			if err != nil {
 				return nil, msg, err
 			}
-			boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+			store, err = openDBStore(backend, dbFile)
 			msg = "recreated missing db file " + dbFile + " from backup file " + dbBkFile
 		}
 	} else {
-		boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+		store, err = openDBStore(backend, dbFile)
 		if err != nil {
 			// try the backup
 			if _, errbk := os.Stat(dbBkFile); errbk == nil {
-				boltdb, errbk = bolt.Open(bkPath, dbFilePermission, nil)
+				var bkStore dbStore
+				bkStore, errbk = openDBStore(backend, bkPath)
 				if errbk == nil {
+					bkStore.close()
 					origerr := err
 					msg = fmt.Sprintf("tried to recreate corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, err)
-					err = os.Remove(dbFile)
+					err = removeDBFile(dbFile)
 					if err != nil {
 						return nil, msg, err
 					}
@@ -231,7 +330,7 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 					if err != nil {
 						return nil, msg, err
 					}
-					boltdb, err = bolt.Open(dbFile, dbFilePermission, nil)
+					store, err = openDBStore(backend, dbFile)
 					msg = fmt.Sprintf("recreated corrupt (?) db file %s from backup file %s (error with original db file was: %s)", dbFile, dbBkFile, origerr)
 				}
 			}
@@ -241,76 +340,20 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		return nil, msg, err
 	}
 
-	// ensure our buckets are in place
-	err = boltdb.Update(func(tx *bolt.Tx) error {
-		_, errf := tx.CreateBucketIfNotExists(bucketJobsLive)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobsLive, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobsComplete)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobsComplete, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRGs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRGs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketLGs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketLGs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketDTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketDTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketRDTK)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketRDTK, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketEnvs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketEnvs, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketStdO)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketStdO, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketStdE)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketStdE, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobRAM)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobRAM, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobDisk)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobDisk, errf)
-		}
-		_, errf = tx.CreateBucketIfNotExists(bucketJobSecs)
-		if errf != nil {
-			return fmt.Errorf("create bucket %s: %s", bucketJobSecs, errf)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, msg, err
-	}
-
 	// we will cache frequently used things to avoid actual db (disk) access
 	envcache, err := lru.NewARC(12) // we don't expect that many different ENVs to be in use at once
 	if err != nil {
 		return nil, msg, err
 	}
 
+	replication := newReplicatingStore(store)
 	dbstruct := &db{
-		bolt:               boltdb,
+		storage:            replication,
+		replication:        replication,
+		backend:            backend,
+		path:               dbFile,
 		envcache:           envcache,
-		ch:                 new(codec.BincHandle),
+		ch:                 dbCodecHandle(backend),
 		backupsEnabled:     backupsEnabled,
 		backupPath:         bkPath,
 		backupNotification: make(chan bool),
@@ -323,26 +366,118 @@ func initDB(dbFile string, dbBkFile string, deployment string, logger log15.Logg
 		dbstruct.backupMount = fs
 	}
 
+	// upgrade databases made by older versions of wr
+	migrated, err := dbstruct.migrate(dbFile)
+	if err != nil {
+		errc := dbstruct.close()
+		if errc != nil {
+			l.Warn("Closing database after failed migration failed", "err", errc)
+		}
+		return nil, msg, err
+	}
+	if migrated != "" {
+		if msg != "" {
+			msg += "; "
+		}
+		msg += migrated
+	}
+
 	return dbstruct, msg, err
 }
 
-// storeLimitGroups stores a mapping of group names to unsigned ints in a
+// mountS3Backup mounts the directory of the given S3 backup location (specified
+// like s3://[profile@]bucket/path/file) beneath mntDir, returning the local
+// path to the backup file.
+func mountS3Backup(dbBkFile string, mntDir string, logger log15.Logger) (string, *muxfys.MuxFys, error) {
+	path := strings.TrimPrefix(dbBkFile, internal.S3Prefix)
+	pp := strings.Split(path, "@")
+	profile := "default"
+	if len(pp) == 2 {
+		profile = pp[0]
+		path = pp[1]
+	}
+	base := filepath.Base(path)
+	path = filepath.Dir(path)
+
+	mnt := filepath.Join(mntDir, path)
+	bkPath := filepath.Join(mnt, base)
+
+	accessorConfig, err := muxfys.S3ConfigFromEnvironment(profile, path)
+	if err != nil {
+		return "", nil, err
+	}
+	accessor, err := muxfys.NewS3Accessor(accessorConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	remoteConfig := &muxfys.RemoteConfig{
+		Accessor: accessor,
+		Write:    true,
+	}
+	muxfys.SetLogHandler(logger.GetHandler())
+
+	cfg := &muxfys.Config{
+		Mount:   mnt,
+		Retries: 10,
+	}
+	fs, err := muxfys.New(cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	err = fs.Mount(remoteConfig)
+	if err != nil {
+		return "", nil, err
+	}
+	fs.UnmountOnDeath()
+
+	return bkPath, fs, nil
+}
+
+// limitGroup describes the limit and optional rate limit of a limit group, as
+// specified by a suffix to its name like ":limit" or ":limit:count/window".
+// A limit of -1 means the group's concurrent usage isn't limited.
+type limitGroup struct {
+	limit int
+	rate  *limiter.Rate
+}
+
+// encode returns the limitGroup in the form stored in the database: the limit
+// as 8 bytes (so that limit-only groups are stored the same way they always
+// have been), followed by the rate's count and window as 8 bytes each, if it
+// has a rate.
+func (lg *limitGroup) encode() []byte {
+	size := 8
+	if lg.rate != nil {
+		size = 24
+	}
+	v := make([]byte, size)
+	binary.BigEndian.PutUint64(v, uint64(int64(lg.limit)))
+	if lg.rate != nil {
+		binary.BigEndian.PutUint64(v[8:], uint64(lg.rate.Count))
+		binary.BigEndian.PutUint64(v[16:], uint64(lg.rate.Window))
+	}
+	return v
+}
+
+// storeLimitGroups stores a mapping of group names to limitGroups in a
 // dedicated bucket. If a group was already in the database, and it had a
-// different value, that group name will be returned in the changed slice. If
-// the group is given with a value less than 0, it is not stored in the
-// database; any existing entry is removed and the name is returned in the
-// removed slice.
-func (db *db) storeLimitGroups(limitGroups map[string]int) (changed []string, removed []string, err error) {
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketLGs)
-
-		for group, limit := range limitGroups {
+// different limit or rate, that group name will be returned in the changed
+// slice. If the group is given with a limit less than 0 and no rate, it is not
+// stored in the database; any existing entry is removed and the name is
+// returned in the removed slice.
+func (db *db) storeLimitGroups(limitGroups map[string]*limitGroup) (changed []string, removed []string, err error) {
+	err = db.storage.update(func(tx dbTx) error {
+		changed, removed = nil, nil
+
+		for group, lg := range limitGroups {
 			key := []byte(group)
+			unlimited := lg.limit < 0 && lg.rate == nil
+			encoded := lg.encode()
 
-			v := b.Get(key)
+			v := tx.get(bucketLGs, key)
 			if v != nil {
-				if limit < 0 {
-					errd := b.Delete(key)
+				if unlimited {
+					errd := tx.delete(bucketLGs, key)
 					if errd != nil {
 						return errd
 					}
@@ -350,17 +485,15 @@ func (db *db) storeLimitGroups(limitGroups map[string]int) (changed []string, re
 					continue
 				}
 
-				if binary.BigEndian.Uint64(v) == uint64(limit) {
+				if bytes.Equal(v, encoded) {
 					continue
 				}
 				changed = append(changed, group)
-			} else if limit < 0 {
+			} else if unlimited {
 				continue
 			}
 
-			v = make([]byte, 8)
-			binary.BigEndian.PutUint64(v, uint64(limit))
-			errp := b.Put(key, v)
+			errp := tx.put(bucketLGs, key, encoded)
 			if errp != nil {
 				return errp
 			}
@@ -372,13 +505,28 @@ func (db *db) storeLimitGroups(limitGroups map[string]int) (changed []string, re
 }
 
 // retrieveLimitGroup gets a value for a particular group from the db that was
-// stored with storeLimitGroups(). If the group wasn't stored, returns -1.
+// stored with storeLimitGroups(). If the group wasn't stored, or only has a
+// rate limit, returns -1.
 func (db *db) retrieveLimitGroup(group string) int {
 	v := db.retrieve(bucketLGs, group)
 	if v == nil {
 		return -1
 	}
-	return int(binary.BigEndian.Uint64(v))
+	return int(int64(binary.BigEndian.Uint64(v)))
+}
+
+// retrieveLimitGroupRate gets the rate limit of a particular group from the db
+// that was stored with storeLimitGroups(). Returns nil if the group wasn't
+// stored or has no rate limit.
+func (db *db) retrieveLimitGroupRate(group string) *limiter.Rate {
+	v := db.retrieve(bucketLGs, group)
+	if len(v) < 24 {
+		return nil
+	}
+	return &limiter.Rate{
+		Count:  uint(binary.BigEndian.Uint64(v[8:])),
+		Window: time.Duration(binary.BigEndian.Uint64(v[16:])),
+	}
 }
 
 // storeNewJobs stores jobs in the live bucket, where they will only be used for
@@ -605,9 +753,8 @@ func (db *db) generateLookupKey(prefix string, jobKey []byte) []byte {
 // bucket.
 func (db *db) checkIfLive(key string) (bool, error) {
 	var isLive bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		if newJobBucket.Get([]byte(key)) != nil {
+	err := db.storage.view(func(tx dbTx) error {
+		if tx.get(bucketJobsLive, []byte(key)) != nil {
 			isLive = true
 		}
 		return nil
@@ -619,10 +766,8 @@ func (db *db) checkIfLive(key string) (bool, error) {
 // complete bucket or the live bucket.
 func (db *db) checkIfAdded(key string) (bool, error) {
 	var isInDB bool
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		if newJobBucket.Get([]byte(key)) != nil || completeJobBucket.Get([]byte(key)) != nil {
+	err := db.storage.view(func(tx dbTx) error {
+		if tx.get(bucketJobsLive, []byte(key)) != nil || tx.get(bucketJobsComplete, []byte(key)) != nil {
 			isInDB = true
 		}
 		return nil
@@ -630,6 +775,21 @@ func (db *db) checkIfAdded(key string) (bool, error) {
 	return isInDB, err
 }
 
+// checkIfComplete tells you which of the jobs with the given keys are in the
+// complete bucket.
+func (db *db) checkIfComplete(keys []string) (map[string]bool, error) {
+	complete := make(map[string]bool)
+	err := db.storage.view(func(tx dbTx) error {
+		for _, key := range keys {
+			if tx.get(bucketJobsComplete, []byte(key)) != nil {
+				complete[key] = true
+			}
+		}
+		return nil
+	})
+	return complete, err
+}
+
 // archiveJob deletes a job from the live bucket, and adds a new version of it
 // (with different properties) to the complete bucket.
 //
@@ -639,53 +799,100 @@ func (db *db) checkIfAdded(key string) (bool, error) {
 // The key you supply must be the key of the job you supply, or bad things will
 // happen - no checking is done! A backgroundBackup() is triggered afterwards.
 func (db *db) archiveJob(key string, job *Job) error {
-	var encoded []byte
-	enc := codec.NewEncoderBytes(&encoded, db.ch)
-	job.RLock()
-	err := enc.Encode(job)
-	job.RUnlock()
+	a, err := db.newJobArchival(key, job)
 	if err != nil {
 		return err
 	}
+	return db.storeArchivals([]*jobArchival{a})
+}
 
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
-		key := []byte(key)
-		errf := bo.Delete(key)
-		if errf != nil {
-			return errf
-		}
-		errf = be.Delete(key)
-		if errf != nil {
-			return errf
+// archiveJobs is like archiveJob(), but archives all the given jobs in a
+// single transaction, which is much faster than archiving each individually.
+func (db *db) archiveJobs(jobs []*Job) error {
+	archivals := make([]*jobArchival, len(jobs))
+	for i, job := range jobs {
+		a, err := db.newJobArchival(job.Key(), job)
+		if err != nil {
+			return err
 		}
+		archivals[i] = a
+	}
+	return db.storeArchivals(archivals)
+}
 
-		b := tx.Bucket(bucketJobsLive)
-		errf = b.Delete(key)
-		if errf != nil {
-			return errf
-		}
+// jobArchival holds everything about a job that archiving it stores.
+type jobArchival struct {
+	key          string
+	encoded      []byte
+	lookups      map[string]sobsd
+	observations map[string]sobsd
+	repGroup     string
+	user         string
+	cost         float64
+	coreHours    float64
+}
 
-		b = tx.Bucket(bucketJobsComplete)
-		errf = b.Put(key, encoded)
-		if errf != nil {
-			return errf
-		}
+// newJobArchival encodes the given job and works out what else needs to be
+// stored when it is archived, taking its run cost.
+func (db *db) newJobArchival(key string, job *Job) (*jobArchival, error) {
+	a := &jobArchival{key: key}
+	enc := codec.NewEncoderBytes(&a.encoded, db.ch)
+	a.cost, a.coreHours = job.takeRunCost()
+	job.RLock()
+	err := enc.Encode(job)
+	a.lookups = historyLookups(key, job)
+	if !job.Cached {
+		// (restoring cached results tells us nothing about the cmd's usage)
+		a.observations = resourceObservations(key, job, ReqGroupResourceMemory, ReqGroupResourceDisk, ReqGroupResourceTime)
+	}
+	a.repGroup, a.user = job.RepGroup, job.User
+	job.RUnlock()
+	return a, err
+}
 
-		b = tx.Bucket(bucketJobRAM)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakRAM)), []byte(strconv.Itoa(job.PeakRAM)))
-		if errf != nil {
-			return errf
-		}
-		b = tx.Bucket(bucketJobDisk)
-		errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, job.PeakDisk)), []byte(strconv.Itoa(int(job.PeakDisk))))
-		if errf != nil {
-			return errf
+// storeArchivals does the work of archiveJob() for each of the given
+// archivals, in a single transaction.
+func (db *db) storeArchivals(archivals []*jobArchival) error {
+	err := db.storage.update(func(tx dbTx) error {
+		for _, a := range archivals {
+			errf := putHistoryLookups(tx, a.lookups)
+			if errf != nil {
+				return errf
+			}
+
+			key := []byte(a.key)
+			errf = tx.delete(bucketStdO, key)
+			if errf != nil {
+				return errf
+			}
+			errf = tx.delete(bucketStdE, key)
+			if errf != nil {
+				return errf
+			}
+
+			errf = tx.delete(bucketJobsLive, key)
+			if errf != nil {
+				return errf
+			}
+
+			errf = tx.put(bucketJobsComplete, key, a.encoded)
+			if errf != nil {
+				return errf
+			}
+
+			if a.cost > 0 || a.coreHours > 0 {
+				errf = addCosts(tx, a.repGroup, a.user, a.cost, a.coreHours)
+				if errf != nil {
+					return errf
+				}
+			}
+
+			errf = putHistoryLookups(tx, a.observations)
+			if errf != nil {
+				return errf
+			}
 		}
-		b = tx.Bucket(bucketJobSecs)
-		secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-		return b.Put([]byte(fmt.Sprintf("%s%s%20d", job.ReqGroup, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
+		return nil
 	})
 
 	db.backgroundBackup()
@@ -703,10 +910,9 @@ func (db *db) deleteLiveJob(key string) {
 
 // deleteLiveJobs remove multiple jobs from the live bucket.
 func (db *db) deleteLiveJobs(keys []string) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsLive)
+	err := db.storage.update(func(tx dbTx) error {
 		for _, key := range keys {
-			errd := b.Delete([]byte(key))
+			errd := tx.delete(bucketJobsLive, []byte(key))
 			if errd != nil {
 				return errd
 			}
@@ -733,19 +939,18 @@ func (db *db) deleteLiveJobs(keys []string) error {
 // is kicked.
 func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsLive)
-		return b.ForEach(func(key, encoded []byte) error {
-			if encoded != nil {
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(bucketJobsLive, nil, nil, func(key, encoded []byte) (bool, error) {
+			if len(encoded) > 0 {
 				dec := codec.NewDecoderBytes(encoded, db.ch)
 				job := &Job{}
 				errf := dec.Decode(job)
 				if errf != nil {
-					return errf
+					return false, errf
 				}
 				jobs = append(jobs, job)
 			}
-			return nil
+			return true, nil
 		})
 	})
 	return jobs, err
@@ -755,11 +960,10 @@ func (db *db) recoverIncompleteJobs() ([]*Job, error) {
 // jobs bucket (ie. those that have gone through the queue and been Remove()d).
 func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketJobsComplete)
+	err := db.storage.view(func(tx dbTx) error {
 		for _, key := range keys {
-			encoded := b.Get([]byte(key))
-			if encoded != nil {
+			encoded := tx.get(bucketJobsComplete, []byte(key))
+			if len(encoded) > 0 {
 				dec := codec.NewDecoderBytes(encoded, db.ch)
 				job := &Job{}
 				err := dec.Decode(job)
@@ -776,11 +980,10 @@ func (db *db) retrieveCompleteJobsByKeys(keys []string) ([]*Job, error) {
 // retrieveRepGroups gets the rep groups of all jobs that have ever been added.
 func (db *db) retrieveRepGroups() ([]string, error) {
 	var rgs []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketRGs)
-		return b.ForEach(func(k, v []byte) error {
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(bucketRGs, nil, nil, func(k, v []byte) (bool, error) {
 			rgs = append(rgs, string(k))
-			return nil
+			return true, nil
 		})
 	})
 	return rgs, err
@@ -792,29 +995,147 @@ func (db *db) retrieveRepGroups() ([]string, error) {
 // re-run).
 func (db *db) retrieveCompleteJobsByRepGroup(repgroup string) ([]*Job, error) {
 	var jobs []*Job
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		lookupBucket := tx.Bucket(bucketRTK).Cursor()
+	err := db.storage.view(func(tx dbTx) error {
 		prefix := []byte(repgroup + dbDelimiter)
-		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+		return tx.seek(bucketRTK, nil, prefix, func(k, _ []byte) (bool, error) {
 			key := bytes.TrimPrefix(k, prefix)
-			encoded := completeJobBucket.Get(key)
-			if len(encoded) > 0 && newJobBucket.Get(key) == nil {
+			encoded := tx.get(bucketJobsComplete, key)
+			if len(encoded) > 0 && tx.get(bucketJobsLive, key) == nil {
 				dec := codec.NewDecoderBytes(encoded, db.ch)
 				job := &Job{}
 				err := dec.Decode(job)
 				if err != nil {
-					return err
+					return false, err
 				}
 				jobs = append(jobs, job)
 			}
-		}
-		return nil
+			return true, nil
+		})
 	})
 	return jobs, err
 }
 
+// historyLookups returns the entries that should be stored in our history
+// lookup buckets for the given job that has just exited, keyed on bucket name.
+// You must hold at least a read lock on the job before calling this.
+func historyLookups(key string, job *Job) map[string]sobsd {
+	if !job.Exited || job.EndTime.IsZero() {
+		return nil
+	}
+
+	pos := historyPosition(job.EndTime, key)
+	val := []byte(key)
+	entry := func(prefix string) [2][]byte {
+		return [2][]byte{[]byte(prefix + dbDelimiter + pos), val}
+	}
+
+	lookups := map[string]sobsd{
+		string(bucketEndTK):  {{[]byte(pos), val}},
+		string(bucketExitTK): {entry(strconv.Itoa(job.Exitcode))},
+		string(bucketReqTK):  {entry(job.ReqGroup)},
+	}
+	if job.FailReason != "" {
+		lookups[string(bucketFailTK)] = sobsd{entry(job.FailReason)}
+	}
+	hosts := make(map[string]bool)
+	for _, host := range []string{job.Host, job.HostID, job.HostIP} {
+		if host != "" && !hosts[host] {
+			hosts[host] = true
+			lookups[string(bucketHostTK)] = append(lookups[string(bucketHostTK)], entry(host))
+		}
+	}
+	return lookups
+}
+
+// putHistoryLookups stores the output of historyLookups() or
+// resourceObservations() within a transaction.
+func putHistoryLookups(tx dbTx, lookups map[string]sobsd) error {
+	for bucket, entries := range lookups {
+		for _, entry := range entries {
+			err := tx.put([]byte(bucket), entry[0], entry[1])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// retrieveJobHistory gets jobs that have exited and match the given search,
+// from both the live and complete buckets, in the order they ended. If the
+// search has a Limit and we stopped after that many jobs, also returns a
+// cursor that can be used as the search's After value to get the next page of
+// results.
+func (db *db) retrieveJobHistory(js *JobSearch) ([]*Job, string, error) {
+	var jobs []*Job
+	var next string
+	bucket, prefix := js.lookup()
+	err := db.storage.view(func(tx dbTx) error {
+		buckets := [][]byte{bucketJobsLive, bucketJobsComplete}
+		if js.Complete {
+			buckets = buckets[1:]
+		}
+
+		start := prefix
+		switch {
+		case js.After != "":
+			start += js.After
+		case !js.Since.IsZero():
+			start += fmt.Sprintf("%0*d", historyTimeWidth, js.Since.UnixNano())
+		}
+		var until string
+		if !js.Until.IsZero() {
+			until = fmt.Sprintf("%0*d", historyTimeWidth, js.Until.UnixNano())
+		}
+
+		pre := []byte(prefix)
+		return tx.seek(bucket, []byte(start), pre, func(k, v []byte) (bool, error) {
+			pos := string(k[len(pre):])
+			if pos == js.After {
+				return true, nil
+			}
+			if until != "" && len(pos) >= historyTimeWidth && pos[:historyTimeWidth] > until {
+				return false, nil
+			}
+			end, err := historyPositionTime(pos)
+			if err != nil {
+				return true, nil
+			}
+
+			// the job may have exited multiple times, but we only consider
+			// the most recent exit we have a record of
+			var job *Job
+			for _, b := range buckets {
+				encoded := tx.get(b, v)
+				if len(encoded) == 0 {
+					continue
+				}
+				dec := codec.NewDecoderBytes(encoded, db.ch)
+				candidate := &Job{}
+				err = dec.Decode(candidate)
+				if err != nil {
+					return false, err
+				}
+				if candidate.EndTime.UnixNano() == end {
+					job = candidate
+					break
+				}
+			}
+			if job == nil || !js.matches(job) {
+				return true, nil
+			}
+
+			jobs = append(jobs, job)
+			if js.Limit > 0 && len(jobs) == js.Limit {
+				next = pos
+				return false, nil
+			}
+			return true, nil
+		})
+	})
+	return jobs, next, err
+}
+
 // retrieveDependentJobs gets previously stored jobs that had a dependency on
 // one for the input depGroups. If the job is found in the live bucket, then it
 // is returned in the jobsToUpdate return value. If it is found in the complete
@@ -828,27 +1149,24 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 	}
 	sort.Sort(prefixes)
 
-	err = db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		completeJobBucket := tx.Bucket(bucketJobsComplete)
-		lookupBucket := tx.Bucket(bucketRDTK).Cursor()
+	err = db.storage.view(func(tx dbTx) error {
 		doneKeys := make(map[string]bool)
 		for {
 			newDepGroups := make(map[string]bool)
 			for _, bsd := range prefixes {
-				for k, _ := lookupBucket.Seek(bsd[0]); bytes.HasPrefix(k, bsd[0]); k, _ = lookupBucket.Next() {
+				errs := tx.seek(bucketRDTK, nil, bsd[0], func(k, _ []byte) (bool, error) {
 					key := bytes.TrimPrefix(k, bsd[0])
 					keyStr := string(key)
 					if doneKeys[keyStr] {
-						continue
+						return true, nil
 					}
 
-					encoded := newJobBucket.Get(key)
+					encoded := tx.get(bucketJobsLive, key)
 					live := false
 					if len(encoded) > 0 {
 						live = true
 					} else if !newJobKeys[keyStr] {
-						encoded = completeJobBucket.Get(key)
+						encoded = tx.get(bucketJobsComplete, key)
 					}
 
 					if len(encoded) > 0 {
@@ -856,7 +1174,7 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 						job := &Job{}
 						errf := dec.Decode(job)
 						if errf != nil {
-							return errf
+							return false, errf
 						}
 
 						// since we're going to add this job, we also need to
@@ -876,6 +1194,10 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 					}
 
 					doneKeys[keyStr] = true
+					return true, nil
+				})
+				if errs != nil {
+					return errs
 				}
 			}
 
@@ -900,18 +1222,24 @@ func (db *db) retrieveDependentJobs(depGroups map[string]bool, newJobKeys map[st
 // the live bucket (ie. those that have been added to the queue and not yet
 // Archive()d - even if they've been added and archived in the past).
 func (db *db) retrieveIncompleteJobKeysByDepGroup(depgroup string) ([]string, error) {
+	return db.retrieveJobKeysByDepGroup(depgroup, true)
+}
+
+// retrieveJobKeysByDepGroup gets the keys of jobs with the given DepGroup,
+// optionally only those in the live bucket (see
+// retrieveIncompleteJobKeysByDepGroup()), otherwise including those that have
+// been Archive()d.
+func (db *db) retrieveJobKeysByDepGroup(depgroup string, liveOnly bool) ([]string, error) {
 	var jobKeys []string
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		lookupBucket := tx.Bucket(bucketDTK).Cursor()
+	err := db.storage.view(func(tx dbTx) error {
 		prefix := []byte(depgroup + dbDelimiter)
-		for k, _ := lookupBucket.Seek(prefix); bytes.HasPrefix(k, prefix); k, _ = lookupBucket.Next() {
+		return tx.seek(bucketDTK, nil, prefix, func(k, _ []byte) (bool, error) {
 			key := bytes.TrimPrefix(k, prefix)
-			if newJobBucket.Get(key) != nil {
+			if !liveOnly || tx.get(bucketJobsLive, key) != nil {
 				jobKeys = append(jobKeys, string(key))
 			}
-		}
-		return nil
+			return true, nil
+		})
 	})
 	return jobKeys, err
 }
@@ -970,13 +1298,20 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 		return
 	}
 	jobkey := job.Key()
+	cost, coreHours := job.takeRunCost()
 	job.RLock()
-	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
-	jrg := job.ReqGroup
-	jpr := job.PeakRAM
-	jpd := job.PeakDisk
 	jec := job.Exitcode
-	jfr := job.FailReason
+	repGroup, user := job.RepGroup, job.User
+	lookups := historyLookups(jobkey, job)
+	var observations map[string]sobsd
+	switch job.FailReason {
+	case FailReasonRAM:
+		observations = resourceObservations(jobkey, job, ReqGroupResourceMemory)
+	case FailReasonDisk:
+		observations = resourceObservations(jobkey, job, ReqGroupResourceDisk)
+	case FailReasonTime:
+		observations = resourceObservations(jobkey, job, ReqGroupResourceTime)
+	}
 	err := enc.Encode(job)
 	job.RUnlock()
 	if err != nil {
@@ -992,52 +1327,50 @@ func (db *db) updateJobAfterExit(job *Job, stdo []byte, stde []byte, forceStorag
 	go func() {
 		defer internal.LogPanic(db.Logger, "updateJobAfterExit", true)
 
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
+		err := db.storage.update(func(tx dbTx) error {
 			key := []byte(jobkey)
 
-			bjl := tx.Bucket(bucketJobsLive)
-			if bjl.Get(key) != nil {
-				errf := bjl.Put(key, encoded)
+			if tx.get(bucketJobsLive, key) != nil {
+				errf := tx.put(bucketJobsLive, key, encoded)
 				if errf != nil {
 					return errf
 				}
 			}
 
-			bo := tx.Bucket(bucketStdO)
-			be := tx.Bucket(bucketStdE)
-			errf := bo.Delete(key)
+			errf := putHistoryLookups(tx, lookups)
+			if errf != nil {
+				return errf
+			}
+
+			errf = tx.delete(bucketStdO, key)
 			if errf != nil {
 				return errf
 			}
-			errf = be.Delete(key)
+			errf = tx.delete(bucketStdE, key)
 			if errf != nil {
 				return errf
 			}
 
 			if jec != 0 || forceStorage {
 				if len(stdo) > 0 {
-					errf = bo.Put(key, stdo)
+					errf = tx.put(bucketStdO, key, stdo)
 				}
 				if len(stde) > 0 {
-					errf = be.Put(key, stde)
+					errf = tx.put(bucketStdE, key, stde)
 				}
 			}
 			if errf != nil {
 				return errf
 			}
 
-			switch jfr {
-			case FailReasonRAM:
-				b := tx.Bucket(bucketJobRAM)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpr)), []byte(strconv.Itoa(jpr)))
-			case FailReasonDisk:
-				b := tx.Bucket(bucketJobDisk)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, jpd)), []byte(strconv.Itoa(int(jpd))))
-			case FailReasonTime:
-				b := tx.Bucket(bucketJobSecs)
-				errf = b.Put([]byte(fmt.Sprintf("%s%s%20d", jrg, dbDelimiter, secs)), []byte(strconv.Itoa(secs)))
+			if cost > 0 || coreHours > 0 {
+				errf = addCosts(tx, repGroup, user, cost, coreHours)
+				if errf != nil {
+					return errf
+				}
 			}
-			return errf
+
+			return putHistoryLookups(tx, observations)
 		})
 		db.wg.Done(wgk)
 		if err != nil {
@@ -1075,9 +1408,8 @@ func (db *db) updateJobAfterChange(job *Job) {
 	go func() {
 		defer internal.LogPanic(db.Logger, "updateJobAfterChange", true)
 
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			bjl := tx.Bucket(bucketJobsLive)
-			if bjl.Get(key) == nil {
+		err := db.storage.update(func(tx dbTx) error {
+			if tx.get(bucketJobsLive, key) == nil {
 				// it's possible for these batches to be interleaved with
 				// archiveJob batches, and for this batch to update that a job
 				// was started to actually execute after the batch that says the
@@ -1085,7 +1417,7 @@ func (db *db) updateJobAfterChange(job *Job) {
 				// case, don't add it back to the live bucket here.
 				return nil
 			}
-			return bjl.Put(key, encoded)
+			return tx.put(bucketJobsLive, key, encoded)
 		})
 		db.wg.Done(wgk)
 		if err != nil {
@@ -1119,55 +1451,55 @@ func (db *db) modifyLiveJobs(oldKeys []string, jobs []*Job) error {
 
 	lookupBuckets := [][]byte{bucketRTK, bucketDTK, bucketRDTK}
 
-	err = db.bolt.Batch(func(tx *bolt.Tx) error {
+	err = db.storage.update(func(tx dbTx) error {
 		// delete old jobs and their lookups
-		newJobBucket := tx.Bucket(bucketJobsLive)
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
 		os := make([][]byte, len(oldKeys))
 		es := make([][]byte, len(oldKeys))
 		var hadStd bool
 		for i, oldKey := range oldKeys {
 			suffix := []byte(dbDelimiter + oldKey)
 			for _, bucket := range lookupBuckets {
-				b := tx.Bucket(bucket)
 				// *** currently having to go through the the whole lookup
 				// buckets; if this is a noticeable performance issue, will have
 				// to implement a reverse lookup...
-				errf := b.ForEach(func(k, v []byte) error {
+				var toDelete [][]byte
+				errf := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
 					if bytes.HasSuffix(k, suffix) {
-						errd := b.Delete(k)
-						if errd != nil {
-							return errd
-						}
+						toDelete = append(toDelete, append([]byte{}, k...))
 					}
-					return nil
+					return true, nil
 				})
 				if errf != nil {
 					return errf
 				}
+				for _, k := range toDelete {
+					errd := tx.delete(bucket, k)
+					if errd != nil {
+						return errd
+					}
+				}
 			}
 
 			key := []byte(oldKey)
-			errd := newJobBucket.Delete(key)
+			errd := tx.delete(bucketJobsLive, key)
 			if errd != nil {
 				return errd
 			}
 
-			o := bo.Get(key)
+			o := tx.get(bucketStdO, key)
 			if o != nil {
-				os[i] = o
-				errd = bo.Delete(key)
+				os[i] = append([]byte{}, o...)
+				errd = tx.delete(bucketStdO, key)
 				if errd != nil {
 					return errd
 				}
 				hadStd = true
 			}
 
-			e := be.Get(key)
+			e := tx.get(bucketStdE, key)
 			if e != nil {
-				es[i] = e
-				errd = be.Delete(key)
+				es[i] = append([]byte{}, e...)
+				errd = tx.delete(bucketStdE, key)
 				if errd != nil {
 					return errd
 				}
@@ -1206,13 +1538,13 @@ func (db *db) modifyLiveJobs(oldKeys []string, jobs []*Job) error {
 			if hadStd {
 				for i, job := range jobs {
 					if os[i] != nil {
-						errs = bo.Put([]byte(job.Key()), os[i])
+						errs = tx.put(bucketStdO, []byte(job.Key()), os[i])
 						if errs != nil {
 							return errs
 						}
 					}
 					if es[i] != nil {
-						errs = be.Put([]byte(job.Key()), es[i])
+						errs = tx.put(bucketStdE, []byte(job.Key()), es[i])
 						if errs != nil {
 							return errs
 						}
@@ -1249,16 +1581,14 @@ func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
 		<-time.After(10 * time.Millisecond)
 	}
 
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		bo := tx.Bucket(bucketStdO)
-		be := tx.Bucket(bucketStdE)
+	err := db.storage.view(func(tx dbTx) error {
 		key := []byte(jobkey)
-		o := bo.Get(key)
+		o := tx.get(bucketStdO, key)
 		if o != nil {
 			stdo = make([]byte, len(o))
 			copy(stdo, o)
 		}
-		e := be.Get(key)
+		e := tx.get(bucketStdE, key)
 		if e != nil {
 			stde = make([]byte, len(e))
 			copy(stde, e)
@@ -1274,103 +1604,85 @@ func (db *db) retrieveJobStd(jobkey string) (stdo []byte, stde []byte) {
 }
 
 // recommendedReqGroupMemory returns the 95th percentile peak memory usage of
-// all jobs that previously ran with the given reqGroup. If there are too few
-// prior values to calculate a 95th percentile, or if the 95th percentile is
-// very close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
-// are no prior values.
+// all jobs that previously ran with the given reqGroup, with older jobs
+// counting for less. If there are too few prior values to calculate a 95th
+// percentile, or if the 95th percentile is very close to the maximum value,
+// returns the maximum value instead. In either case, the true value is rounded
+// up to the nearest RecMBRound MB. Returns 0 if there are no prior values.
 func (db *db) recommendedReqGroupMemory(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobRAM, reqGroup, RecMBRound)
+	mbRound, _, _ := db.recommendationSettings()
+	return db.recommendedReqGroupStat(bucketJobRAM, reqGroup, 0, mbRound)
 }
 
 // recommendedReqGroupDisk returns the 95th percentile peak disk usage of
-// all jobs that previously ran with the given reqGroup. If there are too few
-// prior values to calculate a 95th percentile, or if the 95th percentile is
-// very close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest 100 MB. Returns 0 if there
-// are no prior values.
+// all jobs that previously ran with the given reqGroup, with older jobs
+// counting for less. If there are too few prior values to calculate a 95th
+// percentile, or if the 95th percentile is very close to the maximum value,
+// returns the maximum value instead. In either case, the true value is rounded
+// up to the nearest RecMBRound MB. Returns 0 if there are no prior values.
 func (db *db) recommendedReqGroupDisk(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, RecMBRound)
+	mbRound, _, _ := db.recommendationSettings()
+	return db.recommendedReqGroupStat(bucketJobDisk, reqGroup, 0, mbRound)
 }
 
 // recommendReqGroupTime returns the 95th percentile wall time taken of all jobs
-// that previously ran with the given reqGroup. If there are too few prior
-// values to calculate a 95th percentile, or if the 95th percentile is very
-// close to the maximum value, returns the maximum value instead. In either
-// case, the true value is rounded up to the nearest second. Returns 0 if there
-// are no prior values.
+// that previously ran with the given reqGroup, with older jobs counting for
+// less. If there are too few prior values to calculate a 95th percentile, or if
+// the 95th percentile is very close to the maximum value, returns the maximum
+// value instead. In either case, the true value is rounded up to the nearest
+// RecSecRound seconds. Returns 0 if there are no prior values.
 func (db *db) recommendedReqGroupTime(reqGroup string) (int, error) {
-	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, RecSecRound)
+	_, secRound, _ := db.recommendationSettings()
+	return db.recommendedReqGroupStat(bucketJobSecs, reqGroup, 0, secRound)
 }
 
 // recommendedReqGroupStat is the implementation for the other recommend*()
-// methods.
-func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, roundAmount int) (int, error) {
-	prefix := []byte(reqGroup)
-	max := 0
-	var recommendation int
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		c := tx.Bucket(statBucket).Cursor()
-
-		// we seek over the bucket, and to avoid having to do it twice (first to
-		// get the overall count, then to get the 95th percentile), we keep the
-		// previous 5%-sized window of values, updating recommendation as the
-		// window fills
-		count := 0
-		window := jobStatWindowPercent
-		var prev []int
-		var erra error
-		for k, v := c.Seek(prefix); bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			max, erra = strconv.Atoi(string(v))
-			if erra != nil {
-				return erra
-			}
-
-			count++
-			if count > 100 {
-				window = (float32(count) / 100) * jobStatWindowPercent
-			}
-
-			prev = append(prev, max)
-			if float32(len(prev)) > window {
-				recommendation, prev = prev[0], prev[1:]
-			}
-		}
-
-		return nil
-	})
+// methods. If hint is greater than 0 and enough prior jobs had a SizeHint, the
+// recommendation is based on a regression against SizeHint instead of the 95th
+// percentile.
+func (db *db) recommendedReqGroupStat(statBucket []byte, reqGroup string, hint float64, roundAmount int) (int, error) {
+	rr, err := db.resourceRecommender(statBucket, reqGroup, roundAmount)
 	if err != nil {
 		return 0, err
 	}
+	return rr.recommend(hint), nil
+}
 
-	if recommendation == 0 {
-		if max == 0 {
-			return recommendation, err
-		}
-		recommendation = max
-	}
-
-	if max-recommendation < roundAmount {
-		recommendation = max
-	}
-
-	if recommendation < roundAmount {
-		recommendation = roundAmount
+// resourceRecommender reads the observations of the given ReqGroup in the given
+// bucket and creates a resourceRecommender from them.
+func (db *db) resourceRecommender(statBucket []byte, reqGroup string, roundAmount int) (*resourceRecommender, error) {
+	_, _, halfLife := db.recommendationSettings()
+	now := time.Now()
+	prefix := []byte(reqGroup + dbDelimiter)
+	var start []byte
+	if halfLife > 0 {
+		// observations older than this have a negligible weight
+		oldest := now.Add(-recWeightHalfLives * halfLife)
+		start = []byte(reqGroup + dbDelimiter + fmt.Sprintf("%0*d", historyTimeWidth, oldest.UnixNano()))
 	}
 
-	if recommendation%roundAmount > 0 {
-		recommendation = int(math.Ceil(float64(recommendation)/float64(roundAmount))) * roundAmount
+	var obs []*resourceObservation
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(statBucket, start, prefix, func(k, v []byte) (bool, error) {
+			o, errp := parseResourceObservation(k, v)
+			if errp != nil {
+				return false, errp
+			}
+			obs = append(obs, o)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return recommendation, err
+	return newResourceRecommender(obs, roundAmount, halfLife, now), nil
 }
 
 // store does a basic set of a key/val in a given bucket
 func (db *db) store(bucket []byte, key string, val []byte) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		err := b.Put([]byte(key), val)
-		return err
+	err := db.storage.update(func(tx dbTx) error {
+		return tx.put(bucket, []byte(key), val)
 	})
 	return err
 }
@@ -1379,9 +1691,8 @@ func (db *db) store(bucket []byte, key string, val []byte) error {
 // possible here.
 func (db *db) retrieve(bucket []byte, key string) []byte {
 	var val []byte
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucket)
-		v := b.Get([]byte(key))
+	err := db.storage.view(func(tx dbTx) error {
+		v := tx.get(bucket, []byte(key))
 		if v != nil {
 			val = make([]byte, len(v))
 			copy(val, v)
@@ -1405,9 +1716,8 @@ func (db *db) remove(bucket []byte, key string) {
 	go func() {
 		defer internal.LogPanic(db.Logger, "jobqueue database remove", true)
 		defer db.wg.Done(wgk)
-		err := db.bolt.Batch(func(tx *bolt.Tx) error {
-			b := tx.Bucket(bucket)
-			return b.Delete([]byte(key))
+		err := db.storage.update(func(tx dbTx) error {
+			return tx.delete(bucket, []byte(key))
 		})
 		if err != nil {
 			db.Error("Database remove failed", "err", err)
@@ -1459,18 +1769,17 @@ func (db *db) storeBatched(bucket []byte, data sobsd, storer sobsdStorer) error
 // storeLookups is a sobsdStorer for storing Job.[somevalue]->Job.Key() lookups
 // in the db.
 func (db *db) storeLookups(bucket []byte, lookups sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.storage.update(func(tx dbTx) error {
 		return db.putLookups(tx, bucket, lookups)
 	})
 	return err
 }
 
-// putLookups does the work of storeLookups(). You must be inside a bolt
+// putLookups does the work of storeLookups(). You must be inside a
 // transaction when calling this.
-func (db *db) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
-	lookup := tx.Bucket(bucket)
+func (db *db) putLookups(tx dbTx, bucket []byte, lookups sobsd) error {
 	for _, doublet := range lookups {
-		err := lookup.Put(doublet[0], nil)
+		err := tx.put(bucket, doublet[0], nil)
 		if err != nil {
 			return err
 		}
@@ -1480,18 +1789,17 @@ func (db *db) putLookups(tx *bolt.Tx, bucket []byte, lookups sobsd) error {
 
 // storeEncodedJobs is a sobsdStorer for storing Jobs in the db.
 func (db *db) storeEncodedJobs(bucket []byte, encodes sobsd) error {
-	err := db.bolt.Batch(func(tx *bolt.Tx) error {
+	err := db.storage.update(func(tx dbTx) error {
 		return db.putEncodedJobs(tx, bucket, encodes)
 	})
 	return err
 }
 
-// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a bolt
+// putEncodedJobs does the work of storeEncodedJobs(). You nust be inside a
 // transaction when calling this.
-func (db *db) putEncodedJobs(tx *bolt.Tx, bucket []byte, encodes sobsd) error {
-	bjobs := tx.Bucket(bucket)
+func (db *db) putEncodedJobs(tx dbTx, bucket []byte, encodes sobsd) error {
 	for _, doublet := range encodes {
-		err := bjobs.Put(doublet[0], doublet[1])
+		err := tx.put(bucket, doublet[0], doublet[1])
 		if err != nil {
 			return err
 		}
@@ -1507,6 +1815,9 @@ func (db *db) close() error {
 	defer db.Unlock()
 	if !db.closed {
 		db.closed = true
+		if db.retentionStop != nil {
+			close(db.retentionStop)
+		}
 
 		// before actually closing, wait for any go routines doing database
 		// transactions to complete
@@ -1533,7 +1844,7 @@ func (db *db) close() error {
 			db.backupToBackupFile(false)
 		}
 
-		err := db.bolt.Close()
+		err := db.storage.close()
 		if db.backupMount != nil {
 			erru := db.backupMount.Unmount()
 			if erru != nil {
@@ -1636,9 +1947,7 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 
 	// create the new backup file with temp name
 	tmpBackupPath := db.backupPath + ".tmp"
-	err := db.bolt.View(func(tx *bolt.Tx) error {
-		return tx.CopyFile(tmpBackupPath, dbFilePermission)
-	})
+	err := db.storage.backupToFile(tmpBackupPath)
 
 	if slowBackups {
 		<-time.After(100 * time.Millisecond)
@@ -1657,6 +1966,8 @@ func (db *db) backupToBackupFile(slowBackups bool) {
 		errr := os.Rename(tmpBackupPath, db.backupPath)
 		if errr != nil {
 			db.Warn("Renaming new database backup file failed", "source", tmpBackupPath, "dest", db.backupPath, "err", errr)
+		} else {
+			db.createBackupGeneration()
 		}
 	}
 }
@@ -1673,8 +1984,5 @@ func (db *db) backup(w io.Writer) error {
 	}
 	db.RUnlock()
 
-	return db.bolt.View(func(tx *bolt.Tx) error {
-		_, txErr := tx.WriteTo(w)
-		return txErr
-	})
+	return db.storage.backup(w)
 }
@@ -0,0 +1,158 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the boltdb implementation of dbStore, which is the
+// default storage backend of our db.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore is a dbStore that keeps each of our buckets as a boltdb bucket in a
+// single boltdb file.
+type boltStore struct {
+	bolt *bolt.DB
+}
+
+// openBoltStore opens or creates a boltdb file at the given path, ensuring
+// the given buckets exist.
+func openBoltStore(path string, buckets [][]byte) (dbStore, error) {
+	boltdb, err := bolt.Open(path, dbFilePermission, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			_, errf := tx.CreateBucketIfNotExists(bucket)
+			if errf != nil {
+				return fmt.Errorf("create bucket %s: %s", bucket, errf)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltdb.Close()
+		return nil, err
+	}
+
+	return &boltStore{bolt: boltdb}, nil
+}
+
+// view implements dbStore.
+func (s *boltStore) view(fn func(tx dbTx) error) error {
+	return s.bolt.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// update implements dbStore, using boltdb's Batch() so that concurrent updates
+// are combined in to fewer transactions.
+func (s *boltStore) update(fn func(tx dbTx) error) error {
+	return s.bolt.Batch(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// updateUnbatched implements unbatchedUpdater.
+func (s *boltStore) updateUnbatched(fn func(tx dbTx) error) error {
+	return s.bolt.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// backup implements dbStore.
+func (s *boltStore) backup(w io.Writer) error {
+	return s.bolt.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// backupToFile implements dbStore.
+func (s *boltStore) backupToFile(path string) error {
+	return s.bolt.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, dbFilePermission)
+	})
+}
+
+// check implements dbStore.
+func (s *boltStore) check() ([]string, error) {
+	var problems []string
+	err := s.bolt.View(func(tx *bolt.Tx) error {
+		for errc := range tx.Check() {
+			problems = append(problems, errc.Error())
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// close implements dbStore.
+func (s *boltStore) close() error {
+	return s.bolt.Close()
+}
+
+// boltTx is the dbTx of a boltStore.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// get implements dbTx.
+func (t *boltTx) get(bucket, key []byte) []byte {
+	return t.tx.Bucket(bucket).Get(key)
+}
+
+// put implements dbTx.
+func (t *boltTx) put(bucket, key, val []byte) error {
+	return t.tx.Bucket(bucket).Put(key, val)
+}
+
+// delete implements dbTx.
+func (t *boltTx) delete(bucket, key []byte) error {
+	return t.tx.Bucket(bucket).Delete(key)
+}
+
+// seek implements dbTx.
+func (t *boltTx) seek(bucket, start, prefix []byte, fn func(k, v []byte) (bool, error)) error {
+	if len(start) == 0 {
+		start = prefix
+	}
+
+	c := t.tx.Bucket(bucket).Cursor()
+	var k, v []byte
+	if len(start) == 0 {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(start)
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		carryOn, err := fn(k, v)
+		if err != nil || !carryOn {
+			return err
+		}
+	}
+	return nil
+}
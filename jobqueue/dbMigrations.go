@@ -0,0 +1,209 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the versioning of our database schema, and the
+// migrations that upgrade databases made by older versions of wr.
+//
+// Whenever you change the way jobs are encoded in a way that old code can't
+// read, or change the format of keys or values in any bucket, increment
+// dbSchemaVersion and add a dbMigration that upgrades databases of the
+// previous version.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// dbSchemaVersion is the version of the database schema that this code reads
+// and writes.
+const dbSchemaVersion = 3
+
+// dbSchemaVersionUnversioned is the version we consider databases to be if
+// they were made before we stored schema versions.
+const dbSchemaVersionUnversioned = 1
+
+var (
+	bucketMeta       = []byte("meta")
+	keySchemaVersion = []byte("schema_version")
+)
+
+// dbMigration describes how to upgrade a database from the previous schema
+// version to a new one. migrate is called within a single transaction that
+// will also store the new version; like any update, it may be called more than
+// once, so it must only make changes via the transaction.
+type dbMigration struct {
+	version     int
+	description string
+	migrate     func(tx dbTx, ch codec.Handle) error
+}
+
+// dbMigrations are all our migrations, in version order.
+var dbMigrations = []*dbMigration{
+	{2, "index the history of jobs that have exited", migrateHistoryLookups},
+	{3, "store when job resource usage was observed", migrateResourceObservations},
+}
+
+// migrateHistoryLookups stores history lookups for every job that has exited.
+func migrateHistoryLookups(tx dbTx, ch codec.Handle) error {
+	for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete} {
+		err := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
+			dec := codec.NewDecoderBytes(v, ch)
+			job := &Job{}
+			err := dec.Decode(job)
+			if err != nil {
+				return false, err
+			}
+			return true, putHistoryLookups(tx, historyLookups(string(k), job))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateResourceObservations converts the entries in our resource buckets
+// from the old format, which was keyed on ReqGroup and value and stored only
+// the value, to resourceObservations. Since we don't know when the old values
+// were observed, they're treated as having been observed now.
+func migrateResourceObservations(tx dbTx, ch codec.Handle) error {
+	now := time.Now()
+	for _, bucket := range resourceBuckets {
+		var old sobsd
+		err := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
+			if !strings.Contains(string(v), ",") {
+				old = append(old, [2][]byte{copyBytes(k), copyBytes(v)})
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, kv := range old {
+			key := string(kv[0])
+			pos := strings.LastIndex(key, dbDelimiter)
+			if pos == -1 {
+				continue
+			}
+			value, erra := strconv.Atoi(string(kv[1]))
+			if erra != nil {
+				return erra
+			}
+
+			err = tx.delete(bucket, kv[0])
+			if err != nil {
+				return err
+			}
+
+			o := &resourceObservation{Value: value}
+			err = tx.put(bucket, resourceObservationKey(key[:pos], now, fmt.Sprintf("migrated%d", i)), o.encode())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getSchemaVersion returns the schema version stored in the database. If none
+// is stored, returns 0 if the database has no jobs, otherwise
+// dbSchemaVersionUnversioned.
+func getSchemaVersion(tx dbTx) (int, error) {
+	if v := tx.get(bucketMeta, keySchemaVersion); v != nil {
+		return strconv.Atoi(string(v))
+	}
+
+	empty := true
+	for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete} {
+		err := tx.seek(bucket, nil, nil, func(k, v []byte) (bool, error) {
+			empty = false
+			return false, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if empty {
+		return 0, nil
+	}
+	return dbSchemaVersionUnversioned, nil
+}
+
+// putSchemaVersion stores the given schema version in the database.
+func putSchemaVersion(tx dbTx, version int) error {
+	return tx.put(bucketMeta, keySchemaVersion, []byte(strconv.Itoa(version)))
+}
+
+// migrate upgrades our database to dbSchemaVersion, first backing it up to a
+// file next to dbFile. Returns a message describing what was done, if
+// anything. Returns an Error with Err ErrSchemaTooNew if the database was made
+// by a newer version of wr that we don't understand.
+func (db *db) migrate(dbFile string) (string, error) {
+	var version int
+	err := db.storage.view(func(tx dbTx) error {
+		var errg error
+		version, errg = getSchemaVersion(tx)
+		return errg
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case version > dbSchemaVersion:
+		return "", Error{"initDB", dbFile, ErrSchemaTooNew}
+	case version == dbSchemaVersion:
+		return "", nil
+	case version == 0:
+		return "", db.storage.update(func(tx dbTx) error {
+			return putSchemaVersion(tx, dbSchemaVersion)
+		})
+	}
+
+	bkPath := fmt.Sprintf("%s.pre_migration_v%d", dbFile, version)
+	err = db.storage.backupToFile(bkPath)
+	if err != nil {
+		return "", err
+	}
+
+	for _, m := range dbMigrations {
+		if m.version <= version {
+			continue
+		}
+		db.Info("Migrating database", "version", m.version, "migration", m.description)
+		err = db.storage.update(func(tx dbTx) error {
+			errm := m.migrate(tx, db.ch)
+			if errm != nil {
+				return errm
+			}
+			return putSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return "", fmt.Errorf("migration to schema version %d (%s) failed; the original database is in %s: %w", m.version, m.description, bkPath, err)
+		}
+	}
+
+	return fmt.Sprintf("migrated database from schema version %d to %d (the original was backed up to %s)", version, dbSchemaVersion, bkPath), nil
+}
@@ -0,0 +1,309 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the SQLite implementation of dbStore. Each of our buckets
+// is a table with a text primary key "k" and a blob value "v". Jobs are
+// stored JSON encoded, so you can query them with SQL, eg.
+// SELECT json_extract(CAST(v AS TEXT), '$.Cmd') FROM jobscomplete;
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	_ "modernc.org/sqlite" // registers the pure-go "sqlite" database driver
+)
+
+// sqliteSeekPageSize is the number of rows sqliteTx.seek() reads at a time.
+// We don't hold a query open while calling the seek function, so that it can
+// safely make other queries and changes in the same transaction.
+const sqliteSeekPageSize = 1000
+
+// sqliteStore is a dbStore that keeps each of our buckets as a table in a
+// SQLite database file.
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+}
+
+// openSQLiteStore opens or creates a SQLite database file at the given path,
+// ensuring there is a table for each of the given buckets.
+func openSQLiteStore(path string, buckets [][]byte) (dbStore, error) {
+	sdb, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer at a time, and we don't nest transactions,
+	// so we avoid lock contention by using a single connection
+	sdb.SetMaxOpenConns(1)
+
+	stmts := []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL"}
+	for _, bucket := range buckets {
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (k TEXT PRIMARY KEY, v BLOB) WITHOUT ROWID", sqliteTable(bucket)))
+	}
+	for _, stmt := range stmts {
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			sdb.Close()
+			return nil, err
+		}
+	}
+
+	err = os.Chmod(path, dbFilePermission)
+	if err != nil {
+		sdb.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: sdb, path: path}, nil
+}
+
+// sqliteTable returns the quoted table name for a bucket.
+func sqliteTable(bucket []byte) string {
+	return `"` + string(bucket) + `"`
+}
+
+// view implements dbStore.
+func (s *sqliteStore) view(fn func(tx dbTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stx := &sqliteTx{tx: tx}
+	err = fn(stx)
+	if err == nil {
+		err = stx.err
+	}
+	return err
+}
+
+// update implements dbStore.
+func (s *sqliteStore) update(fn func(tx dbTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stx := &sqliteTx{tx: tx}
+	err = fn(stx)
+	if err == nil {
+		err = stx.err
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// backup implements dbStore, by first backing up to a temporary file next to
+// our database file.
+func (s *sqliteStore) backup(w io.Writer) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".backup.*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = s.backupToFile(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// backupToFile implements dbStore, using VACUUM INTO to create a consistent,
+// compact copy of the database.
+func (s *sqliteStore) backupToFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = s.db.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, dbFilePermission)
+}
+
+// check implements dbStore.
+func (s *sqliteStore) check() ([]string, error) {
+	rows, err := s.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var problem string
+		err = rows.Scan(&problem)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// close implements dbStore.
+func (s *sqliteStore) close() error {
+	return s.db.Close()
+}
+
+// sqliteTx is the dbTx of a sqliteStore.
+type sqliteTx struct {
+	tx *sql.Tx
+
+	// err is the first error get() encountered, which fails the transaction,
+	// since get() itself can't return one.
+	err error
+}
+
+// get implements dbTx.
+func (t *sqliteTx) get(bucket, key []byte) []byte {
+	var v []byte
+	err := t.tx.QueryRow("SELECT v FROM "+sqliteTable(bucket)+" WHERE k = ?", string(key)).Scan(&v)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) && t.err == nil {
+			t.err = err
+		}
+		return nil
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+// put implements dbTx.
+func (t *sqliteTx) put(bucket, key, val []byte) error {
+	if val == nil {
+		val = []byte{}
+	}
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO "+sqliteTable(bucket)+" (k, v) VALUES (?, ?)", string(key), val)
+	return err
+}
+
+// delete implements dbTx.
+func (t *sqliteTx) delete(bucket, key []byte) error {
+	_, err := t.tx.Exec("DELETE FROM "+sqliteTable(bucket)+" WHERE k = ?", string(key))
+	return err
+}
+
+// seek implements dbTx, reading sqliteSeekPageSize rows at a time.
+func (t *sqliteTx) seek(bucket, start, prefix []byte, fn func(k, v []byte) (bool, error)) error {
+	if len(start) == 0 {
+		start = prefix
+	}
+	end := prefixEnd(prefix)
+
+	op := ">="
+	for {
+		query := "SELECT k, v FROM " + sqliteTable(bucket) + " WHERE k " + op + " ?"
+		args := []interface{}{string(start)}
+		if end != nil {
+			query += " AND k < ?"
+			args = append(args, string(end))
+		}
+		query += " ORDER BY k LIMIT " + strconv.Itoa(sqliteSeekPageSize)
+
+		kvs, err := t.seekPage(query, args)
+		if err != nil {
+			return err
+		}
+
+		for _, kv := range kvs {
+			if !bytes.HasPrefix(kv[0], prefix) {
+				return nil
+			}
+			carryOn, errf := fn(kv[0], kv[1])
+			if errf != nil || !carryOn {
+				return errf
+			}
+		}
+
+		if len(kvs) < sqliteSeekPageSize {
+			return nil
+		}
+		start = kvs[len(kvs)-1][0]
+		op = ">"
+	}
+}
+
+// seekPage runs a seek() query and returns all its rows.
+func (t *sqliteTx) seekPage(query string, args []interface{}) (sobsd, error) {
+	rows, err := t.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var kvs sobsd
+	for rows.Next() {
+		var k string
+		var v []byte
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		kvs = append(kvs, [2][]byte{[]byte(k), v})
+	}
+	return kvs, rows.Err()
+}
+
+// prefixEnd returns the smallest key that is greater than every key with the
+// given prefix, or nil if there is no such key (or no prefix).
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,994 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/cloud"
+	"github.com/VertebrateResequencing/wr/internal"
+	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/limiter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// TestDB runs the same tests against every database backend.
+func TestDB(t *testing.T) {
+	if runnermode || servermode {
+		return
+	}
+
+	for _, backend := range []string{DBBackendBolt, DBBackendSQLite} {
+		testDBStore(t, backend)
+		testDBBackend(t, backend)
+	}
+}
+
+// testDBStore tests a dbStore implementation directly.
+func testDBStore(t *testing.T, backend string) {
+	Convey("Given a new "+backend+" store", t, func() {
+		dir, err := os.MkdirTemp("", "wr_jobqueue_test_db_store_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "db")
+
+		store, err := openDBStore(backend, path)
+		So(err, ShouldBeNil)
+		defer store.close()
+
+		Convey("You can put, get and delete values", func() {
+			err = store.update(func(tx dbTx) error {
+				errp := tx.put(bucketEnvs, []byte("a"), []byte("1"))
+				if errp != nil {
+					return errp
+				}
+				return tx.put(bucketEnvs, []byte("b"), nil)
+			})
+			So(err, ShouldBeNil)
+
+			err = store.view(func(tx dbTx) error {
+				So(string(tx.get(bucketEnvs, []byte("a"))), ShouldEqual, "1")
+				So(tx.get(bucketEnvs, []byte("b")), ShouldNotBeNil)
+				So(tx.get(bucketEnvs, []byte("c")), ShouldBeNil)
+				So(tx.get(bucketStdO, []byte("a")), ShouldBeNil)
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			err = store.update(func(tx dbTx) error {
+				return tx.delete(bucketEnvs, []byte("a"))
+			})
+			So(err, ShouldBeNil)
+
+			err = store.view(func(tx dbTx) error {
+				So(tx.get(bucketEnvs, []byte("a")), ShouldBeNil)
+				return nil
+			})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Failed updates are not committed", func() {
+			err = store.update(func(tx dbTx) error {
+				errp := tx.put(bucketEnvs, []byte("a"), []byte("1"))
+				if errp != nil {
+					return errp
+				}
+				return fmt.Errorf("failed")
+			})
+			So(err, ShouldNotBeNil)
+
+			err = store.view(func(tx dbTx) error {
+				So(tx.get(bucketEnvs, []byte("a")), ShouldBeNil)
+				return nil
+			})
+			So(err, ShouldBeNil)
+		})
+
+		if backend == DBBackendSQLite {
+			Convey("Updates with failed gets are not committed", func() {
+				err = store.update(func(tx dbTx) error {
+					errp := tx.put(bucketEnvs, []byte("a"), []byte("1"))
+					if errp != nil {
+						return errp
+					}
+					So(tx.get([]byte("nonexistent"), []byte("a")), ShouldBeNil)
+					return nil
+				})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "no such table")
+
+				err = store.view(func(tx dbTx) error {
+					So(tx.get(bucketEnvs, []byte("a")), ShouldBeNil)
+					return nil
+				})
+				So(err, ShouldBeNil)
+			})
+		}
+
+		Convey("You can seek over keys in order", func() {
+			n := sqliteSeekPageSize*2 + 10
+			err = store.update(func(tx dbTx) error {
+				for i := n - 1; i >= 0; i-- {
+					errp := tx.put(bucketRTK, []byte(fmt.Sprintf("a%s%05d", dbDelimiter, i)), nil)
+					if errp != nil {
+						return errp
+					}
+				}
+				for _, key := range []string{"a", "b" + dbDelimiter + "1", "\xff\xff"} {
+					errp := tx.put(bucketRTK, []byte(key), []byte(key))
+					if errp != nil {
+						return errp
+					}
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			seek := func(start, prefix string, max int) []string {
+				var keys []string
+				errs := store.view(func(tx dbTx) error {
+					return tx.seek(bucketRTK, []byte(start), []byte(prefix), func(k, v []byte) (bool, error) {
+						keys = append(keys, string(k))
+						return max == 0 || len(keys) < max, nil
+					})
+				})
+				So(errs, ShouldBeNil)
+				return keys
+			}
+
+			keys := seek("", "a"+dbDelimiter, 0)
+			So(len(keys), ShouldEqual, n)
+			So(sort.StringsAreSorted(keys), ShouldBeTrue)
+			So(keys[0], ShouldEqual, "a"+dbDelimiter+"00000")
+
+			keys = seek("a"+dbDelimiter+"01999", "a"+dbDelimiter, 0)
+			So(len(keys), ShouldEqual, n-1999)
+			So(keys[0], ShouldEqual, "a"+dbDelimiter+"01999")
+
+			keys = seek("", "a"+dbDelimiter, 3)
+			So(keys, ShouldResemble, []string{"a" + dbDelimiter + "00000", "a" + dbDelimiter + "00001", "a" + dbDelimiter + "00002"})
+
+			keys = seek("", "b", 0)
+			So(keys, ShouldResemble, []string{"b" + dbDelimiter + "1"})
+
+			keys = seek("", "\xff", 0)
+			So(keys, ShouldResemble, []string{"\xff\xff"})
+
+			keys = seek("", "", 0)
+			So(len(keys), ShouldEqual, n+3)
+			So(keys[0], ShouldEqual, "a")
+			So(keys[n+2], ShouldEqual, "\xff\xff")
+
+			Convey("And make changes while seeking", func() {
+				err = store.update(func(tx dbTx) error {
+					return tx.seek(bucketRTK, nil, []byte("a"+dbDelimiter), func(k, v []byte) (bool, error) {
+						return true, tx.delete(bucketRTK, k)
+					})
+				})
+				So(err, ShouldBeNil)
+				So(len(seek("", "", 0)), ShouldEqual, 3)
+			})
+		})
+
+		Convey("You can back it up", func() {
+			err = store.update(func(tx dbTx) error {
+				return tx.put(bucketEnvs, []byte("a"), []byte("1"))
+			})
+			So(err, ShouldBeNil)
+
+			bkPath := filepath.Join(dir, "db_bk")
+			err = store.backupToFile(bkPath)
+			So(err, ShouldBeNil)
+			err = store.backupToFile(bkPath)
+			So(err, ShouldBeNil)
+
+			var buf bytes.Buffer
+			err = store.backup(&buf)
+			So(err, ShouldBeNil)
+			streamPath := filepath.Join(dir, "db_stream")
+			err = os.WriteFile(streamPath, buf.Bytes(), dbFilePermission)
+			So(err, ShouldBeNil)
+
+			for _, path := range []string{bkPath, streamPath} {
+				bk, err := openDBStore(backend, path)
+				So(err, ShouldBeNil)
+				err = bk.view(func(tx dbTx) error {
+					So(string(tx.get(bucketEnvs, []byte("a"))), ShouldEqual, "1")
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(bk.close(), ShouldBeNil)
+			}
+		})
+	})
+}
+
+// testDBBackend tests our db using the given backend.
+func testDBBackend(t *testing.T, backend string) {
+	Convey("Given a new db using the "+backend+" backend", t, func() {
+		dir, err := os.MkdirTemp("", "wr_jobqueue_test_db_")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		db, msg, err := initDB(filepath.Join(dir, "db"), filepath.Join(dir, "db_bk"), backend, internal.Development, testLogger)
+		So(err, ShouldBeNil)
+		So(msg, ShouldStartWith, "created new empty db file")
+		defer db.close()
+
+		waitForDB := func() {
+			db.wgMutex.Lock()
+			db.wg.Wait(dbRunningTransactionsWaitTime)
+			db.wgMutex.Unlock()
+		}
+
+		req := &jqs.Requirements{RAM: 100, Time: 1 * time.Minute, Cores: 1}
+		parent := &Job{Cmd: "parent", Cwd: "/tmp", RepGroup: "rg1", ReqGroup: "req", Requirements: req, DepGroups: []string{"dg1"}}
+		child := &Job{Cmd: "child", Cwd: "/tmp", RepGroup: "rg2", ReqGroup: "req", Requirements: req,
+			Dependencies: Dependencies{NewDepGroupDependency("dg1")}, LimitGroups: []string{"l1"}}
+
+		Convey("You can store and retrieve limit groups", func() {
+			changed, removed, err := db.storeLimitGroups(map[string]*limitGroup{"l1": {limit: 5}, "l2": {limit: 0}})
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeEmpty)
+			So(removed, ShouldBeEmpty)
+			So(db.retrieveLimitGroup("l1"), ShouldEqual, 5)
+			So(db.retrieveLimitGroup("l2"), ShouldEqual, 0)
+			So(db.retrieveLimitGroup("l3"), ShouldEqual, -1)
+			So(db.retrieveLimitGroupRate("l1"), ShouldBeNil)
+
+			changed, removed, err = db.storeLimitGroups(map[string]*limitGroup{"l1": {limit: 6}, "l2": {limit: -1}})
+			So(err, ShouldBeNil)
+			So(changed, ShouldResemble, []string{"l1"})
+			So(removed, ShouldResemble, []string{"l2"})
+			So(db.retrieveLimitGroup("l1"), ShouldEqual, 6)
+			So(db.retrieveLimitGroup("l2"), ShouldEqual, -1)
+
+			rate := &limiter.Rate{Count: 100, Window: time.Minute}
+			changed, removed, err = db.storeLimitGroups(map[string]*limitGroup{"l1": {limit: 6, rate: rate}, "l3": {limit: -1, rate: rate}})
+			So(err, ShouldBeNil)
+			So(changed, ShouldResemble, []string{"l1"})
+			So(removed, ShouldBeEmpty)
+			So(db.retrieveLimitGroup("l1"), ShouldEqual, 6)
+			So(db.retrieveLimitGroupRate("l1"), ShouldResemble, rate)
+			So(db.retrieveLimitGroup("l3"), ShouldEqual, -1)
+			So(db.retrieveLimitGroupRate("l3"), ShouldResemble, rate)
+
+			changed, removed, err = db.storeLimitGroups(map[string]*limitGroup{"l1": {limit: 6, rate: rate}, "l3": {limit: -1}})
+			So(err, ShouldBeNil)
+			So(changed, ShouldBeEmpty)
+			So(removed, ShouldResemble, []string{"l3"})
+			So(db.retrieveLimitGroupRate("l3"), ShouldBeNil)
+		})
+
+		Convey("You can store and retrieve envs", func() {
+			env := []byte("compressed env")
+			key, err := db.storeEnv(env)
+			So(err, ShouldBeNil)
+			db.envcache.Purge()
+			So(db.retrieveEnv(key), ShouldResemble, env)
+		})
+
+		Convey("Job costs are worked out from cost rates, and totalled per RepGroup and user", func() {
+			rates, err := ParseCostRates("core:0.5, gb:0.25,m1.large:4")
+			So(err, ShouldBeNil)
+			So(rates.CoreHour, ShouldEqual, 0.5)
+			So(rates.GBHour, ShouldEqual, 0.25)
+			So(rates.Flavors, ShouldResemble, map[string]float64{"m1.large": 4})
+
+			rates, err = ParseCostRates("")
+			So(err, ShouldBeNil)
+			So(rates, ShouldBeNil)
+			_, err = ParseCostRates("core")
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrBadCostRates)
+			_, err = ParseCostRates("core:-1")
+			So(err, ShouldNotBeNil)
+
+			rates, err = ParseCostRates("core:0.5,gb:0.25,m1.large:4")
+			So(err, ShouldBeNil)
+			twoHours := 2 * time.Hour
+			costReq := &jqs.Requirements{RAM: 2048, Cores: 2}
+			So(rates.jobCost(costReq, nil, twoHours), ShouldEqual, 3)
+			So(rates.jobCost(costReq, &cloud.Flavor{Name: "m1.small", Cores: 4, RAM: 8192}, twoHours), ShouldEqual, 3)
+			So(rates.jobCost(costReq, &cloud.Flavor{Name: "m1.large", Cores: 8, RAM: 4096}, twoHours), ShouldEqual, 4)
+			So(rates.jobCost(&jqs.Requirements{RAM: 8192, Cores: 16}, &cloud.Flavor{Name: "m1.large", Cores: 8, RAM: 4096}, twoHours), ShouldEqual, 8)
+			So(rates.jobCost(costReq, nil, 0), ShouldEqual, 0)
+			var noRates *CostRates
+			So(noRates.jobCost(costReq, nil, twoHours), ShouldEqual, 0)
+			So(jobCoreHours(costReq, twoHours), ShouldEqual, 2*costReq.Cores)
+
+			_, _, _, err = db.storeNewJobs([]*Job{parent, child}, true)
+			So(err, ShouldBeNil)
+			parent.User = "alice"
+			child.User = "bob"
+
+			parent.Exited = true
+			parent.Exitcode = 1
+			parent.Cost = 1.5
+			parent.runCost = 1.5
+			db.updateJobAfterExit(parent, nil, nil, false)
+			waitForDB()
+			So(parent.runCost, ShouldEqual, 0)
+
+			parent.Exitcode = 0
+			parent.State = JobStateComplete
+			parent.Cost += 2
+			parent.runCost = 2
+			err = db.archiveJob(parent.Key(), parent)
+			So(err, ShouldBeNil)
+
+			child.Exited = true
+			child.Cost = 0.25
+			child.runCost = 0.25
+			child.runCoreHours = 4
+			err = db.archiveJob(child.Key(), child)
+			So(err, ShouldBeNil)
+
+			totals, err := db.costTotals()
+			So(err, ShouldBeNil)
+			So(totals.Total, ShouldEqual, 3.75)
+			So(totals.RepGroups, ShouldResemble, map[string]float64{"rg1": 3.5, "rg2": 0.25})
+			So(totals.Users, ShouldResemble, map[string]float64{"alice": 3.5, "bob": 0.25})
+			So(totals.CoreHours, ShouldEqual, 4)
+			So(totals.RepGroupCoreHours, ShouldResemble, map[string]float64{"rg2": 4})
+			So(totals.UserCoreHours, ShouldResemble, map[string]float64{"bob": 4})
+
+			complete, err := db.retrieveCompleteJobsByKeys([]string{parent.Key()})
+			So(err, ShouldBeNil)
+			So(len(complete), ShouldEqual, 1)
+			So(complete[0].Cost, ShouldEqual, 3.5)
+			So(complete[0].User, ShouldEqual, "alice")
+
+			err = db.archiveJob(child.Key(), child)
+			So(err, ShouldBeNil)
+			totals, err = db.costTotals()
+			So(err, ShouldBeNil)
+			So(totals.Total, ShouldEqual, 3.75)
+		})
+
+		Convey("Recommendations favour recent jobs, can be based on size hints, and their accuracy is reported", func() {
+			now := time.Now()
+			err = db.storage.update(func(tx dbTx) error {
+				for i := 0; i < 10; i++ {
+					for _, o := range []*resourceObservation{
+						{Value: 1000, End: now.Add(-100 * 24 * time.Hour)},
+						{Value: 200, End: now},
+					} {
+						errp := tx.put(bucketJobRAM, resourceObservationKey("decay", o.End, fmt.Sprintf("job%d", i)), o.encode())
+						if errp != nil {
+							return errp
+						}
+					}
+				}
+
+				for h := 1; h <= 20; h++ {
+					o := &resourceObservation{Value: 100*h + 50, Predicted: 3600, Hint: float64(h)}
+					if h == 20 {
+						o.Predicted = 2000
+					}
+					errp := tx.put(bucketJobSecs, resourceObservationKey("hinted", now, fmt.Sprintf("job%d", h)), o.encode())
+					if errp != nil {
+						return errp
+					}
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+
+			rec, err := db.recommendedReqGroupMemory("decay")
+			So(err, ShouldBeNil)
+			So(rec, ShouldEqual, 200)
+
+			db.setRecommendationSettings(0, 60, -1)
+			rec, err = db.recommendedReqGroupMemory("decay")
+			So(err, ShouldBeNil)
+			So(rec, ShouldEqual, 1000)
+
+			reqs, err := db.recommendedReqs("hinted", 0)
+			So(err, ShouldBeNil)
+			So(reqs.Time, ShouldEqual, 1560*time.Second)
+			reqs, err = db.recommendedReqs("hinted", 40)
+			So(err, ShouldBeNil)
+			So(reqs.Time, ShouldEqual, 4080*time.Second)
+			So(reqs.RAM, ShouldEqual, 0)
+
+			rr, err := db.reqsRecommender("hinted")
+			So(err, ShouldBeNil)
+			So(rr.reqs(0).Time, ShouldEqual, 1560*time.Second)
+			So(rr.reqs(40).Time, ShouldEqual, 4080*time.Second)
+			So(rr.reqs(20).Time, ShouldBeBetween, 1560*time.Second, 4080*time.Second)
+
+			accuracy, err := db.recommendationAccuracy("")
+			So(err, ShouldBeNil)
+			So(accuracy, ShouldResemble, []*ReqGroupAccuracy{{
+				ReqGroup:      "hinted",
+				Resource:      ReqGroupResourceTime,
+				Count:         20,
+				Under:         1,
+				MeanPredicted: 3520,
+				MeanActual:    1100,
+				MeanAbsError:  2425,
+			}})
+			accuracy, err = db.recommendationAccuracy("decay")
+			So(err, ShouldBeNil)
+			So(accuracy, ShouldBeEmpty)
+
+			Convey("You can get stats on what has been learned, and reset and seed them", func() {
+				stats, err := db.reqGroupStats("")
+				So(err, ShouldBeNil)
+				So(len(stats), ShouldEqual, 2)
+				So(stats[0].ReqGroup, ShouldEqual, "decay")
+				So(stats[1].ReqGroup, ShouldEqual, "hinted")
+
+				So(len(stats[0].Resources), ShouldEqual, 1)
+				rs := stats[0].Resources[0]
+				So(rs.Resource, ShouldEqual, ReqGroupResourceMemory)
+				So(rs.Count, ShouldEqual, 20)
+				So(rs.Min, ShouldEqual, 200)
+				So(rs.Max, ShouldEqual, 1000)
+				So(rs.Percentiles[50], ShouldEqual, 200)
+				So(rs.Percentiles[95], ShouldEqual, 1000)
+				So(rs.Recommendation, ShouldEqual, 1000)
+				So(rs.Newest.Sub(rs.Oldest), ShouldEqual, 100*24*time.Hour)
+				So(len(rs.Histogram), ShouldEqual, 10)
+				So(rs.Histogram[0], ShouldResemble, &HistogramBin{From: 200, To: 280, Count: 10})
+				So(rs.Histogram[9].Count, ShouldEqual, 10)
+
+				stats, err = db.reqGroupStats("hinted")
+				So(err, ShouldBeNil)
+				So(len(stats), ShouldEqual, 1)
+				So(stats[0].Resources[0].Resource, ShouldEqual, ReqGroupResourceTime)
+				So(stats[0].Resources[0].Recommendation, ShouldEqual, 1560)
+
+				removed, err := db.removeReqGroupStats(&ReqGroupStatsFilter{ReqGroup: "decay", Resource: ReqGroupResourceTime})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 0)
+				_, err = db.removeReqGroupStats(&ReqGroupStatsFilter{ReqGroup: "decay", Resource: "cpu"})
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadResource)
+
+				removed, err = db.removeReqGroupStats(&ReqGroupStatsFilter{ReqGroup: "decay", Until: now.Add(-24 * time.Hour)})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 10)
+				stats, err = db.reqGroupStats("decay")
+				So(err, ShouldBeNil)
+				So(stats[0].Resources[0].Count, ShouldEqual, 10)
+				So(stats[0].Resources[0].Max, ShouldEqual, 200)
+
+				removed, err = db.removeReqGroupStats(&ReqGroupStatsFilter{ReqGroup: "hinted", Since: now.Add(-time.Minute)})
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 20)
+				stats, err = db.reqGroupStats("")
+				So(err, ShouldBeNil)
+				So(len(stats), ShouldEqual, 1)
+
+				export := "key,req_group,state,fail_reason,req_memory_mb,req_time_secs,req_disk_gb,peak_memory_mb,peak_disk_mb,wall_time_secs,end_time,size_hint\n" +
+					"k1,seedme,complete,,1000,3600,1,800,10,59.5,2021-06-29T15:04:05Z,2\n" +
+					"k2,seedme,buried," + FailReasonTime + ",1000,60,0,900,0,61,2021-06-29T16:04:05Z,\n" +
+					"k3,seedme,buried," + FailReasonExit + ",1000,60,0,900,0,10,2021-06-29T16:04:05Z,\n"
+				observations, err := ReadReqGroupObservations(strings.NewReader(export), ExportFormatCSV, "")
+				So(err, ShouldBeNil)
+				So(len(observations), ShouldEqual, 4)
+				end := time.Date(2021, 6, 29, 15, 4, 5, 0, time.UTC)
+				So(observations[0], ShouldResemble, &ReqGroupObservation{ReqGroup: "seedme", Resource: ReqGroupResourceMemory, Value: 800, Predicted: 1000, SizeHint: 2, End: end, Key: "k1"})
+				So(observations[1].Predicted, ShouldEqual, 1024)
+				So(observations[2].Value, ShouldEqual, 60)
+				So(observations[3].Resource, ShouldEqual, ReqGroupResourceTime)
+				So(observations[3].Value, ShouldEqual, 61)
+
+				jsonl := `{"key":"k1","req_group":"seedme","state":"complete","peak_memory_mb":800,"end_time":"2021-06-29T15:04:05Z"}` + "\n"
+				jobservations, err := ReadReqGroupObservations(strings.NewReader(jsonl), ExportFormatJSONL, "other")
+				So(err, ShouldBeNil)
+				So(len(jobservations), ShouldEqual, 3)
+				So(jobservations[0].ReqGroup, ShouldEqual, "other")
+				So(jobservations[0].Value, ShouldEqual, 800)
+
+				added, err := db.seedReqGroupStats(observations)
+				So(err, ShouldBeNil)
+				So(added, ShouldEqual, 4)
+				added, err = db.seedReqGroupStats(observations)
+				So(err, ShouldBeNil)
+				So(added, ShouldEqual, 4)
+				stats, err = db.reqGroupStats("seedme")
+				So(err, ShouldBeNil)
+				So(len(stats), ShouldEqual, 1)
+				So(len(stats[0].Resources), ShouldEqual, 3)
+				So(stats[0].Resources[2].Count, ShouldEqual, 2)
+
+				_, err = db.seedReqGroupStats([]*ReqGroupObservation{{ReqGroup: "", Resource: ReqGroupResourceMemory, Value: 1}})
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadObservation)
+			})
+		})
+
+		Convey("You can store new jobs", func() {
+			toQueue, toUpdate, already, err := db.storeNewJobs([]*Job{parent, child}, true)
+			So(err, ShouldBeNil)
+			So(len(toQueue), ShouldEqual, 2)
+			So(toUpdate, ShouldBeEmpty)
+			So(already, ShouldEqual, 0)
+
+			live, err := db.checkIfLive(child.Key())
+			So(err, ShouldBeNil)
+			So(live, ShouldBeTrue)
+			added, err := db.checkIfAdded("foo")
+			So(err, ShouldBeNil)
+			So(added, ShouldBeFalse)
+
+			_, _, already, err = db.storeNewJobs([]*Job{parent}, true)
+			So(err, ShouldBeNil)
+			So(already, ShouldEqual, 1)
+
+			recovered, err := db.recoverIncompleteJobs()
+			So(err, ShouldBeNil)
+			So(len(recovered), ShouldEqual, 2)
+			for _, job := range recovered {
+				if job.Cmd == "child" {
+					So(job.Key(), ShouldEqual, child.Key())
+					So(job.Requirements.Time, ShouldEqual, req.Time)
+					So(job.Dependencies.DepGroups(), ShouldResemble, []string{"dg1"})
+					So(job.LimitGroups, ShouldResemble, []string{"l1"})
+				}
+			}
+
+			rgs, err := db.retrieveRepGroups()
+			So(err, ShouldBeNil)
+			So(rgs, ShouldResemble, []string{"rg1", "rg2"})
+
+			keys, err := db.retrieveIncompleteJobKeysByDepGroup("dg1")
+			So(err, ShouldBeNil)
+			So(keys, ShouldResemble, []string{parent.Key()})
+
+			if backend == DBBackendSQLite {
+				var cmd string
+				err = db.replication.dbStore.(*sqliteStore).db.QueryRow("SELECT json_extract(CAST(v AS TEXT), '$.Cmd') FROM jobslive WHERE k = ?", child.Key()).Scan(&cmd)
+				So(err, ShouldBeNil)
+				So(cmd, ShouldEqual, "child")
+			}
+
+			Convey("Then update them after they exit", func() {
+				parent.Exited = true
+				parent.Exitcode = 1
+				parent.FailReason = FailReasonRAM
+				parent.PeakRAM = 250
+				parent.Host = "host1"
+				parent.StartTime = time.Now().Add(-2 * time.Second)
+				parent.EndTime = time.Now()
+				db.updateJobAfterExit(parent, []byte("out"), []byte("err"), false)
+				waitForDB()
+
+				stdo, stde := db.retrieveJobStd(parent.Key())
+				So(string(stdo), ShouldEqual, "out")
+				So(string(stde), ShouldEqual, "err")
+
+				rec, err := db.recommendedReqGroupMemory("req")
+				So(err, ShouldBeNil)
+				So(rec, ShouldEqual, 300)
+
+				found, _, err := db.retrieveJobHistory(&JobSearch{Host: "host1"})
+				So(err, ShouldBeNil)
+				So(len(found), ShouldEqual, 1)
+				So(found[0].Key(), ShouldEqual, parent.Key())
+				So(found[0].PeakRAM, ShouldEqual, 250)
+
+				Convey("And archive them", func() {
+					parent.Exitcode = 0
+					parent.FailReason = ""
+					parent.State = JobStateComplete
+					parent.EndTime = time.Now()
+					err = db.archiveJob(parent.Key(), parent)
+					So(err, ShouldBeNil)
+
+					live, err = db.checkIfLive(parent.Key())
+					So(err, ShouldBeNil)
+					So(live, ShouldBeFalse)
+					added, err = db.checkIfAdded(parent.Key())
+					So(err, ShouldBeNil)
+					So(added, ShouldBeTrue)
+
+					stdo, stde = db.retrieveJobStd(parent.Key())
+					So(stdo, ShouldBeNil)
+					So(stde, ShouldBeNil)
+
+					complete, err := db.retrieveCompleteJobsByKeys([]string{parent.Key(), child.Key()})
+					So(err, ShouldBeNil)
+					So(len(complete), ShouldEqual, 1)
+					So(complete[0].State, ShouldEqual, JobStateComplete)
+					So(complete[0].EndTime.Equal(parent.EndTime), ShouldBeTrue)
+
+					complete, err = db.retrieveCompleteJobsByRepGroup("rg1")
+					So(err, ShouldBeNil)
+					So(len(complete), ShouldEqual, 1)
+
+					found, _, err = db.retrieveJobHistory(&JobSearch{Complete: true})
+					So(err, ShouldBeNil)
+					So(len(found), ShouldEqual, 1)
+					So(found[0].Exitcode, ShouldEqual, 0)
+
+					rec, err = db.recommendedReqGroupTime("req")
+					So(err, ShouldBeNil)
+					So(rec, ShouldBeGreaterThanOrEqualTo, 2)
+
+					Convey("Re-adding the parent brings back its dependents", func() {
+						err = db.deleteLiveJobs([]string{child.Key()})
+						So(err, ShouldBeNil)
+						err = db.archiveJob(child.Key(), child)
+						So(err, ShouldBeNil)
+
+						newParent := &Job{Cmd: "parent2", Cwd: "/tmp", RepGroup: "rg1", ReqGroup: "req", Requirements: req, DepGroups: []string{"dg1"}}
+						toQueue, toUpdate, _, err = db.storeNewJobs([]*Job{newParent}, false)
+						So(err, ShouldBeNil)
+						So(toUpdate, ShouldBeEmpty)
+						So(len(toQueue), ShouldEqual, 2)
+						So(toQueue[0].Key(), ShouldEqual, child.Key())
+					})
+
+					Convey("Databases from before schema versioning are migrated, and newer ones are refused", func() {
+						waitForDB()
+						err = db.storage.update(func(tx dbTx) error {
+							errd := tx.delete(bucketMeta, keySchemaVersion)
+							if errd != nil {
+								return errd
+							}
+							var keys [][]byte
+							errd = tx.seek(bucketEndTK, nil, nil, func(k, v []byte) (bool, error) {
+								keys = append(keys, copyBytes(k))
+								return true, nil
+							})
+							if errd != nil {
+								return errd
+							}
+							for _, k := range keys {
+								errd = tx.delete(bucketEndTK, k)
+								if errd != nil {
+									return errd
+								}
+							}
+							for _, mb := range []int{5000, 4000} {
+								errd = tx.put(bucketJobRAM, []byte(fmt.Sprintf("old%s%20d", dbDelimiter, mb)), []byte(strconv.Itoa(mb)))
+								if errd != nil {
+									return errd
+								}
+							}
+							return nil
+						})
+						So(err, ShouldBeNil)
+						found, _, err = db.retrieveJobHistory(&JobSearch{Complete: true})
+						So(err, ShouldBeNil)
+						So(found, ShouldBeEmpty)
+						So(db.close(), ShouldBeNil)
+
+						dbFile := filepath.Join(dir, "db")
+						db, msg, err = initDB(dbFile, filepath.Join(dir, "db_bk"), backend, internal.Production, testLogger)
+						So(err, ShouldBeNil)
+						So(msg, ShouldContainSubstring, fmt.Sprintf("migrated database from schema version 1 to %d", dbSchemaVersion))
+						_, err = os.Stat(dbFile + ".pre_migration_v1")
+						So(err, ShouldBeNil)
+
+						found, _, err = db.retrieveJobHistory(&JobSearch{Complete: true})
+						So(err, ShouldBeNil)
+						So(len(found), ShouldEqual, 1)
+
+						rec, err = db.recommendedReqGroupMemory("old")
+						So(err, ShouldBeNil)
+						So(rec, ShouldEqual, 5000)
+						rec, err = db.recommendedReqGroupMemory("req")
+						So(err, ShouldBeNil)
+						So(rec, ShouldEqual, 300)
+
+						err = db.storage.update(func(tx dbTx) error {
+							return putSchemaVersion(tx, dbSchemaVersion+1)
+						})
+						So(err, ShouldBeNil)
+						So(db.close(), ShouldBeNil)
+
+						_, _, err = initDB(dbFile, filepath.Join(dir, "db_bk"), backend, internal.Production, testLogger)
+						So(err, ShouldNotBeNil)
+						jqerr, ok := err.(Error)
+						So(ok, ShouldBeTrue)
+						So(jqerr.Err, ShouldEqual, ErrSchemaTooNew)
+					})
+					Convey("Retention rules delete old data, and the database can be compacted while in use", func() {
+						rules, err := ParseRetentionRules("std:30d; jobs:1h:^rg1$")
+						So(err, ShouldBeNil)
+						So(len(rules), ShouldEqual, 2)
+						So(rules[1].String(), ShouldEqual, "jobs:1h0m0s:^rg1$")
+						_, err = ParseRetentionRules("std:30")
+						So(err, ShouldNotBeNil)
+						_, err = ParseRetentionRules("foo:30d")
+						So(err, ShouldNotBeNil)
+
+						envKey, err := db.storeEnv([]byte("env"))
+						So(err, ShouldBeNil)
+						parent.EnvKey = envKey
+						err = db.archiveJob(parent.Key(), parent)
+						So(err, ShouldBeNil)
+						db.envcache.Purge()
+
+						child.Exited = true
+						child.Exitcode = 1
+						child.StartTime = time.Now().Add(-40 * 24 * time.Hour)
+						child.EndTime = child.StartTime.Add(time.Second)
+						db.updateJobAfterExit(child, []byte("out"), []byte("err"), false)
+						waitForDB()
+
+						result, err := db.applyRetention(rules, time.Now())
+						So(err, ShouldBeNil)
+						So(result, ShouldResemble, &RetentionResult{Std: 1})
+						stdo, stde = db.retrieveJobStd(child.Key())
+						So(stdo, ShouldBeNil)
+						So(stde, ShouldBeNil)
+						complete, err = db.retrieveCompleteJobsByKeys([]string{parent.Key()})
+						So(err, ShouldBeNil)
+						So(len(complete), ShouldEqual, 1)
+
+						result, err = db.applyRetention(rules, time.Now().Add(2*time.Hour))
+						So(err, ShouldBeNil)
+						So(result, ShouldResemble, &RetentionResult{Jobs: 1, Envs: 1})
+						complete, err = db.retrieveCompleteJobsByKeys([]string{parent.Key()})
+						So(err, ShouldBeNil)
+						So(complete, ShouldBeEmpty)
+						complete, err = db.retrieveCompleteJobsByRepGroup("rg1")
+						So(err, ShouldBeNil)
+						So(complete, ShouldBeEmpty)
+						found, _, err = db.retrieveJobHistory(&JobSearch{Complete: true})
+						So(err, ShouldBeNil)
+						So(found, ShouldBeEmpty)
+						So(db.retrieve(bucketEnvs, envKey), ShouldBeNil)
+						live, err = db.checkIfLive(child.Key())
+						So(err, ShouldBeNil)
+						So(live, ShouldBeTrue)
+
+						rec, err = db.recommendedReqGroupTime("req")
+						So(err, ShouldBeNil)
+						So(rec, ShouldBeGreaterThanOrEqualTo, 2)
+
+						padding := make([]byte, 1024)
+						for i := 0; i < 4; i++ {
+							err = db.storage.update(func(tx dbTx) error {
+								for j := 0; j < 1000; j++ {
+									errp := tx.put(bucketEnvs, []byte(fmt.Sprintf("pad%d.%d", i, j)), padding)
+									if errp != nil {
+										return errp
+									}
+								}
+								return nil
+							})
+							So(err, ShouldBeNil)
+						}
+						err = db.storage.update(func(tx dbTx) error {
+							for i := 0; i < 4; i++ {
+								for j := 0; j < 1000; j++ {
+									errd := tx.delete(bucketEnvs, []byte(fmt.Sprintf("pad%d.%d", i, j)))
+									if errd != nil {
+										return errd
+									}
+								}
+							}
+							return nil
+						})
+						So(err, ShouldBeNil)
+
+						stop := make(chan struct{})
+						written := make(chan int)
+						go func() {
+							i := 0
+							defer func() { written <- i }()
+							for {
+								select {
+								case <-stop:
+									return
+								default:
+								}
+								if db.store(bucketLGs, fmt.Sprintf("during%d", i), []byte("1")) != nil {
+									return
+								}
+								i++
+							}
+						}()
+
+						compaction, err := db.compact()
+						close(stop)
+						n := <-written
+						So(err, ShouldBeNil)
+						So(compaction.SizeAfter, ShouldBeGreaterThan, 0)
+						So(compaction.Reclaimed(), ShouldBeGreaterThan, 2*1024*1024)
+						_, err = os.Stat(filepath.Join(dir, "db"+compactFileSuffix))
+						So(os.IsNotExist(err), ShouldBeTrue)
+
+						So(n, ShouldBeGreaterThan, 0)
+						for i := 0; i < n; i++ {
+							So(db.retrieve(bucketLGs, fmt.Sprintf("during%d", i)), ShouldNotBeNil)
+						}
+						live, err = db.checkIfLive(child.Key())
+						So(err, ShouldBeNil)
+						So(live, ShouldBeTrue)
+						So(db.retrieveLimitGroup("l1"), ShouldEqual, -1)
+						problems, err := db.storage.check()
+						So(err, ShouldBeNil)
+						So(problems, ShouldBeEmpty)
+
+						newJob := &Job{Cmd: "after compaction", Cwd: "/tmp", RepGroup: "rg3", ReqGroup: "req", Requirements: req}
+						_, _, _, err = db.storeNewJobs([]*Job{newJob}, false)
+						So(err, ShouldBeNil)
+						live, err = db.checkIfLive(newJob.Key())
+						So(err, ShouldBeNil)
+						So(live, ShouldBeTrue)
+					})
+
+					Convey("If the database can't be closed when compacting, it carries on being used", func() {
+						fs := &closeFailingStore{dbStore: db.replication.dbStore}
+						db.replication.dbStore = fs
+						_, err := db.compact()
+						So(err, ShouldNotBeNil)
+						So(fs.failed, ShouldBeTrue)
+						So(db.replication.dbStore, ShouldEqual, fs)
+						_, err = os.Stat(filepath.Join(dir, "db"+compactFileSuffix))
+						So(os.IsNotExist(err), ShouldBeTrue)
+
+						live, err = db.checkIfLive(child.Key())
+						So(err, ShouldBeNil)
+						So(live, ShouldBeTrue)
+					})
+				})
+			})
+
+			Convey("Then modify them", func() {
+				oldKey := child.Key()
+				child.Cmd = "child modified"
+				child.Dependencies = nil
+				err = db.modifyLiveJobs([]string{oldKey}, []*Job{child})
+				So(err, ShouldBeNil)
+
+				live, err = db.checkIfLive(oldKey)
+				So(err, ShouldBeNil)
+				So(live, ShouldBeFalse)
+				live, err = db.checkIfLive(child.Key())
+				So(err, ShouldBeNil)
+				So(live, ShouldBeTrue)
+
+				toQueue, toUpdate, _, err = db.storeNewJobs([]*Job{{Cmd: "parent3", Cwd: "/tmp", RepGroup: "rg1", DepGroups: []string{"dg1"}}}, false)
+				So(err, ShouldBeNil)
+				So(toUpdate, ShouldBeEmpty)
+				So(len(toQueue), ShouldEqual, 1)
+			})
+
+			Convey("Then back up the database and restore from it", func() {
+				bkPath := filepath.Join(dir, "streamed_bk")
+				f, err := os.Create(bkPath)
+				So(err, ShouldBeNil)
+				err = db.backup(f)
+				So(err, ShouldBeNil)
+				So(f.Close(), ShouldBeNil)
+
+				restored, _, err := initDB(bkPath, filepath.Join(dir, "unused_bk"), backend, internal.Production, testLogger)
+				So(err, ShouldBeNil)
+				defer restored.close()
+				recovered, err = restored.recoverIncompleteJobs()
+				So(err, ShouldBeNil)
+				So(len(recovered), ShouldEqual, 2)
+			})
+
+			Convey("Then keep generations of backups, verify them and restore from them", func() {
+				db.setBackupGenerations(2, 0)
+				now := time.Now()
+				for _, ago := range []time.Duration{2 * time.Hour, 1 * time.Hour} {
+					err = os.WriteFile(backupGenerationPath(db.backupPath, now.Add(-ago)), []byte("old"), dbFilePermission)
+					So(err, ShouldBeNil)
+				}
+				db.backupToBackupFile(false)
+
+				gens, err := BackupGenerations(db.backupPath, testLogger)
+				So(err, ShouldBeNil)
+				So(len(gens), ShouldEqual, 2)
+				So(gens[0].Path, ShouldEqual, backupGenerationPath(db.backupPath, now.Add(-1*time.Hour)))
+
+				path, err := BackupGenerationAt(db.backupPath, now.Add(-30*time.Minute), testLogger)
+				So(err, ShouldBeNil)
+				So(path, ShouldEqual, gens[0].Path)
+				path, err = BackupGenerationAt(db.backupPath, time.Now(), testLogger)
+				So(err, ShouldBeNil)
+				So(path, ShouldEqual, gens[1].Path)
+				_, err = BackupGenerationAt(db.backupPath, now.Add(-3*time.Hour), testLogger)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrNoBackup)
+
+				summary, err := VerifyDB(gens[1].Path, backend, testLogger)
+				So(err, ShouldBeNil)
+				So(summary.Jobs, ShouldEqual, 2)
+				So(summary.Problems, ShouldBeEmpty)
+				So(summary.States[child.State], ShouldEqual, 2)
+				So(summary.RepGroups["rg2"][child.State], ShouldEqual, 1)
+
+				other := DBBackendSQLite
+				if backend == DBBackendSQLite {
+					other = DBBackendBolt
+				}
+				_, err = VerifyDB(gens[1].Path, other, testLogger)
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrWrongBackend)
+
+				_, err = VerifyDB(gens[0].Path, backend, testLogger)
+				So(err, ShouldNotBeNil)
+				_, err = RestoreDB(gens[0].Path, filepath.Join(dir, "restored"), backend, testLogger)
+				So(err, ShouldNotBeNil)
+				_, err = os.Stat(filepath.Join(dir, "restored"))
+				So(os.IsNotExist(err), ShouldBeTrue)
+
+				restoredPath := filepath.Join(dir, "restored")
+				err = os.WriteFile(restoredPath, []byte("existing"), dbFilePermission)
+				So(err, ShouldBeNil)
+				summary, err = RestoreDB(gens[1].Path, restoredPath, backend, testLogger)
+				So(err, ShouldBeNil)
+				So(summary.Jobs, ShouldEqual, 2)
+				existing, err := os.ReadFile(restoredPath + ".pre_restore")
+				So(err, ShouldBeNil)
+				So(string(existing), ShouldEqual, "existing")
+
+				restored, _, err := initDB(restoredPath, filepath.Join(dir, "unused_bk"), backend, internal.Production, testLogger)
+				So(err, ShouldBeNil)
+				defer restored.close()
+				recovered, err = restored.recoverIncompleteJobs()
+				So(err, ShouldBeNil)
+				So(len(recovered), ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+// closeFailingStore is a dbStore whose first close() fails without closing.
+type closeFailingStore struct {
+	dbStore
+	failed bool
+}
+
+func (s *closeFailingStore) close() error {
+	if !s.failed {
+		s.failed = true
+		return fmt.Errorf("close failed")
+	}
+	return s.dbStore.close()
+}
+
+// updateFailingStore is a dbStore whose updates all fail.
+type updateFailingStore struct {
+	dbStore
+}
+
+func (s *updateFailingStore) update(fn func(tx dbTx) error) error {
+	return fmt.Errorf("update failed")
+}
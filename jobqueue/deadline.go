@@ -0,0 +1,197 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for job Deadlines.
+//
+// A job with a Deadline must start running by its Deadline minus its expected
+// run time; the queue reserves ready jobs in the order of this start by time
+// before considering their priority. Scheduler groups containing jobs whose
+// start by time is within ServerDeadlineUrgency get their runners scheduled
+// with the maximum priority, and groups are reconsidered when the next job
+// becomes urgent. When jobs are retrieved for the user, those predicted to miss
+// their Deadline given the current queue depth are flagged with DeadlineAtRisk.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// ParseDeadline parses a deadline supplied by a user, which can either be a
+// time in RFC 3339 format (eg. "2021-06-01T18:00:00Z"), or a duration (eg.
+// "2h30m") from now. An empty string results in the zero time, meaning no
+// deadline.
+func ParseDeadline(deadline string) (time.Time, error) {
+	if deadline == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, deadline)
+	if err == nil {
+		return t, nil
+	}
+
+	d, errd := time.ParseDuration(deadline)
+	if errd != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("deadline [%s] is neither an RFC 3339 time nor a positive duration", deadline)
+	}
+	return time.Now().Add(d), nil
+}
+
+// startBy returns the time this job needs to start running by in order to
+// meet its Deadline, based on its expected run time. Returns the zero time if
+// the job has no Deadline.
+func (j *Job) startBy() time.Time {
+	j.RLock()
+	defer j.RUnlock()
+	if j.Deadline.IsZero() {
+		return time.Time{}
+	}
+	if j.Requirements == nil {
+		return j.Deadline
+	}
+	return j.Deadline.Add(-j.Requirements.Time)
+}
+
+// deadlineUrgent tells you if this job needs to start running within
+// ServerDeadlineUrgency in order to meet its Deadline.
+func (j *Job) deadlineUrgent() bool {
+	startBy := j.startBy()
+	if startBy.IsZero() {
+		return false
+	}
+	return time.Until(startBy) < ServerDeadlineUrgency
+}
+
+// untilDeadlineUrgent tells you how long it will be before this job becomes
+// deadlineUrgent(). Returns 0 if the job has no Deadline or is already urgent.
+func (j *Job) untilDeadlineUrgent() time.Duration {
+	startBy := j.startBy()
+	if startBy.IsZero() {
+		return 0
+	}
+	wait := time.Until(startBy) - ServerDeadlineUrgency
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// deadlineQueue holds, for each scheduler group, the start by times of the
+// ready items with one, in order, and the number of running items, letting us
+// estimate how long items will wait before they start running.
+type deadlineQueue struct {
+	startBys map[string][]time.Time
+	running  map[string]int
+}
+
+// newDeadlineQueue takes a snapshot of the given queue.
+func newDeadlineQueue(q *queue.Queue) *deadlineQueue {
+	dq := &deadlineQueue{
+		startBys: make(map[string][]time.Time),
+		running:  make(map[string]int),
+	}
+
+	for _, item := range q.AllItems() {
+		stats := item.Stats()
+		switch stats.State {
+		case queue.ItemStateReady:
+			if !stats.StartBy.IsZero() {
+				dq.startBys[item.ReserveGroup] = append(dq.startBys[item.ReserveGroup], stats.StartBy)
+			}
+		case queue.ItemStateRun:
+			dq.running[item.ReserveGroup]++
+		}
+	}
+
+	for _, startBys := range dq.startBys {
+		sort.Slice(startBys, func(i, j int) bool {
+			return startBys[i].Before(startBys[j])
+		})
+	}
+
+	return dq
+}
+
+// waves returns how many rounds of jobs have to run in the given group before
+// a ready job with the given start by time gets to start, assuming the group's
+// currently running jobs are replaced as they complete.
+func (dq *deadlineQueue) waves(group string, startBy time.Time) int {
+	startBys := dq.startBys[group]
+	ahead := sort.Search(len(startBys), func(i int) bool {
+		return !startBys[i].Before(startBy)
+	})
+
+	slots := dq.running[group]
+	if slots < 1 {
+		slots = 1
+	}
+	return ahead / slots
+}
+
+// predictDeadlines sets DeadlineAtRisk on those of the given jobs (as
+// formulated for the client by itemToJob()) that have a Deadline and are not
+// expected to complete by it: running jobs expected to run past it, ready jobs
+// that will have to wait for too many jobs ahead of them in the queue, and
+// buried or lost jobs, which won't complete without intervention.
+func (s *Server) predictDeadlines(jobs []*Job) {
+	var dq *deadlineQueue
+	now := time.Now()
+	for _, job := range jobs {
+		job.RLock()
+		deadline, state, started := job.Deadline, job.State, job.StartTime
+		var expected time.Duration
+		if job.Requirements != nil {
+			expected = job.Requirements.Time
+		}
+		key := job.Key()
+		job.RUnlock()
+
+		if deadline.IsZero() || state == JobStateComplete {
+			continue
+		}
+
+		var end time.Time
+		switch state {
+		case JobStateBuried, JobStateLost:
+			end = deadline.Add(1)
+		case JobStateRunning:
+			end = started.Add(expected)
+		case JobStateReady:
+			item, err := s.q.Get(key)
+			if err != nil {
+				continue
+			}
+			if dq == nil {
+				dq = newDeadlineQueue(s.q)
+			}
+			waves := dq.waves(item.ReserveGroup, item.Stats().StartBy)
+			end = now.Add(time.Duration(waves+1) * expected)
+		default:
+			end = now.Add(expected)
+		}
+
+		job.Lock()
+		job.DeadlineAtRisk = end.After(deadline)
+		job.Unlock()
+	}
+}
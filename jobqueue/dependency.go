@@ -20,29 +20,130 @@ package jobqueue
 
 // This file contains the dependency related code.
 
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// DependencyCondition describes what must happen to the jobs a Dependency
+// refers to for it to be satisfied.
+type DependencyCondition string
+
+// DependencyOn* constants are the possible conditions of a Dependency.
+// DependencyOnSuccess, the default, is satisfied once the jobs complete
+// successfully. DependencyOnFailure is satisfied once the jobs are all buried
+// (it will never be satisfied if they complete successfully instead), for
+// cleanup or alerting steps. DependencyOnEnd is satisfied once the jobs have
+// either completed or been buried.
+const (
+	DependencyOnSuccess DependencyCondition = ""
+	DependencyOnFailure DependencyCondition = "failed"
+	DependencyOnEnd     DependencyCondition = "ended"
+)
+
+// dependencyConditionFunctions maps the function names usable in
+// ParseDependency() to their DependencyCondition.
+var dependencyConditionFunctions = map[string]DependencyCondition{
+	"done":   DependencyOnSuccess,
+	"failed": DependencyOnFailure,
+	"ended":  DependencyOnEnd,
+}
+
+// depExprRegex matches a condition function around a dep group in a
+// dependency expression.
+var depExprRegex = regexp.MustCompile(`^(\w+)\((.+)\)$`)
+
+// depExprManagerSeparator separates the name of a RemoteManager from a dep
+// group (or depExprKeyPrefix and job key) in a dependency expression.
+const depExprManagerSeparator = "::"
+
+// depExprKeyPrefix prefixes a job key in a dependency expression, for
+// dependencies on a particular job of a RemoteManager.
+const depExprKeyPrefix = "key:"
+
+// remoteDepKeyPrefix prefixes the keys we give the queue for dependencies on
+// the jobs of RemoteManagers.
+const remoteDepKeyPrefix = "remote" + depExprManagerSeparator
+
+// queueCondition converts the condition to the equivalent condition used by
+// the queue package.
+func (c DependencyCondition) queueCondition() queue.DepCondition {
+	switch c {
+	case DependencyOnFailure:
+		return queue.DepBuried
+	case DependencyOnEnd:
+		return queue.DepEnded
+	}
+	return queue.DepRemoved
+}
+
 // Dependencies is a slice of *Dependency, for use in Job.Dependencies. It
-// describes the jobs that must be complete before the Job you associate this
-// with will start.
+// describes the jobs that must be complete (or otherwise satisfy each
+// Dependency's condition) before the Job you associate this with will start.
 type Dependencies []*Dependency
 
 // incompleteJobKeys converts the constituent Dependency structs in to internal
-// job keys that uniquely identify the jobs we are dependent upon. Note that if
-// you have dependencies that are specified with DepGroups, then you should re-
-// call this and update every time a new Job is added with with one of our
-// DepGroups() in its *Job.DepGroups. It will only return keys for jobs that
-// are incomplete (they could have been Archive()d in the past if they are now
-// being re-run).
-func (d Dependencies) incompleteJobKeys(db *db) ([]string, error) {
+// job keys that uniquely identify the jobs we are dependent upon, along with
+// the rules the queue needs to resolve them according to their conditions and
+// any AnyOf (rules will be nil if none of the Dependency structs have a
+// condition, AnyOf or Manager; the queue only treats keys that aren't in it as
+// unresolved when there are rules). Note that if you have dependencies that
+// are specified with DepGroups, then you should re-call this and update every
+// time a new Job is added with with one of our DepGroups() in its
+// *Job.DepGroups. It will only return keys for jobs that are incomplete (they
+// could have been Archive()d in the past if they are now being re-run), except
+// for DependencyOnFailure dependencies, where the keys of complete jobs are
+// also returned, so that they remain unresolved.
+func (d Dependencies) incompleteJobKeys(db *db) ([]string, *queue.DepRules, error) {
 	// we initially store in a map to avoid duplicates
 	jobKeys := make(map[string]bool)
-	for _, dep := range d {
+	conditions := make(map[string]queue.DepCondition)
+	var remote bool
+	addKeys := func(dep *Dependency) ([]string, error) {
 		keys, err := dep.incompleteJobKeys(db)
 		if err != nil {
-			return []string{}, err
+			return nil, err
 		}
 		for _, key := range keys {
 			jobKeys[key] = true
+			if dep.Manager != "" {
+				// the server resolves these itself, once their condition is
+				// met on the remote manager
+				remote = true
+				continue
+			}
+			if c := dep.On.queueCondition(); c != queue.DepRemoved {
+				conditions[key] = c
+			}
+		}
+		return keys, nil
+	}
+
+	var anyOf [][][]string
+	var allOf []string
+	for _, dep := range d {
+		if len(dep.AnyOf) == 0 {
+			keys, err := addKeys(dep)
+			if err != nil {
+				return []string{}, nil, err
+			}
+			allOf = append(allOf, keys...)
+			continue
+		}
+
+		alts := dep.alternatives()
+		set := make([][]string, len(alts))
+		for i, alt := range alts {
+			keys, err := addKeys(alt)
+			if err != nil {
+				return []string{}, nil, err
+			}
+			set[i] = keys
 		}
+		anyOf = append(anyOf, set)
 	}
 
 	keys := make([]string, len(jobKeys))
@@ -52,14 +153,28 @@ func (d Dependencies) incompleteJobKeys(db *db) ([]string, error) {
 		i++
 	}
 
-	return keys, nil
+	if len(conditions) == 0 && len(anyOf) == 0 && !remote {
+		return keys, nil, nil
+	}
+
+	rules := &queue.DepRules{Conditions: conditions, AnyOf: anyOf}
+	if len(anyOf) > 0 && len(allOf) > 0 {
+		// the keys of our other dependencies could also be in the AnyOf sets,
+		// so make sure they're still all required
+		rules.AnyOf = append(rules.AnyOf, [][]string{allOf})
+	}
+	return keys, rules, nil
 }
 
-// DepGroups returns all the DepGroups of our constituent Dependency structs.
+// DepGroups returns all the DepGroups of our constituent Dependency structs,
+// including those of the alternatives in their AnyOf, but not those of
+// Dependency structs on a RemoteManager.
 func (d Dependencies) DepGroups() []string {
 	var depGroups []string
 	for _, dep := range d {
-		if dep.DepGroup != "" {
+		if len(dep.AnyOf) > 0 {
+			depGroups = append(depGroups, dep.AnyOf.DepGroups()...)
+		} else if dep.DepGroup != "" && dep.Manager == "" {
 			depGroups = append(depGroups, dep.DepGroup)
 		}
 	}
@@ -67,14 +182,14 @@ func (d Dependencies) DepGroups() []string {
 }
 
 // Stringify converts our constituent Dependency structs in to a slice of
-// strings, each of which could be JobEssence or DepGroup based.
+// strings, each of which could be JobEssence or DepGroup based. Conditions
+// and AnyOf are represented in the same way as understood by
+// ParseDependency().
 func (d Dependencies) Stringify() []string {
 	var strings []string
 	for _, dep := range d {
-		if dep.DepGroup != "" {
-			strings = append(strings, dep.DepGroup)
-		} else if dep.Essence != nil {
-			strings = append(strings, dep.Essence.Stringify())
+		if str := dep.String(); str != "" {
+			strings = append(strings, str)
 		}
 	}
 	return strings
@@ -82,10 +197,25 @@ func (d Dependencies) Stringify() []string {
 
 // Dependency is a struct that describes a Job purely in terms of a JobEssence,
 // or in terms of a Job's DepGroup, for use in Dependencies. If DepGroup is
-// specified, then Essence is ignored.
+// specified, then Essence is ignored. On says what must happen to the job(s)
+// for the Dependency to be satisfied, defaulting to DependencyOnSuccess.
+//
+// Alternatively, AnyOf can hold other Dependency structs, in which case this
+// Dependency is satisfied once any one of them is, and Essence, DepGroup and
+// On are ignored.
+//
+// If Manager is set, this is a dependency on the job(s) of another wr manager,
+// the one configured as the RemoteManager with that Name. The Essence (which
+// would normally just have a JobKey) or DepGroup refer to the job(s) of that
+// manager, and the server periodically asks that manager if they satisfy On.
+// Unlike other dependencies, those on a dep group of a remote manager are only
+// satisfied once that manager has at least one job in the group.
 type Dependency struct {
 	Essence  *JobEssence
 	DepGroup string
+	On       DependencyCondition
+	AnyOf    Dependencies
+	Manager  string
 }
 
 // incompleteJobKeys calculates the job keys that this dependency refers to. For
@@ -93,14 +223,21 @@ type Dependency struct {
 // same key you'd get from *Job.key() on a Job made with the same essence.
 // For a Dependency made with a DepGroup, you will get the *Job.key()s of all
 // the jobs in the queue and database that have that DepGroup in their
-// DepGroups. You will only get keys for jobs that are currently in the queue.
+// DepGroups. You will only get keys for jobs that are currently in the queue,
+// unless On is DependencyOnFailure.
 func (d *Dependency) incompleteJobKeys(db *db) ([]string, error) {
+	if d.Manager != "" {
+		return []string{d.remoteKey()}, nil
+	}
 	if d.DepGroup != "" {
-		keys, err := db.retrieveIncompleteJobKeysByDepGroup(d.DepGroup)
+		keys, err := db.retrieveJobKeysByDepGroup(d.DepGroup, d.On != DependencyOnFailure)
 		return keys, err
 	}
 	if d.Essence != nil {
 		jobKey := d.Essence.Key()
+		if d.On == DependencyOnFailure {
+			return []string{jobKey}, nil
+		}
 		live, err := db.checkIfLive(jobKey)
 		if err != nil {
 			return []string{}, err
@@ -112,6 +249,63 @@ func (d *Dependency) incompleteJobKeys(db *db) ([]string, error) {
 	return []string{}, nil
 }
 
+// remoteKey returns the key the queue knows this Dependency on the job(s) of a
+// RemoteManager by.
+func (d *Dependency) remoteKey() string {
+	return remoteDepKeyPrefix + d.Manager + depExprManagerSeparator + string(d.On) + depExprManagerSeparator + d.target()
+}
+
+// target returns our DepGroup, or depExprKeyPrefix followed by our Essence's
+// key if we have no DepGroup.
+func (d *Dependency) target() string {
+	if d.DepGroup != "" {
+		return d.DepGroup
+	}
+	if d.Essence != nil {
+		return depExprKeyPrefix + d.Essence.Key()
+	}
+	return ""
+}
+
+// alternatives returns our AnyOf, with any of their own AnyOf flattened in to
+// it.
+func (d *Dependency) alternatives() Dependencies {
+	var alts Dependencies
+	for _, alt := range d.AnyOf {
+		if len(alt.AnyOf) > 0 {
+			alts = append(alts, alt.alternatives()...)
+		} else {
+			alts = append(alts, alt)
+		}
+	}
+	return alts
+}
+
+// String represents this Dependency in the form understood by
+// ParseDependency(), or for JobEssence based ones, the Stringify() of the
+// JobEssence, wrapped in any condition.
+func (d *Dependency) String() string {
+	if len(d.AnyOf) > 0 {
+		return strings.Join(d.alternatives().Stringify(), "|")
+	}
+
+	var str string
+	if d.Manager != "" {
+		str = d.Manager + depExprManagerSeparator + d.target()
+	} else if d.DepGroup != "" {
+		str = d.DepGroup
+	} else if d.Essence != nil {
+		str = d.Essence.Stringify()
+	} else {
+		return ""
+	}
+
+	if d.On != DependencyOnSuccess {
+		str = string(d.On) + "(" + str + ")"
+	}
+	return str
+}
+
 // NewEssenceDependency makes it a little easier to make a new *Dependency based
 // on Cmd+Cwd, for use in NewDependencies(). Leave cwd as an empty string if the
 // job you are describing does not have CwdMatters true.
@@ -128,3 +322,55 @@ func NewDepGroupDependency(depgroup string) *Dependency {
 		DepGroup: depgroup,
 	}
 }
+
+// ParseDependency makes a new DepGroup based *Dependency from an expression.
+// The simplest expression is just a dep group name, meaning the jobs in that
+// group must complete successfully. The name can be prefixed with the name of
+// a RemoteManager and :: to refer to a dep group of that manager, eg.
+// "prod::align", or to a particular job of that manager, eg. "prod::key:" and
+// the job's key. These can be wrapped in done(), failed() or ended() to set
+// the Dependency's On to DependencyOnSuccess, DependencyOnFailure or
+// DependencyOnEnd respectively. Multiple such terms can be separated by | to
+// make a Dependency with AnyOf, satisfied as soon as any one of the terms is,
+// eg. "failed(align)|ended(qc)".
+func ParseDependency(expr string) (*Dependency, error) {
+	terms := strings.Split(expr, "|")
+	var alts Dependencies
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		dep := &Dependency{DepGroup: term}
+		if matches := depExprRegex.FindStringSubmatch(term); matches != nil {
+			on, known := dependencyConditionFunctions[matches[1]]
+			if !known {
+				return nil, fmt.Errorf("dependency [%s] has unknown condition [%s]; use done, failed or ended", expr, matches[1])
+			}
+			dep.DepGroup = strings.TrimSpace(matches[2])
+			dep.On = on
+		}
+		if parts := strings.SplitN(dep.DepGroup, depExprManagerSeparator, 2); len(parts) == 2 {
+			dep.Manager = strings.TrimSpace(parts[0])
+			dep.DepGroup = strings.TrimSpace(parts[1])
+			if strings.HasPrefix(dep.DepGroup, depExprKeyPrefix) {
+				dep.Essence = &JobEssence{JobKey: strings.TrimPrefix(dep.DepGroup, depExprKeyPrefix)}
+				dep.DepGroup = ""
+				if dep.Essence.JobKey == "" {
+					dep.Essence = nil
+				}
+			}
+			if dep.Manager == "" || (dep.DepGroup == "" && dep.Essence == nil) {
+				return nil, fmt.Errorf("dependency [%s] is not a valid dependency expression", expr)
+			}
+			alts = append(alts, dep)
+			continue
+		}
+		if dep.DepGroup == "" || strings.ContainsAny(dep.DepGroup, "()") {
+			return nil, fmt.Errorf("dependency [%s] is not a valid dependency expression", expr)
+		}
+		alts = append(alts, dep)
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return &Dependency{AnyOf: alts}, nil
+}
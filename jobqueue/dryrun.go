@@ -0,0 +1,309 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for finding out what adding jobs would do,
+// without adding them.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// AddDryRun describes what Client.Add() would do with some jobs, as reported
+// by Client.AddDryRun().
+type AddDryRun struct {
+	// Added is the number of jobs that would be added to the queue.
+	Added int
+
+	// Existing holds the Cmds of the jobs that would not be added because they
+	// are already in the queue, or are repeated in the jobs being added.
+	Existing []string
+
+	// Complete holds the Cmds of the jobs that were previously added and have
+	// completed. These would be skipped if ignoreComplete was true, otherwise
+	// they would be run again and are counted in Added.
+	Complete []string
+
+	// Unsatisfiable describes the dependencies of the jobs that would be added
+	// that no job can satisfy.
+	Unsatisfiable []*UnsatisfiableDependency
+
+	// ReqGroups describes the requirements that the jobs that would be added
+	// would be scheduled with, per ReqGroup, sorted by ReqGroup.
+	ReqGroups []*DryRunReqGroup
+}
+
+// UnsatisfiableDependency describes a Dependency of a job that no job in the
+// queue, or among the jobs being added with it, can satisfy. Without any
+// condition the job would run straight away (perhaps before its inputs have
+// been made); with one it would stay dependent forever.
+type UnsatisfiableDependency struct {
+	// Cmd is the Cmd of the job with the Dependency.
+	Cmd string
+
+	// Dependency is the Dependency, in the form understood by
+	// ParseDependency().
+	Dependency string
+
+	// Reason says why it can't be satisfied.
+	Reason string
+}
+
+// DryRunReqGroup describes the requirements of the jobs in a ReqGroup that
+// would be added. Requirements are those of the first job in the group (jobs
+// are not expected to have different requirements to others in their
+// ReqGroup).
+type DryRunReqGroup struct {
+	ReqGroup string
+
+	// Jobs is the number of jobs in this ReqGroup that would be added.
+	Jobs int
+
+	// Requested is what the job specified.
+	Requested *scheduler.Requirements
+
+	// Recommended is what past jobs in the ReqGroup used, or nil if there are
+	// none.
+	Recommended *scheduler.Requirements
+
+	// Effective is what the job would actually be scheduled with, given its
+	// Override.
+	Effective *scheduler.Requirements
+}
+
+// addDryRun does the same validation as createJobs(), returning the same
+// srerr and error if the jobs are invalid, but instead of storing and queuing
+// them it reports what would happen if it did.
+func (s *Server) addDryRun(inputJobs []*Job, ignoreComplete bool) (*AddDryRun, string, error) {
+	limitGroups := make(map[string]*limitGroup)
+	for _, job := range inputJobs {
+		job.Lock()
+		srerr, err := s.checkNewJob(job, limitGroups)
+		job.Unlock()
+		if err != nil {
+			return nil, srerr, err
+		}
+	}
+
+	err := s.checkNewJobCycles(inputJobs)
+	if err != nil {
+		return nil, cycleCheckSrerr(err), err
+	}
+
+	keys := make([]string, len(inputJobs))
+	for i, job := range inputJobs {
+		keys[i] = job.Key()
+	}
+	complete, err := s.db.checkIfComplete(keys)
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	dr := &AddDryRun{}
+	var jobsToAdd []*Job
+	inputKeys := make(map[string]bool, len(inputJobs))
+	inputDepGroups := make(map[string]bool)
+	for i, job := range inputJobs {
+		key := keys[i]
+		if _, err := s.q.Get(key); err == nil || inputKeys[key] {
+			dr.Existing = append(dr.Existing, job.Cmd)
+			continue
+		}
+		inputKeys[key] = true
+
+		if complete[key] {
+			dr.Complete = append(dr.Complete, job.Cmd)
+			if ignoreComplete {
+				continue
+			}
+		}
+
+		jobsToAdd = append(jobsToAdd, job)
+		for _, dg := range job.DepGroups {
+			if dg != "" {
+				inputDepGroups[dg] = true
+			}
+		}
+	}
+	dr.Added = len(jobsToAdd)
+
+	dr.Unsatisfiable, err = s.unsatisfiableDependencies(jobsToAdd, inputKeys, inputDepGroups)
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	dr.ReqGroups, err = s.dryRunReqGroups(jobsToAdd)
+	if err != nil {
+		return nil, ErrDBError, err
+	}
+
+	return dr, "", nil
+}
+
+// unsatisfiableDependencies finds the dependencies of the given jobs that refer
+// to dep groups without any jobs or to jobs that don't exist, other than the
+// given jobs that are about to be added. Dependencies on other managers are
+// not checked.
+func (s *Server) unsatisfiableDependencies(jobs []*Job, inputKeys, inputDepGroups map[string]bool) ([]*UnsatisfiableDependency, error) {
+	groupExists := make(map[string]bool)
+	keyExists := make(map[string]bool)
+	for dg := range inputDepGroups {
+		groupExists[dg] = true
+	}
+	for key := range inputKeys {
+		keyExists[key] = true
+	}
+
+	// find out which of the dep groups and keys depended upon exist already
+	var unknownKeys []string
+	for _, job := range jobs {
+		for _, alt := range dependencyAlternatives(job.Dependencies) {
+			switch {
+			case alt.Manager != "":
+				continue
+			case alt.DepGroup != "":
+				if _, checked := groupExists[alt.DepGroup]; checked {
+					continue
+				}
+				keys, err := s.db.retrieveJobKeysByDepGroup(alt.DepGroup, false)
+				if err != nil {
+					return nil, err
+				}
+				groupExists[alt.DepGroup] = len(keys) > 0
+			case alt.Essence != nil:
+				key := alt.Essence.Key()
+				if _, checked := keyExists[key]; checked {
+					continue
+				}
+				_, err := s.q.Get(key)
+				keyExists[key] = err == nil
+				if err != nil {
+					unknownKeys = append(unknownKeys, key)
+				}
+			}
+		}
+	}
+
+	if len(unknownKeys) > 0 {
+		complete, err := s.db.checkIfComplete(unknownKeys)
+		if err != nil {
+			return nil, err
+		}
+		for key := range complete {
+			keyExists[key] = true
+		}
+	}
+
+	// a dependency is unsatisfiable if none of its alternatives exist
+	var unsatisfiable []*UnsatisfiableDependency
+	for _, job := range jobs {
+		for _, dep := range job.Dependencies {
+			alts := Dependencies{dep}
+			if len(dep.AnyOf) > 0 {
+				alts = dep.alternatives()
+			}
+
+			var reasons []string
+			for _, alt := range alts {
+				switch {
+				case alt.Manager != "":
+					reasons = nil
+				case alt.DepGroup != "":
+					if groupExists[alt.DepGroup] {
+						reasons = nil
+					} else {
+						reasons = append(reasons, fmt.Sprintf("no jobs are in dep group %s", alt.DepGroup))
+					}
+				case alt.Essence != nil:
+					if keyExists[alt.Essence.Key()] {
+						reasons = nil
+					} else {
+						reasons = append(reasons, fmt.Sprintf("no job has cmd %s", alt.Essence.Cmd))
+					}
+				}
+				if reasons == nil {
+					break
+				}
+			}
+
+			for _, reason := range reasons {
+				unsatisfiable = append(unsatisfiable, &UnsatisfiableDependency{Cmd: job.Cmd, Dependency: dep.String(), Reason: reason})
+			}
+		}
+	}
+	return unsatisfiable, nil
+}
+
+// dependencyAlternatives returns the given dependencies with any AnyOf
+// dependencies replaced by their alternatives.
+func dependencyAlternatives(deps Dependencies) Dependencies {
+	var alts Dependencies
+	for _, dep := range deps {
+		if len(dep.AnyOf) > 0 {
+			alts = append(alts, dep.alternatives()...)
+		} else {
+			alts = append(alts, dep)
+		}
+	}
+	return alts
+}
+
+// dryRunReqGroups works out the requirements that the given jobs would be
+// scheduled with, per ReqGroup, in the same way as createQueue()'s
+// readyAddedCallback does.
+func (s *Server) dryRunReqGroups(jobs []*Job) ([]*DryRunReqGroup, error) {
+	groups := make(map[string]*DryRunReqGroup)
+	var names []string
+	for _, job := range jobs {
+		if rg, exists := groups[job.ReqGroup]; exists {
+			rg.Jobs++
+			continue
+		}
+
+		rg := &DryRunReqGroup{ReqGroup: job.ReqGroup, Jobs: 1}
+		groups[job.ReqGroup] = rg
+		names = append(names, job.ReqGroup)
+		if job.Requirements == nil {
+			continue
+		}
+		rg.Requested = job.Requirements.Clone()
+
+		rec, err := s.db.recommendedReqs(job.ReqGroup, job.SizeHint)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil && (rec.RAM > 0 || rec.Disk > 0 || rec.Time > 0) {
+			rg.Recommended = rec
+		}
+
+		effective := &Job{Requirements: job.Requirements.Clone(), RequirementsOrig: job.Requirements.Clone(), Override: job.Override}
+		applyRecommendedReqs(effective, rg.Recommended)
+		rg.Effective = effective.Requirements
+	}
+
+	sort.Strings(names)
+	reqGroups := make([]*DryRunReqGroup, len(names))
+	for i, name := range names {
+		reqGroups[i] = groups[name]
+	}
+	return reqGroups, nil
+}
@@ -0,0 +1,324 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for exporting the history of jobs that have run
+// in formats suitable for analysis by other tools.
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	_ "modernc.org/sqlite" // registers the pure-go "sqlite" database driver
+)
+
+// ExportFormat is the format that JobExporters write jobs in.
+type ExportFormat string
+
+// ExportFormat* constants are the formats we can export jobs in.
+const (
+	ExportFormatCSV    ExportFormat = "csv"
+	ExportFormatJSONL  ExportFormat = "jsonl"
+	ExportFormatSQLite ExportFormat = "sqlite"
+)
+
+// exportPageSize is the number of jobs we retrieve at once while exporting, so
+// that memory usage is bounded regardless of how many jobs there are.
+const exportPageSize = 1000
+
+// exportSQLiteTable is the name of the table jobs are exported to in SQLite
+// databases.
+const exportSQLiteTable = "jobs"
+
+// exportColumn describes one of the properties of a job that we export.
+type exportColumn struct {
+	name    string
+	sqlType string
+	value   func(*Job) interface{}
+}
+
+// exportColumns are the properties of jobs that we export, in the order they
+// are exported. Values are always strings, int64s or float64s.
+var exportColumns = []exportColumn{
+	{"key", "TEXT", func(j *Job) interface{} { return j.Key() }},
+	{"rep_group", "TEXT", func(j *Job) interface{} { return j.RepGroup }},
+	{"req_group", "TEXT", func(j *Job) interface{} { return j.ReqGroup }},
+	{"limit_groups", "TEXT", func(j *Job) interface{} { return strings.Join(j.LimitGroups, ",") }},
+	{"cmd", "TEXT", func(j *Job) interface{} { return j.Cmd }},
+	{"cwd", "TEXT", func(j *Job) interface{} { return j.Cwd }},
+	{"state", "TEXT", func(j *Job) interface{} { return string(j.State) }},
+	{"exit_code", "INTEGER", func(j *Job) interface{} { return int64(j.Exitcode) }},
+	{"fail_reason", "TEXT", func(j *Job) interface{} { return j.FailReason }},
+	{"attempts", "INTEGER", func(j *Job) interface{} { return int64(j.Attempts) }},
+	{"host", "TEXT", func(j *Job) interface{} { return j.Host }},
+	{"host_id", "TEXT", func(j *Job) interface{} { return j.HostID }},
+	{"host_ip", "TEXT", func(j *Job) interface{} { return j.HostIP }},
+	{"req_memory_mb", "INTEGER", func(j *Job) interface{} { return int64(exportRequirements(j).RAM) }},
+	{"req_time_secs", "REAL", func(j *Job) interface{} { return exportRequirements(j).Time.Seconds() }},
+	{"req_cores", "REAL", func(j *Job) interface{} { return exportRequirements(j).Cores }},
+	{"req_disk_gb", "INTEGER", func(j *Job) interface{} { return int64(exportRequirements(j).Disk) }},
+	{"peak_memory_mb", "INTEGER", func(j *Job) interface{} { return int64(j.PeakRAM) }},
+	{"peak_disk_mb", "INTEGER", func(j *Job) interface{} { return j.PeakDisk }},
+	{"cpu_time_secs", "REAL", func(j *Job) interface{} { return j.CPUtime.Seconds() }},
+	{"wall_time_secs", "REAL", func(j *Job) interface{} { return j.WallTime().Seconds() }},
+	{"start_time", "TEXT", func(j *Job) interface{} { return exportTime(j.StartTime) }},
+	{"end_time", "TEXT", func(j *Job) interface{} { return exportTime(j.EndTime) }},
+	{"size_hint", "REAL", func(j *Job) interface{} { return j.SizeHint }},
+	{"user", "TEXT", func(j *Job) interface{} { return j.User }},
+	{"cost", "REAL", func(j *Job) interface{} { return j.Cost }},
+}
+
+// exportRequirements returns the job's Requirements, or empty ones if it has
+// none.
+func exportRequirements(j *Job) *scheduler.Requirements {
+	if j.Requirements == nil {
+		return &scheduler.Requirements{}
+	}
+	return j.Requirements
+}
+
+// exportTime formats a time as RFC3339 in UTC, or returns an empty string for
+// the zero time.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// JobExporter writes jobs out in some format, one at a time. You must Close()
+// it after your last Export() to ensure everything has been written.
+type JobExporter interface {
+	// Export writes out the given job.
+	Export(job *Job) error
+
+	// Close finishes writing. It does not close any io.Writer supplied to
+	// NewJobExporter().
+	Close() error
+}
+
+// NewJobExporter returns a JobExporter that writes in the given format. For
+// ExportFormatCSV and ExportFormatJSONL, jobs are written to w. For
+// ExportFormatSQLite, jobs are written to a new SQLite database created at
+// path, which must not already exist (you'll get an Error with Err
+// ErrExportExists if it does).
+func NewJobExporter(format ExportFormat, w io.Writer, path string) (JobExporter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return newCSVExporter(w)
+	case ExportFormatJSONL:
+		return &jsonlExporter{w: bufio.NewWriter(w)}, nil
+	case ExportFormatSQLite:
+		return newSQLiteExporter(path)
+	}
+	return nil, fmt.Errorf("unknown export format '%s'", format)
+}
+
+// csvExporter is a JobExporter that writes a CSV file with a header line.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) (*csvExporter, error) {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		header[i] = col.name
+	}
+	return &csvExporter{w: cw}, cw.Write(header)
+}
+
+// Export implements JobExporter.
+func (e *csvExporter) Export(job *Job) error {
+	record := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		switch v := col.value(job).(type) {
+		case string:
+			record[i] = v
+		case int64:
+			record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return e.w.Write(record)
+}
+
+// Close implements JobExporter.
+func (e *csvExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExporter is a JobExporter that writes one JSON object per line.
+type jsonlExporter struct {
+	w *bufio.Writer
+}
+
+// Export implements JobExporter. The properties of each object are in the
+// same order as the columns of the other formats.
+func (e *jsonlExporter) Export(job *Job) error {
+	e.w.WriteByte('{')
+	for i, col := range exportColumns {
+		if i > 0 {
+			e.w.WriteByte(',')
+		}
+		value, err := json.Marshal(col.value(job))
+		if err != nil {
+			return err
+		}
+		e.w.WriteString(strconv.Quote(col.name))
+		e.w.WriteByte(':')
+		e.w.Write(value)
+	}
+	e.w.WriteString("}\n")
+	return nil
+}
+
+// Close implements JobExporter.
+func (e *jsonlExporter) Close() error {
+	return e.w.Flush()
+}
+
+// sqliteExporter is a JobExporter that inserts jobs in to a table of a SQLite
+// database, committing every exportPageSize jobs.
+type sqliteExporter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	insert  string
+	pending int
+}
+
+func newSQLiteExporter(path string) (*sqliteExporter, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, Error{"export", path, ErrExportExists}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	cols := make([]string, len(exportColumns))
+	names := make([]string, len(exportColumns))
+	placeholders := make([]string, len(exportColumns))
+	for i, col := range exportColumns {
+		cols[i] = col.name + " " + col.sqlType
+		names[i] = col.name
+		placeholders[i] = "?"
+	}
+
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", exportSQLiteTable, strings.Join(cols, ", ")))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteExporter{
+		db:     db,
+		insert: fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", exportSQLiteTable, strings.Join(names, ", "), strings.Join(placeholders, ", ")),
+	}, nil
+}
+
+// Export implements JobExporter.
+func (e *sqliteExporter) Export(job *Job) error {
+	if e.tx == nil {
+		tx, err := e.db.Begin()
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.Prepare(e.insert)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		e.tx, e.stmt = tx, stmt
+	}
+
+	values := make([]interface{}, len(exportColumns))
+	for i, col := range exportColumns {
+		values[i] = col.value(job)
+	}
+	_, err := e.stmt.Exec(values...)
+	if err != nil {
+		return err
+	}
+
+	e.pending++
+	if e.pending == exportPageSize {
+		return e.commit()
+	}
+	return nil
+}
+
+// commit commits any pending inserts.
+func (e *sqliteExporter) commit() error {
+	if e.tx == nil {
+		return nil
+	}
+	e.stmt.Close()
+	err := e.tx.Commit()
+	e.tx, e.stmt, e.pending = nil, nil, 0
+	return err
+}
+
+// Close implements JobExporter.
+func (e *sqliteExporter) Close() error {
+	err := e.commit()
+	errc := e.db.Close()
+	if err == nil {
+		err = errc
+	}
+	return err
+}
+
+// exportHistory pages through the results of the given search using the given
+// search function, exporting each job found. The search's Limit and After are
+// overridden.
+func exportHistory(js *JobSearch, exporter JobExporter, search func(*JobSearch) ([]*Job, string, error)) error {
+	page := *js
+	page.Limit = exportPageSize
+	page.After = ""
+	for {
+		jobs, next, err := search(&page)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			err = exporter.Export(job)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		page.After = next
+	}
+}
@@ -0,0 +1,596 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for working with the graph of jobs implied by
+// their DepGroups and Dependencies: detecting cycles in it, and exporting it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// DependencyGraphFormat is a format that a DependencyGraph can be rendered in.
+type DependencyGraphFormat string
+
+// DependencyGraphFormat* constants are the formats supported by
+// DependencyGraph.Render().
+const (
+	DependencyGraphFormatDOT     DependencyGraphFormat = "dot"
+	DependencyGraphFormatMermaid DependencyGraphFormat = "mermaid"
+	DependencyGraphFormatJSON    DependencyGraphFormat = "json"
+)
+
+// graphNodeIDPrefixDepGroup and graphNodeIDPrefixRemote prefix the IDs of
+// DependencyGraphNodes that are not jobs.
+const (
+	graphNodeIDPrefixDepGroup = "depgroup:"
+	graphNodeIDPrefixRemote   = "remote:"
+)
+
+// graphLabelMaxCmdLength is the length we truncate Cmds to in node labels.
+const graphLabelMaxCmdLength = 60
+
+// graphStateColours are the colours we give nodes in each state when rendering
+// as DOT or Mermaid, so you can see at a glance where a pipeline is blocked.
+var graphStateColours = map[JobState]string{
+	JobStateDelayed:   "#fff3b0",
+	JobStateReady:     "#fff3b0",
+	JobStateReserved:  "#9ecae1",
+	JobStateRunning:   "#9ecae1",
+	JobStateLost:      "#fc9272",
+	JobStateBuried:    "#fc9272",
+	JobStateDependent: "#d9d9d9",
+	JobStateComplete:  "#a1d99b",
+}
+
+// graphMissingColour is the colour of nodes for things depended on that don't
+// exist.
+const graphMissingColour = "#ffffff"
+
+// DependencyGraphNode is a node in a DependencyGraph. Most nodes are jobs, but
+// dependencies on dep groups or jobs that don't exist get Missing nodes, and
+// dependencies on the jobs of RemoteManagers get nodes with Remote set.
+type DependencyGraphNode struct {
+	// ID is the job's key, or for non-job nodes a string prefixed with
+	// "depgroup:" or "remote:".
+	ID        string   `json:"id"`
+	Cmd       string   `json:"cmd,omitempty"`
+	RepGroup  string   `json:"rep_grp,omitempty"`
+	DepGroups []string `json:"dep_grps,omitempty"`
+	State     JobState `json:"state,omitempty"`
+
+	// Missing is true if this is a dependency on a dep group with no jobs in
+	// it, or on a job that has never been added. Dependencies on these are
+	// treated as satisfied, so the dependent jobs may have run too soon.
+	Missing bool `json:"missing,omitempty"`
+
+	// Remote is the name of the RemoteManager that this dependency is on the
+	// job(s) of. The state of those jobs is not known.
+	Remote string `json:"remote,omitempty"`
+
+	// Outside is true if this is a job that jobs in the requested RepGroup
+	// depend on, but which isn't itself in that RepGroup.
+	Outside bool `json:"outside,omitempty"`
+}
+
+// label returns a short description of the node suitable for displaying in a
+// rendered graph.
+func (n *DependencyGraphNode) label() string {
+	switch {
+	case n.Remote != "":
+		return strings.TrimPrefix(n.ID, graphNodeIDPrefixRemote) + "\n(remote)"
+	case strings.HasPrefix(n.ID, graphNodeIDPrefixDepGroup):
+		return "dep group " + strings.TrimPrefix(n.ID, graphNodeIDPrefixDepGroup) + "\n(no jobs)"
+	}
+
+	cmd := n.Cmd
+	if len(cmd) > graphLabelMaxCmdLength {
+		cmd = cmd[:graphLabelMaxCmdLength-3] + "..."
+	}
+	if n.Missing {
+		return cmd + "\n(not added)"
+	}
+	return cmd + "\n" + string(n.State)
+}
+
+// colour returns the colour the node should be displayed in.
+func (n *DependencyGraphNode) colour() string {
+	if colour, exists := graphStateColours[n.State]; exists {
+		return colour
+	}
+	return graphMissingColour
+}
+
+// DependencyGraphEdge is an edge in a DependencyGraph, from a node depended
+// upon to a job that depends on it.
+type DependencyGraphEdge struct {
+	From string              `json:"from"`
+	To   string              `json:"to"`
+	On   DependencyCondition `json:"on,omitempty"`
+
+	// DepGroup is the dep group the dependency was on, if any.
+	DepGroup string `json:"dep_grp,omitempty"`
+
+	// AnyOf is true if the dependency is one of a set of alternatives, only
+	// one of which needs to be satisfied.
+	AnyOf bool `json:"any_of,omitempty"`
+}
+
+// label returns a short description of the edge suitable for displaying in a
+// rendered graph.
+func (e *DependencyGraphEdge) label() string {
+	var parts []string
+	if e.On != DependencyOnSuccess {
+		parts = append(parts, string(e.On))
+	}
+	if e.AnyOf {
+		parts = append(parts, "any of")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// DependencyGraph describes some jobs and the things they depend on, as
+// returned by Server.DependencyGraph() and Client.GetDependencyGraph().
+type DependencyGraph struct {
+	Nodes []*DependencyGraphNode `json:"nodes"`
+	Edges []*DependencyGraphEdge `json:"edges"`
+}
+
+// Render returns the graph in the given format: DOT for Graphviz, a Mermaid
+// flowchart, or JSON. Returns an error if the format isn't one of the
+// DependencyGraphFormat* constants.
+func (g *DependencyGraph) Render(format DependencyGraphFormat) (string, error) {
+	switch format {
+	case DependencyGraphFormatDOT:
+		return g.dot(), nil
+	case DependencyGraphFormatMermaid:
+		return g.mermaid(), nil
+	case DependencyGraphFormatJSON:
+		b, err := json.Marshal(g)
+		return string(b), err
+	}
+	return "", fmt.Errorf("unknown graph format %q; must be one of dot, mermaid or json", format)
+}
+
+// dot renders the graph in Graphviz's DOT language.
+func (g *DependencyGraph) dot() string {
+	quote := func(s string) string {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+		s = strings.ReplaceAll(s, `"`, `\"`)
+		return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph wr {\n\tnode [shape=box, style=filled];\n")
+	for _, n := range g.Nodes {
+		style := ""
+		if n.Missing || n.Remote != "" {
+			style = ", style=\"filled,dashed\""
+		}
+		fmt.Fprintf(&b, "\t%s [label=%s, fillcolor=%s%s];\n", quote(n.ID), quote(n.label()), quote(n.colour()), style)
+	}
+	for _, e := range g.Edges {
+		var attrs string
+		if label := e.label(); label != "" {
+			attrs = " [label=" + quote(label) + "]"
+		}
+		fmt.Fprintf(&b, "\t%s -> %s%s;\n", quote(e.From), quote(e.To), attrs)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// mermaid renders the graph as a Mermaid flowchart.
+func (g *DependencyGraph) mermaid() string {
+	ids := make(map[string]string, len(g.Nodes))
+	escape := func(s string) string {
+		s = strings.ReplaceAll(s, `"`, "#quot;")
+		return strings.ReplaceAll(s, "\n", "<br/>")
+	}
+
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	for i, n := range g.Nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[n.ID] = id
+		fmt.Fprintf(&b, "\t%s[\"%s\"]\n", id, escape(n.label()))
+		fmt.Fprintf(&b, "\tstyle %s fill:%s\n", id, n.colour())
+	}
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if label := e.label(); label != "" {
+			arrow = "-->|" + escape(label) + "|"
+		}
+		fmt.Fprintf(&b, "\t%s %s %s\n", ids[e.From], arrow, ids[e.To])
+	}
+	return b.String()
+}
+
+// DependencyGraph returns the graph of the jobs in the given RepGroup (or, if
+// search is true, all RepGroups that have it as a substring), including
+// complete ones, and the things they depend on, so you can see where a
+// pipeline is blocked. Jobs outside the RepGroup(s) that are depended upon are
+// included (with Outside set), but not what they depend on.
+func (s *Server) DependencyGraph(repgroup string, search bool) (*DependencyGraph, error) {
+	jobs, srerr, qerr := s.getJobsByRepGroup(repgroup, search, 0, "", false, false)
+	if srerr != "" {
+		return nil, fmt.Errorf("%s: %s", srerr, qerr)
+	}
+
+	g := &DependencyGraph{Nodes: []*DependencyGraphNode{}, Edges: []*DependencyGraphEdge{}}
+	nodes := make(map[string]*DependencyGraphNode)
+	addJobNode := func(job *Job, outside bool) {
+		key := job.Key()
+		if _, exists := nodes[key]; exists {
+			return
+		}
+		node := &DependencyGraphNode{ID: key, Cmd: job.Cmd, RepGroup: job.RepGroup, DepGroups: job.DepGroups, State: job.State, Outside: outside}
+		nodes[key] = node
+		g.Nodes = append(g.Nodes, node)
+	}
+	for _, job := range jobs {
+		addJobNode(job, false)
+	}
+
+	// work out what each job depends on, noting job keys we don't yet have
+	// nodes for
+	var otherNodes []*DependencyGraphNode
+	wanted := make(map[string]*JobEssence)
+	for _, job := range jobs {
+		for _, dep := range job.Dependencies {
+			alts := Dependencies{dep}
+			anyOf := len(dep.AnyOf) > 0
+			if anyOf {
+				alts = dep.alternatives()
+			}
+			for _, alt := range alts {
+				edge := &DependencyGraphEdge{To: job.Key(), On: alt.On, DepGroup: alt.DepGroup, AnyOf: anyOf}
+
+				var froms []string
+				switch {
+				case alt.Manager != "":
+					id := graphNodeIDPrefixRemote + alt.String()
+					if _, exists := nodes[id]; !exists {
+						nodes[id] = &DependencyGraphNode{ID: id, Remote: alt.Manager}
+						otherNodes = append(otherNodes, nodes[id])
+					}
+					froms = []string{id}
+				case alt.DepGroup != "":
+					keys, err := s.db.retrieveJobKeysByDepGroup(alt.DepGroup, false)
+					if err != nil {
+						return nil, err
+					}
+					if len(keys) == 0 {
+						id := graphNodeIDPrefixDepGroup + alt.DepGroup
+						if _, exists := nodes[id]; !exists {
+							nodes[id] = &DependencyGraphNode{ID: id, Missing: true}
+							otherNodes = append(otherNodes, nodes[id])
+						}
+						keys = []string{id}
+					}
+					froms = keys
+				case alt.Essence != nil:
+					key := alt.Essence.Key()
+					if _, exists := nodes[key]; !exists {
+						wanted[key] = alt.Essence
+					}
+					froms = []string{key}
+				}
+
+				for _, from := range froms {
+					e := *edge
+					e.From = from
+					g.Edges = append(g.Edges, &e)
+					if _, exists := nodes[from]; !exists {
+						if _, exists := wanted[from]; !exists {
+							wanted[from] = nil
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if len(wanted) > 0 {
+		keys := make([]string, 0, len(wanted))
+		for key := range wanted {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		outside, srerr, qerr := s.getJobsByKeys(keys, false, false)
+		if srerr != "" {
+			return nil, fmt.Errorf("%s: %s", srerr, qerr)
+		}
+		for _, job := range outside {
+			addJobNode(job, true)
+		}
+
+		for _, key := range keys {
+			if _, exists := nodes[key]; exists {
+				continue
+			}
+			node := &DependencyGraphNode{ID: key, Missing: true}
+			if essence := wanted[key]; essence != nil {
+				node.Cmd = essence.Cmd
+			}
+			nodes[key] = node
+			otherNodes = append(otherNodes, node)
+		}
+	}
+
+	sort.Slice(otherNodes, func(i, j int) bool {
+		return otherNodes[i].ID < otherNodes[j].ID
+	})
+	g.Nodes = append(g.Nodes, otherNodes...)
+
+	return g, nil
+}
+
+// cycleChecker finds cycles in the graph of jobs implied by their DepGroups and
+// Dependencies, taking in to account jobs that are about to be added or
+// modified.
+type cycleChecker struct {
+	s        *Server
+	proposed map[string]*Job
+	members  map[string][]string
+	visited  map[string]bool
+	onPath   map[string]bool
+	path     []string
+}
+
+// newCycleChecker returns a cycleChecker that considers the given jobs (keyed
+// on their job keys) to be in the queue with their current DepGroups and
+// Dependencies, in preference to any jobs in the queue with the same keys.
+func (s *Server) newCycleChecker(proposed map[string]*Job) *cycleChecker {
+	return &cycleChecker{
+		s:        s,
+		proposed: proposed,
+		members:  make(map[string][]string),
+		visited:  make(map[string]bool),
+		onPath:   make(map[string]bool),
+	}
+}
+
+// check looks for cycles starting from each of the given job keys, returning
+// an Error with Err ErrDependencyCycle describing the first one found.
+func (c *cycleChecker) check(keys []string, op string) error {
+	for _, key := range keys {
+		cycle, err := c.visit(key)
+		if err != nil {
+			return err
+		}
+		if cycle != nil {
+			return Error{op, c.describe(cycle), ErrDependencyCycle}
+		}
+	}
+	return nil
+}
+
+// visit does a depth first search from the given job key, returning the keys
+// of the first cycle found (with the first key repeated at the end).
+func (c *cycleChecker) visit(key string) ([]string, error) {
+	if c.onPath[key] {
+		for i, k := range c.path {
+			if k == key {
+				cycle := append([]string{}, c.path[i:]...)
+				return append(cycle, key), nil
+			}
+		}
+	}
+	if c.visited[key] {
+		return nil, nil
+	}
+	c.visited[key] = true
+	c.onPath[key] = true
+	c.path = append(c.path, key)
+
+	deps, err := c.dependencies(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, dep := range deps {
+		cycle, err := c.visit(dep)
+		if err != nil || cycle != nil {
+			return cycle, err
+		}
+	}
+
+	c.path = c.path[:len(c.path)-1]
+	c.onPath[key] = false
+	return nil, nil
+}
+
+// dependencies returns the keys of the jobs that the job with the given key is
+// waiting on. Jobs in the queue that aren't dependent aren't waiting on
+// anything, and neither are complete jobs. Dependencies on RemoteManagers and
+// the alternatives of AnyOf dependencies are ignored, since other managers'
+// jobs can't depend on ours, and another alternative could be satisfied.
+func (c *cycleChecker) dependencies(key string) ([]string, error) {
+	job, exists := c.proposed[key]
+	var deps Dependencies
+	if exists {
+		deps = job.Dependencies
+	} else {
+		item, err := c.s.q.Get(key)
+		if err != nil || item.Stats().State != queue.ItemStateDependent {
+			return nil, nil
+		}
+		job = item.Data().(*Job)
+		job.RLock()
+		deps = job.Dependencies
+		job.RUnlock()
+	}
+
+	var keys []string
+	for _, dep := range deps {
+		switch {
+		case len(dep.AnyOf) > 0, dep.Manager != "":
+			continue
+		case dep.DepGroup != "":
+			members, err := c.depGroupMembers(dep.DepGroup)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, members...)
+		case dep.Essence != nil:
+			keys = append(keys, dep.Essence.Key())
+		}
+	}
+	return keys, nil
+}
+
+// depGroupMembers returns the keys of the incomplete and proposed jobs that
+// have the given DepGroup.
+func (c *cycleChecker) depGroupMembers(depGroup string) ([]string, error) {
+	if members, done := c.members[depGroup]; done {
+		return members, nil
+	}
+
+	keys, err := c.s.db.retrieveIncompleteJobKeysByDepGroup(depGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	// proposed jobs may have had this DepGroup removed, or added
+	var members []string
+	for _, key := range keys {
+		if _, exists := c.proposed[key]; !exists {
+			members = append(members, key)
+		}
+	}
+	for key, job := range c.proposed {
+		for _, dg := range job.DepGroups {
+			if dg == depGroup {
+				members = append(members, key)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+
+	c.members[depGroup] = members
+	return members, nil
+}
+
+// describe converts a cycle of job keys in to a readable string of their
+// commands.
+func (c *cycleChecker) describe(cycle []string) string {
+	cmds := make([]string, len(cycle))
+	for i, key := range cycle {
+		cmds[i] = key
+		if job, exists := c.proposed[key]; exists {
+			cmds[i] = job.Cmd
+		} else if item, err := c.s.q.Get(key); err == nil {
+			job := item.Data().(*Job)
+			job.RLock()
+			cmds[i] = job.Cmd
+			job.RUnlock()
+		}
+	}
+	return strings.Join(cmds, " -> ")
+}
+
+// checkNewJobCycles returns an Error with Err ErrDependencyCycle if adding the
+// given jobs would create a cycle of dependencies, which would leave the jobs
+// in it dependent forever. Jobs that are already in the queue are ignored,
+// since they won't be added. Previously completed jobs that would be re-run,
+// and queued jobs that would start waiting again, because they depend on one
+// of the new jobs' DepGroups are taken in to account.
+func (s *Server) checkNewJobCycles(jobs []*Job) error {
+	proposed := make(map[string]*Job)
+	var keys []string
+	depGroups := make(map[string]bool)
+	for _, job := range jobs {
+		key := job.Key()
+		if _, err := s.q.Get(key); err == nil {
+			continue
+		}
+		if _, exists := proposed[key]; exists {
+			continue
+		}
+		proposed[key] = job
+		keys = append(keys, key)
+		for _, dg := range job.DepGroups {
+			if dg != "" {
+				depGroups[dg] = true
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if len(depGroups) > 0 {
+		newKeys := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			newKeys[key] = true
+		}
+		resurrected, updated, err := s.db.retrieveDependentJobs(depGroups, newKeys)
+		if err != nil {
+			return err
+		}
+		for _, job := range resurrected {
+			proposed[job.Key()] = job
+		}
+
+		// jobs in the queue that aren't running will wait on the new jobs
+		for _, job := range updated {
+			key := job.Key()
+			if item, err := s.q.Get(key); err == nil && item.Stats().State != queue.ItemStateRun {
+				proposed[key] = job
+			}
+		}
+	}
+
+	return s.newCycleChecker(proposed).check(keys, "Add")
+}
+
+// checkModifiedJobCycles returns an Error with Err ErrDependencyCycle if
+// modifying the DepGroups or Dependencies of the given jobs as the modifier
+// describes would create a cycle of dependencies.
+func (s *Server) checkModifiedJobCycles(jobs []*Job, modifier *JobModifier) error {
+	if !modifier.DependenciesSet && !modifier.DepGroupsSet {
+		return nil
+	}
+
+	proposed := make(map[string]*Job, len(jobs))
+	keys := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		job.RLock()
+		after := &Job{Cmd: job.Cmd, DepGroups: job.DepGroups, Dependencies: job.Dependencies}
+		key := job.Key()
+		job.RUnlock()
+		if modifier.DepGroupsSet {
+			after.DepGroups = modifier.DepGroups
+		}
+		if modifier.DependenciesSet {
+			after.Dependencies = modifier.Dependencies
+		}
+		proposed[key] = after
+		keys = append(keys, key)
+	}
+
+	return s.newCycleChecker(proposed).check(keys, "Modify")
+}
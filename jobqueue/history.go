@@ -0,0 +1,134 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the types used to search through the history of jobs that
+// have run.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyTimeWidth is the width of the zero-padded end times in our history
+// lookup keys, enough to hold any int64 UnixNano.
+const historyTimeWidth = 20
+
+// JobSearch describes the jobs you want to find with Client.SearchHistory().
+// Only jobs that have exited, successfully or not, are considered, and a job
+// is found based on the most recent time it exited. Fields left at their zero
+// value are not used to filter the results.
+type JobSearch struct {
+	// Since and Until restrict the search to jobs that ended within this time
+	// range (inclusive).
+	Since time.Time
+	Until time.Time
+
+	// Host is the name, ID or IP of the host the jobs ran on.
+	Host string
+
+	// Exitcode, if not nil, restricts the search to jobs that exited with this
+	// code.
+	Exitcode *int
+
+	FailReason string
+	ReqGroup   string
+	RepGroup   string
+
+	// MinPeakRAM and MinPeakDisk restrict the search to jobs that used at
+	// least this many MB of memory or disk.
+	MinPeakRAM  int
+	MinPeakDisk int64
+
+	// Complete restricts the search to jobs that completed successfully, so
+	// excludes those that are still in the queue, eg. buried or awaiting a
+	// retry.
+	Complete bool
+
+	// Limit is the maximum number of jobs to return. If more jobs match, you
+	// will also get a cursor that you can supply as After in an otherwise
+	// identical JobSearch to get the next page of results. 0 means no limit.
+	Limit int
+	After string
+}
+
+// matches tells you if the given job, which should have been retrieved via one
+// of our history lookups, satisfies all the criteria of this search.
+func (js *JobSearch) matches(job *Job) bool {
+	if !job.Exited || job.EndTime.IsZero() {
+		return false
+	}
+	if js.Complete && job.State != JobStateComplete {
+		return false
+	}
+	if !js.Since.IsZero() && job.EndTime.Before(js.Since) {
+		return false
+	}
+	if !js.Until.IsZero() && job.EndTime.After(js.Until) {
+		return false
+	}
+	if js.Host != "" && job.Host != js.Host && job.HostID != js.Host && job.HostIP != js.Host {
+		return false
+	}
+	if js.Exitcode != nil && job.Exitcode != *js.Exitcode {
+		return false
+	}
+	if js.FailReason != "" && job.FailReason != js.FailReason {
+		return false
+	}
+	if js.ReqGroup != "" && job.ReqGroup != js.ReqGroup {
+		return false
+	}
+	if js.RepGroup != "" && job.RepGroup != js.RepGroup {
+		return false
+	}
+	return job.PeakRAM >= js.MinPeakRAM && job.PeakDisk >= js.MinPeakDisk
+}
+
+// lookup returns the history lookup bucket that is likely to be most selective
+// for this search, along with the prefix of the keys in that bucket that could
+// match.
+func (js *JobSearch) lookup() ([]byte, string) {
+	switch {
+	case js.Host != "":
+		return bucketHostTK, js.Host + dbDelimiter
+	case js.Exitcode != nil:
+		return bucketExitTK, strconv.Itoa(*js.Exitcode) + dbDelimiter
+	case js.FailReason != "":
+		return bucketFailTK, js.FailReason + dbDelimiter
+	case js.ReqGroup != "":
+		return bucketReqTK, js.ReqGroup + dbDelimiter
+	}
+	return bucketEndTK, ""
+}
+
+// historyPosition returns the part of a history lookup key that comes after its
+// prefix, which orders entries by end time and is also used as a pagination
+// cursor.
+func historyPosition(end time.Time, jobKey string) string {
+	return fmt.Sprintf("%0*d%s%s", historyTimeWidth, end.UnixNano(), dbDelimiter, jobKey)
+}
+
+// historyPositionTime parses the end time out of a historyPosition().
+func historyPositionTime(pos string) (int64, error) {
+	parts := strings.SplitN(pos, dbDelimiter, 2)
+	return strconv.ParseInt(parts[0], 10, 64)
+}
@@ -131,6 +131,12 @@ type Job struct {
 	// you expect to have similar resource requirements.
 	ReqGroup string
 
+	// SizeHint is an optional number, such as the size of an input file, that
+	// you expect this Cmd's resource usage to grow with. Once enough Jobs in
+	// the same ReqGroup have had a SizeHint, Requirements are determined based
+	// on how resource usage grew with SizeHint in the past.
+	SizeHint float64
+
 	// Requirements describes the resources this Cmd needs to run, such as RAM,
 	// Disk and time. These may be determined for you by the system (depending
 	// on Override) based on past experience of running jobs with the same
@@ -151,6 +157,13 @@ type Job struct {
 	// will run before lower numbered ones (the default is 0).
 	Priority uint8
 
+	// Deadline, if not the zero time, is when you need this job to have
+	// completed by. Ready jobs with a Deadline start running before those
+	// without, earliest Deadline minus Requirements.Time first, and only then
+	// in Priority order. Scheduler groups containing jobs that must start soon
+	// to meet their Deadline also get runners spawned for them first.
+	Deadline time.Time
+
 	// Retries is the number of times to retry running a Cmd if it fails.
 	Retries uint8
 
@@ -158,6 +171,9 @@ type Job struct {
 	// of these groups are defined (elsewhere) to have a limit, then if as many
 	// other jobs as the limit are currently running, this job will not start
 	// running. It's a way of not running too many of a type of job at once.
+	// Each running job uses 1 unit of a group's limit, unless the group name
+	// is suffixed with a weight, like "bigio*4" (see limiter.SplitWeight()),
+	// in which case it uses that many units.
 	LimitGroups []string
 
 	// DepGroups are the dependency groups this job belongs to that other jobs
@@ -212,6 +228,15 @@ type Job struct {
 	// monitoring of multiple docker containers run by a single Cmd.
 	MonitorDocker string
 
+	// ResultCache, if set, turns on memoization of the Cmd's results, so that
+	// if an identical Cmd with identical inputs has already run successfully,
+	// its outputs are restored instead of running Cmd again.
+	ResultCache *ResultCache
+
+	// User is the user the job is charged to. If not set, it is filled in with
+	// the name of the user that Add()s the job.
+	User string
+
 	// The remaining properties are used to record information about what
 	// happened when Cmd was executed, or otherwise provide its current state.
 	// It is meaningless to set these yourself.
@@ -230,6 +255,9 @@ type Job struct {
 	Exitcode int
 	// true if the job was running but we've lost contact with it
 	Lost bool
+	// true if the job was completed by restoring the outputs of an identical
+	// earlier run from its ResultCache, instead of running Cmd.
+	Cached bool
 	// if the job failed to complete successfully, this will hold one of the
 	// FailReason* strings. Also set if Lost == true.
 	FailReason string
@@ -247,6 +275,19 @@ type Job struct {
 	EndTime time.Time
 	// CPU time used.
 	CPUtime time.Duration
+	// total cost of all the times the Cmd was run, if the server was
+	// configured with CostRates.
+	Cost float64
+	// if the job is ready to run but is being held back because it is covered
+	// by a Budget that has reached its limit, this is the name of that Budget.
+	BudgetExceeded string
+	// if the job has a Deadline and isn't yet complete, this is true if, given
+	// the number of jobs queued ahead of it, it is predicted to miss it.
+	DeadlineAtRisk bool
+	// if the job depends on the jobs of other wr managers, and some of those
+	// managers could not be contacted the last time we tried, this describes
+	// the problems.
+	RemoteDepProblems []string
 	// to read, call job.StdErr() instead; if the job ran, its (truncated)
 	// STDERR will be here.
 	StdErrC []byte
@@ -296,6 +337,11 @@ type Job struct {
 	// killCalled is set for running jobs if Kill() is called on them.
 	killCalled bool
 
+	// runCost and runCoreHours are the cost and core-hours of the most recent
+	// run of Cmd, until they have been added to the totals in the database.
+	runCost      float64
+	runCoreHours float64
+
 	// incrementedLimitGroups notes that we have incremented limit groups for
 	// this job, so they should be decremented when the job finishes running.
 	incrementedLimitGroups []string
@@ -690,18 +736,19 @@ func (j *Job) noteIncrementedLimitGroups(groups []string) {
 
 // updateAfterExit sets some properties on the job, only if the supplied
 // JobEndState indicates the job exited, and if the job wasn't already exited.
-// It also calls decrementLimitGroups().
-func (j *Job) updateAfterExit(jes *JobEndState, lim *limiter.Limiter) {
+// It also calls decrementLimitGroups(). Returns true if the properties were
+// set.
+func (j *Job) updateAfterExit(jes *JobEndState, lim *limiter.Limiter) bool {
 	j.RLock()
 	if j.Exited {
 		j.RUnlock()
-		return
+		return false
 	}
 	j.RUnlock()
 	j.decrementLimitGroups(lim)
 
 	if jes == nil || !jes.Exited {
-		return
+		return false
 	}
 
 	j.Lock()
@@ -711,10 +758,24 @@ func (j *Job) updateAfterExit(jes *JobEndState, lim *limiter.Limiter) {
 	j.PeakDisk = jes.PeakDisk
 	j.CPUtime = jes.CPUtime
 	j.EndTime = jes.EndTime
+	j.Cached = jes.Cached
 	if jes.Cwd != "" {
 		j.ActualCwd = jes.Cwd
 	}
 	j.Unlock()
+	return true
+}
+
+// takeRunCost returns the cost and core-hours of the most recent run of the job
+// that have not yet been added to the totals in the database, and forgets them
+// so that they only get added once.
+func (j *Job) takeRunCost() (float64, float64) {
+	j.Lock()
+	defer j.Unlock()
+	cost, coreHours := j.runCost, j.runCoreHours
+	j.runCost = 0
+	j.runCoreHours = 0
+	return cost, coreHours
 }
 
 // decrementLimitGroups decrements any limit groups of this job that had been
@@ -793,6 +854,10 @@ func (j *Job) ToStatus() (JStatus, error) {
 	if state == JobStateRunning && j.Lost {
 		state = JobStateLost
 	}
+	var resultCache string
+	if j.ResultCache != nil {
+		resultCache = j.ResultCache.String()
+	}
 	ot := make([]string, 0, len(j.Requirements.Other))
 	for key, val := range j.Requirements.Other {
 		ot = append(ot, key+":"+val)
@@ -811,6 +876,7 @@ func (j *Job) ToStatus() (JStatus, error) {
 		Behaviours:    j.Behaviours.String(),
 		Mounts:        j.MountConfigs.String(),
 		MonitorDocker: j.MonitorDocker,
+		ResultCache:   resultCache,
 		ExpectedRAM:   j.Requirements.RAM,
 		ExpectedTime:  j.Requirements.Time.Seconds(),
 		RequestedDisk: j.Requirements.Disk,
@@ -820,11 +886,15 @@ func (j *Job) ToStatus() (JStatus, error) {
 		PeakDisk:      j.PeakDisk,
 		Exited:        j.Exited,
 		Exitcode:      j.Exitcode,
+		Cached:        j.Cached,
 		FailReason:    j.FailReason,
 		Pid:           j.Pid,
 		Host:          j.Host,
 		HostID:        j.HostID,
 		HostIP:        j.HostIP,
+		User:          j.User,
+		Cost:          j.Cost,
+		Budget:        j.BudgetExceeded,
 		Walltime:      j.WallTime().Seconds(),
 		CPUtime:       j.CPUtime.Seconds(),
 		Started:       j.StartTime.Unix(),
@@ -899,6 +969,8 @@ type JobModifier struct {
 	BsubMode         string
 	MonitorDocker    string
 	Requirements     *scheduler.Requirements
+	Deadline         time.Time
+	DeadlineSet      bool
 	CwdMatters       bool
 	CwdMattersSet    bool
 	ChangeHome       bool
@@ -978,6 +1050,13 @@ func (j *JobModifier) SetPriority(new uint8) {
 	j.PrioritySet = true
 }
 
+// SetDeadline notes that you want to modify the Deadline of Jobs. Supply the
+// zero time to remove their Deadline.
+func (j *JobModifier) SetDeadline(new time.Time) {
+	j.Deadline = new
+	j.DeadlineSet = true
+}
+
 // SetRetries notes that you want to modify the Retries of Jobs.
 func (j *JobModifier) SetRetries(new uint8) {
 	j.Retries = new
@@ -1136,6 +1215,9 @@ func (j *JobModifier) Modify(jobs []*Job, server *Server) (map[string]string, er
 		if j.PrioritySet {
 			job.Priority = j.Priority
 		}
+		if j.DeadlineSet {
+			job.Deadline = j.Deadline
+		}
 		if j.RetriesSet {
 			job.Retries = j.Retries
 		}
@@ -19,7 +19,11 @@
 package jobqueue
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -27,6 +31,8 @@ import (
 	"io/fs"
 	"log"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -493,10 +499,11 @@ func TestJobqueueSignal(t *testing.T) {
 			var jobs []*Job
 			jobs = append(jobs, &Job{Cmd: cmd, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 4 * time.Second, Cores: 1}, Retries: uint8(0), RepGroup: "3secs_pass"})
 			jobs = append(jobs, &Job{Cmd: cmd2, Cwd: "/tmp", ReqGroup: "fake_group", Requirements: &jqs.Requirements{RAM: 10, Time: 1 * time.Second, Cores: 1}, Retries: uint8(0), RepGroup: "3secs_fail"})
+			origRecSecRound := RecSecRound
 			RecSecRound = 1
 			defer func() {
 				// revert back to normal
-				RecSecRound = 1800
+				RecSecRound = origRecSecRound
 			}()
 			inserts, already, err := jq.Add(jobs, envVars, true)
 			So(err, ShouldBeNil)
@@ -983,7 +990,191 @@ func TestJobqueueBasics(t *testing.T) {
 				So(len(jobs), ShouldEqual, 0)
 			})
 
+			Convey("You can search the history of jobs once they've exited", func() {
+				start := time.Now().Add(-1 * time.Hour)
+				for index, job := range jobs {
+					job.Exited = true
+					job.Exitcode = index % 3
+					job.Host = fmt.Sprintf("host%d", index%2)
+					job.ReqGroup = "history_group"
+					job.PeakRAM = index * 100
+					job.StartTime = start
+					job.EndTime = start.Add(time.Duration(index+1) * time.Minute)
+					server.db.updateJobAfterExit(job, []byte{}, []byte{}, false)
+				}
+				<-time.After(200 * time.Millisecond)
+
+				keysOf := func(found []*Job) []string {
+					keys := make([]string, len(found))
+					for i, job := range found {
+						keys[i] = job.Key()
+					}
+					return keys
+				}
+				keysAt := func(indexes ...int) []string {
+					keys := make([]string, len(indexes))
+					for i, index := range indexes {
+						keys[i] = jobs[index].Key()
+					}
+					return keys
+				}
+
+				found, next, err := jq.SearchHistory(&JobSearch{}, false, false)
+				So(err, ShouldBeNil)
+				So(next, ShouldBeBlank)
+				So(keysOf(found), ShouldResemble, keysAt(0, 1, 2, 3, 4, 5, 6, 7, 8, 9))
+				So(found[0].Exited, ShouldBeTrue)
+				So(found[0].Host, ShouldEqual, "host0")
+
+				found, _, err = jq.SearchHistory(&JobSearch{Since: start.Add(5*time.Minute + 30*time.Second)}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(5, 6, 7, 8, 9))
+
+				found, _, err = jq.SearchHistory(&JobSearch{Until: start.Add(2 * time.Minute)}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(0, 1))
+
+				found, _, err = jq.SearchHistory(&JobSearch{Host: "host1"}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(1, 3, 5, 7, 9))
+
+				exit := 2
+				found, _, err = jq.SearchHistory(&JobSearch{Exitcode: &exit}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(2, 5, 8))
+
+				found, _, err = jq.SearchHistory(&JobSearch{Exitcode: &exit, Host: "host1", Since: start.Add(3 * time.Minute)}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(5))
+
+				found, _, err = jq.SearchHistory(&JobSearch{MinPeakRAM: 800, ReqGroup: "history_group"}, false, false)
+				So(err, ShouldBeNil)
+				So(keysOf(found), ShouldResemble, keysAt(8, 9))
+
+				Convey("A page at a time", func() {
+					js := &JobSearch{Host: "host0", Limit: 2}
+					found, next, err = jq.SearchHistory(js, false, false)
+					So(err, ShouldBeNil)
+					So(keysOf(found), ShouldResemble, keysAt(0, 2))
+					So(next, ShouldNotBeBlank)
+
+					js.After = next
+					found, next, err = jq.SearchHistory(js, false, false)
+					So(err, ShouldBeNil)
+					So(keysOf(found), ShouldResemble, keysAt(4, 6))
+					So(next, ShouldNotBeBlank)
+
+					js.After = next
+					found, next, err = jq.SearchHistory(js, false, false)
+					So(err, ShouldBeNil)
+					So(keysOf(found), ShouldResemble, keysAt(8))
+					So(next, ShouldBeBlank)
+				})
+
+				Convey("Only based on the most recent exit of each job", func() {
+					jobs[0].Host = "host1"
+					jobs[0].EndTime = start.Add(20 * time.Minute)
+					server.db.updateJobAfterExit(jobs[0], []byte{}, []byte{}, false)
+					<-time.After(200 * time.Millisecond)
+
+					found, _, err = jq.SearchHistory(&JobSearch{}, false, false)
+					So(err, ShouldBeNil)
+					So(keysOf(found), ShouldResemble, keysAt(1, 2, 3, 4, 5, 6, 7, 8, 9, 0))
+
+					found, _, err = jq.SearchHistory(&JobSearch{Host: "host0"}, false, false)
+					So(err, ShouldBeNil)
+					So(keysOf(found), ShouldResemble, keysAt(2, 4, 6, 8))
+				})
+
+				Convey("And export them", func() {
+					js := &JobSearch{Since: start.Add(5*time.Minute + 30*time.Second)}
+
+					var buf bytes.Buffer
+					exporter, err := NewJobExporter(ExportFormatCSV, &buf, "")
+					So(err, ShouldBeNil)
+					err = jq.ExportHistory(js, exporter)
+					So(err, ShouldBeNil)
+					err = exporter.Close()
+					So(err, ShouldBeNil)
+
+					records, err := csv.NewReader(&buf).ReadAll()
+					So(err, ShouldBeNil)
+					So(len(records), ShouldEqual, 6)
+					So(records[0][0], ShouldEqual, "key")
+					So(records[0][10], ShouldEqual, "host")
+					So(records[0][17], ShouldEqual, "peak_memory_mb")
+					So(records[1][0], ShouldEqual, jobs[5].Key())
+					So(records[1][7], ShouldEqual, "2")
+					So(records[1][10], ShouldEqual, "host1")
+					So(records[1][17], ShouldEqual, "500")
+					So(records[1][20], ShouldEqual, "360")
+					So(records[5][0], ShouldEqual, jobs[9].Key())
+
+					buf.Reset()
+					exporter, err = NewJobExporter(ExportFormatJSONL, &buf, "")
+					So(err, ShouldBeNil)
+					err = jq.ExportHistory(&JobSearch{Host: "host0"}, exporter)
+					So(err, ShouldBeNil)
+					err = exporter.Close()
+					So(err, ShouldBeNil)
+
+					lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+					So(len(lines), ShouldEqual, 5)
+					So(lines[0], ShouldStartWith, `{"key":"`+jobs[0].Key()+`","rep_group":"manually_added"`)
+					var exported map[string]interface{}
+					err = json.Unmarshal([]byte(lines[4]), &exported)
+					So(err, ShouldBeNil)
+					So(exported["key"], ShouldEqual, jobs[8].Key())
+					So(exported["exit_code"], ShouldEqual, 2)
+					So(exported["req_memory_mb"], ShouldEqual, 1024)
+					So(exported["end_time"], ShouldEqual, jobs[8].EndTime.UTC().Format(time.RFC3339))
+
+					dir, err := os.MkdirTemp("", "wr_jobqueue_test_export_")
+					So(err, ShouldBeNil)
+					defer os.RemoveAll(dir)
+					path := filepath.Join(dir, "jobs.db")
+					exporter, err = NewJobExporter(ExportFormatSQLite, nil, path)
+					So(err, ShouldBeNil)
+					err = jq.ExportHistory(&JobSearch{}, exporter)
+					So(err, ShouldBeNil)
+					err = exporter.Close()
+					So(err, ShouldBeNil)
+
+					sdb, err := sql.Open("sqlite", path)
+					So(err, ShouldBeNil)
+					defer sdb.Close()
+					var count, ram int
+					err = sdb.QueryRow("SELECT COUNT(*), SUM(peak_memory_mb) FROM jobs WHERE host = ?", "host1").Scan(&count, &ram)
+					So(err, ShouldBeNil)
+					So(count, ShouldEqual, 5)
+					So(ram, ShouldEqual, 2500)
+
+					_, err = NewJobExporter(ExportFormatSQLite, nil, path)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrExportExists)
+
+					Convey("Only completed jobs are exported if desired", func() {
+						buf.Reset()
+						exporter, err = NewJobExporter(ExportFormatJSONL, &buf, "")
+						So(err, ShouldBeNil)
+						err = jq.ExportHistory(&JobSearch{Complete: true}, exporter)
+						So(err, ShouldBeNil)
+						err = exporter.Close()
+						So(err, ShouldBeNil)
+						So(buf.Len(), ShouldEqual, 0)
+					})
+				})
+			})
+
 			Convey("You can store their (fake) runtime stats and get recommendations", func() {
+				origRecSecRound := RecSecRound
+				RecSecRound = 1800
+				defer func() {
+					RecSecRound = origRecSecRound
+				}()
+
 				// these are ignored by the learning system unless the job
 				// failed due to running out of a resource
 				for index, job := range jobs {
@@ -1333,6 +1524,118 @@ func TestJobqueueBasics(t *testing.T) {
 	}
 }
 
+func TestJobqueueBackends(t *testing.T) {
+	if runnermode || servermode {
+		return
+	}
+
+	for _, backend := range []string{DBBackendBolt, DBBackendSQLite} {
+		testJobqueueBackend(t, backend)
+	}
+}
+
+// testJobqueueBackend tests the core job lifecycle of adding, reserving,
+// executing and archiving jobs, and recovering them after a server restart,
+// with a server using the given database backend.
+func testJobqueueBackend(t *testing.T, backend string) {
+	ctx := context.Background()
+	config, serverConfig, addr, standardReqs, clientConnectTime := jobqueueTestInit(true)
+	serverConfig.DBBackend = backend
+
+	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
+
+	Convey("Once a jobqueue server using the "+backend+" backend is up", t, func() {
+		server, _, token, errs := serve(serverConfig)
+		So(errs, ShouldBeNil)
+		defer func() {
+			server.Stop(true)
+		}()
+
+		detected, err := detectDBBackend(config.ManagerDbFile)
+		So(err, ShouldBeNil)
+		So(detected, ShouldEqual, backend)
+
+		jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+		So(err, ShouldBeNil)
+		defer disconnect(jq)
+
+		var jobs []*Job
+		for i := 1; i <= 3; i++ {
+			jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Priority: uint8(4 - i), Retries: uint8(0), RepGroup: "backend"})
+		}
+		inserts, already, err := jq.Add(jobs, envVars, true)
+		So(err, ShouldBeNil)
+		So(inserts, ShouldEqual, 3)
+		So(already, ShouldEqual, 0)
+
+		Convey("You can reserve and execute jobs, which get archived", func() {
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo 1")
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+			So(job.Exitcode, ShouldEqual, 0)
+
+			job, err = jq.GetByEssence(&JobEssence{Cmd: "echo 1"}, false, false)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.State, ShouldEqual, JobStateComplete)
+
+			job, err = jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo 2")
+			err = jq.Bury(job, nil, "test bury")
+			So(err, ShouldBeNil)
+
+			Convey("Then stop the server, restart it, and carry on where you left off", func() {
+				server.Stop(true)
+				wipeDevDBOnInit = false
+				server, _, token, errs = serve(serverConfig)
+				wipeDevDBOnInit = true
+				So(errs, ShouldBeNil)
+				jq2, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+				defer disconnect(jq2)
+
+				job, err = jq2.GetByEssence(&JobEssence{Cmd: "echo 1"}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.State, ShouldEqual, JobStateComplete)
+
+				job, err = jq2.GetByEssence(&JobEssence{Cmd: "echo 2"}, false, false)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.State, ShouldEqual, JobStateBuried)
+
+				kicked, err := jq2.Kick([]*JobEssence{{Cmd: "echo 2"}})
+				So(err, ShouldBeNil)
+				So(kicked, ShouldEqual, 1)
+
+				for _, cmd := range []string{"echo 2", "echo 3"} {
+					job, err = jq2.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					So(job.Cmd, ShouldEqual, cmd)
+					err = jq2.Execute(ctx, job, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+					So(job.State, ShouldEqual, JobStateComplete)
+				}
+
+				jobs, err = jq2.GetIncomplete(0, "", false, false)
+				So(err, ShouldBeNil)
+				So(jobs, ShouldBeEmpty)
+
+				jobs, err = jq2.GetByRepGroup("backend", false, 0, JobStateComplete, false, false)
+				So(err, ShouldBeNil)
+				So(len(jobs), ShouldEqual, 3)
+			})
+		})
+	})
+}
+
 func TestJobqueueMedium(t *testing.T) {
 	ctx := context.Background()
 
@@ -2342,6 +2645,382 @@ func TestJobqueueMedium(t *testing.T) {
 			})
 		})
 
+		Convey("After connecting and adding some quick jobs", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			var jobs []*Job
+			for i := 0; i < 5; i++ {
+				jobs = append(jobs, &Job{Cmd: fmt.Sprintf("echo batchtest %d", i), Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(0), RepGroup: "batch"})
+			}
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 5)
+			So(already, ShouldEqual, 0)
+
+			Convey("You can reserve many of them at once, and they stay reserved until executed", func() {
+				batch, err := jq.ReserveMany(50*time.Millisecond, "", 3)
+				So(err, ShouldBeNil)
+				So(len(batch), ShouldEqual, 3)
+
+				<-time.After(ServerItemTTR + 100*time.Millisecond)
+				for _, job := range batch {
+					got, err := jq.GetByEssence(&JobEssence{Cmd: job.Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(got.State, ShouldEqual, JobStateReserved)
+				}
+
+				batch2, err := jq.ReserveMany(50*time.Millisecond, "", 3)
+				So(err, ShouldBeNil)
+				So(len(batch2), ShouldEqual, 2)
+
+				batch3, err := jq.ReserveMany(10*time.Millisecond, "", 3)
+				So(err, ShouldBeNil)
+				So(len(batch3), ShouldEqual, 0)
+
+				Convey("Then execute them with archives deferred until flushed", func() {
+					jq.SetDeferArchives(true)
+					for _, job := range batch {
+						err = jq.Execute(ctx, job, config.RunnerExecShell)
+						So(err, ShouldBeNil)
+					}
+
+					<-time.After(ServerItemTTR + 100*time.Millisecond)
+					got, err := jq.GetByEssence(&JobEssence{Cmd: batch[0].Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(got.State, ShouldEqual, JobStateRunning)
+
+					rs := server.db.replication
+					So(rs.pause(), ShouldBeTrue)
+					store := rs.dbStore
+					rs.resume(&updateFailingStore{dbStore: store})
+					failed, err := jq.FlushArchives()
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrDBError)
+					So(failed, ShouldBeNil)
+					So(rs.pause(), ShouldBeTrue)
+					rs.resume(store)
+
+					for _, job := range batch {
+						So(job.State, ShouldNotEqual, JobStateComplete)
+						got, err := jq.GetByEssence(&JobEssence{Cmd: job.Cmd}, false, false)
+						So(err, ShouldBeNil)
+						So(got.State, ShouldEqual, JobStateRunning)
+						So(got.Exited, ShouldBeFalse)
+					}
+
+					failed, err = jq.FlushArchives()
+					So(err, ShouldBeNil)
+					So(failed, ShouldBeEmpty)
+
+					for _, job := range batch {
+						So(job.State, ShouldEqual, JobStateComplete)
+						got, err := jq.GetByEssence(&JobEssence{Cmd: job.Cmd}, false, false)
+						So(err, ShouldBeNil)
+						So(got.State, ShouldEqual, JobStateComplete)
+					}
+
+					failed, err = jq.FlushArchives()
+					So(err, ShouldBeNil)
+					So(failed, ShouldBeEmpty)
+				})
+
+				Convey("Then archive them all at once, with failures reported", func() {
+					err := jq.Started(batch2[0], 123)
+					So(err, ShouldBeNil)
+					var jess []*JobEndState
+					for range batch2 {
+						jess = append(jess, &JobEndState{Cwd: "/tmp", Exitcode: 0, Exited: true, EndTime: time.Now()})
+					}
+
+					failed, err := jq.ArchiveMany(batch2, jess[:1])
+					So(err, ShouldNotBeNil)
+					So(failed, ShouldBeNil)
+
+					failed, err = jq.ArchiveMany(batch2, jess)
+					So(err, ShouldBeNil)
+					So(len(failed), ShouldEqual, 1)
+					So(failed[batch2[1].Key()], ShouldEqual, ErrBadRequest)
+					So(batch2[0].State, ShouldEqual, JobStateComplete)
+					So(batch2[1].State, ShouldEqual, JobStateReserved)
+
+					got, err := jq.GetByEssence(&JobEssence{Cmd: batch2[0].Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(got.State, ShouldEqual, JobStateComplete)
+
+					got, err = jq.GetByEssence(&JobEssence{Cmd: batch2[1].Cmd}, false, false)
+					So(err, ShouldBeNil)
+					So(got.State, ShouldEqual, JobStateReserved)
+				})
+			})
+		})
+
+		Convey("After connecting and adding some jobs with deadlines", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			now := time.Now()
+			var jobs []*Job
+			jobs = append(jobs, &Job{Cmd: "echo deadline none", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Priority: 255, RepGroup: "deadlines"})
+			jobs = append(jobs, &Job{Cmd: "echo deadline late", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Deadline: now.Add(2 * time.Hour), RepGroup: "deadlines"})
+			jobs = append(jobs, &Job{Cmd: "echo deadline soon", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Deadline: now.Add(1 * time.Hour), RepGroup: "deadlines"})
+			jobs = append(jobs, &Job{Cmd: "echo deadline missed", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Deadline: now.Add(1 * time.Second), RepGroup: "deadlines"})
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 4)
+			So(already, ShouldEqual, 0)
+
+			Convey("Those that can't finish by their deadline are predicted to miss it", func() {
+				got, err := jq.GetByRepGroup("deadlines", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(got), ShouldEqual, 4)
+				atRisk := make(map[string]bool)
+				for _, job := range got {
+					atRisk[job.Cmd] = job.DeadlineAtRisk
+					if job.Cmd == "echo deadline soon" {
+						So(job.Deadline.Equal(jobs[2].Deadline), ShouldBeTrue)
+					}
+				}
+				So(atRisk, ShouldResemble, map[string]bool{
+					"echo deadline none":   false,
+					"echo deadline late":   false,
+					"echo deadline soon":   false,
+					"echo deadline missed": true,
+				})
+			})
+
+			Convey("They are reserved earliest deadline first, before jobs without one", func() {
+				var order []string
+				for i := 0; i < 4; i++ {
+					job, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(job, ShouldNotBeNil)
+					order = append(order, job.Cmd)
+				}
+				So(order, ShouldResemble, []string{"echo deadline missed", "echo deadline soon", "echo deadline late", "echo deadline none"})
+			})
+
+			Convey("Their deadlines can be modified", func() {
+				jm := NewJobModifer()
+				jm.SetDeadline(time.Time{})
+				modified, err := jq.Modify([]*JobEssence{{Cmd: "echo deadline missed"}, {Cmd: "echo deadline soon"}}, jm)
+				So(err, ShouldBeNil)
+				So(len(modified), ShouldEqual, 2)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, "echo deadline late")
+				So(job.Deadline.IsZero(), ShouldBeFalse)
+
+				job, err = jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, "echo deadline none")
+			})
+
+			Convey("Those not yet urgent know when they will be", func() {
+				So(jobs[0].deadlineUrgent(), ShouldBeFalse)
+				So(jobs[0].untilDeadlineUrgent(), ShouldEqual, 0)
+				So(jobs[1].deadlineUrgent(), ShouldBeFalse)
+				So(jobs[1].untilDeadlineUrgent(), ShouldAlmostEqual, 2*time.Hour-standardReqs.Time-ServerDeadlineUrgency, float64(1*time.Minute))
+				So(jobs[2].deadlineUrgent(), ShouldBeTrue)
+				So(jobs[2].untilDeadlineUrgent(), ShouldEqual, 0)
+			})
+
+			Convey("You can parse user-supplied deadlines", func() {
+				deadline, err := ParseDeadline("")
+				So(err, ShouldBeNil)
+				So(deadline.IsZero(), ShouldBeTrue)
+
+				deadline, err = ParseDeadline("2021-06-01T18:00:00Z")
+				So(err, ShouldBeNil)
+				So(deadline.Equal(time.Date(2021, 6, 1, 18, 0, 0, 0, time.UTC)), ShouldBeTrue)
+
+				deadline, err = ParseDeadline("2h")
+				So(err, ShouldBeNil)
+				So(deadline, ShouldHappenWithin, 1*time.Minute, time.Now().Add(2*time.Hour))
+
+				_, err = ParseDeadline("tomorrow")
+				So(err, ShouldNotBeNil)
+				_, err = ParseDeadline("-2h")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("After connecting and adding some jobs with conditional dependencies", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			parse := func(exprs ...string) Dependencies {
+				var deps Dependencies
+				for _, expr := range exprs {
+					dep, errp := ParseDependency(expr)
+					So(errp, ShouldBeNil)
+					deps = append(deps, dep)
+				}
+				return deps
+			}
+
+			var jobs []*Job
+			jobs = append(jobs, &Job{Cmd: "echo depcond fail && false", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Priority: 255, DepGroups: []string{"dcfail"}, RepGroup: "depcond"})
+			jobs = append(jobs, &Job{Cmd: "echo depcond ok", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Priority: 254, DepGroups: []string{"dcok"}, RepGroup: "depcond"})
+			jobs = append(jobs, &Job{Cmd: "echo depcond onfail", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("failed(dcfail)"), RepGroup: "depcond"})
+			jobs = append(jobs, &Job{Cmd: "echo depcond onend", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("ended(dcfail)", "dcok"), RepGroup: "depcond"})
+			jobs = append(jobs, &Job{Cmd: "echo depcond anyof", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("dcfail|dcok"), RepGroup: "depcond"})
+			jobs = append(jobs, &Job{Cmd: "echo depcond never", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("failed(dcok)"), RepGroup: "depcond"})
+			inserts, already, err := jq.Add(jobs, envVars, true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 6)
+			So(already, ShouldEqual, 0)
+
+			state := func(cmd string) JobState {
+				job, errg := jq.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+				So(errg, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				return job.State
+			}
+
+			Convey("They start according to their conditions", func() {
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "echo depcond fail && false")
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldNotBeNil)
+				So(state("echo depcond fail && false"), ShouldEqual, JobStateBuried)
+
+				So(state("echo depcond onfail"), ShouldEqual, JobStateReady)
+				So(state("echo depcond onend"), ShouldEqual, JobStateDependent)
+				So(state("echo depcond anyof"), ShouldEqual, JobStateDependent)
+
+				job, err = jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "echo depcond ok")
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+
+				So(state("echo depcond onend"), ShouldEqual, JobStateReady)
+				So(state("echo depcond anyof"), ShouldEqual, JobStateReady)
+				So(state("echo depcond never"), ShouldEqual, JobStateDependent)
+			})
+
+			Convey("Their dependencies can be described as expressions", func() {
+				job, err := jq.GetByEssence(&JobEssence{Cmd: "echo depcond onend"}, false, false)
+				So(err, ShouldBeNil)
+				So(job.Dependencies.Stringify(), ShouldResemble, []string{"ended(dcfail)", "dcok"})
+				So(parse("failed(a)|b|done(c)").Stringify(), ShouldResemble, []string{"failed(a)|b|c"})
+				So(parse("failed(a)|b", "d").DepGroups(), ShouldResemble, []string{"a", "b", "d"})
+
+				_, err = ParseDependency("started(a)")
+				So(err, ShouldNotBeNil)
+				_, err = ParseDependency("a|")
+				So(err, ShouldNotBeNil)
+				_, err = ParseDependency("done(a")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("After connecting and adding a job with a ResultCache", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer disconnect(jq)
+
+			tmpdir, err := os.MkdirTemp("", "wr_jobqueue_test_cache_")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(tmpdir)
+			cacheDir := filepath.Join(tmpdir, "cache")
+			input := filepath.Join(tmpdir, "ref.fa")
+			err = os.WriteFile(input, []byte(">chr1\nACGT\n"), 0600)
+			So(err, ShouldBeNil)
+			output := filepath.Join(tmpdir, "ref.idx")
+
+			cmd := fmt.Sprintf("cat %s > %s && date +%%N >> %s", input, output, output)
+			addAndRun := func(rc *ResultCache) *Job {
+				jobs := []*Job{{Cmd: cmd, Cwd: tmpdir, ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cache", ResultCache: rc}}
+				inserts, _, erra := jq.Add(jobs, envVars, false)
+				So(erra, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+
+				job, errr := jq.Reserve(50 * time.Millisecond)
+				So(errr, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, cmd)
+				errr = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(errr, ShouldBeNil)
+				So(job.State, ShouldEqual, JobStateComplete)
+				return job
+			}
+			readOutput := func() string {
+				b, errr := os.ReadFile(output)
+				So(errr, ShouldBeNil)
+				return string(b)
+			}
+
+			rc := &ResultCache{Dir: cacheDir, Inputs: []string{input}, Outputs: []string{output}}
+			job := addAndRun(rc)
+			So(job.Cached, ShouldBeFalse)
+			So(job.Pid, ShouldBeGreaterThan, 0)
+			first := readOutput()
+			So(first, ShouldStartWith, ">chr1\nACGT\n")
+			records, err := filepath.Glob(filepath.Join(cacheDir, "*", "*", resultCacheRecordFile))
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 1)
+
+			Convey("Running it again restores its outputs instead of running the cmd", func() {
+				err = os.Remove(output)
+				So(err, ShouldBeNil)
+
+				job = addAndRun(rc)
+				So(job.Cached, ShouldBeTrue)
+				So(readOutput(), ShouldEqual, first)
+
+				got, err := jq.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+				So(err, ShouldBeNil)
+				So(got.Cached, ShouldBeTrue)
+				status, err := got.ToStatus()
+				So(err, ShouldBeNil)
+				So(status.Cached, ShouldBeTrue)
+				So(status.ResultCache, ShouldEqual, cacheDir+" (inputs: "+input+"; outputs: "+output+")")
+
+				Convey("Or by linking to them", func() {
+					rc.Link = true
+					job = addAndRun(rc)
+					So(job.Cached, ShouldBeTrue)
+					info, err := os.Lstat(output)
+					So(err, ShouldBeNil)
+					So(info.Mode()&os.ModeSymlink, ShouldNotEqual, 0)
+					So(readOutput(), ShouldEqual, first)
+				})
+			})
+
+			Convey("Changing its inputs makes it run again", func() {
+				err = os.WriteFile(input, []byte(">chr1\nACGTT\n"), 0600)
+				So(err, ShouldBeNil)
+
+				job = addAndRun(rc)
+				So(job.Cached, ShouldBeFalse)
+				So(readOutput(), ShouldStartWith, ">chr1\nACGTT\n")
+				records, err = filepath.Glob(filepath.Join(cacheDir, "*", "*", resultCacheRecordFile))
+				So(err, ShouldBeNil)
+				So(len(records), ShouldEqual, 2)
+			})
+
+			Convey("Missing inputs mean it runs without being memoized", func() {
+				rc.Inputs = append(rc.Inputs, filepath.Join(tmpdir, "missing"))
+				job = addAndRun(rc)
+				So(job.Cached, ShouldBeFalse)
+				So(readOutput(), ShouldNotEqual, first)
+				records, err = filepath.Glob(filepath.Join(cacheDir, "*", "*", resultCacheRecordFile))
+				So(err, ShouldBeNil)
+				So(len(records), ShouldEqual, 1)
+			})
+		})
+
 		Convey("After connecting and adding some jobs under some RepGroups", func() {
 			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
 			So(err, ShouldBeNil)
@@ -2579,9 +3258,6 @@ func TestJobqueueMedium(t *testing.T) {
 
 					err = jq.Release(j4, nil, "")
 					So(err, ShouldBeNil)
-
-					// *** we should implement rejection of dependency cycles
-					// and test for that
 				})
 			})
 		})
@@ -2935,41 +3611,327 @@ func TestJobqueueMedium(t *testing.T) {
 						So(err, ShouldBeNil)
 					}
 
-					jobs = nil
-					d5 := NewDepGroupDependency("dep5")
-					jobs = append(jobs, &Job{Cmd: "echo deptest4", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep4", Dependencies: Dependencies{d5}})
-					jobs = append(jobs, &Job{Cmd: "echo deptest5", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep5", DepGroups: []string{"dep5"}})
+					jobs = nil
+					d5 := NewDepGroupDependency("dep5")
+					jobs = append(jobs, &Job{Cmd: "echo deptest4", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep4", Dependencies: Dependencies{d5}})
+					jobs = append(jobs, &Job{Cmd: "echo deptest5", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep5", DepGroups: []string{"dep5"}})
+
+					inserts, already, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+					So(already, ShouldEqual, 0)
+
+					j5, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(j5.RepGroup, ShouldEqual, "dep5")
+					jNil, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(jNil, ShouldBeNil)
+
+					err = jq.Execute(ctx, j5, config.RunnerExecShell)
+					So(err, ShouldBeNil)
+
+					j4, err := jq.Reserve(50 * time.Millisecond)
+					So(err, ShouldBeNil)
+					So(j4.RepGroup, ShouldEqual, "dep4")
+
+					err = jq.Release(j4, nil, "")
+					So(err, ShouldBeNil)
+				})
+
+				Convey("You can't add or modify jobs such that their dependencies form a cycle", func() {
+					isCycleErr := func(err error) {
+						So(err, ShouldNotBeNil)
+						jqerr, ok := err.(Error)
+						So(ok, ShouldBeTrue)
+						So(jqerr.Err, ShouldEqual, ErrDependencyCycle)
+					}
+
+					_, _, err := jq.Add([]*Job{{Cmd: "echo cycself", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cyc", DepGroups: []string{"cycself"}, Dependencies: Dependencies{NewDepGroupDependency("cycself")}}}, envVars, true)
+					isCycleErr(err)
+
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo cyc1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cyc", DepGroups: []string{"cyc1"}, Dependencies: Dependencies{NewDepGroupDependency("cyc3")}})
+					jobs = append(jobs, &Job{Cmd: "echo cyc2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cyc", DepGroups: []string{"cyc2"}, Dependencies: Dependencies{NewDepGroupDependency("cyc1")}})
+					inserts, _, err := jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 2)
+
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo cyc3", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, RepGroup: "cyc", DepGroups: []string{"cyc3"}, Dependencies: Dependencies{NewEssenceDependency("echo cyc2", "")}})
+					_, _, err = jq.Add(jobs, envVars, true)
+					isCycleErr(err)
+					So(err.Error(), ShouldContainSubstring, "echo cyc3 -> echo cyc2 -> echo cyc1 -> echo cyc3")
+
+					jobs[0].Dependencies = Dependencies{NewEssenceDependency("echo deptest4", "")}
+					inserts, _, err = jq.Add(jobs, envVars, true)
+					So(err, ShouldBeNil)
+					So(inserts, ShouldEqual, 1)
+
+					job, err := jq.GetByEssence(&JobEssence{Cmd: "echo cyc3"}, false, false)
+					So(err, ShouldBeNil)
+					modifier := NewJobModifer()
+					modifier.SetDependencies(Dependencies{NewDepGroupDependency("cyc2")})
+					_, err = jq.Modify([]*JobEssence{job.ToEssense()}, modifier)
+					isCycleErr(err)
+
+					job, err = jq.GetByEssence(&JobEssence{Cmd: "echo cyc3"}, false, false)
+					So(err, ShouldBeNil)
+					So(job.Dependencies.Stringify(), ShouldResemble, []string{"echo deptest4"})
+
+					Convey("And you can get the graph of their dependencies", func() {
+						g, err := jq.GetDependencyGraph("cyc", false)
+						So(err, ShouldBeNil)
+						So(len(g.Nodes), ShouldEqual, 4)
+						states := make(map[string]JobState)
+						for _, node := range g.Nodes {
+							states[node.Cmd] = node.State
+							if node.Cmd == "echo deptest4" {
+								// it was never added
+								So(node.Missing, ShouldBeTrue)
+							}
+						}
+						So(states, ShouldResemble, map[string]JobState{
+							"echo cyc1":     JobStateDependent,
+							"echo cyc2":     JobStateDependent,
+							"echo cyc3":     JobStateReady,
+							"echo deptest4": "",
+						})
+						So(len(g.Edges), ShouldEqual, 3)
+
+						dot, err := g.Render(DependencyGraphFormatDOT)
+						So(err, ShouldBeNil)
+						So(dot, ShouldStartWith, "digraph wr {")
+						So(dot, ShouldContainSubstring, `[label="echo cyc1\ndependent"`)
+						mermaid, err := g.Render(DependencyGraphFormatMermaid)
+						So(err, ShouldBeNil)
+						So(mermaid, ShouldStartWith, "flowchart TD\n")
+						So(mermaid, ShouldContainSubstring, "echo cyc1<br/>dependent")
+						js, err := g.Render(DependencyGraphFormatJSON)
+						So(err, ShouldBeNil)
+						So(js, ShouldContainSubstring, `"state":"dependent"`)
+						_, err = g.Render("png")
+						So(err, ShouldNotBeNil)
+					})
+				})
+
+				Convey("You can find out what adding jobs would do without adding them", func() {
+					dryReqs := &jqs.Requirements{RAM: 20, Time: 20 * time.Second, Cores: 1, Disk: 0, Other: make(map[string]string)}
+					jobs = nil
+					jobs = append(jobs, &Job{Cmd: "echo deptest1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep1"})
+					jobs = append(jobs, &Job{Cmd: "echo deptest2", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "dep2"})
+					jobs = append(jobs, &Job{Cmd: "echo dry1", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Override: uint8(2), Retries: uint8(3), RepGroup: "dry", Dependencies: Dependencies{NewDepGroupDependency("dep1+2+3"), NewDepGroupDependency("dry_typo")}})
+					jobs = append(jobs, &Job{Cmd: "echo dry2", Cwd: "/tmp", ReqGroup: "dry_group", Requirements: dryReqs, Retries: uint8(3), RepGroup: "dry", Dependencies: Dependencies{NewEssenceDependency("echo nothere", "/tmp"), {AnyOf: Dependencies{NewDepGroupDependency("dry_typo2"), NewDepGroupDependency("dep2")}}}})
+					jobs = append(jobs, &Job{Cmd: "echo dry3", Cwd: "/tmp", ReqGroup: "dry_group", Requirements: dryReqs, Retries: uint8(3), RepGroup: "dry", DepGroups: []string{"dry3"}})
+					jobs = append(jobs, &Job{Cmd: "echo dry3", Cwd: "/tmp", ReqGroup: "dry_group", Requirements: dryReqs, Retries: uint8(3), RepGroup: "dry", DepGroups: []string{"dry3"}})
+					jobs = append(jobs, &Job{Cmd: "echo dry4", Cwd: "/tmp", ReqGroup: "dry_group", Requirements: dryReqs, Retries: uint8(3), RepGroup: "dry", Dependencies: Dependencies{NewDepGroupDependency("dry3")}})
+
+					dr, err := jq.AddDryRun(jobs, true)
+					So(err, ShouldBeNil)
+					So(dr.Added, ShouldEqual, 4)
+					So(dr.Existing, ShouldResemble, []string{"echo deptest2", "echo dry3"})
+					So(dr.Complete, ShouldResemble, []string{"echo deptest1"})
+					So(len(dr.Unsatisfiable), ShouldEqual, 2)
+					So(dr.Unsatisfiable[0].Cmd, ShouldEqual, "echo dry1")
+					So(dr.Unsatisfiable[0].Dependency, ShouldEqual, "dry_typo")
+					So(dr.Unsatisfiable[0].Reason, ShouldEqual, "no jobs are in dep group dry_typo")
+					So(dr.Unsatisfiable[1].Cmd, ShouldEqual, "echo dry2")
+					So(dr.Unsatisfiable[1].Reason, ShouldEqual, "no job has cmd echo nothere")
+
+					So(len(dr.ReqGroups), ShouldEqual, 2)
+					So(dr.ReqGroups[0].ReqGroup, ShouldEqual, "dry_group")
+					So(dr.ReqGroups[0].Jobs, ShouldEqual, 3)
+					So(dr.ReqGroups[0].Requested.RAM, ShouldEqual, 20)
+					So(dr.ReqGroups[0].Recommended, ShouldBeNil)
+					So(dr.ReqGroups[0].Effective.RAM, ShouldEqual, 20)
+					So(dr.ReqGroups[0].Effective.Time, ShouldEqual, 20*time.Second)
+					So(dr.ReqGroups[1].ReqGroup, ShouldEqual, "fake_group")
+					So(dr.ReqGroups[1].Jobs, ShouldEqual, 1)
+					So(dr.ReqGroups[1].Effective.RAM, ShouldEqual, 10)
+
+					dr, err = jq.AddDryRun(jobs, false)
+					So(err, ShouldBeNil)
+					So(dr.Added, ShouldEqual, 5)
+					So(dr.Complete, ShouldResemble, []string{"echo deptest1"})
+
+					gottenJobs, err := jq.GetByRepGroup("dry", false, 0, "", false, false)
+					So(err, ShouldBeNil)
+					So(len(gottenJobs), ShouldEqual, 0)
+
+					jobs = []*Job{{Cmd: "echo drycyc", Cwd: "/tmp", ReqGroup: "dry_group", Requirements: dryReqs, Retries: uint8(3), RepGroup: "dry", DepGroups: []string{"drycyc"}, Dependencies: Dependencies{NewDepGroupDependency("drycyc")}}}
+					_, err = jq.AddDryRun(jobs, true)
+					So(err, ShouldNotBeNil)
+					jqerr, ok := err.(Error)
+					So(ok, ShouldBeTrue)
+					So(jqerr.Err, ShouldEqual, ErrDependencyCycle)
+				})
+			})
+		})
+
+		Reset(func() {
+			server.Stop(true)
+		})
+	})
+
+	Convey("Once a new jobqueue server configured with remote managers is up", t, func() {
+		origInterval := ServerRemoteCheckInterval
+		origTimeout := remoteConnectTimeout
+		ServerRemoteCheckInterval = 50 * time.Millisecond
+		remoteConnectTimeout = 100 * time.Millisecond
+		defer func() {
+			ServerRemoteCheckInterval = origInterval
+			remoteConnectTimeout = origTimeout
+		}()
+
+		// the server can act as a remote manager for itself
+		rmConfig := serverConfig
+		rmConfig.RemoteManagers = []*RemoteManager{
+			{Name: "self", Addr: addr, CAFile: config.ManagerCAFile, CertDomain: config.ManagerCertDomain, TokenFile: config.ManagerTokenFile},
+			{Name: "gone", Addr: "localhost:1", CAFile: config.ManagerCAFile, CertDomain: config.ManagerCertDomain, TokenFile: config.ManagerTokenFile},
+		}
+		server, _, token, errs := serve(rmConfig)
+		So(errs, ShouldBeNil)
+		defer func() {
+			server.Stop(true)
+		}()
+
+		jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+		So(err, ShouldBeNil)
+		defer disconnect(jq)
+
+		parse := func(expr string) Dependencies {
+			dep, errp := ParseDependency(expr)
+			So(errp, ShouldBeNil)
+			return Dependencies{dep}
+		}
+
+		var jobs []*Job
+		jobs = append(jobs, &Job{Cmd: "echo remote parent", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, DepGroups: []string{"rmgrp"}, RepGroup: "remote"})
+		jobs = append(jobs, &Job{Cmd: "echo remote child", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("self::rmgrp"), RepGroup: "remote"})
+		jobs = append(jobs, &Job{Cmd: "echo remote onfail", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("failed(self::rmgrp)"), RepGroup: "remote"})
+		jobs = append(jobs, &Job{Cmd: "echo remote unreachable", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("gone::rmgrp"), RepGroup: "remote"})
+		inserts, _, err := jq.Add(jobs, envVars, true)
+		So(err, ShouldBeNil)
+		So(inserts, ShouldEqual, 4)
+
+		getJob := func(cmd string) *Job {
+			job, errg := jq.GetByEssence(&JobEssence{Cmd: cmd}, false, false)
+			So(errg, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			return job
+		}
+
+		waitForState := func(cmd string, state JobState) JobState {
+			limit := time.After(5 * time.Second)
+			ticker := time.NewTicker(25 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if got := getJob(cmd).State; got == state {
+						return got
+					}
+				case <-limit:
+					return getJob(cmd).State
+				}
+			}
+		}
+
+		Convey("Jobs depending on a remote manager's jobs start once they complete", func() {
+			So(getJob("echo remote child").State, ShouldEqual, JobStateDependent)
 
-					inserts, already, err := jq.Add(jobs, envVars, true)
-					So(err, ShouldBeNil)
-					So(inserts, ShouldEqual, 2)
-					So(already, ShouldEqual, 0)
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo remote parent")
+			err = jq.Execute(ctx, job, config.RunnerExecShell)
+			So(err, ShouldBeNil)
 
-					j5, err := jq.Reserve(50 * time.Millisecond)
-					So(err, ShouldBeNil)
-					So(j5.RepGroup, ShouldEqual, "dep5")
-					jNil, err := jq.Reserve(50 * time.Millisecond)
-					So(err, ShouldBeNil)
-					So(jNil, ShouldBeNil)
+			So(waitForState("echo remote child", JobStateReady), ShouldEqual, JobStateReady)
+			So(getJob("echo remote onfail").State, ShouldEqual, JobStateDependent)
 
-					err = jq.Execute(ctx, j5, config.RunnerExecShell)
-					So(err, ShouldBeNil)
+			satisfied, err := jq.DependenciesSatisfied(Dependencies{
+				NewDepGroupDependency("rmgrp"),
+				{DepGroup: "rmgrp", On: DependencyOnFailure},
+				{Essence: &JobEssence{JobKey: job.Key()}, On: DependencyOnEnd},
+				NewDepGroupDependency("nonexistent"),
+			})
+			So(err, ShouldBeNil)
+			So(satisfied, ShouldResemble, []bool{true, false, true, false})
 
-					j4, err := jq.Reserve(50 * time.Millisecond)
-					So(err, ShouldBeNil)
-					So(j4.RepGroup, ShouldEqual, "dep4")
+			Convey("And you can depend on a remote job by its key", func() {
+				inserts, _, err := jq.Add([]*Job{{Cmd: "echo remote bykey", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("ended(self::key:" + job.Key() + ")"), RepGroup: "remote"}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				So(waitForState("echo remote bykey", JobStateReady), ShouldEqual, JobStateReady)
+			})
+		})
 
-					err = jq.Release(j4, nil, "")
-					So(err, ShouldBeNil)
+		Convey("Unreachable remote managers are reported", func() {
+			So(waitForState("echo remote unreachable", JobStateDependent), ShouldEqual, JobStateDependent)
 
-					// *** we should implement rejection of dependency cycles
-					// and test for that
-				})
-			})
+			var statuses []*RemoteManagerStatus
+			limit := time.After(5 * time.Second)
+		WAIT:
+			for {
+				statuses, err = jq.GetRemoteManagers()
+				So(err, ShouldBeNil)
+				So(len(statuses), ShouldEqual, 2)
+				if statuses[0].Err != "" {
+					break
+				}
+				select {
+				case <-time.After(25 * time.Millisecond):
+				case <-limit:
+					break WAIT
+				}
+			}
+			So(statuses[0].Manager.Name, ShouldEqual, "gone")
+			So(statuses[0].Err, ShouldNotBeEmpty)
+			So(statuses[0].Dependencies, ShouldEqual, 1)
+			So(statuses[1].Manager.Name, ShouldEqual, "self")
+
+			job := getJob("echo remote unreachable")
+			So(job.State, ShouldEqual, JobStateDependent)
+			So(len(job.RemoteDepProblems), ShouldEqual, 1)
+			So(job.RemoteDepProblems[0], ShouldContainSubstring, "remote manager gone unreachable")
+			So(getJob("echo remote child").RemoteDepProblems, ShouldBeEmpty)
 		})
 
-		Reset(func() {
-			server.Stop(true)
+		Convey("Jobs can't depend on unknown remote managers", func() {
+			_, _, err := jq.Add([]*Job{{Cmd: "echo remote unknown", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Dependencies: parse("nope::rmgrp"), RepGroup: "remote"}}, envVars, true)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrUnknownManager)
+		})
+
+		Convey("Remote dependencies can be described as expressions", func() {
+			So(parse("failed(self::rmgrp)|prod::key:abc").Stringify(), ShouldResemble, []string{"failed(self::rmgrp)|prod::key:abc"})
+			So(parse("self::rmgrp|local").DepGroups(), ShouldResemble, []string{"local"})
+
+			_, err := ParseDependency("::rmgrp")
+			So(err, ShouldNotBeNil)
+			_, err = ParseDependency("self::key:")
+			So(err, ShouldNotBeNil)
+
+			rms, err := ParseRemoteManagers("prod:production, teamb:farm5:46123:/shared/wr:farm5.internal,x:h:1:/d")
+			So(err, ShouldBeNil)
+			So(len(rms), ShouldEqual, 3)
+			So(rms[0].Deployment, ShouldEqual, "production")
+			So(rms[1].Addr, ShouldEqual, "farm5:46123")
+			So(rms[1].CAFile, ShouldEqual, "/shared/wr/ca.pem")
+			So(rms[1].TokenFile, ShouldEqual, "/shared/wr/client.token")
+			So(rms[1].CertDomain, ShouldEqual, "farm5.internal")
+			So(rms[2].CertDomain, ShouldEqual, "localhost")
+
+			for _, bad := range []string{"prod", "prod:a:b", "prod:production,prod:development", "x:h::/d", ":production"} {
+				_, err = ParseRemoteManagers(bad)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadRemoteManager)
+			}
 		})
 	})
 }
@@ -2982,6 +3944,12 @@ func TestJobqueueLimitGroups(t *testing.T) {
 	}
 	config, serverConfig, addr, standardReqs, clientConnectTime := jobqueueTestInit(true)
 
+	protectors, err := ParseProtectors("irods:2:0s:500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.Protectors = protectors
+
 	defer os.RemoveAll(filepath.Join(os.TempDir(), AppName+"_cwd"))
 
 	Convey("Once a new jobqueue server is up", t, func() {
@@ -3105,6 +4073,188 @@ func TestJobqueueLimitGroups(t *testing.T) {
 				So(l, ShouldEqual, 4)
 			})
 
+			Convey("You can rate limit a group using GetOrSetLimitGroup()", func() {
+				l, err := jq.GetOrSetLimitGroup("a:3:1/500ms")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 3)
+
+				rates, err := jq.GetLimitGroupRates()
+				So(err, ShouldBeNil)
+				So(rates, ShouldResemble, map[string]string{"a": "1/500ms"})
+
+				jobs := reserveJobs()
+				So(len(jobs), ShouldEqual, 1)
+
+				<-time.After(600 * time.Millisecond)
+				jobs = reserveJobs()
+				So(len(jobs), ShouldEqual, 1)
+
+				l, err = jq.GetOrSetLimitGroup("a:3")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 3)
+
+				rates, err = jq.GetLimitGroupRates()
+				So(err, ShouldBeNil)
+				So(rates, ShouldBeEmpty)
+			})
+
+			Convey("You can have the limit of a group set by a probe", func() {
+				_, err := jq.SetLimitGroupProbe(&LimitGroupProbe{Group: "b:1", Probe: "echo 1"})
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadProbe)
+
+				waitForProbe := func(group string) *LimitGroupProbeStatus {
+					for i := 0; i < 100; i++ {
+						probes, errg := jq.GetLimitGroupProbes(group)
+						So(errg, ShouldBeNil)
+						if len(probes) == 1 && (!probes[0].Probed.IsZero() || probes[0].Err != "") {
+							return probes[0]
+						}
+						<-time.After(50 * time.Millisecond)
+					}
+					return nil
+				}
+
+				status, err := jq.SetLimitGroupProbe(&LimitGroupProbe{Group: "b", Probe: "echo 1"})
+				So(err, ShouldBeNil)
+				So(status.Probe.TTL, ShouldEqual, LimitGroupProbeTTL)
+				status = waitForProbe("b")
+				So(status, ShouldNotBeNil)
+				So(status.Limit, ShouldEqual, 1)
+				So(status.Err, ShouldBeBlank)
+
+				l, err := jq.GetOrSetLimitGroup("b")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 1)
+
+				jobs := reserveJobs()
+				So(len(jobs), ShouldEqual, 1)
+
+				probed := 3
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, "%d\n", probed)
+				}))
+				defer ts.Close()
+
+				status, err = jq.SetLimitGroupProbe(&LimitGroupProbe{Group: "b", Probe: ts.URL, TTL: 1 * time.Second})
+				So(err, ShouldBeNil)
+				status = waitForProbe("b")
+				So(status, ShouldNotBeNil)
+				So(status.Limit, ShouldEqual, 3)
+
+				jobs = reserveJobs()
+				So(len(jobs), ShouldEqual, 2)
+
+				l, err = jq.GetOrSetLimitGroup("b:5")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 5)
+				for i := 0; i < 60; i++ {
+					l, err = jq.GetOrSetLimitGroup("b")
+					So(err, ShouldBeNil)
+					if l != 5 {
+						break
+					}
+					<-time.After(50 * time.Millisecond)
+				}
+				So(l, ShouldEqual, 3)
+
+				probes, err := jq.GetLimitGroupProbes("")
+				So(err, ShouldBeNil)
+				So(len(probes), ShouldEqual, 1)
+				So(probes[0].Probe.Probe, ShouldEqual, ts.URL)
+
+				status, err = jq.SetLimitGroupProbe(&LimitGroupProbe{Group: "b", Probe: "echo foo"})
+				So(err, ShouldBeNil)
+				So(status.Probed.IsZero(), ShouldBeTrue)
+				status = waitForProbe("b")
+				So(status, ShouldNotBeNil)
+				So(status.Limit, ShouldEqual, -1)
+				So(status.Err, ShouldNotBeBlank)
+
+				l, err = jq.GetOrSetLimitGroup("b")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 3)
+
+				removed, err := jq.RemoveLimitGroupProbe("b")
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 1)
+				probes, err = jq.GetLimitGroupProbes("b")
+				So(err, ShouldBeNil)
+				So(probes, ShouldBeEmpty)
+
+				started := make(chan bool, 1)
+				cancelled := make(chan bool, 1)
+				slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					started <- true
+					select {
+					case <-r.Context().Done():
+						cancelled <- true
+					case <-time.After(10 * time.Second):
+						fmt.Fprintf(w, "%d\n", 7)
+					}
+				}))
+				defer slow.Close()
+
+				_, err = jq.SetLimitGroupProbe(&LimitGroupProbe{Group: "b", Probe: slow.URL, TTL: 20 * time.Second})
+				So(err, ShouldBeNil)
+				<-started
+				removed, err = jq.RemoveLimitGroupProbe("b")
+				So(err, ShouldBeNil)
+				So(removed, ShouldEqual, 1)
+
+				var wasCancelled bool
+				select {
+				case wasCancelled = <-cancelled:
+				case <-time.After(5 * time.Second):
+				}
+				So(wasCancelled, ShouldBeTrue)
+				l, err = jq.GetOrSetLimitGroup("b")
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 3)
+			})
+
+			Convey("Jobs can use more than 1 unit of a limit group", func() {
+				jobs := reserveJobs()
+				So(len(jobs), ShouldEqual, 2)
+
+				usage, err := jq.GetLimitGroupUsage()
+				So(err, ShouldBeNil)
+				So(usage, ShouldResemble, map[string]int{"a": 2, "b": 2})
+
+				var heavyJobs []*Job
+				for i := 1; i <= 3; i++ {
+					heavyJobs = append(heavyJobs, &Job{Cmd: fmt.Sprintf("echo heavy %d", i), Cwd: "/tmp", ReqGroup: "rgroup", Requirements: standardReqs, Override: uint8(2), Retries: uint8(0), RepGroup: "heavy", LimitGroups: []string{"c", "a*2:6", "c*3:9"}})
+				}
+				inserts, _, err := jq.Add(heavyJobs, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 3)
+
+				got, err := jq.GetByRepGroup("heavy", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(got), ShouldEqual, 3)
+				So(got[0].LimitGroups, ShouldResemble, []string{"a*2", "c*3"})
+
+				var reserved int
+				for i := 1; i <= 3; i++ {
+					job, errr := jq.ReserveScheduled(25*time.Millisecond, "110:30:1:0~a*2,c*3")
+					So(errr, ShouldBeNil)
+					if job != nil {
+						reserved++
+					}
+				}
+				So(reserved, ShouldEqual, 2)
+
+				usage, err = jq.GetLimitGroupUsage()
+				So(err, ShouldBeNil)
+				So(usage["a"], ShouldEqual, 6)
+				So(usage["c"], ShouldEqual, 6)
+
+				_, _, err = jq.Add([]*Job{{Cmd: "echo bad weight", Cwd: "/tmp", ReqGroup: "rgroup", Requirements: standardReqs, RepGroup: "heavy", LimitGroups: []string{"a*0"}}}, envVars, true)
+				So(err, ShouldNotBeNil)
+			})
+
 			Convey("You can't add Jobs with bad LimitGroup names", func() {
 				var jobs []*Job
 				jobs = append(jobs, &Job{Cmd: "echo bad", Cwd: "/tmp", ReqGroup: "rgroup", Requirements: standardReqs, Override: uint8(2), Retries: uint8(0), RepGroup: "ab", LimitGroups: []string{"b:2", "a:d3"}})
@@ -3137,6 +4287,111 @@ func TestJobqueueLimitGroups(t *testing.T) {
 			})
 		})
 
+		Convey("You can acquire and release tokens of protected resources", func() {
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer func() {
+				errd := jq.Disconnect()
+				if errd != nil {
+					fmt.Printf("Disconnect failed: %s\n", errd)
+				}
+			}()
+
+			ps, err := ParseProtectors("a:1, b:2:1s")
+			So(err, ShouldBeNil)
+			So(ps, ShouldResemble, []*Protector{
+				{Name: "a", MaxSimultaneous: 1, ReleaseTimeout: ProtectorReleaseTimeout},
+				{Name: "b", MaxSimultaneous: 2, DelayBetween: 1 * time.Second, ReleaseTimeout: ProtectorReleaseTimeout},
+			})
+			for _, bad := range []string{"a", "a:0", "a:1:x", "a:1:1s:0s", "a:1,a:2"} {
+				_, err = ParseProtectors(bad)
+				So(err, ShouldNotBeNil)
+				jqerr, ok := err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrBadProtector)
+			}
+
+			_, err = jq.AcquireTokens("foo", 1, 0)
+			So(err, ShouldNotBeNil)
+			jqerr, ok := err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrUnknownProtector)
+
+			_, err = jq.AcquireTokens("irods", 3, 0)
+			So(err, ShouldNotBeNil)
+
+			r1, err := jq.AcquireTokens("irods", 1, 0)
+			So(err, ShouldBeNil)
+			So(r1, ShouldStartWith, "irods:")
+			r2, err := jq.AcquireTokens("irods", 1, 0)
+			So(err, ShouldBeNil)
+			So(r2, ShouldNotEqual, r1)
+
+			start := time.Now()
+			_, err = jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+			So(err, ShouldNotBeNil)
+			jqerr, ok = err.(Error)
+			So(ok, ShouldBeTrue)
+			So(jqerr.Err, ShouldEqual, ErrTokensNotGranted)
+			So(time.Since(start), ShouldBeLessThan, 400*time.Millisecond)
+
+			err = jq.ReleaseTokens(r1)
+			So(err, ShouldBeNil)
+			r3, err := jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+			So(err, ShouldBeNil)
+
+			Convey("Untouched tokens are released automatically", func() {
+				<-time.After(300 * time.Millisecond)
+				So(jq.TouchTokens(r2), ShouldBeNil)
+				<-time.After(300 * time.Millisecond)
+				So(jq.TouchTokens(r2), ShouldBeNil)
+
+				err = jq.TouchTokens(r3)
+				So(err, ShouldNotBeNil)
+				jqerr, ok = err.(Error)
+				So(ok, ShouldBeTrue)
+				So(jqerr.Err, ShouldEqual, ErrTokensNotGranted)
+
+				_, err = jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Waiting requests are granted when tokens are released", func() {
+				go func() {
+					<-time.After(100 * time.Millisecond)
+					errr := server.ReleaseTokens(r2)
+					if errr != nil {
+						fmt.Printf("ReleaseTokens failed: %s\n", errr)
+					}
+				}()
+				_, err = jq.AcquireTokens("irods", 1, 0)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Tokens acquired by a job are released when it is released", func() {
+				inserts, _, err := jq.Add([]*Job{{Cmd: "echo tokens", Cwd: "/tmp", ReqGroup: "fake_group", Requirements: standardReqs, Retries: uint8(3), RepGroup: "tokens"}}, envVars, true)
+				So(err, ShouldBeNil)
+				So(inserts, ShouldEqual, 1)
+				job, err := jq.ReserveScheduled(50*time.Millisecond, "110:30:1:0")
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+
+				So(jq.ReleaseTokens(r2), ShouldBeNil)
+				So(jq.TouchTokens(r3), ShouldBeNil)
+				os.Setenv(JobKeyEnvVar, job.Key())
+				_, err = jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+				os.Unsetenv(JobKeyEnvVar)
+				So(err, ShouldBeNil)
+
+				_, err = jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+				So(err, ShouldNotBeNil)
+
+				So(jq.Release(job, nil, "test"), ShouldBeNil)
+				_, err = jq.AcquireTokens("irods", 1, 100*time.Millisecond)
+				So(err, ShouldBeNil)
+			})
+		})
+
 		Reset(func() {
 			server.Stop(true)
 		})
@@ -4012,6 +5267,81 @@ func TestJobqueueProduction(t *testing.T) {
 				So(job.Exited, ShouldBeTrue)
 				So(job.Exitcode, ShouldEqual, 0)
 			})
+
+			Convey("A standby can replicate the database, and take over when the server stops", func() {
+				origWait := ReplicationWaitTime
+				ReplicationWaitTime = 500 * time.Millisecond
+				origChunkSize := replicationChunkSize
+				replicationChunkSize = 4096
+				defer func() {
+					ReplicationWaitTime = origWait
+					replicationChunkSize = origChunkSize
+				}()
+
+				replicaFile := config.ManagerDbFile + ".standby"
+				defer os.Remove(replicaFile)
+				standbyDone := make(chan error, 1)
+				go func() {
+					standbyDone <- Standby(StandbyConfig{
+						PrimaryAddr: addr,
+						CAFile:      config.ManagerCAFile,
+						CertDomain:  config.ManagerCertDomain,
+						Token:       token,
+						DBFile:      replicaFile,
+						DBBackend:   serverConfig.DBBackend,
+						Timeout:     2 * time.Second,
+					})
+				}()
+				<-time.After(1 * time.Second)
+
+				job, err := jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job.Cmd, ShouldEqual, "echo 1")
+				err = jq.Execute(ctx, job, config.RunnerExecShell)
+				So(err, ShouldBeNil)
+				So(job.State, ShouldEqual, JobStateComplete)
+				<-time.After(1 * time.Second)
+
+				server.db.replication.mu.Lock()
+				So(server.db.replication.recording, ShouldBeTrue)
+				So(len(server.db.replication.log), ShouldBeGreaterThan, 0)
+				for i := 1; i < len(server.db.replication.log); i++ {
+					So(server.db.replication.log[i].Seq, ShouldEqual, server.db.replication.log[i-1].Seq+1)
+				}
+				server.db.replication.mu.Unlock()
+
+				server.db.replication.snapshotMu.Lock()
+				So(server.db.replication.snapshots, ShouldBeEmpty)
+				server.db.replication.snapshotMu.Unlock()
+
+				So(len(standbyDone), ShouldEqual, 0)
+
+				server.Stop(true)
+				select {
+				case err = <-standbyDone:
+					So(err, ShouldBeNil)
+				case <-time.After(10 * time.Second):
+					So(false, ShouldBeTrue)
+				}
+
+				standbyConfig := serverConfig
+				standbyConfig.DBFile = replicaFile
+				wipeDevDBOnInit = false
+				server, _, token, errs = serve(standbyConfig)
+				wipeDevDBOnInit = true
+				So(errs, ShouldBeNil)
+				jq, err = Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+				So(err, ShouldBeNil)
+
+				jobsByRepGroup, err := jq.GetByRepGroup("manually_added", false, 0, "", false, false)
+				So(err, ShouldBeNil)
+				So(len(jobsByRepGroup), ShouldEqual, 2)
+
+				job, err = jq.Reserve(50 * time.Millisecond)
+				So(err, ShouldBeNil)
+				So(job, ShouldNotBeNil)
+				So(job.Cmd, ShouldEqual, "echo 2")
+			})
 		})
 
 		Convey("You can connect, add a job, then immediately shutdown, and the db backup still completes", func() {
@@ -6995,11 +8325,8 @@ func TestJobqueueSpeed(t *testing.T) {
 		// }
 
 		// ... Instead we bypass the client interface and directly add to
-		// bolt db
-		err = server.db.bolt.Batch(func(tx *bolt.Tx) error {
-			bl := tx.Bucket(bucketJobsLive)
-			b := tx.Bucket(bucketJobsComplete)
-
+		// the db
+		err = server.db.storage.update(func(tx dbTx) error {
 			var puterr error
 			for _, job := range jobs {
 				key := job.key()
@@ -7007,10 +8334,10 @@ func TestJobqueueSpeed(t *testing.T) {
 				enc := codec.NewEncoderBytes(&encoded, server.db.ch)
 				enc.Encode(job)
 
-				bl.Delete([]byte(key))
+				tx.delete(bucketJobsLive, []byte(key))
 				q.Remove(key)
 
-				puterr = b.Put([]byte(key), encoded)
+				puterr = tx.put(bucketJobsComplete, []byte(key), encoded)
 				if puterr != nil {
 					break
 				}
@@ -0,0 +1,428 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for LimitGroupProbes, which periodically set the
+// limit of a limit group to the number output by a command or URL, so that the
+// number of jobs running in the group can adapt to the load on some shared
+// resource.
+//
+// Probed limits are stored in the limitgroups bucket and pushed to our limiter
+// in the same way as limits set by users, so a limit group with a probe
+// behaves like any other; its limit just changes by itself.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/limiter"
+	"github.com/inconshreveable/log15"
+	"github.com/ugorji/go/codec"
+)
+
+// LimitGroupProbeTTL is the default time a probed limit is used for before
+// the probe is run again.
+const LimitGroupProbeTTL = 1 * time.Minute
+
+// limitGroupProbeMinTTL is the shortest TTL a LimitGroupProbe can have, to
+// avoid hammering whatever is being probed.
+const limitGroupProbeMinTTL = 1 * time.Second
+
+// limitGroupProbeMaxOutput is the most bytes of a probe's output that we read.
+const limitGroupProbeMaxOutput = 1024
+
+// LimitGroupProbe describes how to find out the current limit of a limit group.
+type LimitGroupProbe struct {
+	// Group is the name of the limit group whose limit will be set.
+	Group string `json:"group"`
+
+	// Probe is either a shell command, or an http:// or https:// URL to GET.
+	// The command's output or URL's response body should be an integer, which
+	// will become the group's limit. Negative numbers make the group
+	// unlimited.
+	Probe string `json:"probe"`
+
+	// TTL is how long a probed limit is used for before Probe is run again.
+	// Defaults to LimitGroupProbeTTL. It is also the longest a probe can take
+	// to run.
+	TTL time.Duration `json:"ttl"`
+}
+
+// validate checks the probe makes sense, filling in defaults. Returns an Error
+// with Err ErrBadProbe if not.
+func (p *LimitGroupProbe) validate() error {
+	if p.TTL == 0 {
+		p.TTL = LimitGroupProbeTTL
+	}
+	if p.Group == "" || strings.ContainsAny(p.Group, ":,"+limiter.WeightSeparator) ||
+		strings.TrimSpace(p.Probe) == "" || p.TTL < limitGroupProbeMinTTL {
+		return Error{"SetLimitGroupProbe", p.Group, ErrBadProbe}
+	}
+	return nil
+}
+
+// isURL tells you if our Probe is a URL instead of a command.
+func (p *LimitGroupProbe) isURL() bool {
+	return strings.HasPrefix(p.Probe, "http://") || strings.HasPrefix(p.Probe, "https://")
+}
+
+// run runs our Probe, returning the limit it output. The probe is killed if it
+// takes longer than our TTL, or the given context is cancelled.
+func (p *LimitGroupProbe) run(ctx context.Context, logger log15.Logger) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.TTL)
+	defer cancel()
+
+	var out []byte
+	var err error
+	if p.isURL() {
+		out, err = p.get(ctx, logger)
+	} else {
+		out, err = exec.CommandContext(ctx, "/bin/bash", "-c", p.Probe).Output() // #nosec The whole point is to run the user's probe command
+		if len(out) > limitGroupProbeMaxOutput {
+			out = out[:limitGroupProbeMaxOutput]
+		}
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return -1, fmt.Errorf("probe output was not an integer: %w", err)
+	}
+	return limit, nil
+}
+
+// get does an http GET of our Probe URL, returning the response body.
+func (p *LimitGroupProbe) get(ctx context.Context, logger log15.Logger) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Probe, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.LogClose(logger, resp.Body, "limit group probe response body", "url", p.Probe)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("probe URL returned status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, limitGroupProbeMaxOutput))
+}
+
+// LimitGroupProbeStatus describes a LimitGroupProbe along with the results of
+// last running it.
+type LimitGroupProbeStatus struct {
+	Probe *LimitGroupProbe `json:"probe"`
+
+	// Limit is the limit from the last successful run of the probe, or -1 if
+	// it hasn't yet run successfully.
+	Limit int `json:"limit"`
+
+	// Probed is when the probe last ran successfully.
+	Probed time.Time `json:"probed"`
+
+	// Err is the error from the last run of the probe, if it failed.
+	Err string `json:"error,omitempty"`
+}
+
+// probeState is how the server keeps track of a LimitGroupProbe that it is
+// periodically running.
+type probeState struct {
+	probe  *LimitGroupProbe
+	limit  int
+	probed time.Time
+	err    string
+	stop   chan struct{}
+}
+
+// status returns a LimitGroupProbeStatus for this state. You must hold the
+// server's prmutex when calling this.
+func (ps *probeState) status() *LimitGroupProbeStatus {
+	p := *ps.probe
+	return &LimitGroupProbeStatus{
+		Probe:  &p,
+		Limit:  ps.limit,
+		Probed: ps.probed,
+		Err:    ps.err,
+	}
+}
+
+// storeLimitGroupProbe stores a probe in the database, replacing any existing
+// one for the same group.
+func (db *db) storeLimitGroupProbe(p *LimitGroupProbe) error {
+	var encoded []byte
+	enc := codec.NewEncoderBytes(&encoded, db.ch)
+	err := enc.Encode(p)
+	if err != nil {
+		return err
+	}
+	return db.storage.update(func(tx dbTx) error {
+		return tx.put(bucketLGProbes, []byte(p.Group), encoded)
+	})
+}
+
+// removeLimitGroupProbe removes the probe of the given group from the
+// database.
+func (db *db) removeLimitGroupProbe(group string) error {
+	return db.storage.update(func(tx dbTx) error {
+		return tx.delete(bucketLGProbes, []byte(group))
+	})
+}
+
+// retrieveLimitGroupProbes gets all the probes stored with
+// storeLimitGroupProbe().
+func (db *db) retrieveLimitGroupProbes() ([]*LimitGroupProbe, error) {
+	var probes []*LimitGroupProbe
+	err := db.storage.view(func(tx dbTx) error {
+		return tx.seek(bucketLGProbes, nil, nil, func(k, v []byte) (bool, error) {
+			dec := codec.NewDecoderBytes(v, db.ch)
+			p := &LimitGroupProbe{}
+			err := dec.Decode(p)
+			if err != nil {
+				return false, err
+			}
+			probes = append(probes, p)
+			return true, nil
+		})
+	})
+	return probes, err
+}
+
+// loadLimitGroupProbes starts running the probes stored in the database. You
+// must have created our queue before calling this.
+func (s *Server) loadLimitGroupProbes() error {
+	probes, err := s.db.retrieveLimitGroupProbes()
+	if err != nil {
+		return err
+	}
+
+	s.prmutex.Lock()
+	defer s.prmutex.Unlock()
+	s.probes = make(map[string]*probeState)
+	for _, p := range probes {
+		ps := &probeState{probe: p, limit: -1, stop: make(chan struct{})}
+		s.probes[p.Group] = ps
+		s.startLimitGroupProbe(ps)
+	}
+	return nil
+}
+
+// startLimitGroupProbe runs the given probe in the background, immediately and
+// then every TTL until its stop channel is closed.
+func (s *Server) startLimitGroupProbe(ps *probeState) {
+	wgk := s.wg.Add(1)
+	go func() {
+		defer internal.LogPanic(s.Logger, "limit group probe", false)
+		defer s.wg.Done(wgk)
+
+		s.probeLimitGroup(ps)
+		for {
+			select {
+			case <-time.After(ps.probe.TTL):
+				s.probeLimitGroup(ps)
+			case <-ps.stop:
+				return
+			}
+		}
+	}()
+}
+
+// probeLimitGroup runs the given probe once, and if it worked, stores the
+// limit for its group if the group currently has a different limit. Any
+// existing rate limit of the group is kept. Failures are logged, and leave the
+// group's limit as it was. The probe's status is only updated once any new
+// limit has been stored. The probe is killed if the probe's stop channel is
+// closed while it runs, and the results of a probe that has been stopped or
+// replaced are ignored.
+func (s *Server) probeLimitGroup(ps *probeState) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ps.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	limit, err := ps.probe.run(ctx, s.Logger)
+
+	s.prmutex.Lock()
+	if !s.probeIsCurrent(ps) {
+		s.prmutex.Unlock()
+		return
+	}
+	if err != nil {
+		ps.err = err.Error()
+		s.prmutex.Unlock()
+		s.Warn("limit group probe failed", "group", ps.probe.Group, "probe", ps.probe.Probe, "err", err)
+		return
+	}
+	s.prmutex.Unlock()
+
+	if !s.storeProbedLimit(ps, limit) {
+		return
+	}
+
+	s.prmutex.Lock()
+	ps.limit = limit
+	ps.probed = time.Now()
+	ps.err = ""
+	s.prmutex.Unlock()
+}
+
+// probeIsCurrent tells you if the given probe is still the one we're running
+// for its group, ie. it hasn't been stopped or replaced. You must hold the
+// server's prmutex when calling this.
+func (s *Server) probeIsCurrent(ps *probeState) bool {
+	return s.probes[ps.probe.Group] == ps
+}
+
+// storeProbedLimit stores the given limit for the given probe's group, keeping
+// any existing rate limit, if the group doesn't already have that limit.
+// Returns false without storing anything if we or the probe have been stopped.
+func (s *Server) storeProbedLimit(ps *probeState, limit int) bool {
+	// we could have been stopped while the probe ran
+	s.ssmutex.RLock()
+	defer s.ssmutex.RUnlock()
+	if !s.up {
+		return false
+	}
+	s.prmutex.RLock()
+	current := s.probeIsCurrent(ps)
+	s.prmutex.RUnlock()
+	if !current {
+		return false
+	}
+
+	group := ps.probe.Group
+	if limit < 0 {
+		limit = -1
+	}
+	if limit == s.db.retrieveLimitGroup(group) {
+		return true
+	}
+
+	err := s.storeLimitGroups(map[string]*limitGroup{group: {limit: limit, rate: s.db.retrieveLimitGroupRate(group)}})
+	if err != nil {
+		s.Error("limit group probe failed to store limit", "group", group, "err", err)
+		return true
+	}
+	s.q.TriggerReadyAddedCallback()
+	return true
+}
+
+// SetLimitGroupProbe adds a new probe, or replaces the existing probe of the
+// same limit group. The probe is run straight away in the background, setting
+// the group's limit if it works, and then again every probe TTL. Any limit set
+// on the group by other means will be overwritten the next time the probe
+// runs successfully.
+func (s *Server) SetLimitGroupProbe(p *LimitGroupProbe) (*LimitGroupProbeStatus, error) {
+	err := p.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.storeLimitGroupProbe(p)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &probeState{probe: p, limit: -1, stop: make(chan struct{})}
+	s.prmutex.Lock()
+	if old, existed := s.probes[p.Group]; existed {
+		close(old.stop)
+	}
+	s.probes[p.Group] = ps
+	status := ps.status()
+	s.startLimitGroupProbe(ps)
+	s.prmutex.Unlock()
+
+	return status, nil
+}
+
+// RemoveLimitGroupProbe stops probing the limit of the given limit group. The
+// group keeps the last limit that was probed. Returns true if the group had a
+// probe.
+func (s *Server) RemoveLimitGroupProbe(group string) (bool, error) {
+	s.prmutex.RLock()
+	_, existed := s.probes[group]
+	s.prmutex.RUnlock()
+	if !existed {
+		return false, nil
+	}
+
+	err := s.db.removeLimitGroupProbe(group)
+	if err != nil {
+		return false, err
+	}
+
+	s.prmutex.Lock()
+	if ps, stillExists := s.probes[group]; stillExists {
+		close(ps.stop)
+		delete(s.probes, group)
+	}
+	s.prmutex.Unlock()
+
+	return true, nil
+}
+
+// LimitGroupProbes tells you about all the probes that have been set with
+// SetLimitGroupProbe(), sorted by group, along with their latest results. If
+// group is supplied, only the probe of that group is returned (if it exists).
+func (s *Server) LimitGroupProbes(group string) []*LimitGroupProbeStatus {
+	s.prmutex.RLock()
+	defer s.prmutex.RUnlock()
+
+	groups := make([]string, 0, len(s.probes))
+	for g := range s.probes {
+		if group == "" || g == group {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+
+	statuses := make([]*LimitGroupProbeStatus, 0, len(groups))
+	for _, g := range groups {
+		statuses = append(statuses, s.probes[g].status())
+	}
+	return statuses
+}
+
+// stopLimitGroupProbes stops running all our probes.
+func (s *Server) stopLimitGroupProbes() {
+	s.prmutex.Lock()
+	defer s.prmutex.Unlock()
+	for group, ps := range s.probes {
+		close(ps.stop)
+		delete(s.probes, group)
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for learning the memory, disk and time used by
+// the jobs of a ReqGroup, and recommending how much of each to reserve for
+// future jobs.
+//
+// Every time a job completes, or fails because it ran out of a resource, we
+// store an observation of its resource usage in the jobRAM, jobDisk and
+// jobSecs buckets, keyed on its ReqGroup and end time. Recommendations are
+// based on roughly the 95th percentile of these observations, with older
+// observations counting for less, or, for jobs with a SizeHint, on a linear
+// regression of usage against the SizeHint of prior jobs.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+)
+
+// recMinHintObservations is the minimum number of observations of jobs with a
+// SizeHint in a ReqGroup before we base recommendations on SizeHints.
+const recMinHintObservations = 10
+
+// recWeightHalfLives is how many half-lives old an observation can be before
+// we ignore it entirely.
+const recWeightHalfLives = 20
+
+// ReqGroupResource* are the resources we recommend requirements for, as found
+// in ReqGroupAccuracy.Resource.
+const (
+	ReqGroupResourceMemory = "memory"
+	ReqGroupResourceDisk   = "disk"
+	ReqGroupResourceTime   = "time"
+)
+
+// resourceBuckets maps ReqGroupResource* to the bucket their observations are
+// stored in.
+var resourceBuckets = map[string][]byte{
+	ReqGroupResourceMemory: bucketJobRAM,
+	ReqGroupResourceDisk:   bucketJobDisk,
+	ReqGroupResourceTime:   bucketJobSecs,
+}
+
+// resourceObservation is the resource usage of a single run of a job.
+type resourceObservation struct {
+	// Value is the amount of the resource used, in MB or seconds.
+	Value int
+
+	// Predicted is the amount of the resource that was reserved for the job,
+	// or 0 if not known.
+	Predicted int
+
+	// Hint is the job's SizeHint.
+	Hint float64
+
+	// End is when the job exited.
+	End time.Time
+}
+
+// encode converts the observation in to a database value.
+func (o *resourceObservation) encode() []byte {
+	return []byte(fmt.Sprintf("%d,%d,%s", o.Value, o.Predicted, strconv.FormatFloat(o.Hint, 'g', -1, 64)))
+}
+
+// parseResourceObservation parses the key and value of an observation stored
+// in the database.
+func parseResourceObservation(k, v []byte) (*resourceObservation, error) {
+	parts := strings.Split(string(v), ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("bad resource observation: %s", v)
+	}
+	o := &resourceObservation{}
+	var err error
+	if o.Value, err = strconv.Atoi(parts[0]); err != nil {
+		return nil, err
+	}
+	if o.Predicted, err = strconv.Atoi(parts[1]); err != nil {
+		return nil, err
+	}
+	if o.Hint, err = strconv.ParseFloat(parts[2], 64); err != nil {
+		return nil, err
+	}
+
+	keyParts := strings.Split(string(k), dbDelimiter)
+	if len(keyParts) >= 2 {
+		nanos, errp := strconv.ParseInt(keyParts[1], 10, 64)
+		if errp == nil {
+			o.End = time.Unix(0, nanos)
+		}
+	}
+	return o, nil
+}
+
+// resourceObservationKey returns the key an observation should be stored
+// under: the ReqGroup followed by the end time, so that observations of a
+// ReqGroup are stored in time order, then the key of the job, to make it
+// unique.
+func resourceObservationKey(reqGroup string, end time.Time, jobKey string) []byte {
+	return []byte(reqGroup + dbDelimiter + fmt.Sprintf("%0*d", historyTimeWidth, end.UnixNano()) + dbDelimiter + jobKey)
+}
+
+// resourceObservations returns the observations that should be stored in our
+// resource buckets for the given job that has just exited, keyed on bucket
+// name. Only the buckets of the given resources are included. You must hold at
+// least a read lock on the job before calling this.
+func resourceObservations(key string, job *Job, resources ...string) map[string]sobsd {
+	end := job.EndTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	secs := int(math.Ceil(job.EndTime.Sub(job.StartTime).Seconds()))
+
+	var predRAM, predDisk, predSecs int
+	if req := job.Requirements; req != nil {
+		predRAM = req.RAM
+		if req.Disk > 0 {
+			predDisk = req.Disk * 1024
+		}
+		predSecs = int(math.Ceil(req.Time.Seconds()))
+	}
+
+	lookups := make(map[string]sobsd)
+	for _, resource := range resources {
+		o := &resourceObservation{Hint: job.SizeHint}
+		switch resource {
+		case ReqGroupResourceMemory:
+			o.Value, o.Predicted = job.PeakRAM, predRAM
+		case ReqGroupResourceDisk:
+			o.Value, o.Predicted = int(job.PeakDisk), predDisk
+		case ReqGroupResourceTime:
+			o.Value, o.Predicted = secs, predSecs
+		default:
+			continue
+		}
+		lookups[string(resourceBuckets[resource])] = sobsd{{resourceObservationKey(job.ReqGroup, end, key), o.encode()}}
+	}
+	return lookups
+}
+
+// weightedValue is a value with a weight.
+type weightedValue struct {
+	value  float64
+	weight float64
+}
+
+// observationWeight returns the weight of an observation that ended at end.
+// Observations lose half their weight every halfLife, in whole days, so
+// that all the observations of a day count equally. A halfLife of 0 or less
+// means all observations have a weight of 1.
+func observationWeight(end time.Time, now time.Time, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return 1
+	}
+	days := math.Floor(now.Sub(end).Hours() / 24)
+	if days <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, days/(halfLife.Hours()/24))
+}
+
+// upperWindowValue returns the value at roughly the 95th percentile of the
+// given weighted values: the largest value that has more than a window of
+// weight above and including it, where the window is the weight of
+// jobStatWindowPercent values, or jobStatWindowPercent percent of the total
+// weight if there are more than 100 values. The second return value is false
+// if there is no such value. Sorts values.
+func upperWindowValue(values []weightedValue) (float64, bool) {
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].value < values[j].value
+	})
+
+	total := 0.0
+	for _, wv := range values {
+		total += wv.weight
+	}
+	window := total / float64(len(values)) * float64(jobStatWindowPercent)
+	if len(values) > 100 {
+		window = total / 100 * float64(jobStatWindowPercent)
+	}
+
+	acc := 0.0
+	for i := len(values) - 1; i >= 0; i-- {
+		acc += values[i].weight
+		if acc > window*(1+1e-9) {
+			return values[i].value, true
+		}
+	}
+	return 0, false
+}
+
+// sizeRegression is a weighted linear regression of resource usage against
+// SizeHint, plus a margin that would have covered roughly 95% of the
+// observations it was fitted to.
+type sizeRegression struct {
+	intercept float64
+	slope     float64
+	margin    float64
+}
+
+// fitSizeRegression fits a sizeRegression to the given observations. Returns
+// nil if there are too few observations with hints, or they don't show usage
+// increasing with hint.
+func fitSizeRegression(obs []*resourceObservation, weights []float64) *sizeRegression {
+	var sw, sx, sy float64
+	n := 0
+	for i, o := range obs {
+		if o.Hint <= 0 {
+			continue
+		}
+		n++
+		sw += weights[i]
+		sx += weights[i] * o.Hint
+		sy += weights[i] * float64(o.Value)
+	}
+	if n < recMinHintObservations || sw == 0 {
+		return nil
+	}
+	xbar, ybar := sx/sw, sy/sw
+
+	var sxx, sxy float64
+	for i, o := range obs {
+		if o.Hint <= 0 {
+			continue
+		}
+		dx := o.Hint - xbar
+		sxx += weights[i] * dx * dx
+		sxy += weights[i] * dx * (float64(o.Value) - ybar)
+	}
+	if sxx == 0 {
+		return nil
+	}
+	slope := sxy / sxx
+	if slope <= 0 {
+		return nil
+	}
+	intercept := ybar - slope*xbar
+
+	residuals := make([]weightedValue, 0, n)
+	for i, o := range obs {
+		if o.Hint <= 0 {
+			continue
+		}
+		residuals = append(residuals, weightedValue{float64(o.Value) - (intercept + slope*o.Hint), weights[i]})
+	}
+	margin, _ := upperWindowValue(residuals)
+	if margin < 0 {
+		margin = 0
+	}
+
+	return &sizeRegression{intercept: intercept, slope: slope, margin: margin}
+}
+
+// predict returns the predicted value for the given hint, including the
+// margin. Returns false if the prediction isn't positive.
+func (r *sizeRegression) predict(hint float64) (float64, bool) {
+	prediction := r.intercept + r.slope*hint + r.margin
+	if prediction <= 0 {
+		return 0, false
+	}
+	return prediction, true
+}
+
+// roundRecommendation applies our rules for rounding a recommendation based on
+// the largest value seen.
+func roundRecommendation(recommendation, max, roundAmount int) int {
+	if recommendation == 0 {
+		if max == 0 {
+			return 0
+		}
+		recommendation = max
+	}
+
+	if max-recommendation < roundAmount {
+		recommendation = max
+	}
+
+	if recommendation < roundAmount {
+		recommendation = roundAmount
+	}
+
+	if recommendation%roundAmount > 0 {
+		recommendation = int(math.Ceil(float64(recommendation)/float64(roundAmount))) * roundAmount
+	}
+	return recommendation
+}
+
+// resourceRecommender recommends amounts of a resource for the jobs of a
+// ReqGroup, as described for recommendedReqGroupStat(), having done the work
+// that doesn't depend on a job's SizeHint once.
+type resourceRecommender struct {
+	recommendation int
+	regression     *sizeRegression
+	roundAmount    int
+}
+
+// newResourceRecommender creates a resourceRecommender from past observations
+// of a resource's use.
+func newResourceRecommender(obs []*resourceObservation, roundAmount int, halfLife time.Duration, now time.Time) *resourceRecommender {
+	rr := &resourceRecommender{roundAmount: roundAmount}
+	if len(obs) == 0 {
+		return rr
+	}
+
+	max := 0
+	weights := make([]float64, len(obs))
+	values := make([]weightedValue, len(obs))
+	for i, o := range obs {
+		if o.Value > max {
+			max = o.Value
+		}
+		weights[i] = observationWeight(o.End, now, halfLife)
+		values[i] = weightedValue{float64(o.Value), weights[i]}
+	}
+
+	rr.regression = fitSizeRegression(obs, weights)
+
+	var recommendation int
+	if value, found := upperWindowValue(values); found {
+		recommendation = int(value)
+	}
+	rr.recommendation = roundRecommendation(recommendation, max, roundAmount)
+	return rr
+}
+
+// recommend returns the recommended amount of the resource for a job with the
+// given SizeHint. Returns 0 if there were no observations.
+func (rr *resourceRecommender) recommend(hint float64) int {
+	if hint > 0 && rr.regression != nil {
+		if prediction, ok := rr.regression.predict(hint); ok {
+			// we don't cap to max, since bigger hints are expected to need more
+			// than we've seen before
+			p := int(math.Ceil(prediction))
+			return roundRecommendation(p, p, rr.roundAmount)
+		}
+	}
+	return rr.recommendation
+}
+
+// setRecommendationSettings sets the rounding amounts and half-life used for
+// our recommendations. Values of 0 mean the current values of the Rec*
+// variables will be used.
+func (db *db) setRecommendationSettings(mbRound, secRound int, halfLife time.Duration) {
+	db.Lock()
+	defer db.Unlock()
+	db.recMBRound = mbRound
+	db.recSecRound = secRound
+	db.recHalfLife = halfLife
+}
+
+// recommendationSettings returns the memory and disk rounding amount, time
+// rounding amount and half-life that our recommendations should use.
+func (db *db) recommendationSettings() (int, int, time.Duration) {
+	db.RLock()
+	defer db.RUnlock()
+	mbRound, secRound, halfLife := db.recMBRound, db.recSecRound, db.recHalfLife
+	if mbRound <= 0 {
+		mbRound = RecMBRound
+	}
+	if secRound <= 0 {
+		secRound = RecSecRound
+	}
+	if halfLife == 0 {
+		halfLife = RecHalfLife
+	}
+	return mbRound, secRound, halfLife
+}
+
+// reqsRecommender recommends the memory, disk and time requirements of the
+// jobs of a ReqGroup, based on the prior jobs at the time it was created.
+type reqsRecommender struct {
+	memory *resourceRecommender
+	disk   *resourceRecommender
+	time   *resourceRecommender
+}
+
+// reqsRecommender returns a reqsRecommender for the given ReqGroup. Creating
+// one involves reading all the ReqGroup's observations, so you should use the
+// same one for all the jobs of a ReqGroup you're recommending for at once.
+func (db *db) reqsRecommender(reqGroup string) (*reqsRecommender, error) {
+	mbRound, secRound, _ := db.recommendationSettings()
+	rm, err := db.resourceRecommender(bucketJobRAM, reqGroup, mbRound)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := db.resourceRecommender(bucketJobDisk, reqGroup, mbRound)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := db.resourceRecommender(bucketJobSecs, reqGroup, secRound)
+	if err != nil {
+		return nil, err
+	}
+	return &reqsRecommender{memory: rm, disk: rd, time: rt}, nil
+}
+
+// recommendedReqs returns the recommended memory, disk and time requirements
+// for a job in the given ReqGroup with the given SizeHint, based on prior
+// jobs.
+func (db *db) recommendedReqs(reqGroup string, hint float64) (*scheduler.Requirements, error) {
+	rr, err := db.reqsRecommender(reqGroup)
+	if err != nil {
+		return nil, err
+	}
+	return rr.reqs(hint), nil
+}
+
+// reqs returns the recommended memory, disk and time requirements for a job
+// with the given SizeHint.
+func (rr *reqsRecommender) reqs(hint float64) *scheduler.Requirements {
+	recm := rr.memory.recommend(hint)
+	recd := rr.disk.recommend(hint)
+	recs := rr.time.recommend(hint)
+
+	recdGBs := 0
+	if recd > 0 {
+		recdGBs = int(math.Ceil(float64(recd) / float64(1024)))
+	}
+	return &scheduler.Requirements{RAM: recm, Disk: recdGBs, DiskSet: true, Time: time.Duration(recs) * time.Second}
+}
+
+// ReqGroupAccuracy compares the amount of a resource that was reserved for the
+// jobs of a ReqGroup with the amount they actually used.
+type ReqGroupAccuracy struct {
+	ReqGroup string `json:"req_grp"`
+
+	// Resource is one of the ReqGroupResource* constants. Memory and disk are
+	// in MB, time is in seconds.
+	Resource string `json:"resource"`
+
+	// Count is the number of jobs that we know the reservation of.
+	Count int `json:"count"`
+
+	// Under is the number of those jobs that used more than was reserved.
+	Under int `json:"under"`
+
+	MeanPredicted float64 `json:"mean_predicted"`
+	MeanActual    float64 `json:"mean_actual"`
+	MeanAbsError  float64 `json:"mean_abs_error"`
+}
+
+// recommendationAccuracy returns the accuracy of our recommendations for
+// each resource of the given ReqGroup, or of all ReqGroups if reqGroup is
+// blank, sorted by ReqGroup and Resource.
+func (db *db) recommendationAccuracy(reqGroup string) ([]*ReqGroupAccuracy, error) {
+	accuracies := make(map[string]*ReqGroupAccuracy)
+	var prefix []byte
+	if reqGroup != "" {
+		prefix = []byte(reqGroup + dbDelimiter)
+	}
+
+	err := db.storage.view(func(tx dbTx) error {
+		for resource, bucket := range resourceBuckets {
+			errs := tx.seek(bucket, nil, prefix, func(k, v []byte) (bool, error) {
+				o, errp := parseResourceObservation(k, v)
+				if errp != nil || o.Predicted <= 0 {
+					return true, nil
+				}
+
+				rg := strings.SplitN(string(k), dbDelimiter, 2)[0]
+				id := rg + dbDelimiter + resource
+				acc, exists := accuracies[id]
+				if !exists {
+					acc = &ReqGroupAccuracy{ReqGroup: rg, Resource: resource}
+					accuracies[id] = acc
+				}
+				acc.Count++
+				if o.Value > o.Predicted {
+					acc.Under++
+				}
+				acc.MeanPredicted += float64(o.Predicted)
+				acc.MeanActual += float64(o.Value)
+				acc.MeanAbsError += math.Abs(float64(o.Predicted - o.Value))
+				return true, nil
+			})
+			if errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ReqGroupAccuracy, 0, len(accuracies))
+	for _, acc := range accuracies {
+		n := float64(acc.Count)
+		acc.MeanPredicted /= n
+		acc.MeanActual /= n
+		acc.MeanAbsError /= n
+		results = append(results, acc)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].ReqGroup == results[j].ReqGroup {
+			return results[i].Resource < results[j].Resource
+		}
+		return results[i].ReqGroup < results[j].ReqGroup
+	})
+	return results, nil
+}
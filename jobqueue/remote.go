@@ -0,0 +1,541 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for dependencies on the jobs of other wr
+// managers.
+//
+// Jobs with a Dependency that has a Manager are given a dependency in our queue
+// on a key (see Dependency.remoteKey()) that will never be used for an item.
+// For each RemoteManager, we periodically connect to it as a client and ask it
+// if the dependencies on it are satisfied, then resolve or unresolve those
+// keys in our queue accordingly. If a RemoteManager can't be reached, we log
+// it and report it on the jobs that depend on it, and their dependencies
+// remain as they were until it can be reached again.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/VertebrateResequencing/wr/queue"
+)
+
+// ServerRemoteCheckInterval is how often a server asks each RemoteManager if
+// the dependencies its jobs have on that manager's jobs have been satisfied.
+var ServerRemoteCheckInterval = 30 * time.Second
+
+// remoteConnectTimeout is how long we wait to connect to a RemoteManager.
+var remoteConnectTimeout = 10 * time.Second
+
+// remoteDependencyGrace is how long after a dependency on a RemoteManager was
+// last registered that we keep checking it, even if no jobs in our queue have
+// it, since the jobs may not have been added to the queue yet.
+var remoteDependencyGrace = 1 * time.Minute
+
+// RemoteManager describes another wr manager whose jobs the jobs of a server
+// can depend on, by having a Dependency with a Manager of the RemoteManager's
+// Name.
+type RemoteManager struct {
+	// Name is how Dependency.Manager refers to the manager.
+	Name string
+
+	// Deployment, if set, means the manager is the one of that deployment
+	// (eg. "production") that a wr client on this machine would connect to,
+	// using the client config of that deployment. The other fields below are
+	// then ignored.
+	Deployment string
+
+	// Addr is the host:port of the manager.
+	Addr string
+
+	// CAFile is the path to the manager's CA certificate.
+	CAFile string
+
+	// CertDomain is the domain the manager's certificate is valid for.
+	CertDomain string
+
+	// TokenFile is the path to the file containing the manager's client
+	// token.
+	TokenFile string
+}
+
+// ParseRemoteManagers parses a comma separated list of other wr managers like
+// "name:deployment" (to connect to the manager of that deployment the same way
+// wr would from this machine) or "name:host:port:dir[:domain]", where dir is a
+// directory containing the manager's ca.pem and client.token files (eg. a copy
+// of its ~/.wr_[deployment] directory) and domain is the domain its
+// certificate is valid for (default localhost). Eg.
+// "prod:production,teamb:farm5:46123:/shared/teamb_wr:farm5.internal". Returns
+// nil if spec contains no managers, and an Error with Err ErrBadRemoteManager
+// if spec is invalid.
+func ParseRemoteManagers(spec string) ([]*RemoteManager, error) {
+	var rms []*RemoteManager
+	seen := make(map[string]bool)
+	for _, rSpec := range strings.Split(spec, ",") {
+		rSpec = strings.TrimSpace(rSpec)
+		if rSpec == "" {
+			continue
+		}
+
+		parts := strings.Split(rSpec, ":")
+		if parts[0] == "" || seen[parts[0]] {
+			return nil, Error{"ParseRemoteManagers", rSpec, ErrBadRemoteManager}
+		}
+
+		rm := &RemoteManager{Name: parts[0]}
+		switch len(parts) {
+		case 2:
+			rm.Deployment = parts[1]
+		case 4, 5:
+			rm.Addr = parts[1] + ":" + parts[2]
+			rm.CAFile = filepath.Join(parts[3], "ca.pem")
+			rm.TokenFile = filepath.Join(parts[3], "client.token")
+			rm.CertDomain = "localhost"
+			if len(parts) == 5 {
+				rm.CertDomain = parts[4]
+			}
+		default:
+			return nil, Error{"ParseRemoteManagers", rSpec, ErrBadRemoteManager}
+		}
+		if rm.Deployment == "" && (parts[1] == "" || parts[2] == "" || parts[3] == "" || rm.CertDomain == "") {
+			return nil, Error{"ParseRemoteManagers", rSpec, ErrBadRemoteManager}
+		}
+
+		seen[rm.Name] = true
+		rms = append(rms, rm)
+	}
+	return rms, nil
+}
+
+// connect connects to the manager as a client.
+func (rm *RemoteManager) connect() (*Client, error) {
+	if rm.Deployment != "" {
+		return ConnectUsingConfig(rm.Deployment, remoteConnectTimeout, nil)
+	}
+
+	token, err := os.ReadFile(rm.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(rm.Addr, rm.CAFile, rm.CertDomain, token, remoteConnectTimeout)
+}
+
+// RemoteManagerStatus describes a RemoteManager along with the results of last
+// trying to contact it.
+type RemoteManagerStatus struct {
+	Manager *RemoteManager
+
+	// Dependencies is the number of different dependencies jobs currently
+	// have on the manager.
+	Dependencies int
+
+	// Contacted is when we last got an answer from the manager.
+	Contacted time.Time
+
+	// Err is the error from the last attempt to contact the manager, if it
+	// failed.
+	Err string
+
+	// UnreachableSince is when we first failed to contact the manager, if the
+	// last attempt failed.
+	UnreachableSince time.Time
+}
+
+// remoteState is how the server keeps track of a RemoteManager and the
+// dependencies on it.
+type remoteState struct {
+	manager          *RemoteManager
+	client           *Client
+	deps             map[string]*Dependency
+	registered       map[string]time.Time
+	contacted        time.Time
+	err              string
+	unreachableSince time.Time
+	check            chan struct{}
+	stop             chan struct{}
+}
+
+// status returns a RemoteManagerStatus for this state. You must hold the
+// server's rmmutex when calling this.
+func (rs *remoteState) status() *RemoteManagerStatus {
+	rm := *rs.manager
+	return &RemoteManagerStatus{
+		Manager:          &rm,
+		Dependencies:     len(rs.deps),
+		Contacted:        rs.contacted,
+		Err:              rs.err,
+		UnreachableSince: rs.unreachableSince,
+	}
+}
+
+// problem describes why the manager can't be reached, or returns an empty
+// string if it can. You must hold the server's rmmutex when calling this.
+func (rs *remoteState) problem() string {
+	if rs.err == "" {
+		return ""
+	}
+	return fmt.Sprintf("remote manager %s unreachable since %s: %s", rs.manager.Name, rs.unreachableSince.Format(time.RFC3339), rs.err)
+}
+
+// startRemoteManagers sets up checking the dependencies on the given managers,
+// so that dependencies on them can be registered. The checking itself only
+// starts once you call watchRemoteManagers().
+func (s *Server) startRemoteManagers(rms []*RemoteManager) {
+	s.rmmutex.Lock()
+	defer s.rmmutex.Unlock()
+	s.remotes = make(map[string]*remoteState)
+	for _, rm := range rms {
+		rs := &remoteState{
+			manager:    rm,
+			deps:       make(map[string]*Dependency),
+			registered: make(map[string]time.Time),
+			check:      make(chan struct{}, 1),
+			stop:       make(chan struct{}),
+		}
+		s.remotes[rm.Name] = rs
+	}
+}
+
+// watchRemoteManagers starts checking the dependencies on the managers given
+// to startRemoteManagers(), until stopRemoteManagers() is called. You must have
+// created our queue before calling this.
+func (s *Server) watchRemoteManagers() {
+	s.rmmutex.Lock()
+	defer s.rmmutex.Unlock()
+	for _, rs := range s.remotes {
+		wgk := s.wg.Add(1)
+		go func(rs *remoteState) {
+			defer s.wg.Done(wgk)
+			s.watchRemoteManager(rs)
+		}(rs)
+	}
+}
+
+// watchRemoteManager checks the dependencies on the given manager every
+// ServerRemoteCheckInterval, or sooner when new dependencies are registered,
+// until its stop channel is closed.
+func (s *Server) watchRemoteManager(rs *remoteState) {
+	defer internal.LogPanic(s.Logger, "remote manager watcher", false)
+
+	for {
+		select {
+		case <-time.After(ServerRemoteCheckInterval):
+			s.checkRemoteManager(rs)
+		case <-rs.check:
+			s.checkRemoteManager(rs)
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// checkRemoteManager asks the given manager if the dependencies on it are
+// satisfied, and resolves or unresolves them in our queue accordingly.
+// Dependencies that no jobs in our queue have any more are forgotten about.
+func (s *Server) checkRemoteManager(rs *remoteState) {
+	s.rmmutex.Lock()
+	keys := make([]string, 0, len(rs.deps))
+	for key := range rs.deps {
+		if time.Since(rs.registered[key]) > remoteDependencyGrace {
+			if has, err := s.q.HasDependents(key); err == nil && !has {
+				delete(rs.deps, key)
+				delete(rs.registered, key)
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	deps := make(Dependencies, len(keys))
+	for i, key := range keys {
+		deps[i] = rs.deps[key]
+	}
+	client := rs.client
+	s.rmmutex.Unlock()
+
+	if len(deps) == 0 {
+		return
+	}
+
+	var err error
+	if client == nil {
+		client, err = rs.manager.connect()
+	}
+
+	var satisfied []bool
+	if err == nil {
+		satisfied, err = client.DependenciesSatisfied(deps)
+	}
+
+	s.rmmutex.Lock()
+	stopped := false
+	select {
+	case <-rs.stop:
+		stopped = true
+	default:
+	}
+	if err != nil || stopped {
+		if client != nil {
+			errd := client.Disconnect()
+			if errd != nil {
+				s.Debug("remote manager disconnect failed", "manager", rs.manager.Name, "err", errd)
+			}
+		}
+		rs.client = nil
+		if stopped {
+			// we were stopped while waiting on the manager
+			s.rmmutex.Unlock()
+			return
+		}
+		if rs.err == "" {
+			rs.unreachableSince = time.Now()
+			s.Warn("remote manager unreachable; jobs depending on it will wait", "manager", rs.manager.Name, "err", err)
+		}
+		rs.err = err.Error()
+		s.rmmutex.Unlock()
+		return
+	}
+	if rs.err != "" {
+		s.Info("remote manager reachable again", "manager", rs.manager.Name)
+	}
+	rs.client = client
+	rs.err = ""
+	rs.unreachableSince = time.Time{}
+	rs.contacted = time.Now()
+	s.rmmutex.Unlock()
+
+	for i, key := range keys {
+		if satisfied[i] {
+			err = s.q.ResolveDependency(key, queue.DepRemoved)
+		} else {
+			err = s.q.UnresolveDependency(key, queue.DepRemoved)
+		}
+		if err != nil {
+			s.Warn("failed to update remote dependency", "manager", rs.manager.Name, "dependency", key, "err", err)
+		}
+	}
+}
+
+// remoteDependencies returns those of the given dependencies, including the
+// alternatives in their AnyOf, that are on RemoteManagers.
+func remoteDependencies(deps Dependencies) Dependencies {
+	var remote Dependencies
+	for _, dep := range deps {
+		alts := Dependencies{dep}
+		if len(dep.AnyOf) > 0 {
+			alts = dep.alternatives()
+		}
+		for _, alt := range alts {
+			if alt.Manager != "" {
+				remote = append(remote, alt)
+			}
+		}
+	}
+	return remote
+}
+
+// checkRemoteDependencies returns an Error with Err ErrUnknownManager if any of
+// the given dependencies are on a manager that we weren't configured with.
+func (s *Server) checkRemoteDependencies(deps Dependencies) error {
+	s.rmmutex.RLock()
+	defer s.rmmutex.RUnlock()
+	for _, dep := range remoteDependencies(deps) {
+		if _, exists := s.remotes[dep.Manager]; !exists {
+			return Error{"Add", dep.Manager, ErrUnknownManager}
+		}
+	}
+	return nil
+}
+
+// registerRemoteDependencies starts checking those of the given dependencies
+// that are on RemoteManagers. Returns an Error with Err ErrUnknownManager if
+// any refer to a manager that hasn't been configured.
+func (s *Server) registerRemoteDependencies(deps Dependencies) error {
+	s.rmmutex.Lock()
+	defer s.rmmutex.Unlock()
+	for _, dep := range remoteDependencies(deps) {
+		rs, exists := s.remotes[dep.Manager]
+		if !exists {
+			return Error{"Add", dep.Manager, ErrUnknownManager}
+		}
+
+		key := dep.remoteKey()
+		if _, exists := rs.deps[key]; !exists {
+			rs.deps[key] = &Dependency{Essence: dep.Essence, DepGroup: dep.DepGroup, On: dep.On}
+		}
+		rs.registered[key] = time.Now()
+
+		// check now, since the dependency may already be satisfied
+		select {
+		case rs.check <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// dependencyKeys registers any dependencies the given job has on
+// RemoteManagers, then returns the queue dependencies of the job (see
+// Dependencies.incompleteJobKeys()).
+func (s *Server) dependencyKeys(job *Job) ([]string, *queue.DepRules, error) {
+	err := s.registerRemoteDependencies(job.Dependencies)
+	if err != nil {
+		return nil, nil, err
+	}
+	return job.Dependencies.incompleteJobKeys(s.db)
+}
+
+// noteRemoteProblems sets RemoteDepProblems on those of the given jobs that
+// have dependencies on RemoteManagers that currently can't be reached.
+func (s *Server) noteRemoteProblems(jobs []*Job) {
+	s.rmmutex.RLock()
+	defer s.rmmutex.RUnlock()
+	if len(s.remotes) == 0 {
+		return
+	}
+
+	for _, job := range jobs {
+		job.Lock()
+		job.RemoteDepProblems = nil
+		seen := make(map[string]bool)
+		for _, dep := range remoteDependencies(job.Dependencies) {
+			rs, exists := s.remotes[dep.Manager]
+			if !exists || seen[dep.Manager] {
+				continue
+			}
+			seen[dep.Manager] = true
+			if problem := rs.problem(); problem != "" {
+				job.RemoteDepProblems = append(job.RemoteDepProblems, problem)
+			}
+		}
+		job.Unlock()
+	}
+}
+
+// RemoteManagers tells you about the RemoteManagers this server was configured
+// with, sorted by name, along with how many dependencies jobs have on each, and
+// whether they could be contacted the last time we checked those
+// dependencies.
+func (s *Server) RemoteManagers() []*RemoteManagerStatus {
+	s.rmmutex.RLock()
+	defer s.rmmutex.RUnlock()
+
+	names := make([]string, 0, len(s.remotes))
+	for name := range s.remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	statuses := make([]*RemoteManagerStatus, len(names))
+	for i, name := range names {
+		statuses[i] = s.remotes[name].status()
+	}
+	return statuses
+}
+
+// stopRemoteManagers stops checking dependencies on our RemoteManagers, and
+// disconnects from them.
+func (s *Server) stopRemoteManagers() {
+	s.rmmutex.Lock()
+	defer s.rmmutex.Unlock()
+	for name, rs := range s.remotes {
+		close(rs.stop)
+		if rs.client != nil {
+			err := rs.client.Disconnect()
+			if err != nil {
+				s.Debug("remote manager disconnect failed", "manager", name, "err", err)
+			}
+		}
+		delete(s.remotes, name)
+	}
+}
+
+// dependenciesSatisfied tells you, for each of the given dependencies on our
+// own jobs (their Manager is ignored), if they are currently satisfied. See
+// Dependency for details.
+func (s *Server) dependenciesSatisfied(deps Dependencies) ([]bool, error) {
+	satisfied := make([]bool, len(deps))
+	for i, dep := range deps {
+		alts := Dependencies{dep}
+		if len(dep.AnyOf) > 0 {
+			alts = dep.alternatives()
+		}
+		for _, alt := range alts {
+			ok, err := s.dependencySatisfied(alt)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				satisfied[i] = true
+				break
+			}
+		}
+	}
+	return satisfied, nil
+}
+
+// dependencySatisfied tells you if the job(s) the given dependency refers to
+// exist and are in the states its On needs: all complete for
+// DependencyOnSuccess, all buried for DependencyOnFailure, or all either for
+// DependencyOnEnd.
+func (s *Server) dependencySatisfied(dep *Dependency) (bool, error) {
+	var keys []string
+	var err error
+	switch {
+	case dep.DepGroup != "":
+		keys, err = s.db.retrieveJobKeysByDepGroup(dep.DepGroup, false)
+		if err != nil {
+			return false, err
+		}
+	case dep.Essence != nil:
+		keys = []string{dep.Essence.Key()}
+	}
+
+	var complete, buried int
+	for _, key := range keys {
+		if item, errg := s.q.Get(key); errg == nil {
+			if item.Stats().State != queue.ItemStateBury {
+				return false, nil
+			}
+			buried++
+			continue
+		}
+
+		added, errc := s.db.checkIfAdded(key)
+		if errc != nil {
+			return false, errc
+		}
+		if added {
+			complete++
+		}
+	}
+
+	switch dep.On {
+	case DependencyOnFailure:
+		return buried > 0 && complete == 0, nil
+	case DependencyOnEnd:
+		return buried+complete > 0, nil
+	}
+	return complete > 0 && buried == 0, nil
+}
@@ -0,0 +1,828 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for replicating a server's database to a hot
+// standby. The server records every committed change to its database in a
+// bounded in-memory log, and a standby (see Standby()) repeatedly asks for the
+// changes since the last one it saw, getting a complete copy of the database
+// (fetched in chunks from a snapshot file) whenever it is too far behind.
+// Since the live bucket holds the current state of every incomplete job, the
+// standby can take over and recover the queue exactly as a restarted server
+// would.
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	sync "github.com/sasha-s/go-deadlock"
+
+	"github.com/gofrs/uuid"
+	"github.com/inconshreveable/log15"
+)
+
+// these variables are only exported for testing purposes
+var (
+	// ReplicationWaitTime is the longest the server will wait for new database
+	// changes before responding to a standby.
+	ReplicationWaitTime = 10 * time.Second
+
+	// replicationLogMaxBytes bounds the size of the change log; standbys that
+	// fall further behind than this get a complete copy of the database.
+	replicationLogMaxBytes = 64 * 1024 * 1024
+
+	// replicationIdleTime is how long after the last standby request we stop
+	// recording changes.
+	replicationIdleTime = 5 * time.Minute
+
+	// standbyRetryTime is how long a standby waits before retrying after
+	// failing to get changes from the primary.
+	standbyRetryTime = 1 * time.Second
+
+	// replicationChunkSize is the most bytes of a complete copy of the
+	// database sent to a standby in one response.
+	replicationChunkSize = 16 * 1024 * 1024
+)
+
+// dbChange is a single put or delete in one of our database's buckets.
+type dbChange struct {
+	Bucket []byte
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// dbChangeSet holds all the changes made by a single committed update, along
+// with its sequence number.
+type dbChangeSet struct {
+	Seq     uint64
+	Changes []*dbChange
+}
+
+// size returns the approximate number of bytes used by the changes.
+func (cs *dbChangeSet) size() int {
+	size := 0
+	for _, c := range cs.Changes {
+		size += len(c.Bucket) + len(c.Key) + len(c.Value)
+	}
+	return size
+}
+
+// apply makes the changes in the given transaction.
+func (cs *dbChangeSet) apply(tx dbTx) error {
+	for _, c := range cs.Changes {
+		var err error
+		if c.Delete {
+			err = tx.delete(c.Bucket, c.Key)
+		} else {
+			err = tx.put(c.Bucket, c.Key, c.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicatingStore is a dbStore that records the changes made by update() so
+// that they can be sent to standbys. Recording only happens while a standby
+// has made a request in the last replicationIdleTime. Recording updates are
+// done one at a time, so that their change sets are numbered in the order they
+// were committed.
+//
+// It can also capture changes for compact() (see compact.go), and be paused
+// while the underlying store is replaced.
+type replicatingStore struct {
+	dbStore
+	id             string
+	seq            uint64
+	log            []*dbChangeSet
+	logBytes       int
+	recording      bool
+	lastRequest    time.Time
+	changed        chan struct{}
+	stopped        bool
+	capturing      bool
+	captured       []*dbChangeSet
+	unrecorded     int // updates in progress that are not recording
+	unrecordedDone chan struct{}
+	active         int // operations in progress on dbStore
+	drained        chan struct{}
+	paused         bool
+	resumed        chan struct{}
+	closed         bool
+	snapshots      map[string]*replicaSnapshot
+	mu             sync.Mutex
+	recordMu       sync.Mutex
+	snapshotMu     sync.Mutex
+}
+
+// replicaSnapshot is a complete copy of the database, made for standbys to
+// fetch in chunks.
+type replicaSnapshot struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// unbatchedUpdater is implemented by dbStores whose update() waits to batch
+// transactions together, letting you update without that wait.
+type unbatchedUpdater interface {
+	updateUnbatched(fn func(tx dbTx) error) error
+}
+
+// newReplicatingStore wraps the given store. The returned store gets a new
+// random id, so that standbys of a previous incarnation of the server know
+// they must start again.
+func newReplicatingStore(store dbStore) *replicatingStore {
+	return &replicatingStore{
+		dbStore:   store,
+		id:        uuid.Must(uuid.NewV4()).String(),
+		changed:   make(chan struct{}),
+		snapshots: make(map[string]*replicaSnapshot),
+	}
+}
+
+// update implements dbStore, recording the changes made by fn once they have
+// been committed.
+func (s *replicatingStore) update(fn func(tx dbTx) error) error {
+	store, record := s.acquire(true)
+	defer s.release(!record)
+
+	update := store.update
+	if record {
+		// we must number our change set before any other recording update
+		// can commit, and since we'll be alone there's no point waiting to
+		// batch
+		s.recordMu.Lock()
+		defer s.recordMu.Unlock()
+		if u, ok := store.(unbatchedUpdater); ok {
+			update = u.updateUnbatched
+		}
+	}
+
+	var rtx *recordingTx
+	err := update(func(tx dbTx) error {
+		if !record {
+			return fn(tx)
+		}
+		// fn may be called again if a batched transaction failed, so start
+		// afresh each time
+		rtx = &recordingTx{dbTx: tx}
+		return fn(rtx)
+	})
+	if err != nil || (rtx != nil && len(rtx.changes) == 0) {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	if s.recording && time.Since(s.lastRequest) > replicationIdleTime {
+		s.recording = false
+	}
+	var cs *dbChangeSet
+	if rtx != nil {
+		cs = &dbChangeSet{Seq: s.seq, Changes: rtx.changes}
+		if s.capturing {
+			s.captured = append(s.captured, cs)
+		}
+	}
+	if s.recording && cs != nil {
+		s.log = append(s.log, cs)
+		s.logBytes += cs.size()
+		for s.logBytes > replicationLogMaxBytes && len(s.log) > 0 {
+			s.logBytes -= s.log[0].size()
+			s.log[0] = nil
+			s.log = s.log[1:]
+		}
+	} else {
+		// we weren't recording for all of this update, so the log can't be
+		// used to catch up past it
+		s.log = nil
+		s.logBytes = 0
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+// view implements dbStore.
+func (s *replicatingStore) view(fn func(tx dbTx) error) error {
+	store, _ := s.acquire(false)
+	defer s.release(false)
+	return store.view(fn)
+}
+
+// backup implements dbStore.
+func (s *replicatingStore) backup(w io.Writer) error {
+	store, _ := s.acquire(false)
+	defer s.release(false)
+	return store.backup(w)
+}
+
+// backupToFile implements dbStore.
+func (s *replicatingStore) backupToFile(path string) error {
+	store, _ := s.acquire(false)
+	defer s.release(false)
+	return store.backupToFile(path)
+}
+
+// check implements dbStore.
+func (s *replicatingStore) check() ([]string, error) {
+	store, _ := s.acquire(false)
+	defer s.release(false)
+	return store.check()
+}
+
+// close implements dbStore, waiting for any replacement of the underlying
+// store to finish first.
+func (s *replicatingStore) close() error {
+	s.mu.Lock()
+	s.waitWhilePaused()
+	s.closed = true
+	store := s.dbStore
+	s.mu.Unlock()
+	return store.close()
+}
+
+// acquire returns the underlying store for an operation, waiting while we are
+// paused. Also tells you if an update should record its changes. You must call
+// release() when the operation completes, saying if it was an update that did
+// not record.
+func (s *replicatingStore) acquire(update bool) (dbStore, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitWhilePaused()
+	s.active++
+	record := s.recording || s.capturing
+	if update && !record {
+		s.unrecorded++
+	}
+	return s.dbStore, record
+}
+
+// release undoes an acquire().
+func (s *replicatingStore) release(unrecorded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if unrecorded {
+		s.unrecorded--
+		if s.unrecorded == 0 && s.unrecordedDone != nil {
+			close(s.unrecordedDone)
+			s.unrecordedDone = nil
+		}
+	}
+	if s.active == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// waitWhilePaused must be called while holding mu, and returns (still holding
+// mu) once we are not paused.
+func (s *replicatingStore) waitWhilePaused() {
+	for s.paused {
+		resumed := s.resumed
+		s.mu.Unlock()
+		<-resumed
+		s.mu.Lock()
+	}
+}
+
+// pause stops new operations from starting, and waits for current ones to
+// complete. Returns false without pausing if we have been closed. You must
+// call resume() afterwards.
+func (s *replicatingStore) pause() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitWhilePaused()
+	if s.closed {
+		return false
+	}
+	s.paused = true
+	s.resumed = make(chan struct{})
+	for s.active > 0 {
+		drained := make(chan struct{})
+		s.drained = drained
+		s.mu.Unlock()
+		<-drained
+		s.mu.Lock()
+	}
+	return true
+}
+
+// resume lets operations continue after a pause(), using the given store from
+// now on, if not nil.
+func (s *replicatingStore) resume(store dbStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if store != nil {
+		s.dbStore = store
+	}
+	s.paused = false
+	close(s.resumed)
+}
+
+// startCapture starts keeping every subsequent change, for retrieval with
+// takeCaptured(). It returns once all updates that started before capturing
+// began have completed, so that a copy of the database made after this returns
+// plus the captured changes will be complete.
+func (s *replicatingStore) startCapture() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capturing = true
+	s.captured = nil
+	for s.unrecorded > 0 {
+		done := make(chan struct{})
+		s.unrecordedDone = done
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+}
+
+// takeCaptured returns the changes captured since the last call, optionally
+// stopping the capture.
+func (s *replicatingStore) takeCaptured(stop bool) []*dbChangeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	captured := s.captured
+	s.captured = nil
+	if stop {
+		s.capturing = false
+	}
+	return captured
+}
+
+// changesSince returns the change sets after seq, waiting up to wait for there
+// to be some. If id isn't ours, or the changes after seq are no longer in our
+// log, ok will be false and the caller should send a complete copy of the
+// database instead: current will then be a sequence number that is safe for
+// that copy, since replaying changes that are already in it has no effect.
+func (s *replicatingStore) changesSince(id string, seq uint64, wait time.Duration) (changes []*dbChangeSet, current uint64, ok bool, err error) {
+	s.mu.Lock()
+	s.lastRequest = time.Now()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, 0, false, Error{"replicate", "", ErrClosedStop}
+	}
+
+	if id != s.id || seq > s.seq || !s.recording || (seq < s.seq && (len(s.log) == 0 || s.log[0].Seq > seq+1)) {
+		s.recording = true
+		current = s.seq
+		s.mu.Unlock()
+		return nil, current, false, nil
+	}
+
+	if seq == s.seq {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return nil, 0, false, Error{"replicate", "", ErrClosedStop}
+		}
+		if s.seq > seq && (len(s.log) == 0 || s.log[0].Seq > seq+1) {
+			s.recording = true
+			current = s.seq
+			s.mu.Unlock()
+			return nil, current, false, nil
+		}
+	}
+	defer s.mu.Unlock()
+
+	for _, cs := range s.log {
+		if cs.Seq > seq {
+			changes = append(changes, cs)
+		}
+	}
+	return changes, s.seq, true, nil
+}
+
+// stopReplicating makes any current and future changesSince() calls return
+// immediately with an error, and removes any snapshots.
+func (s *replicatingStore) stopReplicating() {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	for id := range s.snapshots {
+		s.removeSnapshot(id)
+	}
+}
+
+// createSnapshot makes a complete copy of the database in dir for a standby to
+// fetch with snapshotChunk(), returning its id and size. Snapshots that
+// haven't been used for replicationIdleTime are removed.
+func (s *replicatingStore) createSnapshot(dir string) (string, int64, error) {
+	s.snapshotMu.Lock()
+	for id, snap := range s.snapshots {
+		if time.Since(snap.lastUsed) > replicationIdleTime {
+			s.removeSnapshot(id)
+		}
+	}
+	s.snapshotMu.Unlock()
+
+	f, err := os.CreateTemp(dir, ".wr_replica_snapshot.*")
+	if err != nil {
+		return "", 0, err
+	}
+	path := f.Name()
+	err = s.backup(f)
+	errc := f.Close()
+	if err == nil {
+		err = errc
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, err
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	if s.stopped {
+		os.Remove(path)
+		return "", 0, Error{"replicate", "", ErrClosedStop}
+	}
+	id := uuid.Must(uuid.NewV4()).String()
+	s.snapshots[id] = &replicaSnapshot{path: path, size: info.Size(), lastUsed: time.Now()}
+	return id, info.Size(), nil
+}
+
+// snapshotChunk returns up to replicationChunkSize bytes of the snapshot with
+// the given id, starting at offset. The snapshot is removed once its last
+// chunk has been read.
+func (s *replicatingStore) snapshotChunk(id string, offset int64) ([]byte, error) {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+	snap, exists := s.snapshots[id]
+	if !exists || offset < 0 || offset > snap.size {
+		return nil, Error{"replicate", id, ErrBadRequest}
+	}
+	snap.lastUsed = time.Now()
+
+	f, err := os.Open(snap.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n := snap.size - offset
+	if n > int64(replicationChunkSize) {
+		n = int64(replicationChunkSize)
+	}
+	chunk := make([]byte, n)
+	_, err = f.ReadAt(chunk, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if offset+n == snap.size {
+		s.removeSnapshot(id)
+	}
+	return chunk, nil
+}
+
+// removeSnapshot deletes the snapshot with the given id. You must hold
+// snapshotMu.
+func (s *replicatingStore) removeSnapshot(id string) {
+	os.Remove(s.snapshots[id].path)
+	delete(s.snapshots, id)
+}
+
+// recordingTx is the dbTx of a replicatingStore, recording puts and deletes.
+type recordingTx struct {
+	dbTx
+	changes []*dbChange
+}
+
+// put implements dbTx.
+func (t *recordingTx) put(bucket, key, val []byte) error {
+	err := t.dbTx.put(bucket, key, val)
+	if err == nil {
+		t.changes = append(t.changes, &dbChange{Bucket: bucket, Key: copyBytes(key), Value: copyBytes(val)})
+	}
+	return err
+}
+
+// delete implements dbTx.
+func (t *recordingTx) delete(bucket, key []byte) error {
+	err := t.dbTx.delete(bucket, key)
+	if err == nil {
+		t.changes = append(t.changes, &dbChange{Bucket: bucket, Key: copyBytes(key), Delete: true})
+	}
+	return err
+}
+
+// copyBytes returns a copy of b, which will be non-nil.
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// replicate returns a serverResponse for a standby that has seen the change
+// with the given sequence number of the database with the given id. It holds
+// either the subsequent changes, or the id and size of a snapshot of the
+// complete database, to be fetched with replicateChunk().
+func (s *Server) replicate(id string, seq uint64, wait time.Duration) (*serverResponse, error) {
+	rs := s.db.replication
+	if wait <= 0 || wait > ReplicationWaitTime {
+		wait = ReplicationWaitTime
+	}
+
+	changes, current, ok, err := rs.changesSince(id, seq, wait)
+	if err != nil {
+		return nil, err
+	}
+	sr := &serverResponse{ReplicaID: rs.id, ReplicaSeq: current, DBBackend: s.db.backend}
+	if ok {
+		sr.DBChanges = changes
+		return sr, nil
+	}
+
+	sr.ReplicaSnapshot, sr.ReplicaSize, err = rs.createSnapshot(filepath.Dir(s.db.path))
+	if err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// replicateChunk returns a serverResponse holding the chunk of the snapshot
+// with the given id that starts at offset.
+func (s *Server) replicateChunk(id string, offset int64) (*serverResponse, error) {
+	chunk, err := s.db.replication.snapshotChunk(id, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &serverResponse{DB: chunk}, nil
+}
+
+// StandbyConfig is supplied to Standby() to configure it.
+type StandbyConfig struct {
+	// PrimaryAddr is the host:port of the server to replicate.
+	PrimaryAddr string
+
+	// CAFile, CertDomain and Token are used to connect to the primary, as per
+	// Connect().
+	CAFile     string
+	CertDomain string
+	Token      []byte
+
+	// DBFile is where the replica of the primary's database will be kept. Any
+	// existing file will be replaced. It should be the ServerConfig.DBFile you
+	// will Serve() with if Standby() returns nil.
+	DBFile string
+
+	// DBBackend must match the primary's ServerConfig.DBBackend.
+	DBBackend string
+
+	// Timeout is how long the primary must be unresponsive for before
+	// Standby() returns, so that you can take over.
+	Timeout time.Duration
+
+	// Logger is a logger object that will be used to log useful info.
+	Logger log15.Logger
+}
+
+// Standby connects to the server at config.PrimaryAddr and continuously
+// replicates its database to config.DBFile, blocking until the primary has
+// stopped responding for config.Timeout. It then returns nil, and you should
+// Serve() using config.DBFile (with the same port and, if you use them, cert
+// domain as the primary), whereupon the incomplete jobs of the primary will be
+// recovered and its runners will be able to reconnect.
+//
+// Note that the primary stopping for any reason, including being deliberately
+// stopped or drained, is treated as it having become unresponsive.
+//
+// If the initial copy of the primary's database can't be obtained within
+// config.Timeout, returns an Error with Err ErrNoServer. If we receive SIGINT
+// or SIGTERM, returns an Error with Err ErrClosedInt or ErrClosedTerm.
+func Standby(config StandbyConfig) error {
+	logger := config.Logger
+	if logger == nil {
+		logger = log15.New()
+		logger.SetHandler(log15.DiscardHandler())
+	} else {
+		logger = logger.New()
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	sb := &standby{config: config, Logger: logger}
+	defer sb.close()
+
+	lastContact := time.Now()
+	for {
+		err := sb.sync()
+		if err == nil {
+			lastContact = time.Now()
+			continue
+		}
+
+		if time.Since(lastContact) >= config.Timeout {
+			if sb.store == nil {
+				return Error{"Standby", config.PrimaryAddr, ErrNoServer}
+			}
+			sb.Warn("primary unresponsive, taking over", "primary", config.PrimaryAddr, "err", err)
+			return nil
+		}
+		if jqerr, ok := err.(Error); ok && jqerr.Op == "Standby" {
+			return err
+		}
+		sb.Debug("failed to get changes from primary", "primary", config.PrimaryAddr, "err", err)
+
+		select {
+		case sig := <-sigs:
+			reason := ErrClosedInt
+			if sig == syscall.SIGTERM {
+				reason = ErrClosedTerm
+			}
+			return Error{"Standby", config.PrimaryAddr, reason}
+		case <-time.After(standbyRetryTime):
+		}
+	}
+}
+
+// standby holds the state of Standby().
+type standby struct {
+	config StandbyConfig
+	client *Client
+	store  dbStore
+	id     string
+	seq    uint64
+	log15.Logger
+}
+
+// sync gets the next lot of changes from the primary and applies them to our
+// replica.
+func (sb *standby) sync() error {
+	if sb.client == nil {
+		client, err := Connect(sb.config.PrimaryAddr, sb.config.CAFile, sb.config.CertDomain, sb.config.Token, ReplicationWaitTime+sb.config.Timeout)
+		if err != nil {
+			return err
+		}
+		sb.client = client
+	}
+
+	resp, err := sb.client.replicate(sb.id, sb.seq, ReplicationWaitTime)
+	if err != nil {
+		sb.disconnect()
+		return err
+	}
+
+	if resp.DBBackend != sb.config.DBBackend && !(resp.DBBackend == DBBackendBolt && sb.config.DBBackend == "") {
+		return Error{"Standby", sb.config.PrimaryAddr, ErrStandbyBackend}
+	}
+
+	if resp.ReplicaSnapshot != "" {
+		tmpPath := sb.config.DBFile + ".tmp"
+		defer os.Remove(tmpPath)
+		writeFailed, errf := sb.fetch(resp.ReplicaSnapshot, resp.ReplicaSize, tmpPath)
+		if errf != nil {
+			if writeFailed {
+				sb.Error("writing copy of primary's database failed", "err", errf)
+				return Error{"Standby", tmpPath, ErrDBError}
+			}
+			sb.disconnect()
+			return errf
+		}
+
+		err = sb.replace(tmpPath)
+		if err != nil {
+			sb.Error("replacing replica database failed", "err", err)
+			return Error{"Standby", sb.config.DBFile, ErrDBError}
+		}
+		sb.Info("got a complete copy of the primary's database", "seq", resp.ReplicaSeq)
+	} else {
+		for _, cs := range resp.DBChanges {
+			err = sb.store.update(cs.apply)
+			if err != nil {
+				sb.Error("updating replica database failed", "err", err)
+				return Error{"Standby", sb.config.DBFile, ErrDBError}
+			}
+		}
+	}
+
+	sb.id = resp.ReplicaID
+	sb.seq = resp.ReplicaSeq
+	return nil
+}
+
+// fetch gets the primary's snapshot with the given id and size in chunks,
+// writing it to path. If there's an error, writeFailed tells you if it was
+// due to writing the file, as opposed to getting the chunks.
+func (sb *standby) fetch(id string, size int64, path string) (writeFailed bool, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, dbFilePermission)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		errc := f.Close()
+		if err == nil && errc != nil {
+			writeFailed, err = true, errc
+		}
+	}()
+
+	var offset int64
+	for offset < size {
+		chunk, errr := sb.client.replicateChunk(id, offset)
+		if errr != nil {
+			return false, errr
+		}
+		if len(chunk) == 0 {
+			return false, Error{"replicate", id, ErrBadRequest}
+		}
+		_, err = f.Write(chunk)
+		if err != nil {
+			return true, err
+		}
+		offset += int64(len(chunk))
+	}
+	return false, nil
+}
+
+// replace makes our replica the database file at the given path, moving it in
+// to place.
+func (sb *standby) replace(path string) error {
+	if sb.store != nil {
+		err := sb.store.close()
+		sb.store = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	err := removeDBFile(sb.config.DBFile)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, sb.config.DBFile)
+	if err != nil {
+		return err
+	}
+
+	sb.store, err = openDBStore(sb.config.DBBackend, sb.config.DBFile)
+	return err
+}
+
+// disconnect disconnects our client, if any.
+func (sb *standby) disconnect() {
+	if sb.client == nil {
+		return
+	}
+	err := sb.client.Disconnect()
+	if err != nil {
+		sb.Debug("disconnecting from primary failed", "err", err)
+	}
+	sb.client = nil
+}
+
+// close disconnects and closes our replica, so that it can be Serve()d.
+func (sb *standby) close() {
+	sb.disconnect()
+	if sb.store != nil {
+		err := sb.store.close()
+		if err != nil {
+			sb.Warn("closing replica database failed", "err", err)
+		}
+	}
+}
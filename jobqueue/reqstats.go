@@ -0,0 +1,511 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for inspecting and managing the observations of
+// job resource usage that our recommendations (see recommend.go) are based on.
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reqStatsHistogramBins is the number of bins in ResourceStats.Histogram.
+const reqStatsHistogramBins = 10
+
+// reqStatsPercentiles are the percentiles given in ResourceStats.Percentiles.
+var reqStatsPercentiles = []int{50, 75, 90, 95, 99}
+
+// ReqGroupStats describes what we've learned about the resource usage of the
+// jobs in a ReqGroup.
+type ReqGroupStats struct {
+	ReqGroup string
+
+	// Resources has an entry for each resource we've observed the usage of,
+	// in the order memory, disk, time.
+	Resources []*ResourceStats
+}
+
+// ResourceStats describes the observed usage of a resource by the jobs of a
+// ReqGroup. Memory and disk values are in MB, time values are in seconds.
+type ResourceStats struct {
+	// Resource is one of the ReqGroupResource* constants.
+	Resource string
+
+	Count  int
+	Oldest time.Time
+	Newest time.Time
+	Min    int
+	Max    int
+
+	// Percentiles are keyed on percentile (50, 75, 90, 95 and 99), and treat
+	// all observations equally, regardless of age.
+	Percentiles map[int]int
+
+	// Histogram splits the range Min..Max in to equal sized bins.
+	Histogram []*HistogramBin
+
+	// Recommendation is how much would currently be reserved for a job in
+	// the ReqGroup that doesn't have a SizeHint.
+	Recommendation int
+}
+
+// HistogramBin is a bin of ResourceStats.Histogram, counting the observations
+// with values between From and To, inclusive.
+type HistogramBin struct {
+	From  int
+	To    int
+	Count int
+}
+
+// ReqGroupStatsFilter describes which of the observations of a ReqGroup's
+// resource usage you want to remove with Client.RemoveReqGroupStats().
+type ReqGroupStatsFilter struct {
+	// ReqGroup is required.
+	ReqGroup string
+
+	// Resource is one of the ReqGroupResource* constants; blank means all
+	// resources.
+	Resource string
+
+	// Since and Until, if not zero, restrict the removal to observations of
+	// jobs that ended in this time range (inclusive).
+	Since time.Time
+	Until time.Time
+}
+
+// ReqGroupObservation is an observation of the resource usage of a single run
+// of a job, as supplied to Client.SeedReqGroupStats().
+type ReqGroupObservation struct {
+	ReqGroup string `json:"req_grp"`
+
+	// Resource is one of the ReqGroupResource* constants.
+	Resource string `json:"resource"`
+
+	// Value is the amount of Resource used, in MB for memory and disk, or
+	// seconds for time.
+	Value int `json:"value"`
+
+	// Predicted is the amount of Resource that was reserved for the job, if
+	// known.
+	Predicted int `json:"predicted"`
+
+	SizeHint float64 `json:"size_hint"`
+
+	// End is when the job ended. Defaults to now.
+	End time.Time `json:"end_time"`
+
+	// Key is the key of the job. Observations with the same ReqGroup,
+	// Resource, End and Key replace each other, so seeding the same
+	// observations twice doesn't count them twice. If blank, a unique key is
+	// used.
+	Key string `json:"key"`
+}
+
+// validate checks that this observation can be stored.
+func (o *ReqGroupObservation) validate() error {
+	if _, known := resourceBuckets[o.Resource]; !known {
+		return Error{"seedReqGroupStats", o.ReqGroup, ErrBadResource}
+	}
+	if o.ReqGroup == "" || strings.Contains(o.ReqGroup, dbDelimiter) || o.Value < 0 || o.Predicted < 0 || o.SizeHint < 0 {
+		return Error{"seedReqGroupStats", o.ReqGroup, ErrBadObservation}
+	}
+	return nil
+}
+
+// reqGroupStats returns stats on the observed resource usage of the jobs in
+// the given ReqGroup, or of all ReqGroups if reqGroup is blank, sorted by
+// ReqGroup.
+func (db *db) reqGroupStats(reqGroup string) ([]*ReqGroupStats, error) {
+	var prefix []byte
+	if reqGroup != "" {
+		prefix = []byte(reqGroup + dbDelimiter)
+	}
+
+	byGroup := make(map[string]map[string][]*resourceObservation)
+	err := db.storage.view(func(tx dbTx) error {
+		for resource, bucket := range resourceBuckets {
+			errs := tx.seek(bucket, nil, prefix, func(k, v []byte) (bool, error) {
+				o, errp := parseResourceObservation(k, v)
+				if errp != nil {
+					return false, errp
+				}
+				rg := strings.SplitN(string(k), dbDelimiter, 2)[0]
+				if byGroup[rg] == nil {
+					byGroup[rg] = make(map[string][]*resourceObservation)
+				}
+				byGroup[rg][resource] = append(byGroup[rg][resource], o)
+				return true, nil
+			})
+			if errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mbRound, secRound, halfLife := db.recommendationSettings()
+	now := time.Now()
+	stats := make([]*ReqGroupStats, 0, len(byGroup))
+	for rg, resources := range byGroup {
+		rgs := &ReqGroupStats{ReqGroup: rg}
+		for _, resource := range []string{ReqGroupResourceMemory, ReqGroupResourceDisk, ReqGroupResourceTime} {
+			obs := resources[resource]
+			if len(obs) == 0 {
+				continue
+			}
+			round := mbRound
+			if resource == ReqGroupResourceTime {
+				round = secRound
+			}
+			rs := newResourceStats(resource, obs)
+			rs.Recommendation = newResourceRecommender(obs, round, halfLife, now).recommend(0)
+			rgs.Resources = append(rgs.Resources, rs)
+		}
+		stats = append(stats, rgs)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ReqGroup < stats[j].ReqGroup
+	})
+	return stats, nil
+}
+
+// newResourceStats summarises the given observations, which must not be
+// empty. Does not set Recommendation.
+func newResourceStats(resource string, obs []*resourceObservation) *ResourceStats {
+	values := make([]int, len(obs))
+	rs := &ResourceStats{Resource: resource, Count: len(obs), Oldest: obs[0].End, Newest: obs[0].End}
+	for i, o := range obs {
+		values[i] = o.Value
+		if o.End.Before(rs.Oldest) {
+			rs.Oldest = o.End
+		}
+		if o.End.After(rs.Newest) {
+			rs.Newest = o.End
+		}
+	}
+	sort.Ints(values)
+	rs.Min, rs.Max = values[0], values[len(values)-1]
+
+	rs.Percentiles = make(map[int]int, len(reqStatsPercentiles))
+	for _, p := range reqStatsPercentiles {
+		rank := int(math.Ceil(float64(p) / 100 * float64(len(values))))
+		if rank < 1 {
+			rank = 1
+		}
+		rs.Percentiles[p] = values[rank-1]
+	}
+
+	width := int(math.Ceil(float64(rs.Max-rs.Min+1) / reqStatsHistogramBins))
+	for from := rs.Min; from <= rs.Max; from += width {
+		rs.Histogram = append(rs.Histogram, &HistogramBin{From: from, To: from + width - 1})
+	}
+	for _, v := range values {
+		rs.Histogram[(v-rs.Min)/width].Count++
+	}
+	return rs
+}
+
+// removeReqGroupStats deletes the observations of resource usage that match
+// the given filter, returning the number deleted.
+func (db *db) removeReqGroupStats(filter *ReqGroupStatsFilter) (int, error) {
+	if filter.ReqGroup == "" {
+		return 0, Error{"removeReqGroupStats", "", ErrBadRequest}
+	}
+
+	buckets := make([][]byte, 0, len(resourceBuckets))
+	if filter.Resource == "" {
+		for _, bucket := range resourceBuckets {
+			buckets = append(buckets, bucket)
+		}
+	} else {
+		bucket, known := resourceBuckets[filter.Resource]
+		if !known {
+			return 0, Error{"removeReqGroupStats", filter.ReqGroup, ErrBadResource}
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	prefix := filter.ReqGroup + dbDelimiter
+	var start []byte
+	if !filter.Since.IsZero() {
+		start = []byte(prefix + fmt.Sprintf("%0*d", historyTimeWidth, filter.Since.UnixNano()))
+	}
+	var until string
+	if !filter.Until.IsZero() {
+		until = fmt.Sprintf("%0*d", historyTimeWidth, filter.Until.UnixNano())
+	}
+
+	removed := 0
+	for _, bucket := range buckets {
+		var keys [][]byte
+		err := db.storage.view(func(tx dbTx) error {
+			return tx.seek(bucket, start, []byte(prefix), func(k, v []byte) (bool, error) {
+				if until != "" {
+					pos := string(k[len(prefix):])
+					if len(pos) >= historyTimeWidth && pos[:historyTimeWidth] > until {
+						return false, nil
+					}
+				}
+				keys = append(keys, copyBytes(k))
+				return true, nil
+			})
+		})
+		if err != nil {
+			return removed, err
+		}
+
+		for len(keys) > 0 {
+			batch := keys
+			if len(batch) > retentionBatchSize {
+				batch = keys[:retentionBatchSize]
+			}
+			keys = keys[len(batch):]
+
+			err = db.storage.update(func(tx dbTx) error {
+				for _, k := range batch {
+					errd := tx.delete(bucket, k)
+					if errd != nil {
+						return errd
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return removed, err
+			}
+			removed += len(batch)
+		}
+	}
+
+	if removed > 0 {
+		db.backgroundBackup()
+	}
+	return removed, nil
+}
+
+// seedReqGroupStats stores the given observations of resource usage, as if
+// they had been observed from jobs we ran. Returns the number stored.
+func (db *db) seedReqGroupStats(observations []*ReqGroupObservation) (int, error) {
+	for _, o := range observations {
+		if err := o.validate(); err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now()
+	entries := make(map[string]sobsd)
+	for i, o := range observations {
+		end := o.End
+		if end.IsZero() {
+			end = now
+		}
+		key := o.Key
+		if key == "" {
+			key = fmt.Sprintf("seeded%d.%d", now.UnixNano(), i)
+		}
+		ro := &resourceObservation{Value: o.Value, Predicted: o.Predicted, Hint: o.SizeHint}
+		bucket := string(resourceBuckets[o.Resource])
+		entries[bucket] = append(entries[bucket], [2][]byte{resourceObservationKey(o.ReqGroup, end, key), ro.encode()})
+	}
+
+	for bucket, kvs := range entries {
+		for len(kvs) > 0 {
+			batch := kvs
+			if len(batch) > retentionBatchSize {
+				batch = kvs[:retentionBatchSize]
+			}
+			kvs = kvs[len(batch):]
+
+			err := putBatch(db.storage, []byte(bucket), batch)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(observations) > 0 {
+		db.backgroundBackup()
+	}
+	return len(observations), nil
+}
+
+// ReadReqGroupObservations reads jobs in the given format, as written by a
+// JobExporter (eg. by `wr export`), and returns the resource usage
+// observations they represent, suitable for passing to
+// Client.SeedReqGroupStats(). As when jobs run, complete jobs give an
+// observation of each resource, while jobs that failed for using too much of a
+// resource give an observation of just that resource. Other jobs are ignored.
+//
+// If reqGroup is not blank, it is used as the ReqGroup of every observation,
+// instead of the jobs' own req_group.
+func ReadReqGroupObservations(r io.Reader, format ExportFormat, reqGroup string) ([]*ReqGroupObservation, error) {
+	var rows []map[string]string
+	switch format {
+	case ExportFormatCSV:
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			row := make(map[string]string, len(header))
+			for i, column := range header {
+				if i < len(record) {
+					row[column] = record[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	case ExportFormatJSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var obj map[string]interface{}
+			err := json.Unmarshal([]byte(line), &obj)
+			if err != nil {
+				return nil, err
+			}
+			row := make(map[string]string, len(obj))
+			for column, val := range obj {
+				row[column] = fmt.Sprint(val)
+			}
+			rows = append(rows, row)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format '%s'", format)
+	}
+
+	var observations []*ReqGroupObservation
+	for i, row := range rows {
+		obs, err := exportRowObservations(row, reqGroup)
+		if err != nil {
+			return nil, fmt.Errorf("job %d: %w", i+1, err)
+		}
+		observations = append(observations, obs...)
+	}
+	return observations, nil
+}
+
+// exportRowObservations returns the observations represented by a row of
+// exported job data, keyed on the names of our exportColumns.
+func exportRowObservations(row map[string]string, reqGroup string) ([]*ReqGroupObservation, error) {
+	var resources []string
+	switch {
+	case row["state"] == string(JobStateComplete):
+		resources = []string{ReqGroupResourceMemory, ReqGroupResourceDisk, ReqGroupResourceTime}
+	case row["fail_reason"] == FailReasonRAM:
+		resources = []string{ReqGroupResourceMemory}
+	case row["fail_reason"] == FailReasonDisk:
+		resources = []string{ReqGroupResourceDisk}
+	case row["fail_reason"] == FailReasonTime:
+		resources = []string{ReqGroupResourceTime}
+	default:
+		return nil, nil
+	}
+
+	if reqGroup == "" {
+		reqGroup = row["req_group"]
+	}
+
+	num := func(column string) (float64, error) {
+		if row[column] == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseFloat(row[column], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s: %w", column, err)
+		}
+		return n, nil
+	}
+
+	var end time.Time
+	if row["end_time"] != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, row["end_time"])
+		if err != nil {
+			return nil, fmt.Errorf("bad end_time: %w", err)
+		}
+	}
+
+	hint, err := num("size_hint")
+	if err != nil {
+		return nil, err
+	}
+
+	observations := make([]*ReqGroupObservation, 0, len(resources))
+	for _, resource := range resources {
+		var valueColumn, predictedColumn string
+		predictedMultiplier := 1.0
+		switch resource {
+		case ReqGroupResourceMemory:
+			valueColumn, predictedColumn = "peak_memory_mb", "req_memory_mb"
+		case ReqGroupResourceDisk:
+			valueColumn, predictedColumn = "peak_disk_mb", "req_disk_gb"
+			predictedMultiplier = 1024
+		case ReqGroupResourceTime:
+			valueColumn, predictedColumn = "wall_time_secs", "req_time_secs"
+		}
+
+		value, err := num(valueColumn)
+		if err != nil {
+			return nil, err
+		}
+		predicted, err := num(predictedColumn)
+		if err != nil {
+			return nil, err
+		}
+
+		observations = append(observations, &ReqGroupObservation{
+			ReqGroup:  reqGroup,
+			Resource:  resource,
+			Value:     int(math.Ceil(value)),
+			Predicted: int(math.Ceil(predicted * predictedMultiplier)),
+			SizeHint:  hint,
+			End:       end,
+			Key:       row["key"],
+		})
+	}
+	return observations, nil
+}
@@ -31,6 +31,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -74,6 +75,7 @@ func TestREST(t *testing.T) {
 		CertDomain:      config.ManagerCertDomain,
 		KeyFile:         config.ManagerKeyFile,
 		Deployment:      config.Deployment,
+		CostRates:       &CostRates{CoreHour: 3600},
 		Logger:          testLogger,
 	}
 	addr := "localhost:" + config.ManagerPort
@@ -82,6 +84,14 @@ func TestREST(t *testing.T) {
 	uploadEndPoint := baseURL + "/rest/v1/upload"
 	warningsEndPoint := baseURL + "/rest/v1/warnings/"
 	serversEndPoint := baseURL + "/rest/v1/servers/"
+	retryEndPoint := baseURL + "/rest/v1/retry/"
+	killEndPoint := baseURL + "/rest/v1/kill/"
+	managerEndPoint := baseURL + "/rest/v1/manager/"
+	limitsEndPoint := baseURL + "/rest/v1/limits/"
+	reqsEndPoint := baseURL + "/rest/v1/reqs/"
+	accuracyEndPoint := baseURL + "/rest/v1/accuracy/"
+	budgetsEndPoint := baseURL + "/rest/v1/budgets/"
+	graphEndPoint := baseURL + "/rest/v1/graph/"
 
 	setDomainIP(config.ManagerCertDomain)
 
@@ -272,6 +282,175 @@ func TestREST(t *testing.T) {
 				})
 			})
 
+			Convey("You can GET the dependency graph of jobs by RepGroup", func() {
+				getGraph := func(query string) (int, []byte) {
+					req, err := http.NewRequest(http.MethodGet, graphEndPoint+"rp1"+query, nil)
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err := client.Do(req)
+					So(err, ShouldBeNil)
+					responseData, err := io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+					return response.StatusCode, responseData
+				}
+
+				status, data := getGraph("")
+				So(status, ShouldEqual, http.StatusOK)
+				var g DependencyGraph
+				err := json.Unmarshal(data, &g)
+				So(err, ShouldBeNil)
+				So(len(g.Nodes), ShouldEqual, 2)
+				So(g.Nodes[0].State, ShouldEqual, JobStateReady)
+				So(len(g.Edges), ShouldEqual, 0)
+
+				status, data = getGraph("?format=dot")
+				So(status, ShouldEqual, http.StatusOK)
+				So(string(data), ShouldStartWith, "digraph wr {")
+				So(string(data), ShouldContainSubstring, "de6d167c58701e55f5b9f9e1e91d7807")
+
+				status, data = getGraph("?format=mermaid")
+				So(status, ShouldEqual, http.StatusOK)
+				So(string(data), ShouldStartWith, "flowchart TD")
+
+				status, _ = getGraph("?format=png")
+				So(status, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("You can PATCH jobs to modify them", func() {
+				jsonValue, err := json.Marshal(map[string]interface{}{"priority": 5, "memory": "2G", "limit_grps": []string{"l1:3"}})
+				So(err, ShouldBeNil)
+				req, err := http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp1", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+				responseData, err = io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				var jstati []JStatus
+				err = json.Unmarshal(responseData, &jstati)
+				So(err, ShouldBeNil)
+				So(len(jstati), ShouldEqual, 2)
+				for _, j := range jstati {
+					So(j.RepGroup, ShouldEqual, "rp1")
+					So(j.ExpectedRAM, ShouldEqual, 2048)
+					So(j.LimitGroups, ShouldResemble, []string{"l1"})
+				}
+
+				job, _, qerr := server.getJobsByKeys([]string{"de6d167c58701e55f5b9f9e1e91d7807"}, false, false)
+				So(qerr, ShouldBeEmpty)
+				So(len(job), ShouldEqual, 1)
+				So(job[0].Priority, ShouldEqual, 5)
+				So(server.limiter.GetLimit("l1"), ShouldEqual, 3)
+
+				Convey("Modifying the cmd changes the job key", func() {
+					jsonValue, err = json.Marshal(map[string]interface{}{"cmd": "echo 1b && true"})
+					So(err, ShouldBeNil)
+					req, err = http.NewRequest(http.MethodPatch, jobsEndPoint+"/de6d167c58701e55f5b9f9e1e91d7807", bytes.NewBuffer(jsonValue))
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err = client.Do(req)
+					So(err, ShouldBeNil)
+					So(response.StatusCode, ShouldEqual, http.StatusOK)
+					responseData, err = io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					jstati = []JStatus{}
+					err = json.Unmarshal(responseData, &jstati)
+					So(err, ShouldBeNil)
+					So(len(jstati), ShouldEqual, 1)
+					So(jstati[0].Cmd, ShouldEqual, "echo 1b && true")
+					So(jstati[0].Key, ShouldNotEqual, "de6d167c58701e55f5b9f9e1e91d7807")
+				})
+
+				Convey("But you can't modify the cmd of multiple jobs", func() {
+					jsonValue, err = json.Marshal(map[string]interface{}{"cmd": "echo 1b && true"})
+					So(err, ShouldBeNil)
+					req, err = http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp1", bytes.NewBuffer(jsonValue))
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err = client.Do(req)
+					So(err, ShouldBeNil)
+					So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+					responseData, err = io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					var restErr RESTError
+					err = json.Unmarshal(responseData, &restErr)
+					So(err, ShouldBeNil)
+					So(restErr.Error, ShouldContainSubstring, "cmd can only be modified for 1 job")
+				})
+			})
+
+			Convey("Invalid requests get field-level errors", func() {
+				getFieldErrors := func(method, url string, body []byte) []RESTFieldError {
+					req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+					So(err, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err := client.Do(req)
+					So(err, ShouldBeNil)
+					So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+					responseData, err := io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					var restErr RESTError
+					err = json.Unmarshal(responseData, &restErr)
+					So(err, ShouldBeNil)
+					So(restErr.Status, ShouldEqual, http.StatusBadRequest)
+					So(restErr.Error, ShouldStartWith, "invalid request: ")
+					return restErr.Fields
+				}
+
+				fes := getFieldErrors(http.MethodGet, jobsEndPoint+"/rp1?state=foo&limit=-1&std=yes&bar=1", nil)
+				So(fes, ShouldResemble, []RESTFieldError{
+					{In: "query", Field: "std", Error: "value (yes) must be true or false"},
+					{In: "query", Field: "limit", Error: "value (-1) must be at least 0"},
+					{In: "query", Field: "state", Error: "value (foo) must be one of delayed|ready|reserved|running|lost|buried|dependent|complete|deletable"},
+				})
+
+				req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/rp1?bar=1", nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusOK)
+
+				fes = getFieldErrors(http.MethodPost, jobsEndPoint+"/?memory=lots&on_failure="+url.QueryEscape(`[{"run":1}]`),
+					[]byte(`[{"cmd":"echo a","memory":"1G"},{"cmd":"echo b","priority":300,"time":"long","cpus":"2","foo":true,"mounts":[{"Targets":[{"Path":"b","Write":"yes"}]}]}]`))
+				So(fes, ShouldResemble, []RESTFieldError{
+					{In: "query", Field: "memory", Error: "value (lots) must be a number with a unit suffix, eg. 1G"},
+					{In: "query", Field: "on_failure[0].run", Error: "must be a string"},
+					{In: "body", Field: "[1].cpus", Error: "must be a number"},
+					{In: "body", Field: "[1].foo", Error: "unknown property"},
+					{In: "body", Field: "[1].mounts[0].Targets[0].Write", Error: "must be true or false"},
+					{In: "body", Field: "[1].priority", Error: "value (300) is not in the range 0..255"},
+					{In: "body", Field: "[1].time", Error: "value (long) must be a duration with a unit suffix, eg. 1h"},
+				})
+
+				fes = getFieldErrors(http.MethodPatch, jobsEndPoint+"/rp1", []byte(`{"retries":1.5}`))
+				So(fes, ShouldResemble, []RESTFieldError{{In: "body", Field: "retries", Error: "must be an integer"}})
+
+				fes = getFieldErrors(http.MethodPatch, jobsEndPoint+"/rp1", []byte(`{"retries":`))
+				So(len(fes), ShouldEqual, 1)
+				So(fes[0].In, ShouldEqual, "body")
+				So(fes[0].Error, ShouldStartWith, "must be valid JSON")
+
+				fes = getFieldErrors(http.MethodPost, baseURL+"/rest/v1/manager/foo", nil)
+				So(fes, ShouldResemble, []RESTFieldError{{In: "path", Field: "action", Error: "value (foo) must be one of pause|resume|drain"}})
+			})
+
+			Convey("You can't PATCH with invalid values", func() {
+				jsonValue, err := json.Marshal(map[string]interface{}{"priority": 256})
+				So(err, ShouldBeNil)
+				req, err := http.NewRequest(http.MethodPatch, jobsEndPoint+"/rp1", bytes.NewBuffer(jsonValue))
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err = client.Do(req)
+				So(err, ShouldBeNil)
+				So(response.StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
 			Convey("You can DELETE jobs by RepGroup", func() {
 				req, err := http.NewRequest(http.MethodDelete, jobsEndPoint+"/rp1", nil)
 				So(err, ShouldBeNil)
@@ -282,7 +461,12 @@ func TestREST(t *testing.T) {
 				So(err, ShouldBeNil)
 
 				So(response.Status, ShouldEqual, "400 Bad Request")
-				So(string(responseData), ShouldEqual, "state must be supplied as one of running|lost|deletable\n")
+				var restErr RESTError
+				err = json.Unmarshal(responseData, &restErr)
+				So(err, ShouldBeNil)
+				So(restErr.Error, ShouldEqual, "invalid request: query state: required parameter was not supplied")
+				So(restErr.Status, ShouldEqual, http.StatusBadRequest)
+				So(restErr.Fields, ShouldResemble, []RESTFieldError{{In: "query", Field: "state", Error: "required parameter was not supplied"}})
 
 				req, err = http.NewRequest(http.MethodDelete, jobsEndPoint+"/rp1?state=deletable", nil)
 				So(err, ShouldBeNil)
@@ -360,6 +544,45 @@ func TestREST(t *testing.T) {
 					So(jstati[0].State, ShouldEqual, JobStateBuried)
 				})
 
+				Convey("You can POST to kill running jobs", func() {
+					err = jq.Started(job, 1)
+					So(err, ShouldBeNil)
+
+					req, errr := http.NewRequest(http.MethodPost, killEndPoint+"rp1?confirmdead=true", nil)
+					So(errr, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err = client.Do(req)
+					So(err, ShouldBeNil)
+					responseData, err = io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					var jstati []JStatus
+					err = json.Unmarshal(responseData, &jstati)
+					So(err, ShouldBeNil)
+					So(len(jstati), ShouldEqual, 0)
+
+					req, errr = http.NewRequest(http.MethodPost, killEndPoint+"rp1", nil)
+					So(errr, ShouldBeNil)
+					req.Header.Add("Authorization", bearer)
+					response, err = client.Do(req)
+					So(err, ShouldBeNil)
+					So(response.StatusCode, ShouldEqual, http.StatusAccepted)
+					responseData, err = io.ReadAll(response.Body)
+					So(err, ShouldBeNil)
+
+					err = json.Unmarshal(responseData, &jstati)
+					So(err, ShouldBeNil)
+					So(len(jstati), ShouldEqual, 1)
+					So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+
+					<-time.After(300 * time.Millisecond)
+
+					jobs, _, qerr := server.getJobsByKeys([]string{"db1e7d99becace3306c1c2470331c78e"}, false, false)
+					So(qerr, ShouldBeEmpty)
+					So(len(jobs), ShouldEqual, 1)
+					So(jobs[0].State, ShouldEqual, JobStateBuried)
+				})
+
 				Convey("You can DELETE lost jobs to bury them", func() {
 					err = jq.Started(job, 1)
 					So(err, ShouldBeNil)
@@ -404,6 +627,112 @@ func TestREST(t *testing.T) {
 					So(job.Exited, ShouldBeTrue)
 					So(job.Exitcode, ShouldEqual, 1)
 
+					Convey("You can GET them from the job history", func() {
+						<-time.After(300 * time.Millisecond)
+
+						getHistory := func(query string) JobHistoryPage {
+							req, err := http.NewRequest(http.MethodGet, baseURL+"/rest/v1/history/?"+query, nil)
+							So(err, ShouldBeNil)
+							req.Header.Add("Authorization", bearer)
+							response, err := client.Do(req)
+							So(err, ShouldBeNil)
+							So(response.StatusCode, ShouldEqual, http.StatusOK)
+							responseData, err := io.ReadAll(response.Body)
+							So(err, ShouldBeNil)
+
+							var page JobHistoryPage
+							err = json.Unmarshal(responseData, &page)
+							So(err, ShouldBeNil)
+							return page
+						}
+
+						page := getHistory("exit=1&since=1h&host=" + url.QueryEscape(job.Host))
+						So(len(page.Jobs), ShouldEqual, 1)
+						So(page.Jobs[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+						So(page.Jobs[0].State, ShouldEqual, JobStateBuried)
+						So(page.Jobs[0].Exitcode, ShouldEqual, 1)
+						So(page.Next, ShouldBeBlank)
+
+						page = getHistory("exit=0")
+						So(len(page.Jobs), ShouldEqual, 0)
+
+						page = getHistory("until=1h")
+						So(len(page.Jobs), ShouldEqual, 0)
+
+						getExport := func(query string) string {
+							req, err := http.NewRequest(http.MethodGet, baseURL+"/rest/v1/export/?"+query, nil)
+							So(err, ShouldBeNil)
+							req.Header.Add("Authorization", bearer)
+							response, err := client.Do(req)
+							So(err, ShouldBeNil)
+							So(response.StatusCode, ShouldEqual, http.StatusOK)
+							responseData, err := io.ReadAll(response.Body)
+							So(err, ShouldBeNil)
+							So(response.Trailer.Get("X-Export-Error"), ShouldBeBlank)
+							return string(responseData)
+						}
+
+						exported := getExport("live=true&format=jsonl")
+						So(exported, ShouldStartWith, `{"key":"db1e7d99becace3306c1c2470331c78e",`)
+						So(exported, ShouldContainSubstring, `"state":"buried","exit_code":1,`)
+						So(strings.Count(exported, "\n"), ShouldEqual, 1)
+
+						exported = getExport("live=true")
+						So(exported, ShouldStartWith, "key,rep_group,")
+						So(strings.Count(exported, "\n"), ShouldEqual, 2)
+
+						exported = getExport("")
+						So(strings.Count(exported, "\n"), ShouldEqual, 1)
+
+						user, err := internal.Username()
+						So(err, ShouldBeNil)
+						page = getHistory("exit=1")
+						So(len(page.Jobs), ShouldEqual, 1)
+						So(page.Jobs[0].User, ShouldEqual, user)
+						So(page.Jobs[0].Cost, ShouldBeGreaterThan, 0)
+
+						req, err := http.NewRequest(http.MethodGet, baseURL+"/rest/v1/info/", nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err := client.Do(req)
+						So(err, ShouldBeNil)
+						So(response.StatusCode, ShouldEqual, http.StatusOK)
+						responseData, err := io.ReadAll(response.Body)
+						So(err, ShouldBeNil)
+						var info ServerInfo
+						err = json.Unmarshal(responseData, &info)
+						So(err, ShouldBeNil)
+						So(info.Costs, ShouldNotBeNil)
+						So(info.Costs.RepGroups["rp1"], ShouldEqual, page.Jobs[0].Cost)
+						So(info.Costs.Users[user], ShouldEqual, page.Jobs[0].Cost)
+						So(info.Costs.Total, ShouldEqual, page.Jobs[0].Cost)
+					})
+
+					Convey("You can POST to retry buried jobs", func() {
+						req, err := http.NewRequest(http.MethodGet, retryEndPoint+"rp1", nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err := client.Do(req)
+						So(err, ShouldBeNil)
+						So(response.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+
+						req, err = http.NewRequest(http.MethodPost, retryEndPoint+"rp1", nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err = client.Do(req)
+						So(err, ShouldBeNil)
+						So(response.StatusCode, ShouldEqual, http.StatusOK)
+						responseData, err := io.ReadAll(response.Body)
+						So(err, ShouldBeNil)
+
+						var jstati []JStatus
+						err = json.Unmarshal(responseData, &jstati)
+						So(err, ShouldBeNil)
+						So(len(jstati), ShouldEqual, 1)
+						So(jstati[0].Key, ShouldEqual, "db1e7d99becace3306c1c2470331c78e")
+						So(jstati[0].State, ShouldEqual, JobStateReady)
+					})
+
 					Convey("You can GET all jobs by state, and get their stdout/err", func() {
 						req, err := http.NewRequest(http.MethodGet, jobsEndPoint+"/?state=ready", nil)
 						So(err, ShouldBeNil)
@@ -536,7 +865,11 @@ func TestREST(t *testing.T) {
 			So(response.StatusCode, ShouldEqual, 400)
 			responseData, err := io.ReadAll(response.Body)
 			So(err, ShouldBeNil)
-			So(string(responseData), ShouldEqual, "there was a problem interpreting your job: cmd was not specified\n")
+			var restErr RESTError
+			err = json.Unmarshal(responseData, &restErr)
+			So(err, ShouldBeNil)
+			So(restErr.Error, ShouldEqual, "there was a problem interpreting your job: cmd was not specified")
+			So(restErr.Status, ShouldEqual, http.StatusBadRequest)
 		})
 
 		Convey("You can POST with optional parameters to set new job defaults", func() {
@@ -573,6 +906,26 @@ func TestREST(t *testing.T) {
 			So(jstati[0].Mounts, ShouldEqual, mountJSON)
 		})
 
+		Convey("You can POST jobs with a result cache, taking defaults from optional parameters", func() {
+			inputJobs := []*JobViaJSON{{Cmd: "echo cached", CacheOutputs: []string{"out.idx"}}}
+			jsonValue, err := json.Marshal(inputJobs)
+			So(err, ShouldBeNil)
+			req, err := http.NewRequest(http.MethodPost, jobsEndPoint+"/?cache_dir=/tmp/wr_cache&cache_inputs=in.fa,/ref/in2.fa&cache_outputs=ignored&cache_link=true", bytes.NewBuffer(jsonValue))
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			req.Header.Add("Content-Type", "application/json")
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var jstati []JStatus
+			err = json.Unmarshal(responseData, &jstati)
+			So(err, ShouldBeNil)
+			So(len(jstati), ShouldEqual, 1)
+			So(jstati[0].ResultCache, ShouldEqual, "/tmp/wr_cache (inputs: in.fa, /ref/in2.fa; outputs: out.idx; linked)")
+			So(jstati[0].Cached, ShouldBeFalse)
+		})
+
 		Convey("Trying to POST a job with a non-existent cloud_script fails", func() {
 			cloudScript := filepath.Join(dir, "cloud.script")
 			uploadedScript := filepath.Join(dir, "cloud.script.uploaded")
@@ -678,6 +1031,338 @@ func TestREST(t *testing.T) {
 			})
 		})
 
+		Convey("You can GET the manager status and POST to change its mode", func() {
+			getStatus := func(method, url string) (ManagerStatus, int) {
+				req, err := http.NewRequest(method, url, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				var ms ManagerStatus
+				if response.StatusCode == http.StatusOK {
+					err = json.Unmarshal(responseData, &ms)
+					So(err, ShouldBeNil)
+
+					var raw map[string]interface{}
+					err = json.Unmarshal(responseData, &raw)
+					So(err, ShouldBeNil)
+					So(raw, ShouldContainKey, "mode")
+					So(raw, ShouldContainKey, "etc")
+					So(raw, ShouldNotContainKey, "Mode")
+				}
+				return ms, response.StatusCode
+			}
+
+			ms, status := getStatus(http.MethodGet, managerEndPoint)
+			So(status, ShouldEqual, http.StatusOK)
+			So(ms.Mode, ShouldEqual, ServerModeNormal)
+			So(ms.Running, ShouldEqual, 0)
+			So(ms.ETC, ShouldEqual, "0s")
+
+			ms, status = getStatus(http.MethodPost, managerEndPoint+"pause")
+			So(status, ShouldEqual, http.StatusOK)
+			So(ms.Mode, ShouldEqual, ServerModePause)
+
+			ms, status = getStatus(http.MethodPost, managerEndPoint+"resume")
+			So(status, ShouldEqual, http.StatusOK)
+			So(ms.Mode, ShouldEqual, ServerModeNormal)
+
+			_, status = getStatus(http.MethodPost, managerEndPoint+"foo")
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			ms, status = getStatus(http.MethodPost, managerEndPoint+"drain")
+			So(status, ShouldEqual, http.StatusOK)
+			So(ms.Mode, ShouldEqual, ServerModeDrain)
+		})
+
+		Convey("You can GET and PUT limit groups", func() {
+			doLimit := func(method, url string) (*LimitGroupViaJSON, int) {
+				req, err := http.NewRequest(method, url, nil)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+
+				lg := &LimitGroupViaJSON{}
+				if response.StatusCode == http.StatusOK {
+					err = json.Unmarshal(responseData, lg)
+					So(err, ShouldBeNil)
+				}
+				return lg, response.StatusCode
+			}
+
+			lg, status := doLimit(http.MethodGet, limitsEndPoint+"lg1")
+			So(status, ShouldEqual, http.StatusOK)
+			So(lg.Name, ShouldEqual, "lg1")
+			So(lg.Limit, ShouldEqual, -1)
+
+			lg, status = doLimit(http.MethodPut, limitsEndPoint+"lg1?limit=5")
+			So(status, ShouldEqual, http.StatusOK)
+			So(lg.Limit, ShouldEqual, 5)
+
+			_, status = doLimit(http.MethodPut, limitsEndPoint+"lg1?limit=foo")
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			_, status = doLimit(http.MethodPut, limitsEndPoint+"lg1")
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			_, status = doLimit(http.MethodGet, limitsEndPoint+"lg1:2")
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			req, err := http.NewRequest(http.MethodGet, limitsEndPoint, nil)
+			So(err, ShouldBeNil)
+			req.Header.Add("Authorization", bearer)
+			response, err := client.Do(req)
+			So(err, ShouldBeNil)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+			var limits map[string]int
+			err = json.Unmarshal(responseData, &limits)
+			So(err, ShouldBeNil)
+			So(limits, ShouldResemble, map[string]int{"lg1": 5})
+
+			lg, status = doLimit(http.MethodDelete, limitsEndPoint+"lg1")
+			So(status, ShouldEqual, http.StatusOK)
+			So(lg.Limit, ShouldEqual, -1)
+
+			lg, status = doLimit(http.MethodGet, limitsEndPoint+"lg1")
+			So(status, ShouldEqual, http.StatusOK)
+			So(lg.Limit, ShouldEqual, -1)
+		})
+
+		Convey("You can seed, get and reset learned resource stats", func() {
+			doReqs := func(method, url string, body string) ([]byte, int) {
+				var reader io.Reader
+				if body != "" {
+					reader = strings.NewReader(body)
+				}
+				req, err := http.NewRequest(method, url, reader)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+				return responseData, response.StatusCode
+			}
+
+			data, status := doReqs(http.MethodGet, reqsEndPoint+"rg", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldEqual, "[]\n")
+
+			data, status = doReqs(http.MethodPost, reqsEndPoint, `[{"req_grp":"rg","resource":"memory","value":150,"end_time":"2021-06-29T15:04:05Z","key":"k1"},{"req_grp":"rg","resource":"time","value":20}]`)
+			So(status, ShouldEqual, http.StatusCreated)
+			So(string(data), ShouldContainSubstring, `"added":2`)
+
+			_, status = doReqs(http.MethodPost, reqsEndPoint, `[{"req_grp":"rg","resource":"cpu","value":1}]`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			_, status = doReqs(http.MethodPost, reqsEndPoint, `[{"req_grp":"rg","resource":"memory","value":1,"end_time":"yesterday"}]`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			data, status = doReqs(http.MethodGet, reqsEndPoint, "")
+			So(status, ShouldEqual, http.StatusOK)
+			var stats []*ReqGroupStats
+			err := json.Unmarshal(data, &stats)
+			So(err, ShouldBeNil)
+			So(len(stats), ShouldEqual, 1)
+			So(stats[0].ReqGroup, ShouldEqual, "rg")
+			So(len(stats[0].Resources), ShouldEqual, 2)
+			So(stats[0].Resources[0].Max, ShouldEqual, 150)
+			So(stats[0].Resources[0].Recommendation, ShouldEqual, 200)
+
+			_, status = doReqs(http.MethodDelete, reqsEndPoint+"rg?resource=cpu", "")
+			So(status, ShouldEqual, http.StatusBadRequest)
+			data, status = doReqs(http.MethodDelete, reqsEndPoint+"rg?resource=memory&until=2021-06-30", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldContainSubstring, `"removed":1`)
+
+			data, status = doReqs(http.MethodGet, reqsEndPoint+"rg", "")
+			So(status, ShouldEqual, http.StatusOK)
+			err = json.Unmarshal(data, &stats)
+			So(err, ShouldBeNil)
+			So(len(stats[0].Resources), ShouldEqual, 1)
+			So(stats[0].Resources[0].Resource, ShouldEqual, ReqGroupResourceTime)
+
+			data, status = doReqs(http.MethodPost, reqsEndPoint, `[{"req_grp":"acc","resource":"memory","value":150,"predicted":100,"key":"k1"},{"req_grp":"acc","resource":"memory","value":50,"predicted":100,"key":"k2"}]`)
+			So(status, ShouldEqual, http.StatusCreated)
+			So(string(data), ShouldContainSubstring, `"added":2`)
+
+			data, status = doReqs(http.MethodGet, accuracyEndPoint+"acc", "")
+			So(status, ShouldEqual, http.StatusOK)
+			var accuracy []*ReqGroupAccuracy
+			err = json.Unmarshal(data, &accuracy)
+			So(err, ShouldBeNil)
+			So(accuracy, ShouldResemble, []*ReqGroupAccuracy{{ReqGroup: "acc", Resource: ReqGroupResourceMemory, Count: 2, Under: 1, MeanPredicted: 100, MeanActual: 100, MeanAbsError: 50}})
+			So(string(data), ShouldContainSubstring, `"mean_abs_error":50`)
+
+			data, status = doReqs(http.MethodGet, accuracyEndPoint, "")
+			So(status, ShouldEqual, http.StatusOK)
+			err = json.Unmarshal(data, &accuracy)
+			So(err, ShouldBeNil)
+			So(len(accuracy), ShouldEqual, 1)
+
+			_, status = doReqs(http.MethodDelete, accuracyEndPoint+"acc", "")
+			So(status, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("You can set budgets, which hold back the jobs they cover once exceeded", func() {
+			doBudgets := func(method, url string, body string) ([]byte, int) {
+				var reader io.Reader
+				if body != "" {
+					reader = strings.NewReader(body)
+				}
+				req, err := http.NewRequest(method, url, reader)
+				So(err, ShouldBeNil)
+				req.Header.Add("Authorization", bearer)
+				response, err := client.Do(req)
+				So(err, ShouldBeNil)
+				responseData, err := io.ReadAll(response.Body)
+				So(err, ShouldBeNil)
+				return responseData, response.StatusCode
+			}
+
+			data, status := doBudgets(http.MethodGet, budgetsEndPoint, "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldEqual, "[]\n")
+
+			_, status = doBudgets(http.MethodPut, budgetsEndPoint+"b1", `{"limit":1}`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			_, status = doBudgets(http.MethodPut, budgetsEndPoint+"b1", `{"rep_grp":"bud","limit":1,"unit":"pounds"}`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+
+			data, status = doBudgets(http.MethodPut, budgetsEndPoint+"b1", `{"rep_grp":"bud","limit":0,"unit":"corehours"}`)
+			So(status, ShouldEqual, http.StatusOK)
+			bs := &BudgetStatus{}
+			err := json.Unmarshal(data, bs)
+			So(err, ShouldBeNil)
+			So(bs.Budget.Name, ShouldEqual, "b1")
+			So(bs.Budget.WarnAt, ShouldEqual, BudgetWarnAt)
+			So(bs.Exceeded, ShouldBeTrue)
+
+			jq, err := Connect(addr, config.ManagerCAFile, config.ManagerCertDomain, token, clientConnectTime)
+			So(err, ShouldBeNil)
+			defer func() {
+				err = jq.Disconnect()
+				if err != nil {
+					fmt.Printf("jq.Disconnect failed: %s\n", err)
+				}
+			}()
+
+			inserts, _, err := jq.Add([]*Job{{Cmd: "echo budget", Cwd: "/tmp", RepGroup: "budget_test", ReqGroup: "budget", Requirements: &jqs.Requirements{RAM: 10, Time: 10 * time.Second, Cores: 1}}}, os.Environ(), true)
+			So(err, ShouldBeNil)
+			So(inserts, ShouldEqual, 1)
+
+			<-time.After(100 * time.Millisecond)
+			job, err := jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldBeNil)
+
+			jobs, err := jq.GetByRepGroup("budget_test", false, 0, "", false, false)
+			So(err, ShouldBeNil)
+			So(len(jobs), ShouldEqual, 1)
+			So(jobs[0].BudgetExceeded, ShouldEqual, "b1")
+
+			data, status = doBudgets(http.MethodGet, warningsEndPoint, "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldContainSubstring, "budget b1 (RepGroups starting bud) has a limit of 0; no more of its jobs will be scheduled")
+
+			data, status = doBudgets(http.MethodPut, budgetsEndPoint+"b1", `{"rep_grp":"bud","limit":10,"unit":"corehours"}`)
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldContainSubstring, `"exceeded":false`)
+
+			<-time.After(100 * time.Millisecond)
+			job, err = jq.Reserve(50 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(job, ShouldNotBeNil)
+			So(job.Cmd, ShouldEqual, "echo budget")
+			So(job.BudgetExceeded, ShouldBeBlank)
+
+			data, status = doBudgets(http.MethodGet, budgetsEndPoint+"b1", "")
+			So(status, ShouldEqual, http.StatusOK)
+			var statuses []*BudgetStatus
+			err = json.Unmarshal(data, &statuses)
+			So(err, ShouldBeNil)
+			So(len(statuses), ShouldEqual, 1)
+			So(statuses[0].Budget.Limit, ShouldEqual, 10)
+
+			data, status = doBudgets(http.MethodDelete, budgetsEndPoint+"b1", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldContainSubstring, `"removed":1`)
+			data, status = doBudgets(http.MethodGet, budgetsEndPoint, "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(data), ShouldEqual, "[]\n")
+		})
+
+		Convey("You can GET an OpenAPI document describing the API without authentication", func() {
+			response, err := client.Get(baseURL + "/rest/v1/openapi.json")
+			So(err, ShouldBeNil)
+			So(response.StatusCode, ShouldEqual, http.StatusOK)
+			responseData, err := io.ReadAll(response.Body)
+			So(err, ShouldBeNil)
+
+			var doc struct {
+				OpenAPI string `json:"openapi"`
+				Paths   map[string]map[string]struct {
+					OperationID string `json:"operationId"`
+					Parameters  []struct {
+						Name string `json:"name"`
+						In   string `json:"in"`
+					} `json:"parameters"`
+				} `json:"paths"`
+				Components struct {
+					Schemas map[string]struct {
+						Properties map[string]struct {
+							Type    string `json:"type"`
+							Format  string `json:"format"`
+							Maximum *int   `json:"maximum"`
+						} `json:"properties"`
+					} `json:"schemas"`
+				} `json:"components"`
+			}
+			err = json.Unmarshal(responseData, &doc)
+			So(err, ShouldBeNil)
+			So(doc.OpenAPI, ShouldEqual, "3.0.3")
+
+			So(doc.Paths["/rest/v1/jobs/"], ShouldContainKey, "get")
+			So(doc.Paths["/rest/v1/jobs/"], ShouldContainKey, "post")
+			So(doc.Paths["/rest/v1/jobs/{ids}"], ShouldContainKey, "patch")
+			So(doc.Paths["/rest/v1/jobs/{ids}"]["delete"].OperationID, ShouldEqual, "cancelJobsByID")
+			So(doc.Paths["/rest/v1/manager/{action}"], ShouldContainKey, "post")
+			So(doc.Paths["/rest/v1/limits/{name}"], ShouldContainKey, "put")
+			So(doc.Paths["/rest/version/"], ShouldContainKey, "get")
+			So(doc.Paths["/rest/v1/openapi.json"], ShouldContainKey, "get")
+
+			jvj := doc.Components.Schemas["JobViaJSON"]
+			So(jvj.Properties["cmd"].Type, ShouldEqual, "string")
+			So(jvj.Properties["memory"].Format, ShouldEqual, "memory")
+			So(jvj.Properties["cpus"].Type, ShouldEqual, "number")
+			So(jvj.Properties["cmd_deps"].Type, ShouldEqual, "array")
+			So(*jvj.Properties["priority"].Maximum, ShouldEqual, 255)
+			So(doc.Components.Schemas, ShouldContainKey, "JobModifierViaJSON")
+			So(doc.Components.Schemas, ShouldContainKey, "JStatus")
+			So(doc.Components.Schemas, ShouldContainKey, "RESTError")
+
+			Convey("Every operation it describes is supported by the handlers", func() {
+				for path, ops := range doc.Paths {
+					path = strings.NewReplacer("{ids}", "rp1", "{action}", "pause", "{name}", "lg1").Replace(path)
+					for method := range ops {
+						req, err := http.NewRequest(strings.ToUpper(method), baseURL+path, nil)
+						So(err, ShouldBeNil)
+						req.Header.Add("Authorization", bearer)
+						response, err := client.Do(req)
+						So(err, ShouldBeNil)
+						So(response.StatusCode, ShouldNotEqual, http.StatusMethodNotAllowed)
+						So(response.StatusCode, ShouldNotEqual, http.StatusNotFound)
+					}
+				}
+			})
+		})
+
 		Convey("Initial GET queries on the warnings endpoint return nothing", func() {
 			req, err := http.NewRequest(http.MethodGet, warningsEndPoint, nil)
 			So(err, ShouldBeNil)
@@ -0,0 +1,488 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for deleting old data from our database
+// according to user-defined retention rules.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/internal"
+	"github.com/ugorji/go/codec"
+)
+
+// RetainStd and RetainJobs are the kinds of data a RetentionRule can delete.
+// RetainStd is the stdout and stderr kept for failed and buried jobs;
+// RetainJobs is completed jobs, along with their lookups. The aggregate
+// resource usage stats used to recommend the requirements of future jobs are
+// never deleted.
+const (
+	RetainStd  = "std"
+	RetainJobs = "jobs"
+)
+
+// retentionBatchSize is the maximum number of jobs we consider per database
+// transaction when applying retention rules.
+const retentionBatchSize = 1000
+
+// retentionInterval is how often the server applies its retention rules; it is
+// a variable for testing purposes.
+var retentionInterval = 1 * time.Hour
+
+// RetentionRule says that a certain kind of data about jobs that exited more
+// than Age ago should be deleted from the database.
+type RetentionRule struct {
+	// What is RetainStd or RetainJobs.
+	What string
+
+	// Age is how long after a job's last exit its data is kept.
+	Age time.Duration
+
+	// RepGroup, if not nil, restricts the rule to jobs with matching
+	// RepGroups.
+	RepGroup *regexp.Regexp
+}
+
+// ParseRetentionRules parses a semicolon separated list of rules like
+// "what:age[:repgroup_regexp]", where what is RetainStd or RetainJobs, and age
+// is a duration like "720h" or a number of days like "30d". Eg.
+// "std:30d;jobs:365d:^old_" deletes the stdout/err of jobs after 30 days, and
+// completed jobs with RepGroups starting "old_" after a year. Returns an Error
+// with Err ErrBadRetention if spec is invalid.
+func ParseRetentionRules(spec string) ([]*RetentionRule, error) {
+	var rules []*RetentionRule
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		ruleSpec = strings.TrimSpace(ruleSpec)
+		if ruleSpec == "" {
+			continue
+		}
+
+		parts := strings.SplitN(ruleSpec, ":", 3)
+		if len(parts) < 2 || (parts[0] != RetainStd && parts[0] != RetainJobs) {
+			return nil, Error{"ParseRetentionRules", ruleSpec, ErrBadRetention}
+		}
+
+		age, err := parseRetentionAge(parts[1])
+		if err != nil {
+			return nil, Error{"ParseRetentionRules", ruleSpec, ErrBadRetention}
+		}
+		rule := &RetentionRule{What: parts[0], Age: age}
+
+		if len(parts) == 3 && parts[2] != "" {
+			rule.RepGroup, err = regexp.Compile(parts[2])
+			if err != nil {
+				return nil, Error{"ParseRetentionRules", ruleSpec, ErrBadRetention}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRetentionAge parses a time.Duration string, or a number of days
+// followed by "d".
+func parseRetentionAge(age string) (time.Duration, error) {
+	if days := strings.TrimSuffix(age, "d"); days != age {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad number of days: %s", age)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative age: %s", age)
+	}
+	return d, err
+}
+
+// String returns the rule in the form accepted by ParseRetentionRules().
+func (r *RetentionRule) String() string {
+	s := r.What + ":" + r.Age.String()
+	if r.RepGroup != nil {
+		s += ":" + r.RepGroup.String()
+	}
+	return s
+}
+
+// expired tells you if this rule says the given job's data should be deleted
+// at time now.
+func (r *RetentionRule) expired(job *Job, now time.Time) bool {
+	if job.EndTime.IsZero() || now.Sub(job.EndTime) <= r.Age {
+		return false
+	}
+	return r.RepGroup == nil || r.RepGroup.MatchString(job.RepGroup)
+}
+
+// RetentionResult describes what was deleted by applying retention rules.
+type RetentionResult struct {
+	Std  int // number of jobs whose stdout/err was deleted
+	Jobs int // number of completed jobs deleted
+	Envs int // number of environments deleted because no job used them
+}
+
+// retentionRules holds RetentionRules, for use by the db.
+type retentionRules []*RetentionRule
+
+// expired tells you if any of our rules of the given kind say the job's data
+// should be deleted.
+func (rules retentionRules) expired(what string, job *Job, now time.Time) bool {
+	for _, r := range rules {
+		if r.What == what && r.expired(job, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// minAge returns the smallest Age of our rules of the given kind, and false if
+// there are no such rules.
+func (rules retentionRules) minAge(what string) (time.Duration, bool) {
+	var min time.Duration
+	found := false
+	for _, r := range rules {
+		if r.What == what && (!found || r.Age < min) {
+			min = r.Age
+			found = true
+		}
+	}
+	return min, found
+}
+
+// setRetention makes us apply the given rules now and then every
+// retentionInterval until we're closed.
+func (db *db) setRetention(rules []*RetentionRule) {
+	if len(rules) == 0 {
+		return
+	}
+	stop := make(chan struct{})
+	db.Lock()
+	db.retentionStop = stop
+	db.Unlock()
+
+	go func() {
+		defer internal.LogPanic(db.Logger, "retention", true)
+
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			db.wgMutex.Lock()
+			wgk := db.wg.Add(1)
+			db.wgMutex.Unlock()
+			result, err := db.applyRetention(rules, time.Now())
+			db.wg.Done(wgk)
+			if err != nil {
+				db.Error("Applying database retention rules failed", "err", err)
+			} else if result.Std+result.Jobs+result.Envs > 0 {
+				db.Info("Applied database retention rules", "std", result.Std, "jobs", result.Jobs, "envs", result.Envs)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// applyRetention deletes the data that the given rules say has expired at time
+// now. Jobs that are currently in the queue are never deleted, but their
+// stdout/err can be.
+func (db *db) applyRetention(rules []*RetentionRule, now time.Time) (*RetentionResult, error) {
+	db.RLock()
+	if db.closed {
+		db.RUnlock()
+		return nil, Error{"applyRetention", db.path, ErrDBError}
+	}
+	db.RUnlock()
+
+	rr := retentionRules(rules)
+	result := &RetentionResult{}
+	var err error
+	if _, ok := rr.minAge(RetainStd); ok {
+		result.Std, err = db.applyStdRetention(rr, now)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if minAge, ok := rr.minAge(RetainJobs); ok {
+		var envKeys map[string]bool
+		result.Jobs, envKeys, err = db.applyJobRetention(rr, now.Add(-minAge), now)
+		if err != nil {
+			return result, err
+		}
+		result.Envs, err = db.removeUnusedEnvs(envKeys)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.Std+result.Jobs+result.Envs > 0 {
+		db.backgroundBackup()
+	}
+	return result, nil
+}
+
+// applyStdRetention deletes the stdout/err of jobs that have expired, as well
+// as any that no longer belongs to a job. Returns the number of jobs that had
+// their stdout/err deleted.
+func (db *db) applyStdRetention(rules retentionRules, now time.Time) (int, error) {
+	keys := make(map[string]bool)
+	err := db.storage.view(func(tx dbTx) error {
+		for _, bucket := range [][]byte{bucketStdO, bucketStdE} {
+			errs := tx.seek(bucket, nil, nil, func(k, _ []byte) (bool, error) {
+				keys[string(k)] = true
+				return true, nil
+			})
+			if errs != nil {
+				return errs
+			}
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	deleted, err := db.inRetentionBatches(keys, func(tx dbTx, key []byte) (*Job, error) {
+		job := &Job{}
+		encoded := tx.get(bucketJobsLive, key)
+		if encoded == nil {
+			encoded = tx.get(bucketJobsComplete, key)
+		}
+		if encoded != nil {
+			var errd error
+			job, errd = db.decodeJob(encoded)
+			if errd != nil {
+				return nil, errd
+			}
+			if !rules.expired(RetainStd, job, now) {
+				return nil, nil
+			}
+		}
+
+		errd := tx.delete(bucketStdO, key)
+		if errd != nil {
+			return nil, errd
+		}
+		return job, tx.delete(bucketStdE, key)
+	})
+	return len(deleted), err
+}
+
+// applyJobRetention deletes completed jobs that ended before cutoff and have
+// expired. Returns the number of jobs deleted and the EnvKeys they used.
+func (db *db) applyJobRetention(rules retentionRules, cutoff time.Time, now time.Time) (int, map[string]bool, error) {
+	// our end time lookups let us consider only the jobs that are old enough
+	// to possibly have expired; entries for jobs that have since been deleted
+	// are removed along the way
+	entries := make(map[string]bool)
+	err := db.storage.view(func(tx dbTx) error {
+		until := fmt.Sprintf("%0*d", historyTimeWidth, cutoff.UnixNano())
+		return tx.seek(bucketEndTK, nil, nil, func(k, _ []byte) (bool, error) {
+			if string(k[:historyTimeWidth]) > until {
+				return false, nil
+			}
+			entries[string(k)] = true
+			return true, nil
+		})
+	})
+	if err != nil || len(entries) == 0 {
+		return 0, nil, err
+	}
+
+	deleted, err := db.inRetentionBatches(entries, func(tx dbTx, entry []byte) (*Job, error) {
+		key := tx.get(bucketEndTK, entry)
+		if key == nil {
+			return nil, nil
+		}
+		key = copyBytes(key)
+		if tx.get(bucketJobsLive, key) != nil {
+			return nil, nil
+		}
+		encoded := tx.get(bucketJobsComplete, key)
+		if encoded == nil {
+			return nil, tx.delete(bucketEndTK, entry)
+		}
+
+		job, errd := db.decodeJob(encoded)
+		if errd != nil {
+			return nil, errd
+		}
+		if !rules.expired(RetainJobs, job, now) {
+			return nil, nil
+		}
+
+		errd = tx.delete(bucketEndTK, entry)
+		if errd != nil {
+			return nil, errd
+		}
+		return job, db.deleteCompleteJob(tx, key, job)
+	})
+
+	envKeys := make(map[string]bool)
+	for _, job := range deleted {
+		if job.EnvKey != "" {
+			envKeys[job.EnvKey] = true
+		}
+	}
+	return len(deleted), envKeys, err
+}
+
+// deleteCompleteJob deletes the given job, which has the given key, from the
+// complete bucket, along with its stdout/err and all its lookups.
+func (db *db) deleteCompleteJob(tx dbTx, key []byte, job *Job) error {
+	deletes := map[string][][]byte{
+		string(bucketJobsComplete): {key},
+		string(bucketStdO):         {key},
+		string(bucketStdE):         {key},
+		string(bucketRTK):          {db.generateLookupKey(job.RepGroup, key)},
+	}
+	for _, depGroup := range job.DepGroups {
+		if depGroup != "" {
+			deletes[string(bucketDTK)] = append(deletes[string(bucketDTK)], db.generateLookupKey(depGroup, key))
+		}
+	}
+	for _, depGroup := range job.Dependencies.DepGroups() {
+		deletes[string(bucketRDTK)] = append(deletes[string(bucketRDTK)], db.generateLookupKey(depGroup, key))
+	}
+	for bucket, lookups := range historyLookups(string(key), job) {
+		for _, lookup := range lookups {
+			deletes[bucket] = append(deletes[bucket], lookup[0])
+		}
+	}
+
+	for bucket, keys := range deletes {
+		for _, k := range keys {
+			err := tx.delete([]byte(bucket), k)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeUnusedEnvs deletes the environments with the given keys, unless they
+// are still used by a job, or have been used recently (since their use by a
+// job that is being added may not be stored yet). Returns the number deleted.
+func (db *db) removeUnusedEnvs(envKeys map[string]bool) (int, error) {
+	for envKey := range envKeys {
+		if db.envcache.Contains(envKey) {
+			delete(envKeys, envKey)
+		}
+	}
+	if len(envKeys) == 0 {
+		return 0, nil
+	}
+
+	err := db.storage.view(func(tx dbTx) error {
+		for _, bucket := range [][]byte{bucketJobsLive, bucketJobsComplete} {
+			errs := tx.seek(bucket, nil, nil, func(_, encoded []byte) (bool, error) {
+				job, errd := db.decodeJob(encoded)
+				if errd != nil {
+					return false, errd
+				}
+				delete(envKeys, job.EnvKey)
+				return len(envKeys) > 0, nil
+			})
+			if errs != nil || len(envKeys) == 0 {
+				return errs
+			}
+		}
+		return nil
+	})
+	if err != nil || len(envKeys) == 0 {
+		return 0, err
+	}
+
+	err = db.storage.update(func(tx dbTx) error {
+		for envKey := range envKeys {
+			errd := tx.delete(bucketEnvs, []byte(envKey))
+			if errd != nil {
+				return errd
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for envKey := range envKeys {
+		db.envcache.Remove(envKey)
+	}
+	return len(envKeys), nil
+}
+
+// inRetentionBatches calls fn with each of the given keys, in update
+// transactions of up to retentionBatchSize keys each. fn should return the job
+// whose data it deleted, if any. Returns all such jobs from committed
+// transactions.
+func (db *db) inRetentionBatches(keys map[string]bool, fn func(tx dbTx, key []byte) (*Job, error)) ([]*Job, error) {
+	all := make([]string, 0, len(keys))
+	for key := range keys {
+		all = append(all, key)
+	}
+
+	var deleted []*Job
+	for len(all) > 0 {
+		n := retentionBatchSize
+		if n > len(all) {
+			n = len(all)
+		}
+		batch := all[:n]
+		all = all[n:]
+
+		var batchDeleted []*Job
+		err := db.storage.update(func(tx dbTx) error {
+			// updates can be retried, so start afresh each time
+			batchDeleted = nil
+			for _, key := range batch {
+				job, err := fn(tx, []byte(key))
+				if err != nil {
+					return err
+				}
+				if job != nil {
+					batchDeleted = append(batchDeleted, job)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, batchDeleted...)
+	}
+	return deleted, nil
+}
+
+// decodeJob decodes a job that was stored in our database.
+func (db *db) decodeJob(encoded []byte) (*Job, error) {
+	dec := codec.NewDecoderBytes(encoded, db.ch)
+	job := &Job{}
+	err := dec.Decode(job)
+	return job, err
+}
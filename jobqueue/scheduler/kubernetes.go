@@ -43,8 +43,8 @@ import (
 // k8s is the implementer of scheduleri. It is a wrapper to implement scheduleri
 // by sending requests to the controller
 
-// maxQueueTime(), reserveTimeout(), hostToID(), busy(), schedule() are
-// inherited from local
+// maxQueueTime(), reserveTimeout(), hostToID(), hostFlavor(), busy(),
+// schedule() are inherited from local
 type k8s struct {
 	local
 	config          *ConfigKubernetes
@@ -36,6 +36,7 @@ import (
 
 	sync "github.com/sasha-s/go-deadlock"
 
+	"github.com/VertebrateResequencing/wr/cloud"
 	"github.com/VertebrateResequencing/wr/internal"
 	"github.com/VertebrateResequencing/wr/queue"
 	"github.com/inconshreveable/log15"
@@ -945,6 +946,11 @@ func (s *local) hostToID(host string) string {
 	return ""
 }
 
+// hostFlavor always returns nil, since we're not in the cloud.
+func (s *local) hostFlavor(host string) *cloud.Flavor {
+	return nil
+}
+
 // localHost implements the Host interface.
 type localHost struct {
 	logger log15.Logger
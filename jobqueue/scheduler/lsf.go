@@ -773,6 +773,11 @@ func (s *lsf) hostToID(host string) string {
 	return ""
 }
 
+// hostFlavor always returns nil, since we're not in the cloud.
+func (s *lsf) hostFlavor(host string) *cloud.Flavor {
+	return nil
+}
+
 // getHost returns a cloud.Server for the given host.
 func (s *lsf) getHost(host string) (Host, bool) {
 	name := "unknown"
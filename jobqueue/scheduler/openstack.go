@@ -1361,6 +1361,16 @@ func (s *opst) hostToID(host string) string {
 	return server.ID
 }
 
+// hostFlavor does the necessary lookup to find the flavor of the server with
+// the given hostname.
+func (s *opst) hostFlavor(host string) *cloud.Flavor {
+	server := s.provider.GetServerByName(host)
+	if server == nil {
+		return nil
+	}
+	return server.Flavor
+}
+
 // getHost returns a cloud.Server for the given host.
 func (s *opst) getHost(host string) (Host, bool) {
 	server := s.provider.GetServerByName(host)
@@ -192,6 +192,7 @@ type scheduleri interface {
 	reserveTimeout(req *Requirements) int                                    // achieve the aims of ReserveTimeout()
 	maxQueueTime(req *Requirements) time.Duration                            // achieve the aims of MaxQueueTime(), return 0 for infinite queue time
 	hostToID(host string) string                                             // achieve the aims of HostToID()
+	hostFlavor(host string) *cloud.Flavor                                    // achieve the aims of HostFlavor()
 	getHost(host string) (Host, bool)                                        // get a Host that can be used to run commands over ssh on the given host, return false boolean if not such host exists
 	setMessageCallBack(MessageCallBack)                                      // achieve the aims of SetMessageCallBack()
 	setBadServerCallBack(BadServerCallBack)                                  // achieve the aims of SetBadServerCallBack()
@@ -386,6 +387,13 @@ func (s *Scheduler) HostToID(host string) string {
 	return s.impl.hostToID(host)
 }
 
+// HostFlavor will return the flavor of the server with the given host name, if
+// the scheduler is cloud based and knows about that server. Otherwise this just
+// returns nil.
+func (s *Scheduler) HostFlavor(host string) *cloud.Flavor {
+	return s.impl.hostFlavor(host)
+}
+
 // ProcessNotRunngingOnHost will ssh to the given host and check if the given
 // process id is still running. Returns true if it isn't. Returns false if it is
 // running, or if the ssh wasn't possible. This is to find out if a process is
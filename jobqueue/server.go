@@ -34,6 +34,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -47,6 +48,7 @@ import (
 	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/VertebrateResequencing/wr/limiter"
 	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/VertebrateResequencing/wr/rp"
 	"github.com/gorilla/websocket"
 	"github.com/grafov/bcast" // *** must be commit e9affb593f6c871f9b4c3ee6a3c77d421fe953df or status web page updates break in certain cases
 	"github.com/inconshreveable/log15"
@@ -80,7 +82,26 @@ const (
 	ErrPermissionDenied = "bad token: permission denied"
 	ErrBeingDrained     = "server is being drained"
 	ErrStopReserving    = "recovered on a new server; you should stop reserving"
-	ErrBadLimitGroup    = "colons in limit group names must be followed by integers"
+	ErrBadLimitGroup    = "colons in limit group names must be followed by an integer limit and/or a count/duration rate"
+	ErrExportExists     = "export file already exists"
+	ErrStandbyBackend   = "standby database backend does not match the primary's"
+	ErrWrongBackend     = "database file is not of the configured backend"
+	ErrBadBackup        = "database failed verification"
+	ErrNoBackup         = "no suitable database backup found"
+	ErrSchemaTooNew     = "database was made by a newer version of wr"
+	ErrCompacting       = "database compaction already in progress"
+	ErrBadRetention     = "retention rules must be like what:age[:repgroup_regexp]"
+	ErrBadResource      = "resource must be one of memory, disk or time"
+	ErrBadObservation   = "observations need a req group and non-negative values"
+	ErrBadCostRates     = "cost rates must be like name:price, with non-negative prices"
+	ErrBadBudget        = "budgets need a name, a non-negative limit in a known unit, and one of a RepGroup prefix or user"
+	ErrBadProbe         = "limit group probes need a limit group name, a command or URL, and a TTL of at least 1s"
+	ErrBadProtector     = "protected resources must be like name:max[:delay[:timeout]], with unique names and max of at least 1"
+	ErrUnknownProtector = "no such protected resource"
+	ErrTokensNotGranted = "tokens are not granted; they were released, cancelled or timed out"
+	ErrBadRemoteManager = "remote managers must be like name:deployment or name:host:port:dir[:domain], with unique names"
+	ErrUnknownManager   = "no such remote manager"
+	ErrDependencyCycle  = "dependencies would form a cycle"
 	ServerModeNormal    = "started"
 	ServerModePause     = "paused"
 	ServerModeDrain     = "draining"
@@ -102,6 +123,7 @@ var (
 	ServerMaximumRunForResourceRecommendation       = 100
 	ServerMinimumScheduledForResourceRecommendation = 10
 	ServerLogClientErrors                           = true
+	ServerDeadlineUrgency                           = 1 * time.Hour
 	serverShutdownRunnerTickerTime                  = 50 * time.Millisecond
 
 	// httpServerShutdownTime is the time we'll wait before forcing
@@ -128,33 +150,57 @@ func (e Error) Error() string {
 // serverResponse is the struct that the server sends to clients over the
 // network in response to their clientRequest.
 type serverResponse struct {
-	Err         string // string instead of error so we can decode on the client side
-	Added       int
-	Existed     int
-	AddedIDs    []string
-	Modified    map[string]string
-	KillCalled  bool
-	Job         *Job
-	Jobs        []*Job
-	Limit       int
-	LimitGroups map[string]int
-	SInfo       *ServerInfo
-	SStats      *ServerStats
-	DB          []byte
-	Path        string
-	BadServers  []*BadServer
+	Err             string // string instead of error so we can decode on the client side
+	ErrItem         string // what Err is about, if not the client's Job
+	Added           int
+	Existed         int
+	AddedIDs        []string
+	Modified        map[string]string
+	KillCalled      bool
+	Failed          map[string]string // keys of jobs that could not be archived, and why
+	Job             *Job
+	Jobs            []*Job
+	Limit           int
+	LimitGroups     map[string]int
+	LimitRates      map[string]string
+	LimitUsage      map[string]int
+	SInfo           *ServerInfo
+	SStats          *ServerStats
+	DB              []byte
+	Path            string
+	BadServers      []*BadServer
+	Next            string
+	ReplicaID       string
+	ReplicaSeq      uint64
+	ReplicaSnapshot string
+	ReplicaSize     int64
+	DBChanges       []*dbChangeSet
+	DBBackend       string
+	Compaction      *CompactionResult
+	Accuracy        []*ReqGroupAccuracy
+	ReqStats        []*ReqGroupStats
+	Budgets         []*BudgetStatus
+	Probes          []*LimitGroupProbeStatus
+	Remotes         []*RemoteManagerStatus
+	Satisfied       []bool
+	Graph           *DependencyGraph
+	DryRun          *AddDryRun
+	Receipt         string
+	Granted         bool
+	Removed         int
 }
 
 // ServerInfo holds basic addressing info about the server.
 type ServerInfo struct {
-	Addr       string // ip:port
-	Host       string // hostname
-	Port       string // port
-	WebPort    string // port of the web interface
-	PID        int    // process id of server
-	Deployment string // deployment the server is running under
-	Scheduler  string // the name of the scheduler that jobs are being submitted to
-	Mode       string // ServerModeNormal if the server is running normally, or ServerModeDrain|Paused if draining or paused
+	Addr       string      // ip:port
+	Host       string      // hostname
+	Port       string      // port
+	WebPort    string      // port of the web interface
+	PID        int         // process id of server
+	Deployment string      // deployment the server is running under
+	Scheduler  string      // the name of the scheduler that jobs are being submitted to
+	Mode       string      // ServerModeNormal if the server is running normally, or ServerModeDrain|Paused if draining or paused
+	Costs      *CostTotals // total costs of the jobs run so far if CostRates were configured (only filled in by the REST API)
 }
 
 // ServerVersions holds the server version (git tag) and API version supported.
@@ -215,6 +261,7 @@ type sgroup struct {
 	skipped  int
 	req      *scheduler.Requirements
 	priority uint8
+	urgent   bool
 	sync.RWMutex
 }
 
@@ -228,6 +275,7 @@ func (s *sgroup) clone(count int) *sgroup {
 		skipped:  s.skipped,
 		req:      s.req.Clone(),
 		priority: s.priority,
+		urgent:   s.urgent,
 	}
 }
 
@@ -297,6 +345,14 @@ type Server struct {
 	wg                        *waitgroup.WaitGroup
 	q                         *queue.Queue
 	rpl                       *rgToKeys
+	costRates                 *CostRates
+	priorityAging             time.Duration
+	budgets                   map[string]*budgetState
+	spending                  *CostTotals
+	probes                    map[string]*probeState
+	protectors                map[string]*rp.Protector
+	jobTokens                 *jobTokens
+	remotes                   map[string]*remoteState
 	limiter                   *limiter.Limiter
 	scheduler                 *scheduler.Scheduler
 	previouslyScheduledGroups map[string]*sgroup
@@ -305,6 +361,8 @@ type Server struct {
 	badServerCaster           *bcast.Group
 	schedCaster               *bcast.Group
 	racCheckTimer             *time.Timer
+	rateTimer                 *time.Timer // to re-trigger the readyaddedcallback when rate limits allow
+	urgencyTimer              *time.Timer // to re-trigger the readyaddedcallback when a job's deadline becomes urgent
 	pauseRequests             int
 	wsconns                   map[string]*websocket.Conn
 	badServers                map[string]*cloud.Server
@@ -312,10 +370,13 @@ type Server struct {
 	racmutex                  sync.RWMutex // to protect the readyaddedcallback
 	bsmutex                   sync.RWMutex
 	simutex                   sync.RWMutex
+	bgmutex                   sync.RWMutex // to protect budgets and spending
+	prmutex                   sync.RWMutex // to protect probes
 	krmutex                   sync.RWMutex
 	ssmutex                   sync.RWMutex // "server state mutex" to protect up, drain, blocking and ServerInfo.Mode
 	psgmutex                  sync.RWMutex // to protect previouslyScheduledGroups
 	rpmutex                   sync.Mutex   // to protect racPending, racRunning and waitingReserves
+	rmmutex                   sync.RWMutex // to protect remotes
 	sync.Mutex
 	wsmutex              sync.Mutex
 	up                   bool
@@ -366,6 +427,58 @@ type ServerConfig struct {
 	// Absolute path to where the database file should be backed up to.
 	DBFileBackup string
 
+	// DBBackupGenerations is the number of timestamped copies of the database
+	// backup file (named DBFileBackup.YYYYMMDDTHHMMSSZ) to keep, so that you can
+	// RestoreDB() to an earlier point in time. The default of 0 keeps none.
+	DBBackupGenerations int
+
+	// DBBackupGenerationInterval is the minimum time between the creation of
+	// backup generations. The default of 0 means every backup.
+	DBBackupGenerationInterval time.Duration
+
+	// DBRetention are rules for deleting old data from the database, which are
+	// applied when the server starts and hourly thereafter. See
+	// ParseRetentionRules(). The default of none keeps everything forever.
+	DBRetention []*RetentionRule
+
+	// RecMBRound and RecSecRound are the amounts that memory and disk (in MB)
+	// and time (in seconds) recommendations for jobs are rounded up to. The
+	// defaults of 0 mean RecMBRound and RecSecRound.
+	RecMBRound  int
+	RecSecRound int
+
+	// RecHalfLife is how long it takes for an observation of a job's resource
+	// usage to count for half as much when recommending resources for future
+	// jobs in the same ReqGroup. The default of 0 means RecHalfLife; a
+	// negative value means observations always count the same.
+	RecHalfLife time.Duration
+
+	// PriorityAging, if greater than 0, raises the effective priority of
+	// ready jobs by 1 for every PriorityAging they have been waiting to run,
+	// so that a steady stream of high priority jobs can't stop low priority
+	// jobs from ever running. See queue.SetPriorityAging().
+	PriorityAging time.Duration
+
+	// CostRates, if set, are used to work out the Cost of each job that runs,
+	// and the total costs per RepGroup and User. See ParseCostRates(). The
+	// default of nil means costs are not recorded.
+	CostRates *CostRates
+
+	// Protectors are resources that the commands of running jobs can request
+	// tokens for via a Client's AcquireTokens(), so that only part of a job's
+	// run need be limited. See ParseProtectors().
+	Protectors []*Protector
+
+	// RemoteManagers are other wr managers whose jobs our jobs can depend on,
+	// via Dependency.Manager. See ParseRemoteManagers().
+	RemoteManagers []*RemoteManager
+
+	// DBBackend is the storage backend used for the database file, one of
+	// DBBackendBolt (the default if left empty) or DBBackendSQLite. The
+	// latter lets you query the database with SQL. An existing database file
+	// (and its backup) must be of the chosen backend's format.
+	DBBackend string
+
 	// Absolute path to where the server will store the authorization token
 	// needed by clients to communicate with the server. Storing it in a file
 	// could make using any CLI clients more convenient. The file will be
@@ -519,7 +632,14 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 	}
 
 	// we need to persist stuff to disk, and we do so using boltdb
-	db, msg, err := initDB(config.DBFile, config.DBFileBackup, config.Deployment, serverLogger)
+	db, msg, err := initDB(config.DBFile, config.DBFileBackup, config.DBBackend, config.Deployment, serverLogger)
+	if err == nil && config.DBBackupGenerations > 0 {
+		db.setBackupGenerations(config.DBBackupGenerations, config.DBBackupGenerationInterval)
+	}
+	if err == nil {
+		db.setRetention(config.DBRetention)
+		db.setRecommendationSettings(config.RecMBRound, config.RecSecRound, config.RecHalfLife)
+	}
 	if certMsg != "" {
 		if msg == "" {
 			msg = certMsg
@@ -653,6 +773,7 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 
 	// our limiter will use a callback that gets group limits from our database
 	l := limiter.New(db.retrieveLimitGroup)
+	l.SetRateCallback(db.retrieveLimitGroupRate)
 
 	s = &Server{
 		ServerInfo:                &ServerInfo{Addr: ip + ":" + config.Port, Host: certDomain, Port: config.Port, WebPort: config.WebPort, PID: os.Getpid(), Deployment: config.Deployment, Scheduler: config.SchedulerName, Mode: ServerModeNormal},
@@ -662,6 +783,10 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		sock:                      sock,
 		ch:                        new(codec.BincHandle),
 		rpl:                       &rgToKeys{lookup: make(map[string]map[string]bool)},
+		costRates:                 config.CostRates,
+		priorityAging:             config.PriorityAging,
+		protectors:                createProtectors(config.Protectors),
+		jobTokens:                 newJobTokens(),
 		limiter:                   l,
 		db:                        db,
 		stopSigHandling:           stopSigHandling,
@@ -682,9 +807,25 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		Logger:                    serverLogger,
 	}
 
+	// budgets must be known before any jobs are scheduled
+	err = s.loadBudgets()
+	if err != nil {
+		return nil, msg, token, err
+	}
+
 	// if we're restarting from a state where there were incomplete jobs, we
 	// need to load those in to our queue now
 	s.createQueue()
+
+	// limit group probes need our queue to tell it about changed limits
+	err = s.loadLimitGroupProbes()
+	if err != nil {
+		return nil, msg, token, err
+	}
+
+	// recovered jobs may depend on the jobs of remote managers (which we only
+	// start watching once we can no longer fail)
+	s.startRemoteManagers(config.RemoteManagers)
 	priorJobs, err := db.recoverIncompleteJobs()
 	if err != nil {
 		return nil, msg, token, err
@@ -704,12 +845,18 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		var itemdefs []*queue.ItemDef
 		for _, job := range priorJobs {
 			var deps []string
-			deps, err = job.Dependencies.incompleteJobKeys(s.db)
+			var rules *queue.DepRules
+			err = s.registerRemoteDependencies(job.Dependencies)
+			if err != nil {
+				// the job will wait until the manager is configured again
+				s.Warn("recovered job depends on an unknown remote manager", "job", job.Key(), "err", err)
+			}
+			deps, rules, err = job.Dependencies.incompleteJobKeys(s.db)
 			if err != nil {
 				return nil, msg, token, err
 			}
 
-			itemdef := &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps}
+			itemdef := &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps, StartBy: job.startBy(), DepRules: rules}
 
 			switch job.State {
 			case JobStateRunning:
@@ -782,12 +929,9 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		mux := http.NewServeMux()
 		mux.HandleFunc("/", webInterfaceStatic(s))
 		mux.HandleFunc("/status_ws", webInterfaceStatusWS(s))
-		mux.HandleFunc(restJobsEndpoint, restJobs(s))
-		mux.HandleFunc(restWarningsEndpoint, restWarnings(s))
-		mux.HandleFunc(restBadServersEndpoint, restBadServers(s))
-		mux.HandleFunc(restFileUploadEndpoint, restFileUpload(s))
-		mux.HandleFunc(restInfoEndpoint, restInfo(s))
-		mux.HandleFunc(restVersionEndpoint, restVersion(s))
+		for _, ep := range restEndpoints() {
+			mux.HandleFunc(ep.path, ep.handler(s))
+		}
 		srv := &http.Server{Addr: httpAddr, Handler: mux}
 		wgk2 := wg.Add(1)
 		go func() {
@@ -879,26 +1023,7 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		}
 		s.scheduler.SetBadServerCallBack(badServerCB)
 
-		messageCB := func(msg string) {
-			s.simutex.Lock()
-			var si *schedulerIssue
-			var existed bool
-			if si, existed = s.schedIssues[msg]; existed {
-				si.LastDate = time.Now().Unix()
-				si.Count++
-			} else {
-				si = &schedulerIssue{
-					Msg:       msg,
-					FirstDate: time.Now().Unix(),
-					LastDate:  time.Now().Unix(),
-					Count:     1,
-				}
-				s.schedIssues[msg] = si
-			}
-			s.simutex.Unlock()
-			s.schedCaster.Send(si)
-		}
-		s.scheduler.SetMessageCallBack(messageCB)
+		s.scheduler.SetMessageCallBack(s.schedulerMessage)
 
 		// wait a while for ListenAndServe() to start listening
 		<-time.After(10 * time.Millisecond)
@@ -959,6 +1084,8 @@ func Serve(config ServerConfig) (s *Server, msg string, token []byte, err error)
 		}
 	}()
 
+	s.watchRemoteManagers()
+
 	return s, msg, token, err
 }
 
@@ -999,8 +1126,18 @@ func (s *Server) Drain() error {
 		ticker := time.NewTicker(1 * time.Second)
 	TICKS:
 		for range ticker.C {
+			// if we were stopped some other way in the mean time, our queue
+			// will have gone and there's nothing left to drain
+			s.ssmutex.RLock()
+			if !s.up {
+				s.ssmutex.RUnlock()
+				ticker.Stop()
+				return
+			}
+
 			// check our queue for things running, which is cheap
 			stats := s.q.Stats()
+			s.ssmutex.RUnlock()
 			if stats.Running > 0 {
 				continue TICKS
 			}
@@ -1063,6 +1200,30 @@ func (s *Server) Resume() (bool, error) {
 	return true, nil
 }
 
+// pauseOnRequest calls Pause() on behalf of a client. Clients are allowed to
+// request a pause as many times as they like, but a single Resume() later
+// should work, so if we were already paused we resume again to keep the
+// internal pause counter at 1.
+func (s *Server) pauseOnRequest() error {
+	paused, err := s.Pause()
+	if err != nil {
+		return err
+	}
+
+	if paused {
+		s.Info("paused by request")
+		return nil
+	}
+
+	resumed, err := s.Resume()
+	if err != nil {
+		s.Error("resume following an extraneous pause failed", "error", err)
+	} else if resumed {
+		s.Error("resumed incorrectly succeeded following a pause that did not")
+	}
+	return nil
+}
+
 // GetServerStats returns some simple live stats about what's happening in the
 // server's queue.
 func (s *Server) GetServerStats() *ServerStats {
@@ -1100,6 +1261,90 @@ func (s *Server) BackupDB(w io.Writer) error {
 	return s.db.backup(w)
 }
 
+// CompactDB rewrites the database file so that it takes up as little space as
+// possible, without stopping the database from being used. This is useful
+// after lots of data has been deleted by ServerConfig.DBRetention rules.
+func (s *Server) CompactDB() (*CompactionResult, error) {
+	return s.db.compact()
+}
+
+// RecommendationAccuracy tells you how well the resources reserved for past
+// jobs in the given ReqGroup (or all ReqGroups, if blank) matched what they
+// actually used.
+func (s *Server) RecommendationAccuracy(reqGroup string) ([]*ReqGroupAccuracy, error) {
+	return s.db.recommendationAccuracy(reqGroup)
+}
+
+// setJobReserveGroup changes the given job's schedulerGroup and its reserve
+// group in the given queue, if the group differs from prevGroup.
+func (s *Server) setJobReserveGroup(q *queue.Queue, job *Job, prevGroup, group string) {
+	if prevGroup == group {
+		return
+	}
+	job.setSchedulerGroup(group)
+	err := q.SetReserveGroup(job.Key(), group)
+	if err != nil {
+		// we could be trying to set the reserve group after the job has
+		// already completed, if they complete ~instantly
+		if qerr, ok := err.(queue.Error); !ok || qerr.Err != queue.ErrNotFound {
+			s.Warn("readycallback queue setreservegroup failed", "err", err)
+		}
+	}
+}
+
+// schedulerMessage notes the given message as a scheduler issue, and sends it
+// to anyone watching the scheduler messages, eg. the status web page.
+func (s *Server) schedulerMessage(msg string) {
+	s.simutex.Lock()
+	var si *schedulerIssue
+	var existed bool
+	if si, existed = s.schedIssues[msg]; existed {
+		si.LastDate = time.Now().Unix()
+		si.Count++
+	} else {
+		si = &schedulerIssue{
+			Msg:       msg,
+			FirstDate: time.Now().Unix(),
+			LastDate:  time.Now().Unix(),
+			Count:     1,
+		}
+		s.schedIssues[msg] = si
+	}
+	s.simutex.Unlock()
+	s.schedCaster.Send(si)
+}
+
+// CostTotals tells you the total cost and core-hours of the jobs that have run,
+// broken down by RepGroup and User. The costs are only added to while the
+// server is configured with CostRates.
+func (s *Server) CostTotals() (*CostTotals, error) {
+	return s.db.costTotals()
+}
+
+// ReqGroupStats tells you what has been learned about the memory, disk and time
+// used by jobs in the given ReqGroup, or all ReqGroups if blank.
+func (s *Server) ReqGroupStats(reqGroup string) ([]*ReqGroupStats, error) {
+	return s.db.reqGroupStats(reqGroup)
+}
+
+// RemoveReqGroupStats forgets the observations of resource usage that match
+// the given filter, eg. to discard those of jobs that ran with a buggy version
+// of a tool. Returns the number of observations removed.
+func (s *Server) RemoveReqGroupStats(filter *ReqGroupStatsFilter) (int, error) {
+	removed, err := s.db.removeReqGroupStats(filter)
+	if removed > 0 {
+		s.Info("removed req group stats", "reqgroup", filter.ReqGroup, "resource", filter.Resource, "removed", removed)
+	}
+	return removed, err
+}
+
+// SeedReqGroupStats stores the given observations of resource usage as if jobs
+// had been run with that usage, so that good recommendations can be made for
+// the first jobs of a ReqGroup. Returns the number of observations stored.
+func (s *Server) SeedReqGroupStats(observations []*ReqGroupObservation) (int, error) {
+	return s.db.seedReqGroupStats(observations)
+}
+
 // HasRunners tells you if there are currently runner clients in the job
 // scheduler (either running or pending).
 func (s *Server) HasRunners() bool {
@@ -1210,6 +1455,7 @@ func (s *Server) uploadFile(source io.Reader, savePath string) (string, error) {
 // callbacks.
 func (s *Server) createQueue() {
 	q := queue.New("cmds", s.Logger)
+	q.SetPriorityAging(s.priorityAging)
 	s.q = q
 
 	// we set a callback for things entering this queue's ready sub-queue.
@@ -1254,38 +1500,34 @@ func (s *Server) createQueue() {
 		// calculate, set and count jobs by schedulerGroup
 		groups := make(map[string]*sgroup)
 		reqGroupToReqs := make(map[string]*scheduler.Requirements)
+		reqGroupRecommenders := make(map[string]*reqsRecommender)
 		groupLimits := make(map[string]int)
+		var urgencyWait time.Duration
 		for _, inter := range allitemdata {
 			job := inter.(*Job)
 
 			// depending on job.Override, get memory, disk and time
 			// recommendations, which are rounded to get fewer larger
 			// groups
+			// jobs with a SizeHint can get their own recommendation, but we
+			// only read the ReqGroup's past observations once
 			var recommendedReq *scheduler.Requirements
-			if rec, existed := reqGroupToReqs[job.ReqGroup]; existed {
+			recKey := job.ReqGroup
+			if job.SizeHint > 0 {
+				recKey += dbDelimiter + strconv.FormatFloat(job.SizeHint, 'g', -1, 64)
+			}
+			if rec, existed := reqGroupToReqs[recKey]; existed {
 				recommendedReq = rec
 			} else {
-				recm, errm := s.db.recommendedReqGroupMemory(job.ReqGroup)
-				recd, errd := s.db.recommendedReqGroupDisk(job.ReqGroup)
-				recs, errs := s.db.recommendedReqGroupTime(job.ReqGroup)
-				if errm != nil || errd != nil || errs != nil {
-					reqGroupToReqs[job.ReqGroup] = nil
-				} else {
-					recmMBs := 0
-					if recm > 0 {
-						recmMBs = recm
-					}
-					recdGBs := 0
-					if recd > 0 {
-						recdGBs = int(math.Ceil(float64(recd) / float64(1024)))
-					}
-					recsSecs := 0
-					if recs > 0 {
-						recsSecs = recs
-					}
-					recommendedReq = &scheduler.Requirements{RAM: recmMBs, Disk: recdGBs, DiskSet: true, Time: time.Duration(recsSecs) * time.Second}
-					reqGroupToReqs[job.ReqGroup] = recommendedReq
+				rr, existed := reqGroupRecommenders[job.ReqGroup]
+				if !existed {
+					rr, _ = s.db.reqsRecommender(job.ReqGroup)
+					reqGroupRecommenders[job.ReqGroup] = rr
+				}
+				if rr != nil {
+					recommendedReq = rr.reqs(job.SizeHint)
 				}
+				reqGroupToReqs[recKey] = recommendedReq
 			}
 
 			if recommendedReq != nil || job.FailReason == FailReasonRAM || job.FailReason == FailReasonDisk || job.FailReason == FailReasonTime {
@@ -1299,50 +1541,7 @@ func (s *Server) createQueue() {
 					}
 				}
 
-				if recommendedReq.RAM > 0 {
-					if job.RequirementsOrig.RAM > 0 {
-						switch job.Override {
-						case 0:
-							job.Requirements.RAM = recommendedReq.RAM
-						case 1:
-							if recommendedReq.RAM > job.Requirements.RAM {
-								job.Requirements.RAM = recommendedReq.RAM
-							}
-						}
-					} else {
-						job.Requirements.RAM = recommendedReq.RAM
-					}
-				}
-
-				if recommendedReq.Disk > 0 {
-					if job.RequirementsOrig.Disk > 0 || job.RequirementsOrig.DiskSet {
-						switch job.Override {
-						case 0:
-							job.Requirements.Disk = recommendedReq.Disk
-						case 1:
-							if recommendedReq.Disk > job.Requirements.Disk {
-								job.Requirements.Disk = recommendedReq.Disk
-							}
-						}
-					} else {
-						job.Requirements.Disk = recommendedReq.Disk
-					}
-				}
-
-				if recommendedReq.Time.Seconds() > 0 {
-					if job.RequirementsOrig.Time > 0 {
-						switch job.Override {
-						case 0:
-							job.Requirements.Time = recommendedReq.Time
-						case 1:
-							if recommendedReq.Time > job.Requirements.Time {
-								job.Requirements.Time = recommendedReq.Time
-							}
-						}
-					} else {
-						job.Requirements.Time = recommendedReq.Time
-					}
-				}
+				applyRecommendedReqs(job, recommendedReq)
 
 				switch job.FailReason {
 				case FailReasonRAM:
@@ -1384,19 +1583,26 @@ func (s *Server) createQueue() {
 
 			req := reqForScheduler(job.Requirements)
 
+			// jobs covered by an exceeded budget are held back in a reserve
+			// group that no runner will ask for, and aren't scheduled
+			job.RLock()
+			repGroup, user := job.RepGroup, job.User
+			job.RUnlock()
 			prevSchedGroup := job.getSchedulerGroup()
+			budget := s.exceededBudget(repGroup, user)
+			job.Lock()
+			job.BudgetExceeded = budget
+			job.Unlock()
+			if budget != "" {
+				s.setJobReserveGroup(q, job, prevSchedGroup, budgetHeldGroupPrefix+budget)
+				continue
+			}
+
 			schedulerGroup := job.generateSchedulerGroup(req)
 			if rc != "" && prevSchedGroup != schedulerGroup {
-				job.setSchedulerGroup(schedulerGroup)
-				errs := q.SetReserveGroup(job.Key(), schedulerGroup)
-				if errs != nil {
-					// we could be trying to set the reserve group after the
-					// job has already completed, if they complete
-					// ~instantly
-					if qerr, ok := errs.(queue.Error); !ok || qerr.Err != queue.ErrNotFound {
-						s.Warn("readycallback queue setreservegroup failed", "err", errs)
-					}
-				}
+				s.setJobReserveGroup(q, job, prevSchedGroup, schedulerGroup)
+			} else if rc == "" && strings.HasPrefix(prevSchedGroup, budgetHeldGroupPrefix) {
+				s.setJobReserveGroup(q, job, prevSchedGroup, "")
 			}
 
 			if rc != "" {
@@ -1430,12 +1636,27 @@ func (s *Server) createQueue() {
 				if job.Priority > group.priority {
 					group.priority = job.Priority
 				}
+				if job.deadlineUrgent() {
+					group.urgent = true
+				} else if wait := job.untilDeadlineUrgent(); wait > 0 && (urgencyWait == 0 || wait < urgencyWait) {
+					urgencyWait = wait
+				}
 			}
 		}
 
 		if rc != "" {
+			var rateWait time.Duration
 			for name, group := range groups {
 				s.Debug("rac saw ready jobs", "group", name, "count", group.count, "limitskipped", group.skipped)
+
+				// if jobs were skipped because of rate limits, we'll need to
+				// schedule them once the rate allows, even if nothing else
+				// happens in the mean time
+				if group.skipped > 0 {
+					if wait := s.limiter.GetRateWait(s.schedGroupToLimitGroups(name)); wait > 0 && (rateWait == 0 || wait < rateWait) {
+						rateWait = wait
+					}
+				}
 			}
 
 			// add in info for running jobs
@@ -1508,6 +1729,21 @@ func (s *Server) createQueue() {
 			// new jobs get added
 			s.racmutex.Lock()
 			defer s.racmutex.Unlock()
+			if rateWait > 0 {
+				if s.rateTimer != nil {
+					s.rateTimer.Stop()
+				}
+				s.rateTimer = time.AfterFunc(rateWait, q.TriggerReadyAddedCallback)
+			}
+			if s.urgencyTimer != nil {
+				s.urgencyTimer.Stop()
+				s.urgencyTimer = nil
+			}
+			if urgencyWait > 0 {
+				// so that the runners of jobs that become deadline urgent get
+				// rescheduled with maximum priority at that point
+				s.urgencyTimer = time.AfterFunc(urgencyWait, q.TriggerReadyAddedCallback)
+			}
 			if s.racChecking {
 				if !s.racCheckTimer.Stop() {
 					<-s.racCheckTimer.C
@@ -1717,7 +1953,7 @@ func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool
 	s.racmutex.RUnlock()
 
 	// create itemdefs for the jobs
-	limitGroups := make(map[string]int)
+	limitGroups := make(map[string]*limitGroup)
 	for _, job := range inputJobs {
 		job.Lock()
 		job.EnvKey = envkey
@@ -1729,17 +1965,19 @@ func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool
 			job.BsubID = atomic.AddUint64(&BsubID, 1)
 		}
 
-		if len(job.LimitGroups) > 0 {
-			err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
-			if err != nil {
-				return added, dups, alreadyComplete, ErrBadLimitGroup, err
-			}
+		thisSrerr, err := s.checkNewJob(job, limitGroups)
+		job.Unlock()
+		if err != nil {
+			return added, dups, alreadyComplete, thisSrerr, err
 		}
+	}
 
-		job.Unlock()
+	err := s.checkNewJobCycles(inputJobs)
+	if err != nil {
+		return added, dups, alreadyComplete, cycleCheckSrerr(err), err
 	}
 
-	err := s.storeLimitGroups(limitGroups)
+	err = s.storeLimitGroups(limitGroups)
 	if err != nil {
 		return added, dups, alreadyComplete, ErrDBError, err
 	}
@@ -1759,20 +1997,20 @@ func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool
 		qerr = err
 	} else {
 		// now that jobs are in the db we can get dependencies fully, so now we
-		// can build our itemdefs *** we really need to test for cycles, because
-		// if the user creates one, we won't let them delete the bad jobs!
+		// can build our itemdefs (checkNewJobCycles() already made sure they
+		// won't form a cycle, which would leave them dependent forever).
 		// storeNewJobs() returns jobsToQueue, which is all of cr.Jobs plus any
 		// previously Archive()d jobs that were resurrected because of one of
 		// their DepGroup dependencies being in cr.Jobs
 		var itemdefs []*queue.ItemDef
 		for _, job := range jobsToQueue {
-			deps, err := job.Dependencies.incompleteJobKeys(s.db)
+			deps, rules, err := s.dependencyKeys(job)
 			if err != nil {
 				srerr = ErrDBError
 				qerr = err
 				break
 			}
-			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps})
+			itemdefs = append(itemdefs, &queue.ItemDef{Key: job.Key(), ReserveGroup: job.getSchedulerGroup(), Data: job, Priority: job.Priority, Delay: 0 * time.Second, TTR: ServerItemTTR, Dependencies: deps, StartBy: job.startBy(), DepRules: rules})
 		}
 
 		srerr, qerr = s.updateJobDependencies(jobsToUpdate)
@@ -1790,42 +2028,82 @@ func (s *Server) createJobs(inputJobs []*Job, envkey string, ignoreComplete bool
 	return added, dups, alreadyComplete, srerr, qerr
 }
 
+// checkNewJob fixes the user-specified LimitGroups of a job that is about to be
+// added (see handleUserSpecifiedJobLimitGroups()) and checks its Dependencies,
+// returning the srerr and error that createJobs() should return if there is a
+// problem. You should hold the lock on the Job before calling this.
+func (s *Server) checkNewJob(job *Job, limitGroups map[string]*limitGroup) (string, error) {
+	if len(job.LimitGroups) > 0 {
+		err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
+		if err != nil {
+			return ErrBadLimitGroup, err
+		}
+	}
+
+	err := s.checkRemoteDependencies(job.Dependencies)
+	if err != nil {
+		return ErrUnknownManager, err
+	}
+	return "", nil
+}
+
+// cycleCheckSrerr returns the srerr that goes with an error from
+// checkNewJobCycles().
+func cycleCheckSrerr(err error) string {
+	if jqerr, ok := err.(Error); ok {
+		return jqerr.Err
+	}
+	return ErrDBError
+}
+
 // handleUserSpecifiedJobLimitGroups takes limit groups on a job that may have
-// been specified like name:limit, and fixes them to remove the limit suffix,
-// dedup and sort the groups, and fill in your supplied limitGroups map with the
-// latest limit on groups, if any were specified. You should hold the lock on
-// the Job before calling this.
-func (s *Server) handleUserSpecifiedJobLimitGroups(job *Job, limitGroups map[string]int) error {
-	// remove limit suffixes and remember the last limit per group specified
-	for i, group := range job.LimitGroups {
-		name, limit, suffixed, err := s.splitSuffixedLimitGroup(group)
+// been specified like name:limit or name:limit:rate, and fixes them to remove
+// the suffix, dedup and sort the groups, and fill in your supplied limitGroups
+// map with the latest limit on groups, if any were specified. Names may also be
+// given a weight like name*weight:limit, which is kept on the job's group name
+// (except for weights of 1) so that the limiter consumes that many units of
+// the group for the job. You should hold the lock on the Job before calling
+// this.
+func (s *Server) handleUserSpecifiedJobLimitGroups(job *Job, limitGroups map[string]*limitGroup) error {
+	// remove limit suffixes and remember the last limit and weight per group
+	// specified
+	weighted := make(map[string]string, len(job.LimitGroups))
+	for _, group := range job.LimitGroups {
+		spec, lg, err := s.splitSuffixedLimitGroup(group)
 		if err != nil {
 			return err
 		}
-		if suffixed {
-			job.LimitGroups[i] = name
-			limitGroups[name] = limit
+		name, weight, err := limiter.SplitWeight(spec)
+		if err != nil {
+			return err
+		}
+		weighted[name] = limiter.JoinWeight(name, weight)
+		if lg != nil {
+			limitGroups[name] = lg
 		}
 	}
 
 	// because these later become part of scheduler groups names, store
 	// them in sorted order, with no duplicates
-	if len(job.LimitGroups) > 1 {
-		job.LimitGroups = internal.DedupSortStrings(job.LimitGroups)
+	groups := make([]string, 0, len(weighted))
+	for _, group := range weighted {
+		groups = append(groups, group)
 	}
+	sort.Strings(groups)
+	job.LimitGroups = groups
 
 	return nil
 }
 
 // storeLimitGroups calls db.storeLimitGroups() and handles updating the
 // in-memory representation of the groups.
-func (s *Server) storeLimitGroups(limitGroups map[string]int) error {
+func (s *Server) storeLimitGroups(limitGroups map[string]*limitGroup) error {
 	changed, removed, err := s.db.storeLimitGroups(limitGroups)
 	if err != nil {
 		return err
 	}
 	for _, group := range changed {
-		s.limiter.SetLimit(group, uint(limitGroups[group]))
+		s.setLimiterGroup(group, limitGroups[group])
 	}
 	for _, group := range removed {
 		s.limiter.RemoveLimit(group)
@@ -1833,6 +2111,18 @@ func (s *Server) storeLimitGroups(limitGroups map[string]int) error {
 	return nil
 }
 
+// setLimiterGroup updates our limiter's in-memory limit and rate of a group
+// that was stored in the database, without losing its current count.
+func (s *Server) setLimiterGroup(name string, lg *limitGroup) {
+	if lg.limit >= 0 {
+		s.limiter.SetLimit(name, uint(lg.limit))
+		s.limiter.SetRate(name, lg.rate)
+		return
+	}
+	s.limiter.SetRate(name, lg.rate)
+	s.limiter.ClearLimit(name)
+}
+
 // updateJobDependencies is used to handle the jobsToUpdate from storeNewJobs()
 // and db.modifyLiveJobs(). These are those jobs currently in the queue that
 // need their dependencies updated because they just changed when we stored the
@@ -1842,13 +2132,18 @@ func (s *Server) updateJobDependencies(jobs []*Job) (srerr string, qerr error) {
 	s.racPending = true
 	s.rpmutex.Unlock()
 	for _, job := range jobs {
-		deps, err := job.Dependencies.incompleteJobKeys(s.db)
+		deps, rules, err := s.dependencyKeys(job)
 		if err != nil {
 			srerr = ErrDBError
 			qerr = err
 			break
 		}
-		thisErr := s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
+		thisErr := s.q.SetDepRules(job.Key(), rules)
+		if thisErr != nil {
+			qerr = thisErr
+			break
+		}
+		thisErr = s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
 		if thisErr != nil {
 			qerr = thisErr
 			break
@@ -1857,6 +2152,61 @@ func (s *Server) updateJobDependencies(jobs []*Job) (srerr string, qerr error) {
 	return srerr, qerr
 }
 
+// applyRecommendedReqs changes the job's Requirements to those recommended
+// (based on prior jobs in its ReqGroup), taking in to account its Override and
+// original Requirements. You must hold the job's lock and have set its
+// RequirementsOrig before calling this.
+func applyRecommendedReqs(job *Job, rec *scheduler.Requirements) {
+	if rec == nil {
+		return
+	}
+
+	if rec.RAM > 0 {
+		if job.RequirementsOrig.RAM > 0 {
+			switch job.Override {
+			case 0:
+				job.Requirements.RAM = rec.RAM
+			case 1:
+				if rec.RAM > job.Requirements.RAM {
+					job.Requirements.RAM = rec.RAM
+				}
+			}
+		} else {
+			job.Requirements.RAM = rec.RAM
+		}
+	}
+
+	if rec.Disk > 0 {
+		if job.RequirementsOrig.Disk > 0 || job.RequirementsOrig.DiskSet {
+			switch job.Override {
+			case 0:
+				job.Requirements.Disk = rec.Disk
+			case 1:
+				if rec.Disk > job.Requirements.Disk {
+					job.Requirements.Disk = rec.Disk
+				}
+			}
+		} else {
+			job.Requirements.Disk = rec.Disk
+		}
+	}
+
+	if rec.Time.Seconds() > 0 {
+		if job.RequirementsOrig.Time > 0 {
+			switch job.Override {
+			case 0:
+				job.Requirements.Time = rec.Time
+			case 1:
+				if rec.Time > job.Requirements.Time {
+					job.Requirements.Time = rec.Time
+				}
+			}
+		} else {
+			job.Requirements.Time = rec.Time
+		}
+	}
+}
+
 // confirmJobDead() checks if the actual PID isn't running on the job's host.
 //  You must hold the job.Lock() before calling this.
 func (s *Server) confirmJobDead(job *Job) bool {
@@ -1884,6 +2234,8 @@ func (s *Server) releaseJob(job *Job, endState *JobEndState, failReason string,
 	currentState := job.State
 	job.RUnlock()
 
+	s.releaseJobTokens(key)
+
 	item, err := s.q.Get(key)
 	if err != nil {
 		return err
@@ -1913,7 +2265,9 @@ func (s *Server) releaseJob(job *Job, endState *JobEndState, failReason string,
 		return errq
 	}
 
-	job.updateAfterExit(endState, s.limiter)
+	if job.updateAfterExit(endState, s.limiter) {
+		s.chargeJob(job)
+	}
 
 	job.Lock()
 	if forceBury {
@@ -1942,6 +2296,51 @@ func (s *Server) releaseJob(job *Job, endState *JobEndState, failReason string,
 	return nil
 }
 
+// chargeJob works out the cost of the run of a job that just exited according
+// to our CostRates (if any), adding it to the job's Cost, and works out the
+// core-hours it reserved. Both are noted for storage in the database's cost
+// totals, and count against any budgets.
+func (s *Server) chargeJob(job *Job) {
+	cost, coreHours := s.costJob(job)
+	if cost <= 0 && coreHours <= 0 {
+		return
+	}
+
+	job.RLock()
+	repGroup, user := job.RepGroup, job.User
+	job.RUnlock()
+	s.noteSpending(repGroup, user, cost, coreHours)
+}
+
+// costJob does the work of chargeJob() apart from counting against budgets,
+// returning the cost and core-hours.
+func (s *Server) costJob(job *Job) (float64, float64) {
+	job.RLock()
+	host := job.Host
+	req := *job.Requirements
+	var wall time.Duration
+	if !job.StartTime.IsZero() {
+		wall = job.EndTime.Sub(job.StartTime)
+	}
+	job.RUnlock()
+
+	coreHours := jobCoreHours(&req, wall)
+	var cost float64
+	if s.costRates != nil {
+		cost = s.costRates.jobCost(&req, s.scheduler.HostFlavor(host), wall)
+	}
+	if cost <= 0 && coreHours <= 0 {
+		return 0, 0
+	}
+
+	job.Lock()
+	job.Cost += cost
+	job.runCost = cost
+	job.runCoreHours = coreHours
+	job.Unlock()
+	return cost, coreHours
+}
+
 // inputToQueuedJobs shows you which of the inputJobs are now actually in the
 // queue
 func (s *Server) inputToQueuedJobs(inputJobs []*Job) []*Job {
@@ -1992,6 +2391,206 @@ func (s *Server) killJob(jobkey string) (bool, error) {
 	return true, err
 }
 
+// kickJobs moves the jobs with the given keys from the bury queue to the ready
+// queue. Keys of jobs that are not currently buried are ignored. Returns the
+// keys of jobs actually kicked.
+func (s *Server) kickJobs(keys []string) []string {
+	var kicked []string
+	for _, jobkey := range keys {
+		item, err := s.q.Get(jobkey)
+		if err != nil || item.Stats().State != queue.ItemStateBury {
+			continue
+		}
+		s.rpmutex.Lock()
+		s.racPending = true
+		s.rpmutex.Unlock()
+		err = s.q.Kick(jobkey)
+		if err == nil {
+			job := item.Data().(*Job)
+			job.Lock()
+			job.UntilBuried = job.Retries + 1
+			s.Debug("unburied job", "cmd", job.Cmd, "schedGrp", job.schedulerGroup)
+			job.State = JobStateReady
+			job.Unlock()
+			kicked = append(kicked, jobkey)
+
+			s.db.updateJobAfterChange(job)
+		} else {
+			s.rpmutex.Lock()
+			s.racPending = false
+			s.rpmutex.Unlock()
+		}
+	}
+	return kicked
+}
+
+// modifyJobs modifies the jobs with the given keys that are in the
+// bury/delay/dependent/ready queue and the live bucket, according to the given
+// modifier. Running jobs are ignored.
+//
+// Returns a REVERSE mapping of new to old Job keys for the jobs that were
+// modified. The string return value is one of our Err* constants, set if there
+// was an error.
+func (s *Server) modifyJobs(keys []string, modifier *JobModifier) (map[string]string, string, error) {
+	// to avoid race conditions with jobs that are currently pending, but
+	// become running in the middle of us trying to modify them, we first
+	// pause the server, and resume it afterwards
+	paused, err := s.Pause()
+	if err != nil {
+		if jqerr, ok := err.(Error); ok {
+			return nil, jqerr.Err, err
+		}
+		return nil, ErrInternalError, err
+	}
+	if paused {
+		s.Debug("modify requested, paused server")
+	} else {
+		s.Debug("modify requested")
+	}
+
+	var toModifyJobs []*Job
+	toModifyKeys := make(map[string]*Job)
+	for _, jobkey := range keys {
+		item, errg := s.q.Get(jobkey)
+		if errg != nil || item == nil {
+			continue
+		}
+		iState := item.Stats().State
+		if iState == queue.ItemStateRun {
+			continue
+		}
+		toModifyJobs = append(toModifyJobs, item.Data().(*Job))
+		toModifyKeys[jobkey] = item.Data().(*Job)
+	}
+
+	var srerr string
+	var modified map[string]string
+	err = s.checkModifiedJobCycles(toModifyJobs, modifier)
+	if err == nil {
+		modified, err = modifier.Modify(toModifyJobs, s)
+	}
+	if err != nil {
+		if jqerr, ok := err.(Error); ok {
+			srerr = jqerr.Err
+		} else {
+			srerr = ErrInternalError
+		}
+	}
+
+	if err == nil && len(modified) > 0 {
+		s.storeModifiedJobs(modified, toModifyKeys, modifier)
+	}
+
+	// now resume the server again
+	resumed, errr := s.Resume()
+	if errr != nil {
+		s.Error(errr.Error())
+	} else if resumed {
+		s.Debug("modify completed, resumed server", "count", len(modified))
+	} else {
+		s.Debug("modify completed", "count", len(modified))
+	}
+
+	return modified, srerr, err
+}
+
+// storeModifiedJobs is used by modifyJobs() to reflect the changes made to
+// jobs by a JobModifier in our limit groups, queue, rpl lookup and database.
+// modified is the REVERSE mapping of new to old Job keys returned by
+// JobModifier.Modify(), while oldKeyToJob maps old keys to the modified jobs.
+func (s *Server) storeModifiedJobs(modified map[string]string, oldKeyToJob map[string]*Job, modifier *JobModifier) {
+	var toModify []*Job
+	for _, old := range modified {
+		job := oldKeyToJob[old]
+		if job != nil {
+			toModify = append(toModify, job)
+		}
+	}
+
+	// additional handling of changed limit groups
+	if modifier.LimitGroupsSet {
+		limitGroups := make(map[string]*limitGroup)
+		for _, job := range toModify {
+			err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
+			if err != nil {
+				s.Error("failed to modify limit group", "err", err)
+			}
+		}
+		err := s.storeLimitGroups(limitGroups)
+		if err != nil {
+			s.Error("failed to store limit groups", "err", err)
+		}
+	}
+
+	// update changed keys in the queue and in our rpl lookup
+	keyToRP := make(map[string]string)
+	for _, job := range toModify {
+		keyToRP[job.Key()] = job.RepGroup
+	}
+	s.rpl.Lock()
+	for new, old := range modified {
+		if old == new {
+			continue
+		}
+		errc := s.q.ChangeKey(old, new)
+		if errc != nil {
+			s.Error("failed to change a job key in the queue", "err", errc)
+		}
+
+		rp := keyToRP[new]
+		if _, exists := s.rpl.lookup[rp]; !exists {
+			s.rpl.lookup[rp] = make(map[string]bool)
+		}
+		delete(s.rpl.lookup[rp], old)
+		s.rpl.lookup[rp][new] = true
+	}
+	s.rpl.Unlock()
+
+	// update db live bucket and dep lookups
+	if len(toModify) == 0 {
+		return
+	}
+	oldKeys := make([]string, len(toModify))
+	for i, job := range toModify {
+		oldKeys[i] = modified[job.Key()]
+	}
+	errm := s.db.modifyLiveJobs(oldKeys, toModify)
+	if errm != nil {
+		s.Error("job modification in database failed", "err", errm)
+		return
+	}
+
+	if modifier.DependenciesSet || modifier.PrioritySet {
+		// if we're changing the jobs these jobs are dependant upon or their
+		// priority, that must be reflected in the queue as well
+		for _, job := range toModify {
+			deps, rules, err := s.dependencyKeys(job)
+			if err != nil {
+				s.Error("failed to get job dependencies", "err", err)
+			}
+			err = s.q.SetDepRules(job.Key(), rules)
+			if err != nil {
+				s.Error("failed to modify a job in the queue", "err", err)
+			}
+			err = s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
+			if err != nil {
+				s.Error("failed to modify a job in the queue", "err", err)
+			}
+		}
+	}
+
+	if modifier.DeadlineSet || modifier.Requirements != nil {
+		// the time these jobs need to start by to meet their deadline may have
+		// changed
+		for _, job := range toModify {
+			err := s.q.SetStartBy(job.Key(), job.startBy())
+			if err != nil {
+				s.Error("failed to modify a job's deadline in the queue", "err", err)
+			}
+		}
+	}
+}
+
 // deleteJobs deletes the jobs with the given keys from the
 // bury/delay/dependent/ready queue and the live bucket. Does not delete jobs
 // that have jobs dependant upon them, unless all those dependants were also
@@ -2145,6 +2744,8 @@ func (s *Server) getJobsByKeys(keys []string, getStd bool, getEnv bool) (jobs []
 		}
 	}
 
+	s.predictDeadlines(jobs)
+	s.noteRemoteProblems(jobs)
 	return jobs, srerr, qerr
 }
 
@@ -2225,6 +2826,9 @@ func (s *Server) getJobsByRepGroup(repgroup string, search bool, limit int, stat
 		}
 	}
 
+	s.predictDeadlines(jobs)
+	s.noteRemoteProblems(jobs)
+
 	if limit > 0 || state != "" || getStd || getEnv {
 		jobs = s.limitJobs(jobs, limit, state, getStd, getEnv)
 	}
@@ -2241,6 +2845,47 @@ func (s *Server) getCompleteJobsByRepGroup(repgroup string) (jobs []*Job, srerr
 	return jobs, srerr, qerr
 }
 
+// searchJobHistory gets jobs that have exited and match the given search, in
+// the order they ended. Jobs that are still in the queue are returned in their
+// current state if they haven't started running again since. Also returns a
+// cursor for getting the next page of results, if the search's Limit was
+// reached.
+func (s *Server) searchJobHistory(js *JobSearch, getStd bool, getEnv bool) ([]*Job, string, error) {
+	jobs, next, err := s.db.retrieveJobHistory(js)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i, job := range jobs {
+		if job.State != JobStateComplete {
+			item, errg := s.q.Get(job.Key())
+			if errg == nil && item != nil {
+				current := s.itemToJob(item, false, false)
+				if current.EndTime.Equal(job.EndTime) {
+					jobs[i] = current
+				}
+			}
+		}
+
+		if getStd || getEnv {
+			s.jobPopulateStdEnv(jobs[i], getStd, getEnv)
+		}
+	}
+
+	return jobs, next, nil
+}
+
+// ExportHistory exports the jobs that have exited and match the given search,
+// in the order they ended, using the given exporter. The search's Limit and
+// After are ignored: jobs are retrieved from the database a page at a time, so
+// that any number of jobs can be exported using bounded memory. You must
+// Close() the exporter yourself afterwards.
+func (s *Server) ExportHistory(js *JobSearch, exporter JobExporter) error {
+	return exportHistory(js, exporter, func(page *JobSearch) ([]*Job, string, error) {
+		return s.searchJobHistory(page, false, false)
+	})
+}
+
 // getJobsCurrent gets all current (incomplete) jobs.
 func (s *Server) getJobsCurrent(limit int, state JobState, getStd bool, getEnv bool) []*Job {
 	allItems := s.q.AllItems()
@@ -2249,6 +2894,9 @@ func (s *Server) getJobsCurrent(limit int, state JobState, getStd bool, getEnv b
 		jobs = append(jobs, s.itemToJob(item, false, false))
 	}
 
+	s.predictDeadlines(jobs)
+	s.noteRemoteProblems(jobs)
+
 	if limit > 0 || state != "" || getStd || getEnv {
 		jobs = s.limitJobs(jobs, limit, state, getStd, getEnv)
 	}
@@ -2351,7 +2999,14 @@ func (s *Server) scheduleRunners(group *sgroup) {
 		return
 	}
 
-	err := s.scheduler.Schedule(s.groupToScheduleCmd(rc, group.name, group.req), group.req, group.priority, group.count)
+	// groups with jobs that must start soon to meet their deadline get their
+	// runners spawned before any others
+	priority := group.priority
+	if group.urgent {
+		priority = math.MaxUint8
+	}
+
+	err := s.scheduler.Schedule(s.groupToScheduleCmd(rc, group.name, group.req), group.req, priority, group.count)
 	if err != nil {
 		problem := true
 		if serr, ok := err.(scheduler.Error); ok && serr.Err == scheduler.ErrImpossible {
@@ -2464,40 +3119,76 @@ func (s *Server) getBadServers() []*BadServer {
 // getSetLimitGroup does the server side of Client.GetOrSetLimitGroup(), taking
 // the same argument. The string return value is one of our Err* constants.
 func (s *Server) getSetLimitGroup(group string) (int, string, error) {
-	name, limit, suffixed, err := s.splitSuffixedLimitGroup(group)
+	spec, lg, err := s.splitSuffixedLimitGroup(group)
+	if err != nil {
+		return 0, ErrBadLimitGroup, err
+	}
+	name, _, err := limiter.SplitWeight(spec)
 	if err != nil {
 		return 0, ErrBadLimitGroup, err
 	}
-	if suffixed {
-		_, removed, err := s.db.storeLimitGroups(map[string]int{name: limit})
+	if lg != nil {
+		_, removed, err := s.db.storeLimitGroups(map[string]*limitGroup{name: lg})
 		if err != nil {
 			return -1, ErrDBError, err
 		}
-		if limit >= 0 {
-			s.limiter.SetLimit(name, uint(limit))
+		if lg.limit >= 0 || lg.rate != nil {
+			s.setLimiterGroup(name, lg)
 		}
 		for _, g := range removed {
 			s.limiter.RemoveLimit(g)
 		}
 		s.q.TriggerReadyAddedCallback()
-		return limit, "", nil
+		return lg.limit, "", nil
 	}
 	return s.limiter.GetLimit(name), "", nil
 }
 
+// limitGroupRates returns the rate limits of the limit groups currently in use,
+// in the form accepted by limiter.ParseRate().
+func (s *Server) limitGroupRates() map[string]string {
+	rates := make(map[string]string)
+	for name, rate := range s.limiter.GetRates() {
+		rates[name] = rate.String()
+	}
+	return rates
+}
+
 // splitSuffixedLimitGroup parses a limit group that might be suffixed with a
-// colon and the limit of that group. Returns the group name, and if the final
-// bool is true, the int will be the desired limit for that group.
-func (s *Server) splitSuffixedLimitGroup(group string) (string, int, bool, error) {
+// colon and the limit of that group, and/or a colon and a rate limit like
+// count/duration. Returns the group name, and if it was suffixed, the desired
+// limitGroup (with a limit of -1 if only a rate was given).
+func (s *Server) splitSuffixedLimitGroup(group string) (string, *limitGroup, error) {
 	parts := strings.Split(group, ":")
-	if len(parts) == 2 {
+	switch len(parts) {
+	case 1:
+		return group, nil, nil
+	case 2:
+		if strings.Contains(parts[1], "/") {
+			rate, err := limiter.ParseRate(parts[1])
+			if err != nil {
+				return "", nil, err
+			}
+			return parts[0], &limitGroup{limit: -1, rate: rate}, nil
+		}
+
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return parts[0], &limitGroup{limit: limit}, nil
+	case 3:
 		limit, err := strconv.Atoi(parts[1])
 		if err != nil {
-			return "", -1, false, err
+			return "", nil, err
 		}
-		return parts[0], limit, true, nil
+		rate, err := limiter.ParseRate(parts[2])
+		if err != nil {
+			return "", nil, err
+		}
+		return parts[0], &limitGroup{limit: limit, rate: rate}, nil
 	}
-	return group, -1, false, nil
+	return "", nil, Error{"LimitGroup", group, ErrBadLimitGroup}
 }
 
 // storeWebSocketConnection stores a connection and returns a unique identifier
@@ -2559,6 +3250,10 @@ func (s *Server) shutdown(reason string, wait bool, stopSigHandling bool) {
 	s.drain = true
 	s.ServerInfo.Mode = ServerModeDrain
 	s.ssmutex.Unlock()
+
+	// free any waiting standbys
+	s.db.replication.stopReplicating()
+
 	s.krmutex.Lock()
 	s.killRunners = true
 	s.krmutex.Unlock()
@@ -2614,6 +3309,11 @@ func (s *Server) shutdown(reason string, wait bool, stopSigHandling bool) {
 		s.Warn("server shutdown socket close failed", "err", err)
 	}
 
+	// stop probing limit groups and watching remote managers, which would
+	// otherwise keep our waitgroup waiting
+	s.stopLimitGroupProbes()
+	s.stopRemoteManagers()
+
 	// close the database
 	err = s.db.close()
 	if err != nil {
@@ -2656,6 +3356,17 @@ func (s *Server) shutdown(reason string, wait bool, stopSigHandling bool) {
 		break
 	}
 
+	s.racmutex.Lock()
+	if s.rateTimer != nil {
+		s.rateTimer.Stop()
+	}
+	if s.urgencyTimer != nil {
+		s.urgencyTimer.Stop()
+	}
+	s.racmutex.Unlock()
+
+	s.shutdownProtectors()
+
 	// clean up our queues and empty everything out to be garbage collected,
 	// in case the same process calls Serve() again after this
 	err = s.q.Destroy()
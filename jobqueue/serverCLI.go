@@ -27,6 +27,7 @@ import (
 
 	"github.com/VertebrateResequencing/wr/jobqueue/scheduler"
 	"github.com/VertebrateResequencing/wr/queue"
+	"github.com/gofrs/uuid"
 	"github.com/ugorji/go/codec"
 	"nanomsg.org/go-mangos"
 )
@@ -45,6 +46,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	var sr *serverResponse
 	var srerr string
 	var qerr string
+	var srerrItem string // what srerr is about, if the client won't know
 
 	s.ssmutex.RLock()
 	up := s.up
@@ -82,9 +84,9 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			} else {
 				sr = &serverResponse{DB: b.Bytes()}
 			}
-		case "pause":
-			s.Debug("pause requested")
-			paused, err := s.Pause()
+		case "compact":
+			s.Info("database compaction requested")
+			result, err := s.CompactDB()
 			if err != nil {
 				if jqerr, ok := err.(Error); ok {
 					srerr = jqerr.Err
@@ -93,19 +95,199 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				}
 				qerr = err.Error()
 			} else {
-				if paused {
-					s.Info("paused by request")
+				sr = &serverResponse{Compaction: result}
+			}
+		case "recaccuracy":
+			accuracy, err := s.RecommendationAccuracy(cr.ReqGroup)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Accuracy: accuracy}
+			}
+		case "getreqstats":
+			stats, err := s.ReqGroupStats(cr.ReqGroup)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{ReqStats: stats}
+			}
+		case "removereqstats":
+			if cr.ReqStatsFilter == nil {
+				srerr = ErrBadRequest
+			} else {
+				removed, err := s.RemoveReqGroupStats(cr.ReqStatsFilter)
+				if err != nil {
+					if jqerr, ok := err.(Error); ok {
+						srerr = jqerr.Err
+					} else {
+						srerr = ErrDBError
+					}
+					qerr = err.Error()
 				} else {
-					// clients are allowed to call pause as many times as they
-					// like, but a single resume call later should work, so we
-					// resume now to keep the internal pause counter at 1
-					resumed, err := s.Resume()
-					if err != nil {
-						s.Error("resume following an extraneous pause failed", "error", err)
-					} else if resumed {
-						s.Error("resumed incorrectly succeeded following a pause that did not")
+					sr = &serverResponse{Removed: removed}
+				}
+			}
+		case "seedreqstats":
+			added, err := s.SeedReqGroupStats(cr.Observations)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrDBError
+				}
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Added: added}
+			}
+		case "getbudgets":
+			var name string
+			if cr.Budget != nil {
+				name = cr.Budget.Name
+			}
+			sr = &serverResponse{Budgets: s.Budgets(name)}
+		case "setbudget":
+			if cr.Budget == nil {
+				srerr = ErrBadRequest
+			} else {
+				status, err := s.SetBudget(cr.Budget)
+				if err != nil {
+					if jqerr, ok := err.(Error); ok {
+						srerr = jqerr.Err
+					} else {
+						srerr = ErrDBError
+					}
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Budgets: []*BudgetStatus{status}}
+				}
+			}
+		case "removebudget":
+			if cr.Budget == nil {
+				srerr = ErrBadRequest
+			} else {
+				removed, err := s.RemoveBudget(cr.Budget.Name)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{}
+					if removed {
+						sr.Removed = 1
+					}
+				}
+			}
+		case "getprobes":
+			var group string
+			if cr.Probe != nil {
+				group = cr.Probe.Group
+			}
+			sr = &serverResponse{Probes: s.LimitGroupProbes(group)}
+		case "setprobe":
+			if cr.Probe == nil {
+				srerr = ErrBadRequest
+			} else {
+				status, err := s.SetLimitGroupProbe(cr.Probe)
+				if err != nil {
+					if jqerr, ok := err.(Error); ok {
+						srerr = jqerr.Err
+					} else {
+						srerr = ErrDBError
 					}
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Probes: []*LimitGroupProbeStatus{status}}
+				}
+			}
+		case "removeprobe":
+			if cr.Probe == nil {
+				srerr = ErrBadRequest
+			} else {
+				removed, err := s.RemoveLimitGroupProbe(cr.Probe.Group)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{}
+					if removed {
+						sr.Removed = 1
+					}
+				}
+			}
+		case "depstatus":
+			satisfied, err := s.dependenciesSatisfied(cr.Dependencies)
+			if err != nil {
+				srerr = ErrDBError
+				qerr = err.Error()
+			} else {
+				sr = &serverResponse{Satisfied: satisfied}
+			}
+		case "getremotes":
+			sr = &serverResponse{Remotes: s.RemoteManagers()}
+		case "tokenrequest":
+			receipt, err := s.RequestTokens(cr.Protector, cr.NumTokens, cr.TokenJobKey)
+			if err != nil {
+				srerr, qerr = tokenErr(err)
+			} else {
+				sr = &serverResponse{Receipt: receipt}
+			}
+		case "tokenwait":
+			granted, err := s.WaitForTokens(cr.Receipt, cr.Timeout)
+			if err != nil {
+				srerr, qerr = tokenErr(err)
+			} else {
+				sr = &serverResponse{Granted: granted}
+			}
+		case "tokentouch":
+			err := s.TouchTokens(cr.Receipt)
+			if err != nil {
+				srerr, qerr = tokenErr(err)
+			} else {
+				sr = &serverResponse{}
+			}
+		case "tokenrelease":
+			err := s.ReleaseTokens(cr.Receipt)
+			if err != nil {
+				srerr, qerr = tokenErr(err)
+			} else {
+				sr = &serverResponse{}
+			}
+		case "replicate":
+			resp, err := s.replicate(cr.ReplicaID, cr.ReplicaSeq, cr.Timeout)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrInternalError
+				}
+				qerr = err.Error()
+			} else {
+				sr = resp
+			}
+		case "replicatechunk":
+			resp, err := s.replicateChunk(cr.ReplicaSnapshot, cr.ReplicaOffset)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrInternalError
+				}
+				qerr = err.Error()
+			} else {
+				sr = resp
+			}
+		case "pause":
+			s.Debug("pause requested")
+			err := s.pauseOnRequest()
+			if err != nil {
+				if jqerr, ok := err.(Error); ok {
+					srerr = jqerr.Err
+				} else {
+					srerr = ErrInternalError
 				}
+				qerr = err.Error()
+			} else {
 				sr = &serverResponse{SStats: s.GetServerStats()}
 			}
 		case "resume":
@@ -155,8 +337,24 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			}
 		case "add":
 			// add jobs to the queue, and along side keep the environment variables
-			// they're supposed to execute under.
-			if cr.Env == nil || cr.Jobs == nil {
+			// they're supposed to execute under. In dry run mode, just report
+			// what adding them would do.
+			if cr.DryRun {
+				if cr.Jobs == nil {
+					srerr = ErrBadRequest
+				} else {
+					dr, thisSrerr, err := s.addDryRun(cr.Jobs, cr.IgnoreComplete)
+					if err != nil {
+						srerr = thisSrerr
+						qerr = err.Error()
+						if thisSrerr == ErrDependencyCycle {
+							srerrItem = err.(Error).Item
+						}
+					} else {
+						sr = &serverResponse{DryRun: dr}
+					}
+				}
+			} else if cr.Env == nil || cr.Jobs == nil {
 				srerr = ErrBadRequest
 			} else {
 				// Store Env
@@ -170,6 +368,9 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					if err != nil {
 						srerr = thisSrerr
 						qerr = err.Error()
+						if thisSrerr == ErrDependencyCycle {
+							srerrItem = err.(Error).Item
+						}
 					} else {
 						s.Debug("added jobs", "new", added, "dups", dups, "complete", alreadyComplete)
 						if cr.ReturnIDs {
@@ -185,86 +386,23 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					}
 				}
 			}
-		case "reserve":
-			// return the next ready job
+		case "reserve", "reservemany":
+			// return the next ready job(s)
 			if cr.ClientID.String() == "00000000-0000-0000-0000-000000000000" {
 				srerr = ErrBadRequest
 			} else if !drain {
-				// first just try to Reserve normally
-				var item *queue.Item
-				var err error
-
-				// don't proceed when we're expecting new/changed items
-				s.rpmutex.Lock()
-				var wch chan struct{}
-				if s.racPending || s.racRunning {
-					wch = make(chan struct{})
-					s.waitingReserves = append(s.waitingReserves, wch)
-				}
-				s.rpmutex.Unlock()
-				if wch != nil {
-					<-wch
-				}
-
-				skip := false
-				if cr.SchedulerGroup != "" {
-					// if this is the first job that the client is trying to
-					// reserve, and if we don't actually want any more clients
-					// working on this schedulerGroup, we'll just act as if
-					// nothing was ready. Likewise if in drain mode.
-					if cr.FirstReserve && s.rc != "" {
-						s.psgmutex.RLock()
-						if group, existed := s.previouslyScheduledGroups[cr.SchedulerGroup]; !existed || group.getCount() == 0 {
-							skip = true
-						}
-						s.psgmutex.RUnlock()
-					}
-				}
-
-				if !skip {
-					item, err = s.reserveWithLimits(cr.SchedulerGroup, cr.Timeout)
-
-					if err != nil {
-						if qerr, ok := err.(queue.Error); ok {
-							switch qerr.Err {
-							case queue.ErrNothingReady:
-								srerr = ""
-							case queue.ErrQueueClosed:
-								srerr = ErrQueueClosed
-							default:
-								srerr = ErrInternalError
-							}
-						}
-					}
+				n := 1
+				if cr.Method == "reservemany" {
+					n = cr.NumJobs
 				}
-
-				if srerr == "" && item != nil {
-					// clean up any past state to have a fresh job ready to run
-					sjob := item.Data().(*Job)
-					sjob.Lock()
-					sjob.ReservedBy = cr.ClientID //*** we should unset this on moving out of run state, to save space
-					sjob.Exited = false
-					sjob.Pid = 0
-					sjob.Host = ""
-					var tnil time.Time
-					sjob.StartTime = tnil
-					sjob.EndTime = tnil
-					sjob.PeakRAM = 0
-					sjob.PeakDisk = 0
-					sjob.Exitcode = -1
-					sgroup := sjob.schedulerGroup
-					sjob.Unlock()
-
-					errd := s.q.SetDelay(item.Key, ClientReleaseDelay)
-					if errd != nil {
-						s.Warn("reserve queue SetDelay failed", "err", errd)
+				var jobs []*Job
+				jobs, srerr = s.reserveJobs(cr, n)
+				if len(jobs) > 0 {
+					if cr.Method == "reserve" {
+						sr = &serverResponse{Job: jobs[0]}
+					} else {
+						sr = &serverResponse{Jobs: jobs}
 					}
-
-					// make a copy of the job with some extra stuff filled in (that
-					// we don't want taking up memory here) for the client
-					job := s.itemToJob(item, false, true)
-					sr = &serverResponse{Job: job}
-					s.Debug("reserved job", "cmd", job.Cmd, "schedGrp", sgroup)
 				}
 			} // else we'll return nothing, as if there were no jobs in the queue
 		case "jstart":
@@ -289,6 +427,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					job.Attempts++
 					job.killCalled = false
 					job.Lost = false
+					job.Cached = false
 					job.State = JobStateRunning
 
 					job.Unlock()
@@ -340,50 +479,52 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 		case "jarchive":
 			// remove the job from the queue, rpl and live bucket and add to
 			// complete bucket
-			var item *queue.Item
-			var job *Job
-			item, job, srerr = s.getij(cr, true)
+			var pa *preparedArchive
+			pa, srerr = s.prepareArchive(cr.ClientID, cr.Job, cr.JobEndState)
 			if srerr == "" {
-				// first check the item is still in the run queue (eg. the job
-				// wasn't released by another process; unlike the other methods,
-				// queue package does not check we're in the run queue when
-				// Remove()ing, since you can remove from any queue)
-				job.updateAfterExit(cr.JobEndState, s.limiter)
-				job.Lock()
-				running := item.Stats().State == queue.ItemStateRun
-				switch {
-				case !running:
-					srerr = ErrBadJob
-					job.Unlock()
-				case !job.Exited || job.Exitcode != 0 || job.StartTime.IsZero() || job.EndTime.IsZero():
-					srerr = ErrBadRequest
-					job.Unlock()
-				default:
-					key := job.Key()
-					job.State = JobStateComplete
-					job.FailReason = ""
-					sgroup := job.schedulerGroup
-					rgroup := job.RepGroup
-					job.Unlock()
-					err := s.db.archiveJob(key, job)
-					if err != nil {
-						srerr = ErrDBError
-						qerr = err.Error()
-					} else {
-						err = s.q.Remove(key)
-						if err != nil {
-							srerr = ErrInternalError
-							qerr = err.Error()
-						} else {
-							s.rpl.Lock()
-							if m, exists := s.rpl.lookup[rgroup]; exists {
-								delete(m, key)
-							}
-							s.rpl.Unlock()
-							s.Debug("completed job", "cmd", job.Cmd, "schedGrp", sgroup)
-							s.decrementGroupCount(sgroup, 1)
+				err := s.db.archiveJob(pa.job.Key(), pa.job)
+				if err != nil {
+					pa.undo()
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else if err = s.finishArchive(pa); err != nil {
+					srerr = ErrInternalError
+					qerr = err.Error()
+				}
+			}
+		case "jarchivemany":
+			// like jarchive, but for many jobs at once, archiving them in a
+			// single database transaction
+			if len(cr.JobEndStates) != len(cr.Jobs) {
+				srerr = ErrBadRequest
+			} else {
+				failed := make(map[string]string)
+				var pas []*preparedArchive
+				var jobs []*Job
+				for i, cjob := range cr.Jobs {
+					pa, jerr := s.prepareArchive(cr.ClientID, cjob, cr.JobEndStates[i])
+					if jerr != "" {
+						failed[cjob.Key()] = jerr
+						continue
+					}
+					pas = append(pas, pa)
+					jobs = append(jobs, pa.job)
+				}
+
+				err := s.db.archiveJobs(jobs)
+				if err != nil {
+					for _, pa := range pas {
+						pa.undo()
+					}
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					for _, pa := range pas {
+						if err = s.finishArchive(pa); err != nil {
+							failed[pa.job.Key()] = ErrInternalError
 						}
 					}
+					sr = &serverResponse{Failed: failed}
 				}
 			}
 		case "jrelease":
@@ -426,33 +567,8 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			if cr.Keys == nil {
 				srerr = ErrBadRequest
 			} else {
-				kicked := 0
-				for _, jobkey := range cr.Keys {
-					item, err := s.q.Get(jobkey)
-					if err != nil || item.Stats().State != queue.ItemStateBury {
-						continue
-					}
-					s.rpmutex.Lock()
-					s.racPending = true
-					s.rpmutex.Unlock()
-					err = s.q.Kick(jobkey)
-					if err == nil {
-						job := item.Data().(*Job)
-						job.Lock()
-						job.UntilBuried = job.Retries + 1
-						s.Debug("unburied job", "cmd", job.Cmd, "schedGrp", job.schedulerGroup)
-						job.State = JobStateReady
-						job.Unlock()
-						kicked++
-
-						s.db.updateJobAfterChange(job)
-					} else {
-						s.rpmutex.Lock()
-						s.racPending = false
-						s.rpmutex.Unlock()
-					}
-				}
-				sr = &serverResponse{Existed: kicked}
+				kicked := s.kickJobs(cr.Keys)
+				sr = &serverResponse{Existed: len(kicked)}
 			}
 		case "jdel":
 			// remove the jobs from the bury/delay/dependent/ready queue and the
@@ -470,136 +586,15 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 			if cr.Keys == nil || cr.Modifier == nil {
 				srerr = ErrBadRequest
 			} else {
-				// to avoid race conditions with jobs that are currently
-				// pending, but become running in the middle of us trying to
-				// modify them, we first pause the server, and resume it
-				// afterwards
-				paused, err := s.Pause()
+				modified, thisSrerr, err := s.modifyJobs(cr.Keys, cr.Modifier)
 				if err != nil {
-					if jqerr, ok := err.(Error); ok {
-						srerr = jqerr.Err
-					} else {
-						srerr = ErrInternalError
-					}
+					srerr = thisSrerr
 					qerr = err.Error()
-				} else if paused {
-					s.Debug("modify requested, paused server")
-				} else {
-					s.Debug("modify requested")
-				}
-
-				if err == nil {
-					var toModifyJobs []*Job
-					toModifyKeys := make(map[string]*Job)
-					for _, jobkey := range cr.Keys {
-						item, err := s.q.Get(jobkey)
-						if err != nil || item == nil {
-							continue
-						}
-						iState := item.Stats().State
-						if iState == queue.ItemStateRun {
-							continue
-						}
-						toModifyJobs = append(toModifyJobs, item.Data().(*Job))
-						toModifyKeys[jobkey] = item.Data().(*Job)
-					}
-
-					modified, err := cr.Modifier.Modify(toModifyJobs, s)
-					if err != nil {
-						if jqerr, ok := err.(Error); ok {
-							srerr = jqerr.Err
-						} else {
-							srerr = ErrInternalError
-						}
-						qerr = err.Error()
-					}
-
-					if err == nil && len(modified) > 0 {
-						var toModify []*Job
-						for _, old := range modified {
-							job := toModifyKeys[old]
-							if job != nil {
-								toModify = append(toModify, job)
-							}
-						}
-
-						// additional handling of changed limit groups
-						if cr.Modifier.LimitGroupsSet {
-							limitGroups := make(map[string]int)
-							for _, job := range toModify {
-								err := s.handleUserSpecifiedJobLimitGroups(job, limitGroups)
-								if err != nil {
-									s.Error("failed to modify limit group", "err", err)
-								}
-							}
-							err := s.storeLimitGroups(limitGroups)
-							if err != nil {
-								s.Error("failed to store limit groups", "err", err)
-							}
-						}
-
-						// update changed keys in the queue and in our rpl lookup
-						keyToRP := make(map[string]string)
-						for _, job := range toModify {
-							keyToRP[job.Key()] = job.RepGroup
-						}
-						s.rpl.Lock()
-						for new, old := range modified {
-							if old == new {
-								continue
-							}
-							errc := s.q.ChangeKey(old, new)
-							if errc != nil {
-								s.Error("failed to change a job key in the queue", "err", errc)
-							}
-
-							rp := keyToRP[new]
-							if _, exists := s.rpl.lookup[rp]; !exists {
-								s.rpl.lookup[rp] = make(map[string]bool)
-							}
-							delete(s.rpl.lookup[rp], old)
-							s.rpl.lookup[rp][new] = true
-						}
-						s.rpl.Unlock()
-
-						// update db live bucket and dep lookups
-						if len(toModify) > 0 {
-							oldKeys := make([]string, len(toModify))
-							for i, job := range toModify {
-								oldKeys[i] = modified[job.Key()]
-							}
-							errm := s.db.modifyLiveJobs(oldKeys, toModify)
-							if errm != nil {
-								s.Error("job modification in database failed", "err", errm)
-							} else if cr.Modifier.DependenciesSet || cr.Modifier.PrioritySet {
-								// if we're changing the jobs these jobs are
-								// dependant upon or their priority, that must be
-								// reflected in the queue as well
-								for _, job := range toModify {
-									deps, err := job.Dependencies.incompleteJobKeys(s.db)
-									if err != nil {
-										s.Error("failed to get job dependencies", "err", err)
-									}
-									err = s.q.Update(job.Key(), job.getSchedulerGroup(), job, job.Priority, 0*time.Second, ServerItemTTR, deps)
-									if err != nil {
-										s.Error("failed to modify a job in the queue", "err", err)
-									}
-								}
-							}
-						}
+					if thisSrerr == ErrDependencyCycle {
+						srerrItem = err.(Error).Item
 					}
-
+				} else {
 					sr = &serverResponse{Modified: modified}
-
-					// now resume the server again
-					resumed, err := s.Resume()
-					if err != nil {
-						s.Error(err.Error())
-					} else if resumed {
-						s.Debug("modify completed, resumed server", "count", len(modified))
-					} else {
-						s.Debug("modify completed", "count", len(modified))
-					}
 				}
 			}
 		case "jkill":
@@ -646,6 +641,36 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 					sr = &serverResponse{Jobs: jobs}
 				}
 			}
+		case "getgraph":
+			// get the dependency graph of jobs by their RepGroup
+			if cr.Job == nil || cr.Job.RepGroup == "" {
+				srerr = ErrBadRequest
+			} else {
+				g, err := s.DependencyGraph(cr.Job.RepGroup, cr.Search)
+				if err != nil {
+					if jqerr, ok := err.(Error); ok {
+						srerr = jqerr.Err
+					} else {
+						srerr = ErrDBError
+					}
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Graph: g}
+				}
+			}
+		case "gethist":
+			// search through jobs that have exited
+			if cr.History == nil {
+				srerr = ErrBadRequest
+			} else {
+				jobs, next, err := s.searchJobHistory(cr.History, cr.GetStd, cr.GetEnv)
+				if err != nil {
+					srerr = ErrDBError
+					qerr = err.Error()
+				} else {
+					sr = &serverResponse{Jobs: jobs, Next: next}
+				}
+			}
 		case "getin":
 			// get all jobs in the jobqueue
 			jobs := s.getJobsCurrent(cr.Limit, cr.State, cr.GetStd, cr.GetEnv)
@@ -719,7 +744,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 				}
 			}
 		case "getlgs":
-			sr = &serverResponse{LimitGroups: s.limiter.GetLimits()}
+			sr = &serverResponse{LimitGroups: s.limiter.GetLimits(), LimitRates: s.limitGroupRates(), LimitUsage: s.limiter.GetUsage()}
 		default:
 			srerr = ErrUnknownCommand
 		}
@@ -728,7 +753,7 @@ func (s *Server) handleRequest(m *mangos.Message) error {
 	// on error, just send the error back to client and return a more detailed
 	// error for logging
 	if srerr != "" {
-		errr := s.reply(m, &serverResponse{Err: srerr})
+		errr := s.reply(m, &serverResponse{Err: srerr, ErrItem: srerrItem})
 		if errr != nil {
 			s.Warn("reply to client failed", "err", errr)
 		}
@@ -772,6 +797,15 @@ func (s *Server) getij(cr *clientRequest, checkRunning bool) (*queue.Item, *Job,
 	return item, job, ""
 }
 
+// tokenErr converts an error from one of our token methods to one of our Err*
+// constants and the message the client should get.
+func tokenErr(err error) (string, string) {
+	if jqerr, ok := err.(Error); ok {
+		return jqerr.Err, err.Error()
+	}
+	return ErrInternalError, err.Error()
+}
+
 func (s *Server) itemStateToJobState(itemState queue.ItemState, lost bool) JobState {
 	state := itemsStateToJobState[itemState]
 	if state == "" {
@@ -798,42 +832,49 @@ func (s *Server) itemToJob(item *queue.Item, getStd bool, getEnv bool) *Job {
 	req := &scheduler.Requirements{}
 	*req = *sjob.Requirements // copy reqs since server changes these, avoiding a race condition
 	job := &Job{
-		RepGroup:      sjob.RepGroup,
-		ReqGroup:      sjob.ReqGroup,
-		LimitGroups:   sjob.LimitGroups,
-		DepGroups:     sjob.DepGroups,
-		Cmd:           sjob.Cmd,
-		Cwd:           sjob.Cwd,
-		CwdMatters:    sjob.CwdMatters,
-		ChangeHome:    sjob.ChangeHome,
-		ActualCwd:     sjob.ActualCwd,
-		Requirements:  req,
-		Priority:      sjob.Priority,
-		Retries:       sjob.Retries,
-		PeakRAM:       sjob.PeakRAM,
-		PeakDisk:      sjob.PeakDisk,
-		Exited:        sjob.Exited,
-		Exitcode:      sjob.Exitcode,
-		FailReason:    sjob.FailReason,
-		StartTime:     sjob.StartTime,
-		EndTime:       sjob.EndTime,
-		Pid:           sjob.Pid,
-		Host:          sjob.Host,
-		HostID:        sjob.HostID,
-		HostIP:        sjob.HostIP,
-		CPUtime:       sjob.CPUtime,
-		State:         state,
-		Attempts:      sjob.Attempts,
-		UntilBuried:   sjob.UntilBuried,
-		ReservedBy:    sjob.ReservedBy,
-		EnvKey:        sjob.EnvKey,
-		EnvOverride:   sjob.EnvOverride,
-		Dependencies:  sjob.Dependencies,
-		Behaviours:    sjob.Behaviours,
-		MountConfigs:  sjob.MountConfigs,
-		MonitorDocker: sjob.MonitorDocker,
-		BsubMode:      sjob.BsubMode,
-		BsubID:        sjob.BsubID,
+		RepGroup:       sjob.RepGroup,
+		ReqGroup:       sjob.ReqGroup,
+		LimitGroups:    sjob.LimitGroups,
+		DepGroups:      sjob.DepGroups,
+		Cmd:            sjob.Cmd,
+		Cwd:            sjob.Cwd,
+		CwdMatters:     sjob.CwdMatters,
+		ChangeHome:     sjob.ChangeHome,
+		ActualCwd:      sjob.ActualCwd,
+		SizeHint:       sjob.SizeHint,
+		Requirements:   req,
+		Priority:       sjob.Priority,
+		Deadline:       sjob.Deadline,
+		Retries:        sjob.Retries,
+		PeakRAM:        sjob.PeakRAM,
+		PeakDisk:       sjob.PeakDisk,
+		Exited:         sjob.Exited,
+		Exitcode:       sjob.Exitcode,
+		FailReason:     sjob.FailReason,
+		StartTime:      sjob.StartTime,
+		EndTime:        sjob.EndTime,
+		Pid:            sjob.Pid,
+		Host:           sjob.Host,
+		HostID:         sjob.HostID,
+		HostIP:         sjob.HostIP,
+		CPUtime:        sjob.CPUtime,
+		User:           sjob.User,
+		Cost:           sjob.Cost,
+		BudgetExceeded: sjob.BudgetExceeded,
+		State:          state,
+		Attempts:       sjob.Attempts,
+		UntilBuried:    sjob.UntilBuried,
+		ReservedBy:     sjob.ReservedBy,
+		EnvKey:         sjob.EnvKey,
+		EnvOverride:    sjob.EnvOverride,
+		Dependencies:   sjob.Dependencies,
+		Behaviours:     sjob.Behaviours,
+		MountConfigs:   sjob.MountConfigs,
+		MonitorDocker:  sjob.MonitorDocker,
+		ResultCache:    sjob.ResultCache,
+		Cached:         sjob.Cached,
+		BsubMode:       sjob.BsubMode,
+		BsubID:         sjob.BsubID,
 	}
 
 	if state == JobStateReserved && !sjob.StartTime.IsZero() {
@@ -858,14 +899,228 @@ func (s *Server) jobPopulateStdEnv(job *Job, getStd bool, getEnv bool) {
 	}
 }
 
-// reserveWithLimits reserves the next item in the queue (optionally limited to
-// the given scheduler group). If (and only if!) a scheduler group was supplied,
-// and it is suffixed with limit groups, those limit groups will be incremented.
-// On success we reserve and return as normal. On failure, we act as if the
-// queue was empty.
-func (s *Server) reserveWithLimits(group string, wait time.Duration) (*queue.Item, error) {
-	var item *queue.Item
-	var err error
+// preparedArchive is a job that prepareArchive() has marked complete, along
+// with what it was like before, so that the changes can be undone if the job
+// couldn't be archived to the database.
+type preparedArchive struct {
+	job          *Job
+	cost         float64
+	coreHours    float64
+	exited       bool
+	exitcode     int
+	peakRAM      int
+	peakDisk     int64
+	cpuTime      time.Duration
+	endTime      time.Time
+	cached       bool
+	actualCwd    string
+	jobCost      float64
+	runCost      float64
+	runCoreHours float64
+	state        JobState
+	failReason   string
+}
+
+// undo reverts the job to how it was before prepareArchive(). (Its limit groups
+// stay decremented, since its cmd is no longer running.)
+func (pa *preparedArchive) undo() {
+	job := pa.job
+	job.Lock()
+	defer job.Unlock()
+	job.Exited = pa.exited
+	job.Exitcode = pa.exitcode
+	job.PeakRAM = pa.peakRAM
+	job.PeakDisk = pa.peakDisk
+	job.CPUtime = pa.cpuTime
+	job.EndTime = pa.endTime
+	job.Cached = pa.cached
+	job.ActualCwd = pa.actualCwd
+	job.Cost = pa.jobCost
+	job.runCost = pa.runCost
+	job.runCoreHours = pa.runCoreHours
+	job.State = pa.state
+	job.FailReason = pa.failReason
+}
+
+// prepareArchive checks that the job corresponding to the given client-side
+// job was reserved by the given client, is still running and ran successfully
+// according to the given end state, and if so marks it complete and returns it
+// ready for archiving to the database. Otherwise returns an error string
+// suitable for a serverResponse, having left the job as it was.
+//
+// The cost of the run is not noted against budgets until finishArchive(), and
+// the returned preparedArchive should be undo()ne if archiving fails.
+func (s *Server) prepareArchive(clientID uuid.UUID, cjob *Job, jes *JobEndState) (*preparedArchive, string) {
+	item, job, srerr := s.getij(&clientRequest{ClientID: clientID, Job: cjob}, true)
+	if srerr != "" {
+		return nil, srerr
+	}
+
+	job.RLock()
+	pa := &preparedArchive{
+		job:          job,
+		exited:       job.Exited,
+		exitcode:     job.Exitcode,
+		peakRAM:      job.PeakRAM,
+		peakDisk:     job.PeakDisk,
+		cpuTime:      job.CPUtime,
+		endTime:      job.EndTime,
+		cached:       job.Cached,
+		actualCwd:    job.ActualCwd,
+		jobCost:      job.Cost,
+		runCost:      job.runCost,
+		runCoreHours: job.runCoreHours,
+		state:        job.State,
+		failReason:   job.FailReason,
+	}
+	job.RUnlock()
+
+	// first check the item is still in the run queue (eg. the job wasn't
+	// released by another process; unlike the other methods, queue package
+	// does not check we're in the run queue when Remove()ing, since you can
+	// remove from any queue)
+	if job.updateAfterExit(jes, s.limiter) {
+		pa.cost, pa.coreHours = s.costJob(job)
+	}
+	job.Lock()
+	running := item.Stats().State == queue.ItemStateRun
+	var ok bool
+	switch {
+	case !running:
+		srerr = ErrBadJob
+	case !job.Exited || job.Exitcode != 0 || job.StartTime.IsZero() || job.EndTime.IsZero():
+		srerr = ErrBadRequest
+	default:
+		ok = true
+		job.State = JobStateComplete
+		job.FailReason = ""
+	}
+	job.Unlock()
+
+	if !ok {
+		pa.undo()
+		return nil, srerr
+	}
+	return pa, ""
+}
+
+// finishArchive removes a job that prepareArchive() returned from the queue
+// and our lookups, and notes the cost of its run, once it has been archived to
+// the database.
+func (s *Server) finishArchive(pa *preparedArchive) error {
+	job := pa.job
+	if pa.cost > 0 || pa.coreHours > 0 {
+		job.RLock()
+		repGroup, user := job.RepGroup, job.User
+		job.RUnlock()
+		s.noteSpending(repGroup, user, pa.cost, pa.coreHours)
+	}
+
+	job.RLock()
+	key := job.Key()
+	sgroup := job.schedulerGroup
+	rgroup := job.RepGroup
+	job.RUnlock()
+
+	err := s.q.Remove(key)
+	if err != nil {
+		return err
+	}
+	s.releaseJobTokens(key)
+
+	s.rpl.Lock()
+	if m, exists := s.rpl.lookup[rgroup]; exists {
+		delete(m, key)
+	}
+	s.rpl.Unlock()
+	s.Debug("completed job", "cmd", job.Cmd, "schedGrp", sgroup)
+	s.decrementGroupCount(sgroup, 1)
+	return nil
+}
+
+// reserveJobs reserves up to n ready jobs for the client that made the given
+// request, in the request's SchedulerGroup, waiting up to the request's Timeout
+// for the first. Returns copies of the jobs for sending to the client, and an
+// error string suitable for a serverResponse.
+func (s *Server) reserveJobs(cr *clientRequest, n int) ([]*Job, string) {
+	// don't proceed when we're expecting new/changed items
+	s.rpmutex.Lock()
+	var wch chan struct{}
+	if s.racPending || s.racRunning {
+		wch = make(chan struct{})
+		s.waitingReserves = append(s.waitingReserves, wch)
+	}
+	s.rpmutex.Unlock()
+	if wch != nil {
+		<-wch
+	}
+
+	if cr.SchedulerGroup != "" {
+		// if this is the first job that the client is trying to reserve, and
+		// if we don't actually want any more clients working on this
+		// schedulerGroup, we'll just act as if nothing was ready. Likewise if
+		// in drain mode.
+		if cr.FirstReserve && s.rc != "" {
+			s.psgmutex.RLock()
+			group, existed := s.previouslyScheduledGroups[cr.SchedulerGroup]
+			s.psgmutex.RUnlock()
+			if !existed || group.getCount() == 0 {
+				return nil, ""
+			}
+		}
+	}
+
+	items, err := s.reserveWithLimits(cr.SchedulerGroup, n, cr.Timeout)
+	if err != nil {
+		if qerr, ok := err.(queue.Error); ok {
+			switch qerr.Err {
+			case queue.ErrNothingReady:
+				return nil, ""
+			case queue.ErrQueueClosed:
+				return nil, ErrQueueClosed
+			}
+		}
+		return nil, ErrInternalError
+	}
+
+	jobs := make([]*Job, len(items))
+	for i, item := range items {
+		// clean up any past state to have a fresh job ready to run
+		sjob := item.Data().(*Job)
+		sjob.Lock()
+		sjob.ReservedBy = cr.ClientID //*** we should unset this on moving out of run state, to save space
+		sjob.Exited = false
+		sjob.Pid = 0
+		sjob.Host = ""
+		var tnil time.Time
+		sjob.StartTime = tnil
+		sjob.EndTime = tnil
+		sjob.PeakRAM = 0
+		sjob.PeakDisk = 0
+		sjob.Exitcode = -1
+		sgroup := sjob.schedulerGroup
+		sjob.Unlock()
+
+		errd := s.q.SetDelay(item.Key, ClientReleaseDelay)
+		if errd != nil {
+			s.Warn("reserve queue SetDelay failed", "err", errd)
+		}
+
+		// make a copy of the job with some extra stuff filled in (that we
+		// don't want taking up memory here) for the client
+		jobs[i] = s.itemToJob(item, false, true)
+		s.Debug("reserved job", "cmd", jobs[i].Cmd, "schedGrp", sgroup)
+	}
+	return jobs, ""
+}
+
+// reserveWithLimits reserves up to n of the next items in the queue
+// (optionally limited to the given scheduler group), waiting only for the
+// first. If (and only if!) a scheduler group was supplied, and it is suffixed
+// with limit groups, those limit groups will be incremented once per item, and
+// we reserve no more items than the limits allow. On success we reserve and
+// return as normal. On failure, we act as if the queue was empty.
+func (s *Server) reserveWithLimits(group string, n int, wait time.Duration) ([]*queue.Item, error) {
 	var limitGroups []string
 	if group != "" {
 		limitGroups = s.schedGroupToLimitGroups(group)
@@ -879,20 +1134,27 @@ func (s *Server) reserveWithLimits(group string, wait time.Duration) (*queue.Ite
 				return nil, queue.Error{Queue: s.q.Name, Op: "Reserve", Item: "", Err: queue.ErrNothingReady}
 			}
 			wait -= time.Since(t)
+
+			incremented := 1
+			for incremented < n && s.limiter.Increment(limitGroups) {
+				incremented++
+			}
+			n = incremented
 		}
 	}
 
-	item, err = s.q.Reserve(group, wait)
+	items, err := s.q.ReserveMany(group, n, wait)
 
 	if len(limitGroups) > 0 {
-		if item == nil {
+		for i := len(items); i < n; i++ {
 			s.limiter.Decrement(limitGroups)
-		} else {
+		}
+		for _, item := range items {
 			item.Data().(*Job).noteIncrementedLimitGroups(limitGroups)
 		}
 	}
 
-	return item, err
+	return items, err
 }
 
 // schedGroupToLimitGroups takes a scheduler group that may be suffixed with
@@ -0,0 +1,1074 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the description of the REST API. The same description is
+// used to register the REST handlers, to serve an OpenAPI 3 document that
+// 3rd party clients can be generated from, and to validate incoming requests
+// before they reach the handlers in serverREST.go.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/VertebrateResequencing/wr/internal"
+)
+
+const (
+	restOpenAPIEndpoint = "/rest/v" + restAPIVersion + "/openapi.json"
+	openAPIVersion      = "3.0.3"
+	restSchemaRefPrefix = "#/components/schemas/"
+
+	restInQuery = "query"
+	restInPath  = "path"
+	restInBody  = "body"
+
+	restTypeString  = "string"
+	restTypeInteger = "integer"
+	restTypeNumber  = "number"
+	restTypeBoolean = "boolean"
+	restTypeArray   = "array"
+	restTypeObject  = "object"
+
+	// restFormatDuration values are durations with a unit suffix, eg. 1h.
+	restFormatDuration = "duration"
+
+	// restFormatMemory values are a number and unit suffix, eg. 1G.
+	restFormatMemory = "memory"
+
+	// restFormatTime values are dates, times or durations ago, as understood
+	// by internal.ParseTimeOrAgo().
+	restFormatTime = "time"
+
+	// restFormatCSV values are comma separated lists.
+	restFormatCSV = "csv"
+
+	// restFormatJSON values are query escaped JSON strings.
+	restFormatJSON = "json"
+
+	// restFormatDateTime values are RFC3339 times, as time.Times are encoded
+	// in JSON.
+	restFormatDateTime = "date-time"
+)
+
+// restParam describes a query or path parameter of a REST API operation, or
+// the constraints of a property of a JSON request body.
+type restParam struct {
+	name        string
+	typ         string
+	format      string
+	description string
+	enum        []string
+	min         *int
+	max         *int
+	required    bool
+
+	// value is used for restFormatJSON parameters: it is a value of the type
+	// the JSON should decode to.
+	value interface{}
+}
+
+// restOperation describes what happens when you use a particular HTTP method
+// on a REST API endpoint.
+type restOperation struct {
+	method  string
+	id      string
+	summary string
+
+	// pathParam, if set, means this operation is on the endpoint suffixed with
+	// this parameter.
+	pathParam *restParam
+	params    []*restParam
+
+	// body, if set, is a value of the type of JSON the request body should
+	// contain. If binaryBody is true, the body is instead arbitrary bytes.
+	body       interface{}
+	binaryBody bool
+
+	// response is a value of the type of JSON returned with the status codes
+	// that indicate success. If responseTypes is set, the response is instead
+	// a document of one of those media types.
+	response      interface{}
+	responseTypes []string
+	status        []int
+}
+
+// restEndpoint describes a REST API endpoint and the handler that serves it.
+type restEndpoint struct {
+	path       string
+	handler    func(*Server) http.HandlerFunc
+	public     bool // if true, no authentication is required
+	operations []*restOperation
+}
+
+var (
+	restAPIOnce sync.Once
+	restAPI     []*restEndpoint
+)
+
+// restIntPtr returns a pointer to the given int, for use with restParam min
+// and max.
+func restIntPtr(i int) *int {
+	return &i
+}
+
+// restJobProperties describes the properties of JobViaJSON and
+// JobModifierViaJSON beyond what can be inferred from their types.
+var restJobProperties = map[string]*restParam{
+	"cmd":           {description: "the command line to execute"},
+	"cwd":           {description: "the directory to run the cmd in"},
+	"cwd_matters":   {description: "if true, cmd will be run directly in cwd instead of a unique sub-directory of it"},
+	"change_home":   {description: "if true, $HOME will be changed to the actual working directory"},
+	"req_grp":       {description: "the requirements group, used to learn how much memory and time similar cmds use"},
+	"size_hint":     {description: "a number, such as input file size, that the cmd's memory, disk and time usage grows with"},
+	"rep_grp":       {description: "the reporting group, used to refer to sets of jobs"},
+	"user":          {description: "who the cmd's cost should be charged to; defaults to the user running the manager"},
+	"limit_grps":    {description: "the limit groups this job belongs to, each optionally suffixed with a colon and the limit of that group"},
+	"dep_grps":      {description: "the dependency groups this job belongs to"},
+	"deps":          {description: "the dependency groups this job depends upon, each optionally wrapped in done(), failed() or ended(), and joined with | for any-of"},
+	"cmd_deps":      {description: "the cmds (and cwds) this job depends upon"},
+	"env":           {description: "key=value environment variables to override for this job"},
+	"memory":        {format: restFormatMemory, description: "a number and unit suffix, eg. 1G for 1 Gigabyte"},
+	"time":          {format: restFormatDuration, description: "a duration with a unit suffix, eg. 1h for 1 hour"},
+	"deadline":      {description: "when the cmd must complete by, as an RFC 3339 time or a duration from now, eg. 2h"},
+	"cpus":          {description: "the number of CPU cores the cmd will use"},
+	"disk":          {min: restIntPtr(0), description: "the number of Gigabytes the cmd will use"},
+	"override":      {min: restIntPtr(0), max: restIntPtr(2), description: "0 to learn resource usage, 1 to use the supplied values if higher than learned, 2 to always use the supplied values"},
+	"priority":      {min: restIntPtr(0), max: restIntPtr(255), description: "higher priority jobs are run first"},
+	"retries":       {min: restIntPtr(0), max: restIntPtr(255), description: "the number of times to retry a failing cmd before burying it"},
+	"cloud_ram":     {min: restIntPtr(0), description: "the number of Megabytes the cloud_os needs to run"},
+	"cloud_script":  {description: "the local path to a script to run on new cloud servers"},
+	"cloud_shared":  {description: "if true, the cloud servers will share a disk"},
+	"cache_dir":     {description: "a directory, accessible wherever the cmd runs, to memoize the cmd's results in; if an identical cmd with identical cache_inputs succeeded before, its cache_outputs are restored instead of running the cmd"},
+	"cache_inputs":  {description: "paths to the files or directories the cmd reads, whose content must match for memoized results to be used"},
+	"cache_outputs": {description: "paths to the files or directories the cmd creates, to be memoized"},
+	"cache_link":    {description: "if true, memoized outputs are restored by symlinking instead of copying"},
+}
+
+// restEndpoints returns the description of all the REST API endpoints we
+// serve.
+func restEndpoints() []*restEndpoint {
+	restAPIOnce.Do(func() {
+		restAPI = restDefineEndpoints()
+	})
+	return restAPI
+}
+
+// restDefineEndpoints creates the description of all our REST API endpoints.
+func restDefineEndpoints() []*restEndpoint {
+	search := &restParam{name: "search", typ: restTypeBoolean, description: "if true, treat the supplied RepGroups as substrings to search for"}
+	std := &restParam{name: "std", typ: restTypeBoolean, description: "if true, include the last stdout and stderr of each job"}
+	env := &restParam{name: "env", typ: restTypeBoolean, description: "if true, include the environment variables of each job"}
+	limit := &restParam{name: "limit", typ: restTypeInteger, min: restIntPtr(0), description: "group similar jobs together, returning at most this many of each group"}
+	states := []string{"delayed", "ready", "reserved", "running", "lost", "buried", "dependent", "complete", "deletable"}
+	state := &restParam{name: "state", typ: restTypeString, enum: states, description: "only get jobs in this state; deletable means not running or complete"}
+	ids := &restParam{name: "ids", typ: restTypeString, format: restFormatCSV, required: true, description: "comma separated job keys or RepGroups"}
+	cancelParams := []*restParam{search, std, env, limit, {
+		name: "state", typ: restTypeString, enum: []string{"running", "lost", "deletable"}, required: true,
+		description: "the state of the jobs to cancel; running jobs are killed, lost jobs are confirmed dead, and deletable jobs are deleted",
+	}}
+	killParams := []*restParam{search, limit,
+		{name: "confirmdead", typ: restTypeBoolean, description: "if true, confirm lost jobs as dead instead of killing running ones"},
+		{name: "age", typ: restTypeString, format: restFormatDuration, description: "only affect jobs that have been running (or lost) for at least this long"},
+	}
+	jobsStatus := []int{http.StatusOK}
+	cancelStatus := []int{http.StatusOK, http.StatusAccepted}
+	killStatus := []int{http.StatusAccepted}
+	var jstati []JStatus
+
+	return []*restEndpoint{
+		{
+			path:    restJobsEndpoint,
+			handler: restJobs,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getJobs", summary: "Get the status of all current jobs.", params: []*restParam{search, std, env, limit, state}, response: jstati, status: jobsStatus},
+				{method: http.MethodGet, id: "getJobsByID", summary: "Get the status of the given jobs.", pathParam: ids, params: []*restParam{search, std, env, limit, state}, response: jstati, status: jobsStatus},
+				{
+					method:  http.MethodPost,
+					id:      "addJobs",
+					summary: "Add new jobs to the queue. Query parameters supply default values for the properties of the jobs.",
+					params: []*restParam{
+						{name: "cwd", typ: restTypeString, description: restJobProperties["cwd"].description},
+						{name: "cwd_matters", typ: restTypeBoolean, description: restJobProperties["cwd_matters"].description},
+						{name: "change_home", typ: restTypeBoolean, description: restJobProperties["change_home"].description},
+						{name: "rep_grp", typ: restTypeString, description: restJobProperties["rep_grp"].description},
+						{name: "req_grp", typ: restTypeString, description: restJobProperties["req_grp"].description},
+						{name: "limit_grps", typ: restTypeString, format: restFormatCSV, description: restJobProperties["limit_grps"].description},
+						{name: "dep_grps", typ: restTypeString, format: restFormatCSV, description: restJobProperties["dep_grps"].description},
+						{name: "deps", typ: restTypeString, format: restFormatCSV, description: restJobProperties["deps"].description},
+						{name: "env", typ: restTypeString, format: restFormatCSV, description: restJobProperties["env"].description},
+						{name: "memory", typ: restTypeString, format: restFormatMemory, description: restJobProperties["memory"].description},
+						{name: "time", typ: restTypeString, format: restFormatDuration, description: restJobProperties["time"].description},
+						{name: "deadline", typ: restTypeString, description: restJobProperties["deadline"].description},
+						{name: "cpus", typ: restTypeNumber, description: restJobProperties["cpus"].description},
+						{name: "disk", typ: restTypeInteger, min: restIntPtr(0), description: restJobProperties["disk"].description},
+						{name: "override", typ: restTypeInteger, min: restIntPtr(0), max: restIntPtr(2), description: restJobProperties["override"].description},
+						{name: "priority", typ: restTypeInteger, min: restIntPtr(0), max: restIntPtr(255), description: restJobProperties["priority"].description},
+						{name: "retries", typ: restTypeInteger, min: restIntPtr(0), max: restIntPtr(255), description: restJobProperties["retries"].description},
+						{name: "on_failure", typ: restTypeString, format: restFormatJSON, value: BehavioursViaJSON{}, description: "what to do when a cmd fails"},
+						{name: "on_success", typ: restTypeString, format: restFormatJSON, value: BehavioursViaJSON{}, description: "what to do when a cmd succeeds"},
+						{name: "on_exit", typ: restTypeString, format: restFormatJSON, value: BehavioursViaJSON{}, description: "what to do when a cmd exits"},
+						{name: "mounts", typ: restTypeString, format: restFormatJSON, value: MountConfigs{}, description: "the mounts to set up before running a cmd"},
+						{name: "monitor_docker", typ: restTypeString, description: "the name or id file of a docker container to monitor the resource usage of"},
+						{name: "cache_dir", typ: restTypeString, description: restJobProperties["cache_dir"].description},
+						{name: "cache_inputs", typ: restTypeString, format: restFormatCSV, description: restJobProperties["cache_inputs"].description},
+						{name: "cache_outputs", typ: restTypeString, format: restFormatCSV, description: restJobProperties["cache_outputs"].description},
+						{name: "cache_link", typ: restTypeBoolean, description: restJobProperties["cache_link"].description},
+						{name: "cloud_os", typ: restTypeString, description: "the image to use for new cloud servers"},
+						{name: "cloud_username", typ: restTypeString, description: "the username to log in to new cloud servers with"},
+						{name: "cloud_script", typ: restTypeString, description: restJobProperties["cloud_script"].description},
+						{name: "cloud_flavor", typ: restTypeString, description: "the flavor of new cloud servers"},
+						{name: "cloud_ram", typ: restTypeInteger, min: restIntPtr(0), description: restJobProperties["cloud_ram"].description},
+						{name: "cloud_shared", typ: restTypeBoolean, description: restJobProperties["cloud_shared"].description},
+						{name: "bsub_mode", typ: restTypeString, description: "the deployment to emulate bsub for"},
+						{name: "rerun", typ: restTypeBoolean, description: "if true, add jobs even if they have previously completed"},
+					},
+					body:     []*JobViaJSON{},
+					response: jstati,
+					status:   []int{http.StatusCreated},
+				},
+				{method: http.MethodPatch, id: "modifyJobs", summary: "Modify all incomplete, non-running jobs.", params: []*restParam{search, limit}, body: &JobModifierViaJSON{}, response: jstati, status: jobsStatus},
+				{method: http.MethodPatch, id: "modifyJobsByID", summary: "Modify the given incomplete, non-running jobs.", pathParam: ids, params: []*restParam{search, limit}, body: &JobModifierViaJSON{}, response: jstati, status: jobsStatus},
+				{method: http.MethodDelete, id: "cancelJobs", summary: "Kill all running jobs, confirm all lost jobs as dead, or delete all incomplete jobs.", params: cancelParams, response: jstati, status: cancelStatus},
+				{method: http.MethodDelete, id: "cancelJobsByID", summary: "Kill the given running jobs, confirm the given lost jobs as dead, or delete the given incomplete jobs.", pathParam: ids, params: cancelParams, response: jstati, status: cancelStatus},
+			},
+		},
+		{
+			path:    restRetryEndpoint,
+			handler: restRetry,
+			operations: []*restOperation{
+				{method: http.MethodPost, id: "retryJobs", summary: "Retry all buried jobs.", params: []*restParam{search, limit}, response: jstati, status: jobsStatus},
+				{method: http.MethodPost, id: "retryJobsByID", summary: "Retry the given buried jobs.", pathParam: ids, params: []*restParam{search, limit}, response: jstati, status: jobsStatus},
+			},
+		},
+		{
+			path:    restKillEndpoint,
+			handler: restKill,
+			operations: []*restOperation{
+				{method: http.MethodPost, id: "killJobs", summary: "Kill all running jobs, or confirm all lost ones as dead.", params: killParams, response: jstati, status: killStatus},
+				{method: http.MethodPost, id: "killJobsByID", summary: "Kill the given running jobs, or confirm lost ones as dead.", pathParam: ids, params: killParams, response: jstati, status: killStatus},
+			},
+		},
+		{
+			path:    restManagerEndpoint,
+			handler: restManager,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getManager", summary: "Get the status of the manager.", response: &ManagerStatus{}, status: jobsStatus},
+				{
+					method:    http.MethodPost,
+					id:        "changeManagerMode",
+					summary:   "Pause, resume or drain the manager.",
+					pathParam: &restParam{name: "action", typ: restTypeString, enum: []string{"pause", "resume", "drain"}, required: true, description: "the mode change to make"},
+					response:  &ManagerStatus{},
+					status:    jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restLimitsEndpoint,
+			handler: restLimits,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getLimits", summary: "Get the limits of all limit groups.", response: map[string]int{}, status: jobsStatus},
+				{method: http.MethodGet, id: "getLimit", summary: "Get the limit of a limit group.", pathParam: restLimitGroupParam(), response: &LimitGroupViaJSON{}, status: jobsStatus},
+				{
+					method:    http.MethodPut,
+					id:        "setLimit",
+					summary:   "Set the limit of a limit group.",
+					pathParam: restLimitGroupParam(),
+					params: []*restParam{
+						{name: "limit", typ: restTypeInteger, required: true, description: "the new limit; -1 means no limit"},
+						{name: "rate", typ: restTypeString, description: "also limit how many jobs in the group can start in a period, like 100/1m"},
+					},
+					response: &LimitGroupViaJSON{},
+					status:   jobsStatus,
+				},
+				{method: http.MethodDelete, id: "removeLimit", summary: "Remove the limit of a limit group.", pathParam: restLimitGroupParam(), response: &LimitGroupViaJSON{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restHistoryEndpoint,
+			handler: restHistory,
+			operations: []*restOperation{
+				{
+					method:  http.MethodGet,
+					id:      "searchHistory",
+					summary: "Search through jobs that have exited, in the order they ended.",
+					params: []*restParam{
+						{name: "since", typ: restTypeString, format: restFormatTime, description: "only find jobs that ended at or after this date, time or duration ago"},
+						{name: "until", typ: restTypeString, format: restFormatTime, description: "only find jobs that ended at or before this date, time or duration ago"},
+						{name: "host", typ: restTypeString, description: "only find jobs that ran on the host with this name, ID or IP"},
+						{name: "exit", typ: restTypeInteger, description: "only find jobs that exited with this exit code"},
+						{name: "fail_reason", typ: restTypeString, description: "only find jobs that failed for this reason"},
+						{name: "req_grp", typ: restTypeString, description: "only find jobs in this requirements group"},
+						{name: "rep_grp", typ: restTypeString, description: "only find jobs in this reporting group"},
+						{name: "min_memory", typ: restTypeString, format: restFormatMemory, description: "only find jobs that used at least this much memory"},
+						{name: "min_disk", typ: restTypeInteger, min: restIntPtr(0), description: "only find jobs that used at least this many MB of disk"},
+						{name: "limit", typ: restTypeInteger, min: restIntPtr(0), description: "the maximum number of jobs to return; 0 means no limit"},
+						{name: "after", typ: restTypeString, description: "the next value from a previous page of results, to get the next page"},
+						std, env,
+					},
+					response: &JobHistoryPage{},
+					status:   jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restExportEndpoint,
+			handler: restExport,
+			operations: []*restOperation{
+				{
+					method:  http.MethodGet,
+					id:      "exportHistory",
+					summary: "Export jobs that have exited, in the order they ended, with their requirements and resource usage.",
+					params: []*restParam{
+						{name: "format", typ: restTypeString, enum: []string{string(ExportFormatCSV), string(ExportFormatJSONL)}, description: "the format to export in; defaults to csv"},
+						{name: "live", typ: restTypeBoolean, description: "if true, also export jobs that are still in the queue (eg. buried), not just those that completed"},
+						{name: "since", typ: restTypeString, format: restFormatTime, description: "only export jobs that ended at or after this date, time or duration ago"},
+						{name: "until", typ: restTypeString, format: restFormatTime, description: "only export jobs that ended at or before this date, time or duration ago"},
+						{name: "rep_grp", typ: restTypeString, description: "only export jobs in this reporting group"},
+					},
+					responseTypes: []string{"text/csv", "application/x-ndjson"},
+					status:        jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restGraphEndpoint,
+			handler: restGraph,
+			operations: []*restOperation{
+				{
+					method:    http.MethodGet,
+					id:        "getDependencyGraph",
+					summary:   "Get the graph of the jobs in a RepGroup and the things they depend on, with the state of each, to see where a pipeline is blocked.",
+					pathParam: &restParam{name: "rep_grp", typ: restTypeString, required: true, description: "the RepGroup of the jobs"},
+					params: []*restParam{
+						{name: "format", typ: restTypeString, enum: []string{string(DependencyGraphFormatJSON), string(DependencyGraphFormatDOT), string(DependencyGraphFormatMermaid)}, description: "the format of the graph; defaults to json"},
+						search,
+					},
+					responseTypes: []string{"application/json", "text/vnd.graphviz", "text/plain"},
+					status:        jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restReqsEndpoint,
+			handler: restReqs,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getReqGroupStats", summary: "Get what has been learned about the resource usage of all requirements groups.", response: []*ReqGroupStats{}, status: jobsStatus},
+				{method: http.MethodGet, id: "getReqGroupStatsByName", summary: "Get what has been learned about the resource usage of a requirements group.", pathParam: restReqGroupParam(), response: []*ReqGroupStats{}, status: jobsStatus},
+				{
+					method:    http.MethodDelete,
+					id:        "removeReqGroupStats",
+					summary:   "Forget observations of the resource usage of a requirements group.",
+					pathParam: restReqGroupParam(),
+					params: []*restParam{
+						{name: "resource", typ: restTypeString, enum: []string{ReqGroupResourceMemory, ReqGroupResourceDisk, ReqGroupResourceTime}, description: "only forget observations of this resource"},
+						{name: "since", typ: restTypeString, format: restFormatTime, description: "only forget observations of jobs that ended at or after this date, time or duration ago"},
+						{name: "until", typ: restTypeString, format: restFormatTime, description: "only forget observations of jobs that ended at or before this date, time or duration ago"},
+					},
+					response: map[string]int{},
+					status:   jobsStatus,
+				},
+				{method: http.MethodPost, id: "seedReqGroupStats", summary: "Add observations of resource usage to learn from, as if jobs had run with that usage.", body: []*ReqGroupObservation{}, response: map[string]int{}, status: []int{http.StatusCreated}},
+			},
+		},
+		{
+			path:    restAccuracyEndpoint,
+			handler: restAccuracy,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getRecommendationAccuracy", summary: "Get how well the resources reserved for the jobs of all requirements groups matched what they used.", response: []*ReqGroupAccuracy{}, status: jobsStatus},
+				{method: http.MethodGet, id: "getRecommendationAccuracyByName", summary: "Get how well the resources reserved for the jobs of a requirements group matched what they used.", pathParam: restReqGroupParam(), response: []*ReqGroupAccuracy{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restBudgetsEndpoint,
+			handler: restBudgets,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getBudgets", summary: "Get all budgets and how much of them has been spent.", response: []*BudgetStatus{}, status: jobsStatus},
+				{method: http.MethodGet, id: "getBudget", summary: "Get a budget and how much of it has been spent.", pathParam: restBudgetParam(), response: []*BudgetStatus{}, status: jobsStatus},
+				{method: http.MethodPut, id: "setBudget", summary: "Create or update a budget, eg. to raise its limit.", pathParam: restBudgetParam(), body: &Budget{}, response: &BudgetStatus{}, status: jobsStatus},
+				{method: http.MethodDelete, id: "removeBudget", summary: "Remove a budget, letting the jobs it held back run.", pathParam: restBudgetParam(), response: map[string]int{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restWarningsEndpoint,
+			handler: restWarnings,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getWarnings", summary: "Get and dismiss warnings from the scheduler.", response: []*schedulerIssue{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restBadServersEndpoint,
+			handler: restBadServers,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getBadServers", summary: "Get the cloud servers that have gone bad.", response: []*BadServer{}, status: jobsStatus},
+				{
+					method:  http.MethodDelete,
+					id:      "confirmBadServer",
+					summary: "Confirm a cloud server as bad, terminating it if it still exists.",
+					params:  []*restParam{{name: "id", typ: restTypeString, required: true, description: "the ID of the bad server"}},
+					status:  jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restFileUploadEndpoint,
+			handler: restFileUpload,
+			operations: []*restOperation{
+				{
+					method:     http.MethodPut,
+					id:         "uploadFile",
+					summary:    "Upload a file to the manager's host.",
+					params:     []*restParam{{name: "path", typ: restTypeString, description: "where to save the file; defaults to a unique path in the manager's upload directory"}},
+					binaryBody: true,
+					response:   map[string]string{},
+					status:     jobsStatus,
+				},
+			},
+		},
+		{
+			path:    restInfoEndpoint,
+			handler: restInfo,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getInfo", summary: "Get information about the manager.", response: &ServerInfo{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restVersionEndpoint,
+			handler: restVersion,
+			public:  true,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getVersion", summary: "Get the version of the manager and the API version it supports.", response: &ServerVersions{}, status: jobsStatus},
+			},
+		},
+		{
+			path:    restOpenAPIEndpoint,
+			handler: restOpenAPI,
+			public:  true,
+			operations: []*restOperation{
+				{method: http.MethodGet, id: "getOpenAPI", summary: "Get this OpenAPI document.", response: map[string]interface{}{}, status: jobsStatus},
+			},
+		},
+	}
+}
+
+// restLimitGroupParam describes the path parameter of the limits endpoint.
+func restLimitGroupParam() *restParam {
+	return &restParam{name: "name", typ: restTypeString, required: true, description: "the name of a limit group"}
+}
+
+// restReqGroupParam describes the path parameter of the reqs endpoint.
+func restReqGroupParam() *restParam {
+	return &restParam{name: "name", typ: restTypeString, required: true, description: "the name of a requirements group"}
+}
+
+// restBudgetParam describes the path parameter of the budgets endpoint.
+func restBudgetParam() *restParam {
+	return &restParam{name: "name", typ: restTypeString, required: true, description: "the name of a budget"}
+}
+
+// restOpenAPI serves an OpenAPI 3 document describing the REST API. This end
+// point doesn't need authentication.
+func restOpenAPI(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restOpenAPI", false)
+
+		if r.Method != http.MethodGet {
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		restWriteJSON(w, s, http.StatusOK, openAPIDocument(s.ServerVersions))
+	}
+}
+
+// openAPIDocument generates the OpenAPI 3 document describing restEndpoints().
+func openAPIDocument(sv *ServerVersions) map[string]interface{} {
+	version := restAPIVersion
+	if sv != nil && sv.Version != "" {
+		version = sv.Version
+	}
+
+	schemas := make(restSchemas)
+	errorResponse := map[string]interface{}{
+		"description": "an error, with field-level details if the request was invalid",
+		"content":     restJSONContent(schemas.schemaFor(reflect.TypeOf(RESTError{}))),
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, ep := range restEndpoints() {
+		for _, op := range ep.operations {
+			path := ep.path
+			var params []*restParam
+			if op.pathParam != nil {
+				path += "{" + op.pathParam.name + "}"
+				params = append(params, op.pathParam)
+			}
+			params = append(params, op.params...)
+
+			responses := map[string]interface{}{"default": errorResponse}
+			for _, status := range op.status {
+				response := map[string]interface{}{"description": http.StatusText(status)}
+				switch {
+				case len(op.responseTypes) > 0:
+					content := make(map[string]interface{})
+					for _, mediaType := range op.responseTypes {
+						content[mediaType] = map[string]interface{}{"schema": &restSchema{Type: restTypeString}}
+					}
+					response["content"] = content
+				case op.response != nil:
+					response["content"] = restJSONContent(schemas.schemaFor(reflect.TypeOf(op.response)))
+				}
+				responses[strconv.Itoa(status)] = response
+			}
+
+			operation := map[string]interface{}{
+				"operationId": op.id,
+				"summary":     op.summary,
+				"responses":   responses,
+			}
+
+			if len(params) > 0 {
+				oaParams := make([]map[string]interface{}, len(params))
+				for i, param := range params {
+					in := restInQuery
+					if param == op.pathParam {
+						in = restInPath
+					}
+					oaParams[i] = map[string]interface{}{
+						"name":        param.name,
+						"in":          in,
+						"description": param.description,
+						"required":    param.required || in == restInPath,
+						"schema":      param.schema(),
+					}
+				}
+				operation["parameters"] = oaParams
+			}
+
+			switch {
+			case op.binaryBody:
+				operation["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/octet-stream": map[string]interface{}{
+							"schema": &restSchema{Type: restTypeString, Format: "binary"},
+						},
+					},
+				}
+			case op.body != nil:
+				operation["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content":  restJSONContent(schemas.schemaFor(reflect.TypeOf(op.body))),
+				}
+			}
+
+			if ep.public {
+				operation["security"] = []interface{}{}
+			}
+
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(op.method)] = operation
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "wr",
+			"description": "REST API for adding jobs to and managing a wr manager.",
+			"version":     version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"token":  map[string]interface{}{"type": "apiKey", "in": restInQuery, "name": "token"},
+			},
+		},
+		"security": []interface{}{
+			map[string][]string{"bearer": {}},
+			map[string][]string{"token": {}},
+		},
+	}
+}
+
+// restJSONContent returns an OpenAPI content object for JSON with the given
+// schema.
+func restJSONContent(schema *restSchema) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// restSchema is an OpenAPI schema object.
+type restSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *int                   `json:"minimum,omitempty"`
+	Maximum              *int                   `json:"maximum,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	Items                *restSchema            `json:"items,omitempty"`
+	Properties           map[string]*restSchema `json:"properties,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+}
+
+// restSchemas holds named schemas for the structs used by the REST API, keyed
+// on struct name.
+type restSchemas map[string]*restSchema
+
+// schemaFor returns a schema describing how the given type is encoded to and
+// decoded from JSON. Structs are added to our named schemas and referred to.
+func (rs restSchemas) schemaFor(t reflect.Type) *restSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return &restSchema{Type: restTypeString, Format: restFormatDateTime}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &restSchema{Type: restTypeString}
+	case reflect.Bool:
+		return &restSchema{Type: restTypeBoolean}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &restSchema{Type: restTypeInteger}
+	case reflect.Float32, reflect.Float64:
+		return &restSchema{Type: restTypeNumber}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &restSchema{Type: restTypeString, Format: "byte"}
+		}
+		return &restSchema{Type: restTypeArray, Items: rs.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &restSchema{Type: restTypeObject, AdditionalProperties: rs.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if _, exists := rs[name]; !exists {
+			schema := &restSchema{Type: restTypeObject, Properties: make(map[string]*restSchema), AdditionalProperties: false}
+			rs[name] = schema
+			rs.addProperties(schema, t)
+		}
+		return &restSchema{Ref: restSchemaRefPrefix + name}
+	}
+
+	return &restSchema{}
+}
+
+// addProperties adds the exported fields of the given struct type to the given
+// schema's properties, using their JSON names.
+func (rs restSchemas) addProperties(schema *restSchema, t reflect.Type) {
+	var rules map[string]*restParam
+	if t == reflect.TypeOf(JobViaJSON{}) || t == reflect.TypeOf(JobModifierViaJSON{}) {
+		rules = restJobProperties
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				rs.addProperties(schema, ft)
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := rs.schemaFor(field.Type)
+		if prop.Ref == "" && field.Type.Kind() == reflect.Ptr {
+			prop.Nullable = true
+		}
+		if rule, exists := rules[name]; exists {
+			if rule.format != "" {
+				prop.Format = rule.format
+			}
+			prop.Description = rule.description
+			prop.Minimum = rule.min
+			prop.Maximum = rule.max
+		}
+		schema.Properties[name] = prop
+	}
+}
+
+// resolve returns the named schema the given schema refers to, or the given
+// schema if it isn't a reference.
+func (rs restSchemas) resolve(schema *restSchema) *restSchema {
+	if schema.Ref != "" {
+		if named, exists := rs[strings.TrimPrefix(schema.Ref, restSchemaRefPrefix)]; exists {
+			return named
+		}
+	}
+	return schema
+}
+
+// validate checks that the given value, decoded from JSON using UseNumber(),
+// matches the given schema. field is the location of the value, used in any
+// returned errors.
+func (rs restSchemas) validate(schema *restSchema, v interface{}, in, field string) []RESTFieldError {
+	schema = rs.resolve(schema)
+	if v == nil || schema.Type == "" {
+		return nil
+	}
+
+	fieldErr := func(format string, a ...interface{}) []RESTFieldError {
+		return []RESTFieldError{{In: in, Field: field, Error: fmt.Sprintf(format, a...)}}
+	}
+
+	switch schema.Type {
+	case restTypeObject:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fieldErr("must be an object")
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var errs []RESTFieldError
+		for _, key := range keys {
+			sub := key
+			if field != "" {
+				sub = field + "." + key
+			}
+
+			prop := schema.propertySchema(key)
+			if prop == nil {
+				errs = append(errs, RESTFieldError{In: in, Field: sub, Error: "unknown property"})
+				continue
+			}
+			errs = append(errs, rs.validate(prop, obj[key], in, sub)...)
+		}
+		return errs
+	case restTypeArray:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fieldErr("must be an array")
+		}
+		var errs []RESTFieldError
+		for i, item := range arr {
+			errs = append(errs, rs.validate(schema.Items, item, in, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return errs
+	case restTypeString:
+		str, ok := v.(string)
+		if !ok {
+			return fieldErr("must be a string")
+		}
+		if err := schema.checkString(str); err != "" {
+			return fieldErr("%s", err)
+		}
+	case restTypeInteger:
+		num, ok := restJSONNumber(v)
+		if !ok {
+			return fieldErr("must be an integer")
+		}
+		i, err := strconv.Atoi(num)
+		if err != nil {
+			return fieldErr("must be an integer")
+		}
+		if err := schema.checkRange(i); err != "" {
+			return fieldErr("%s", err)
+		}
+	case restTypeNumber:
+		num, ok := restJSONNumber(v)
+		if !ok {
+			return fieldErr("must be a number")
+		}
+		if _, err := strconv.ParseFloat(num, 64); err != nil {
+			return fieldErr("must be a number")
+		}
+	case restTypeBoolean:
+		if _, ok := v.(bool); !ok {
+			return fieldErr("must be true or false")
+		}
+	}
+
+	return nil
+}
+
+// restJSONNumber returns the string form of a number decoded from JSON, and
+// false if v wasn't a number.
+func restJSONNumber(v interface{}) (string, bool) {
+	switch num := v.(type) {
+	case json.Number:
+		return num.String(), true
+	case float64:
+		return strconv.FormatFloat(num, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// propertySchema returns the schema of the given property of an object schema.
+// Like encoding/json, property names are matched case-insensitively if there's
+// no exact match. Returns nil if the object has no such property.
+func (schema *restSchema) propertySchema(key string) *restSchema {
+	if additional, ok := schema.AdditionalProperties.(*restSchema); ok {
+		return additional
+	}
+	if prop, exists := schema.Properties[key]; exists {
+		return prop
+	}
+	for name, prop := range schema.Properties {
+		if strings.EqualFold(name, key) {
+			return prop
+		}
+	}
+	return nil
+}
+
+// checkString checks that the given string matches the enum and format of this
+// schema, returning a description of the problem if not. Empty strings are
+// allowed for any format, since they mean "use the default".
+func (schema *restSchema) checkString(str string) string {
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if str == allowed {
+				return ""
+			}
+		}
+		return fmt.Sprintf("value (%s) must be one of %s", str, strings.Join(schema.Enum, "|"))
+	}
+
+	if str == "" {
+		return ""
+	}
+
+	switch schema.Format {
+	case restFormatDuration:
+		if _, err := time.ParseDuration(str); err != nil {
+			return fmt.Sprintf("value (%s) must be a duration with a unit suffix, eg. 1h", str)
+		}
+	case restFormatMemory:
+		if _, err := bytefmt.ToMegabytes(str); err != nil {
+			return fmt.Sprintf("value (%s) must be a number with a unit suffix, eg. 1G", str)
+		}
+	case restFormatTime:
+		if _, err := internal.ParseTimeOrAgo(str); err != nil {
+			return fmt.Sprintf("value (%s) must be a date (eg. 2006-01-02), RFC3339 time or duration (eg. 24h)", str)
+		}
+	case restFormatDateTime:
+		if _, err := time.Parse(time.RFC3339, str); err != nil {
+			return fmt.Sprintf("value (%s) must be an RFC3339 time, eg. 2006-01-02T15:04:05Z", str)
+		}
+	}
+	return ""
+}
+
+// checkRange checks that the given int is within the minimum and maximum of
+// this schema, returning a description of the problem if not.
+func (schema *restSchema) checkRange(i int) string {
+	if (schema.Minimum != nil && i < *schema.Minimum) || (schema.Maximum != nil && i > *schema.Maximum) {
+		switch {
+		case schema.Maximum == nil:
+			return fmt.Sprintf("value (%d) must be at least %d", i, *schema.Minimum)
+		case schema.Minimum == nil:
+			return fmt.Sprintf("value (%d) must be at most %d", i, *schema.Maximum)
+		default:
+			return fmt.Sprintf("value (%d) is not in the range %d..%d", i, *schema.Minimum, *schema.Maximum)
+		}
+	}
+	return ""
+}
+
+// schema returns an OpenAPI schema describing the value of this parameter.
+func (p *restParam) schema() *restSchema {
+	return &restSchema{Type: p.typ, Format: p.format, Enum: p.enum, Minimum: p.min, Maximum: p.max}
+}
+
+// validate checks the given value supplied for this parameter, returning a
+// description of the problem if it isn't valid.
+func (p *restParam) validate(value string) string {
+	schema := p.schema()
+	switch p.typ {
+	case restTypeInteger:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Sprintf("value (%s) must be an integer", value)
+		}
+		return schema.checkRange(i)
+	case restTypeNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Sprintf("value (%s) must be a number", value)
+		}
+	case restTypeBoolean:
+		if value != restFormTrue && value != "false" {
+			return fmt.Sprintf("value (%s) must be true or false", value)
+		}
+	default:
+		return schema.checkString(value)
+	}
+	return ""
+}
+
+// validateJSON checks that the value of this restFormatJSON parameter is query
+// escaped JSON matching p.value, returning field-level errors if not.
+func (p *restParam) validateJSON(value string) []RESTFieldError {
+	var v interface{}
+	err := urlStringToStruct(value, &v)
+	if err != nil {
+		return []RESTFieldError{{In: restInQuery, Field: p.name, Error: fmt.Sprintf("must be query escaped JSON: %s", err)}}
+	}
+
+	schemas := make(restSchemas)
+	return schemas.validate(schemas.schemaFor(reflect.TypeOf(p.value)), v, restInQuery, p.name)
+}
+
+// restOperationFor finds the operation that describes the given request,
+// returning it along with the path parameter value. Returns nil if we don't
+// describe the request, eg. because its method isn't supported.
+func restOperationFor(r *http.Request) (*restOperation, string) {
+	var endpoint *restEndpoint
+	for _, ep := range restEndpoints() {
+		if strings.HasPrefix(r.URL.Path, ep.path) && (endpoint == nil || len(ep.path) > len(endpoint.path)) {
+			endpoint = ep
+		}
+	}
+	if endpoint == nil {
+		return nil, ""
+	}
+
+	suffix := strings.TrimSuffix(r.URL.Path[len(endpoint.path):], "/")
+
+	var fallback *restOperation
+	for _, op := range endpoint.operations {
+		if op.method != r.Method {
+			continue
+		}
+		if (op.pathParam != nil) == (suffix != "") {
+			return op, suffix
+		}
+		fallback = op
+	}
+	if fallback != nil && fallback.pathParam != nil {
+		return nil, ""
+	}
+	return fallback, suffix
+}
+
+// restValidRequest checks the given request against the description of our
+// REST API. If it isn't valid, writes out a RESTError with field-level details
+// to w and returns false. Requests we don't describe are considered valid, so
+// that handlers can deal with them.
+func restValidRequest(w http.ResponseWriter, r *http.Request) bool {
+	op, suffix := restOperationFor(r)
+	if op == nil {
+		return true
+	}
+
+	var errs []RESTFieldError
+	if op.pathParam != nil {
+		if msg := op.pathParam.validate(suffix); msg != "" {
+			errs = append(errs, RESTFieldError{In: restInPath, Field: op.pathParam.name, Error: msg})
+		}
+	}
+
+	// query parameters we don't describe are ignored, as they always have
+	// been by our handlers
+	query := r.URL.Query()
+	for _, param := range op.params {
+		if _, supplied := query[param.name]; !supplied {
+			if param.required {
+				errs = append(errs, RESTFieldError{In: restInQuery, Field: param.name, Error: "required parameter was not supplied"})
+			}
+			continue
+		}
+
+		value := query.Get(param.name)
+		if param.format == restFormatJSON {
+			errs = append(errs, param.validateJSON(value)...)
+		} else if msg := param.validate(value); msg != "" {
+			errs = append(errs, RESTFieldError{In: restInQuery, Field: param.name, Error: msg})
+		}
+	}
+
+	if op.body != nil && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			restError(w, http.StatusBadRequest, fmt.Sprintf("could not read request body: %s", err))
+			return false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if len(bytes.TrimSpace(body)) > 0 {
+			errs = append(errs, restValidateBody(body, op.body)...)
+		}
+	}
+
+	if len(errs) == 0 {
+		return true
+	}
+
+	msgs := make([]string, len(errs))
+	for i, fe := range errs {
+		msgs[i] = fe.String()
+	}
+	restErrorWithFields(w, http.StatusBadRequest, "invalid request: "+strings.Join(msgs, "; "), errs)
+	return false
+}
+
+// restValidateBody checks that the given JSON matches the type of the given
+// value, returning field-level errors if not.
+func restValidateBody(body []byte, value interface{}) []RESTFieldError {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return []RESTFieldError{{In: restInBody, Error: fmt.Sprintf("must be valid JSON: %s", err)}}
+	}
+
+	schemas := make(restSchemas)
+	return schemas.validate(schemas.schemaFor(reflect.TypeOf(value)), v, restInBody, "")
+}
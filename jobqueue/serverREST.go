@@ -36,6 +36,7 @@ import (
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/VertebrateResequencing/wr/internal"
 	jqs "github.com/VertebrateResequencing/wr/jobqueue/scheduler"
+	"github.com/VertebrateResequencing/wr/limiter"
 	"github.com/ugorji/go/codec"
 )
 
@@ -47,8 +48,19 @@ const (
 	restBadServersEndpoint = "/rest/v" + restAPIVersion + "/servers/"
 	restFileUploadEndpoint = "/rest/v" + restAPIVersion + "/upload/"
 	restInfoEndpoint       = "/rest/v" + restAPIVersion + "/info/"
+	restRetryEndpoint      = "/rest/v" + restAPIVersion + "/retry/"
+	restKillEndpoint       = "/rest/v" + restAPIVersion + "/kill/"
+	restManagerEndpoint    = "/rest/v" + restAPIVersion + "/manager/"
+	restLimitsEndpoint     = "/rest/v" + restAPIVersion + "/limits/"
+	restHistoryEndpoint    = "/rest/v" + restAPIVersion + "/history/"
+	restExportEndpoint     = "/rest/v" + restAPIVersion + "/export/"
+	restReqsEndpoint       = "/rest/v" + restAPIVersion + "/reqs/"
+	restAccuracyEndpoint   = "/rest/v" + restAPIVersion + "/accuracy/"
+	restBudgetsEndpoint    = "/rest/v" + restAPIVersion + "/budgets/"
+	restGraphEndpoint      = "/rest/v" + restAPIVersion + "/graph/"
 	restFormTrue           = "true"
 	bearerSchema           = "Bearer "
+	restExportErrorTrailer = "X-Export-Error"
 )
 
 // JobViaJSON describes the properties of a JOB that a user wishes to add to the
@@ -66,12 +78,24 @@ type JobViaJSON struct {
 	Cmd          string            `json:"cmd"`
 	Cwd          string            `json:"cwd"`
 	ReqGrp       string            `json:"req_grp"`
+	// SizeHint is a number that the cmd's resource usage grows with.
+	SizeHint *float64 `json:"size_hint"`
+	// User is who the cmd's cost should be charged to.
+	User string `json:"user"`
 	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte.
 	Memory string `json:"memory"`
 	// Time is a duration with a unit suffix, eg. 1h for 1 hour.
-	Time             string   `json:"time"`
-	RepGrp           string   `json:"rep_grp"`
-	MonitorDocker    string   `json:"monitor_docker"`
+	Time string `json:"time"`
+	// Deadline is an RFC 3339 time, or a duration from now; see
+	// ParseDeadline().
+	Deadline      string `json:"deadline"`
+	RepGrp        string `json:"rep_grp"`
+	MonitorDocker string `json:"monitor_docker"`
+	// CacheDir turns on memoization of the cmd's results in this directory;
+	// see ResultCache.
+	CacheDir         string   `json:"cache_dir"`
+	CacheInputs      []string `json:"cache_inputs"`
+	CacheOutputs     []string `json:"cache_outputs"`
 	CloudOS          string   `json:"cloud_os"`
 	CloudUser        string   `json:"cloud_username"`
 	CloudScript      string   `json:"cloud_script"`
@@ -91,6 +115,7 @@ type JobViaJSON struct {
 	CwdMatters  bool `json:"cwd_matters"`
 	ChangeHome  bool `json:"change_home"`
 	CloudShared bool `json:"cloud_shared"`
+	CacheLink   bool `json:"cache_link"`
 }
 
 // JobDefaults is supplied to JobViaJSON.Convert() to provide default values for
@@ -111,9 +136,14 @@ type JobDefaults struct {
 	// Env is a comma separated list of key=val pairs.
 	Env           string
 	MonitorDocker string
-	CloudOS       string
-	CloudUser     string
-	CloudFlavor   string
+	// CacheDir, CacheInputs, CacheOutputs and CacheLink are used to make a
+	// ResultCache.
+	CacheDir     string
+	CacheInputs  []string
+	CacheOutputs []string
+	CloudOS      string
+	CloudUser    string
+	CloudFlavor  string
 	// CloudScript is the local path to a script.
 	CloudScript string
 	// CloudConfigFiles is the config files to copy in cloud.Server.CopyOver() format
@@ -127,6 +157,8 @@ type JobDefaults struct {
 	Memory int
 	// Time is the amount of time each cmd will run for. Defaults to 1 hour.
 	Time time.Duration
+	// Deadline is when each cmd must complete by. Defaults to no deadline.
+	Deadline time.Time
 	// Disk is the number of Gigabytes cmds will use.
 	Disk     int
 	Override int
@@ -142,6 +174,7 @@ type JobDefaults struct {
 	// being provided with a value of 0 or more.
 	DiskSet     bool
 	CloudShared bool
+	CacheLink   bool
 }
 
 // DefaultCwd returns the Cwd value, defaulting to /tmp.
@@ -295,6 +328,14 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		diskSet = true
 	}
 
+	var sizeHint float64
+	if jvj.SizeHint != nil {
+		sizeHint = *jvj.SizeHint
+		if sizeHint < 0 {
+			return nil, fmt.Errorf("size_hint value (%g) is negative", sizeHint)
+		}
+	}
+
 	if jvj.Priority == nil {
 		priority = jd.Priority
 	} else {
@@ -304,6 +345,15 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		return nil, fmt.Errorf("priority value (%d) is not in the range 0..255", priority)
 	}
 
+	deadline := jd.Deadline
+	if jvj.Deadline != "" {
+		var err error
+		deadline, err = ParseDeadline(jvj.Deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if jvj.Retries == nil {
 		retries = jd.Retries
 	} else {
@@ -332,8 +382,12 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 			deps = jvj.CmdDeps
 		}
 		if len(jvj.Deps) > 0 {
-			for _, depgroup := range jvj.Deps {
-				deps = append(deps, NewDepGroupDependency(depgroup))
+			for _, expr := range jvj.Deps {
+				dep, err := ParseDependency(expr)
+				if err != nil {
+					return nil, err
+				}
+				deps = append(deps, dep)
 			}
 		}
 	}
@@ -385,6 +439,26 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		monitorDocker = jvj.MonitorDocker
 	}
 
+	var resultCache *ResultCache
+	cacheDir := jvj.CacheDir
+	if cacheDir == "" {
+		cacheDir = jd.CacheDir
+	}
+	if cacheDir != "" {
+		resultCache = &ResultCache{
+			Dir:     cacheDir,
+			Inputs:  jvj.CacheInputs,
+			Outputs: jvj.CacheOutputs,
+			Link:    jvj.CacheLink || jd.CacheLink,
+		}
+		if len(resultCache.Inputs) == 0 {
+			resultCache.Inputs = jd.CacheInputs
+		}
+		if len(resultCache.Outputs) == 0 {
+			resultCache.Outputs = jd.CacheOutputs
+		}
+	}
+
 	// scheduler-specific options
 	other := make(map[string]string)
 	if jvj.CloudOS != "" {
@@ -462,9 +536,12 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		CwdMatters:    cwdMatters,
 		ChangeHome:    changeHome,
 		ReqGroup:      rg,
+		SizeHint:      sizeHint,
+		User:          jvj.User,
 		Requirements:  &jqs.Requirements{RAM: mb, Time: dur, Cores: cpus, Disk: disk, DiskSet: diskSet, Other: other},
 		Override:      uint8(override),
 		Priority:      uint8(priority),
+		Deadline:      deadline,
 		Retries:       uint8(retries),
 		LimitGroups:   limitGroups,
 		DepGroups:     depGroups,
@@ -473,17 +550,317 @@ func (jvj *JobViaJSON) Convert(jd *JobDefaults) (*Job, error) {
 		Behaviours:    behaviours,
 		MountConfigs:  mounts,
 		MonitorDocker: monitorDocker,
+		ResultCache:   resultCache,
 		BsubMode:      bsubMode,
 	}, nil
 }
 
+// JobModifierViaJSON describes the properties of existing jobs that a user
+// wishes to modify, convenient if they are supplying JSON. Only properties
+// that are present in the JSON will be modified. To turn off a string property
+// supply an empty string, and to turn off limit_grps, deps, cmd_deps, env,
+// mounts or a behaviour, supply an empty list.
+type JobModifierViaJSON struct {
+	MountConfigs *MountConfigs      `json:"mounts"`
+	LimitGrps    *[]string          `json:"limit_grps"`
+	Deps         *[]string          `json:"deps"`
+	CmdDeps      *Dependencies      `json:"cmd_deps"`
+	OnFailure    *BehavioursViaJSON `json:"on_failure"`
+	OnSuccess    *BehavioursViaJSON `json:"on_success"`
+	OnExit       *BehavioursViaJSON `json:"on_exit"`
+	Env          *[]string          `json:"env"`
+	Cmd          *string            `json:"cmd"`
+	Cwd          *string            `json:"cwd"`
+	ReqGrp       *string            `json:"req_grp"`
+	// Memory is a number and unit suffix, eg. 1G for 1 Gigabyte.
+	Memory *string `json:"memory"`
+	// Time is a duration with a unit suffix, eg. 1h for 1 hour.
+	Time *string `json:"time"`
+	// Deadline is an RFC 3339 time, a duration from now, or blank to remove
+	// the deadline; see ParseDeadline().
+	Deadline         *string  `json:"deadline"`
+	MonitorDocker    *string  `json:"monitor_docker"`
+	CloudOS          *string  `json:"cloud_os"`
+	CloudUser        *string  `json:"cloud_username"`
+	CloudScript      *string  `json:"cloud_script"`
+	CloudConfigFiles *string  `json:"cloud_config_files"`
+	CloudFlavor      *string  `json:"cloud_flavor"`
+	CPUs             *float64 `json:"cpus"`
+	// Disk is the number of Gigabytes the cmd will use.
+	Disk        *int  `json:"disk"`
+	Override    *int  `json:"override"`
+	Priority    *int  `json:"priority"`
+	Retries     *int  `json:"retries"`
+	CloudOSRam  *int  `json:"cloud_ram"`
+	CwdMatters  *bool `json:"cwd_matters"`
+	ChangeHome  *bool `json:"change_home"`
+	CloudShared *bool `json:"cloud_shared"`
+}
+
+// Convert returns a *JobModifier with the properties of this
+// JobModifierViaJSON set on it, suitable for passing to Client.Modify().
+func (jmj *JobModifierViaJSON) Convert() (*JobModifier, error) {
+	jm := NewJobModifer()
+
+	if jmj.Cmd != nil {
+		if *jmj.Cmd == "" {
+			return nil, fmt.Errorf("cmd can not be modified to be empty")
+		}
+		jm.SetCmd(*jmj.Cmd)
+	}
+	if jmj.Cwd != nil {
+		jm.SetCwd(*jmj.Cwd)
+	}
+	if jmj.CwdMatters != nil {
+		jm.SetCwdMatters(*jmj.CwdMatters)
+	}
+	if jmj.ChangeHome != nil {
+		jm.SetChangeHome(*jmj.ChangeHome)
+	}
+	if jmj.ReqGrp != nil {
+		jm.SetReqGroup(*jmj.ReqGrp)
+	}
+	if jmj.LimitGrps != nil {
+		jm.SetLimitGroups(*jmj.LimitGrps)
+	}
+
+	req := &jqs.Requirements{}
+	var setReq bool
+	if jmj.Memory != nil {
+		mb, err := bytefmt.ToMegabytes(*jmj.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("memory value (%s) was not specified correctly: %s", *jmj.Memory, err)
+		}
+		req.RAM = int(mb)
+		setReq = true
+	}
+	if jmj.Time != nil {
+		dur, err := time.ParseDuration(*jmj.Time)
+		if err != nil {
+			return nil, fmt.Errorf("time value (%s) was not specified correctly: %s", *jmj.Time, err)
+		}
+		req.Time = dur
+		setReq = true
+	}
+	if jmj.CPUs != nil {
+		req.Cores = *jmj.CPUs
+		req.CoresSet = true
+		setReq = true
+	}
+	if jmj.Disk != nil {
+		req.Disk = *jmj.Disk
+		req.DiskSet = true
+		setReq = true
+	}
+
+	other, otherSet, err := jmj.other()
+	if err != nil {
+		return nil, err
+	}
+	if otherSet {
+		req.Other = other
+		req.OtherSet = true
+		setReq = true
+	}
+	if setReq {
+		jm.SetRequirements(req)
+	}
+
+	if jmj.Override != nil {
+		if *jmj.Override < 0 || *jmj.Override > 2 {
+			return nil, fmt.Errorf("override value (%d) is not in the range 0..2", *jmj.Override)
+		}
+		jm.SetOverride(uint8(*jmj.Override))
+	}
+	if jmj.Priority != nil {
+		if *jmj.Priority < 0 || *jmj.Priority > 255 {
+			return nil, fmt.Errorf("priority value (%d) is not in the range 0..255", *jmj.Priority)
+		}
+		jm.SetPriority(uint8(*jmj.Priority))
+	}
+	if jmj.Deadline != nil {
+		deadline, err := ParseDeadline(*jmj.Deadline)
+		if err != nil {
+			return nil, err
+		}
+		jm.SetDeadline(deadline)
+	}
+	if jmj.Retries != nil {
+		if *jmj.Retries < 0 || *jmj.Retries > 255 {
+			return nil, fmt.Errorf("retries value (%d) is not in the range 0..255", *jmj.Retries)
+		}
+		jm.SetRetries(uint8(*jmj.Retries))
+	}
+
+	if jmj.Deps != nil || jmj.CmdDeps != nil {
+		var deps Dependencies
+		if jmj.CmdDeps != nil {
+			deps = append(deps, *jmj.CmdDeps...)
+		}
+		if jmj.Deps != nil {
+			for _, expr := range *jmj.Deps {
+				dep, err := ParseDependency(expr)
+				if err != nil {
+					return nil, err
+				}
+				deps = append(deps, dep)
+			}
+		}
+		jm.SetDependencies(deps)
+	}
+
+	if jmj.MonitorDocker != nil {
+		jm.SetMonitorDocker(*jmj.MonitorDocker)
+	}
+
+	var behaviours Behaviours
+	var behavioursSet bool
+	triggers := []BehaviourTrigger{OnFailure, OnSuccess, OnExit}
+	for i, bvj := range []*BehavioursViaJSON{jmj.OnFailure, jmj.OnSuccess, jmj.OnExit} {
+		if bvj == nil {
+			continue
+		}
+		if len(*bvj) == 0 {
+			// turn off the behaviour
+			behaviours = append(behaviours, BehaviourViaJSON{Nothing: true}.Behaviour(triggers[i]))
+		} else {
+			behaviours = append(behaviours, bvj.Behaviours(triggers[i])...)
+		}
+		behavioursSet = true
+	}
+	if behavioursSet {
+		jm.SetBehaviours(behaviours)
+	}
+
+	if jmj.MountConfigs != nil {
+		if len(*jmj.MountConfigs) == 0 {
+			jm.SetMountConfigs(nil)
+		} else {
+			jm.SetMountConfigs(*jmj.MountConfigs)
+		}
+	}
+
+	if jmj.Env != nil {
+		err = jm.SetEnvOverride(strings.Join(*jmj.Env, ","))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jm, nil
+}
+
+// other returns the scheduler-specific Requirements.Other settings of this
+// JobModifierViaJSON, and true if any were set (even if they were all set to
+// empty values, which means to remove all existing settings).
+func (jmj *JobModifierViaJSON) other() (map[string]string, bool, error) {
+	other := make(map[string]string)
+	var set bool
+	for key, val := range map[string]*string{"cloud_os": jmj.CloudOS, "cloud_user": jmj.CloudUser, "cloud_flavor": jmj.CloudFlavor, "cloud_config_files": jmj.CloudConfigFiles} {
+		if val == nil {
+			continue
+		}
+		set = true
+		if *val != "" {
+			other[key] = *val
+		}
+	}
+
+	if jmj.CloudScript != nil {
+		set = true
+		if *jmj.CloudScript != "" {
+			scriptContent, err := internal.PathToContent(*jmj.CloudScript)
+			if err != nil {
+				return nil, set, err
+			}
+			other["cloud_script"] = scriptContent
+		}
+	}
+
+	if jmj.CloudOSRam != nil {
+		set = true
+		other["cloud_os_ram"] = strconv.Itoa(*jmj.CloudOSRam)
+	}
+
+	if jmj.CloudShared != nil {
+		set = true
+		other["cloud_shared"] = strconv.FormatBool(*jmj.CloudShared)
+	}
+
+	return other, set, nil
+}
+
+// RESTError is the JSON object returned by all REST API endpoints when there
+// is a problem with a request.
+type RESTError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+
+	// Fields is only set if the request was invalid, describing each problem
+	// with it.
+	Fields []RESTFieldError `json:"fields,omitempty"`
+}
+
+// RESTFieldError describes a problem with a particular query parameter, path
+// parameter or JSON body property of an invalid REST API request.
+type RESTFieldError struct {
+	// In is one of query|path|body.
+	In string `json:"in"`
+
+	// Field is the name of the parameter, or the location of the property
+	// within the body, eg. [0].memory.
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// String describes the problem, including where in the request it was.
+func (fe RESTFieldError) String() string {
+	if fe.Field == "" {
+		return fe.In + ": " + fe.Error
+	}
+	return fe.In + " " + fe.Field + ": " + fe.Error
+}
+
+// ManagerStatus is the JSON object returned by the manager REST API endpoint,
+// describing the current mode of the server and what's happening in its queue.
+type ManagerStatus struct {
+	Mode    string `json:"mode"`
+	Delayed int    `json:"delayed"`
+	Ready   int    `json:"ready"`
+	Running int    `json:"running"`
+	Buried  int    `json:"buried"`
+
+	// ETC is how long until the slowest of the currently running jobs is
+	// expected to complete, eg. 1h2m3s.
+	ETC string `json:"etc"`
+}
+
+// LimitGroupViaJSON is the JSON object returned by the limits REST API endpoint
+// when getting or setting the limit of a particular limit group.
+type LimitGroupViaJSON struct {
+	Name  string `json:"name"`
+	Limit int    `json:"limit"`
+	Rate  string `json:"rate,omitempty"`
+	Used  int    `json:"used"`
+}
+
+// JobHistoryPage is the JSON object returned by the history REST API endpoint.
+// If Next is not blank, there may be more matching jobs, which you can get by
+// repeating the request with an after parameter set to Next.
+type JobHistoryPage struct {
+	Jobs []JStatus `json:"jobs"`
+	Next string    `json:"next"`
+}
+
 // httpAuthorized checks for parameter 'token' and for Authorization header for
 // Bearer token; if not supplied, or the token is wrong, writes out an error to
-// w, otherwise returns true.
+// w. It then checks the request is valid according to our OpenAPI description
+// of the REST API, writing out field-level errors to w if not. Otherwise
+// returns true.
 func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 	err := r.ParseForm()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("form parsing error: %s", err), http.StatusBadRequest)
+		restError(w, http.StatusBadRequest, fmt.Sprintf("form parsing error: %s", err))
 		return false
 	}
 
@@ -493,12 +870,12 @@ func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 		// try auth header
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
+			restError(w, http.StatusUnauthorized, "Authorization header required")
 			return false
 		}
 
 		if !strings.HasPrefix(authHeader, bearerSchema) {
-			http.Error(w, "Authorization requires Bearer scheme", http.StatusUnauthorized)
+			restError(w, http.StatusUnauthorized, "Authorization requires Bearer scheme")
 			return false
 		}
 
@@ -506,10 +883,10 @@ func (s *Server) httpAuthorized(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	if !tokenMatches([]byte(token), s.token) {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		restError(w, http.StatusUnauthorized, "Invalid token")
 		return false
 	}
-	return true
+	return restValidRequest(w, r)
 }
 
 // restJobs lets you do CRUD on jobs in the queue.
@@ -531,38 +908,42 @@ func restJobs(s *Server) http.HandlerFunc {
 			jobs, status, err = restJobsStatus(r, s)
 		case http.MethodPost:
 			jobs, status, err = restJobsAdd(r, s)
+		case http.MethodPatch:
+			jobs, status, err = restJobsModify(r, s)
 		case http.MethodDelete:
 			jobs, status, err = restJobsCancel(r, s)
 		default:
-			http.Error(w, "So far only GET, POST and DELETE are supported", http.StatusBadRequest)
+			restError(w, http.StatusMethodNotAllowed, "So far only GET, POST, PATCH and DELETE are supported")
 			return
 		}
 
-		if status >= 400 || err != nil {
-			http.Error(w, err.Error(), status)
-			return
-		}
+		restWriteJobs(w, s, jobs, status, err)
+	}
+}
 
-		// convert jobs to jstatus
-		jstati := make([]JStatus, len(jobs))
-		for i, job := range jobs {
-			jstati[i], err = job.ToStatus()
-			if err != nil && err != io.ErrUnexpectedEOF {
-				http.Error(w, err.Error(), status)
-				return
-			}
+// restWriteJobs writes out the given jobs as JSON JStatus, unless status
+// indicates an error, in which case the error is written out instead.
+func restWriteJobs(w http.ResponseWriter, s *Server, jobs []*Job, status int, err error) {
+	if status >= 400 || err != nil {
+		if status < 400 {
+			status = http.StatusInternalServerError
 		}
+		restError(w, status, err.Error())
+		return
+	}
 
-		// return job details as JSON
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(status)
-		encoder := json.NewEncoder(w)
-		encoder.SetEscapeHTML(false)
-		erre := encoder.Encode(jstati)
-		if erre != nil {
-			s.Warn("restJobs failed to encode job statuses", "err", erre)
+	// convert jobs to jstatus
+	jstati := make([]JStatus, len(jobs))
+	for i, job := range jobs {
+		jstati[i], err = job.ToStatus()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
 		}
 	}
+
+	// return job details as JSON
+	restWriteJSON(w, s, status, jstati)
 }
 
 // restJobsStatus gets the status of the requested jobs in the queue. The
@@ -573,10 +954,46 @@ func restJobs(s *Server) http.HandlerFunc {
 // where deletable == !(running|complete). Returns the Jobs, a http.Status*
 // value and error.
 func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
+	return restRequestedJobs(r, s, restJobsEndpoint, restFormToJobState(r.Form.Get("state")))
+}
+
+// restFormToJobState converts the value of a state query parameter to a
+// JobState. Unknown values result in an empty JobState, meaning "any state".
+func restFormToJobState(value string) JobState {
+	switch value {
+	case "delayed":
+		return JobStateDelayed
+	case "ready":
+		return JobStateReady
+	case "reserved":
+		return JobStateReserved
+	case "running":
+		return JobStateRunning
+	case "lost":
+		return JobStateLost
+	case "buried":
+		return JobStateBuried
+	case "dependent":
+		return JobStateDependent
+	case "complete":
+		return JobStateComplete
+	case "deletable":
+		return JobStateDeletable
+	}
+	return ""
+}
+
+// restRequestedJobs gets the jobs identified by the request url, which is the
+// given endpoint optionally suffixed with comma separated job keys or
+// RepGroups. Jobs found by RepGroup, or all current jobs if there was no
+// suffix, are filtered to those in the given state (if not blank); jobs
+// requested by key are returned regardless of state. Possible query parameters are search, std, env
+// (which can take a "true" value) and limit (a number). Returns the Jobs, a
+// http.Status* value and error.
+func restRequestedJobs(r *http.Request, s *Server, endpoint string, state JobState) ([]*Job, int, error) {
 	// handle possible ?query parameters
 	var search, getStd, getEnv bool
 	var limit int
-	var state JobState
 	var err error
 
 	if r.Form.Get("search") == restFormTrue {
@@ -594,32 +1011,10 @@ func restJobsStatus(r *http.Request, s *Server) ([]*Job, int, error) {
 			return nil, http.StatusBadRequest, err
 		}
 	}
-	if r.Form.Get("state") != "" {
-		switch r.Form.Get("state") {
-		case "delayed":
-			state = JobStateDelayed
-		case "ready":
-			state = JobStateReady
-		case "reserved":
-			state = JobStateReserved
-		case "running":
-			state = JobStateRunning
-		case "lost":
-			state = JobStateLost
-		case "buried":
-			state = JobStateBuried
-		case "dependent":
-			state = JobStateDependent
-		case "complete":
-			state = JobStateComplete
-		case "deletable":
-			state = JobStateDeletable
-		}
-	}
 
-	if len(r.URL.Path) > len(restJobsEndpoint) {
+	if len(r.URL.Path) > len(endpoint) {
 		// get the requested jobs
-		ids := r.URL.Path[len(restJobsEndpoint):]
+		ids := r.URL.Path[len(endpoint):]
 		var jobs []*Job
 		for _, id := range strings.Split(ids, ",") {
 			if len(id) == 32 {
@@ -674,6 +1069,9 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 		DepGroups:     urlStringToSlice(r.Form.Get("dep_grps")),
 		Env:           r.Form.Get("env"),
 		MonitorDocker: r.Form.Get("monitor_docker"),
+		CacheDir:      r.Form.Get("cache_dir"),
+		CacheInputs:   urlStringToSlice(r.Form.Get("cache_inputs")),
+		CacheOutputs:  urlStringToSlice(r.Form.Get("cache_outputs")),
 		CloudOS:       r.Form.Get("cloud_os"),
 		CloudUser:     r.Form.Get("cloud_username"),
 		CloudScript:   r.Form.Get("cloud_script"),
@@ -693,6 +1091,9 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 	if r.Form.Get("cloud_shared") == restFormTrue {
 		jd.CloudShared = true
 	}
+	if r.Form.Get("cache_link") == restFormTrue {
+		jd.CacheLink = true
+	}
 	if r.Form.Get("memory") != "" {
 		mb, err := bytefmt.ToMegabytes(r.Form.Get("memory"))
 		if err != nil {
@@ -707,14 +1108,25 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 			return nil, http.StatusBadRequest, err
 		}
 	}
+	if r.Form.Get("deadline") != "" {
+		var err error
+		jd.Deadline, err = ParseDeadline(r.Form.Get("deadline"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
 	var rerun bool
 	if r.Form.Get("rerun") == restFormTrue {
 		rerun = true
 	}
 	defaultDeps := urlStringToSlice(r.Form.Get("deps"))
 	if len(defaultDeps) > 0 {
-		for _, depgroup := range defaultDeps {
-			jd.Deps = append(jd.Deps, NewDepGroupDependency(depgroup))
+		for _, expr := range defaultDeps {
+			dep, err := ParseDependency(expr)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			jd.Deps = append(jd.Deps, dep)
 		}
 	}
 	if r.Form.Get("on_failure") != "" {
@@ -775,13 +1187,20 @@ func restJobsAdd(r *http.Request, s *Server) ([]*Job, int, error) {
 		inputJobs = append(inputJobs, job)
 	}
 
+	// jobs added over REST are charged to the user running the manager unless
+	// they say otherwise
+	setJobUsers(inputJobs)
+
 	envkey, err := s.db.storeEnv([]byte{})
 	if err != nil {
 		return nil, http.StatusInternalServerError, err
 	}
 
-	_, _, _, _, err = s.createJobs(inputJobs, envkey, !rerun)
+	_, _, _, srerr, err := s.createJobs(inputJobs, envkey, !rerun)
 	if err != nil {
+		if srerr == ErrDependencyCycle {
+			return nil, http.StatusBadRequest, err
+		}
 		return nil, http.StatusInternalServerError, err
 	}
 
@@ -850,97 +1269,816 @@ func restJobsCancel(r *http.Request, s *Server) ([]*Job, int, error) {
 	return handled, returnStatus, nil
 }
 
-// restWarnings lets you read warnings from the scheduler, and auto-"dismisses"
-// (deletes) them.
-func restWarnings(s *Server) http.HandlerFunc {
+// restJobsModify modifies incomplete, non-running jobs in the queue. You
+// identify the jobs to operate on in the same way as for restJobsStatus(),
+// except that state is ignored. The request must have some PATCHed JSON that
+// is a JobModifierViaJSON. Because modifying a job may change its key, the
+// returned Jobs are the modified jobs with their new keys. Also returns a
+// http.Status* value and error.
+func restJobsModify(r *http.Request, s *Server) ([]*Job, int, error) {
+	var jmj JobModifierViaJSON
+	err := json.NewDecoder(r.Body).Decode(&jmj)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	jm, err := jmj.Convert()
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("there was a problem interpreting your modification: %s", err)
+	}
+
+	jobs, status, err := restRequestedJobs(r, s, restJobsEndpoint, JobStateDeletable)
+	if err != nil || status != http.StatusOK {
+		return nil, status, err
+	}
+
+	if jm.Cmd != "" && len(jobs) > 1 {
+		return nil, http.StatusBadRequest, fmt.Errorf("%d jobs matched your query, but cmd can only be modified for 1 job", len(jobs))
+	}
+
+	keys := make([]string, len(jobs))
+	for i, job := range jobs {
+		keys[i] = job.Key()
+	}
+
+	modified, srerr, err := s.modifyJobs(keys, jm)
+	if err != nil {
+		if srerr == ErrDependencyCycle {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+
+	newKeys := make([]string, 0, len(modified))
+	for newKey := range modified {
+		newKeys = append(newKeys, newKey)
+	}
+	jobs, _, qerr := s.getJobsByKeys(newKeys, false, false)
+	if qerr != "" {
+		return nil, http.StatusInternalServerError, fmt.Errorf(qerr)
+	}
+	return jobs, http.StatusOK, nil
+}
+
+// restRetry lets you retry buried jobs. The only method supported is POST. You
+// identify the jobs to retry in the same way as for restJobsStatus(), except
+// that state is ignored: only buried jobs will be affected. Returns the status
+// of the jobs that were retried.
+func restRetry(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		defer internal.LogPanic(s.Logger, "jobqueue web server restWarnings", false)
+		defer internal.LogPanic(s.Logger, "jobqueue web server restRetry", false)
 
 		ok := s.httpAuthorized(w, r)
 		if !ok {
 			return
 		}
 
-		// carry out a different action based on the HTTP Verb
-		sis := []*schedulerIssue{}
-		switch r.Method {
-		case http.MethodGet:
-			s.simutex.Lock()
-			for key, si := range s.schedIssues {
-				sis = append(sis, si)
-				delete(s.schedIssues, key)
-			}
-			s.simutex.Unlock()
-		default:
-			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+		if r.Method != http.MethodPost {
+			restError(w, http.StatusMethodNotAllowed, "Only POST is supported")
 			return
 		}
 
-		// return schedulerIssues as JSON
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusOK)
-		encoder := json.NewEncoder(w)
-		encoder.SetEscapeHTML(false)
-		erre := encoder.Encode(sis)
-		if erre != nil {
-			s.Warn("restWarnings failed to encode scheduler issues", "err", erre)
+		jobs, status, err := restRequestedJobs(r, s, restRetryEndpoint, JobStateBuried)
+		if err != nil || status != http.StatusOK {
+			restWriteJobs(w, s, nil, status, err)
+			return
 		}
+
+		keys := make([]string, len(jobs))
+		for i, job := range jobs {
+			keys[i] = job.Key()
+		}
+		kicked := s.kickJobs(keys)
+		s.Debug("retried jobs", "count", len(kicked))
+
+		jobs, _, qerr := s.getJobsByKeys(kicked, false, false)
+		if qerr != "" {
+			restWriteJobs(w, s, nil, http.StatusInternalServerError, fmt.Errorf(qerr))
+			return
+		}
+		restWriteJobs(w, s, jobs, http.StatusOK, nil)
 	}
 }
 
-// restBadServers lets you do CRUD on cloud servers that have gone bad. The
-// DELETE verb has a required 'id' parameter, being the ID of a server you wish
-// to confirm as bad and have terminated if it still exists.
-func restBadServers(s *Server) http.HandlerFunc {
+// restKill lets you kill running jobs. The only method supported is POST. You
+// identify the jobs to kill in the same way as for restJobsStatus(), except
+// that state is ignored: only running jobs will be affected. If the
+// confirmdead parameter is "true", instead only lost jobs will be affected,
+// confirming them as dead. The optional age parameter (a duration with a unit
+// suffix, eg. 1h) restricts the jobs to those that have been running (or lost)
+// for at least that long. Returns the status of the jobs that will be killed.
+func restKill(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		defer internal.LogPanic(s.Logger, "jobqueue web server restBadServers", false)
+		defer internal.LogPanic(s.Logger, "jobqueue web server restKill", false)
 
 		ok := s.httpAuthorized(w, r)
 		if !ok {
 			return
 		}
 
-		// carry out a different action based on the HTTP Verb
-		switch r.Method {
-		case http.MethodGet:
-			servers := s.getBadServers()
-			if len(servers) == 0 {
-				servers = []*BadServer{}
-			}
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusOK)
-			encoder := json.NewEncoder(w)
-			encoder.SetEscapeHTML(false)
-			erre := encoder.Encode(servers)
-			if erre != nil {
-				s.Warn("restBadServers failed to encode servers", "err", erre)
-			}
+		if r.Method != http.MethodPost {
+			restError(w, http.StatusMethodNotAllowed, "Only POST is supported")
 			return
-		case http.MethodDelete:
-			serverID := r.Form.Get("id")
-			if serverID == "" {
-				http.Error(w, "id parameter is required", http.StatusBadRequest)
+		}
+
+		confirmDead := r.Form.Get("confirmdead") == restFormTrue
+		var age time.Duration
+		if r.Form.Get("age") != "" {
+			var err error
+			age, err = time.ParseDuration(r.Form.Get("age"))
+			if err != nil {
+				restError(w, http.StatusBadRequest, fmt.Sprintf("age value (%s) was not specified correctly: %s", r.Form.Get("age"), err))
 				return
 			}
-			s.bsmutex.Lock()
-			server := s.badServers[serverID]
-			delete(s.badServers, serverID)
-			s.bsmutex.Unlock()
-			if server == nil {
-				http.Error(w, "Server was not known to be bad", http.StatusNotFound)
-				return
+		}
+
+		state := JobStateRunning
+		if confirmDead {
+			state = JobStateLost
+		}
+		jobs, status, err := restRequestedJobs(r, s, restKillEndpoint, state)
+		if err != nil || status != http.StatusOK {
+			restWriteJobs(w, s, nil, status, err)
+			return
+		}
+
+		var killed []*Job
+		for _, job := range jobs {
+			if job.State != JobStateRunning || job.Lost != confirmDead {
+				continue
+			}
+
+			if age > 0 {
+				var thisAge time.Duration
+				if confirmDead {
+					thisAge = time.Since(job.EndTime)
+				} else {
+					thisAge = job.WallTime()
+				}
+				if thisAge < age {
+					continue
+				}
+			}
+
+			k, errk := s.killJob(job.Key())
+			if errk != nil {
+				restWriteJobs(w, s, nil, http.StatusInternalServerError, errk)
+				return
+			}
+			if k {
+				killed = append(killed, job)
+			}
+		}
+		s.Debug("killed jobs", "count", len(killed))
+
+		restWriteJobs(w, s, killed, http.StatusAccepted, nil)
+	}
+}
+
+// restManager lets you get the status of the manager with GET, or change its
+// mode by POSTing to the endpoint suffixed with one of pause|resume|drain.
+// Both return a ManagerStatus.
+func restManager(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restManager", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		action := strings.TrimSuffix(r.URL.Path[len(restManagerEndpoint):], "/")
+
+		switch r.Method {
+		case http.MethodGet:
+			if action != "" {
+				restError(w, http.StatusNotFound, fmt.Sprintf("unknown manager resource %s", action))
+				return
+			}
+		case http.MethodPost:
+			var err error
+			switch action {
+			case "pause":
+				s.Debug("pause requested")
+				err = s.pauseOnRequest()
+			case "resume":
+				s.Debug("resume requested")
+				var resumed bool
+				resumed, err = s.Resume()
+				if err == nil && resumed {
+					s.Info("resumed on request")
+				}
+			case "drain":
+				s.Info("drain requested")
+				err = s.Drain()
+			default:
+				restError(w, http.StatusBadRequest, "the endpoint must be suffixed with one of pause|resume|drain")
+				return
+			}
+
+			if err != nil {
+				status := http.StatusInternalServerError
+				if jqerr, ok := err.(Error); ok && jqerr.Err == ErrBeingDrained {
+					status = http.StatusConflict
+				}
+				restError(w, status, err.Error())
+				return
+			}
+		default:
+			restError(w, http.StatusMethodNotAllowed, "Only GET and POST are supported")
+			return
+		}
+
+		s.ssmutex.RLock()
+		mode := s.ServerInfo.Mode
+		s.ssmutex.RUnlock()
+		stats := s.GetServerStats()
+		restWriteJSON(w, s, http.StatusOK, &ManagerStatus{
+			Mode:    mode,
+			Delayed: stats.Delayed,
+			Ready:   stats.Ready,
+			Running: stats.Running,
+			Buried:  stats.Buried,
+			ETC:     stats.ETC.String(),
+		})
+	}
+}
+
+// restLimits lets you get or set the limits of limit groups. GET on the bare
+// endpoint returns all current limits as a JSON object of group names to
+// limits. Suffixing the endpoint with a group name lets you GET the limit of
+// that group (-1 if it has no limit), PUT a new limit using the required limit
+// parameter (and optional rate parameter, like 100/1m), or DELETE the group's
+// limit, making it unlimited. These return a LimitGroupViaJSON, which includes
+// how many units of the group are being used by running jobs.
+func restLimits(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restLimits", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimSuffix(r.URL.Path[len(restLimitsEndpoint):], "/")
+		if strings.ContainsAny(name, ":,"+limiter.WeightSeparator) {
+			restError(w, http.StatusBadRequest, "limit group names should not contain commas, colons or asterisks")
+			return
+		}
+
+		if name == "" {
+			if r.Method != http.MethodGet {
+				restError(w, http.StatusMethodNotAllowed, "Only GET is supported without a limit group name")
+				return
+			}
+			restWriteJSON(w, s, http.StatusOK, s.limiter.GetLimits())
+			return
+		}
+
+		group := name
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			if r.Form.Get("limit") == "" {
+				restError(w, http.StatusBadRequest, "limit parameter is required")
+				return
+			}
+			group += ":" + r.Form.Get("limit")
+			if r.Form.Get("rate") != "" {
+				group += ":" + r.Form.Get("rate")
+			}
+		case http.MethodDelete:
+			group += ":-1"
+		default:
+			restError(w, http.StatusMethodNotAllowed, "Only GET, PUT and DELETE are supported")
+			return
+		}
+
+		limit, srerr, err := s.getSetLimitGroup(group)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if srerr == ErrBadLimitGroup {
+				status = http.StatusBadRequest
+			}
+			restError(w, status, err.Error())
+			return
+		}
+
+		lgvj := &LimitGroupViaJSON{Name: name, Limit: limit, Used: s.limiter.GetUsage()[name]}
+		if rate := s.limiter.GetRate(name); rate != nil {
+			lgvj.Rate = rate.String()
+		}
+		restWriteJSON(w, s, http.StatusOK, lgvj)
+	}
+}
+
+// restReqs lets you see what has been learned about the resource usage of
+// ReqGroups with GET (of all ReqGroups, or of the one named in the path), which
+// returns a slice of ReqGroupStats. DELETE of a named ReqGroup removes its
+// observations, optionally restricted by the query parameters resource, since
+// and until, returning the number removed. POST of a JSON array of
+// ReqGroupObservations seeds them, returning the number added.
+func restReqs(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restReqs", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimSuffix(r.URL.Path[len(restReqsEndpoint):], "/")
+
+		switch r.Method {
+		case http.MethodGet:
+			stats, err := s.ReqGroupStats(name)
+			if err != nil {
+				restError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			restWriteJSON(w, s, http.StatusOK, stats)
+		case http.MethodDelete:
+			if name == "" {
+				restError(w, http.StatusMethodNotAllowed, "DELETE requires a req group name")
+				return
+			}
+			filter := &ReqGroupStatsFilter{ReqGroup: name, Resource: r.Form.Get("resource")}
+			var err error
+			if r.Form.Get("since") != "" {
+				filter.Since, err = internal.ParseTimeOrAgo(r.Form.Get("since"))
+				if err != nil {
+					restError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			if r.Form.Get("until") != "" {
+				filter.Until, err = internal.ParseTimeOrAgo(r.Form.Get("until"))
+				if err != nil {
+					restError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			removed, err := s.RemoveReqGroupStats(filter)
+			if err != nil {
+				restError(w, restReqsErrorStatus(err), err.Error())
+				return
+			}
+			restWriteJSON(w, s, http.StatusOK, map[string]int{"removed": removed})
+		case http.MethodPost:
+			if name != "" {
+				restError(w, http.StatusMethodNotAllowed, "POST does not take a req group name; supply it in each observation")
+				return
+			}
+			var observations []*ReqGroupObservation
+			err := json.NewDecoder(r.Body).Decode(&observations)
+			if err != nil {
+				restError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			added, err := s.SeedReqGroupStats(observations)
+			if err != nil {
+				restError(w, restReqsErrorStatus(err), err.Error())
+				return
+			}
+			restWriteJSON(w, s, http.StatusCreated, map[string]int{"added": added})
+		default:
+			restError(w, http.StatusMethodNotAllowed, "Only GET, DELETE and POST are supported")
+		}
+	}
+}
+
+// restAccuracy lets you see how well the resources reserved for the jobs of
+// ReqGroups matched what they used with GET (of all ReqGroups, or of the one
+// named in the path), which returns a slice of ReqGroupAccuracy.
+func restAccuracy(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restAccuracy", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		name := strings.TrimSuffix(r.URL.Path[len(restAccuracyEndpoint):], "/")
+		accuracy, err := s.RecommendationAccuracy(name)
+		if err != nil {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		restWriteJSON(w, s, http.StatusOK, accuracy)
+	}
+}
+
+// restReqsErrorStatus returns the http status appropriate for an error from
+// removing or seeding ReqGroup stats.
+func restReqsErrorStatus(err error) int {
+	if jqerr, ok := err.(Error); ok {
+		switch jqerr.Err {
+		case ErrBadResource, ErrBadObservation, ErrBadRequest:
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// restBudgets lets you see budgets with GET (all of them, or the one named in
+// the path), which returns a slice of BudgetStatus. PUT of a JSON Budget to a
+// name creates or updates that budget, returning its BudgetStatus, and DELETE
+// of a name removes it, returning the number removed.
+func restBudgets(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restBudgets", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		name := strings.TrimSuffix(r.URL.Path[len(restBudgetsEndpoint):], "/")
+
+		switch r.Method {
+		case http.MethodGet:
+			restWriteJSON(w, s, http.StatusOK, s.Budgets(name))
+		case http.MethodPut:
+			if name == "" {
+				restError(w, http.StatusMethodNotAllowed, "PUT requires a budget name")
+				return
+			}
+			budget := &Budget{}
+			err := json.NewDecoder(r.Body).Decode(budget)
+			if err != nil {
+				restError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			budget.Name = name
+			status, err := s.SetBudget(budget)
+			if err != nil {
+				if jqerr, ok := err.(Error); ok && jqerr.Err == ErrBadBudget {
+					restError(w, http.StatusBadRequest, err.Error())
+				} else {
+					restError(w, http.StatusInternalServerError, err.Error())
+				}
+				return
+			}
+			restWriteJSON(w, s, http.StatusOK, status)
+		case http.MethodDelete:
+			if name == "" {
+				restError(w, http.StatusMethodNotAllowed, "DELETE requires a budget name")
+				return
+			}
+			removed, err := s.RemoveBudget(name)
+			if err != nil {
+				restError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			var n int
+			if removed {
+				n = 1
+			}
+			restWriteJSON(w, s, http.StatusOK, map[string]int{"removed": n})
+		default:
+			restError(w, http.StatusMethodNotAllowed, "Only GET, PUT and DELETE are supported")
+		}
+	}
+}
+
+// restHistory lets you search through jobs that have exited, using GET. The
+// query parameters correspond to the properties of a JobSearch: since and until
+// (a date, time or duration ago), host, exit, fail_reason, req_grp, rep_grp,
+// min_memory (a number with a unit suffix), min_disk (in MB), limit and after.
+// std and env can also be "true", as for restJobsStatus(). Returns a
+// JobHistoryPage.
+func restHistory(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restHistory", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		js, err := restFormToJobSearch(r)
+		if err != nil {
+			restError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		jobs, next, err := s.searchJobHistory(js, r.Form.Get("std") == restFormTrue, r.Form.Get("env") == restFormTrue)
+		if err != nil {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		page := &JobHistoryPage{Jobs: make([]JStatus, len(jobs)), Next: next}
+		for i, job := range jobs {
+			page.Jobs[i], err = job.ToStatus()
+			if err != nil && err != io.ErrUnexpectedEOF {
+				restError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		restWriteJSON(w, s, http.StatusOK, page)
+	}
+}
+
+// restDeferredOKWriter is an io.Writer that only writes an OK status to its
+// ResponseWriter when something is first written, so that errors before then
+// can still be reported with an error status.
+type restDeferredOKWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+// Write implements io.Writer.
+func (dw *restDeferredOKWriter) Write(p []byte) (int, error) {
+	dw.start()
+	return dw.w.Write(p)
+}
+
+// start writes the OK status if it hasn't been written already.
+func (dw *restDeferredOKWriter) start() {
+	if !dw.started {
+		dw.started = true
+		dw.w.WriteHeader(http.StatusOK)
+	}
+}
+
+// restExport streams the jobs that have exited and match the query parameters
+// as CSV or JSON Lines. Only GET is supported. Should the export fail after
+// some of it has already been sent, the error is given in the X-Export-Error
+// trailer.
+func restExport(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restExport", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		js, err := restFormToJobSearch(r)
+		if err != nil {
+			restError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		js.Complete = r.Form.Get("live") != restFormTrue
+
+		format := ExportFormat(r.Form.Get("format"))
+		var contentType string
+		switch format {
+		case "", ExportFormatCSV:
+			format = ExportFormatCSV
+			contentType = "text/csv"
+		case ExportFormatJSONL:
+			contentType = "application/x-ndjson"
+		default:
+			restError(w, http.StatusBadRequest, fmt.Sprintf("unsupported export format '%s'", format))
+			return
+		}
+
+		dw := &restDeferredOKWriter{w: w}
+		exporter, err := NewJobExporter(format, dw, "")
+		if err != nil {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType+"; charset=UTF-8")
+		w.Header().Set("Trailer", restExportErrorTrailer)
+		err = s.ExportHistory(js, exporter)
+		errc := exporter.Close()
+		if err == nil {
+			err = errc
+		}
+
+		if err != nil {
+			s.Warn("rest failed to export jobs", "err", err)
+			if !dw.started {
+				restError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			// we already said everything was OK, so all we can do now is tell
+			// the client that what they got is incomplete
+			w.Header().Set(restExportErrorTrailer, err.Error())
+			return
+		}
+		dw.start()
+	}
+}
+
+// restGraph lets you GET the dependency graph of the jobs in the RepGroup named
+// in the path (or all RepGroups it is a substring of, with search=true), in
+// the format given by the format parameter: json (the default), dot or
+// mermaid.
+func restGraph(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restGraph", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		repgroup := strings.TrimSuffix(r.URL.Path[len(restGraphEndpoint):], "/")
+		if repgroup == "" {
+			restError(w, http.StatusBadRequest, "a RepGroup must be supplied")
+			return
+		}
+
+		format := DependencyGraphFormat(r.Form.Get("format"))
+		var contentType string
+		switch format {
+		case "", DependencyGraphFormatJSON:
+			format = DependencyGraphFormatJSON
+		case DependencyGraphFormatDOT:
+			contentType = "text/vnd.graphviz"
+		case DependencyGraphFormatMermaid:
+			contentType = "text/plain"
+		default:
+			restError(w, http.StatusBadRequest, "format must be one of json, dot or mermaid")
+			return
+		}
+
+		g, err := s.DependencyGraph(repgroup, r.Form.Get("search") == restFormTrue)
+		if err != nil {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == DependencyGraphFormatJSON {
+			restWriteJSON(w, s, http.StatusOK, g)
+			return
+		}
+
+		rendered, err := g.Render(format)
+		if err != nil {
+			restError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", contentType+"; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write([]byte(rendered))
+		if err != nil {
+			s.Warn("rest failed to write graph", "err", err)
+		}
+	}
+}
+
+// restFormToJobSearch converts the query parameters of a restHistory() or
+// restExport() request to a JobSearch.
+func restFormToJobSearch(r *http.Request) (*JobSearch, error) {
+	js := &JobSearch{
+		Host:        r.Form.Get("host"),
+		FailReason:  r.Form.Get("fail_reason"),
+		ReqGroup:    r.Form.Get("req_grp"),
+		RepGroup:    r.Form.Get("rep_grp"),
+		MinPeakDisk: int64(urlStringToInt(r.Form.Get("min_disk"))),
+		Limit:       urlStringToInt(r.Form.Get("limit")),
+		After:       r.Form.Get("after"),
+	}
+
+	var err error
+	if r.Form.Get("since") != "" {
+		js.Since, err = internal.ParseTimeOrAgo(r.Form.Get("since"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Form.Get("until") != "" {
+		js.Until, err = internal.ParseTimeOrAgo(r.Form.Get("until"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Form.Get("exit") != "" {
+		exit, erra := strconv.Atoi(r.Form.Get("exit"))
+		if erra != nil {
+			return nil, erra
+		}
+		js.Exitcode = &exit
+	}
+	if r.Form.Get("min_memory") != "" {
+		mb, errb := bytefmt.ToMegabytes(r.Form.Get("min_memory"))
+		if errb != nil {
+			return nil, errb
+		}
+		js.MinPeakRAM = int(mb)
+	}
+	return js, nil
+}
+
+// restWarnings lets you read warnings from the scheduler, and auto-"dismisses"
+// (deletes) them.
+func restWarnings(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restWarnings", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		// carry out a different action based on the HTTP Verb
+		sis := []*schedulerIssue{}
+		switch r.Method {
+		case http.MethodGet:
+			s.simutex.Lock()
+			for key, si := range s.schedIssues {
+				sis = append(sis, si)
+				delete(s.schedIssues, key)
+			}
+			s.simutex.Unlock()
+		default:
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+			return
+		}
+
+		// return schedulerIssues as JSON
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		erre := encoder.Encode(sis)
+		if erre != nil {
+			s.Warn("restWarnings failed to encode scheduler issues", "err", erre)
+		}
+	}
+}
+
+// restBadServers lets you do CRUD on cloud servers that have gone bad. The
+// DELETE verb has a required 'id' parameter, being the ID of a server you wish
+// to confirm as bad and have terminated if it still exists.
+func restBadServers(s *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer internal.LogPanic(s.Logger, "jobqueue web server restBadServers", false)
+
+		ok := s.httpAuthorized(w, r)
+		if !ok {
+			return
+		}
+
+		// carry out a different action based on the HTTP Verb
+		switch r.Method {
+		case http.MethodGet:
+			servers := s.getBadServers()
+			if len(servers) == 0 {
+				servers = []*BadServer{}
+			}
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusOK)
+			encoder := json.NewEncoder(w)
+			encoder.SetEscapeHTML(false)
+			erre := encoder.Encode(servers)
+			if erre != nil {
+				s.Warn("restBadServers failed to encode servers", "err", erre)
+			}
+			return
+		case http.MethodDelete:
+			serverID := r.Form.Get("id")
+			if serverID == "" {
+				restError(w, http.StatusBadRequest, "id parameter is required")
+				return
+			}
+			s.bsmutex.Lock()
+			server := s.badServers[serverID]
+			delete(s.badServers, serverID)
+			s.bsmutex.Unlock()
+			if server == nil {
+				restError(w, http.StatusNotFound, "Server was not known to be bad")
+				return
 			}
 			if server.IsBad() {
 				err := server.Destroy()
 				if err != nil {
-					http.Error(w, fmt.Sprintf("Server was bad but could not be destroyed: %s", err), http.StatusNotModified)
+					restError(w, http.StatusNotModified, fmt.Sprintf("Server was bad but could not be destroyed: %s", err))
 					return
 				}
 			}
 			w.WriteHeader(http.StatusOK)
 			return
 		default:
-			http.Error(w, "Only GET and DELETE are supported", http.StatusBadRequest)
+			restError(w, http.StatusMethodNotAllowed, "Only GET and DELETE are supported")
 			return
 		}
 	}
@@ -958,13 +2096,13 @@ func restFileUpload(s *Server) http.HandlerFunc {
 		}
 
 		if r.Method != http.MethodPut {
-			http.Error(w, "Only PUT is supported", http.StatusBadRequest)
+			restError(w, http.StatusMethodNotAllowed, "Only PUT is supported")
 			return
 		}
 
 		savePath, err := s.uploadFile(r.Body, r.Form.Get("path"))
 		if err != nil {
-			http.Error(w, "file upload failed", http.StatusInternalServerError)
+			restError(w, http.StatusInternalServerError, "file upload failed")
 			return
 		}
 
@@ -981,7 +2119,8 @@ func restFileUpload(s *Server) http.HandlerFunc {
 	}
 }
 
-// restInfo lets you get info on self.
+// restInfo lets you get info on self, including the live cost totals if we
+// were configured with CostRates.
 func restInfo(s *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer internal.LogPanic(s.Logger, "jobqueue server status", false)
@@ -992,15 +2131,27 @@ func restInfo(s *Server) http.HandlerFunc {
 		}
 
 		if r.Method != http.MethodGet {
-			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
 			return
 		}
 
+		s.ssmutex.RLock()
+		info := *s.ServerInfo
+		s.ssmutex.RUnlock()
+		if s.costRates != nil {
+			costs, err := s.CostTotals()
+			if err != nil {
+				restError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			info.Costs = costs
+		}
+
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
 		encoder := json.NewEncoder(w)
 		encoder.SetEscapeHTML(false)
-		err := encoder.Encode(s.ServerInfo)
+		err := encoder.Encode(&info)
 		if err != nil {
 			s.Warn("restInfo failed to encode ServerInfo", "err", err)
 		}
@@ -1015,7 +2166,7 @@ func restVersion(s *Server) http.HandlerFunc {
 		defer internal.LogPanic(s.Logger, "jobqueue server version", false)
 
 		if r.Method != http.MethodGet {
-			http.Error(w, "Only GET is supported", http.StatusBadRequest)
+			restError(w, http.StatusMethodNotAllowed, "Only GET is supported")
 			return
 		}
 
@@ -1030,6 +2181,36 @@ func restVersion(s *Server) http.HandlerFunc {
 	}
 }
 
+// restError writes out the given message and http.Status* value as a JSON
+// RESTError.
+func restError(w http.ResponseWriter, status int, msg string) {
+	restErrorWithFields(w, status, msg, nil)
+}
+
+// restErrorWithFields is like restError, but also includes details of the
+// problems with particular fields of the request.
+func restErrorWithFields(w http.ResponseWriter, status int, msg string, fields []RESTFieldError) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(&RESTError{Error: msg, Status: status, Fields: fields}) //nolint:errcheck
+}
+
+// restWriteJSON writes out the given value as JSON with the given http.Status*
+// value.
+func restWriteJSON(w http.ResponseWriter, s *Server, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	if err != nil {
+		s.Warn("rest failed to encode JSON", "err", err)
+	}
+}
+
 // urlStringToInt takes a possible string from a url parameter value and
 // converts it to an int. If the value is "", or if the value isn't a number,
 // returns 0.
@@ -48,6 +48,8 @@ type jstatusReq struct {
 	// confirmBadServer = confirm that the server with ID ServerID is bad.
 	// dismissMsg = dismiss the given Msg.
 	// dismissMsgs = dismiss all scheduler messages.
+	// costs = get the total costs of jobs per RepGroup and user, if the
+	//         server was configured with CostRates.
 	Request string
 
 	// sending Key means "give me detailed info about this single job", and
@@ -83,10 +85,13 @@ type JStatus struct {
 	Behaviours    string
 	Mounts        string
 	MonitorDocker string
+	ResultCache   string
 	FailReason    string
 	Host          string
 	HostID        string
 	HostIP        string
+	User          string
+	Budget        string
 	StdErr        string
 	StdOut        string
 	ExpectedRAM   int     // ExpectedRAM is in Megabytes.
@@ -99,12 +104,14 @@ type JStatus struct {
 	Pid           int
 	Walltime      float64
 	CPUtime       float64
+	Cost          float64
 	Started       int64
 	Ended         int64
 	Similar       int
 	Attempts      uint32
 	HomeChanged   bool
 	Exited        bool
+	Cached        bool
 }
 
 // webInterfaceStatic is a http handler for our static documents in the static
@@ -368,6 +375,21 @@ func webInterfaceStatusWS(s *Server) http.HandlerFunc {
 						s.simutex.Lock()
 						s.schedIssues = make(map[string]*schedulerIssue)
 						s.simutex.Unlock()
+					case "costs":
+						if s.costRates == nil {
+							continue
+						}
+						costs, err := s.CostTotals()
+						if err != nil {
+							s.Warn("web interface getting cost totals failed", "err", err)
+							continue
+						}
+						writeMutex.Lock()
+						err = conn.WriteJSON(costs)
+						writeMutex.Unlock()
+						if err != nil {
+							break
+						}
 					default:
 						continue
 					}
@@ -0,0 +1,311 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package jobqueue
+
+// This file contains the code for resource protector tokens, which let the
+// commands of running jobs ask the server for permission to use some limited
+// resource for just part of their run, instead of limiting the whole job with
+// a limit group.
+//
+// Each named Protector configured on the server is an rp.Protector. Receipts
+// handed out to clients are prefixed with the name of the Protector they came
+// from, so that clients only need to hold on to the receipt. Receipts requested
+// from within a job's Cmd are also remembered against that job, so that they
+// can be released when the job exits, even if the Cmd didn't release them.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VertebrateResequencing/wr/rp"
+	sync "github.com/sasha-s/go-deadlock"
+)
+
+// ProtectorReleaseTimeout is the default time after which granted tokens are
+// released if they are not touched or released by the client.
+const ProtectorReleaseTimeout = 5 * time.Minute
+
+// tokenGrantedPollInterval is how often we check to see if a request for
+// tokens has been granted while a client waits.
+var tokenGrantedPollInterval = 50 * time.Millisecond
+
+// receiptSeparator separates the name of a Protector from an rp.Receipt in the
+// receipts we give to clients.
+const receiptSeparator = ":"
+
+// JobKeyEnvVar is the environment variable that Execute() sets to the key of
+// the job whose Cmd it runs.
+const JobKeyEnvVar = "WR_JOB_KEY"
+
+// jobTokens keeps track of the receipts requested by jobs.
+type jobTokens struct {
+	receipts map[string]map[string]bool // job key to receipts
+	jobs     map[string]string          // receipt to job key
+	sync.Mutex
+}
+
+// newJobTokens returns an empty jobTokens.
+func newJobTokens() *jobTokens {
+	return &jobTokens{
+		receipts: make(map[string]map[string]bool),
+		jobs:     make(map[string]string),
+	}
+}
+
+// add remembers that the given receipt was requested by the given job.
+func (jt *jobTokens) add(jobKey, receipt string) {
+	jt.Lock()
+	defer jt.Unlock()
+	receipts, exists := jt.receipts[jobKey]
+	if !exists {
+		receipts = make(map[string]bool)
+		jt.receipts[jobKey] = receipts
+	}
+	receipts[receipt] = true
+	jt.jobs[receipt] = jobKey
+}
+
+// remove forgets the given receipt.
+func (jt *jobTokens) remove(receipt string) {
+	jt.Lock()
+	defer jt.Unlock()
+	jobKey, exists := jt.jobs[receipt]
+	if !exists {
+		return
+	}
+	delete(jt.jobs, receipt)
+	delete(jt.receipts[jobKey], receipt)
+	if len(jt.receipts[jobKey]) == 0 {
+		delete(jt.receipts, jobKey)
+	}
+}
+
+// take forgets and returns all the receipts of the given job.
+func (jt *jobTokens) take(jobKey string) []string {
+	jt.Lock()
+	defer jt.Unlock()
+	receipts := make([]string, 0, len(jt.receipts[jobKey]))
+	for receipt := range jt.receipts[jobKey] {
+		receipts = append(receipts, receipt)
+		delete(jt.jobs, receipt)
+	}
+	delete(jt.receipts, jobKey)
+	return receipts
+}
+
+// Protector describes a resource that the server will hand out tokens for.
+type Protector struct {
+	// Name identifies the resource, eg. "irods".
+	Name string
+
+	// MaxSimultaneous is the most tokens that can be in use at once.
+	MaxSimultaneous int
+
+	// DelayBetween is the minimum time between the granting of each request
+	// for tokens.
+	DelayBetween time.Duration
+
+	// ReleaseTimeout is how long granted tokens can go without being touched
+	// before they are released automatically, so that the tokens of commands
+	// that die are not held forever. Defaults to ProtectorReleaseTimeout.
+	ReleaseTimeout time.Duration
+}
+
+// ParseProtectors parses a comma separated list of resources to protect like
+// "name:max[:delay[:timeout]]", where max is the maximum number of tokens that
+// can be in use at once, delay is the minimum duration between grants (default
+// 0) and timeout is the Protector's ReleaseTimeout. Eg.
+// "irods:20:100ms:10m,db:5". Returns nil if spec contains no resources, and an
+// Error with Err ErrBadProtector if spec is invalid.
+func ParseProtectors(spec string) ([]*Protector, error) {
+	var protectors []*Protector
+	seen := make(map[string]bool)
+	for _, pSpec := range strings.Split(spec, ",") {
+		pSpec = strings.TrimSpace(pSpec)
+		if pSpec == "" {
+			continue
+		}
+
+		parts := strings.Split(pSpec, ":")
+		if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || seen[parts[0]] {
+			return nil, Error{"ParseProtectors", pSpec, ErrBadProtector}
+		}
+
+		p := &Protector{Name: parts[0], ReleaseTimeout: ProtectorReleaseTimeout}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max < 1 {
+			return nil, Error{"ParseProtectors", pSpec, ErrBadProtector}
+		}
+		p.MaxSimultaneous = max
+
+		if len(parts) > 2 {
+			p.DelayBetween, err = time.ParseDuration(parts[2])
+			if err != nil || p.DelayBetween < 0 {
+				return nil, Error{"ParseProtectors", pSpec, ErrBadProtector}
+			}
+		}
+
+		if len(parts) > 3 {
+			p.ReleaseTimeout, err = time.ParseDuration(parts[3])
+			if err != nil || p.ReleaseTimeout <= 0 {
+				return nil, Error{"ParseProtectors", pSpec, ErrBadProtector}
+			}
+		}
+
+		seen[p.Name] = true
+		protectors = append(protectors, p)
+	}
+	return protectors, nil
+}
+
+// createProtectors makes an rp.Protector for each of the given Protectors.
+func createProtectors(protectors []*Protector) map[string]*rp.Protector {
+	rps := make(map[string]*rp.Protector)
+	for _, p := range protectors {
+		timeout := p.ReleaseTimeout
+		if timeout <= 0 {
+			timeout = ProtectorReleaseTimeout
+		}
+		rps[p.Name] = rp.New(p.Name, p.DelayBetween, p.MaxSimultaneous, timeout)
+	}
+	return rps
+}
+
+// protectorForReceipt returns the rp.Protector and rp.Receipt that a receipt
+// we handed out corresponds to. Returns an Error with Err ErrUnknownProtector
+// if the receipt isn't from one of our protectors.
+func (s *Server) protectorForReceipt(op, receipt string) (*rp.Protector, rp.Receipt, error) {
+	i := strings.LastIndex(receipt, receiptSeparator)
+	if i < 1 {
+		return nil, "", Error{op, receipt, ErrUnknownProtector}
+	}
+	p, exists := s.protectors[receipt[:i]]
+	if !exists {
+		return nil, "", Error{op, receipt, ErrUnknownProtector}
+	}
+	return p, rp.Receipt(receipt[i+1:]), nil
+}
+
+// RequestTokens queues a request for the given number of tokens of the named
+// Protector, returning a receipt that should be supplied to WaitForTokens(),
+// TouchTokens() and ReleaseTokens(). If jobKey is supplied, the tokens will
+// also be released when that job is archived, released or buried.
+func (s *Server) RequestTokens(protector string, numTokens int, jobKey string) (string, error) {
+	p, exists := s.protectors[protector]
+	if !exists {
+		return "", Error{"RequestTokens", protector, ErrUnknownProtector}
+	}
+	if numTokens < 1 {
+		numTokens = 1
+	}
+
+	receipt, err := p.Request(numTokens)
+	if err != nil {
+		if rperr, ok := err.(rp.Error); ok {
+			return "", Error{"RequestTokens", protector, rperr.Err}
+		}
+		return "", err
+	}
+
+	ourReceipt := protector + receiptSeparator + string(receipt)
+	if jobKey != "" {
+		s.jobTokens.add(jobKey, ourReceipt)
+	}
+	return ourReceipt, nil
+}
+
+// WaitForTokens blocks until the request with the given receipt has been
+// granted its tokens, or until timeout has passed, returning true in the
+// former case. The request remains queued if the timeout is hit, so you can
+// call this again. Returns an Error with Err ErrTokensNotGranted if the
+// request was cancelled or released, or has otherwise become unable to be
+// granted.
+func (s *Server) WaitForTokens(receipt string, timeout time.Duration) (bool, error) {
+	p, r, err := s.protectorForReceipt("WaitForTokens", receipt)
+	if err != nil {
+		return false, err
+	}
+
+	ticker := time.NewTicker(tokenGrantedPollInterval)
+	defer ticker.Stop()
+	limit := time.After(timeout)
+	for {
+		granted, keepChecking := p.Granted(r)
+		if granted {
+			return true, nil
+		}
+		if !keepChecking {
+			return false, Error{"WaitForTokens", receipt, ErrTokensNotGranted}
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-limit:
+			return false, nil
+		}
+	}
+}
+
+// TouchTokens stops the tokens granted for the given receipt from being
+// released automatically for another ReleaseTimeout. Returns an Error with Err
+// ErrTokensNotGranted if they are no longer granted.
+func (s *Server) TouchTokens(receipt string) error {
+	p, r, err := s.protectorForReceipt("TouchTokens", receipt)
+	if err != nil {
+		return err
+	}
+
+	p.Touch(r)
+	if granted, _ := p.Granted(r); !granted {
+		return Error{"TouchTokens", receipt, ErrTokensNotGranted}
+	}
+	return nil
+}
+
+// ReleaseTokens releases the tokens granted for the given receipt, or cancels
+// the request if they have not been granted yet.
+func (s *Server) ReleaseTokens(receipt string) error {
+	p, r, err := s.protectorForReceipt("ReleaseTokens", receipt)
+	if err != nil {
+		return err
+	}
+	p.Cancel(r)
+	s.jobTokens.remove(receipt)
+	return nil
+}
+
+// releaseJobTokens releases the tokens of any receipts requested by the job
+// with the given key that haven't been released already.
+func (s *Server) releaseJobTokens(jobKey string) {
+	for _, receipt := range s.jobTokens.take(jobKey) {
+		if p, r, err := s.protectorForReceipt("releaseJobTokens", receipt); err == nil {
+			p.Cancel(r)
+			s.Debug("released tokens of exited job", "job", jobKey, "receipt", receipt)
+		}
+	}
+}
+
+// shutdownProtectors releases all tokens and stops granting new ones.
+func (s *Server) shutdownProtectors() {
+	for _, p := range s.protectors {
+		p.Shutdown()
+	}
+}
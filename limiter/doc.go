@@ -63,5 +63,27 @@ any.
 
     l.Increment([]string{"l3"}) // true since callback returns 0
     l.Decrement([]string{"l3"}) // ignored
+
+Groups can also be rate limited, so that they can only be Increment()ed a
+certain number of times within a time window, regardless of Decrement()s. Set a
+second callback that provides the Rate of each group (or nil for groups without
+one); groups that have a Rate but a limit of -1 are only rate limited:
+
+    l.SetRateCallback(func(name string) *limiter.Rate {
+        if name == "l4" {
+            return &limiter.Rate{Count: 100, Window: time.Minute}
+        }
+        return nil
+    })
+
+    l.Increment([]string{"l4"}) // true up to 100 times a minute
+
+If something uses more than 1 unit of a group, suffix the group name with
+WeightSeparator and the number of units. Supply the same suffixed names to
+Decrement():
+
+    l.Increment([]string{"l1*2"}) // true, uses 2 of l1's limit of 3
+    l.Increment([]string{"l1*2"}) // false
+    l.Decrement([]string{"l1*2"})
 */
 package limiter
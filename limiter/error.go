@@ -28,6 +28,8 @@ import (
 const (
 	ErrNotIncremented = "decrement attempted on a limit group that had not been incremented"
 	ErrAtLimit        = "increment attempted on a limit group already at its limit"
+	ErrBadRate        = "rates must be like count/duration, eg. 100/1m"
+	ErrBadWeight      = "weights must be positive integers, eg. name*4"
 )
 
 // Error records an error and the operation, request and protector that caused it.
@@ -20,12 +20,17 @@ package limiter
 
 // This file contains the implementation of the group stuct.
 
+import "time"
+
 // group struct describes an individual limit group.
 type group struct {
-	name     string
-	limit    uint
-	current  uint
-	toNotify []chan bool
+	name      string
+	limit     uint
+	unlimited bool // true if the group only has a rate limit
+	current   uint
+	rate      *Rate
+	starts    []time.Time // times of increments within the rate's window
+	toNotify  []chan bool
 }
 
 // newGroup creates a new group.
@@ -39,31 +44,75 @@ func newGroup(name string, limit uint) *group {
 // setLimit updates the group's limit.
 func (g *group) setLimit(limit uint) {
 	g.limit = limit
+	g.unlimited = false
+}
+
+// setRate updates the group's rate limit. A nil rate removes it.
+func (g *group) setRate(rate *Rate) {
+	g.rate = rate
+	if rate == nil {
+		g.starts = nil
+	}
+}
+
+// canIncrement tells you if the current count of this group plus the given
+// weight is no more than the limit, and if there have been fewer increments
+// than its rate allows within the rate's window.
+func (g *group) canIncrement(weight uint) bool {
+	if !g.unlimited && g.current+weight > g.limit {
+		return false
+	}
+	return g.rateCapacity() != 0
 }
 
-// canIncrement tells you if the current count of this group is less than the
-// limit.
-func (g *group) canIncrement() bool {
-	return g.current < g.limit
+// increment increases the current count of this group by the given weight. You
+// must call canIncrement() first to make sure you won't go over the limit (and
+// hold a lock over the 2 calls to avoid a race condition).
+func (g *group) increment(weight uint) {
+	g.current += weight
+	if g.rate != nil {
+		g.starts = append(g.starts, time.Now())
+	}
 }
 
-// increment increases the current count of this group. You must call
-// canIncrement() first to make sure you won't go over the limit (and hold a
-// lock over the 2 calls to avoid a race condition).
-func (g *group) increment() {
-	g.current++
+// rateCapacity prunes our record of increments that are no longer within our
+// rate's window, and tells you how many more increments our rate allows right
+// now. Returns -1 if we have no rate.
+func (g *group) rateCapacity() int {
+	if g.rate == nil {
+		return -1
+	}
+	within, _ := g.rate.startsWithin(g.starts, time.Now())
+	g.starts = g.starts[len(g.starts)-within:]
+	if within >= int(g.rate.Count) {
+		return 0
+	}
+	return int(g.rate.Count) - within
 }
 
-// decrement decreases the current count of this group. Returns true if the
-// current count indicates the group is unused.
-func (g *group) decrement() bool {
+// rateWait tells you how long until our rate would allow another increment,
+// which is 0 if it allows one now (or we have no rate).
+func (g *group) rateWait() time.Duration {
+	if g.rateCapacity() != 0 {
+		return 0
+	}
+	_, wait := g.rate.startsWithin(g.starts, time.Now())
+	return wait
+}
+
+// decrement decreases the current count of this group by the given weight.
+// Returns true if the current count indicates the group is unused.
+func (g *group) decrement(weight uint) bool {
 	// (decrementing a uint under 0 makes it a large positive value, so we must
 	// check first)
 	if g.current == 0 {
-		return true
+		return g.unused()
 	}
 
-	g.current--
+	if weight > g.current {
+		weight = g.current
+	}
+	g.current -= weight
 
 	// notify callers who passed a channel to notifyDecrement(), but do it
 	// defensively in a go routine so if the caller doesn't read from the
@@ -78,16 +127,37 @@ func (g *group) decrement() bool {
 		}()
 	}
 
-	return g.current < 1
+	return g.unused()
+}
+
+// unused tells you if this group has no current count and there are no recent
+// increments that its rate needs to remember.
+func (g *group) unused() bool {
+	return g.current < 1 && g.rateCapacity() == g.rateCount()
 }
 
-// capacity tells you how many more increments you could do on this group before
-// breaching the limit.
-func (g *group) capacity() int {
-	if g.current >= g.limit {
+// rateCount returns the Count of our rate, or -1 if we don't have one.
+func (g *group) rateCount() int {
+	if g.rate == nil {
+		return -1
+	}
+	return int(g.rate.Count)
+}
+
+// capacity tells you how many more increments of the given weight you could do
+// on this group before breaching the limit or rate.
+func (g *group) capacity(weight uint) int {
+	capacity := g.rateCapacity()
+	if g.unlimited {
+		return capacity
+	}
+	if g.current+weight > g.limit {
 		return 0
 	}
-	return int(g.limit - g.current)
+	if limited := int((g.limit - g.current) / weight); capacity == -1 || limited < capacity {
+		return limited
+	}
+	return capacity
 }
 
 // notifyDecrement will result in true being sent on the given channel the next
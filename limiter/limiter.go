@@ -38,6 +38,7 @@ type SetLimitCallback func(name string) int
 // Limiter struct is used to limit usage of groups.
 type Limiter struct {
 	cb     SetLimitCallback
+	rcb    SetRateCallback
 	groups map[string]*group
 	mu     sync.Mutex
 }
@@ -50,6 +51,17 @@ func New(cb SetLimitCallback) *Limiter {
 	}
 }
 
+// SetRateCallback sets a callback that provides the rate limits of groups, for
+// groups that should only be Increment()ed a certain number of times in a
+// period, in addition to (or instead of) having their concurrent usage
+// limited. A group that your SetLimitCallback returns -1 for, but this returns
+// a Rate for, will only be rate limited.
+func (l *Limiter) SetRateCallback(cb SetRateCallback) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rcb = cb
+}
+
 // SetLimit creates or updates a group with the given limit.
 func (l *Limiter) SetLimit(name string, limit uint) {
 	l.mu.Lock()
@@ -62,20 +74,73 @@ func (l *Limiter) SetLimit(name string, limit uint) {
 	}
 }
 
+// SetRate creates or updates a group with the given rate limit. If the group
+// didn't exist, it will have no limit on its concurrent usage. A nil rate
+// removes the group's rate limit, and removes the group entirely if it has no
+// other limit.
+func (l *Limiter) SetRate(name string, rate *Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	g, set := l.groups[name]
+	switch {
+	case set:
+		g.setRate(rate)
+		if rate == nil && g.unlimited {
+			delete(l.groups, name)
+		}
+	case rate != nil:
+		g = newGroup(name, 0)
+		g.unlimited = true
+		g.setRate(rate)
+		l.groups[name] = g
+	}
+}
+
+// ClearLimit removes the limit on the concurrent usage of the given group,
+// leaving it with only its rate limit. If it has no rate limit, this is the
+// same as RemoveLimit().
+func (l *Limiter) ClearLimit(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if g, set := l.groups[name]; set {
+		if g.rate == nil {
+			delete(l.groups, name)
+			return
+		}
+		g.unlimited = true
+	}
+}
+
 // GetLimit tells you the limit currently set for the given group. If the group
-// doesn't exist, returns -1.
+// doesn't exist or only has a rate limit, returns -1.
 func (l *Limiter) GetLimit(name string) int {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	group := l.vivifyGroup(name)
-	if group == nil {
+	if group == nil || group.unlimited {
 		return -1
 	}
 	return int(group.limit)
 }
 
-// GetLimits tells you the current limit of all currently set groups.
+// GetRate tells you the rate limit currently set for the given group, or nil
+// if it has none.
+func (l *Limiter) GetRate(name string) *Rate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group := l.vivifyGroup(name)
+	if group == nil {
+		return nil
+	}
+	return group.rate
+}
+
+// GetLimits tells you the current limit of all currently set groups. Groups
+// that only have a rate limit are given a limit of -1.
 func (l *Limiter) GetLimits() map[string]int {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -83,12 +148,49 @@ func (l *Limiter) GetLimits() map[string]int {
 	limits := make(map[string]int, len(l.groups))
 
 	for name, group := range l.groups {
+		if group.unlimited {
+			limits[name] = -1
+			continue
+		}
 		limits[name] = int(group.limit)
 	}
 
 	return limits
 }
 
+// GetRates tells you the current rate limit of all currently set groups that
+// have one.
+func (l *Limiter) GetRates() map[string]*Rate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rates := make(map[string]*Rate)
+
+	for name, group := range l.groups {
+		if group.rate != nil {
+			rates[name] = group.rate
+		}
+	}
+
+	return rates
+}
+
+// GetUsage tells you the current count of all groups in memory, which is the
+// sum of the weights they have been Increment()ed by, less those they have been
+// Decrement()ed by.
+func (l *Limiter) GetUsage() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	usage := make(map[string]int, len(l.groups))
+
+	for name, group := range l.groups {
+		usage[name] = int(group.current)
+	}
+
+	return usage
+}
+
 // RemoveLimit removes the given group from memory. If your callback also begins
 // returning -1 for this group, the group effectively becomes unlimited.
 func (l *Limiter) RemoveLimit(name string) {
@@ -100,6 +202,10 @@ func (l *Limiter) RemoveLimit(name string) {
 // Increment sees if it would be possible to increment the count of every
 // supplied group, without making any of them go over their limit.
 //
+// Groups are incremented by 1, unless their name is suffixed with a weight (see
+// SplitWeight()), in which case they are incremented by that weight. (Rate
+// limits count each increment once, regardless of weight.)
+//
 // If this is the first time we're seeing a group name, or a Decrement() call
 // has made us forget about that group, the callback provided to New() will be
 // called with the name, and the returned value will be used to create a new
@@ -110,7 +216,8 @@ func (l *Limiter) RemoveLimit(name string) {
 // true. If not possible, no group counts are altered and this returns false.
 //
 // If an optional wait duration is supplied, will wait for up to the given wait
-// period for an increment of every group to be possible.
+// period for an increment of every group to be possible, either because of
+// Decrement()s or because a rate limit's window moved on.
 func (l *Limiter) Increment(groups []string, wait ...time.Duration) bool {
 	l.mu.Lock()
 	if l.checkGroups(groups) {
@@ -126,36 +233,76 @@ func (l *Limiter) Increment(groups []string, wait ...time.Duration) bool {
 
 	ch := make(chan bool, len(groups))
 	l.registerGroupNotifications(groups, ch)
+	rateCh := l.rateTimer(groups)
 	l.mu.Unlock()
 
 	limit := time.After(wait[0])
 	for {
 		select {
 		case <-ch:
-			l.mu.Lock()
-			if l.checkGroups(groups) {
-				l.incrementGroups(groups)
-				l.mu.Unlock()
-				return true
-			}
-			ch = make(chan bool, len(groups))
-			l.registerGroupNotifications(groups, ch)
-			l.mu.Unlock()
-			continue
+		case <-rateCh:
 		case <-limit:
 			return false
 		}
+
+		l.mu.Lock()
+		if l.checkGroups(groups) {
+			l.incrementGroups(groups)
+			l.mu.Unlock()
+			return true
+		}
+		ch = make(chan bool, len(groups))
+		l.registerGroupNotifications(groups, ch)
+		rateCh = l.rateTimer(groups)
+		l.mu.Unlock()
 	}
 }
 
+// rateTimer returns a channel that will receive when the rate limits of the
+// given groups next allow an increment, or nil if they aren't currently
+// stopping one. You must hold the mu.Lock() before calling this.
+func (l *Limiter) rateTimer(groups []string) <-chan time.Time {
+	wait := l.rateWait(groups)
+	if wait <= 0 {
+		return nil
+	}
+	return time.After(wait)
+}
+
+// rateWait returns the longest time any of the given groups must wait before
+// its rate limit allows an increment. You must hold the mu.Lock() before
+// calling this.
+func (l *Limiter) rateWait(groups []string) time.Duration {
+	var longest time.Duration
+	for _, name := range groups {
+		group, _ := l.vivifyWeightedGroup(name)
+		if group != nil {
+			if wait := group.rateWait(); wait > longest {
+				longest = wait
+			}
+		}
+	}
+	return longest
+}
+
+// GetRateWait tells you how long it will be until the rate limits of the given
+// groups would allow an Increment(), ignoring their limits on concurrent
+// usage. Returns 0 if their rate limits would allow one now, or they have no
+// rate limits.
+func (l *Limiter) GetRateWait(groups []string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rateWait(groups)
+}
+
 // checkGroups checks all the groups to see if they can be incremented. You must
 // hold the mu.lock before calling this, and until after calling
 // incrementGroups() if this returns true.
 func (l *Limiter) checkGroups(groups []string) bool {
 	for _, name := range groups {
-		group := l.vivifyGroup(name)
+		group, weight := l.vivifyWeightedGroup(name)
 		if group != nil {
-			if !group.canIncrement() {
+			if !group.canIncrement(weight) {
 				return false
 			}
 		}
@@ -167,13 +314,20 @@ func (l *Limiter) checkGroups(groups []string) bool {
 // hold the mu.lock before calling this (and check first).
 func (l *Limiter) incrementGroups(groups []string) {
 	for _, name := range groups {
-		group := l.vivifyGroup(name)
+		group, weight := l.vivifyWeightedGroup(name)
 		if group != nil {
-			group.increment()
+			group.increment(weight)
 		}
 	}
 }
 
+// vivifyWeightedGroup is like vivifyGroup(), but takes a group name that might
+// be suffixed with a weight (see SplitWeight()), and also returns the weight.
+func (l *Limiter) vivifyWeightedGroup(spec string) (*group, uint) {
+	name, weight := splitWeight(spec)
+	return l.vivifyGroup(name), weight
+}
+
 // vivifyGroup either returns a stored group or creates a new one based on the
 // results of calling the SetLimitCallback. You must have the mu.Lock() before
 // calling this. Can return nil if the callback doesn't know about this group
@@ -181,10 +335,22 @@ func (l *Limiter) incrementGroups(groups []string) {
 func (l *Limiter) vivifyGroup(name string) *group {
 	group, exists := l.groups[name]
 	if !exists {
-		if limit := l.cb(name); limit >= 0 {
+		limit := l.cb(name)
+		var rate *Rate
+		if l.rcb != nil {
+			rate = l.rcb(name)
+		}
+		switch {
+		case limit >= 0:
 			group = newGroup(name, uint(limit))
-			l.groups[name] = group
+		case rate != nil:
+			group = newGroup(name, 0)
+			group.unlimited = true
+		default:
+			return nil
 		}
+		group.setRate(rate)
+		l.groups[name] = group
 	}
 	return group
 }
@@ -193,14 +359,16 @@ func (l *Limiter) vivifyGroup(name string) *group {
 // decrement() calls on them.
 func (l *Limiter) registerGroupNotifications(groups []string, ch chan bool) {
 	for _, name := range groups {
-		group := l.vivifyGroup(name)
+		group, _ := l.vivifyWeightedGroup(name)
 		if group != nil {
 			group.notifyDecrement(ch)
 		}
 	}
 }
 
-// Decrement decrements the count of every supplied group.
+// Decrement decrements the count of every supplied group, by the weight
+// suffixed to the group's name, if any. You should supply the same group names
+// you supplied to Increment().
 //
 // To save memory, if a group reaches a count of 0, it is forgotten.
 //
@@ -211,9 +379,10 @@ func (l *Limiter) Decrement(groups []string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	for _, name := range groups {
+	for _, spec := range groups {
+		name, weight := splitWeight(spec)
 		if group, exists := l.groups[name]; exists {
-			if group.decrement() {
+			if group.decrement(weight) {
 				delete(l.groups, group.name)
 			}
 		}
@@ -221,15 +390,16 @@ func (l *Limiter) Decrement(groups []string) {
 }
 
 // GetLowestLimit tells you the lowest limit currently set amongst the given
-// groups. If none have a limit set, returns -1.
+// groups. If none have a limit set, returns -1. (Rate limits are not
+// considered.)
 func (l *Limiter) GetLowestLimit(groups []string) int {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	lowest := -1
 	for _, name := range groups {
-		group := l.vivifyGroup(name)
-		if group != nil && (lowest == -1 || int(group.limit) < lowest) {
+		group, _ := l.vivifyWeightedGroup(name)
+		if group != nil && !group.unlimited && (lowest == -1 || int(group.limit) < lowest) {
 			lowest = int(group.limit)
 		}
 	}
@@ -237,17 +407,18 @@ func (l *Limiter) GetLowestLimit(groups []string) int {
 }
 
 // GetRemainingCapacity tells you how many times you could Increment() the given
-// groups. If none have a limit set, returns -1.
+// groups right now, taking in to account their weights, limits and rate limits.
+// If none have a limit set, returns -1.
 func (l *Limiter) GetRemainingCapacity(groups []string) int {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	lowest := -1
 	for _, name := range groups {
-		group := l.vivifyGroup(name)
+		group, weight := l.vivifyWeightedGroup(name)
 		if group != nil {
-			capacity := group.capacity()
-			if lowest == -1 || capacity < lowest {
+			capacity := group.capacity(weight)
+			if capacity >= 0 && (lowest == -1 || capacity < lowest) {
 				lowest = capacity
 			}
 		}
@@ -251,6 +251,115 @@ func TestLimiter(t *testing.T) {
 			So(atomic.LoadUint64(&fails), ShouldEqual, 75)
 		})
 
+		Convey("You can increment groups by a weight", func() {
+			name, weight, err := SplitWeight("l4*4")
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "l4")
+			So(weight, ShouldEqual, 4)
+			So(JoinWeight(name, weight), ShouldEqual, "l4*4")
+			name, weight, err = SplitWeight("l4")
+			So(err, ShouldBeNil)
+			So(name, ShouldEqual, "l4")
+			So(weight, ShouldEqual, 1)
+			So(JoinWeight(name, weight), ShouldEqual, "l4")
+			_, _, err = SplitWeight("l4*0")
+			So(err, ShouldNotBeNil)
+			_, _, err = SplitWeight("l4*x")
+			So(err, ShouldNotBeNil)
+
+			heavy := []string{"l1*2", "l4*40"}
+			So(l.GetRemainingCapacity(heavy), ShouldEqual, 1)
+			So(l.Increment(heavy), ShouldBeTrue)
+			So(l.GetUsage(), ShouldResemble, map[string]int{"l1": 2, "l4": 40})
+			So(l.GetRemainingCapacity(heavy), ShouldEqual, 0)
+			So(l.GetRemainingCapacity([]string{"l4*30"}), ShouldEqual, 2)
+			So(l.Increment(heavy), ShouldBeFalse)
+			So(l.Increment([]string{"l1"}), ShouldBeTrue)
+			So(l.Increment([]string{"l1"}), ShouldBeFalse)
+
+			l.Decrement([]string{"l1"})
+			So(l.Increment([]string{"l1*2"}), ShouldBeFalse)
+			l.Decrement(heavy)
+			So(l.GetUsage(), ShouldResemble, map[string]int{})
+			So(l.Increment([]string{"l1*3"}), ShouldBeTrue)
+			So(l.Increment([]string{"l1*4"}), ShouldBeFalse)
+			l.Decrement([]string{"l1*4"})
+			So(l.GetUsage(), ShouldResemble, map[string]int{})
+
+			start := time.Now()
+			go func() {
+				<-time.After(50 * time.Millisecond)
+				l.Decrement(heavy)
+			}()
+			So(l.Increment(heavy), ShouldBeTrue)
+			So(l.Increment(heavy, 200*time.Millisecond), ShouldBeTrue)
+			So(time.Since(start), ShouldBeGreaterThan, 40*time.Millisecond)
+		})
+
+		Convey("You can rate limit groups", func() {
+			rate, err := ParseRate("2/100ms")
+			So(err, ShouldBeNil)
+			So(rate, ShouldResemble, &Rate{Count: 2, Window: 100 * time.Millisecond})
+			So(rate.String(), ShouldEqual, "2/100ms")
+			rate, err = ParseRate("100/m")
+			So(err, ShouldBeNil)
+			So(rate.String(), ShouldEqual, "100/1m")
+			_, err = ParseRate("100")
+			So(err, ShouldNotBeNil)
+			_, err = ParseRate("x/1m")
+			So(err, ShouldNotBeNil)
+			_, err = ParseRate("1/0s")
+			So(err, ShouldNotBeNil)
+
+			rates := map[string]*Rate{"l2": {Count: 2, Window: 100 * time.Millisecond}, "r1": {Count: 3, Window: 100 * time.Millisecond}}
+			l.SetRateCallback(func(name string) *Rate {
+				return rates[name]
+			})
+
+			r1 := []string{"r1"}
+			So(l.GetLimit("r1"), ShouldEqual, -1)
+			So(l.GetRate("r1"), ShouldResemble, rates["r1"])
+			So(l.GetRemainingCapacity(r1), ShouldEqual, 3)
+			So(l.Increment(r1), ShouldBeTrue)
+			So(l.Increment(r1), ShouldBeTrue)
+			l.Decrement(r1)
+			l.Decrement(r1)
+			So(l.GetRemainingCapacity(r1), ShouldEqual, 1)
+			So(l.Increment(r1), ShouldBeTrue)
+			l.Decrement(r1)
+			So(l.Increment(r1), ShouldBeFalse)
+			So(l.GetRateWait(r1), ShouldBeGreaterThan, 0)
+			So(l.GetRates(), ShouldResemble, map[string]*Rate{"r1": rates["r1"]})
+
+			<-time.After(110 * time.Millisecond)
+			So(l.GetRateWait(r1), ShouldEqual, 0)
+			So(l.GetRemainingCapacity(r1), ShouldEqual, 3)
+
+			both := []string{"l1", "l2"}
+			So(l.GetRemainingCapacity(both), ShouldEqual, 2)
+			So(l.Increment(both), ShouldBeTrue)
+			So(l.Increment(both), ShouldBeTrue)
+			l.Decrement(both)
+			So(l.GetRemainingCapacity(both), ShouldEqual, 0)
+			start := time.Now()
+			So(l.Increment(both, 200*time.Millisecond), ShouldBeTrue)
+			So(time.Since(start), ShouldBeGreaterThan, 50*time.Millisecond)
+
+			l.SetRate("l2", nil)
+			So(l.GetRate("l2"), ShouldBeNil)
+			So(l.GetLimit("l2"), ShouldEqual, 2)
+			l.SetRate("new", &Rate{Count: 1, Window: time.Minute})
+			So(l.Increment([]string{"new"}), ShouldBeTrue)
+			So(l.Increment([]string{"new"}), ShouldBeFalse)
+			l.SetLimit("new", 5)
+			So(l.GetLimit("new"), ShouldEqual, 5)
+			l.ClearLimit("new")
+			So(l.GetLimit("new"), ShouldEqual, -1)
+			So(l.GetLimits()["new"], ShouldEqual, -1)
+			l.SetRate("new", nil)
+			So(l.GetRates(), ShouldNotContainKey, "new")
+		})
+
 		Convey("Concurrent Increment()s at the limit work with wait times", func() {
 			groups := []string{"l1", "l2"}
 			So(l.Increment(groups), ShouldBeTrue)
@@ -0,0 +1,92 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package limiter
+
+// This file contains the implementation of rate limits.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate describes a limit on how many times a group can be Increment()ed
+// within any period of Window, regardless of how many Decrement()s there have
+// been.
+type Rate struct {
+	Count  uint
+	Window time.Duration
+}
+
+// SetRateCallback can be provided to Limiter.SetRateCallback(). Your function
+// should take the name of a group and return its current Rate, or nil if it
+// has no rate limit. Like SetLimitCallback, the idea is that you retrieve the
+// rate from some on-disk database.
+type SetRateCallback func(name string) *Rate
+
+// ParseRate parses a string like "100/1m" in to a Rate of 100 per minute. The
+// part after the slash is a duration understood by time.ParseDuration(), or
+// just a unit, in which case it is taken to mean 1 of that unit (so "100/m" is
+// the same as "100/1m").
+func ParseRate(spec string) (*Rate, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 {
+		return nil, Error{Group: spec, Op: "ParseRate", Err: ErrBadRate}
+	}
+
+	count, err := strconv.ParseUint(parts[0], 10, 0)
+	if err != nil {
+		return nil, Error{Group: spec, Op: "ParseRate", Err: ErrBadRate}
+	}
+
+	window, err := time.ParseDuration(parts[1])
+	if err != nil {
+		window, err = time.ParseDuration("1" + parts[1])
+	}
+	if err != nil || window <= 0 {
+		return nil, Error{Group: spec, Op: "ParseRate", Err: ErrBadRate}
+	}
+
+	return &Rate{Count: uint(count), Window: window}, nil
+}
+
+// String returns the rate in the form accepted by ParseRate().
+func (r *Rate) String() string {
+	window := r.Window.String()
+	if strings.HasSuffix(window, "m0s") {
+		window = strings.TrimSuffix(window, "0s")
+	}
+	if strings.HasSuffix(window, "h0m") {
+		window = strings.TrimSuffix(window, "0m")
+	}
+	return strconv.FormatUint(uint64(r.Count), 10) + "/" + window
+}
+
+// startsWithin returns how many of the given start times are within the rate's
+// window of now, along with how long until the oldest of those leaves the
+// window. The given starts must be in time order.
+func (r *Rate) startsWithin(starts []time.Time, now time.Time) (int, time.Duration) {
+	cutoff := now.Add(-r.Window)
+	for i, start := range starts {
+		if start.After(cutoff) {
+			return len(starts) - i, start.Sub(cutoff)
+		}
+	}
+	return 0, 0
+}
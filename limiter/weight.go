@@ -0,0 +1,68 @@
+// Copyright © 2021 Genome Research Limited
+// Author: Sendu Bala <sb10@sanger.ac.uk>.
+//
+//  This file is part of wr.
+//
+//  wr is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU Lesser General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  wr is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU Lesser General Public License for more details.
+//
+//  You should have received a copy of the GNU Lesser General Public License
+//  along with wr. If not, see <http://www.gnu.org/licenses/>.
+
+package limiter
+
+// This file contains the implementation of weighted group names.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// WeightSeparator separates a group name from its weight in the group names you
+// supply to Increment() and similar methods, eg. "bigio*4" to consume 4 units
+// of the "bigio" group.
+const WeightSeparator = "*"
+
+// SplitWeight splits a group name that might be suffixed with WeightSeparator
+// and a weight, like "bigio*4", in to the name and weight. Names without a
+// weight have a weight of 1. Returns an error if the weight isn't a positive
+// integer.
+func SplitWeight(group string) (string, uint, error) {
+	i := strings.LastIndex(group, WeightSeparator)
+	if i == -1 {
+		return group, 1, nil
+	}
+
+	weight, err := strconv.ParseUint(group[i+1:], 10, 0)
+	if err != nil || weight == 0 {
+		return "", 0, Error{Group: group, Op: "SplitWeight", Err: ErrBadWeight}
+	}
+
+	return group[:i], uint(weight), nil
+}
+
+// JoinWeight is the opposite of SplitWeight(), returning a group name suffixed
+// with the given weight, or just the name if weight is 1.
+func JoinWeight(name string, weight uint) string {
+	if weight == 1 {
+		return name
+	}
+	return name + WeightSeparator + strconv.FormatUint(uint64(weight), 10)
+}
+
+// splitWeight is like SplitWeight(), but treats group names with bad weights
+// as names with a weight of 1.
+func splitWeight(group string) (string, uint) {
+	name, weight, err := SplitWeight(group)
+	if err != nil {
+		return group, 1
+	}
+	return name, weight
+}
@@ -63,10 +63,15 @@ type Item struct {
 	delay         time.Duration
 	ttr           time.Duration
 	readyAt       time.Time
+	readySince    time.Time
+	agingInterval time.Duration
+	startBy       time.Time
 	releaseAt     time.Time
 	creation      time.Time
 	dependencies  []string
 	remainingDeps map[string]bool
+	depRules      *DepRules
+	anyOfDeps     map[string]bool
 	mutex         sync.RWMutex
 	queueIndexes  [5]int
 	iid           uint64
@@ -76,7 +81,10 @@ type Item struct {
 // remaining in the current sub-queue. This will be a duration of zero for all
 // but the delay and run states. In the delay state it tells you how long before
 // it can be reserved, and in the run state it tells you how long before it will
-// be released automatically.
+// be released automatically. EffectivePriority is Priority raised by 1 for
+// every aging interval the item has spent in the ready state, if the queue it
+// is in has priority aging enabled; otherwise it is the same as Priority.
+// StartBy is the time the item should be reserved by, if one was set.
 type ItemStats struct {
 	State     ItemState
 	Age       time.Duration
@@ -90,6 +98,9 @@ type ItemStats struct {
 	Kicks     uint32
 	Priority  uint8
 	Size      uint8
+	// EffectivePriority can exceed 255 due to aging
+	EffectivePriority int
+	StartBy           time.Time
 }
 
 func newItem(key string, reserveGroup string, data interface{}, priority uint8, delay time.Duration, ttr time.Duration) *Item {
@@ -141,21 +152,35 @@ func (item *Item) Stats() *ItemStats {
 		remaining = time.Duration(0) * time.Second
 	}
 	return &ItemStats{
-		State:     item.state,
-		Reserves:  item.reserves,
-		Timeouts:  item.timeouts,
-		Releases:  item.releases,
-		Buries:    item.buries,
-		Kicks:     item.kicks,
-		Age:       age,
-		Remaining: remaining,
-		Priority:  item.priority,
-		Size:      item.size,
-		Delay:     item.delay,
-		TTR:       item.ttr,
+		State:             item.state,
+		Reserves:          item.reserves,
+		Timeouts:          item.timeouts,
+		Releases:          item.releases,
+		Buries:            item.buries,
+		Kicks:             item.kicks,
+		Age:               age,
+		Remaining:         remaining,
+		Priority:          item.priority,
+		EffectivePriority: item.effectivePriority(),
+		StartBy:           item.startBy,
+		Size:              item.size,
+		Delay:             item.delay,
+		TTR:               item.ttr,
 	}
 }
 
+// effectivePriority returns our priority plus the number of aging intervals
+// we've been ready for. You must hold at least the read lock before calling
+// this.
+func (item *Item) effectivePriority() int {
+	priority := int(item.priority)
+	if item.state != ItemStateReady || item.agingInterval <= 0 || item.readySince.IsZero() {
+		return priority
+	}
+	interval := int64(item.agingInterval)
+	return priority + int(time.Now().UnixNano()/interval-item.readySince.UnixNano()/interval)
+}
+
 // State is a thread-safe way of getting just the state of an item, when you
 // don't need all of the other information from Stats().
 func (item *Item) State() ItemState {
@@ -224,6 +249,10 @@ func (item *Item) ChangedKey(old, new string) {
 		delete(item.remainingDeps, old)
 		item.remainingDeps[new] = true
 	}
+
+	if item.depRules != nil {
+		item.setDepRules(item.depRules.changedKey(old, new))
+	}
 }
 
 // setDependencies sets the keys of the other items we are dependent upon. This
@@ -239,20 +268,109 @@ func (item *Item) setDependencies(deps []string) {
 	}
 }
 
+// setDepRules sets the rules that refine how our dependencies get resolved.
+// You must hold the item's lock before calling this.
+func (item *Item) setDepRules(rules *DepRules) {
+	item.depRules = rules
+	item.anyOfDeps = nil
+	if rules == nil {
+		return
+	}
+	for _, set := range rules.AnyOf {
+		for _, group := range set {
+			for _, key := range group {
+				if item.anyOfDeps == nil {
+					item.anyOfDeps = make(map[string]bool)
+				}
+				item.anyOfDeps[key] = true
+			}
+		}
+	}
+}
+
+// depCondition returns the DepCondition of our dependency on the item with the
+// given key. You must hold the item's lock before calling this.
+func (item *Item) depCondition(key string) DepCondition {
+	if item.depRules == nil {
+		return DepRemoved
+	}
+	return item.depRules.Conditions[key]
+}
+
+// depsResolved tells you if enough of our dependencies have been resolved for
+// us to no longer be dependent: all of them, unless we have DepRules with
+// AnyOf sets, in which case just those not in any set, and all of one group in
+// each set. You must hold the item's lock before calling this.
+func (item *Item) depsResolved() bool {
+	if len(item.anyOfDeps) == 0 {
+		return len(item.remainingDeps) == 0
+	}
+
+	for key := range item.remainingDeps {
+		if !item.anyOfDeps[key] {
+			return false
+		}
+	}
+
+	for _, set := range item.depRules.AnyOf {
+		satisfied := false
+		for _, group := range set {
+			satisfied = true
+			for _, key := range group {
+				if item.remainingDeps[key] {
+					satisfied = false
+					break
+				}
+			}
+			if satisfied {
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
+
 // resolveDependency takes the key of an item this item depends on, and marks
-// that as a resolved dependency. Returns false if this item is not currently in
-// the dependency sub queue. Otherwise, if all of this item's dependencies have
-// now been resolved in this way, returns true.
-func (item *Item) resolveDependency(key string) bool {
+// that as a resolved dependency if that item just underwent the given event
+// (DepRemoved or DepBuried) and our DepCondition for it allows it. Returns
+// false if this item is not currently in the dependency sub queue. Otherwise,
+// if enough of this item's dependencies have now been resolved in this way
+// (see depsResolved()), returns true.
+func (item *Item) resolveDependency(key string, event DepCondition) bool {
 	item.mutex.Lock()
 	defer item.mutex.Unlock()
+	if !item.depCondition(key).metBy(event) {
+		return false
+	}
 	delete(item.remainingDeps, key)
 	if item.state == ItemStateDependent {
-		return len(item.remainingDeps) == 0
+		return item.depsResolved()
 	}
 	return false
 }
 
+// unresolveDependency takes the key of an item this item depends on, which
+// has just stopped being in the state of the given event (eg. it was kicked
+// after being buried), and if we're still in the dependency sub queue and could
+// have resolved that dependency because of that event, marks it as unresolved
+// again.
+func (item *Item) unresolveDependency(key string, event DepCondition) {
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	if item.state != ItemStateDependent || !item.depCondition(key).metBy(event) {
+		return
+	}
+	for _, dep := range item.dependencies {
+		if dep == key {
+			item.remainingDeps[key] = true
+			return
+		}
+	}
+}
+
 // restart is a thread-safe way to reset the readyAt time, for when the item
 // is put back in to the delay queue
 func (item *Item) restart() {
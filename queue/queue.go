@@ -34,8 +34,20 @@ priority (or for those with equal priority, the oldest - fifo) one which
 switches it from the ready queue to the run queue. Items can also have
 dependencies, in which case they start in the dependency queue and only move to
 the ready queue (bypassing the delay queue) once all its dependencies have been
-Remove()d from the queue. Items can also belong to a reservation group, in which
-case you can Reserve() an item in a desired group.
+Remove()d from the queue. DepRules let you instead have particular dependencies
+resolve when their item is Bury()d (or either Remove()d or Bury()d), and let you
+say that only one of a number of groups of dependencies need be resolved. Items
+can also belong to a reservation group, in which case you can Reserve() an item
+in a desired group.
+
+So that a steady stream of high priority items can't stop low priority items
+from ever being reserved, you can SetPriorityAging(), whereupon the priority of
+items goes up the longer they wait in the ready queue.
+
+Items can also be given a time they should start by (eg. their deadline minus
+how long they take), with AddMany() or SetStartBy(). Ready items with a start by
+time are reserved before those without, earliest start by time first, and only
+then by priority.
 
 In the run queue the item starts a time-to-release (ttr) countdown; when that
 runs out the item is placed back on the ready queue. This is to handle a
@@ -209,6 +221,66 @@ type ItemDef struct {
 	TTR          time.Duration
 	StartQueue   SubQueue // blank, or one of SubQueueRun or SubQueueBury
 	Dependencies []string
+	StartBy      time.Time // zero, or when the item should be reserved by
+	DepRules     *DepRules // nil, or how Dependencies should be resolved
+}
+
+// DepCondition describes what must happen to an item for a dependency upon it
+// to be resolved.
+type DepCondition string
+
+// DepCondition* constants are the possible conditions of a dependency. The
+// default, DepRemoved, is used for dependencies without a condition.
+const (
+	DepRemoved DepCondition = ""       // the item must be Remove()d
+	DepBuried  DepCondition = "buried" // the item must be Bury()d
+	DepEnded   DepCondition = "ended"  // the item must be Remove()d or Bury()d
+)
+
+// metBy tells you if this condition is met by an item undergoing the given
+// event, which should be DepRemoved or DepBuried.
+func (c DepCondition) metBy(event DepCondition) bool {
+	return c == event || c == DepEnded
+}
+
+// DepRules refine how the dependencies of an item get resolved. Conditions
+// gives the DepCondition of particular dependency keys; those not mentioned
+// are DepRemoved. AnyOf holds sets of alternative groups of dependency keys: a
+// set is satisfied once all of the dependencies in any one of its groups are
+// resolved. An item with DepRules stops being dependent once all of its AnyOf
+// sets are satisfied and all its dependencies that aren't in any set are
+// resolved. The keys used in DepRules must also be supplied as the item's
+// dependencies.
+type DepRules struct {
+	Conditions map[string]DepCondition
+	AnyOf      [][][]string
+}
+
+// changedKey returns a copy of these rules with the old key switched to new.
+func (r *DepRules) changedKey(old, new string) *DepRules {
+	rules := &DepRules{AnyOf: make([][][]string, len(r.AnyOf))}
+	if len(r.Conditions) > 0 {
+		rules.Conditions = make(map[string]DepCondition, len(r.Conditions))
+		for key, c := range r.Conditions {
+			if key == old {
+				key = new
+			}
+			rules.Conditions[key] = c
+		}
+	}
+	for i, set := range r.AnyOf {
+		rules.AnyOf[i] = make([][]string, len(set))
+		for j, group := range set {
+			rules.AnyOf[i][j] = make([]string, len(group))
+			for k, key := range group {
+				if key == old {
+					key = new
+				}
+				rules.AnyOf[i][j][k] = key
+			}
+		}
+	}
+	return rules
 }
 
 // New is a helper to create instance of the Queue struct.
@@ -247,6 +319,20 @@ func New(name string, logger ...log15.Logger) *Queue {
 	return queue
 }
 
+// SetPriorityAging turns on priority aging for the ready sub-queue, so that
+// low priority items don't wait forever while higher priority ones keep being
+// added. Every interval an item spends in the ready sub-queue raises its
+// effective priority by 1 (beyond the 255 maximum of priorities you can set),
+// and items are reserved in order of effective priority. Eg. with an interval
+// of 1 minute, a priority 0 item that has been ready for 101 minutes will be
+// reserved before a priority 100 item that just became ready.
+//
+// An interval of 0 (the default) turns aging off, so that items are reserved
+// strictly in priority order. See ItemStats.EffectivePriority.
+func (queue *Queue) SetPriorityAging(interval time.Duration) {
+	queue.readyQueue.setAgingInterval(interval)
+}
+
 // SetReadyAddedCallback sets a callback that will be called when new items have
 // been added to the ready sub-queue. The callback will receive the name of the
 // queue, and a slice of the Data properties of every item currently in the
@@ -449,8 +535,7 @@ func (queue *Queue) newItemForAdd(key string, reserveGroup string, data interfac
 // subqueue. You must hold the mutex lock before calling this. It will unlock.
 func (queue *Queue) handleItemForAdd(item *Item, startQueue SubQueue, delay time.Duration, deps ...[]string) {
 	// check dependencies
-	if len(deps) == 1 && len(deps[0]) > 0 {
-		queue.setItemDependencies(item, deps[0])
+	if len(deps) == 1 && len(deps[0]) > 0 && queue.setItemDependencies(item, deps[0], nil) {
 		queue.mutex.Unlock()
 		queue.changed(SubQueueNew, SubQueueDependent, []*Item{item})
 		return
@@ -503,16 +588,82 @@ func (queue *Queue) AddWithSize(key string, reserveGroup string, data interface{
 	return item, nil
 }
 
-// setItemDependencies sets the given item keys as the dependencies of the given
-// item, and places the item in the dependency queue. Note that you can be
-// dependent on items that do not exist in the queue; the item will remain in
-// dependent queue until you add items with the given deps keys and then
-// Remove() them.
-func (queue *Queue) setItemDependencies(item *Item, deps []string) {
+// setItemDependencies sets the given item keys (and optional rules) as the
+// dependencies of the given item, and places the item in the dependency queue,
+// returning true. Note that you can be dependent on items that do not exist in
+// the queue; the item will remain in dependent queue until you add items with
+// the given deps keys and then Remove() them. If the rules mean the
+// dependencies are already resolved (because the relevant items are currently
+// buried), the item is not placed in the dependency queue and this returns
+// false.
+func (queue *Queue) setItemDependencies(item *Item, deps []string, rules *DepRules) bool {
 	item.setDependencies(deps)
+	item.mutex.Lock()
+	item.setDepRules(rules)
+	item.mutex.Unlock()
 	queue.setQueueDeps(item)
+	if queue.resolveBuriedDeps(item) {
+		return false
+	}
 	item.switchDelayDependent()
 	queue.depQueue.push(item)
+	return true
+}
+
+// resolveBuriedDeps marks as resolved those of the given item's dependencies
+// on currently buried items that have a condition met by being buried.
+// Returns true if the item's dependencies are now resolved. You must hold the
+// queue's lock before calling this.
+func (queue *Queue) resolveBuriedDeps(item *Item) bool {
+	item.mutex.RLock()
+	var candidates []string
+	if item.depRules != nil {
+		for _, dep := range item.dependencies {
+			if item.depCondition(dep).metBy(DepBuried) {
+				candidates = append(candidates, dep)
+			}
+		}
+	}
+	item.mutex.RUnlock()
+
+	var buried []string
+	for _, dep := range candidates {
+		if parent, exists := queue.items[dep]; exists && parent != item {
+			parent.mutex.RLock()
+			if parent.state == ItemStateBury {
+				buried = append(buried, dep)
+			}
+			parent.mutex.RUnlock()
+		}
+	}
+
+	item.mutex.Lock()
+	defer item.mutex.Unlock()
+	for _, dep := range buried {
+		delete(item.remainingDeps, dep)
+	}
+	return item.depsResolved()
+}
+
+// resolveDependants resolves the dependencies of the items that depend on the
+// item with the given key, which just underwent the given event (DepRemoved
+// or DepBuried). Those items that no longer have unresolved dependencies are
+// moved to the ready queue and returned. You must hold the queue's lock before
+// calling this.
+func (queue *Queue) resolveDependants(key string, event DepCondition) []*Item {
+	var readyItems []*Item
+	for _, dep := range queue.dependants[key] {
+		done := dep.resolveDependency(key, event)
+		if done && dep.state == ItemStateDependent {
+			queue.depQueue.remove(dep)
+
+			// put it straight on the ready queue, regardless of delay value
+			dep.switchDependentReady()
+			queue.readyQueue.push(dep)
+			readyItems = append(readyItems, dep)
+		}
+	}
+	return readyItems
 }
 
 // setQueueDeps updates the queue's lookup of parent items to their dependent
@@ -528,14 +679,22 @@ func (queue *Queue) setQueueDeps(item *Item) {
 }
 
 // itemHasDeps returns true if the item has unresolved dependencies according
-// to the queue's lookup of parent items to their dependent children.
+// to the queue's lookup of parent items to their dependent children (taking
+// in to account any DepRules of the item).
 func (queue *Queue) itemHasDeps(item *Item) bool {
-	for _, dep := range item.Dependencies() {
-		if _, exists := queue.items[dep]; exists {
-			return true
+	item.mutex.RLock()
+	rules := item.depRules
+	item.mutex.RUnlock()
+	if rules == nil {
+		for _, dep := range item.Dependencies() {
+			if _, exists := queue.items[dep]; exists {
+				return true
+			}
 		}
+		return false
 	}
-	return false
+
+	return !queue.resolveBuriedDeps(item)
 }
 
 // AddMany is like Add(), except that you supply a slice of *ItemDef, and it
@@ -557,6 +716,7 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 	var addedDepItems []*Item
 	var addedRunItems []*Item
 	var addedBuryItems []*Item
+	var resolvedItems []*Item
 	for _, def := range items {
 		_, existed := queue.items[def.Key]
 		if existed {
@@ -565,10 +725,10 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 		}
 
 		item := newItem(def.Key, def.ReserveGroup, def.Data, def.Priority, def.Delay, def.TTR)
+		item.startBy = def.StartBy
 		queue.items[def.Key] = item
 
-		if len(def.Dependencies) > 0 {
-			queue.setItemDependencies(item, def.Dependencies)
+		if len(def.Dependencies) > 0 && queue.setItemDependencies(item, def.Dependencies, def.DepRules) {
 			addedDepItems = append(addedDepItems, item)
 		} else {
 			switch def.StartQueue {
@@ -588,6 +748,7 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 				item.switchReadyRun()
 				item.switchRunBury()
 				addedBuryItems = append(addedBuryItems, item)
+				resolvedItems = append(resolvedItems, queue.resolveDependants(def.Key, DepBuried)...)
 			default:
 				if def.Delay.Nanoseconds() == 0 {
 					// put it directly on the ready queue
@@ -625,6 +786,10 @@ func (queue *Queue) AddMany(items []*ItemDef) (added, dups int, err error) {
 	if len(addedBuryItems) > 0 {
 		queue.changed(SubQueueNew, SubQueueBury, addedBuryItems)
 	}
+	if len(resolvedItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, resolvedItems)
+		queue.readyAdded("dependent")
+	}
 
 	return added, dups, err
 }
@@ -711,6 +876,11 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 			toRemove = append(toRemove, dep)
 		}
 
+		item.mutex.RLock()
+		iState := item.state
+		hasRules := item.depRules != nil
+		item.mutex.RUnlock()
+
 		if len(toRemove) > 0 || newDeps > 0 {
 			// remove any invalid dependencies from our lookup
 			for _, dep := range toRemove {
@@ -725,13 +895,11 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 			// set the new dependencies and update our lookup
 			item.setDependencies(deps[0])
 			queue.setQueueDeps(item)
+			resolved := queue.resolveBuriedDeps(item)
 
 			// if we now have unresolved dependencies and we're not in dependent
 			// state, switch to dependent queue
-			item.mutex.RLock()
-			iState := item.state
-			item.mutex.RUnlock()
-			if len(deps[0]) > 0 && iState != ItemStateDependent {
+			if !resolved && iState != ItemStateDependent {
 				pushToDep := true
 				switch iState {
 				case ItemStateDelay:
@@ -754,13 +922,19 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 				if pushToDep {
 					queue.depQueue.push(item)
 				}
-			} else if len(deps[0]) == 0 {
+			} else if resolved && iState == ItemStateDependent {
 				// switch to ready queue
 				queue.depQueue.remove(item)
 				item.switchDependentReady()
 				queue.readyQueue.push(item)
 				addedReady = true
 			}
+		} else if hasRules && iState == ItemStateDependent && queue.resolveBuriedDeps(item) {
+			// our rules may have changed such that we're now resolved
+			queue.depQueue.remove(item)
+			item.switchDependentReady()
+			queue.readyQueue.push(item)
+			addedReady = true
 		}
 	}
 
@@ -813,6 +987,29 @@ func (queue *Queue) Update(key string, reserveGroup string, data interface{}, pr
 	return nil
 }
 
+// SetDepRules is a thread-safe way to change the DepRules of an item (set nil
+// to have all its dependencies resolve normally). The rules take effect when
+// you next Update() the item with its dependencies, so call this first. The
+// keys in the rules must be amongst the dependencies you supply to Update().
+func (queue *Queue) SetDepRules(key string, rules *DepRules) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return Error{queue.Name, "SetDepRules", key, ErrQueueClosed}
+	}
+
+	item, exists := queue.items[key]
+	if !exists {
+		return Error{queue.Name, "SetDepRules", key, ErrNotFound}
+	}
+
+	item.mutex.Lock()
+	item.setDepRules(rules)
+	item.mutex.Unlock()
+	return nil
+}
+
 // ChangeKey is a thread-safe way to change the key an item can be found with
 // using Get() (and also ensures any dependencies involving the old key will
 // continue to work). If an item already exists in the queue with the new key,
@@ -887,6 +1084,36 @@ func (queue *Queue) SetDelay(key string, delay time.Duration) error {
 	return nil
 }
 
+// SetStartBy is a thread-safe way to change the time an item should be
+// reserved by. Ready items with a start by time are reserved before those
+// without, earliest first. Supply the zero time to make the item be reserved in
+// the normal priority order.
+func (queue *Queue) SetStartBy(key string, startBy time.Time) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return Error{queue.Name, "SetStartBy", key, ErrQueueClosed}
+	}
+
+	item, exists := queue.items[key]
+	if !exists {
+		return Error{queue.Name, "SetStartBy", key, ErrNotFound}
+	}
+
+	item.mutex.Lock()
+	if item.startBy.Equal(startBy) {
+		item.mutex.Unlock()
+		return nil
+	}
+	item.startBy = startBy
+	ready := item.state == ItemStateReady
+	item.mutex.Unlock()
+	if ready {
+		queue.readyQueue.update(item)
+	}
+	return nil
+}
+
 // SetReserveGroup is a thread-safe way to change the ReserveGroup of an item.
 func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 	queue.mutex.Lock()
@@ -940,11 +1167,37 @@ func (queue *Queue) SetReserveGroup(key string, newGroup string) error {
 // able to later, you can manually call Release(), which moves it to the delay
 // sub-queue.
 func (queue *Queue) Reserve(reserveGroup string, wait time.Duration) (*Item, error) {
+	items, err := queue.reserve("Reserve", reserveGroup, 1, wait)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// ReserveMany is like Reserve(), but lets you reserve up to n items at once,
+// for when you'll deal with many quick items one after the other and want to
+// avoid the overhead of reserving each individually. It waits (for up to
+// wait) only for the first item; you get back that and as many of the
+// following items as were ready at the time, in the order Reserve() would have
+// given them to you.
+//
+// Each item has its own ttr countdown, so you'll need to Touch() the items
+// you're not yet dealing with, as well as the one you are.
+func (queue *Queue) ReserveMany(reserveGroup string, n int, wait time.Duration) ([]*Item, error) {
+	if n < 1 {
+		n = 1
+	}
+	return queue.reserve("ReserveMany", reserveGroup, n, wait)
+}
+
+// reserve implements Reserve() and ReserveMany(), with op being the name of the
+// method to use in errors.
+func (queue *Queue) reserve(op string, reserveGroup string, n int, wait time.Duration) ([]*Item, error) {
 	queue.mutex.Lock()
 
 	if queue.closed {
 		queue.mutex.Unlock()
-		return nil, Error{queue.Name, "Reserve", "", ErrQueueClosed}
+		return nil, Error{queue.Name, op, "", ErrQueueClosed}
 	}
 
 	// pop an item from the ready queue and add it to the run queue
@@ -970,19 +1223,32 @@ func (queue *Queue) Reserve(reserveGroup string, wait time.Duration) (*Item, err
 		}
 
 		if item == nil {
-			return item, Error{queue.Name, "Reserve", "", ErrNothingReady}
+			return nil, Error{queue.Name, op, "", ErrNothingReady}
 		}
 	}
 
-	item.touch()
-	queue.runQueue.push(item)
-	item.switchReadyRun()
+	items := []*Item{item}
+	for len(items) < n {
+		item = queue.readyQueue.pop(reserveGroup)
+		if item == nil {
+			break
+		}
+		items = append(items, item)
+	}
+
+	for _, item := range items {
+		item.touch()
+		queue.runQueue.push(item)
+		item.switchReadyRun()
+	}
 
 	queue.mutex.Unlock()
-	queue.ttrNotificationTrigger(item)
-	queue.changed(SubQueueReady, SubQueueRun, []*Item{item})
+	for _, item := range items {
+		queue.ttrNotificationTrigger(item)
+	}
+	queue.changed(SubQueueReady, SubQueueRun, items)
 
-	return item, nil
+	return items, nil
 }
 
 // Touch is a thread-safe way to extend the amount of time a Reserve()d item
@@ -1090,8 +1356,15 @@ func (queue *Queue) Bury(key string) error {
 	queue.runQueue.remove(item)
 	queue.buryQueue.push(item)
 	item.switchRunBury()
+
+	// transfer any dependants waiting on us being buried to the ready queue
+	addedReadyItems := queue.resolveDependants(key, DepBuried)
 	queue.mutex.Unlock()
 	queue.changed(SubQueueRun, SubQueueBury, []*Item{item})
+	if len(addedReadyItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+		queue.readyAdded("dependent")
+	}
 
 	return nil
 }
@@ -1119,6 +1392,12 @@ func (queue *Queue) Kick(key string) error {
 		return Error{queue.Name, "Kick", key, ErrNotBuried}
 	}
 
+	// any dependants still waiting on other things can no longer count us
+	// being buried
+	for _, dep := range queue.dependants[key] {
+		dep.unresolveDependency(key, DepBuried)
+	}
+
 	// switch from bury to ready or dependent queue
 	queue.buryQueue.remove(item)
 	if queue.itemHasDeps(item) {
@@ -1152,22 +1431,19 @@ func (queue *Queue) Remove(key string) error {
 		return Error{queue.Name, "Remove", key, ErrNotFound}
 	}
 
-	// transfer any dependants to the ready queue
-	addedReady := false
-	var addedReadyItems []*Item
-	if deps, exists := queue.dependants[key]; exists {
-		for _, dep := range deps {
-			done := dep.resolveDependency(key)
-			if done && dep.state == ItemStateDependent {
-				queue.depQueue.remove(dep)
-
-				// put it straight on the ready queue, regardless of delay value
-				dep.switchDependentReady()
-				queue.readyQueue.push(dep)
-				addedReadyItems = append(addedReadyItems, dep)
-				addedReady = true
-			}
+	// transfer any dependants to the ready queue. Those waiting on us to be
+	// buried stay in our lookup, in case we're added and buried again
+	addedReadyItems := queue.resolveDependants(key, DepRemoved)
+	addedReady := len(addedReadyItems) > 0
+	for depKey, dep := range queue.dependants[key] {
+		dep.mutex.RLock()
+		waiting := dep.depCondition(key) == DepBuried
+		dep.mutex.RUnlock()
+		if !waiting {
+			delete(queue.dependants[key], depKey)
 		}
+	}
+	if len(queue.dependants[key]) == 0 {
 		delete(queue.dependants, key)
 	}
 
@@ -1214,10 +1490,51 @@ func (queue *Queue) Remove(key string) error {
 	return nil
 }
 
+// ResolveDependency resolves the dependencies that items have on the given key
+// as if an item with that key had just undergone the given event (DepRemoved,
+// as if Remove()d, or DepBuried, as if Bury()d). This is for when items depend
+// on things outside of the queue, which you keep track of yourself: you can
+// give items dependencies on keys that will never be used for items, then call
+// this when the thing they represent happens. Items with no remaining
+// unresolved dependencies move to the ready sub-queue. It is harmless to call
+// this repeatedly.
+func (queue *Queue) ResolveDependency(key string, event DepCondition) error {
+	queue.mutex.Lock()
+	if queue.closed {
+		queue.mutex.Unlock()
+		return Error{queue.Name, "ResolveDependency", key, ErrQueueClosed}
+	}
+
+	addedReadyItems := queue.resolveDependants(key, event)
+	queue.mutex.Unlock()
+	if len(addedReadyItems) > 0 {
+		queue.changed(SubQueueDependent, SubQueueReady, addedReadyItems)
+		queue.readyAdded("dependent")
+	}
+	return nil
+}
+
+// UnresolveDependency undoes ResolveDependency() for those items still in the
+// dependent sub-queue, for when the thing outside of the queue that the key
+// represents is no longer in the state of the given event.
+func (queue *Queue) UnresolveDependency(key string, event DepCondition) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if queue.closed {
+		return Error{queue.Name, "UnresolveDependency", key, ErrQueueClosed}
+	}
+
+	for _, dep := range queue.dependants[key] {
+		dep.unresolveDependency(key, event)
+	}
+	return nil
+}
+
 // HasDependents tells you if the item with the given key has any other items
 // depending upon it. You'd want to check this before Remove()ing this item if
 // you're removing it because it was undesired as opposed to complete, as
-// Remove() always triggers dependent items to become ready.
+// Remove() triggers dependent items to become ready (unless they depend on
+// this item being buried).
 func (queue *Queue) HasDependents(key string) (bool, error) {
 	queue.mutex.Lock()
 	defer queue.mutex.Unlock()
@@ -957,6 +957,156 @@ func TestQueue(t *testing.T) {
 		So(item.Key, ShouldEqual, "key_large")
 	})
 
+	Convey("You can turn on priority aging so that low priority items are not starved", t, func() {
+		queue := New("aging queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+		interval := 20 * time.Millisecond
+		queue.SetPriorityAging(interval)
+
+		old, err := queue.Add("key_old", "", "data", 0, 0*time.Millisecond, 1*time.Second, "")
+		So(err, ShouldBeNil)
+		So(old.Stats().EffectivePriority, ShouldEqual, 0)
+		<-time.After(5 * interval)
+		So(old.Stats().EffectivePriority, ShouldBeGreaterThanOrEqualTo, 4)
+
+		newItem, err := queue.Add("key_new", "", "data", 3, 0*time.Millisecond, 1*time.Second, "")
+		So(err, ShouldBeNil)
+		So(newItem.Stats().EffectivePriority, ShouldEqual, 3)
+		So(newItem.Stats().Priority, ShouldEqual, 3)
+
+		item, err := queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item, ShouldNotBeNil)
+		So(item.Key, ShouldEqual, "key_old")
+		So(item.Stats().EffectivePriority, ShouldEqual, 0)
+
+		Convey("Turning it off reverts to strict priority order", func() {
+			err = queue.Release("key_old")
+			So(err, ShouldBeNil)
+			So(queue.SetDelay("key_old", 0), ShouldBeNil)
+			<-time.After(5 * interval)
+			queue.SetPriorityAging(0)
+			So(old.Stats().EffectivePriority, ShouldEqual, 0)
+
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			So(item, ShouldNotBeNil)
+			So(item.Key, ShouldEqual, "key_new")
+		})
+	})
+
+	Convey("Items with a start by time are reserved before others, earliest first", t, func() {
+		queue := New("startby queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+
+		now := time.Now()
+		added, dups, err := queue.AddMany([]*ItemDef{
+			{Key: "key_high", Data: "data", Priority: 255, TTR: 1 * time.Second},
+			{Key: "key_late", Data: "data", TTR: 1 * time.Second, StartBy: now.Add(2 * time.Hour)},
+			{Key: "key_soon", Data: "data", TTR: 1 * time.Second, StartBy: now.Add(1 * time.Hour)},
+			{Key: "key_low", Data: "data", TTR: 1 * time.Second},
+		})
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 4)
+		So(dups, ShouldEqual, 0)
+
+		item, err := queue.Get("key_soon")
+		So(err, ShouldBeNil)
+		So(item.Stats().StartBy, ShouldEqual, now.Add(1*time.Hour))
+
+		err = queue.SetStartBy("key_low", now.Add(90*time.Minute))
+		So(err, ShouldBeNil)
+		err = queue.SetStartBy("key_late", time.Time{})
+		So(err, ShouldBeNil)
+		err = queue.SetStartBy("key_missing", now)
+		So(err, ShouldNotBeNil)
+
+		var order []string
+		for i := 0; i < 4; i++ {
+			item, err = queue.Reserve("", 0)
+			So(err, ShouldBeNil)
+			order = append(order, item.Key)
+		}
+		So(order, ShouldResemble, []string{"key_soon", "key_low", "key_high", "key_late"})
+	})
+
+	Convey("You can reserve many items at once", t, func() {
+		queue := New("many queue")
+		defer func() {
+			errd := queue.Destroy()
+			So(errd, ShouldBeNil)
+		}()
+
+		items, err := queue.ReserveMany("", 3, 0)
+		So(err, ShouldNotBeNil)
+		So(items, ShouldBeNil)
+		qerr, ok := err.(Error)
+		So(ok, ShouldBeTrue)
+		So(qerr.Err, ShouldEqual, ErrNothingReady)
+		So(qerr.Op, ShouldEqual, "ReserveMany")
+
+		for i := 0; i < 5; i++ {
+			_, err = queue.Add(fmt.Sprintf("key_%d", i), "", "data", uint8(i), 0*time.Millisecond, 100*time.Millisecond, "")
+			So(err, ShouldBeNil)
+		}
+		_, err = queue.Add("key_other", "other", "data", 0, 0*time.Millisecond, 100*time.Millisecond, "")
+		So(err, ShouldBeNil)
+
+		items, err = queue.ReserveMany("", 3, 0)
+		So(err, ShouldBeNil)
+		So(len(items), ShouldEqual, 3)
+		So(items[0].Key, ShouldEqual, "key_4")
+		So(items[1].Key, ShouldEqual, "key_3")
+		So(items[2].Key, ShouldEqual, "key_2")
+		for _, item := range items {
+			So(item.Stats().State, ShouldEqual, ItemStateRun)
+			So(item.Stats().Reserves, ShouldEqual, 1)
+		}
+
+		items, err = queue.ReserveMany("", 3, 0)
+		So(err, ShouldBeNil)
+		So(len(items), ShouldEqual, 2)
+
+		stats := queue.Stats()
+		So(stats.Ready, ShouldEqual, 1)
+		So(stats.Running, ShouldEqual, 5)
+
+		Convey("Each has its own ttr", func() {
+			<-time.After(60 * time.Millisecond)
+			So(queue.Touch("key_4"), ShouldBeNil)
+			<-time.After(60 * time.Millisecond)
+			So(queue.Stats().Running, ShouldEqual, 1)
+			item, errg := queue.Get("key_4")
+			So(errg, ShouldBeNil)
+			So(item.Stats().State, ShouldEqual, ItemStateRun)
+		})
+
+		Convey("Waiting only happens for the first item", func() {
+			go func() {
+				<-time.After(20 * time.Millisecond)
+				_, erra := queue.Add("key_late", "other", "data", 0, 0*time.Millisecond, 100*time.Millisecond, "")
+				if erra != nil {
+					fmt.Printf("Add failed: %s\n", erra)
+				}
+			}()
+			items, err = queue.ReserveMany("other", 3, 50*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 1)
+			So(items[0].Key, ShouldEqual, "key_other")
+
+			items, err = queue.ReserveMany("other", 3, 50*time.Millisecond)
+			So(err, ShouldBeNil)
+			So(len(items), ShouldEqual, 1)
+			So(items[0].Key, ShouldEqual, "key_late")
+		})
+	})
+
 	Convey("Once a thousand items with no delay have been added to the queue", t, func() {
 		queue := New("1000 queue")
 		defer qdestroy(queue)
@@ -1491,12 +1641,42 @@ func TestQueue(t *testing.T) {
 			Data: "2",
 			TTR:  30 * time.Second,
 		})
-		itemdefs = append(itemdefs, &ItemDef{"key_3", "", "3", 0, 0 * time.Second, 30 * time.Second, "", []string{}})
-		itemdefs = append(itemdefs, &ItemDef{"key_4", "", "4", 0, 0 * time.Second, 30 * time.Second, "", []string{"key_1"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_5", "", "5", 0, 0 * time.Second, 30 * time.Second, "", []string{"key_2", "key_3"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_6", "", "6", 0, 0 * time.Second, 30 * time.Second, "", []string{"key_3", "key_4"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_7", "", "7", 0, 0 * time.Second, 30 * time.Second, "", []string{"key_5", "key_6"}})
-		itemdefs = append(itemdefs, &ItemDef{"key_8", "", "8", 0, 0 * time.Second, 30 * time.Second, "", []string{"key_5"}})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_3",
+			Data:         "3",
+			TTR:          30 * time.Second,
+			Dependencies: []string{},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_4",
+			Data:         "4",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_1"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_5",
+			Data:         "5",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_2", "key_3"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_6",
+			Data:         "6",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_3", "key_4"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_7",
+			Data:         "7",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_5", "key_6"},
+		})
+		itemdefs = append(itemdefs, &ItemDef{
+			Key:          "key_8",
+			Data:         "8",
+			TTR:          30 * time.Second,
+			Dependencies: []string{"key_5"},
+		})
 
 		added, dups, err := queue.AddMany(itemdefs)
 		So(err, ShouldBeNil)
@@ -1512,6 +1692,193 @@ func TestQueue(t *testing.T) {
 		})
 	})
 
+	Convey("Items with DepRules resolve their dependencies according to them", t, func() {
+		queue := New("dep rules queue")
+		defer qdestroy(queue)
+
+		itemdefs := []*ItemDef{
+			{Key: "up_1", Data: "u1", TTR: 30 * time.Second},
+			{Key: "up_2", Data: "u2", TTR: 30 * time.Second},
+			{Key: "up_3", Data: "u3", TTR: 30 * time.Second},
+			{
+				Key:          "onbury",
+				Data:         "b",
+				TTR:          30 * time.Second,
+				Dependencies: []string{"up_1"},
+				DepRules:     &DepRules{Conditions: map[string]DepCondition{"up_1": DepBuried}},
+			},
+			{
+				Key:          "onend",
+				Data:         "e",
+				TTR:          30 * time.Second,
+				Dependencies: []string{"up_1", "up_2"},
+				DepRules:     &DepRules{Conditions: map[string]DepCondition{"up_1": DepEnded, "up_2": DepEnded}},
+			},
+			{
+				Key:          "anyof",
+				Data:         "a",
+				TTR:          30 * time.Second,
+				Dependencies: []string{"up_1", "up_2", "up_3"},
+				DepRules:     &DepRules{AnyOf: [][][]string{{{"up_1"}, {"up_2", "up_3"}}}},
+			},
+		}
+		added, _, err := queue.AddMany(itemdefs)
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 6)
+
+		state := func(key string) ItemState {
+			item, errg := queue.Get(key)
+			So(errg, ShouldBeNil)
+			return item.Stats().State
+		}
+		So(state("onbury"), ShouldEqual, ItemStateDependent)
+		So(state("onend"), ShouldEqual, ItemStateDependent)
+		So(state("anyof"), ShouldEqual, ItemStateDependent)
+
+		reserve := func(key string) {
+			item, errr := queue.Reserve("", 0)
+			So(errr, ShouldBeNil)
+			So(item.Key, ShouldEqual, key)
+		}
+
+		Convey("Dependencies on being buried resolve on Bury(), not Remove()", func() {
+			reserve("up_1")
+			err = queue.Bury("up_1")
+			So(err, ShouldBeNil)
+			So(state("onbury"), ShouldEqual, ItemStateReady)
+			So(state("onend"), ShouldEqual, ItemStateDependent)
+			So(state("anyof"), ShouldEqual, ItemStateDependent)
+
+			reserve("up_2")
+			err = queue.Remove("up_2")
+			So(err, ShouldBeNil)
+			So(state("onend"), ShouldEqual, ItemStateReady)
+			So(state("anyof"), ShouldEqual, ItemStateDependent)
+
+			Convey("Kicking a buried item unresolves dependencies still waiting", func() {
+				_, err = queue.Add("late", "", "l", 0, 0*time.Second, 30*time.Second, "", []string{"up_1", "up_3"})
+				So(err, ShouldBeNil)
+				err = queue.SetDepRules("late", &DepRules{Conditions: map[string]DepCondition{"up_1": DepBuried}})
+				So(err, ShouldBeNil)
+				err = queue.Update("late", "", "l", 0, 0*time.Second, 30*time.Second, []string{"up_1", "up_3"})
+				So(err, ShouldBeNil)
+				item, errg := queue.Get("late")
+				So(errg, ShouldBeNil)
+				So(item.UnresolvedDependencies(), ShouldResemble, []string{"up_3"})
+
+				err = queue.Kick("up_1")
+				So(err, ShouldBeNil)
+				So(len(item.UnresolvedDependencies()), ShouldEqual, 2)
+
+				err = queue.Remove("up_3")
+				So(err, ShouldBeNil)
+				So(state("late"), ShouldEqual, ItemStateDependent)
+			})
+
+			Convey("New items depending on buried items are immediately resolved", func() {
+				item, errg := queue.Add("new", "", "n", 0, 0*time.Second, 30*time.Second, "", []string{"up_1"})
+				So(errg, ShouldBeNil)
+				So(item.Stats().State, ShouldEqual, ItemStateDependent)
+
+				_, _, err = queue.AddMany([]*ItemDef{{
+					Key:          "new2",
+					Data:         "n2",
+					TTR:          30 * time.Second,
+					Dependencies: []string{"up_1"},
+					DepRules:     &DepRules{Conditions: map[string]DepCondition{"up_1": DepBuried}},
+				}})
+				So(err, ShouldBeNil)
+				So(state("new2"), ShouldEqual, ItemStateReady)
+			})
+		})
+
+		Convey("Any one group of an AnyOf set resolves it", func() {
+			reserve("up_1")
+			err = queue.Remove("up_1")
+			So(err, ShouldBeNil)
+			So(state("anyof"), ShouldEqual, ItemStateReady)
+			So(state("onbury"), ShouldEqual, ItemStateDependent)
+			So(state("onend"), ShouldEqual, ItemStateDependent)
+		})
+
+		Convey("All of a group of an AnyOf set must be resolved", func() {
+			reserve("up_1")
+			reserve("up_2")
+			err = queue.Remove("up_2")
+			So(err, ShouldBeNil)
+			So(state("anyof"), ShouldEqual, ItemStateDependent)
+
+			reserve("up_3")
+			err = queue.Remove("up_3")
+			So(err, ShouldBeNil)
+			So(state("anyof"), ShouldEqual, ItemStateReady)
+		})
+	})
+
+	Convey("Items can depend on keys outside of the queue that you resolve yourself", t, func() {
+		queue := New("external deps queue")
+		defer qdestroy(queue)
+
+		itemdefs := []*ItemDef{
+			{Key: "local", Data: "l", TTR: 30 * time.Second},
+			{
+				Key:          "both",
+				Data:         "b",
+				TTR:          30 * time.Second,
+				Dependencies: []string{"local", "external"},
+				DepRules:     &DepRules{},
+			},
+			{
+				Key:          "external_only",
+				Data:         "e",
+				TTR:          30 * time.Second,
+				Dependencies: []string{"external"},
+				DepRules:     &DepRules{},
+			},
+		}
+		added, _, err := queue.AddMany(itemdefs)
+		So(err, ShouldBeNil)
+		So(added, ShouldEqual, 3)
+
+		state := func(key string) ItemState {
+			item, errg := queue.Get(key)
+			So(errg, ShouldBeNil)
+			return item.Stats().State
+		}
+		So(state("both"), ShouldEqual, ItemStateDependent)
+		So(state("external_only"), ShouldEqual, ItemStateDependent)
+
+		has, err := queue.HasDependents("external")
+		So(err, ShouldBeNil)
+		So(has, ShouldBeTrue)
+
+		err = queue.ResolveDependency("external", DepBuried)
+		So(err, ShouldBeNil)
+		So(state("external_only"), ShouldEqual, ItemStateDependent)
+
+		err = queue.ResolveDependency("external", DepRemoved)
+		So(err, ShouldBeNil)
+		So(state("external_only"), ShouldEqual, ItemStateReady)
+		So(state("both"), ShouldEqual, ItemStateDependent)
+
+		err = queue.UnresolveDependency("external", DepRemoved)
+		So(err, ShouldBeNil)
+
+		item, err := queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item.Key, ShouldBeIn, []string{"local", "external_only"})
+		item2, err := queue.Reserve("", 0)
+		So(err, ShouldBeNil)
+		So(item2.Key, ShouldBeIn, []string{"local", "external_only"})
+		err = queue.Remove("local")
+		So(err, ShouldBeNil)
+		So(state("both"), ShouldEqual, ItemStateDependent)
+
+		err = queue.ResolveDependency("external", DepRemoved)
+		So(err, ShouldBeNil)
+		So(state("both"), ShouldEqual, ItemStateReady)
+	})
+
 	Convey("When you add items to the queue over time, slow readyAddedCallbacks only get called once at a time", t, func() {
 		queue := New("myqueue")
 		defer qdestroy(queue)
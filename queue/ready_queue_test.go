@@ -117,6 +117,35 @@ func TestReadyQueue(t *testing.T) {
 		})
 	})
 
+	Convey("With aging, items that have been ready for longer gain priority", t, func() {
+		queue := newSubQueue(1)
+		interval := 10 * time.Millisecond
+		queue.setAgingInterval(interval)
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("low_%d", i)
+			queue.push(newItem(key, "", "data", 0, 0*time.Second, 0*time.Second))
+		}
+		<-time.After(6 * interval)
+		queue.push(newItem("high", "", "data", 3, 0*time.Second, 0*time.Second))
+		queue.push(newItem("higher", "", "data", 200, 0*time.Second, 0*time.Second))
+
+		Convey("Popping them should remove them in effective priority and then fifo order", func() {
+			expected := []string{"higher", "low_0", "low_1", "low_2", "high"}
+			for _, key := range expected {
+				So(queue.pop().Key, ShouldEqual, key)
+			}
+			So(queue.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Turning aging off reorders them by priority", func() {
+			queue.setAgingInterval(0)
+			expected := []string{"higher", "high", "low_0", "low_1", "low_2"}
+			for _, key := range expected {
+				So(queue.pop().Key, ShouldEqual, key)
+			}
+		})
+	})
+
 	Convey("Once 10 items of equal priority and 2 different ReserveGroups have been pushed to the queue", t, func() {
 		queue := newSubQueue(1)
 		items := make(map[string]*Item)
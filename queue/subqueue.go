@@ -36,6 +36,7 @@ type subQueue struct {
 	items                    []*Item
 	groupedItems             map[string][]*Item
 	sqIndex                  int
+	agingInterval            time.Duration
 	reserveGroup             string
 	pushNotificationChannels map[string]map[string]chan bool
 	log15.Logger
@@ -43,7 +44,8 @@ type subQueue struct {
 
 // create a new subQueue that can hold *Items in "priority" order. sqIndex is
 // one of 0 (priority is based on the item's delay), 1 (priority is based on the
-// item's priority or creation) or 2 (priority is based on the item's ttr).
+// item's start by time, then priority or creation) or 2 (priority is based on
+// the item's ttr).
 func newSubQueue(sqIndex int, logger ...log15.Logger) *subQueue {
 	var l log15.Logger
 	if len(logger) == 1 {
@@ -123,6 +125,10 @@ func (q *subQueue) push(item *Item) {
 	defer q.mutex.Unlock()
 	if q.sqIndex == 1 {
 		q.reserveGroup = item.ReserveGroup
+		item.mutex.Lock()
+		item.readySince = time.Now()
+		item.agingInterval = q.agingInterval
+		item.mutex.Unlock()
 	}
 	defer q.triggerNotify(q.reserveGroup)
 	heap.Push(q, item)
@@ -212,6 +218,39 @@ func (q *subQueue) update(item *Item, oldGroup ...string) {
 	heap.Fix(q, item.queueIndexes[q.sqIndex])
 }
 
+// setAgingInterval changes how long items must wait in this (ready) queue for
+// their effective priority to go up by 1, re-ordering all items to match. An
+// interval of 0 disables aging.
+func (q *subQueue) setAgingInterval(interval time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if interval < 0 {
+		interval = 0
+	}
+	q.agingInterval = interval
+	for group, itemList := range q.groupedItems {
+		for _, item := range itemList {
+			item.mutex.Lock()
+			item.agingInterval = interval
+			item.mutex.Unlock()
+		}
+		q.reserveGroup = group
+		heap.Init(q)
+	}
+}
+
+// agingKey returns the item's priority lowered by the number of aging
+// intervals between the epoch and when the item became ready. All ready items
+// age at the same rate, so comparing these keys orders items the same way as
+// comparing their current effective priorities, but without the keys changing
+// over time, which lets our heap remain valid.
+func (q *subQueue) agingKey(item *Item) int64 {
+	if q.agingInterval <= 0 {
+		return int64(item.priority)
+	}
+	return int64(item.priority) - item.readySince.UnixNano()/int64(q.agingInterval)
+}
+
 // empty clears out a queue, setting it back to its new state
 func (q *subQueue) empty() {
 	q.mutex.Lock()
@@ -246,13 +285,21 @@ func (q *subQueue) Less(i, j int) bool {
 		return q.items[i].readyAt.Before(q.items[j].readyAt)
 	case 1:
 		if itemList, existed := q.groupedItems[q.reserveGroup]; existed {
-			if itemList[i].priority == itemList[j].priority {
+			si, sj := itemList[i].startBy, itemList[j].startBy
+			if !si.Equal(sj) {
+				if si.IsZero() || sj.IsZero() {
+					return sj.IsZero()
+				}
+				return si.Before(sj)
+			}
+			ki, kj := q.agingKey(itemList[i]), q.agingKey(itemList[j])
+			if ki == kj {
 				if itemList[i].size == itemList[j].size {
 					return itemList[i].creation.Before(itemList[j].creation)
 				}
 				return itemList[i].size > itemList[j].size
 			}
-			return itemList[i].priority > itemList[j].priority
+			return ki > kj
 		}
 		return false
 	}
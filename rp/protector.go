@@ -254,6 +254,34 @@ func (p *Protector) ReleaseAfter(receipt Receipt, delay time.Duration) {
 	}
 }
 
+// Cancel is for when you no longer want the tokens of a Request() that you
+// have not yet started using. If the request is still pending it is forgotten
+// about and will never be granted (so any ongoing WaitUntilGranted() will
+// return false). If it had already been granted, this is the same as
+// Release().
+func (p *Protector) Cancel(receipt Receipt) {
+	p.mu.Lock()
+	r, found := p.requests[receipt]
+	if !found {
+		p.mu.Unlock()
+		return
+	}
+	if r.granted() {
+		p.mu.Unlock()
+		r.release()
+		return
+	}
+	defer p.mu.Unlock()
+	for i, req := range p.pending {
+		if req.id == receipt {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
+		}
+	}
+	delete(p.requests, receipt)
+	r.cancel()
+}
+
 // Shutdown will make subsequent Request(), WaitUntilGranted() and Granted()
 // calls fail. Any currently granted requests will be released. Any ungranted
 // requests will be forgotten about.
@@ -95,6 +95,23 @@ func (r *request) release() {
 	r.releaseCh <- true
 }
 
+// cancel is called to signify a pending request will never be granted. Any
+// ongoing waitUntilGranted() will return false.
+func (r *request) cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.done = true
+	if r.waiting {
+		select {
+		case r.cancelCh <- true:
+		default:
+		}
+	}
+}
+
 // grant is called to signify a request was granted.
 func (r *request) grant() {
 	r.mu.Lock()
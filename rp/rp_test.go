@@ -217,6 +217,34 @@ func TestRP(t *testing.T) {
 			So(rp.WaitUntilGranted(r2), ShouldBeFalse)
 		})
 
+		Convey("You can Cancel pending and granted requests", func() {
+			r, err := rp.Request(maxSimultaneous)
+			So(err, ShouldBeNil)
+			So(rp.WaitUntilGranted(r), ShouldBeTrue)
+
+			r2, err := rp.Request(1)
+			So(err, ShouldBeNil)
+			r3, err := rp.Request(1)
+			So(err, ShouldBeNil)
+
+			waitCh := make(chan bool, 1)
+			go func() {
+				waitCh <- rp.WaitUntilGranted(r2)
+			}()
+			<-time.After(halfDelay)
+			rp.Cancel(r2)
+			So(<-waitCh, ShouldBeFalse)
+			granted, keepChecking := rp.Granted(r2)
+			So(granted, ShouldBeFalse)
+			So(keepChecking, ShouldBeFalse)
+
+			rp.Cancel(r)
+			So(rp.WaitUntilGranted(r3), ShouldBeTrue)
+			So(time.Now(), ShouldHappenBefore, begin.Add(oneFiftyPercentDelay))
+			rp.Cancel(r3)
+			So(rp.WaitUntilGranted(r3), ShouldBeFalse)
+		})
+
 		Convey("You can request the maximum tokens in a single request", func() {
 			r, err := rp.Request(maxSimultaneous)
 			So(err, ShouldBeNil)